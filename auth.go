@@ -0,0 +1,170 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readTokens reads a file of bearer tokens, one per line, each optionally
+// followed by a client name used in logs and for rate limiting.
+// Blank lines and lines beginning with # are ignored.
+// The result maps token to client name.
+func readTokens(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tokens := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%s:%d: expected token and optional client name", file, line)
+		}
+		name := fmt.Sprintf("token%d", line)
+		if len(fields) == 2 {
+			name = fields[1]
+		}
+		tokens[fields[0]] = name
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", file)
+	}
+	return tokens, nil
+}
+
+// authenticate returns the client name for r's bearer token, or ok=false
+// if the token is missing or unknown.  Tokens are compared in constant time.
+func authenticate(tokens map[string]string, r *http.Request) (client string, ok bool) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return "", false
+	}
+	got := []byte(strings.TrimSpace(h[len("Bearer "):]))
+	for t, name := range tokens {
+		if subtle.ConstantTimeCompare(got, []byte(t)) == 1 {
+			client, ok = name, true
+		}
+	}
+	return client, ok
+}
+
+// remoteHost returns the host part of r.RemoteAddr.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// A rateLimiter is a set of token buckets, one per client, each refilled
+// at rate tokens per second up to burst.  A bucket that has refilled is
+// no different from a new one, so those of idle clients are dropped,
+// at most once every pruneInterval, rather than kept for the life of
+// the server.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time // when buckets was last pruned
+}
+
+const pruneInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// allow reports whether client may make a request now, and if not,
+// how long it should wait before trying again.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.pruned) >= pruneInterval {
+		l.prune(now)
+	}
+	b := l.buckets[client]
+	if b == nil {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// prune drops the buckets that would be full by now.  l.mu is held.
+func (l *rateLimiter) prune(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.pruned = now
+}
+
+// guard checks r against the server's tokens and rate limits.
+// If the request may not proceed, guard writes the error response
+// and returns false.  A request without a known token is charged to
+// its remote host, before it is refused, so that tokens cannot be
+// guessed faster than the rate allows.
+func (s *server) guard(w http.ResponseWriter, r *http.Request) bool {
+	client, authorized := remoteHost(r), true
+	if s.tokens != nil {
+		var name string
+		if name, authorized = authenticate(s.tokens, r); authorized {
+			client = name
+		}
+	}
+	if s.limiter != nil {
+		if ok, wait := s.limiter.allow(client, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return false
+		}
+	}
+	if !authorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sd"`)
+		http.Error(w, "missing or unknown bearer token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,490 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A chunked dSYM is the dSYM cut into chunks, each named for its
+// SHA-256, and an index that lists them in order, casync style.  Where
+// the cuts fall depends only on the bytes just before them, so an edit
+// moves no cut far from it, and the dSYM of the next release shares most
+// of its chunks with this one's: a client that keeps the chunks it has
+// fetched downloads only those that changed.
+//
+// Unless told to cut only by content, the chunker also cuts at the
+// start and end of each DWARF section of each slice, and starts the
+// rolling hash afresh there.  A section is then cut into the same chunks
+// wherever it lies, so a section identical in two slices of a universal
+// dSYM, or in two builds, as data-only sections often are, is stored
+// once, and is downloaded once, however far apart the slices are.
+//
+// The chunks are kept in a directory, as XXXX/SHA256.chunk, XXXX being
+// the first four hex digits of the hash, which any number of indexes
+// may share.  An index is written where the dSYM would have been.
+
+// chunkIndexFormat identifies a chunk index, and the version of it.
+const chunkIndexFormat = "sd-chunks/1"
+
+// Chunks are at least minChunk bytes and at most maxChunk; in between,
+// a cut falls where the rolling hash has the bits of chunkMask clear,
+// which makes the average chunk about 64KB past the minimum.
+const (
+	minChunk  = 16 << 10
+	maxChunk  = 256 << 10
+	chunkMask = 1<<16 - 1
+)
+
+// A ChunkIndex lists the chunks of a chunked dSYM.
+type ChunkIndex struct {
+	Format string   `json:"format"`
+	UUIDs  []string `json:"uuids,omitempty"` // of the dSYM, one for each slice
+	Size   int64    `json:"size"`
+	SHA256 string   `json:"sha256"` // of the whole dSYM
+	// Where the chunks are, relative to the index's directory, if
+	// written beside it; a served index has none.
+	ChunkDir string  `json:"chunk_dir,omitempty"`
+	Chunks   []Chunk `json:"chunks"`
+}
+
+// A Chunk is one chunk of a chunked dSYM.
+type Chunk struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// gear is the table of the rolling hash: each byte shifts the hash left
+// one and adds its entry, so only the last 64 bytes count.  The entries
+// are fixed, so the same contents are always cut the same way.
+var gear = func() (t [256]uint64) {
+	x := uint64(0x53446368756e6b73) // "SDchunks"
+	for i := range t {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+// cutChunks reads r to the end and calls fn with each chunk in turn,
+// cutting at each offset in cuts, which are ascending, as well as where
+// the contents say.  The slice fn is passed is reused for the next chunk.
+func cutChunks(r io.Reader, cuts []int64, fn func([]byte) error) error {
+	br := bufio.NewReaderSize(r, 1<<16)
+	buf := make([]byte, 0, maxChunk)
+	var h uint64
+	for pos := int64(0); ; pos++ {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for len(cuts) > 0 && cuts[0] <= pos {
+			if cuts[0] == pos && len(buf) > 0 {
+				if err := fn(buf); err != nil {
+					return err
+				}
+				buf, h = buf[:0], 0
+			}
+			cuts = cuts[1:]
+		}
+		buf = append(buf, c)
+		h = h<<1 + gear[c]
+		if len(buf) >= minChunk && h&chunkMask == 0 || len(buf) == maxChunk {
+			if err := fn(buf); err != nil {
+				return err
+			}
+			buf, h = buf[:0], 0
+		}
+	}
+	if len(buf) > 0 {
+		return fn(buf)
+	}
+	return nil
+}
+
+// isChunkSum reports whether s is a SHA-256 as chunks are named, in
+// lower-case hex, so that it is safe to use in a path.
+func isChunkSum(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// chunkPath returns where the chunk with SHA-256 sum is kept in dir.
+func chunkPath(dir, sum string) string {
+	return filepath.Join(dir, sum[:4], sum+".chunk")
+}
+
+// putChunk stores b, a chunk with SHA-256 sum, in dir, unless it is
+// there already.
+func putChunk(dir, sum string, b []byte) error {
+	name := chunkPath(dir, sum)
+	if _, err := os.Stat(name); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".chunk")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// sectionCuts returns, in ascending order, the offsets in the Mach-O
+// file r, thin or universal, at which each slice and each of its DWARF
+// sections starts and ends.  A file that is not Mach-O has none.
+func sectionCuts(r io.ReaderAt) []int64 {
+	var cuts []int64
+	add := func(base int64, f *macho.File) {
+		cuts = append(cuts, base)
+		for _, s := range f.Sections {
+			if s.Seg == "__DWARF" && s.Offset != 0 && s.Size != 0 {
+				cuts = append(cuts, base+int64(s.Offset), base+int64(s.Offset)+int64(s.Size))
+			}
+		}
+	}
+	if ff, err := macho.NewFatFile(r); err == nil {
+		for _, a := range ff.Arches {
+			add(int64(a.Offset), a.File)
+			cuts = append(cuts, int64(a.Offset)+int64(a.Size))
+		}
+	} else if f, err := macho.NewFile(r); err == nil {
+		add(0, f)
+	}
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i] < cuts[j] })
+	return cuts
+}
+
+// chunkFile cuts file into chunks, if bySection is set also at its
+// DWARF sections' bounds, stores in dir those not there already, and
+// returns the index of them, with no UUIDs or ChunkDir.
+func chunkFile(file, dir string, bySection bool) (*ChunkIndex, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cuts []int64
+	if bySection {
+		cuts = sectionCuts(f)
+	}
+	ix := &ChunkIndex{Format: chunkIndexFormat}
+	whole := sha256.New()
+	err = cutChunks(io.TeeReader(f, whole), cuts, func(b []byte) error {
+		s := sha256.Sum256(b)
+		sum := hex.EncodeToString(s[:])
+		ix.Chunks = append(ix.Chunks, Chunk{SHA256: sum, Size: int64(len(b))})
+		ix.Size += int64(len(b))
+		return putChunk(dir, sum, b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	ix.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	return ix, nil
+}
+
+// writeChunked writes d as a chunked dSYM: its chunks into dir, and
+// the index of them into outdwarf.  Unless contentOnly is set, chunks
+// are also cut at its DWARF sections' bounds, to share them.
+func writeChunked(d interface {
+	writeFile(name string, perm os.FileMode) error
+}, outdwarf, dir string, contentOnly bool) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".dsym")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := d.writeFile(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	ix, err := chunkFile(tmp.Name(), dir, !contentOnly)
+	if err != nil {
+		return err
+	}
+	ix.UUIDs = fileUUIDs(tmp.Name())
+	if abs, err := filepath.Abs(filepath.Dir(outdwarf)); err == nil {
+		ix.ChunkDir = relativeTo(abs, dir)
+	}
+	return ix.write(outdwarf)
+}
+
+// fileUUIDs returns the UUIDs of the Mach-O file named name, thin or
+// universal, one for each slice that has one.
+func fileUUIDs(name string) []string {
+	var uuids []string
+	if ff, err := macho.OpenFat(name); err == nil {
+		for _, a := range ff.Arches {
+			if u := uuidOf(a.File); u != "" {
+				uuids = append(uuids, u)
+			}
+		}
+		ff.Close()
+	} else if f, err := macho.Open(name); err == nil {
+		if u := uuidOf(f); u != "" {
+			uuids = append(uuids, u)
+		}
+		f.Close()
+	}
+	return uuids
+}
+
+func (ix *ChunkIndex) write(file string) error {
+	b, err := json.MarshalIndent(ix, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(b, '\n'), 0644)
+}
+
+// readChunkIndex reads the chunk index in file.  Anything else, such as
+// a Mach-O file, is an error, and found so without reading all of it.
+func readChunkIndex(file string) (*ChunkIndex, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeChunkIndex(f)
+}
+
+func decodeChunkIndex(r io.Reader) (*ChunkIndex, error) {
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(1); err != nil || b[0] != '{' {
+		return nil, fmt.Errorf("not a chunk index")
+	}
+	ix := new(ChunkIndex)
+	if err := json.NewDecoder(br).Decode(ix); err != nil {
+		return nil, fmt.Errorf("not a chunk index: %v", err)
+	}
+	if ix.Format != chunkIndexFormat {
+		return nil, fmt.Errorf("not a chunk index: format %q", ix.Format)
+	}
+	for _, c := range ix.Chunks {
+		if !isChunkSum(c.SHA256) {
+			return nil, fmt.Errorf("chunk index: malformed chunk %q", c.SHA256)
+		}
+	}
+	return ix, nil
+}
+
+// chunkDir returns the directory of the chunks of the index in file.
+func (ix *ChunkIndex) chunkDir(file string) string {
+	if filepath.IsAbs(ix.ChunkDir) {
+		return ix.ChunkDir
+	}
+	return filepath.Join(filepath.Dir(file), ix.ChunkDir)
+}
+
+// readChunk returns the chunk c from dir, checked against its hash.
+func readChunk(dir string, c Chunk) ([]byte, error) {
+	b, err := ioutil.ReadFile(chunkPath(dir, c.SHA256))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkChunk(c, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func checkChunk(c Chunk, b []byte) error {
+	s := sha256.Sum256(b)
+	if int64(len(b)) != c.Size || hex.EncodeToString(s[:]) != c.SHA256 {
+		return fmt.Errorf("chunk %s is corrupt", c.SHA256)
+	}
+	return nil
+}
+
+// writeTo writes the dSYM ix lists to w, getting each chunk from get,
+// and checks it against the index.
+func (ix *ChunkIndex) writeTo(w io.Writer, get func(Chunk) ([]byte, error)) error {
+	whole := sha256.New()
+	var size int64
+	for _, c := range ix.Chunks {
+		b, err := get(c)
+		if err != nil {
+			return err
+		}
+		whole.Write(b)
+		size += int64(len(b))
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	if size != ix.Size || hex.EncodeToString(whole.Sum(nil)) != ix.SHA256 {
+		return fmt.Errorf("reassembled %d bytes do not match the index", size)
+	}
+	return nil
+}
+
+// reassemble writes the dSYM ix lists into file, getting each chunk
+// from get.  Nothing is left at file unless all of it checks out.
+func (ix *ChunkIndex) reassemble(file string, get func(Chunk) ([]byte, error)) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".sd")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(tmp)
+	err = ix.writeTo(bw, get)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// fetchChunked asks the sd server at url for the chunk index of uuid
+// and, if it has one, reassembles the dSYM into file, fetching only the
+// chunks not already in cache, and keeping those it fetches there.
+func fetchChunked(url, uuid, file, cache string) (bool, error) {
+	url = strings.TrimSuffix(url, "/")
+	id := strings.ToLower(strings.Replace(uuid, "-", "", -1))
+	resp, err := http.Get(url + "/buildid/" + id + "/chunks")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+	ix, err := decodeChunkIndex(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	fetched, size := 0, int64(0)
+	err = ix.reassemble(file, func(c Chunk) ([]byte, error) {
+		if b, err := readChunk(cache, c); err == nil {
+			return b, nil
+		}
+		b, err := fetchChunk(url, c)
+		if err != nil {
+			return nil, err
+		}
+		fetched++
+		size += c.Size
+		return b, putChunk(cache, c.SHA256, b)
+	})
+	if err != nil {
+		return false, err
+	}
+	note("fetched %d of %d chunks, %d of %d bytes", fetched, len(ix.Chunks), size, ix.Size)
+	return true, nil
+}
+
+func fetchChunk(url string, c Chunk) ([]byte, error) {
+	resp, err := http.Get(url + "/chunks/" + c.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("chunk %s: %s", c.SHA256, resp.Status)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(resp.Body, c.Size+1)); err != nil {
+		return nil, err
+	}
+	if err := checkChunk(c, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pruneChunks removes the chunks in dir that no index of entries lists,
+// or with dryRun, only counts them, and returns how many there are.
+// Chunks are taken to be listed only by indexes in the same store.
+func pruneChunks(dir string, entries []*storeEntry, dryRun bool) (int, error) {
+	listed := make(map[string]bool)
+	for _, e := range entries {
+		if !e.chunked {
+			continue
+		}
+		for _, file := range e.files {
+			ix, err := readChunkIndex(file)
+			if err != nil {
+				continue
+			}
+			for _, c := range ix.Chunks {
+				listed[c.SHA256] = true
+			}
+		}
+	}
+	pruned := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		sum := strings.TrimSuffix(info.Name(), ".chunk")
+		if !info.Mode().IsRegular() || sum == info.Name() || !isChunkSum(sum) || listed[sum] {
+			return nil
+		}
+		pruned++
+		if dryRun {
+			return nil
+		}
+		return os.Remove(path)
+	})
+	return pruned, err
+}
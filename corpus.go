@@ -0,0 +1,289 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+// "sd corpus-check" qualifies sd against a corpus of binaries, such as
+// every program a team ships: it reads each Mach-O file under the
+// directories it is given, checks that its table of contents is
+// consistent, and with -split, splits each slice that has DWARF into a
+// dSYM it discards, and then reports how many of what it found, and
+// each file that failed.  A failure is never fatal; the walk goes on.
+
+// corpusStats are what corpus-check found, and what failed.
+type corpusStats struct {
+	files     int            // regular files seen
+	machos    int            // of them, Mach-O files
+	universal int            // of those, universal
+	slices    int            // thin files, and slices of universal ones
+	bytes     int64          // the size of the Mach-O files
+	types     map[string]int // slices, by file type
+	arches    map[string]int // slices, by architecture
+	split     int            // slices split
+	noDwarf   int            // slices that could have been split, but have no DWARF
+	dsymBytes int64          // the size of the dSYMs the splits made
+	failures  []corpusFailure
+}
+
+// A corpusFailure is a file, or slice of one, that did not pass a stage
+// of corpus-check: read, parse, validate, or split.
+type corpusFailure struct {
+	path, slice, stage string
+	err                error
+}
+
+func (f corpusFailure) String() string {
+	if f.slice != "" {
+		return fmt.Sprintf("%s (%s): %s: %v", f.path, f.slice, f.stage, f.err)
+	}
+	return fmt.Sprintf("%s: %s: %v", f.path, f.stage, f.err)
+}
+
+// sd corpus-check [ -split ] [ -v ] [ split flags ] dir ...
+func corpusCheck(args []string) {
+	var opts splitOptions
+	fs := flag.NewFlagSet("corpus-check", flag.ExitOnError)
+	split := fs.Bool("split", false, "also split, with the flags below, each executable, dylib, or bundle slice that has DWARF,\n"+
+		"writing the dSYM nowhere")
+	verbose := fs.Bool("v", false, "print each Mach-O file as it is checked")
+	splitFlags(fs, &opts)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s corpus-check [ -split ] [ -v ] [ flags ] dir ...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if opts.arch != "" {
+		fail("corpus-check splits every slice; -arch does not apply")
+	}
+	opts.transforms = macho.SectionTransforms()
+	var o io.Writer
+	if *verbose {
+		o = os.Stdout
+	}
+	start := time.Now()
+	st := &corpusStats{types: make(map[string]int), arches: make(map[string]int)}
+	for _, dir := range fs.Args() {
+		if err := st.walk(dir, *split, &opts, o); err != nil {
+			fail("%v", err)
+		}
+	}
+	st.report(os.Stdout, time.Since(start))
+	if len(st.failures) > 0 {
+		os.Exit(1)
+	}
+}
+
+// walk checks each Mach-O file under dir, as described above, noting
+// each in o if it is not nil.  It returns an error only if dir cannot
+// be walked; a file that cannot be read is a failure of it.
+func (st *corpusStats) walk(dir string, split bool, opts *splitOptions, o io.Writer) error {
+	seen := make(map[int64][]os.FileInfo) // by size, to find hard links
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			st.failures = append(st.failures, corpusFailure{path: path, stage: "read", err: err})
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		for _, fi := range seen[info.Size()] {
+			if os.SameFile(fi, info) {
+				return nil
+			}
+		}
+		seen[info.Size()] = append(seen[info.Size()], info)
+		st.files++
+		st.check(path, info.Size(), split, opts, o)
+		return nil
+	})
+}
+
+// check checks the file path, of size bytes, if it is Mach-O.
+func (st *corpusStats) check(path string, size int64, split bool, opts *splitOptions, o io.Writer) {
+	f, err := os.Open(path)
+	if err != nil {
+		st.failures = append(st.failures, corpusFailure{path: path, stage: "read", err: err})
+		return
+	}
+	defer f.Close()
+	if !isMachO(f) {
+		return
+	}
+	st.machos++
+	st.bytes += size
+	if o != nil {
+		fmt.Fprintln(o, path)
+	}
+	opts.supDir = filepath.Dir(path)
+	if !isFat(f) {
+		var exem *macho.File
+		err := recovered(func() (err error) {
+			exem, err = macho.NewFile(f)
+			return err
+		})
+		if err != nil {
+			st.failures = append(st.failures, corpusFailure{path: path, stage: "parse", err: err})
+			return
+		}
+		st.checkSlice(path, "", exem, split, opts)
+		return
+	}
+	st.universal++
+	var ff *macho.FatFile
+	err = recovered(func() (err error) {
+		ff, err = macho.NewFatFile(f)
+		return err
+	})
+	if err != nil {
+		st.failures = append(st.failures, corpusFailure{path: path, stage: "parse", err: err})
+		return
+	}
+	for _, a := range ff.Arches {
+		st.checkSlice(path, archName(a.Cpu, a.SubCpu), a.File, split, opts)
+	}
+}
+
+// checkSlice checks exem, the file path, or if slice is not "", that
+// slice of it.
+func (st *corpusStats) checkSlice(path, slice string, exem *macho.File, split bool, opts *splitOptions) {
+	st.slices++
+	st.types[exem.Type.String()]++
+	st.arches[archName(exem.Cpu, exem.SubCpu)]++
+	if err := exem.FileTOC.Validate(); err != nil {
+		st.failures = append(st.failures, corpusFailure{path: path, slice: slice, stage: "validate", err: err})
+		return
+	}
+	if !split {
+		return
+	}
+	switch exem.Type {
+	case macho.MhExecute, macho.MhDylib, macho.MhBundle:
+	default:
+		return // a dSYM, an object file, ...: nothing to split
+	}
+	if exem.Segment("__DWARF") == nil && !opts.symbolsOnly {
+		st.noDwarf++
+		return
+	}
+	n, err := dryRunSplit(exem, opts)
+	if err != nil {
+		st.failures = append(st.failures, corpusFailure{path: path, slice: slice, stage: "split", err: err})
+		return
+	}
+	st.split++
+	st.dsymBytes += n
+}
+
+// dryRunSplit splits exem as opts say, writing the dSYM nowhere, and
+// returns its size.  Every byte of it is made, so that a section that
+// cannot be read, or inflated, or transformed, fails the split.
+func dryRunSplit(exem *macho.File, opts *splitOptions) (n int64, err error) {
+	err = recovered(func() error {
+		d, err := splitDwarf(exem, opts)
+		if err == nil {
+			n, err = d.WriteTo(ioutil.Discard)
+		}
+		return err
+	})
+	return n, err
+}
+
+// recovered calls parse, reporting a panic, which malformed input
+// should never cause, as an error: a bug in sd, with where it was, so
+// that the walk goes on and the corpus yields every one of them.
+func recovered(parse func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("sd panicked, a bug: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return parse()
+}
+
+// isMachO reports whether r begins as a Mach-O file does, thin, in
+// either byte order, or universal.  A Java class file begins with the
+// same magic number as a universal file, but where a universal file
+// has its (few) slices, has its version, 45 or more, and is not one.
+func isMachO(r io.ReaderAt) bool {
+	var b [8]byte
+	if _, err := r.ReadAt(b[:], 0); err != nil {
+		return false
+	}
+	if binary.BigEndian.Uint32(b[:]) == macho.MagicFat {
+		return binary.BigEndian.Uint32(b[4:]) < 45
+	}
+	for _, o := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		if m := o.Uint32(b[:]); m == macho.Magic32 || m == macho.Magic64 {
+			return true
+		}
+	}
+	return false
+}
+
+// report writes st, and how long the check took, to w.
+func (st *corpusStats) report(w io.Writer, took time.Duration) {
+	fmt.Fprintf(w, "%d files, %d Mach-O (%d universal), %d bytes, %d slices, checked in %v\n",
+		st.files, st.machos, st.universal, st.bytes, st.slices, took.Round(time.Millisecond))
+	fmt.Fprintf(w, "types: %s\n", countsString(st.types))
+	fmt.Fprintf(w, "architectures: %s\n", countsString(st.arches))
+	if st.split > 0 || st.noDwarf > 0 {
+		fmt.Fprintf(w, "split: %d slices into %d bytes of dSYM; %d without DWARF\n", st.split, st.dsymBytes, st.noDwarf)
+	}
+	stages := make(map[string]int)
+	for _, f := range st.failures {
+		stages[f.stage]++
+	}
+	fmt.Fprintf(w, "%d failed", len(st.failures))
+	if len(stages) > 0 {
+		fmt.Fprintf(w, " (%s)", countsString(stages))
+	}
+	fmt.Fprintln(w)
+	for _, f := range st.failures {
+		fmt.Fprintf(w, "failed: %v\n", f)
+	}
+}
+
+// countsString returns counts as "name n, ...", most first.
+func countsString(counts map[string]int) string {
+	if len(counts) == 0 {
+		return "none"
+	}
+	var names []string
+	for k := range counts {
+		names = append(names, k)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	var s []string
+	for _, k := range names {
+		s = append(s, fmt.Sprintf("%s %d", k, counts[k]))
+	}
+	return strings.Join(s, ", ")
+}
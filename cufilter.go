@@ -0,0 +1,775 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A cuFilter selects compile units by DW_AT_name.  A unit is kept if it
+// matches some include pattern (or there are none) and no exclude
+// pattern.  Patterns are as for path.Match, except that one ending in
+// "/..." also matches everything below that path, as in go list.
+// A unit whose name cannot be read (DWARF 5 string offsets are not
+// followed) is treated as having the empty name.
+type cuFilter struct {
+	include, exclude []string
+}
+
+func (f *cuFilter) addInclude(p string) error { return f.add(&f.include, p) }
+func (f *cuFilter) addExclude(p string) error { return f.add(&f.exclude, p) }
+
+func (f *cuFilter) add(list *[]string, p string) error {
+	if err := checkPattern(p); err != nil {
+		return fmt.Errorf("bad compile unit pattern %q: %v", p, err)
+	}
+	*list = append(*list, p)
+	return nil
+}
+
+func (f *cuFilter) keep(name string) bool {
+	return (len(f.include) == 0 || matchPatterns(f.include, name)) && !matchPatterns(f.exclude, name)
+}
+
+// String returns the flags that give f's patterns, for messages.
+func (f *cuFilter) String() string {
+	var flags []string
+	for _, p := range f.include {
+		flags = append(flags, fmt.Sprintf("-include-cu %q", p))
+	}
+	for _, p := range f.exclude {
+		flags = append(flags, fmt.Sprintf("-exclude-cu %q", p))
+	}
+	return strings.Join(flags, " ")
+}
+
+// checkPattern reports whether p is a well-formed pattern for matchPatterns.
+func checkPattern(p string) error {
+	_, err := path.Match(strings.TrimSuffix(p, "/..."), "")
+	return err
+}
+
+// matchPatterns reports whether name matches one of patterns, as for
+// path.Match, except that a pattern ending in "/..." also matches
+// everything below the path it names.
+func matchPatterns(patterns []string, name string) bool {
+	for _, p := range patterns {
+		prefix := strings.TrimSuffix(p, "/...")
+		if prefix == p {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+			continue
+		}
+		// name, or any directory above it.
+		for n := name; ; {
+			if ok, _ := path.Match(prefix, n); ok {
+				return true
+			}
+			i := strings.LastIndex(n, "/")
+			if i < 0 {
+				break
+			}
+			n = n[:i]
+		}
+	}
+	return false
+}
+
+// A sectionEdit replaces the contents of a DWARF section, or drops it.
+type sectionEdit struct {
+	data []byte
+	drop bool
+}
+
+// A compUnit is a compile unit found in __debug_info.
+type compUnit struct {
+	name       string
+	start, end uint64   // extent within __debug_info, including the header
+	refs       []dieRef // DW_FORM_ref_addr values within the unit
+	stmtList   *dieRef  // DW_AT_stmt_list of the unit's DIE
+	keep       bool
+	newStart   uint64
+}
+
+// A dieRef is an offset-valued attribute found in __debug_info.
+type dieRef struct {
+	at, size uint64 // where in __debug_info the value is stored
+	value    uint64
+}
+
+// dwarfSectionsByName returns the sections of exem's __DWARF segment,
+// keyed by name without the leading "__" or "__z", and for DWARF
+// sections, with any truncation undone: "debug_str_offsets".  Of a
+// section the input has twice, it returns the copy the dSYM keeps.
+func dwarfSectionsByName(exem *macho.File) map[string]*macho.Section {
+	sections, _ := dedupDWARFSections(exem)
+	return sections
+}
+
+// editedData returns the contents of s after edits, nil if s is nil or
+// dropped.
+func editedData(edits map[*macho.Section]sectionEdit, s *macho.Section) ([]byte, error) {
+	if s == nil {
+		return nil, nil
+	}
+	if e, ok := edits[s]; ok {
+		return e.data, nil
+	}
+	return s.UncompressedData()
+}
+
+// dropAccelerators drops the accelerator tables, which index DIEs by
+// offset and cannot be patched.
+func dropAccelerators(sections map[string]*macho.Section, edits map[*macho.Section]sectionEdit) {
+	for name, s := range sections {
+		if strings.HasPrefix(name, "apple_") || name == "debug_names" {
+			edits[s] = sectionEdit{drop: true}
+		}
+	}
+}
+
+// filterCompileUnits adds to edits the changes to the DWARF sections of
+// exem needed to write only the compile units f keeps.  Units referred
+// to by a kept unit's DW_FORM_ref_addr attributes are kept too, so that
+// (for instance) Go's shared type information survives.  __debug_info,
+// __debug_line, __debug_aranges, and __debug_pub{names,types} are
+// rewritten, and the accelerator tables dropped.  Other sections are
+// left alone.  If f keeps no unit at all, that is an error.
+func filterCompileUnits(exem *macho.File, f *cuFilter, edits map[*macho.Section]sectionEdit) error {
+	sections := dwarfSectionsByName(exem)
+	data := func(name string) ([]byte, error) {
+		return editedData(edits, sections[name])
+	}
+	info, err := data("debug_info")
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return nil
+	}
+	abbrev, err := data("debug_abbrev")
+	if err != nil {
+		return err
+	}
+	str, err := data("debug_str")
+	if err != nil {
+		return err
+	}
+	o := exem.ByteOrder
+
+	cus, err := compileUnits(info, abbrev, str, o)
+	if err != nil {
+		return err
+	}
+	unitAt := func(off uint64) int {
+		i := sort.Search(len(cus), func(i int) bool { return cus[i].end > off })
+		if i == len(cus) || off < cus[i].start {
+			return -1
+		}
+		return i
+	}
+	var work []int
+	for i := range cus {
+		if f.keep(cus[i].name) {
+			cus[i].keep = true
+			work = append(work, i)
+		}
+	}
+	if len(work) == 0 && len(cus) > 0 {
+		return fmt.Errorf("no compile unit is kept by %v; the dSYM would hold no debugging information", f)
+	}
+	for len(work) > 0 {
+		cu := &cus[work[len(work)-1]]
+		work = work[:len(work)-1]
+		for _, r := range cu.refs {
+			j := unitAt(r.value)
+			if j < 0 {
+				return fmt.Errorf("compile unit %s refers to offset %#x, outside every unit", cu.name, r.value)
+			}
+			if !cus[j].keep {
+				cus[j].keep = true
+				work = append(work, j)
+			}
+		}
+	}
+
+	var newInfo []byte
+	for i := range cus {
+		cu := &cus[i]
+		if cu.keep {
+			cu.newStart = uint64(len(newInfo))
+			newInfo = append(newInfo, info[cu.start:cu.end]...)
+		}
+	}
+	for i := range cus {
+		cu := &cus[i]
+		if !cu.keep {
+			continue
+		}
+		for _, r := range cu.refs {
+			t := &cus[unitAt(r.value)]
+			putOffset(newInfo[r.at-cu.start+cu.newStart:], r.size, r.value-t.start+t.newStart, o)
+		}
+	}
+	infoOffset := func(old uint64) (uint64, bool) {
+		if j := unitAt(old); j >= 0 && cus[j].start == old && cus[j].keep {
+			return cus[j].newStart, true
+		}
+		return 0, false
+	}
+
+	if line, err := data("debug_line"); err != nil {
+		return err
+	} else if line != nil {
+		if newLine, ok := filterLine(line, cus, o); ok {
+			for i := range cus {
+				if r := cus[i].stmtList; cus[i].keep && r != nil {
+					putOffset(newInfo[r.at-cus[i].start+cus[i].newStart:], r.size, r.value, o)
+				}
+			}
+			edits[sections["debug_line"]] = sectionEdit{data: newLine}
+		}
+	}
+	edits[sections["debug_info"]] = sectionEdit{data: newInfo}
+	dropAccelerators(sections, edits)
+
+	for _, name := range []string{"debug_aranges", "debug_pubnames", "debug_pubtypes"} {
+		b, err := data(name)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			continue
+		}
+		nb, err := filterInfoIndexed(b, infoOffset, o)
+		if err != nil {
+			return fmt.Errorf("__%s: %v", name, err)
+		}
+		edits[sections[name]] = sectionEdit{data: nb}
+	}
+	return nil
+}
+
+// filterLine returns __debug_line with only the line programs that kept
+// units use, updating those units' stmtList values to match.  It
+// reports false, leaving everything alone, if some unit's
+// DW_AT_stmt_list does not name the start of a line program.
+func filterLine(line []byte, cus []compUnit, o binary.ByteOrder) ([]byte, bool) {
+	type program struct {
+		start, end uint64
+		used       bool
+		newStart   uint64
+	}
+	var progs []program
+	for off := uint64(0); off < uint64(len(line)); {
+		_, end, err := unitExtent(line, off, o)
+		if err != nil {
+			return nil, false
+		}
+		progs = append(progs, program{start: off, end: end})
+		off = end
+	}
+	find := func(off uint64) int {
+		i := sort.Search(len(progs), func(i int) bool { return progs[i].start >= off })
+		if i == len(progs) || progs[i].start != off {
+			return -1
+		}
+		return i
+	}
+	for i := range cus {
+		if r := cus[i].stmtList; r != nil {
+			j := find(r.value)
+			if j < 0 {
+				return nil, false
+			}
+			if cus[i].keep {
+				progs[j].used = true
+			}
+		}
+	}
+	var out []byte
+	for i := range progs {
+		if progs[i].used {
+			progs[i].newStart = uint64(len(out))
+			out = append(out, line[progs[i].start:progs[i].end]...)
+		}
+	}
+	for i := range cus {
+		if r := cus[i].stmtList; r != nil && cus[i].keep {
+			r.value = progs[find(r.value)].newStart
+		}
+	}
+	return out, true
+}
+
+// filterInfoIndexed filters a section made of sets that each begin
+// with a version and a __debug_info offset (__debug_aranges,
+// __debug_pubnames, and __debug_pubtypes), keeping the sets for which
+// infoOffset gives a new offset, and updating it.
+func filterInfoIndexed(b []byte, infoOffset func(uint64) (uint64, bool), o binary.ByteOrder) ([]byte, error) {
+	var out []byte
+	for off := uint64(0); off < uint64(len(b)); {
+		hdr, end, err := unitExtent(b, off, o)
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(4)
+		if hdr-off == 12 {
+			size = 8
+		}
+		if end-hdr < 2+size {
+			return nil, fmt.Errorf("set at %#x is too short", off)
+		}
+		at := hdr + 2
+		if n, ok := infoOffset(getOffset(b[at:], size, o)); ok {
+			start := uint64(len(out))
+			out = append(out, b[off:end]...)
+			putOffset(out[start+at-off:], size, n, o)
+		}
+		off = end
+	}
+	return out, nil
+}
+
+// unitExtent reads the initial length of the unit at off in b, and
+// returns the offset just past it and the end of the unit.
+func unitExtent(b []byte, off uint64, o binary.ByteOrder) (hdr, end uint64, err error) {
+	if uint64(len(b))-off < 4 {
+		return 0, 0, fmt.Errorf("truncated unit at %#x", off)
+	}
+	length, hdr := uint64(o.Uint32(b[off:])), off+4
+	if length == 0xffffffff {
+		if uint64(len(b))-hdr < 8 {
+			return 0, 0, fmt.Errorf("truncated unit at %#x", off)
+		}
+		length, hdr = o.Uint64(b[hdr:]), hdr+8
+	}
+	if length > uint64(len(b))-hdr {
+		return 0, 0, fmt.Errorf("unit at %#x claims %d bytes, only %d remain", off, length, uint64(len(b))-hdr)
+	}
+	return hdr, hdr + length, nil
+}
+
+func getOffset(b []byte, size uint64, o binary.ByteOrder) uint64 {
+	switch size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(o.Uint16(b))
+	case 4:
+		return uint64(o.Uint32(b))
+	}
+	return o.Uint64(b)
+}
+
+func putOffset(b []byte, size, v uint64, o binary.ByteOrder) {
+	switch size {
+	case 1:
+		b[0] = byte(v)
+	case 2:
+		o.PutUint16(b, uint16(v))
+	case 4:
+		o.PutUint32(b, uint32(v))
+	default:
+		o.PutUint64(b, v)
+	}
+}
+
+// DWARF constants used in walking __debug_info.
+const (
+	dwAtName     = 0x03
+	dwAtStmtList = 0x10
+
+	dwFormAddr          = 0x01
+	dwFormBlock2        = 0x03
+	dwFormBlock4        = 0x04
+	dwFormData2         = 0x05
+	dwFormData4         = 0x06
+	dwFormData8         = 0x07
+	dwFormString        = 0x08
+	dwFormBlock         = 0x09
+	dwFormBlock1        = 0x0a
+	dwFormData1         = 0x0b
+	dwFormFlag          = 0x0c
+	dwFormSdata         = 0x0d
+	dwFormStrp          = 0x0e
+	dwFormUdata         = 0x0f
+	dwFormRefAddr       = 0x10
+	dwFormRef1          = 0x11
+	dwFormRef2          = 0x12
+	dwFormRef4          = 0x13
+	dwFormRef8          = 0x14
+	dwFormRefUdata      = 0x15
+	dwFormIndirect      = 0x16
+	dwFormSecOffset     = 0x17
+	dwFormExprloc       = 0x18
+	dwFormFlagPresent   = 0x19
+	dwFormStrx          = 0x1a
+	dwFormAddrx         = 0x1b
+	dwFormRefSup4       = 0x1c
+	dwFormStrpSup       = 0x1d
+	dwFormData16        = 0x1e
+	dwFormLineStrp      = 0x1f
+	dwFormRefSig8       = 0x20
+	dwFormImplicitConst = 0x21
+	dwFormLoclistx      = 0x22
+	dwFormRnglistx      = 0x23
+	dwFormRefSup8       = 0x24
+	dwFormStrx1         = 0x25
+	dwFormStrx4         = 0x28
+	dwFormAddrx1        = 0x29
+	dwFormAddrx4        = 0x2c
+	dwFormGNUAddrIndex  = 0x1f01
+	dwFormGNUStrIndex   = 0x1f02
+	dwFormGNURefAlt     = 0x1f20
+	dwFormGNUStrpAlt    = 0x1f21
+
+	dwUtCompile = 0x01
+	dwUtPartial = 0x03
+)
+
+type abbrevAttr struct {
+	attr, form uint64
+}
+
+type abbrev struct {
+	tag      uint64
+	children bool
+	attrs    []abbrevAttr
+}
+
+// A dwarfBuf reads DWARF encodings from a byte slice, recording the
+// first error and returning zeros after it.
+type dwarfBuf struct {
+	b   []byte
+	off uint64
+	o   binary.ByteOrder
+	err error
+}
+
+func (d *dwarfBuf) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("at %#x: %s", d.off, fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *dwarfBuf) bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.b))-d.off {
+		d.fail("%d bytes past the end", n)
+		return nil
+	}
+	b := d.b[d.off : d.off+n]
+	d.off += n
+	return b
+}
+
+func (d *dwarfBuf) uint(n uint64) uint64 {
+	b := d.bytes(n)
+	if b == nil {
+		return 0
+	}
+	return getOffset(b, n, d.o)
+}
+
+func (d *dwarfBuf) uleb() uint64 {
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		b := d.bytes(1)
+		if b == nil {
+			return 0
+		}
+		if shift < 64 {
+			v |= uint64(b[0]&0x7f) << shift
+		}
+		if b[0]&0x80 == 0 {
+			return v
+		}
+	}
+}
+
+func (d *dwarfBuf) sleb() int64 {
+	var v int64
+	for shift := uint(0); ; shift += 7 {
+		b := d.bytes(1)
+		if b == nil {
+			return 0
+		}
+		if shift < 64 {
+			v |= int64(b[0]&0x7f) << shift
+		}
+		if b[0]&0x80 == 0 {
+			if shift+7 < 64 && b[0]&0x40 != 0 {
+				v |= -1 << (shift + 7)
+			}
+			return v
+		}
+	}
+}
+
+func (d *dwarfBuf) cstring() string {
+	if d.err != nil {
+		return ""
+	}
+	for i := d.off; i < uint64(len(d.b)); i++ {
+		if d.b[i] == 0 {
+			s := string(d.b[d.off:i])
+			d.off = i + 1
+			return s
+		}
+	}
+	d.fail("unterminated string")
+	return ""
+}
+
+// abbrevTable parses the abbreviations starting at off in b.
+func abbrevTable(b []byte, off uint64, o binary.ByteOrder) (map[uint64]*abbrev, error) {
+	d := &dwarfBuf{b: b, off: off, o: o}
+	if off > uint64(len(b)) {
+		return nil, fmt.Errorf("abbreviation offset %#x is past the end of __debug_abbrev", off)
+	}
+	table := make(map[uint64]*abbrev)
+	for d.err == nil {
+		code := d.uleb()
+		if code == 0 {
+			break
+		}
+		a := &abbrev{tag: d.uleb()}
+		a.children = d.uint(1) != 0
+		for d.err == nil {
+			attr, form := d.uleb(), d.uleb()
+			if attr == 0 && form == 0 {
+				break
+			}
+			if form == dwFormImplicitConst {
+				d.uleb() // the constant, a signed LEB128; skipping it is the same
+			}
+			a.attrs = append(a.attrs, abbrevAttr{attr, form})
+		}
+		table[code] = a
+	}
+	return table, d.err
+}
+
+// A unitHeader is the header of a unit in __debug_info.
+type unitHeader struct {
+	start, end uint64 // extent, including the header
+	dies       uint64 // where the first DIE starts
+	version    uint64
+	offSize    uint64 // 4, or 8 for 64-bit DWARF
+	addrSize   uint64
+	abbrevOff  uint64 // of the unit's table in __debug_abbrev
+	abbrevs    map[uint64]*abbrev
+}
+
+// unitHeaders reads the headers of the units in __debug_info, and
+// their abbreviation tables.
+func unitHeaders(info, abbrevs []byte, o binary.ByteOrder) ([]unitHeader, error) {
+	var units []unitHeader
+	tables := make(map[uint64]map[uint64]*abbrev)
+	for off := uint64(0); off < uint64(len(info)); {
+		hdr, end, err := unitExtent(info, off, o)
+		if err != nil {
+			return nil, fmt.Errorf("__debug_info: %v", err)
+		}
+		u := unitHeader{start: off, end: end, offSize: 4}
+		if hdr-off == 12 {
+			u.offSize = 8
+		}
+		d := &dwarfBuf{b: info[:end], off: hdr, o: o}
+		u.version = d.uint(2)
+		switch {
+		case u.version >= 2 && u.version <= 4:
+			u.abbrevOff, u.addrSize = d.uint(u.offSize), d.uint(1)
+		case u.version == 5:
+			ut := d.uint(1)
+			u.addrSize, u.abbrevOff = d.uint(1), d.uint(u.offSize)
+			if ut != dwUtCompile && ut != dwUtPartial {
+				return nil, fmt.Errorf("__debug_info: unit at %#x has unsupported type %#x", off, ut)
+			}
+		default:
+			return nil, fmt.Errorf("__debug_info: unit at %#x has unsupported version %d", off, u.version)
+		}
+		if d.err != nil {
+			return nil, fmt.Errorf("__debug_info: unit at %#x: %v", off, d.err)
+		}
+		u.dies = d.off
+		if u.abbrevs = tables[u.abbrevOff]; u.abbrevs == nil {
+			if u.abbrevs, err = abbrevTable(abbrevs, u.abbrevOff, o); err != nil {
+				return nil, fmt.Errorf("__debug_abbrev: %v", err)
+			}
+			tables[u.abbrevOff] = u.abbrevs
+		}
+		units = append(units, u)
+		off = end
+	}
+	return units, nil
+}
+
+// An attrValue is an attribute of a DIE.  Values of 1, 2, 4, or 8
+// bytes, and LEB128 values, are decoded into val; pos and size say
+// where a value other than a string or block is.
+type attrValue struct {
+	abbrevAttr
+	pos, size uint64
+	leb       bool
+	val       uint64
+	str       string // for DW_FORM_string
+}
+
+// attr reads the value of a DIE's attribute a, in unit u.
+func (d *dwarfBuf) attr(a abbrevAttr, u *unitHeader) attrValue {
+	v := attrValue{abbrevAttr: a}
+	for v.form == dwFormIndirect {
+		v.form = d.uleb()
+	}
+	switch v.form {
+	case dwFormAddr:
+		v.size = u.addrSize
+	case dwFormData1, dwFormRef1, dwFormFlag, dwFormStrx1, dwFormAddrx1:
+		v.size = 1
+	case dwFormData2, dwFormRef2, dwFormStrx1 + 1, dwFormAddrx1 + 1:
+		v.size = 2
+	case dwFormStrx1 + 2, dwFormAddrx1 + 2:
+		v.size = 3
+	case dwFormData4, dwFormRef4, dwFormRefSup4, dwFormStrx4, dwFormAddrx4:
+		v.size = 4
+	case dwFormData8, dwFormRef8, dwFormRefSig8, dwFormRefSup8:
+		v.size = 8
+	case dwFormData16:
+		v.size = 16
+	case dwFormStrp, dwFormSecOffset, dwFormLineStrp, dwFormStrpSup, dwFormGNURefAlt, dwFormGNUStrpAlt:
+		v.size = u.offSize
+	case dwFormRefAddr:
+		v.size = u.offSize
+		if u.version == 2 {
+			v.size = u.addrSize
+		}
+	case dwFormBlock1:
+		d.bytes(d.uint(1))
+	case dwFormBlock2:
+		d.bytes(d.uint(2))
+	case dwFormBlock4:
+		d.bytes(d.uint(4))
+	case dwFormBlock, dwFormExprloc:
+		d.bytes(d.uleb())
+	case dwFormSdata, dwFormUdata, dwFormRefUdata, dwFormStrx, dwFormAddrx,
+		dwFormLoclistx, dwFormRnglistx, dwFormGNUAddrIndex, dwFormGNUStrIndex:
+		v.pos, v.leb = d.off, true
+		v.val = d.uleb()
+		v.size = d.off - v.pos
+	case dwFormString:
+		v.str = d.cstring()
+	case dwFormFlagPresent, dwFormImplicitConst:
+	default:
+		d.fail("unknown form %#x", v.form)
+	}
+	if v.size > 0 && !v.leb {
+		v.pos = d.off
+		if b := d.bytes(v.size); b != nil && v.size&(v.size-1) == 0 && v.size <= 8 {
+			v.val = getOffset(b, v.size, d.o)
+		}
+	}
+	return v
+}
+
+// string returns the value of a string attribute, if it is in the
+// DIE or in str (__debug_str).
+func (v *attrValue) string(str []byte) (string, bool) {
+	switch {
+	case v.form == dwFormString:
+		return v.str, true
+	case v.form == dwFormStrp && v.val < uint64(len(str)):
+		return (&dwarfBuf{b: str, off: v.val}).cstring(), true
+	}
+	return "", false
+}
+
+// walkDIEs calls fn for each entry of unit u in info, in order, with
+// its offset, the offset after it, its depth (0 for the unit's own
+// DIE), its abbreviation, and its attributes.  The null entries that
+// end lists of children are passed too, with a nil abbreviation and
+// the depth of the list they end.
+func walkDIEs(info []byte, u *unitHeader, o binary.ByteOrder, fn func(off, next uint64, depth int, a *abbrev, attrs []attrValue)) error {
+	d := &dwarfBuf{b: info[:u.end], off: u.dies, o: o}
+	depth := 0
+	var attrs []attrValue
+	for d.err == nil && d.off < u.end {
+		off := d.off
+		code := d.uleb()
+		if code == 0 {
+			fn(off, d.off, depth, nil, nil)
+			if depth > 0 {
+				depth--
+			}
+			continue
+		}
+		a := u.abbrevs[code]
+		if a == nil {
+			d.fail("unknown abbreviation code %d", code)
+			break
+		}
+		attrs = attrs[:0]
+		for _, at := range a.attrs {
+			attrs = append(attrs, d.attr(at, u))
+		}
+		if d.err != nil {
+			break
+		}
+		fn(off, d.off, depth, a, attrs)
+		if a.children {
+			depth++
+		}
+	}
+	if d.err != nil {
+		return fmt.Errorf("__debug_info: unit at %#x: %v", u.start, d.err)
+	}
+	return nil
+}
+
+// compileUnits walks __debug_info, returning each unit's extent, name,
+// DW_FORM_ref_addr attributes, and DW_AT_stmt_list.
+func compileUnits(info, abbrevs, str []byte, o binary.ByteOrder) ([]compUnit, error) {
+	units, err := unitHeaders(info, abbrevs, o)
+	if err != nil {
+		return nil, err
+	}
+	cus := make([]compUnit, len(units))
+	for i := range units {
+		cu := &cus[i]
+		cu.start, cu.end = units[i].start, units[i].end
+		err := walkDIEs(info, &units[i], o, func(off, next uint64, depth int, a *abbrev, attrs []attrValue) {
+			for _, v := range attrs {
+				if v.size != 4 && v.size != 8 {
+					if s, ok := v.string(str); ok && off == units[i].dies && v.attr == dwAtName {
+						cu.name = s
+					}
+					continue
+				}
+				switch {
+				case v.form == dwFormRefAddr:
+					cu.refs = append(cu.refs, dieRef{at: v.pos, size: v.size, value: v.val})
+				case off != units[i].dies:
+				case v.attr == dwAtName:
+					cu.name, _ = v.string(str)
+				case v.attr == dwAtStmtList && (v.form == dwFormSecOffset || v.form == dwFormData4 || v.form == dwFormData8):
+					cu.stmtList = &dieRef{at: v.pos, size: v.size, value: v.val}
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cus, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// With -dedup, every dSYM written is also entered in a pool, a
+// directory of files named for the SHA-256 of their contents, and a
+// dSYM whose contents are pooled already becomes a hard link to that
+// file.  A store into which the same build is split again, under
+// another name or by another job, then keeps one copy of it.  Only
+// whole files are shared; the pool must be on the same file system
+// as the dSYMs, and should not be within a store, whose scans would
+// find both names for each file.
+
+// dedupDir is the pool of -dedup, or "" for none.
+var dedupDir string
+
+// dedupFile makes the file name share its storage with the identical
+// file in the pool dir, if there is one, or else adds it to the pool.
+// Either way its modification time becomes now, as it was just written.
+func dedupFile(dir, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	pooled := filepath.Join(dir, sum[:4], sum+".dwarf")
+	if err := os.MkdirAll(filepath.Dir(pooled), 0755); err != nil {
+		return err
+	}
+	err = os.Link(name, pooled)
+	if os.IsExist(err) {
+		err = linkPooled(pooled, name)
+	}
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(name, now, now)
+}
+
+// linkPooled replaces name with a hard link to pooled, by way of a
+// temporary name, so that name is never missing.
+func linkPooled(pooled, name string) error {
+	pi, err := os.Stat(pooled)
+	if err != nil {
+		return err
+	}
+	ni, err := os.Stat(name)
+	if err != nil || os.SameFile(pi, ni) {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(name), "."+filepath.Base(pooled))
+	os.Remove(tmp)
+	if err := os.Link(pooled, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// removeOutput removes the file name, if there is one, so that it is
+// written anew rather than overwritten: -dedup may have made it a hard
+// link to a file that other dSYMs share.
+func removeOutput(name string) error {
+	fi, err := os.Lstat(name)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,359 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A delta is a dSYM described as the changes from another, its base,
+// such as yesterday's dSYM of the same program.  Because a split lays
+// out the same input the same way every time, most of a dSYM is the
+// same bytes as the one before it, shifted; a delta cuts both into
+// chunks as a chunked dSYM does (see chunk.go), and copies from the
+// base each chunk it has, so that only what changed is sent.
+//
+// A delta file is a line of JSON, its DeltaHeader, and then, compressed
+// with zlib, a sequence of operations, each a byte and uvarints:
+//
+//	'c' off n     copy n bytes of the base from offset off
+//	'd' n data    the n bytes that follow
+//	'e'           the end
+const deltaFormat = "sd-delta/1"
+
+// A DeltaHeader says what a delta applies to, and what it makes.
+type DeltaHeader struct {
+	Format string     `json:"format"`
+	Base   FileDigest `json:"base"`
+	Result FileDigest `json:"result"`
+	UUIDs  []string   `json:"uuids,omitempty"` // of the result, one for each slice
+}
+
+// deltaStats are what writeDelta tells its caller.
+type deltaStats struct {
+	size   int64 // of the result
+	copied int64 // of its bytes, how many were copied from the base
+	ops    int
+}
+
+// sd delta [ flags ] -base dsym inputexe delta
+func deltaCmd(args []string) {
+	var opts splitOptions
+	fs := flag.NewFlagSet("delta", flag.ExitOnError)
+	base := fs.String("base", "", "the earlier dSYM, a file or bundle, that the delta is from")
+	splitFlags(fs, &opts)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s delta [ flags ] -base dsym inputexe delta\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 || *base == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts.transforms = macho.SectionTransforms()
+	inexe, out := fs.Arg(0), fs.Arg(1)
+	bases, err := expandBundles([]string{*base})
+	if err != nil {
+		fail("%v", err)
+	}
+	if len(bases) != 1 {
+		fail("%s holds %d DWARF files; give the one the delta is from", *base, len(bases))
+	}
+
+	st, err := splitDelta(inexe, bases[0], out, &opts)
+	if err != nil {
+		fail("%v", err)
+	}
+	fi, err := os.Stat(out)
+	if err != nil {
+		fail("%v", err)
+	}
+	note("%s: %d bytes for a dSYM of %d, %d of them copied from %s in %d operations",
+		out, fi.Size(), st.size, st.copied, bases[0], st.ops)
+}
+
+// splitDelta splits inexe with opts and writes into out the delta that
+// makes the dSYM from base.
+func splitDelta(inexe, base, out string, opts *splitOptions) (*deltaStats, error) {
+	// The dSYM is named as inexe, for the delta to record.
+	dir, err := ioutil.TempDir("", "sd-delta")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	dwarf := filepath.Join(dir, filepath.Base(inexe))
+	if err := splitFile(inexe, dwarf, false, opts, "", ""); err != nil {
+		return nil, err
+	}
+	st, err := writeDeltaFile(out, base, dwarf)
+	if err != nil {
+		return nil, fmt.Errorf("Could not write delta %s, error=%v", out, err)
+	}
+	return st, nil
+}
+
+// sd apply-delta base delta output
+func applyDeltaCmd(args []string) {
+	fs := flag.NewFlagSet("apply-delta", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		fail("Usage: %s apply-delta base delta output", os.Args[0])
+	}
+	bases, err := expandBundles([]string{fs.Arg(0)})
+	if err != nil {
+		fail("%v", err)
+	}
+	if len(bases) != 1 {
+		fail("%s holds %d DWARF files; give the one the delta is from", fs.Arg(0), len(bases))
+	}
+	h, err := applyDeltaFile(bases[0], fs.Arg(1), fs.Arg(2))
+	if err != nil {
+		fail("%v", err)
+	}
+	fmt.Printf("%s: size=%d sha256=%s\n", fs.Arg(2), h.Result.Size, h.Result.SHA256)
+}
+
+// writeDeltaFile writes into file the delta that makes result from base.
+func writeDeltaFile(file, base, result string) (*deltaStats, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	st, err := writeDelta(f, base, result)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file)
+	}
+	return st, err
+}
+
+// writeDelta writes to w the delta that makes result from base.
+func writeDelta(w io.Writer, base, result string) (*deltaStats, error) {
+	h := DeltaHeader{Format: deltaFormat, UUIDs: fileUUIDs(result)}
+
+	// Where in base each of its chunks is.
+	bf, err := os.Open(base)
+	if err != nil {
+		return nil, err
+	}
+	defer bf.Close()
+	at := make(map[[sha256.Size]byte]int64)
+	whole := sha256.New()
+	var off int64
+	err = cutChunks(io.TeeReader(bf, whole), nil, func(b []byte) error {
+		sum := sha256.Sum256(b)
+		if _, ok := at[sum]; !ok {
+			at[sum] = off
+		}
+		off += int64(len(b))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.Base = FileDigest{Path: filepath.Base(base), Size: off, SHA256: hex.EncodeToString(whole.Sum(nil))}
+	h.Result, err = digestFile(result, hashSHA256)
+	if err != nil {
+		return nil, err
+	}
+	h.Result.Path = filepath.Base(result)
+
+	hb, err := json.Marshal(&h)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(hb, '\n')); err != nil {
+		return nil, err
+	}
+
+	rf, err := os.Open(result)
+	if err != nil {
+		return nil, err
+	}
+	defer rf.Close()
+	zw := zlib.NewWriter(w)
+	ops := &deltaWriter{w: bufio.NewWriter(zw)}
+	err = cutChunks(rf, nil, func(b []byte) error {
+		if off, ok := at[sha256.Sum256(b)]; ok {
+			return ops.copy(off, int64(len(b)))
+		}
+		return ops.data(b)
+	})
+	if err == nil {
+		err = ops.end()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	ops.st.size = h.Result.Size
+	return &ops.st, nil
+}
+
+// A deltaWriter writes the operations of a delta, joining copies of
+// adjacent ranges of the base into one.
+type deltaWriter struct {
+	w       *bufio.Writer
+	off, n  int64 // the copy not yet written, if n > 0
+	st      deltaStats
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (d *deltaWriter) uvarint(x uint64) {
+	d.w.Write(d.scratch[:binary.PutUvarint(d.scratch[:], x)])
+}
+
+func (d *deltaWriter) flush() {
+	if d.n > 0 {
+		d.w.WriteByte('c')
+		d.uvarint(uint64(d.off))
+		d.uvarint(uint64(d.n))
+		d.st.copied += d.n
+		d.st.ops++
+		d.n = 0
+	}
+}
+
+func (d *deltaWriter) copy(off, n int64) error {
+	if d.n > 0 && d.off+d.n == off {
+		d.n += n
+		return nil
+	}
+	d.flush()
+	d.off, d.n = off, n
+	return nil
+}
+
+func (d *deltaWriter) data(b []byte) error {
+	d.flush()
+	d.w.WriteByte('d')
+	d.uvarint(uint64(len(b)))
+	d.st.ops++
+	_, err := d.w.Write(b)
+	return err
+}
+
+func (d *deltaWriter) end() error {
+	d.flush()
+	d.w.WriteByte('e')
+	return d.w.Flush()
+}
+
+// applyDeltaFile applies the delta in file to base, writing the result
+// into out.  Nothing is left at out unless the base is the one the
+// delta was made from, and the result is the one it makes.
+func applyDeltaFile(base, file, out string) (*DeltaHeader, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return applyDelta(base, f, out)
+}
+
+func applyDelta(base string, delta io.Reader, out string) (*DeltaHeader, error) {
+	br := bufio.NewReader(delta)
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("not a delta: %v", err)
+	}
+	h := new(DeltaHeader)
+	if err := json.Unmarshal(line, h); err != nil || h.Format != deltaFormat {
+		return nil, fmt.Errorf("not a delta")
+	}
+	have, err := digestFile(base, hashSHA256)
+	if err != nil {
+		return nil, err
+	}
+	if have.Size != h.Base.Size || have.SHA256 != h.Base.SHA256 {
+		return nil, fmt.Errorf("%s is not the dSYM the delta is from: size=%d sha256=%s, want size=%d sha256=%s (%s)",
+			base, have.Size, have.SHA256, h.Base.Size, h.Base.SHA256, h.Base.Path)
+	}
+	bf, err := os.Open(base)
+	if err != nil {
+		return nil, err
+	}
+	defer bf.Close()
+	zr, err := zlib.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("delta: %v", err)
+	}
+	ops := bufio.NewReader(zr)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(out), ".sd")
+	if err != nil {
+		return nil, err
+	}
+	whole := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(tmp, whole))
+	var size int64
+	err = func() error {
+		for {
+			op, err := ops.ReadByte()
+			if err != nil {
+				return fmt.Errorf("delta: %v", err)
+			}
+			switch op {
+			case 'c':
+				off, err1 := binary.ReadUvarint(ops)
+				n, err2 := binary.ReadUvarint(ops)
+				if err1 != nil || err2 != nil || off > uint64(h.Base.Size) || n > uint64(h.Base.Size)-off {
+					return fmt.Errorf("delta: malformed copy at result offset %#x", size)
+				}
+				if _, err := io.Copy(w, io.NewSectionReader(bf, int64(off), int64(n))); err != nil {
+					return err
+				}
+				size += int64(n)
+			case 'd':
+				n, err := binary.ReadUvarint(ops)
+				if err != nil || n > uint64(h.Result.Size-size) {
+					return fmt.Errorf("delta: malformed data at result offset %#x", size)
+				}
+				if _, err := io.CopyN(w, ops, int64(n)); err != nil {
+					return fmt.Errorf("delta: %v", err)
+				}
+				size += int64(n)
+			case 'e':
+				return w.Flush()
+			default:
+				return fmt.Errorf("delta: unknown operation %#x at result offset %#x", op, size)
+			}
+		}
+	}()
+	if err == nil && (size != h.Result.Size || hex.EncodeToString(whole.Sum(nil)) != h.Result.SHA256) {
+		err = fmt.Errorf("delta: made %d bytes that are not %s", size, h.Result.Path)
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), out)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return h, nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"os"
+)
+
+// describeFiles implements "sd describe".
+func describeFiles(args []string) {
+	if len(args) == 0 {
+		fail("Usage: %s describe file ...", os.Args[0])
+	}
+	args, err := expandBundles(args)
+	if err != nil {
+		fail("%v", err)
+	}
+	for i, name := range args {
+		osf, err := os.Open(name)
+		if err != nil {
+			fail("Could not open %s, error=%v", name, err)
+		}
+		if len(args) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%s:\n", name)
+		}
+		if isFat(osf) {
+			err = describeFat(os.Stdout, osf)
+		} else {
+			var f *macho.File
+			if f, err = macho.NewFile(osf); err != nil {
+				fail("Could not open %s, error=%v", name, err)
+			}
+			err = describe(os.Stdout, &f.FileTOC)
+			if err == nil {
+				err = describeToolchain(os.Stdout, detectToolchain(f, osf))
+			}
+			if err == nil {
+				err = describeCapabilities(os.Stdout, f)
+			}
+			if err == nil {
+				err = describeWeak(os.Stdout, f)
+			}
+			if err == nil {
+				err = describeStamp(os.Stdout, f)
+			}
+		}
+		osf.Close()
+		if err != nil {
+			fail("%s: %v", name, err)
+		}
+	}
+}
+
+// describeFat describes the universal binary r: its header, then each
+// slice as describe and describeToolchain would.
+func describeFat(w io.Writer, r io.ReaderAt) error {
+	ff, err := macho.NewFatFile(r)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Universal, narch=%d\n", len(ff.Arches))
+	for i, a := range ff.Arches {
+		fmt.Fprintf(w, "\nArch %d is %s, subcpu=0x%x, offset=0x%x, size=%d, align=2^%d\n",
+			i, archName(a.Cpu, a.SubCpu), a.SubCpu, a.Offset, a.Size, a.Align)
+		if err := describe(w, &a.FileTOC); err != nil {
+			return err
+		}
+		tc := detectToolchain(a.File, io.NewSectionReader(r, int64(a.Offset), int64(a.Size)))
+		if err := describeToolchain(w, tc); err != nil {
+			return err
+		}
+		if err := describeCapabilities(w, a.File); err != nil {
+			return err
+		}
+		if err := describeWeak(w, a.File); err != nil {
+			return err
+		}
+		if err := describeStamp(w, a.File); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describe writes a description of t to w: the header, then each load
+// command in file order, with a segment's sections listed beneath it.
+// The output depends only on t, not on the host, locale, or map order,
+// so descriptions can be kept as golden files and compared across runs.
+func describe(w io.Writer, t *macho.FileTOC) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Magic=0x%x, Cpu=%s, SubCpu=0x%x, Type=%s, Flags=%s, Ncmd=%d, Cmdsz=%d\n",
+		t.Magic, t.Cpu, t.SubCpu, t.Type, t.Flags, t.Ncmd, t.Cmdsz)
+	for i, l := range t.Loads {
+		if s, ok := l.(*macho.Segment); ok {
+			fmt.Fprintf(&b, "Load %d is Segment %s, offset=0x%x, filesz=%d, addr=0x%x, memsz=%d, nsect=%d", i, s.Name,
+				s.Offset, s.Filesz, s.Addr, s.Memsz, s.Nsect)
+			if s.Flag != 0 {
+				fmt.Fprintf(&b, ", flags=%s", s.Flag)
+			}
+			b.WriteByte('\n')
+			for j := uint32(0); j < s.Nsect; j++ {
+				if int(j+s.Firstsect) >= len(t.Sections) {
+					fmt.Fprintf(&b, "   Section %d is missing\n", j+s.Firstsect)
+					continue
+				}
+				c := t.Sections[j+s.Firstsect]
+				fmt.Fprintf(&b, "   Section %s, offset=0x%x, size=%d, addr=0x%x, flags=%s, nreloc=%d, res1=%d, res2=%d, res3=%d\n",
+					c.Name, c.Offset, c.Size, c.Addr, c.Flags, c.Nreloc, c.Reserved1, c.Reserved2, c.Reserved3)
+			}
+		} else if u, ok := l.(*macho.Uuid); ok {
+			fmt.Fprintf(&b, "Load %d is Uuid %v\n", i, u)
+		} else {
+			fmt.Fprintf(&b, "Load %d is %v\n", i, l)
+		}
+	}
+	if t.Cmdsz != t.LoadSize() {
+		fmt.Fprintf(&b, "Recorded command size %d does not equal computed command size %d\n", t.Cmdsz, t.LoadSize())
+	}
+	fmt.Fprintf(&b, "File size is %d\n", t.FileSize())
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// describeToolchain writes tc, and the evidence for it, to w.
+func describeToolchain(w io.Writer, tc *Toolchain) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Toolchain is %s\n", tc)
+	for _, e := range tc.Evidence {
+		fmt.Fprintf(&b, "   because %s\n", e)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// describeCapabilities writes which features of the format f uses,
+// which decide what can be done with it.
+func describeCapabilities(w io.Writer, f *macho.File) error {
+	c, err := f.Capabilities()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Format features: %s\n", c)
+	return err
+}
+
+// describeWeak writes the weak definitions and references of f, and
+// the weak binds by which dyld coalesces definitions, if it has any,
+// which decide which image's definition of a symbol is used.
+func describeWeak(w io.Writer, f *macho.File) error {
+	binds, strong, err := f.WeakBinds()
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	for _, s := range f.WeakDefinitions() {
+		fmt.Fprintf(&b, "Weak definition %s, addr=0x%x\n", s.Name, s.Value)
+	}
+	for _, s := range f.WeakReferences() {
+		fmt.Fprintf(&b, "Weak reference %s, library=%d\n", s.Name, s.LibraryOrdinal())
+	}
+	for _, x := range binds {
+		fmt.Fprintf(&b, "Weak bind of %s at 0x%x, type=%s", x.Name, x.Addr, x.Type)
+		if x.Addend != 0 {
+			fmt.Fprintf(&b, ", addend=%d", x.Addend)
+		}
+		b.WriteByte('\n')
+	}
+	for _, name := range strong {
+		fmt.Fprintf(&b, "Strong definition %s overrides weak definitions\n", name)
+	}
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+// describeStamp writes how sd produced f, if f is a dSYM it made.
+func describeStamp(w io.Writer, f *macho.File) error {
+	s, err := readStamp(f)
+	if s == nil || err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Produced by %s\n", s)
+	return err
+}
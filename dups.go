@@ -0,0 +1,89 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"strings"
+)
+
+// A duplicateSection is a section of __DWARF that the input has twice,
+// usually once compressed and once not, after partial stripping or an
+// odd link step.  Only one copy, keep, goes into the dSYM.
+type duplicateSection struct {
+	keep, drop *macho.Section
+	why        string
+}
+
+func (d duplicateSection) String() string {
+	return fmt.Sprintf("both %s and %s are present; %s, so %s is dropped", d.keep.Name, d.drop.Name, d.why, d.drop.Name)
+}
+
+// dwarfSectionKey returns the name by which dwarfSectionsByName knows
+// the section named name: without the leading "__" or "__z", and for
+// DWARF sections, with any truncation undone: "debug_str_offsets".
+func dwarfSectionKey(name string) string {
+	if section, _ := macho.DWARFSection(name); section != "" {
+		return "debug_" + section
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(name, "__z"), "__")
+}
+
+// dedupDWARFSections returns the sections of exem's __DWARF segment,
+// keyed as dwarfSectionsByName keys them, and the duplicates left out.
+// Of two copies of a section, the one kept is, deterministically: the
+// uncompressed one if both hold the same bytes; else the one that can
+// be read; else the larger; else the uncompressed one.
+func dedupDWARFSections(exem *macho.File) (map[string]*macho.Section, []duplicateSection) {
+	sections := make(map[string]*macho.Section)
+	var dups []duplicateSection
+	dw := exem.Segment("__DWARF")
+	if dw == nil {
+		return sections, nil
+	}
+	for _, s := range exem.Sections[dw.Firstsect : dw.Firstsect+dw.Nsect] {
+		key := dwarfSectionKey(s.Name)
+		old := sections[key]
+		if old == nil {
+			sections[key] = s
+			continue
+		}
+		d := pickDuplicate(old, s)
+		sections[key] = d.keep
+		dups = append(dups, d)
+	}
+	return sections, dups
+}
+
+// pickDuplicate decides which of a and b, two copies of one section, to
+// keep.
+func pickDuplicate(a, b *macho.Section) duplicateSection {
+	// Prefer a stored uncompressed, all else being equal.
+	if compressed(a) && !compressed(b) {
+		a, b = b, a
+	}
+	da, erra := a.UncompressedData()
+	db, errb := b.UncompressedData()
+	switch {
+	case erra == nil && errb == nil && bytes.Equal(da, db):
+		return duplicateSection{a, b, "they are the same"}
+	case erra != nil && errb == nil:
+		return duplicateSection{b, a, fmt.Sprintf("%s cannot be read (%v)", a.Name, erra)}
+	case errb != nil:
+		return duplicateSection{a, b, fmt.Sprintf("%s cannot be read (%v)", b.Name, errb)}
+	case len(db) > len(da):
+		return duplicateSection{b, a, fmt.Sprintf("they differ, and %s is larger", b.Name)}
+	case len(da) > len(db):
+		return duplicateSection{a, b, fmt.Sprintf("they differ, and %s is larger", a.Name)}
+	}
+	return duplicateSection{a, b, fmt.Sprintf("they differ, and %s is not compressed", a.Name)}
+}
+
+// compressed reports whether s is named as a compressed section.
+func compressed(s *macho.Section) bool {
+	return strings.HasPrefix(s.Name, "__z")
+}
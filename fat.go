@@ -0,0 +1,186 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A fatDsym is a laid-out universal dSYM: a dsym for each slice of a
+// universal input, in the input's order, each at its own offset.
+type fatDsym struct {
+	arches []macho.FatArchHeader
+	slices []*dsym
+	size   int64
+
+	// The first supplementary file any slice refers into.
+	supplementary *Supplementary
+
+	// The warnings of every slice, each naming its slice.
+	warnings []string
+}
+
+// isFat reports whether r begins as a universal binary does.
+func isFat(r io.ReaderAt) bool {
+	var magic [4]byte
+	_, err := r.ReadAt(magic[:], 0)
+	return err == nil && binary.BigEndian.Uint32(magic[:]) == macho.MagicFat
+}
+
+// fatAlign returns the log2 alignment of a slice for cpu, as lipo
+// chooses it: the page size of the architecture.
+func fatAlign(cpu macho.Cpu) uint32 {
+	if cpu == macho.CpuArm64 {
+		return 14
+	}
+	return pageAlign
+}
+
+// splitFat lays out a universal dSYM for the universal binary r.  The
+// slices are independent, so each is parsed and split concurrently;
+// the first slice to fail, in file order, decides the error.
+func splitFat(r io.ReaderAt, opts *splitOptions) (*fatDsym, error) {
+	ff, err := macho.NewFatFile(r)
+	if err != nil {
+		return nil, err
+	}
+	fd := &fatDsym{slices: make([]*dsym, len(ff.Arches))}
+	errs := make([]error, len(ff.Arches))
+	var wg sync.WaitGroup
+	for i := range ff.Arches {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fd.slices[i], errs[i] = splitDwarf(ff.Arches[i].File, opts)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, a := range ff.Arches {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("%v slice: %v", a.Cpu, errs[i])
+		}
+		d := fd.slices[i]
+		fd.arches = append(fd.arches, macho.FatArchHeader{Cpu: a.Cpu, SubCpu: a.SubCpu, Size: uint32(d.size)})
+		if uint64(d.size) != uint64(uint32(d.size)) {
+			return nil, fmt.Errorf("%v slice: a universal dSYM cannot hold more than 4GiB", a.Cpu)
+		}
+		if fd.supplementary == nil {
+			fd.supplementary = d.supplementary
+		}
+		for _, w := range d.warnings {
+			fd.warnings = append(fd.warnings, fmt.Sprintf("%v slice: %s", a.Cpu, w))
+		}
+	}
+	size, err := layoutFat(fd.arches)
+	if err != nil {
+		return nil, err
+	}
+	fd.size = int64(size)
+	return fd, nil
+}
+
+// layoutFat assigns each slice of a universal file, whose Cpu and Size
+// are set, its alignment and offset, in order, and returns the size of
+// the file.
+func layoutFat(arches []macho.FatArchHeader) (uint64, error) {
+	off := uint64(macho.FatHeaderSize(len(arches)))
+	for i := range arches {
+		a := &arches[i]
+		a.Align = fatAlign(a.Cpu)
+		off = macho.RoundUp(off, 1<<a.Align)
+		if off+uint64(a.Size) > 1<<32-1 {
+			return 0, fmt.Errorf("%v slice: a universal file cannot hold more than 4GiB", a.Cpu)
+		}
+		a.Offset = uint32(off)
+		off += uint64(a.Size)
+	}
+	return off, nil
+}
+
+// writeFile writes the universal dSYM to name, with permissions perm,
+// writing the slices concurrently.
+func (fd *fatDsym) writeFile(name string, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	err = fd.writeAt(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeAt writes the universal dSYM to w, the header first, then each
+// slice, concurrently, at its offset.
+func (fd *fatDsym) writeAt(w io.WriterAt) error {
+	hdr := make([]byte, macho.FatHeaderSize(len(fd.arches)))
+	macho.PutFatHeader(hdr, fd.arches)
+	if _, err := w.WriteAt(hdr, 0); err != nil {
+		return err
+	}
+	errs := make([]error, len(fd.slices))
+	var wg sync.WaitGroup
+	for i, d := range fd.slices {
+		wg.Add(1)
+		go func(i int, d *dsym) {
+			defer wg.Done()
+			_, errs[i] = d.WriteTo(io.NewOffsetWriter(w, int64(fd.arches[i].Offset)))
+		}(i, d)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("%v slice: %v", fd.arches[i].Cpu, err)
+		}
+	}
+	// The padding before a slice is never written, so make sure the
+	// file is as long as it should be even if its last slice is empty.
+	if t, ok := w.(interface{ Truncate(int64) error }); ok {
+		return t.Truncate(fd.size)
+	}
+	return nil
+}
+
+// thinSlice returns the Mach-O image in r for the architecture named
+// name, as lipo names it, or "host" for the slice the machine running
+// sd would run.  If r is thin, it is the image, and unless name is ""
+// or "host", it must be of that architecture.
+func thinSlice(r io.ReaderAt, name string) (*macho.File, error) {
+	if !isFat(r) {
+		f, err := macho.NewFile(r)
+		if err == nil && name != "" && name != "host" && archName(f.Cpu, f.SubCpu) != name {
+			err = fmt.Errorf("the input is %s, not %s", archName(f.Cpu, f.SubCpu), name)
+		}
+		return f, err
+	}
+	ff, err := macho.NewFatFile(r)
+	if err != nil {
+		return nil, err
+	}
+	var have []string
+	for _, a := range ff.Arches {
+		have = append(have, archName(a.Cpu, a.SubCpu))
+	}
+	if name == "host" {
+		if a := ff.HostArch(); a != nil {
+			return a.File, nil
+		}
+		return nil, fmt.Errorf("no slice runs on this machine, only %s", strings.Join(have, ", "))
+	}
+	for _, a := range ff.Arches {
+		if archName(a.Cpu, a.SubCpu) == name {
+			return a.File, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s slice, only %s", name, strings.Join(have, ", "))
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// A filter is an external program that rewrites the DWARF sections of
+// a dSYM, for policies that sd cannot be built to apply itself.  It is
+// run once for each section, with no shell, and is given on its
+// standard input a line holding the section's name, then the section's
+// contents, uncompressed; the name is also in $SD_SECTION.  What it
+// writes to its standard output replaces the contents.  A filter that
+// exits with a failure fails the split, reporting its standard error.
+//
+// The name is the full name of the section, uncompressed: a filter is
+// given __debug_str_offsets, not __zdebug_str_offs.
+func filterTransform(command string) macho.SectionTransform {
+	args := strings.Fields(command)
+	return func(s *macho.Section, data []byte) ([]byte, error) {
+		name := s.Name
+		if section, _ := macho.DWARFSection(s.Name); section != "" {
+			name = "__debug_" + section
+		}
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Env = append(os.Environ(), "SD_SECTION="+name)
+		cmd.Stdin = bytes.NewReader(append([]byte(name+"\n"), data...))
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				err = fmt.Errorf("%v: %s", err, msg)
+			}
+			return nil, fmt.Errorf("filter %q: %v", command, err)
+		}
+		return stdout.Bytes(), nil
+	}
+}
+
+// parseFilter adds the filter command s to o.
+func parseFilter(s string, o *splitOptions) error {
+	if strings.TrimSpace(s) == "" {
+		return fmt.Errorf("empty filter command")
+	}
+	o.filters = append(o.filters, s)
+	return nil
+}
+
+// sectionTransforms returns the transforms to apply to each DWARF
+// section: o.transforms, then a filter for each of o.filters, in the
+// order given.
+func (o *splitOptions) sectionTransforms() []macho.SectionTransform {
+	transforms := append([]macho.SectionTransform(nil), o.transforms...)
+	for _, f := range o.filters {
+		transforms = append(transforms, filterTransform(f))
+	}
+	return transforms
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"hash"
+)
+
+// The checksums sd records for others to check, in manifests, and the
+// checksum that names a store's shared-strings file, are SHA-256 unless
+// -hash says BLAKE3, as some organizations mandate one or the other for
+// artifact integrity; a manifest records which, in "hash", and each of
+// its checksums under the algorithm's name.  The chunks of a store, and
+// deltas, are named and checked by SHA-256 whatever -hash says, since
+// every dSYM that shares them must agree on their names.
+
+// A hashAlgorithm is a hash sd can digest files with.
+type hashAlgorithm string
+
+const (
+	hashSHA256 hashAlgorithm = "sha256"
+	hashBLAKE3 hashAlgorithm = "blake3"
+)
+
+// parseHash parses the argument of -hash, or the hash a manifest
+// records, where "", from before there was a choice, is SHA-256.
+func parseHash(s string) (hashAlgorithm, error) {
+	switch a := hashAlgorithm(s); a {
+	case "":
+		return hashSHA256, nil
+	case hashSHA256, hashBLAKE3:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown hash %q (want sha256 or blake3)", s)
+}
+
+// new returns a new hash.Hash computing a; the zero hashAlgorithm is
+// SHA-256.
+func (a hashAlgorithm) new() hash.Hash {
+	if a == hashBLAKE3 {
+		return newBlake3()
+	}
+	return sha256.New()
+}
+
+// sum returns the checksum of b by a.
+func (a hashAlgorithm) sum(b []byte) []byte {
+	h := a.new()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// hashFlag defines in fs the -hash flag, which says what to digest
+// what by, setting *a, SHA-256 if it is not given.
+func hashFlag(fs *flag.FlagSet, a *hashAlgorithm, what string) {
+	*a = hashSHA256
+	fs.Func("hash", "digest "+what+" by `algorithm`: sha256 (the default) or blake3", func(s string) (err error) {
+		if s == "" {
+			return fmt.Errorf("no hash given (want sha256 or blake3)")
+		}
+		*a, err = parseHash(s)
+		return err
+	})
+}
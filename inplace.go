@@ -0,0 +1,176 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// An edit in place rewrites a file that something may rely on, such as
+// the dSYM of an installed program, rather than a build output that can
+// be made again, so it is guarded.  The new contents are written beside
+// the file and checked before they replace it; the file is first kept
+// as FILE.bak; and if the file in place then fails the check, the
+// backup is put back, and checked to be the original, byte for byte.
+
+// backupSuffix ends the name of the backup an edit in place keeps.
+const backupSuffix = ".bak"
+
+// editInPlace replaces the file name with what write writes, keeping
+// its permissions, if check, given the file as it was and as it would
+// be, accepts the change.  If keepBackup is set, the file as it was is
+// left at name+backupSuffix.  If name does not exist, it is written,
+// with check given "" for the file as it was.
+func editInPlace(name string, write func(io.Writer) error, check func(orig, edited string) error, keepBackup bool) error {
+	perm := os.FileMode(0644)
+	fi, err := os.Stat(name)
+	exists := err == nil
+	if exists {
+		perm = fi.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".sd")
+	if err != nil {
+		return err
+	}
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if !exists {
+		if err := check("", tmp.Name()); err != nil {
+			os.Remove(tmp.Name())
+			return fmt.Errorf("%s, as written, %v", name, err)
+		}
+		if err := os.Rename(tmp.Name(), name); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+		return nil
+	}
+	if err := check(name, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("%s, as edited, %v; it was left as it was", name, err)
+	}
+
+	before, err := digestFile(name, hashSHA256)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	bak := name + backupSuffix
+	if err := backup(name, bak); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Could not back up %s, error=%v; it was left as it was", name, err)
+	}
+	err = os.Rename(tmp.Name(), name)
+	if err != nil {
+		os.Remove(tmp.Name())
+	} else {
+		err = check(bak, name)
+	}
+	if err != nil {
+		return rollBack(name, bak, before, err)
+	}
+	if !keepBackup {
+		os.Remove(bak)
+	}
+	return nil
+}
+
+// backup makes bak a copy of name, replacing any earlier backup: a hard
+// link if it can, as the file is about to be replaced, not changed.
+func backup(name, bak string) error {
+	if err := os.Remove(bak); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.Link(name, bak) == nil {
+		return nil
+	}
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(bak, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(bak)
+	}
+	return err
+}
+
+// rollBack puts back the backup bak of name, which failed with why,
+// and checks that it is the file before was the digest of.
+func rollBack(name, bak string, before FileDigest, why error) error {
+	if err := os.Rename(bak, name); err != nil {
+		return fmt.Errorf("%s, as edited, %v, and could not be rolled back: %v; the original is %s", name, why, err, bak)
+	}
+	after, err := digestFile(name, hashSHA256)
+	if err != nil || after.Size != before.Size || after.SHA256 != before.SHA256 {
+		return fmt.Errorf("%s, as edited, %v, and rolling back did not restore it: size=%d sha256=%s, want size=%d sha256=%s",
+			name, why, after.Size, after.SHA256, before.Size, before.SHA256)
+	}
+	return fmt.Errorf("%s, as edited, %v; it was rolled back", name, why)
+}
+
+// checkDsymEdit checks that edited, a dSYM rewritten from orig, is
+// still one: that it can be read, and has orig's slices and UUIDs.
+func checkDsymEdit(orig, edited string) error {
+	got, err := sliceUUIDs(edited)
+	if err != nil {
+		return fmt.Errorf("is not a readable Mach-O file: %v", err)
+	}
+	if orig == "" {
+		return nil
+	}
+	want, err := sliceUUIDs(orig)
+	if err == nil && !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("has slices and UUIDs %v, not %v", got, want)
+	}
+	return nil
+}
+
+// sliceUUIDs returns the architecture and UUID of each slice of the
+// Mach-O file name, thin or universal.
+func sliceUUIDs(name string) ([]string, error) {
+	var slices []string
+	ff, err := macho.OpenFat(name)
+	if err == nil {
+		defer ff.Close()
+		for _, a := range ff.Arches {
+			slices = append(slices, archName(a.Cpu, a.SubCpu)+" "+uuidOf(a.File))
+		}
+		return slices, nil
+	}
+	f, err := macho.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return []string{archName(f.Cpu, f.SubCpu) + " " + uuidOf(f)}, nil
+}
@@ -0,0 +1,277 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// splitOptions control the layout of the dSYM written by splitDwarf.
+// The zero value gives the default layout.
+type splitOptions struct {
+	vmaddr       vmaddrPolicy
+	base         uint64     // for vmaddrBase, the new address of __TEXT
+	dsymutil     bool       // order loads and segments as dsymutil does
+	linkEditData bool       // copy LC_FUNCTION_STARTS and LC_DATA_IN_CODE
+	onlyDwarf    bool       // omit every segment but __DWARF
+	symbolsOnly  bool       // omit __DWARF, but copy LC_FUNCTION_STARTS
+	cus          *cuFilter  // if not nil, the compile units to keep
+	redact       *redaction // if not nil, the functions and variables to remove
+	stripMacros  bool       // omit __debug_macinfo and __debug_macro
+	lineTables   bool       // keep only the line tables and unit skeletons
+	// What to do when the DWARF refers into a supplementary file, and
+	// where to find it for supInline if not where the input says.
+	supplementary supPolicy
+	supFile       string
+	supDir        string // the input's directory
+	// For a universal input, the one slice to split, or "" for all.
+	arch string
+	// How the DWARF sections, uncompressed, are named, and for
+	// renameMap, the names to give them, by input name.
+	rename  renamePolicy
+	renames map[string]string
+	// Applied in order to the contents of each DWARF section copied,
+	// after any other edits, and then the filter commands.
+	transforms []macho.SectionTransform
+	filters    []string
+	// How long to wait for another sd writing the same dSYM or store,
+	// the hash a manifest digests files by, whether to strip the DWARF
+	// from the input once split, without a backup, or despite a code
+	// signature, and whether to cut chunks by content alone; not matters
+	// of how the dSYM is made, so not recorded in it.
+	lockWait         time.Duration
+	hash             hashAlgorithm
+	strip            bool
+	stripNoBackup    bool
+	stripSigned      bool
+	chunkContentOnly bool
+}
+
+// A vmaddrPolicy says how splitDwarf assigns the vmaddrs of the
+// segments in the dSYM.
+type vmaddrPolicy int
+
+const (
+	// __TEXT and __DATA keep their addresses; __LINKEDIT follows
+	// __DATA and __DWARF follows __LINKEDIT.
+	vmaddrChain vmaddrPolicy = iota
+	// Every segment keeps the address it had in the executable, but
+	// for __LINKEDIT, if __DWARF would overlap it, as in Go executables.
+	vmaddrPreserve
+	// __TEXT keeps its address, and each later segment starts at the
+	// first page after the one before it.
+	vmaddrPack
+	// As for vmaddrChain, but everything above __PAGEZERO is slid so
+	// that __TEXT starts at an explicit base address.
+	vmaddrBase
+)
+
+// parseVmaddr parses the argument of -vmaddr: chain, preserve, pack, or base=ADDR.
+func parseVmaddr(s string, o *splitOptions) error {
+	switch {
+	case s == "chain":
+		o.vmaddr = vmaddrChain
+	case s == "preserve":
+		o.vmaddr = vmaddrPreserve
+	case s == "pack":
+		o.vmaddr = vmaddrPack
+	case strings.HasPrefix(s, "base="):
+		a, err := strconv.ParseUint(s[len("base="):], 0, 64)
+		if err != nil {
+			return fmt.Errorf("bad base address: %v", err)
+		}
+		if !macho.IsAligned(a, 1<<pageAlign) {
+			return fmt.Errorf("base address %#x is not page-aligned", a)
+		}
+		o.vmaddr, o.base = vmaddrBase, a
+	default:
+		return fmt.Errorf("unknown vmaddr policy %q (want chain, preserve, pack, or base=ADDR)", s)
+	}
+	return nil
+}
+
+// A renamePolicy says how splitDwarf names the DWARF sections of the
+// dSYM, which it always writes uncompressed.
+type renamePolicy int
+
+const (
+	// A compressed __zdebug_x becomes __debug_x, its full name cut
+	// to 16 bytes, whatever the compressed name lost to that cut.
+	renameCanonical renamePolicy = iota
+	// Every section keeps its name, even __zdebug_x.  Readers that
+	// inflate only sections beginning with a "ZLIB" header, as
+	// debug/macho does, accept this.
+	renameKeep
+	// The sections named in renames take those names; the others are
+	// named as for renameCanonical.
+	renameMap
+)
+
+// parseRename parses the argument of -rename: canonical, keep, or
+// map=FROM:TO,...
+func parseRename(s string, o *splitOptions) error {
+	switch {
+	case s == "canonical":
+		o.rename = renameCanonical
+	case s == "keep":
+		o.rename = renameKeep
+	case strings.HasPrefix(s, "map="):
+		renames := make(map[string]string)
+		for _, pair := range strings.Split(s[len("map="):], ",") {
+			from, to, ok := strings.Cut(pair, ":")
+			if !ok || from == "" || to == "" {
+				return fmt.Errorf("bad rename %q (want FROM:TO)", pair)
+			}
+			if len(to) > 16 {
+				return fmt.Errorf("section name %q is longer than 16 bytes", to)
+			}
+			if _, dup := renames[from]; dup {
+				return fmt.Errorf("section %s is renamed twice", from)
+			}
+			renames[from] = to
+		}
+		o.rename, o.renames = renameMap, renames
+	default:
+		return fmt.Errorf("unknown rename policy %q (want canonical, keep, or map=FROM:TO,...)", s)
+	}
+	return nil
+}
+
+// sectionName returns the name, under o.rename, of the dSYM's copy of
+// the DWARF section named name in the input.
+func (o *splitOptions) sectionName(name string) string {
+	switch o.rename {
+	case renameKeep:
+		return name
+	case renameMap:
+		if to, ok := o.renames[name]; ok {
+			return to
+		}
+	}
+	if section, compressed := macho.DWARFSection(name); compressed {
+		return macho.DWARFSectionName(section, false)
+	}
+	if strings.HasPrefix(name, "__z") {
+		return name[0:2] + name[3:]
+	}
+	return name
+}
+
+// assignAddrs reassigns the vmaddrs of the segments of t, which were laid
+// out by the chain policy, according to o.vmaddr.  Sections and symbols
+// defined in them (syms, numbered by section as in exem) move with their
+// segments, relative to where they were in exem.
+func assignAddrs(t *macho.FileTOC, exem *macho.File, syms []macho.Nlist64, o *splitOptions) error {
+	if o.vmaddr == vmaddrChain {
+		return nil
+	}
+	var text *macho.Segment
+	for _, l := range t.Loads {
+		if g, ok := l.(*macho.Segment); ok && g.Name == "__TEXT" {
+			text = g
+		}
+	}
+	if text == nil {
+		return fmt.Errorf("lacks segment __TEXT")
+	}
+	next := text.Addr
+	slide := o.base - text.Addr
+
+	delta := make(map[string]uint64) // by segment name, modulo 2**64
+	for _, l := range t.Loads {
+		g, ok := l.(*macho.Segment)
+		if !ok || g.Name == "__PAGEZERO" {
+			continue
+		}
+		orig := exem.Segment(g.Name)
+		if orig == nil {
+			continue
+		}
+		switch o.vmaddr {
+		case vmaddrPreserve:
+			g.Addr = orig.Addr
+		case vmaddrPack:
+			g.Addr = next
+			end, ok := macho.CheckedAdd(g.Addr, g.Memsz)
+			if !ok {
+				return fmt.Errorf("segment %s ends beyond the address space", g.Name)
+			}
+			if next, ok = macho.CheckedRoundUp(end, 1<<pageAlign); !ok {
+				return fmt.Errorf("segment %s ends beyond the address space", g.Name)
+			}
+		case vmaddrBase:
+			g.Addr += slide
+			if pz := exem.Segment("__PAGEZERO"); pz != nil && g.Addr < pz.Addr+pz.Memsz {
+				return fmt.Errorf("segment %s at %#x would overlap __PAGEZERO", g.Name, g.Addr)
+			}
+		}
+		d := g.Addr - orig.Addr
+		delta[g.Name] = d
+		// splitDwarf copies each segment's sections in order.
+		for k := uint32(0); k < g.Nsect && k < orig.Nsect; k++ {
+			t.Sections[g.Firstsect+k].Addr = exem.Sections[orig.Firstsect+k].Addr + d
+		}
+	}
+	if err := checkOverlap(t, o.vmaddr == vmaddrPreserve); err != nil {
+		return err
+	}
+
+	for i := range syms {
+		s := &syms[i]
+		if s.Type&macho.NStab != 0 || s.Type&macho.NType != macho.NSect || s.Sect == 0 || int(s.Sect) > len(exem.Sections) {
+			continue
+		}
+		s.Value += delta[exem.Sections[s.Sect-1].Seg]
+	}
+	return nil
+}
+
+// checkOverlap returns an error if two segments of t overlap in memory.
+// If moveLinkedit is set, __LINKEDIT, which holds no sections or symbols
+// and so can go anywhere, is first moved past a __DWARF it overlaps, as
+// it does in Go executables, where the two start at the same vmaddr and
+// __DWARF takes no memory until the dSYM gives it its sections.
+func checkOverlap(t *macho.FileTOC, moveLinkedit bool) error {
+	var segs []*macho.Segment
+	var linkedit, dwarf *macho.Segment
+	for _, l := range t.Loads {
+		g, ok := l.(*macho.Segment)
+		if !ok || g.Memsz == 0 {
+			continue
+		}
+		segs = append(segs, g)
+		switch g.Name {
+		case "__LINKEDIT":
+			linkedit = g
+		case "__DWARF":
+			dwarf = g
+		}
+	}
+	overlap := func(a, b *macho.Segment) bool {
+		return a.Addr < b.Addr+b.Memsz && b.Addr < a.Addr+a.Memsz
+	}
+	if moveLinkedit && linkedit != nil && dwarf != nil && overlap(linkedit, dwarf) {
+		end, ok := macho.CheckedAdd(dwarf.Addr, dwarf.Memsz)
+		if ok {
+			end, ok = macho.CheckedRoundUp(end, 1<<pageAlign)
+		}
+		if !ok {
+			return fmt.Errorf("segment __DWARF ends beyond the address space")
+		}
+		linkedit.Addr = end
+	}
+	for i, a := range segs {
+		for _, b := range segs[i+1:] {
+			if overlap(a, b) {
+				return fmt.Errorf("segments %s at %#x and %s at %#x would overlap", a.Name, a.Addr, b.Name, b.Addr)
+			}
+		}
+	}
+	return nil
+}
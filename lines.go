@@ -0,0 +1,144 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+)
+
+// DWARF attributes of a unit's DIE that -line-tables-only keeps: enough
+// to name the unit, find its line program, and say which code it covers.
+var lineTableAttrs = map[uint64]bool{
+	0x03: true, // DW_AT_name
+	0x10: true, // DW_AT_stmt_list
+	0x11: true, // DW_AT_low_pc
+	0x12: true, // DW_AT_high_pc
+	0x13: true, // DW_AT_language
+	0x1b: true, // DW_AT_comp_dir
+	0x25: true, // DW_AT_producer
+	0x55: true, // DW_AT_ranges
+	0x72: true, // DW_AT_str_offsets_base
+	0x73: true, // DW_AT_addr_base
+	0x74: true, // DW_AT_rnglists_base
+}
+
+// The sections -line-tables-only keeps, other than __debug_info and
+// __debug_abbrev, which it rebuilds, and __debug_aranges, which it
+// updates.
+var lineTableSections = map[string]bool{
+	"debug_line":        true,
+	"debug_line_str":    true,
+	"debug_str":         true,
+	"debug_str_offsets": true,
+	"debug_addr":        true,
+	"debug_ranges":      true,
+	"debug_rnglists":    true,
+}
+
+// lineTablesOnly adds to edits the changes to exem's DWARF that leave
+// only what a profiler needs to map PCs to file and line: the line
+// tables, and a skeleton of each unit holding only its own DIE, with
+// only the attributes in lineTableAttrs.  Other sections are dropped.
+func lineTablesOnly(exem *macho.File, edits map[*macho.Section]sectionEdit) error {
+	sections := dwarfSectionsByName(exem)
+	info, err := editedData(edits, sections["debug_info"])
+	if err != nil || info == nil {
+		return err
+	}
+	abbrevs, err := editedData(edits, sections["debug_abbrev"])
+	if err != nil {
+		return err
+	}
+	o := exem.ByteOrder
+	units, err := unitHeaders(info, abbrevs, o)
+	if err != nil {
+		return err
+	}
+
+	var newInfo, newAbbrevs []byte
+	codes := make(map[string]uint64) // by tag and attribute list
+	newStart := make(map[uint64]uint64)
+	for i := range units {
+		u := &units[i]
+		d := &dwarfBuf{b: info[:u.end], off: u.dies, o: o}
+		a := u.abbrevs[d.uleb()]
+		if d.err != nil || a == nil {
+			return fmt.Errorf("__debug_info: unit at %#x has no DIE", u.start)
+		}
+		var spec, values []byte // the new abbreviation's attributes, and their values
+		for _, at := range a.attrs {
+			v := d.attr(at, u)
+			if !lineTableAttrs[v.attr] || v.form == dwFormImplicitConst {
+				continue
+			}
+			switch {
+			case v.form == dwFormString:
+				values = append(append(values, v.str...), 0)
+			case v.size > 0:
+				values = append(values, info[v.pos:v.pos+v.size]...)
+			case v.form != dwFormFlagPresent:
+				continue // a block; none of the attributes kept is one
+			}
+			spec = appendULEB(appendULEB(spec, v.attr), v.form)
+		}
+		if d.err != nil {
+			return fmt.Errorf("__debug_info: unit at %#x: %v", u.start, d.err)
+		}
+		key := string(appendULEB(spec, a.tag))
+		code, ok := codes[key]
+		if !ok {
+			code = uint64(len(codes) + 1)
+			codes[key] = code
+			newAbbrevs = appendULEB(appendULEB(newAbbrevs, code), a.tag)
+			newAbbrevs = append(newAbbrevs, 0) // no children
+			newAbbrevs = append(append(newAbbrevs, spec...), 0, 0)
+		}
+
+		start := uint64(len(newInfo))
+		newStart[u.start] = start
+		newInfo = append(newInfo, info[u.start:u.dies]...)
+		newInfo = append(appendULEB(newInfo, code), values...)
+		hdr := uint64(4)
+		if u.offSize == 8 {
+			hdr = 12
+		}
+		putOffset(newInfo[start+hdr-u.offSize:], u.offSize, uint64(len(newInfo))-start-hdr, o)
+		at := start + hdr + 2 // the abbreviation offset, past the version
+		if u.version >= 5 {
+			at += 2
+		}
+		putOffset(newInfo[at:], u.offSize, 0, o)
+	}
+	newAbbrevs = append(newAbbrevs, 0)
+
+	for name, s := range sections {
+		if edits[s].drop {
+			continue
+		}
+		switch {
+		case name == "debug_info":
+			edits[s] = sectionEdit{data: newInfo}
+		case name == "debug_abbrev":
+			edits[s] = sectionEdit{data: newAbbrevs}
+		case name == "debug_aranges":
+			b, err := editedData(edits, s)
+			if err != nil {
+				return err
+			}
+			nb, err := filterInfoIndexed(b, func(old uint64) (uint64, bool) {
+				n, ok := newStart[old]
+				return n, ok
+			}, o)
+			if err != nil {
+				return fmt.Errorf("__debug_aranges: %v", err)
+			}
+			edits[s] = sectionEdit{data: nb}
+		case !lineTableSections[name]:
+			edits[s] = sectionEdit{drop: true}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"os"
+	"strings"
+)
+
+// An arch is an architecture as lipo names it.
+type arch struct {
+	name   string
+	cpu    macho.Cpu
+	subCpu uint32
+	anySub bool // matches any subtype of cpu
+}
+
+var arches = []arch{
+	{name: "i386", cpu: macho.Cpu386, anySub: true},
+	{name: "x86_64", cpu: macho.CpuAmd64, anySub: true},
+	{name: "arm", cpu: macho.CpuArm, anySub: true},
+	{name: "arm64e", cpu: macho.CpuArm64, subCpu: uint32(macho.SubCpuArm64E)},
+	{name: "arm64", cpu: macho.CpuArm64, anySub: true},
+	{name: "ppc", cpu: macho.CpuPpc, anySub: true},
+	{name: "ppc64", cpu: macho.CpuPpc64, anySub: true},
+}
+
+// matches reports whether the slice for cpu and subCpu is of a.
+// Arm64 with any subtype but that of arm64e is arm64.
+func (a arch) matches(cpu macho.Cpu, subCpu uint32) bool {
+	sub := macho.CpuSubtype(subCpu).Base()
+	if a.cpu != cpu {
+		return false
+	}
+	if a.name == "arm64" {
+		return sub != macho.SubCpuArm64E
+	}
+	return a.anySub || macho.CpuSubtype(a.subCpu) == sub
+}
+
+// archName names the architecture of the slice for cpu and subCpu.
+func archName(cpu macho.Cpu, subCpu uint32) string {
+	for _, a := range arches {
+		if a.matches(cpu, subCpu) {
+			return a.name
+		}
+	}
+	return fmt.Sprintf("%v/%#x", cpu, subCpu)
+}
+
+// A lipoSlice is a thin Mach-O image, read from r.
+type lipoSlice struct {
+	macho.FatArchHeader // Offset is that in r
+	from                string
+	uuid                string
+	r                   io.ReaderAt
+	stamp               *Stamp // if sd made it, how
+}
+
+// sd lipo -thin arch input output
+// sd lipo -create input ... -o output
+func lipoCmd(args []string) {
+	fs := flag.NewFlagSet("lipo", flag.ExitOnError)
+	thin := fs.String("thin", "", "write the slice of the universal input for `arch` (arm64, arm64e, x86_64, i386, ...)")
+	create := fs.Bool("create", false, "write a universal file holding every slice of the inputs")
+	out := fs.String("o", "", "write the result to `file`")
+	fs.StringVar(out, "output", "", "the same as -o")
+	usage := func() {
+		fail("Usage: %s lipo -thin arch input output\n       %s lipo -create input ... -o output", os.Args[0], os.Args[0])
+	}
+	// As with lipo, flags may come after the inputs.
+	var inputs []string
+	for fs.Parse(args); fs.NArg() > 0; fs.Parse(args) {
+		inputs = append(inputs, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if *thin != "" && *out == "" && len(inputs) == 2 {
+		*out, inputs = inputs[1], inputs[:1]
+	}
+	if (*thin != "") == *create || *out == "" || len(inputs) == 0 || *thin != "" && len(inputs) != 1 {
+		usage()
+	}
+	var err error
+	if *create {
+		err = lipoCreate(inputs, *out)
+	} else {
+		err = lipoThin(inputs[0], *thin, *out)
+	}
+	if err != nil {
+		fail("%v", err)
+	}
+}
+
+// lipoThin writes the slice of the universal file in for the
+// architecture named name to out.
+func lipoThin(in, name, out string) error {
+	var a *arch
+	for i := range arches {
+		if arches[i].name == name {
+			a = &arches[i]
+		}
+	}
+	if a == nil {
+		return fmt.Errorf("unknown architecture %q", name)
+	}
+	r, slices, fat, err := openLipo(in)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if !fat {
+		return fmt.Errorf("%s: not a universal file", in)
+	}
+	for _, s := range slices {
+		if a.matches(s.Cpu, s.SubCpu) {
+			return writeLipo(out, in, nil, []lipoSlice{s})
+		}
+	}
+	var have []string
+	for _, s := range slices {
+		have = append(have, archName(s.Cpu, s.SubCpu))
+	}
+	return fmt.Errorf("%s does not contain %s, only %s", in, name, strings.Join(have, ", "))
+}
+
+// lipoCreate writes a universal file holding every slice of inputs,
+// which may be thin or universal, to out.
+func lipoCreate(inputs []string, out string) error {
+	var all []lipoSlice
+	for _, in := range inputs {
+		r, slices, _, err := openLipo(in)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		for _, s := range slices {
+			for _, t := range all {
+				if t.Cpu == s.Cpu && macho.CpuSubtype(t.SubCpu).Base() == macho.CpuSubtype(s.SubCpu).Base() {
+					return fmt.Errorf("%s and %s both contain %s", t.from, s.from, archName(s.Cpu, s.SubCpu))
+				}
+			}
+			all = append(all, s)
+		}
+	}
+	hdrs := make([]macho.FatArchHeader, len(all))
+	for i, s := range all {
+		hdrs[i] = macho.FatArchHeader{Cpu: s.Cpu, SubCpu: s.SubCpu, Size: s.Size}
+	}
+	if _, err := layoutFat(hdrs); err != nil {
+		return err
+	}
+	return writeLipo(out, inputs[0], hdrs, all)
+}
+
+// lipoSlices returns the slices of the Mach-O file r, named in, and
+// whether it is universal; if not, its one slice is the whole file.
+func lipoSlices(in string, r *os.File) ([]lipoSlice, bool, error) {
+	if !isFat(r) {
+		fi, err := r.Stat()
+		if err != nil {
+			return nil, false, err
+		}
+		if fi.Size() > 1<<32-1 {
+			return nil, false, fmt.Errorf("%s: too large for a universal file", in)
+		}
+		f, err := macho.NewFile(r)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %v", in, err)
+		}
+		return []lipoSlice{{macho.FatArchHeader{Cpu: f.Cpu, SubCpu: f.SubCpu, Size: uint32(fi.Size())}, in, uuidOf(f), r, stampOf(f)}}, false, nil
+	}
+	ff, err := macho.NewFatFile(r)
+	if err != nil {
+		return nil, true, fmt.Errorf("%s: %v", in, err)
+	}
+	var slices []lipoSlice
+	for _, a := range ff.Arches {
+		slices = append(slices, lipoSlice{a.FatArchHeader, in, uuidOf(a.File), r, stampOf(a.File)})
+	}
+	return slices, true, nil
+}
+
+// openLipo opens the Mach-O file in and returns its slices.
+func openLipo(in string) (*os.File, []lipoSlice, bool, error) {
+	r, err := os.Open(in)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	slices, fat, err := lipoSlices(in, r)
+	if err != nil {
+		r.Close()
+		return nil, nil, false, err
+	}
+	return r, slices, fat, nil
+}
+
+// writeLipo writes to out the slices, as a universal file laid out as
+// hdrs says, or if hdrs is nil, the one slice alone.  The output has
+// the permissions of the file like.
+func writeLipo(out, like string, hdrs []macho.FatArchHeader, slices []lipoSlice) error {
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(like); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	var size int64
+	if hdrs != nil {
+		hdr := make([]byte, macho.FatHeaderSize(len(hdrs)))
+		macho.PutFatHeader(hdr, hdrs)
+		_, err = f.Write(hdr)
+	}
+	for i, s := range slices {
+		if err != nil {
+			break
+		}
+		var at int64
+		if hdrs != nil {
+			at = int64(hdrs[i].Offset)
+		}
+		size = at + int64(s.Size)
+		_, err = io.Copy(io.NewOffsetWriter(f, at), io.NewSectionReader(s.r, int64(s.Offset), int64(s.Size)))
+	}
+	if err == nil {
+		err = f.Truncate(size)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
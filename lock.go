@@ -0,0 +1,186 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Concurrent runs of sd, such as CI jobs that share a symbol store or
+// build the same program, must not write the same dSYM, or change the
+// same store, at once, or the writes of one land among the other's.
+// So each first locks what it writes: a dSYM bundle (or a dSYM outside
+// any bundle), or a whole store.  A lock is a file, NAME.lock beside
+// the dSYM, or .sd.lock in the store, which is created only if it does
+// not already exist, records who holds it, and is removed when they are
+// done.  A lock held by a process of this host that has exited is
+// broken; any other is waited for as long as -lock-wait says, and then
+// reported as busy.
+
+// lockSuffix ends the name of the lock file of a dSYM.
+const lockSuffix = ".lock"
+
+// storeLockName is the name of the lock file of a store.
+const storeLockName = ".sd.lock"
+
+// A lockHolder is what a lock file records of the process holding it.
+type lockHolder struct {
+	PID   int       `json:"pid"`
+	Host  string    `json:"host"`
+	Since time.Time `json:"since"`
+	Args  []string  `json:"args"`
+}
+
+// A busyError says that what sd would write is locked by another run.
+type busyError struct {
+	what   string      // what is locked
+	file   string      // its lock file
+	holder *lockHolder // nil if the lock file could not be read
+	waited time.Duration
+}
+
+func (e *busyError) Error() string {
+	who := "another process"
+	if h := e.holder; h != nil {
+		who = fmt.Sprintf("sd (pid %d on %s, since %s)", h.PID, h.Host, h.Since.Format(time.RFC3339))
+	}
+	s := fmt.Sprintf("%s is busy: %s is writing it", e.what, who)
+	if e.waited > 0 {
+		s += fmt.Sprintf(", still after waiting %v", e.waited)
+	}
+	return s + fmt.Sprintf("; retry later, or use -lock-wait to wait for it; if no sd is running, remove %s", e.file)
+}
+
+// A fileLock is a lock held until unlock is called.  As fail exits
+// without running deferred calls, a caller holding a lock unlocks it
+// first; unlocking twice, or a nil lock, does nothing.
+type fileLock struct {
+	file string
+}
+
+func (l *fileLock) unlock() {
+	if l != nil && l.file != "" {
+		os.Remove(l.file)
+		l.file = ""
+	}
+}
+
+// lockDsym locks the dSYM bundle that holds path, or if none does,
+// path, waiting up to wait for another holder to let go of it.
+func lockDsym(path string, wait time.Duration) (*fileLock, error) {
+	what := lockTarget(path)
+	return acquireLock(what, what+lockSuffix, wait)
+}
+
+// lockStore locks the store dir, waiting up to wait for another holder
+// to let go of it.
+func lockStore(dir string, wait time.Duration) (*fileLock, error) {
+	return acquireLock("store "+dir, filepath.Join(dir, storeLockName), wait)
+}
+
+// lockTarget returns the innermost .dSYM bundle holding path, or path
+// if it is not in one.
+func lockTarget(path string) string {
+	for p := path; ; {
+		if hasDsymSuffix(filepath.Base(p)) {
+			return p
+		}
+		dir := filepath.Dir(p)
+		if dir == p {
+			return path
+		}
+		p = dir
+	}
+}
+
+// acquireLock takes the lock whose file is file, on what, retrying
+// until wait has passed.  It returns a *busyError if it could not.
+func acquireLock(what, file string, wait time.Duration) (*fileLock, error) {
+	me := lockHolder{PID: os.Getpid(), Since: time.Now().UTC().Truncate(time.Second), Args: os.Args}
+	me.Host, _ = os.Hostname()
+	b, err := json.Marshal(&me)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	delay := 50 * time.Millisecond
+	for {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(append(b, '\n'))
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(file)
+				return nil, fmt.Errorf("Could not lock %s, error=%v", what, err)
+			}
+			return &fileLock{file: file}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("Could not lock %s, error=%v", what, err)
+		}
+		h := readLockHolder(file)
+		if h != nil && me.Host != "" && h.Host == me.Host && h.PID != me.PID && !processAlive(h.PID) {
+			breakLock(file, h)
+			continue
+		}
+		waited := time.Since(start)
+		if waited >= wait {
+			return nil, &busyError{what: what, file: file, holder: h, waited: wait}
+		}
+		if d := wait - waited; delay > d {
+			delay = d
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
+	}
+}
+
+// readLockHolder returns who holds the lock file, or nil if it cannot
+// be read, as when it is still being written.
+func readLockHolder(file string) *lockHolder {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	h := new(lockHolder)
+	if json.Unmarshal(b, h) != nil || h.PID == 0 {
+		return nil
+	}
+	return h
+}
+
+// breakLock removes the lock file that h, now gone, left.  It moves the
+// file aside first, and puts it back if it turns out to be another's,
+// taken since h's was read.
+func breakLock(file string, h *lockHolder) {
+	aside := fmt.Sprintf("%s.%d", file, os.Getpid())
+	if os.Rename(file, aside) != nil {
+		return
+	}
+	if now := readLockHolder(aside); now == nil || now.PID != h.PID || !now.Since.Equal(h.Since) {
+		os.Link(aside, file)
+	}
+	os.Remove(aside)
+}
+
+// processAlive reports whether the process pid, of this host, may still
+// be running.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) != os.ErrProcessDone
+}
@@ -0,0 +1,45 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+// AddrToOffset returns the file offset of the byte at address addr,
+// and whether it has one.  Addresses outside every segment have none,
+// and neither do those in a segment's zero-filled tail (past Filesz) or
+// in a zero-fill section.
+func (t *FileTOC) AddrToOffset(addr uint64) (uint64, bool) {
+	for _, l := range t.Loads {
+		s, ok := l.(*Segment)
+		if !ok || addr < s.Addr || addr-s.Addr >= s.Memsz {
+			continue
+		}
+		if addr-s.Addr >= s.Filesz {
+			return 0, false
+		}
+		if first, n := uint64(s.Firstsect), uint64(s.Nsect); first+n <= uint64(len(t.Sections)) {
+			for _, sect := range t.Sections[first : first+n] {
+				if sect.Flags.IsZerofill() && addr >= sect.Addr && addr-sect.Addr < sect.Size {
+					return 0, false
+				}
+			}
+		}
+		return s.Offset + addr - s.Addr, true
+	}
+	return 0, false
+}
+
+// OffsetToAddr returns the address at which the byte at file offset
+// off is mapped, and whether it is.  The header and load commands are
+// mapped with the segment that starts at offset 0, usually __TEXT;
+// padding between segments, and anything past the last, is not mapped.
+func (t *FileTOC) OffsetToAddr(off uint64) (uint64, bool) {
+	for _, l := range t.Loads {
+		s, ok := l.(*Segment)
+		if !ok || off < s.Offset || off-s.Offset >= s.Filesz || off-s.Offset >= s.Memsz {
+			continue
+		}
+		return s.Addr + off - s.Offset, true
+	}
+	return 0, false
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import "fmt"
+
+// Alignment arithmetic for laying out Mach-O files.  Every align
+// argument must be a power of two; the functions panic otherwise,
+// since that is a bug in the caller, not a property of the input.
+// Sizes and addresses read from a file are not to be trusted, so
+// layout code should use CheckedAdd and CheckedRoundUp (or RoundUp,
+// which panics) rather than bare arithmetic that can silently wrap.
+
+// RoundUp returns x rounded up to a multiple of align.
+// It panics if the result does not fit in a uint64.
+func RoundUp(x, align uint64) uint64 {
+	r, ok := CheckedRoundUp(x, align)
+	if !ok {
+		panic(fmt.Sprintf("RoundUp(0x%x, 0x%x) overflows", x, align))
+	}
+	return r
+}
+
+// CheckedRoundUp returns x rounded up to a multiple of align,
+// and ok=false if the result does not fit in a uint64.
+func CheckedRoundUp(x, align uint64) (r uint64, ok bool) {
+	checkAlign(align)
+	s, ok := CheckedAdd(x, align-1)
+	if !ok {
+		return 0, false
+	}
+	return s &^ (align - 1), true
+}
+
+// RoundDown returns x rounded down to a multiple of align.
+func RoundDown(x, align uint64) uint64 {
+	checkAlign(align)
+	return x &^ (align - 1)
+}
+
+// IsAligned reports whether x is a multiple of align.
+func IsAligned(x, align uint64) bool {
+	checkAlign(align)
+	return x&(align-1) == 0
+}
+
+// CheckedAdd returns x+y, and ok=false if the sum does not fit in a uint64.
+func CheckedAdd(x, y uint64) (sum uint64, ok bool) {
+	sum = x + y
+	return sum, sum >= x
+}
+
+func checkAlign(align uint64) {
+	if align == 0 || align&(align-1) != 0 {
+		panic(fmt.Sprintf("alignment 0x%x is not a power of two", align))
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAlign(t *testing.T) {
+	tests := []struct {
+		x, align      uint64
+		up, down      uint64
+		upOK, aligned bool
+	}{
+		{0, 1, 0, 0, true, true},
+		{0, 4096, 0, 0, true, true},
+		{1, 8, 8, 0, true, false},
+		{8, 8, 8, 8, true, true},
+		{4097, 4096, 8192, 4096, true, false},
+		{math.MaxUint64, 1, math.MaxUint64, math.MaxUint64, true, true},
+		{math.MaxUint64, 2, 0, math.MaxUint64 - 1, false, false},
+		{math.MaxUint64 - 4094, 4096, 0, math.MaxUint64 - 4095, false, false},
+		{math.MaxUint64 - 4095, 4096, math.MaxUint64 - 4095, math.MaxUint64 - 4095, true, true},
+	}
+	for _, tt := range tests {
+		up, ok := CheckedRoundUp(tt.x, tt.align)
+		if ok != tt.upOK || ok && up != tt.up {
+			t.Errorf("CheckedRoundUp(%#x, %#x) = %#x, %v, want %#x, %v", tt.x, tt.align, up, ok, tt.up, tt.upOK)
+		}
+		if down := RoundDown(tt.x, tt.align); down != tt.down {
+			t.Errorf("RoundDown(%#x, %#x) = %#x, want %#x", tt.x, tt.align, down, tt.down)
+		}
+		if a := IsAligned(tt.x, tt.align); a != tt.aligned {
+			t.Errorf("IsAligned(%#x, %#x) = %v, want %v", tt.x, tt.align, a, tt.aligned)
+		}
+	}
+}
+
+func TestRoundUpPanics(t *testing.T) {
+	for _, c := range []struct{ x, align uint64 }{
+		{math.MaxUint64, 8}, // overflow
+		{1, 0},              // not a power of two
+		{1, 12},             // not a power of two
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RoundUp(%#x, %#x) did not panic", c.x, c.align)
+				}
+			}()
+			RoundUp(c.x, c.align)
+		}()
+	}
+}
+
+func TestCheckedAdd(t *testing.T) {
+	if s, ok := CheckedAdd(1, 2); s != 3 || !ok {
+		t.Errorf("CheckedAdd(1, 2) = %d, %v", s, ok)
+	}
+	if s, ok := CheckedAdd(math.MaxUint64, 0); s != math.MaxUint64 || !ok {
+		t.Errorf("CheckedAdd(max, 0) = %d, %v", s, ok)
+	}
+	if _, ok := CheckedAdd(math.MaxUint64, 1); ok {
+		t.Errorf("CheckedAdd(max, 1) did not report overflow")
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// A Builder makes a Mach-O file from nothing, rather than from another
+// file's FileTOC: the caller says what goes in it, its segments, their
+// sections and contents, its symbols, and its UUID, and Build works out
+// where each goes and returns the FileTOC, ready for WriteTo or Bytes.
+//
+// The load commands are the segments, in the order they were first
+// named, then LC_SYMTAB, if there are symbols, then LC_UUID, if there
+// is one.  In a file of type MhObject, every section is in the one
+// unnamed segment, as the compiler writes them, packed as their
+// alignment allows, at addresses from 0.  In any other file, each
+// segment starts at a page boundary, in the file and in memory, from
+// Addr on, and is as large, rounded up to pages, as its sections; the
+// symbols and their names follow the last segment, and a __LINKEDIT
+// segment, if there is one, holds them and must come last.
+type Builder struct {
+	FileHeader // Ncmd and Cmdsz are computed
+	ByteOrder  binary.ByteOrder
+
+	Addr     uint64 // where the first segment goes in memory
+	PageSize uint64 // a power of two; 0 means 4096
+
+	segs []*builderSegment
+	syms []Symbol
+	uuid *[16]byte
+}
+
+type builderSegment struct {
+	name  string
+	prot  uint32
+	sects []*builderSection
+	built *Segment
+}
+
+type builderSection struct {
+	seg, name string
+	flags     SecFlags
+	align     uint32 // log2
+	size      uint64
+	r         io.ReaderAt
+	built     *Section
+}
+
+// NewBuilder returns a Builder of a file for cpu and subcpu, of type
+// typ, in byte order o; whether the file is 64-bit is cpu's.
+func NewBuilder(cpu Cpu, subcpu uint32, typ HdrType, o binary.ByteOrder) *Builder {
+	magic := Magic32
+	if cpu&cpuArch64 != 0 {
+		magic = Magic64
+	}
+	return &Builder{FileHeader: FileHeader{Magic: magic, Cpu: cpu, SubCpu: subcpu, Type: typ}, ByteOrder: o}
+}
+
+// AddSegment names a segment, with protection prot (VM_PROT_* bits,
+// for both Prot and Maxprot), so that the file has it, in this order,
+// even if it has no sections.  Adding a section names its segment
+// too, with no protection.
+func (b *Builder) AddSegment(name string, prot uint32) {
+	b.segment(name).prot = prot
+}
+
+func (b *Builder) segment(name string) *builderSegment {
+	for _, g := range b.segs {
+		if g.name == name {
+			return g
+		}
+	}
+	g := &builderSegment{name: name}
+	b.segs = append(b.segs, g)
+	return g
+}
+
+// AddSection adds section seg,name holding data, aligned to 1<<align
+// bytes, with flags, and returns the number by which symbols refer to
+// it, n_sect.  The data is not copied until the file is written.
+func (b *Builder) AddSection(seg, name string, data []byte, align uint32, flags SecFlags) uint8 {
+	return b.AddSectionReader(seg, name, bytes.NewReader(data), uint64(len(data)), align, flags)
+}
+
+// AddSectionReader is AddSection for contents of size bytes read from
+// r, for a section too large to hold in memory.  For a zero-fill
+// section, r may be nil.
+func (b *Builder) AddSectionReader(seg, name string, r io.ReaderAt, size uint64, align uint32, flags SecFlags) uint8 {
+	g := b.segment(seg)
+	g.sects = append(g.sects, &builderSection{seg: seg, name: name, flags: flags, align: align, size: size, r: r})
+	n := 0
+	for _, g := range b.segs {
+		n += len(g.sects)
+	}
+	return uint8(n)
+}
+
+// AddSymbol adds a symbol; its Sect is a number AddSection returned,
+// or 0 for none.
+func (b *Builder) AddSymbol(s Symbol) {
+	b.syms = append(b.syms, s)
+}
+
+// SetUUID gives the file an LC_UUID.
+func (b *Builder) SetUUID(id [16]byte) {
+	b.uuid = &id
+}
+
+// Build lays out the file and returns its FileTOC, with the contents
+// of the sections and the symbol table registered to be written.  It
+// returns an error if a name is too long, a section follows a zero-fill
+// section in its segment, or the file is too large for its offsets.
+func (b *Builder) Build() (*FileTOC, error) {
+	page := b.PageSize
+	if page == 0 {
+		page = 1 << 12
+	}
+	if page&(page-1) != 0 {
+		return nil, fmt.Errorf("page size %#x is not a power of two", page)
+	}
+	h := b.FileHeader
+	h.Ncmd, h.Cmdsz = 0, 0
+	t := &FileTOC{FileHeader: h, ByteOrder: b.ByteOrder}
+	cmd := LcSegment
+	if t.Magic == Magic64 {
+		cmd = LcSegment64
+	}
+	object := t.Type == MhObject
+
+	// First the load commands, whose sizes fix where the contents go.
+	segs := b.segs
+	if object {
+		one := &builderSegment{prot: 7}
+		for _, g := range b.segs {
+			one.sects = append(one.sects, g.sects...)
+		}
+		segs = []*builderSegment{one}
+	}
+	if len(b.syms) > 0 {
+		for i, g := range segs {
+			if g.name == "__LINKEDIT" && (i != len(segs)-1 || len(g.sects) > 0) {
+				return nil, fmt.Errorf("segment __LINKEDIT, which holds the symbols, must come last and have no sections")
+			}
+		}
+	}
+	for _, g := range segs {
+		if len(g.name) > 16 {
+			return nil, fmt.Errorf("segment name %q is longer than 16 bytes", g.name)
+		}
+		g.built = &Segment{SegmentHeader: SegmentHeader{LoadCmd: cmd, Name: g.name, Maxprot: g.prot, Prot: g.prot}}
+		t.AddSegment(g.built)
+		zerofill := false
+		for _, s := range g.sects {
+			if len(s.name) > 16 || len(s.seg) > 16 {
+				return nil, fmt.Errorf("section name %s,%s is longer than 16 bytes", s.seg, s.name)
+			}
+			if zerofill && !s.flags.IsZerofill() {
+				return nil, fmt.Errorf("section %s,%s follows a zero-fill section", s.seg, s.name)
+			}
+			zerofill = s.flags.IsZerofill()
+			s.built = &Section{SectionHeader: SectionHeader{Name: s.name, Seg: s.seg, Size: s.size, Align: s.align, Flags: s.flags}}
+			t.AddSection(s.built)
+		}
+	}
+	var symtab *Symtab
+	if len(b.syms) > 0 {
+		symtab = &Symtab{SymtabCmd: SymtabCmd{LoadCmd: LcSymtab}, Syms: b.syms}
+		symtab.Len = symtab.LoadSize(t)
+		symtab.Nsyms = uint32(len(b.syms))
+		t.AddLoad(symtab)
+	}
+	if b.uuid != nil {
+		u := &Uuid{UuidCmd: UuidCmd{LoadCmd: LcUuid, Id: *b.uuid}}
+		u.Len = u.LoadSize(t)
+		t.AddLoad(u)
+	}
+
+	// Then the contents.
+	off, addr := uint64(t.TOCSize()), b.Addr
+	if !object {
+		off = RoundUp(off, page)
+	}
+	for _, g := range segs {
+		seg := g.built
+		seg.Addr = addr
+		if err := t.LayOutSegment(seg, off); err != nil {
+			return nil, err
+		}
+		for _, s := range g.sects {
+			t.AddSectionPayload(s.built, s.r)
+		}
+		off = seg.Offset + seg.Filesz
+		if object {
+			break
+		}
+		if seg.Filesz == 0 {
+			seg.Offset = 0 // such as __PAGEZERO, or __LINKEDIT, placed below
+		}
+		seg.Filesz = RoundUp(seg.Filesz, page)
+		seg.Memsz = RoundUp(seg.Memsz, page)
+		off, addr = RoundUp(off, page), seg.Addr+seg.Memsz
+	}
+
+	if symtab != nil {
+		size := uint64(t.SymbolSize())
+		off = RoundUp(off, t.LoadAlign())
+		names := make([]uint32, len(b.syms))
+		strs := []byte{' ', 0}
+		for i, s := range b.syms {
+			if s.Name == "" {
+				names[i] = 1 // the NUL of " "
+			} else {
+				names[i] = uint32(len(strs))
+				strs = append(append(strs, s.Name...), 0)
+			}
+		}
+		for uint64(len(strs))%t.LoadAlign() != 0 {
+			strs = append(strs, 0)
+		}
+		nsyms := uint64(len(b.syms)) * size
+		symtab.Symoff = uint32(off)
+		symtab.Stroff = uint32(off + nsyms)
+		symtab.Strsize = uint32(len(strs))
+		if off+nsyms+uint64(len(strs)) > 1<<32-1 {
+			return nil, fmt.Errorf("the symbol table ends beyond 4GB, which its offset cannot reach")
+		}
+		// The symbols are encoded as they are written, so that they
+		// have any section numbers InsertSection or RemoveSection
+		// have given them since.
+		syms := func() (io.ReadCloser, error) {
+			buf := make([]byte, nsyms)
+			for i, s := range symtab.Syms {
+				n := Nlist64{Name: names[i], Type: s.Type, Sect: s.Sect, Desc: s.Desc, Value: s.Value}
+				if t.Magic == Magic64 {
+					n.Put64(buf[uint64(i)*size:], t.ByteOrder)
+				} else {
+					n.Put32(buf[uint64(i)*size:], t.ByteOrder)
+				}
+			}
+			return ioutil.NopCloser(bytes.NewReader(buf)), nil
+		}
+		t.payloads = append(t.payloads, &payload{off: off, n: nsyms, open: syms})
+		t.AddPayload(off+nsyms, bytes.NewReader(strs), uint64(len(strs)))
+		if len(segs) > 0 && segs[len(segs)-1].name == "__LINKEDIT" {
+			seg := segs[len(segs)-1].built
+			seg.Offset, seg.Filesz = off, nsyms+uint64(len(strs))
+			seg.Memsz = RoundUp(seg.Filesz, page)
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Capabilities summarizes which features of the Mach-O format a file
+// uses, and so what can be done with it: a file with classic dyld info
+// can have its rebases and binds rewritten, but one with chained
+// fixups keeps them in its data; compressed DWARF must be uncompressed
+// before most debuggers can read it; and an encrypted file's text
+// cannot be disassembled or unwound, nor a signed file be edited
+// without invalidating its signature.
+type Capabilities struct {
+	ChainedFixups   bool // LC_DYLD_CHAINED_FIXUPS
+	DyldInfo        bool // LC_DYLD_INFO or LC_DYLD_INFO_ONLY
+	DWARF           bool // sections in __DWARF
+	CompressedDWARF bool // __zdebug sections in __DWARF
+	SplitSeg        bool // LC_SEGMENT_SPLIT_INFO
+	SplitSegV2      bool // LC_SEGMENT_SPLIT_INFO in DYLD_CACHE_ADJ_V2_FORMAT
+	CodeSignature   bool // LC_CODE_SIGNATURE
+	Encrypted       bool // LC_ENCRYPTION_INFO(_64) with a nonzero cryptid
+}
+
+// dyldCacheAdjV2Format is the first byte of split seg info in the
+// second format.
+const dyldCacheAdjV2Format = 0x7f
+
+// Capabilities reports which features of the format f uses.
+func (f *File) Capabilities() (Capabilities, error) {
+	var c Capabilities
+	for _, l := range f.Loads {
+		switch l := l.(type) {
+		case *DyldInfo:
+			c.DyldInfo = true
+		case *EncryptionInfo:
+			c.Encrypted = c.Encrypted || l.CryptId != 0
+		case *LinkEditData:
+			switch l.Command() {
+			case LcDyldChainedFixups:
+				c.ChainedFixups = true
+			case LcCodeSignature:
+				c.CodeSignature = true
+			case LcSegmentSplitInfo:
+				c.SplitSeg = true
+				if l.DataLen > 0 {
+					var b [1]byte
+					if _, err := f.r.ReadAt(b[:], int64(l.DataOff)); err != nil {
+						return c, fmt.Errorf("reading %v: %v", l.Command(), err)
+					}
+					c.SplitSegV2 = b[0] == dyldCacheAdjV2Format
+				}
+			}
+		}
+	}
+	for _, s := range f.Sections {
+		if s.Seg == "__DWARF" {
+			c.DWARF = true
+			c.CompressedDWARF = c.CompressedDWARF || strings.HasPrefix(s.Name, "__z")
+		}
+	}
+	return c, nil
+}
+
+// String lists the features c records, in the order of its fields, or
+// returns "none".
+func (c Capabilities) String() string {
+	var s []string
+	for _, f := range []struct {
+		has  bool
+		name string
+	}{
+		{c.ChainedFixups, "chained fixups"},
+		{c.DyldInfo, "dyld info"},
+		{c.DWARF && !c.CompressedDWARF, "DWARF"},
+		{c.CompressedDWARF, "compressed DWARF"},
+		{c.SplitSeg && !c.SplitSegV2, "split seg info"},
+		{c.SplitSegV2, "split seg info v2"},
+		{c.CodeSignature, "code signature"},
+		{c.Encrypted, "encryption"},
+	} {
+		if f.has {
+			s = append(s, f.name)
+		}
+	}
+	if len(s) == 0 {
+		return "none"
+	}
+	return strings.Join(s, ", ")
+}
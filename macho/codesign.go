@@ -0,0 +1,366 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+)
+
+// Code signature blob magic numbers (CSMAGIC_*).  Code signatures are
+// big-endian whatever the byte order of the image.
+const (
+	CsMagicRequirement        uint32 = 0xfade0c00
+	CsMagicRequirements       uint32 = 0xfade0c01
+	CsMagicCodeDirectory      uint32 = 0xfade0c02
+	CsMagicEmbeddedSignature  uint32 = 0xfade0cc0
+	CsMagicBlobWrapper        uint32 = 0xfade0b01 // the CMS signature
+	CsMagicEntitlements       uint32 = 0xfade7171
+	CsMagicEntitlementsDER    uint32 = 0xfade7172
+	csSuperBlobHeaderSize            = 12
+	csBlobIndexSize                  = 8
+	csCodeDirectoryHeaderSize        = 44 // through spare2
+)
+
+// A CodeSignatureSlot is the role of a blob in a code signature
+// (CSSLOT_*).
+type CodeSignatureSlot uint32
+
+const (
+	CsSlotCodeDirectory          CodeSignatureSlot = 0
+	CsSlotInfo                   CodeSignatureSlot = 1
+	CsSlotRequirements           CodeSignatureSlot = 2
+	CsSlotResourceDir            CodeSignatureSlot = 3
+	CsSlotApplication            CodeSignatureSlot = 4
+	CsSlotEntitlements           CodeSignatureSlot = 5
+	CsSlotEntitlementsDER        CodeSignatureSlot = 7
+	CsSlotAlternateCodeDirectory CodeSignatureSlot = 0x1000 // the first of 5
+	CsSlotSignature              CodeSignatureSlot = 0x10000
+)
+
+var codeSignatureSlotStrings = []intName{
+	{uint32(CsSlotCodeDirectory), "CsSlotCodeDirectory"},
+	{uint32(CsSlotInfo), "CsSlotInfo"},
+	{uint32(CsSlotRequirements), "CsSlotRequirements"},
+	{uint32(CsSlotResourceDir), "CsSlotResourceDir"},
+	{uint32(CsSlotApplication), "CsSlotApplication"},
+	{uint32(CsSlotEntitlements), "CsSlotEntitlements"},
+	{uint32(CsSlotEntitlementsDER), "CsSlotEntitlementsDER"},
+	{uint32(CsSlotAlternateCodeDirectory), "CsSlotAlternateCodeDirectory"},
+	{uint32(CsSlotSignature), "CsSlotSignature"},
+}
+
+func (i CodeSignatureSlot) String() string {
+	return stringName(uint32(i), codeSignatureSlotStrings, false)
+}
+func (i CodeSignatureSlot) GoString() string {
+	return stringName(uint32(i), codeSignatureSlotStrings, true)
+}
+
+// isCodeDirectory reports whether the blob in slot s is a code
+// directory, the primary one or an alternate.
+func (s CodeSignatureSlot) isCodeDirectory() bool {
+	return s == CsSlotCodeDirectory || s >= CsSlotAlternateCodeDirectory && s < CsSlotAlternateCodeDirectory+5
+}
+
+// A CodeHashType is the hash a code directory uses (CS_HASHTYPE_*).
+type CodeHashType uint8
+
+const (
+	CodeHashSHA1            CodeHashType = 1
+	CodeHashSHA256          CodeHashType = 2
+	CodeHashSHA256Truncated CodeHashType = 3 // SHA-256, cut to 20 bytes
+	CodeHashSHA384          CodeHashType = 4
+)
+
+var codeHashTypeStrings = []intName{
+	{uint32(CodeHashSHA1), "CodeHashSHA1"},
+	{uint32(CodeHashSHA256), "CodeHashSHA256"},
+	{uint32(CodeHashSHA256Truncated), "CodeHashSHA256Truncated"},
+	{uint32(CodeHashSHA384), "CodeHashSHA384"},
+}
+
+func (i CodeHashType) String() string   { return stringName(uint32(i), codeHashTypeStrings, false) }
+func (i CodeHashType) GoString() string { return stringName(uint32(i), codeHashTypeStrings, true) }
+
+// New returns a new hash of type t, or nil if t is unknown.
+func (t CodeHashType) New() hash.Hash {
+	switch t {
+	case CodeHashSHA1:
+		return sha1.New()
+	case CodeHashSHA256, CodeHashSHA256Truncated:
+		return sha256.New()
+	case CodeHashSHA384:
+		return sha512.New384()
+	}
+	return nil
+}
+
+// cdHashSize is the length of a cdhash, whatever the hash.
+const cdHashSize = 20
+
+// A CodeSignature is the embedded code signature of LC_CODE_SIGNATURE:
+// a SuperBlob, an index of blobs.
+type CodeSignature struct {
+	Blobs []CodeSignatureBlob // in index order
+
+	// The code directories, the primary first, then any alternates;
+	// the requirements; and the entitlements, in their property list
+	// form, or "" if there are none.
+	CodeDirectories []*CodeDirectory
+	Requirements    []Requirement
+	Entitlements    string
+}
+
+// A CodeSignatureBlob is one blob of a code signature.
+type CodeSignatureBlob struct {
+	Slot   CodeSignatureSlot
+	Offset uint32 // from the start of the signature
+	Magic  uint32
+	Data   []byte // the whole blob, its header included
+}
+
+// A CodeDirectory is a CodeDirectory blob: the hashes of the pages of
+// the image and of the special slots, such as the requirements, that
+// the signature covers.
+type CodeDirectory struct {
+	Version       uint32
+	Flags         uint32
+	HashType      CodeHashType
+	HashSize      uint8
+	Platform      uint8
+	PageSize      uint32 // in bytes; 0 if the code is hashed as one page
+	Identifier    string
+	TeamID        string // "" before version 0x20200
+	NSpecialSlots uint32
+	CodeLimit     uint64 // the end of the code signed, in bytes from the start of the image
+	ExecSegBase   uint64 // from version 0x20400
+	ExecSegLimit  uint64
+	ExecSegFlags  uint64
+	CodeHashes    [][]byte // one for each page, in order
+
+	// The hash of the directory itself, cut to 20 bytes, which names
+	// the signature to the system.
+	CDHash []byte
+}
+
+// A RequirementType is the use of a code requirement (kSecRequirementType).
+type RequirementType uint32
+
+const (
+	RequirementHost       RequirementType = 1
+	RequirementGuest      RequirementType = 2
+	RequirementDesignated RequirementType = 3
+	RequirementLibrary    RequirementType = 4
+	RequirementPlugin     RequirementType = 5
+)
+
+var requirementTypeStrings = []intName{
+	{uint32(RequirementHost), "RequirementHost"},
+	{uint32(RequirementGuest), "RequirementGuest"},
+	{uint32(RequirementDesignated), "RequirementDesignated"},
+	{uint32(RequirementLibrary), "RequirementLibrary"},
+	{uint32(RequirementPlugin), "RequirementPlugin"},
+}
+
+func (i RequirementType) String() string { return stringName(uint32(i), requirementTypeStrings, false) }
+func (i RequirementType) GoString() string {
+	return stringName(uint32(i), requirementTypeStrings, true)
+}
+
+// A Requirement is one code requirement of a Requirements blob.  The
+// expression is left compiled.
+type Requirement struct {
+	Type RequirementType
+	Kind uint32 // 1 for an expression
+	Expr []byte // the compiled expression
+}
+
+// CodeSignature decodes f's embedded code signature.  It returns nil if
+// f has no LC_CODE_SIGNATURE.
+func (f *File) CodeSignature() (*CodeSignature, error) {
+	for _, l := range f.Loads {
+		le, ok := l.(*LinkEditData)
+		if !ok || le.Command() != LcCodeSignature {
+			continue
+		}
+		b := make([]byte, le.DataLen)
+		if _, err := f.r.ReadAt(b, int64(le.DataOff)); err != nil {
+			return nil, fmt.Errorf("reading LC_CODE_SIGNATURE: %v", err)
+		}
+		cs, err := ParseCodeSignature(b)
+		if err != nil {
+			return nil, fmt.Errorf("LC_CODE_SIGNATURE: %v", err)
+		}
+		return cs, nil
+	}
+	return nil, nil
+}
+
+// ParseCodeSignature decodes the SuperBlob b, an embedded code
+// signature.  Padding after the SuperBlob is ignored.
+func ParseCodeSignature(b []byte) (*CodeSignature, error) {
+	bo := binary.BigEndian
+	sb, err := csBlob(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	if magic := bo.Uint32(sb); magic != CsMagicEmbeddedSignature || len(sb) < csSuperBlobHeaderSize {
+		return nil, fmt.Errorf("bad SuperBlob (magic %#x, %d bytes)", magic, len(sb))
+	}
+	count := bo.Uint32(sb[8:])
+	if count > uint32(len(sb)-csSuperBlobHeaderSize)/csBlobIndexSize {
+		return nil, fmt.Errorf("SuperBlob index of %d blobs overruns it", count)
+	}
+	cs := new(CodeSignature)
+	for i := uint32(0); i < count; i++ {
+		ix := sb[csSuperBlobHeaderSize+i*csBlobIndexSize:]
+		slot, off := CodeSignatureSlot(bo.Uint32(ix)), bo.Uint32(ix[4:])
+		data, err := csBlob(sb, off)
+		if err != nil {
+			return nil, fmt.Errorf("%v blob: %v", slot, err)
+		}
+		magic := bo.Uint32(data)
+		cs.Blobs = append(cs.Blobs, CodeSignatureBlob{Slot: slot, Offset: off, Magic: magic, Data: data})
+		switch {
+		case slot.isCodeDirectory() && magic == CsMagicCodeDirectory:
+			cd, err := parseCodeDirectory(data)
+			if err != nil {
+				return nil, fmt.Errorf("%v blob: %v", slot, err)
+			}
+			if slot == CsSlotCodeDirectory {
+				cs.CodeDirectories = append([]*CodeDirectory{cd}, cs.CodeDirectories...)
+			} else {
+				cs.CodeDirectories = append(cs.CodeDirectories, cd)
+			}
+		case slot == CsSlotRequirements && magic == CsMagicRequirements:
+			cs.Requirements, err = parseRequirements(data)
+			if err != nil {
+				return nil, fmt.Errorf("%v blob: %v", slot, err)
+			}
+		case slot == CsSlotEntitlements && magic == CsMagicEntitlements:
+			cs.Entitlements = string(data[8:])
+		}
+	}
+	return cs, nil
+}
+
+// csBlob returns the blob at off in b, checking that its length, from
+// its header, fits.
+func csBlob(b []byte, off uint32) ([]byte, error) {
+	if uint64(off)+8 > uint64(len(b)) {
+		return nil, fmt.Errorf("blob at %#x is outside the signature", off)
+	}
+	n := binary.BigEndian.Uint32(b[off+4:])
+	if n < 8 || uint64(off)+uint64(n) > uint64(len(b)) {
+		return nil, fmt.Errorf("blob at %#x of %d bytes overruns the signature", off, n)
+	}
+	return b[off : off+n], nil
+}
+
+// parseCodeDirectory decodes the CodeDirectory blob b.
+func parseCodeDirectory(b []byte) (*CodeDirectory, error) {
+	bo := binary.BigEndian
+	if len(b) < csCodeDirectoryHeaderSize {
+		return nil, fmt.Errorf("code directory of %d bytes is too short", len(b))
+	}
+	cd := &CodeDirectory{
+		Version:       bo.Uint32(b[8:]),
+		Flags:         bo.Uint32(b[12:]),
+		NSpecialSlots: bo.Uint32(b[24:]),
+		CodeLimit:     uint64(bo.Uint32(b[32:])),
+		HashSize:      b[36],
+		HashType:      CodeHashType(b[37]),
+		Platform:      b[38],
+	}
+	if b[39] != 0 {
+		if b[39] >= 32 {
+			return nil, fmt.Errorf("page size 2**%d is too large", b[39])
+		}
+		cd.PageSize = 1 << b[39]
+	}
+	hashOff, identOff, nCodeSlots := bo.Uint32(b[16:]), bo.Uint32(b[20:]), bo.Uint32(b[28:])
+	var teamOff uint32
+	if cd.Version >= 0x20200 && len(b) >= 52 {
+		teamOff = bo.Uint32(b[48:])
+	}
+	if cd.Version >= 0x20300 && len(b) >= 64 {
+		if limit := bo.Uint64(b[56:]); limit != 0 {
+			cd.CodeLimit = limit
+		}
+	}
+	if cd.Version >= 0x20400 && len(b) >= 88 {
+		cd.ExecSegBase = bo.Uint64(b[64:])
+		cd.ExecSegLimit = bo.Uint64(b[72:])
+		cd.ExecSegFlags = bo.Uint64(b[80:])
+	}
+
+	var err error
+	if cd.Identifier, err = csString(b, identOff); err != nil {
+		return nil, fmt.Errorf("identifier: %v", err)
+	}
+	if teamOff != 0 {
+		if cd.TeamID, err = csString(b, teamOff); err != nil {
+			return nil, fmt.Errorf("team ID: %v", err)
+		}
+	}
+
+	size := uint64(cd.HashSize)
+	if uint64(cd.NSpecialSlots)*size > uint64(hashOff) || uint64(hashOff)+uint64(nCodeSlots)*size > uint64(len(b)) {
+		return nil, fmt.Errorf("%d special and %d code hashes at %#x overrun the directory", cd.NSpecialSlots, nCodeSlots, hashOff)
+	}
+	for i := uint64(0); i < uint64(nCodeSlots); i++ {
+		at := uint64(hashOff) + i*size
+		cd.CodeHashes = append(cd.CodeHashes, b[at:at+size])
+	}
+
+	h := cd.HashType.New()
+	if h == nil {
+		return nil, fmt.Errorf("unknown hash type %v", cd.HashType)
+	}
+	h.Write(b)
+	cd.CDHash = h.Sum(nil)[:cdHashSize]
+	return cd, nil
+}
+
+// csString returns the NUL-terminated string at off in b.
+func csString(b []byte, off uint32) (string, error) {
+	if uint64(off) >= uint64(len(b)) {
+		return "", fmt.Errorf("offset %#x is outside the blob", off)
+	}
+	d := &readBuf{b: b, off: uint64(off)}
+	s := d.cstring()
+	return s, d.err
+}
+
+// parseRequirements decodes the Requirements blob b.
+func parseRequirements(b []byte) ([]Requirement, error) {
+	bo := binary.BigEndian
+	if len(b) < csSuperBlobHeaderSize {
+		return nil, fmt.Errorf("requirements of %d bytes are too short", len(b))
+	}
+	count := bo.Uint32(b[8:])
+	if count > uint32(len(b)-csSuperBlobHeaderSize)/csBlobIndexSize {
+		return nil, fmt.Errorf("index of %d requirements overruns the blob", count)
+	}
+	var reqs []Requirement
+	for i := uint32(0); i < count; i++ {
+		ix := b[csSuperBlobHeaderSize+i*csBlobIndexSize:]
+		typ, off := RequirementType(bo.Uint32(ix)), bo.Uint32(ix[4:])
+		r, err := csBlob(b, off)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", typ, err)
+		}
+		if magic := bo.Uint32(r); magic != CsMagicRequirement || len(r) < 12 {
+			return nil, fmt.Errorf("%v: bad requirement blob (magic %#x, %d bytes)", typ, magic, len(r))
+		}
+		reqs = append(reqs, Requirement{Type: typ, Kind: bo.Uint32(r[8:]), Expr: r[12:]})
+	}
+	return reqs, nil
+}
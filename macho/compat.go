@@ -0,0 +1,58 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+// This file eases moving code from the standard library's debug/macho
+// to this package, which can also write and edit Mach-O files.  Most
+// of debug/macho's API is here under the same names: Open, NewFile,
+// OpenFat, NewFatFile, ErrNotFat, FormatError, File and its Symtab,
+// Dysymtab, Loads, and Sections, and its Close, DWARF, Section,
+// Segment, ImportedSymbols, and ImportedLibraries methods; Section
+// and Segment with Data, Open, and ReadAt; Cpu, Symbol, Reloc, and
+// the RelocType enums.  The declarations below supply the names that
+// differ.  What cannot be matched is:
+//
+//   - A SegmentHeader's command is its embedded LoadCmd, not a field
+//     named Cmd; use s.Command() or s.LoadCmd for debug/macho's s.Cmd.
+//   - Load is an interface for writing load commands, not for reading
+//     their bytes, and has no Raw method; use File.RawLoad(i) for
+//     debug/macho's f.Loads[i].Raw().
+//   - A FileHeader's Flags are HdrFlags, and the Flag constants are of
+//     that type, where debug/macho has uint32.
+
+// Type is debug/macho's name for HdrType.
+type Type = HdrType
+
+// debug/macho's names for the file types.
+const (
+	TypeObj    = MhObject
+	TypeExec   = MhExecute
+	TypeDylib  = MhDylib
+	TypeBundle = MhBundle
+)
+
+// debug/macho's names for the load commands it knows.
+const (
+	LoadCmdSegment    = LcSegment
+	LoadCmdSymtab     = LcSymtab
+	LoadCmdThread     = LcThread
+	LoadCmdUnixThread = LcUnixthread
+	LoadCmdDysymtab   = LcDysymtab
+	LoadCmdDylib      = LcDylib
+	LoadCmdDylinker   = LcLoadDylinker
+	LoadCmdSegment64  = LcSegment64
+	LoadCmdRpath      = LcRpath
+)
+
+// RawLoad returns the bytes of f's i'th load command as they were read,
+// however f.Loads has since been edited, as debug/macho's Load.Raw
+// does.  It returns nil if f was not read from a file or had fewer
+// load commands.
+func (f *File) RawLoad(i int) []byte {
+	if i < 0 || i >= len(f.raw) {
+		return nil
+	}
+	return f.raw[i]
+}
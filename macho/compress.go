@@ -0,0 +1,215 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// A Compression describes how the contents of one compressed section
+// are framed: the format recognized, where the compressed stream starts
+// within the section, and the size of the contents once uncompressed.
+type Compression struct {
+	Format string
+	Offset uint64
+	Size   uint64
+
+	// NewReader returns a reader of the uncompressed contents, given
+	// the compressed stream.  If nil, the stream is zlib.
+	NewReader func(io.Reader) (io.ReadCloser, error)
+}
+
+// A CompressionFormat recognizes one framing of compressed section
+// contents, given at most the first MaxCompressionHeader bytes of the
+// section.  It reports whether the framing is its own, and if so how to
+// uncompress it.
+type CompressionFormat func(hdr []byte) (Compression, bool)
+
+// MaxCompressionHeader is the most bytes of a section passed to a
+// CompressionFormat.
+const MaxCompressionHeader = 64
+
+var (
+	compressionMu      sync.Mutex
+	compressionFormats = []CompressionFormat{goZlib, zlib32, elfChdr64, elfChdr32}
+)
+
+// RegisterCompression adds f to the formats tried on compressed
+// sections.  Formats are tried in the order registered, after the
+// built-in ones: Go's "ZLIB" with a 64-bit big-endian size, "ZLIB" with
+// a 32-bit size, and ELF-style Elf64_Chdr and Elf32_Chdr headers with
+// zlib contents, as some LLVM-based producers write.
+func RegisterCompression(f CompressionFormat) {
+	compressionMu.Lock()
+	compressionFormats = append(compressionFormats, f)
+	compressionMu.Unlock()
+}
+
+// Compression reports how s is compressed, or nil if it is not.  Only
+// sections whose names begin with "__z" are compressed; if such a
+// section is in no known format, Compression returns an error rather
+// than have it mistaken for uncompressed contents.
+func (s *Section) Compression() (*Compression, error) {
+	if !strings.HasPrefix(s.Name, "__z") {
+		return nil, nil
+	}
+	hdr := make([]byte, MaxCompressionHeader)
+	if uint64(len(hdr)) > s.Size {
+		hdr = hdr[:s.Size]
+	}
+	n, err := s.sr.ReadAt(hdr, 0)
+	if n < len(hdr) {
+		return nil, fmt.Errorf("section %s: reading compression header: %v", s.Name, err)
+	}
+	compressionMu.Lock()
+	formats := compressionFormats
+	compressionMu.Unlock()
+	for _, f := range formats {
+		if c, ok := f(hdr); ok {
+			if c.Offset > s.Size {
+				return nil, fmt.Errorf("section %s: %s header claims %d bytes", s.Name, c.Format, c.Offset)
+			}
+			return &c, nil
+		}
+	}
+	if len(hdr) > 16 {
+		hdr = hdr[:16]
+	}
+	return nil, fmt.Errorf("section %s: unrecognized compression header %x", s.Name, hdr)
+}
+
+// UncompressedReader returns a reader of the contents of s, inflating
+// them as they are read if s is compressed.  The reader fails with
+// io.ErrUnexpectedEOF if the compressed stream ends before the size its
+// header promised, and stops at that size even if the stream does not.
+func (s *Section) UncompressedReader() (io.ReadCloser, error) {
+	c, err := s.Compression()
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return ioutil.NopCloser(io.NewSectionReader(s.sr, 0, s.sr.Size())), nil
+	}
+	r := io.NewSectionReader(s.sr, int64(c.Offset), int64(s.Size-c.Offset))
+	var rc io.ReadCloser
+	if c.NewReader != nil {
+		rc, err = c.NewReader(r)
+	} else {
+		rc, err = zlib.NewReader(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("section %s: %s: %v", s.Name, c.Format, err)
+	}
+	return &sizedReader{rc, c.Size}, nil
+}
+
+// UncompressedData reads and returns the contents of s, uncompressed.
+// Memory grows as the contents are inflated, so a header claiming an
+// absurd size costs nothing until the data backs it up.
+func (s *Section) UncompressedData() ([]byte, error) {
+	c, err := s.Compression()
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return s.Data()
+	}
+	r, err := s.UncompressedReader()
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(r)
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("section %s: %s: %v", s.Name, c.Format, err)
+	}
+	return b, nil
+}
+
+// A sizedReader reads exactly n bytes from r.
+type sizedReader struct {
+	r io.ReadCloser
+	n uint64
+}
+
+func (z *sizedReader) Read(b []byte) (int, error) {
+	if z.n == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(b)) > z.n {
+		b = b[:z.n]
+	}
+	n, err := z.r.Read(b)
+	z.n -= uint64(n)
+	switch {
+	case z.n == 0:
+		err = nil
+	case err == io.EOF:
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (z *sizedReader) Close() error { return z.r.Close() }
+
+// isZlib reports whether b begins with a zlib stream header using deflate.
+func isZlib(b []byte) bool {
+	return len(b) >= 2 && b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
+
+func goZlib(hdr []byte) (Compression, bool) {
+	if len(hdr) < 14 || string(hdr[:4]) != "ZLIB" || !isZlib(hdr[12:]) {
+		return Compression{}, false
+	}
+	return Compression{Format: "ZLIB", Offset: 12, Size: binary.BigEndian.Uint64(hdr[4:])}, true
+}
+
+func zlib32(hdr []byte) (Compression, bool) {
+	if len(hdr) < 10 || string(hdr[:4]) != "ZLIB" || !isZlib(hdr[8:]) {
+		return Compression{}, false
+	}
+	return Compression{Format: "ZLIB32", Offset: 8, Size: uint64(binary.BigEndian.Uint32(hdr[4:]))}, true
+}
+
+// elfCompressZlib is ELFCOMPRESS_ZLIB, the ch_type of a zlib Chdr.
+const elfCompressZlib = 1
+
+// chdrOrder returns the byte order in which hdr starts with a 32-bit
+// ch_type of elfCompressZlib.
+func chdrOrder(hdr []byte) (binary.ByteOrder, bool) {
+	switch {
+	case len(hdr) < 4:
+		return nil, false
+	case binary.LittleEndian.Uint32(hdr) == elfCompressZlib:
+		return binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr) == elfCompressZlib:
+		return binary.BigEndian, true
+	}
+	return nil, false
+}
+
+func elfChdr64(hdr []byte) (Compression, bool) {
+	o, ok := chdrOrder(hdr)
+	if !ok || len(hdr) < 26 || !isZlib(hdr[24:]) {
+		return Compression{}, false
+	}
+	return Compression{Format: "Elf64_Chdr", Offset: 24, Size: o.Uint64(hdr[8:])}, true
+}
+
+func elfChdr32(hdr []byte) (Compression, bool) {
+	o, ok := chdrOrder(hdr)
+	if !ok || len(hdr) < 14 || !isZlib(hdr[12:]) {
+		return Compression{}, false
+	}
+	return Compression{Format: "Elf32_Chdr", Offset: 12, Size: uint64(o.Uint32(hdr[4:]))}, true
+}
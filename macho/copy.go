@@ -0,0 +1,61 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"fmt"
+	"io"
+)
+
+// copyBufferSize bounds the memory used by the DataTo methods.
+const copyBufferSize = 64 << 10
+
+// DataTo writes the contents of the segment to w, as Data would return
+// them, but through a buffer of bounded size.  It returns the number of
+// bytes written.
+func (s *Segment) DataTo(w io.Writer) (int64, error) {
+	return copyRange(w, s.sr, 0, s.sr.Size(), "segment "+s.Name)
+}
+
+// DataRangeTo writes the n bytes of the segment starting at off to w,
+// through a buffer of bounded size.  It returns the number of bytes
+// written.
+func (s *Segment) DataRangeTo(w io.Writer, off, n int64) (int64, error) {
+	return copyRange(w, s.sr, off, n, "segment "+s.Name)
+}
+
+// DataTo writes the contents of the section to w, as Data would return
+// them, but through a buffer of bounded size.  It returns the number of
+// bytes written.
+func (s *Section) DataTo(w io.Writer) (int64, error) {
+	return copyRange(w, s.sr, 0, s.sr.Size(), "section "+s.Name)
+}
+
+// DataRangeTo writes the n bytes of the section starting at off to w,
+// through a buffer of bounded size.  It returns the number of bytes
+// written.
+func (s *Section) DataRangeTo(w io.Writer, off, n int64) (int64, error) {
+	return copyRange(w, s.sr, off, n, "section "+s.Name)
+}
+
+// copyRange copies bytes [off, off+n) of r, which must lie within r, to w.
+// A file that ends early is reported as io.ErrUnexpectedEOF.
+func copyRange(w io.Writer, r *io.SectionReader, off, n int64, what string) (int64, error) {
+	if off < 0 || n < 0 || off > r.Size() || n > r.Size()-off {
+		return 0, fmt.Errorf("range [%d, %d) is outside %s of size %d", off, off+n, what, r.Size())
+	}
+	size := int64(copyBufferSize)
+	if n < size {
+		size = n
+	}
+	if size == 0 {
+		return 0, nil
+	}
+	written, err := io.CopyBuffer(w, io.NewSectionReader(r, off, n), make([]byte, size))
+	if err == nil && written < n {
+		err = io.ErrUnexpectedEOF
+	}
+	return written, err
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// A DataInCodeKind is what a run of data in code is (DICE_KIND_*).
+type DataInCodeKind uint16
+
+const (
+	DataInCodeData           DataInCodeKind = 1 // literal pool or other data
+	DataInCodeJumpTable8     DataInCodeKind = 2
+	DataInCodeJumpTable16    DataInCodeKind = 3
+	DataInCodeJumpTable32    DataInCodeKind = 4
+	DataInCodeAbsJumpTable32 DataInCodeKind = 5
+)
+
+var dataInCodeKindStrings = []intName{
+	{uint32(DataInCodeData), "DataInCodeData"},
+	{uint32(DataInCodeJumpTable8), "DataInCodeJumpTable8"},
+	{uint32(DataInCodeJumpTable16), "DataInCodeJumpTable16"},
+	{uint32(DataInCodeJumpTable32), "DataInCodeJumpTable32"},
+	{uint32(DataInCodeAbsJumpTable32), "DataInCodeAbsJumpTable32"},
+}
+
+func (i DataInCodeKind) String() string   { return stringName(uint32(i), dataInCodeKindStrings, false) }
+func (i DataInCodeKind) GoString() string { return stringName(uint32(i), dataInCodeKindStrings, true) }
+
+// A DataInCode is a run of bytes among the instructions of __TEXT that
+// are not instructions, from LC_DATA_IN_CODE.
+type DataInCode struct {
+	Offset uint32 // the file offset of the run, from the start of the image
+	Addr   uint64 // the address of the run
+	Length uint16
+	Kind   DataInCodeKind
+}
+
+// dataInCodeSize is the size of a data_in_code_entry.
+const dataInCodeSize = 8
+
+// DataInCode decodes f's LC_DATA_IN_CODE table.  It returns nil if f
+// has none.
+func (f *File) DataInCode() ([]DataInCode, error) {
+	for _, l := range f.Loads {
+		le, ok := l.(*LinkEditData)
+		if !ok || le.Command() != LcDataInCode {
+			continue
+		}
+		b := make([]byte, le.DataLen)
+		if _, err := f.r.ReadAt(b, int64(le.DataOff)); err != nil {
+			return nil, fmt.Errorf("reading LC_DATA_IN_CODE: %v", err)
+		}
+		entries, err := DataInCodeEntries(b, f.ByteOrder, f.imageBase())
+		if err != nil {
+			return nil, fmt.Errorf("LC_DATA_IN_CODE: %v", err)
+		}
+		return entries, nil
+	}
+	return nil, nil
+}
+
+// DataInCodeEntries decodes a data-in-code table, in byte order bo, of
+// an image whose first byte is at base.
+func DataInCodeEntries(b []byte, bo binary.ByteOrder, base uint64) ([]DataInCode, error) {
+	if len(b)%dataInCodeSize != 0 {
+		return nil, fmt.Errorf("table of %d bytes is not a whole number of %d-byte entries", len(b), dataInCodeSize)
+	}
+	entries := make([]DataInCode, 0, len(b)/dataInCodeSize)
+	for ; len(b) > 0; b = b[dataInCodeSize:] {
+		e := DataInCode{
+			Offset: bo.Uint32(b),
+			Length: bo.Uint16(b[4:]),
+			Kind:   DataInCodeKind(bo.Uint16(b[6:])),
+		}
+		e.Addr = base + uint64(e.Offset)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"debug/dwarf"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DIEPaths gives the fully qualified names of DIEs, as users see them
+// in source: "ns::Class::method" for C++, or for Go, whose compiler
+// already qualifies names, "pkg.(*T).Method".
+type DIEPaths struct {
+	dies  map[dwarf.Offset]*dieScope
+	funcs []dieFunc // sorted by low
+}
+
+// A dieScope is what DIEPaths keeps of a DIE.
+type dieScope struct {
+	tag    dwarf.Tag
+	name   string
+	parent *dieScope
+	ref    dwarf.Offset // DW_AT_specification or DW_AT_abstract_origin, if any
+	hasRef bool
+	goLang bool // in a Go compile unit
+	off    dwarf.Offset
+}
+
+// A dieFunc is a range of code of a subprogram.
+type dieFunc struct {
+	low, high uint64
+	off       dwarf.Offset
+}
+
+const dwLangGo = 0x16
+
+// NewDIEPaths reads every DIE of d, keeping their names and nesting.
+func NewDIEPaths(d *dwarf.Data) (*DIEPaths, error) {
+	p := &DIEPaths{dies: make(map[dwarf.Offset]*dieScope)}
+	var stack []*dieScope
+	goLang := false
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		if e.Tag == 0 {
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+		if e.Tag == dwarf.TagCompileUnit || e.Tag == dwarf.TagPartialUnit {
+			stack = stack[:0]
+			lang, _ := e.Val(dwarf.AttrLanguage).(int64)
+			goLang = lang == dwLangGo
+		}
+		s := &dieScope{tag: e.Tag, goLang: goLang, off: e.Offset}
+		s.name, _ = e.Val(dwarf.AttrName).(string)
+		if s.ref, s.hasRef = e.Val(dwarf.AttrSpecification).(dwarf.Offset); !s.hasRef {
+			s.ref, s.hasRef = e.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset)
+		}
+		if len(stack) > 0 {
+			s.parent = stack[len(stack)-1]
+		}
+		p.dies[e.Offset] = s
+		if e.Tag == dwarf.TagSubprogram {
+			ranges, err := d.Ranges(e)
+			if err == nil {
+				for _, rg := range ranges {
+					if rg[1] > rg[0] {
+						p.funcs = append(p.funcs, dieFunc{rg[0], rg[1], e.Offset})
+					}
+				}
+			}
+		}
+		if e.Children {
+			stack = append(stack, s)
+		}
+	}
+	sort.Slice(p.funcs, func(i, j int) bool { return p.funcs[i].low < p.funcs[j].low })
+	return p, nil
+}
+
+// Path returns the qualified name of the DIE at off.  A DIE without a
+// name of its own, such as the out-of-line definition of a method or
+// of an inlined function, takes its name and scope from the DIE its
+// DW_AT_specification or DW_AT_abstract_origin refers to.  Path returns
+// "" for a DIE with no name.
+func (p *DIEPaths) Path(off dwarf.Offset) (string, error) {
+	s := p.dies[off]
+	if s == nil {
+		return "", fmt.Errorf("no DIE at %#x", off)
+	}
+	named := p.named(s)
+	if named == nil || named.name == "" {
+		return "", nil
+	}
+	if named.goLang {
+		return named.name, nil
+	}
+	// The scope is that of the declaration, even if the definition
+	// repeats the name.
+	for i := 0; i < 4 && s.hasRef && p.dies[s.ref] != nil; i++ {
+		s = p.dies[s.ref]
+	}
+	parts := []string{named.name}
+scopes:
+	for sc := s.parent; sc != nil; sc = sc.parent {
+		switch sc.tag {
+		case dwarf.TagNamespace:
+			if sc.name == "" {
+				parts = append(parts, "(anonymous namespace)")
+			} else {
+				parts = append(parts, sc.name)
+			}
+		case dwarf.TagClassType, dwarf.TagStructType, dwarf.TagUnionType, dwarf.TagInterfaceType, dwarf.TagEnumerationType:
+			if n := p.named(sc); n != nil && n.name != "" {
+				parts = append(parts, n.name)
+			} else {
+				parts = append(parts, "(anonymous)")
+			}
+		case dwarf.TagLexDwarfBlock:
+		case dwarf.TagSubprogram:
+			// Something local to a function.
+			fn, err := p.Path(sc.off)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, fn)
+			break scopes
+		default:
+			break scopes
+		}
+	}
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return strings.Join(parts, "::"), nil
+}
+
+// named follows s's DW_AT_specification or DW_AT_abstract_origin until
+// it reaches a DIE with a name, or one with no such reference.
+func (p *DIEPaths) named(s *dieScope) *dieScope {
+	for i := 0; i < 4 && s != nil && s.name == "" && s.hasRef; i++ { // origins can chain, but not far
+		s = p.dies[s.ref]
+	}
+	return s
+}
+
+// PCPath returns the qualified name of the function whose code includes
+// pc, not counting functions inlined into it, and whether there is one.
+func (p *DIEPaths) PCPath(pc uint64) (string, bool, error) {
+	i := sort.Search(len(p.funcs), func(i int) bool { return p.funcs[i].low > pc }) - 1
+	if i < 0 || pc >= p.funcs[i].high {
+		return "", false, nil
+	}
+	name, err := p.Path(p.funcs[i].off)
+	return name, err == nil, err
+}
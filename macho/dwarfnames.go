@@ -0,0 +1,77 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import "strings"
+
+// dwarfSections are the DWARF sections, as DWARF names them less the
+// leading ".debug_".  Mach-O section names hold at most 16 bytes, so
+// several of these lose their ends in a Mach-O file: __debug_str_offsets
+// is __debug_str_offs, and compressed, __debug_line_str is
+// __zdebug_line_st.  Dropping the "z" of such a name does not give the
+// uncompressed one, and the truncated name matches none of these.
+var dwarfSections = []string{
+	"abbrev",
+	"addr",
+	"aranges",
+	"cu_index",
+	"frame",
+	"gnu_pubnames",
+	"gnu_pubtypes",
+	"info",
+	"line",
+	"line_str",
+	"loc",
+	"loclists",
+	"macinfo",
+	"macro",
+	"names",
+	"pubnames",
+	"pubtypes",
+	"ranges",
+	"rnglists",
+	"str",
+	"str_offsets",
+	"tu_index",
+	"types",
+}
+
+// DWARFSection returns the DWARF section, such as "str_offsets", that
+// the Mach-O section named name holds, and whether it is compressed
+// (__zdebug_...).  It undoes the truncation of names to 16 bytes.  It
+// returns "" if name is not that of a DWARF section; an unknown section
+// whose name begins __debug_ or __zdebug_ is returned as it is named.
+func DWARFSection(name string) (section string, compressed bool) {
+	var suffix string
+	switch {
+	case strings.HasPrefix(name, "__debug_"):
+		suffix = name[len("__debug_"):]
+	case strings.HasPrefix(name, "__zdebug_"):
+		suffix, compressed = name[len("__zdebug_"):], true
+	default:
+		return "", false
+	}
+	if len(name) == 16 {
+		for _, s := range dwarfSections {
+			if DWARFSectionName(s, compressed) == name {
+				return s, compressed
+			}
+		}
+	}
+	return suffix, compressed
+}
+
+// DWARFSectionName returns the name of the Mach-O section holding the
+// DWARF section section, compressed or not, truncated as it must be.
+func DWARFSectionName(section string, compressed bool) string {
+	name := "__debug_" + section
+	if compressed {
+		name = "__zdebug_" + section
+	}
+	if len(name) > 16 {
+		name = name[:16]
+	}
+	return name
+}
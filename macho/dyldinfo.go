@@ -0,0 +1,407 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import "fmt"
+
+// A RebaseType is the kind of pointer a rebase adjusts (REBASE_TYPE_*).
+type RebaseType uint8
+
+const (
+	RebaseTypePointer        RebaseType = 1
+	RebaseTypeTextAbsolute32 RebaseType = 2
+	RebaseTypeTextPCRel32    RebaseType = 3
+)
+
+var rebaseTypeStrings = []intName{
+	{uint32(RebaseTypePointer), "RebaseTypePointer"},
+	{uint32(RebaseTypeTextAbsolute32), "RebaseTypeTextAbsolute32"},
+	{uint32(RebaseTypeTextPCRel32), "RebaseTypeTextPCRel32"},
+}
+
+func (i RebaseType) String() string   { return stringName(uint32(i), rebaseTypeStrings, false) }
+func (i RebaseType) GoString() string { return stringName(uint32(i), rebaseTypeStrings, true) }
+
+// A Rebase is one location that dyld slides, from the rebase opcodes
+// of LC_DYLD_INFO.
+type Rebase struct {
+	SegIndex  int    // the segment, counting from 0 in load command order
+	SegOffset uint64 // the offset of the location in the segment, in memory
+	Addr      uint64 // the address of the location
+	Type      RebaseType
+}
+
+// Rebase opcodes (REBASE_OPCODE_*), in the high nibble of a byte whose
+// low nibble is their immediate operand.
+const (
+	rebaseDone                      = 0x00
+	rebaseSetTypeImm                = 0x10
+	rebaseSetSegmentAndOffsetUleb   = 0x20
+	rebaseAddAddrUleb               = 0x30
+	rebaseAddAddrImmScaled          = 0x40
+	rebaseDoRebaseImmTimes          = 0x50
+	rebaseDoRebaseUlebTimes         = 0x60
+	rebaseDoRebaseAddAddrUleb       = 0x70
+	rebaseDoRebaseUlebTimesSkipping = 0x80
+)
+
+// Rebases decodes the rebase opcodes of f's LC_DYLD_INFO or
+// LC_DYLD_INFO_ONLY and returns each location they rebase, in the
+// order they give them.  It returns nil if f has no rebase opcodes.
+func (f *File) Rebases() ([]Rebase, error) {
+	var info *DyldInfo
+	for _, l := range f.Loads {
+		if l, ok := l.(*DyldInfo); ok {
+			info = l
+		}
+	}
+	if info == nil || info.RebaseLen == 0 {
+		return nil, nil
+	}
+	b := make([]byte, info.RebaseLen)
+	if _, err := f.r.ReadAt(b, int64(info.RebaseOff)); err != nil {
+		return nil, fmt.Errorf("reading %v rebase opcodes: %v", info.Command(), err)
+	}
+	rebases, err := decodeRebases(b, f.ptrSize(), f.segments())
+	if err != nil {
+		return nil, fmt.Errorf("%v rebase opcodes: %v", info.Command(), err)
+	}
+	return rebases, nil
+}
+
+// segments returns f's segments, in load command order, as the segment
+// indices of dyld info and chained fixups count them.
+func (f *File) segments() []*Segment {
+	var segs []*Segment
+	for _, l := range f.Loads {
+		if s, ok := l.(*Segment); ok {
+			segs = append(segs, s)
+		}
+	}
+	return segs
+}
+
+// ptrSize returns the size of a pointer in f.
+func (f *File) ptrSize() uint64 {
+	if f.Magic == Magic64 {
+		return 8
+	}
+	return 4
+}
+
+// decodeRebases decodes the rebase opcodes b of an image with segments
+// segs and pointers of ptrSize bytes.  Every location must lie within
+// its segment, which also bounds how many a short stream can produce.
+func decodeRebases(b []byte, ptrSize uint64, segs []*Segment) ([]Rebase, error) {
+	var rebases []Rebase
+	d := &readBuf{b: b}
+	var typ RebaseType
+	seg, off := -1, uint64(0)
+	rebase := func(n, step uint64) error {
+		if seg < 0 {
+			return fmt.Errorf("rebase at %#x before any segment is set", d.off)
+		}
+		s := segs[seg]
+		for i := uint64(0); i < n; i++ {
+			if off >= s.Memsz {
+				return fmt.Errorf("rebase at %s+%#x, beyond the segment's %#x bytes", s.Name, off, s.Memsz)
+			}
+			rebases = append(rebases, Rebase{SegIndex: seg, SegOffset: off, Addr: s.Addr + off, Type: typ})
+			off += step
+		}
+		return nil
+	}
+	for d.off < uint64(len(b)) {
+		at := d.off
+		c := d.u8()
+		imm := uint64(c & 0x0f)
+		var err error
+		switch c & 0xf0 {
+		case rebaseDone:
+			return rebases, nil
+		case rebaseSetTypeImm:
+			typ = RebaseType(imm)
+		case rebaseSetSegmentAndOffsetUleb:
+			if imm >= uint64(len(segs)) {
+				return nil, fmt.Errorf("opcode at %#x: segment %d, but there are %d", at, imm, len(segs))
+			}
+			seg, off = int(imm), d.uleb()
+		case rebaseAddAddrUleb:
+			off += d.uleb()
+		case rebaseAddAddrImmScaled:
+			off += imm * ptrSize
+		case rebaseDoRebaseImmTimes:
+			err = rebase(imm, ptrSize)
+		case rebaseDoRebaseUlebTimes:
+			err = rebase(d.uleb(), ptrSize)
+		case rebaseDoRebaseAddAddrUleb:
+			err = rebase(1, d.uleb()+ptrSize)
+		case rebaseDoRebaseUlebTimesSkipping:
+			n := d.uleb()
+			err = rebase(n, d.uleb()+ptrSize)
+		default:
+			return nil, fmt.Errorf("opcode at %#x: unknown opcode %#x", at, c)
+		}
+		if d.err != nil {
+			return nil, fmt.Errorf("opcode at %#x: %v", at, d.err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("opcode at %#x: %v", at, err)
+		}
+	}
+	return rebases, nil
+}
+
+// A BindKind says which of LC_DYLD_INFO's bind opcode streams a Bind
+// comes from.
+type BindKind uint8
+
+const (
+	BindRegular BindKind = iota // bound at launch
+	BindWeak                    // coalesced with other images' weak definitions
+	BindLazy                    // bound on first call
+)
+
+var bindKindStrings = []intName{
+	{uint32(BindRegular), "BindRegular"},
+	{uint32(BindWeak), "BindWeak"},
+	{uint32(BindLazy), "BindLazy"},
+}
+
+func (i BindKind) String() string   { return stringName(uint32(i), bindKindStrings, false) }
+func (i BindKind) GoString() string { return stringName(uint32(i), bindKindStrings, true) }
+
+// Flags of the symbol of a bind (BIND_SYMBOL_FLAGS_*).
+const (
+	BindSymbolWeakImport        = 0x1 // may be missing at run time
+	BindSymbolNonWeakDefinition = 0x8 // in a weak bind, a strong definition that overrides the others
+)
+
+// A Bind is one location that dyld sets to the address of a symbol,
+// from the bind opcodes of LC_DYLD_INFO.
+type Bind struct {
+	Kind       BindKind
+	SegIndex   int        // the segment, counting from 0 in load command order
+	SegOffset  uint64     // the offset of the location in the segment, in memory
+	Addr       uint64     // the address of the location
+	Type       RebaseType // BIND_TYPE_*, whose values are those of REBASE_TYPE_*
+	LibOrdinal int        // 1 and up for a dylib; 0 for this image, -1 the main executable, -2 flat lookup; unused for BindWeak
+	Name       string
+	Flags      uint8 // BindSymbol*
+	Addend     int64
+}
+
+// Bind opcodes (BIND_OPCODE_*), in the high nibble of a byte whose low
+// nibble is their immediate operand.
+const (
+	bindDone                    = 0x00
+	bindSetDylibOrdinalImm      = 0x10
+	bindSetDylibOrdinalUleb     = 0x20
+	bindSetDylibSpecialImm      = 0x30
+	bindSetSymbolTrailingFlags  = 0x40
+	bindSetTypeImm              = 0x50
+	bindSetAddendSleb           = 0x60
+	bindSetSegmentAndOffsetUleb = 0x70
+	bindAddAddrUleb             = 0x80
+	bindDoBind                  = 0x90
+	bindDoBindAddAddrUleb       = 0xa0
+	bindDoBindAddAddrImmScaled  = 0xb0
+	bindDoBindUlebTimesSkipping = 0xc0
+	bindThreaded                = 0xd0
+)
+
+// BindInfo decodes the bind, weak bind, and lazy bind opcodes of f's
+// LC_DYLD_INFO or LC_DYLD_INFO_ONLY and returns each location they
+// bind, those of each stream in the order it gives them.  It returns
+// nil if f has no bind opcodes.
+func (f *File) BindInfo() ([]Bind, error) {
+	var info *DyldInfo
+	for _, l := range f.Loads {
+		if l, ok := l.(*DyldInfo); ok {
+			info = l
+		}
+	}
+	if info == nil {
+		return nil, nil
+	}
+	var binds []Bind
+	for _, s := range []struct {
+		kind     BindKind
+		off, len uint32
+	}{
+		{BindRegular, info.BindOff, info.BindLen},
+		{BindWeak, info.WeakBindOff, info.WeakBindLen},
+		{BindLazy, info.LazyBindOff, info.LazyBindLen},
+	} {
+		if s.len == 0 {
+			continue
+		}
+		bs, _, err := f.readBinds(info, s.kind, s.off, s.len)
+		if err != nil {
+			return nil, err
+		}
+		binds = append(binds, bs...)
+	}
+	return binds, nil
+}
+
+// WeakBinds decodes the weak bind opcodes of f's LC_DYLD_INFO or
+// LC_DYLD_INFO_ONLY, by which dyld coalesces the weak definitions of
+// the images it loads, so that all use the same one.  It returns each
+// location they bind, in the order the opcodes give them, and the
+// symbols they declare f defines strongly (BindSymbolNonWeakDefinition),
+// which override the weak definitions of other images and are bound at
+// no location of f.  It returns nil, nil if f has no weak bind opcodes.
+func (f *File) WeakBinds() (binds []Bind, strong []string, err error) {
+	var info *DyldInfo
+	for _, l := range f.Loads {
+		if l, ok := l.(*DyldInfo); ok {
+			info = l
+		}
+	}
+	if info == nil || info.WeakBindLen == 0 {
+		return nil, nil, nil
+	}
+	return f.readBinds(info, BindWeak, info.WeakBindOff, info.WeakBindLen)
+}
+
+// readBinds reads and decodes the bind opcodes of info for kind, the n
+// bytes at off, as decodeBinds does.
+func (f *File) readBinds(info *DyldInfo, kind BindKind, off, n uint32) ([]Bind, []string, error) {
+	b := make([]byte, n)
+	if _, err := f.r.ReadAt(b, int64(off)); err != nil {
+		return nil, nil, fmt.Errorf("reading %v %v opcodes: %v", info.Command(), kind, err)
+	}
+	binds, strong, err := decodeBinds(b, kind, f.ptrSize(), f.segments())
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v %v opcodes: %v", info.Command(), kind, err)
+	}
+	return binds, strong, nil
+}
+
+// decodeBinds decodes the bind opcodes b, of the stream for kind, of an
+// image with segments segs and pointers of ptrSize bytes.  As with
+// rebases, every location must lie within its segment.  For BindWeak,
+// it also returns the symbols the stream declares strong definitions.
+func decodeBinds(b []byte, kind BindKind, ptrSize uint64, segs []*Segment) ([]Bind, []string, error) {
+	var binds []Bind
+	var strong []string
+	d := &readBuf{b: b}
+	cur := Bind{Kind: kind, Type: RebaseTypePointer}
+	seg := -1
+	bind := func(n, step uint64) error {
+		if seg < 0 {
+			return fmt.Errorf("bind at %#x before any segment is set", d.off)
+		}
+		if cur.Name == "" {
+			return fmt.Errorf("bind at %#x before any symbol is set", d.off)
+		}
+		s := segs[seg]
+		for i := uint64(0); i < n; i++ {
+			if cur.SegOffset >= s.Memsz {
+				return fmt.Errorf("bind of %s at %s+%#x, beyond the segment's %#x bytes", cur.Name, s.Name, cur.SegOffset, s.Memsz)
+			}
+			cur.SegIndex, cur.Addr = seg, s.Addr+cur.SegOffset
+			binds = append(binds, cur)
+			cur.SegOffset += step
+		}
+		return nil
+	}
+	for d.off < uint64(len(b)) {
+		at := d.off
+		c := d.u8()
+		imm := uint64(c & 0x0f)
+		var err error
+		switch c & 0xf0 {
+		case bindDone:
+			// The lazy binds are each followed by a DONE, so that
+			// dyld can start at any one of them; the others end.
+			if kind != BindLazy {
+				return binds, strong, nil
+			}
+		case bindSetDylibOrdinalImm:
+			cur.LibOrdinal = int(imm)
+		case bindSetDylibOrdinalUleb:
+			cur.LibOrdinal = int(d.uleb())
+		case bindSetDylibSpecialImm:
+			cur.LibOrdinal = 0
+			if imm != 0 {
+				cur.LibOrdinal = int(int8(0xf0 | c))
+			}
+		case bindSetSymbolTrailingFlags:
+			cur.Flags = uint8(imm)
+			cur.Name = d.cstring()
+			if kind == BindWeak && cur.Flags&BindSymbolNonWeakDefinition != 0 {
+				strong = append(strong, cur.Name)
+			}
+		case bindSetTypeImm:
+			cur.Type = RebaseType(imm)
+		case bindSetAddendSleb:
+			cur.Addend = d.sleb()
+		case bindSetSegmentAndOffsetUleb:
+			if imm >= uint64(len(segs)) {
+				return nil, nil, fmt.Errorf("opcode at %#x: segment %d, but there are %d", at, imm, len(segs))
+			}
+			seg, cur.SegOffset = int(imm), d.uleb()
+		case bindAddAddrUleb:
+			cur.SegOffset += d.uleb()
+		case bindDoBind:
+			err = bind(1, ptrSize)
+		case bindDoBindAddAddrUleb:
+			err = bind(1, d.uleb()+ptrSize)
+		case bindDoBindAddAddrImmScaled:
+			err = bind(1, imm*ptrSize+ptrSize)
+		case bindDoBindUlebTimesSkipping:
+			n := d.uleb()
+			err = bind(n, d.uleb()+ptrSize)
+		case bindThreaded:
+			return nil, nil, fmt.Errorf("opcode at %#x: threaded binds are not supported", at)
+		default:
+			return nil, nil, fmt.Errorf("opcode at %#x: unknown opcode %#x", at, c)
+		}
+		if d.err != nil {
+			return nil, nil, fmt.Errorf("opcode at %#x: %v", at, d.err)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("opcode at %#x: %v", at, err)
+		}
+	}
+	return binds, strong, nil
+}
+
+// boundSymbols returns the names of the symbols that f's binds, other
+// than weak binds, or else its chained fixups' imports refer to, each
+// once, in the order they are first referred to.  It returns nil if f
+// has neither.
+func (f *File) boundSymbols() ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	binds, err := f.BindInfo()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range binds {
+		if b.Kind != BindWeak {
+			add(b.Name)
+		}
+	}
+	if binds != nil {
+		return names, nil
+	}
+	c, err := f.ChainedFixups()
+	if c == nil || err != nil {
+		return nil, err
+	}
+	for _, imp := range c.Imports {
+		add(imp.Name)
+	}
+	return names, nil
+}
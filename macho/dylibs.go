@@ -0,0 +1,213 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The paths a file's load commands hold can be changed in place, as
+// install_name_tool changes them: a dylib's install name, in its
+// LC_ID_DYLIB, the dylibs it loads, and its rpaths, which can also be
+// added and removed.  A command grows
+// or shrinks with its path, to the alignment of the file's loads, and
+// the commands after it move, but nothing else does; they must still
+// end before the file's first contents, in the padding the linker left
+// after them (see ld's -headerpad), and PutOver writes them back over
+// the file they were read from.  A code signature is not remade, and no
+// longer matches the file.
+
+// SetDylibID sets the install name of t, a dylib, to name.  It returns
+// an error, and changes nothing, if t has no LC_ID_DYLIB, or the load
+// commands would no longer fit.
+func (t *FileTOC) SetDylibID(name string) error {
+	var names []*string
+	for _, l := range t.Loads {
+		if d, ok := l.(*Dylib); ok && d.Kind == DylibID {
+			names = append(names, &d.Name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("there is no %v; only a dylib has an install name", LcIdDylib)
+	}
+	return t.rename(names, name)
+}
+
+// ChangeDylibPath changes the path of each dylib t loads, in whichever
+// way, from from to to.  It returns an error, and changes nothing, if t
+// loads no dylib from from, or the load commands would no longer fit.
+func (t *FileTOC) ChangeDylibPath(from, to string) error {
+	var names []*string
+	for _, l := range t.Loads {
+		if d, ok := l.(*Dylib); ok && d.Kind != DylibID && d.Name == from {
+			names = append(names, &d.Name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no dylib is loaded from %s", from)
+	}
+	return t.rename(names, to)
+}
+
+// ChangeRpath changes each LC_RPATH of t that is from to to.  It
+// returns an error, and changes nothing, if t has no rpath from, or the
+// load commands would no longer fit.
+func (t *FileTOC) ChangeRpath(from, to string) error {
+	var names []*string
+	for _, l := range t.Loads {
+		if r, ok := l.(*Rpath); ok && r.Path == from {
+			names = append(names, &r.Path)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("there is no rpath %s", from)
+	}
+	return t.rename(names, to)
+}
+
+// AddRpath adds an LC_RPATH of path to t, after its other load
+// commands.  It returns an error, and changes nothing, if t already has
+// that rpath, or the load commands would no longer fit.
+func (t *FileTOC) AddRpath(path string) error {
+	if err := checkPath(path); err != nil {
+		return err
+	}
+	for _, l := range t.Loads {
+		if r, ok := l.(*Rpath); ok && r.Path == path {
+			return fmt.Errorf("there is already an rpath %s", path)
+		}
+	}
+	r := &Rpath{LoadCmd: LcRpath, Path: path}
+	if err := t.fits(uint64(t.TOCSize()) + uint64(r.LoadSize(t))); err != nil {
+		return err
+	}
+	t.AddLoad(r)
+	return nil
+}
+
+// RemoveRpath removes each LC_RPATH of t that is path, as RemoveLoad
+// does.  It returns an error, and changes nothing, if t has no such
+// rpath.
+func (t *FileTOC) RemoveRpath(path string) error {
+	n := 0
+	for i := 0; i < len(t.Loads); {
+		if r, ok := t.Loads[i].(*Rpath); ok && r.Path == path {
+			if err := t.RemoveLoad(i); err != nil {
+				return err // an rpath locates nothing, so cannot fail
+			}
+			n++
+			continue
+		}
+		i++
+	}
+	if n == 0 {
+		return fmt.Errorf("there is no rpath %s", path)
+	}
+	return nil
+}
+
+// rename sets each of names, the names or paths of load commands of
+// t, to name, and updates Cmdsz, or if the load commands would then
+// not end before the file's first contents, leaves them as they were
+// and returns an error.
+func (t *FileTOC) rename(names []*string, name string) error {
+	if err := checkPath(name); err != nil {
+		return err
+	}
+	before := t.LoadSize()
+	olds := make([]string, len(names))
+	for i, p := range names {
+		olds[i], *p = *p, name
+	}
+	after := t.LoadSize()
+	if err := t.fits(uint64(t.HdrSize()) + uint64(after)); err != nil {
+		for i, p := range names {
+			*p = olds[i]
+		}
+		return err
+	}
+	t.Cmdsz += after - before
+	return nil
+}
+
+// checkPath returns an error if path cannot be held by a load command,
+// being empty, or holding a NUL.
+func checkPath(path string) error {
+	if path == "" || strings.IndexByte(path, 0) >= 0 {
+		return fmt.Errorf("invalid path %q", path)
+	}
+	return nil
+}
+
+// fits returns an error if load commands that end at end would not end
+// before the first contents of the file t describes.
+func (t *FileTOC) fits(end uint64) error {
+	if start := t.contentStart(); end > start {
+		return fmt.Errorf("the load commands would end at %#x, past the file's first contents at %#x", end, start)
+	}
+	return nil
+}
+
+// PutOver writes the header and load commands of t over the start of
+// b, which holds the file t was read from and then edited, and zeros
+// what follows them up to the file's first contents, where longer load
+// commands may have been.  It returns an error, and writes nothing, if
+// the load commands do not end before those contents, or b.
+func (t *FileTOC) PutOver(b []byte) error {
+	end, start := uint64(t.TOCSize()), t.contentStart()
+	if end > start {
+		return fmt.Errorf("the load commands end at %#x, past the file's first contents at %#x", end, start)
+	}
+	if start > uint64(len(b)) {
+		start = uint64(len(b))
+	}
+	if end > start {
+		return fmt.Errorf("the load commands end at %#x, beyond the %d-byte file", end, len(b))
+	}
+	t.Put(b)
+	for i := end; i < start; i++ {
+		b[i] = 0
+	}
+	return nil
+}
+
+// contentStart returns the offset of the first contents of the file t
+// describes that follow its load commands: the first section, segment,
+// data a load command locates, or payload that is not empty.  A segment
+// at offset 0, such as __TEXT, holds the load commands themselves.
+func (t *FileTOC) contentStart() uint64 {
+	return t.contentFrom(1)
+}
+
+// contentFrom returns the offset of the first contents of the file t
+// describes, as contentStart counts them, at or after off, or ^0 if
+// there are none.
+func (t *FileTOC) contentFrom(off uint64) uint64 {
+	from, start := off, ^uint64(0)
+	at := func(off, n uint64) {
+		if off >= from && n > 0 && off < start {
+			start = off
+		}
+	}
+	for _, l := range t.Loads {
+		if g, ok := l.(*Segment); ok {
+			at(g.Offset, g.Filesz)
+			continue
+		}
+		for _, r := range t.loadRanges(l) {
+			at(r.off, r.n)
+		}
+	}
+	for _, s := range t.Sections {
+		if !s.Flags.IsZerofill() {
+			at(uint64(s.Offset), s.Size)
+		}
+	}
+	for _, p := range t.payloads {
+		at(p.extent())
+	}
+	return start
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ExportFlag is the flags of an exported symbol (EXPORT_SYMBOL_FLAGS_*).
+type ExportFlag uint64
+
+const (
+	ExportKindMask        ExportFlag = 0x03
+	ExportRegular         ExportFlag = 0x00 // a kind
+	ExportThreadLocal     ExportFlag = 0x01 // a kind
+	ExportAbsolute        ExportFlag = 0x02 // a kind
+	ExportWeakDefinition  ExportFlag = 0x04
+	ExportReexport        ExportFlag = 0x08
+	ExportStubAndResolver ExportFlag = 0x10
+	ExportStaticResolver  ExportFlag = 0x20
+)
+
+// An Export is a symbol that an image exports.
+type Export struct {
+	Name       string
+	Flags      ExportFlag
+	Addr       uint64 // the address, or for ExportAbsolute, the value
+	Resolver   uint64 // for ExportStubAndResolver, the resolver's address
+	Ordinal    uint64 // for ExportReexport, the dylib it comes from
+	ImportName string // for ExportReexport, its name there, if different
+}
+
+// Exports decodes f's export trie, from LC_DYLD_EXPORTS_TRIE or else
+// from the export information of LC_DYLD_INFO, and returns the
+// exported symbols sorted by name.  It returns nil if f has neither.
+func (f *File) Exports() ([]Export, error) {
+	var off, size uint32
+	var cmd LoadCmd
+	for _, l := range f.Loads {
+		switch l := l.(type) {
+		case *LinkEditData:
+			if l.Command() == LcDyldExportsTrie {
+				off, size, cmd = l.DataOff, l.DataLen, l.Command()
+			}
+		case *DyldInfo:
+			if cmd == 0 {
+				off, size, cmd = l.ExportOff, l.ExportLen, l.Command()
+			}
+		}
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	b := make([]byte, size)
+	if _, err := f.r.ReadAt(b, int64(off)); err != nil {
+		return nil, fmt.Errorf("reading %v export trie: %v", cmd, err)
+	}
+	exports, err := ExportTrie(b, f.imageBase())
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", cmd, err)
+	}
+	return exports, nil
+}
+
+// ExportTrie decodes an export trie, in which symbols' addresses are
+// offsets from base, and returns the exported symbols sorted by name.
+func ExportTrie(b []byte, base uint64) ([]Export, error) {
+	var exports []Export
+	visited := make(map[uint64]bool)
+	var walk func(off uint64, prefix string) error
+	walk = func(off uint64, prefix string) error {
+		if visited[off] {
+			return fmt.Errorf("trie node at %#x is reached twice", off)
+		}
+		visited[off] = true
+		d := &readBuf{b: b, off: off}
+		if n := d.uleb(); n > 0 {
+			end := d.off + n
+			e := Export{Name: prefix, Flags: ExportFlag(d.uleb())}
+			switch {
+			case e.Flags&ExportReexport != 0:
+				e.Ordinal = d.uleb()
+				e.ImportName = d.cstring()
+			case e.Flags&ExportStubAndResolver != 0:
+				e.Addr = base + d.uleb()
+				e.Resolver = base + d.uleb()
+			case e.Flags&ExportKindMask == ExportAbsolute:
+				e.Addr = d.uleb()
+			default:
+				e.Addr = base + d.uleb()
+			}
+			if d.err == nil && d.off > end {
+				return fmt.Errorf("trie node at %#x: export of %q overruns it", off, prefix)
+			}
+			exports = append(exports, e)
+			d.off = end
+		}
+		nchildren := d.u8()
+		for i := byte(0); i < nchildren && d.err == nil; i++ {
+			label := d.cstring()
+			child := d.uleb()
+			if d.err != nil {
+				break
+			}
+			if child >= uint64(len(b)) {
+				return fmt.Errorf("trie node at %#x: edge %q leads outside the trie", off, label)
+			}
+			if err := walk(child, prefix+label); err != nil {
+				return err
+			}
+		}
+		if d.err != nil {
+			return fmt.Errorf("trie node at %#x: %v", off, d.err)
+		}
+		return nil
+	}
+	if len(b) == 0 {
+		return nil, nil
+	}
+	if err := walk(0, ""); err != nil {
+		return nil, err
+	}
+	sort.Slice(exports, func(i, j int) bool { return exports[i].Name < exports[j].Name })
+	return exports, nil
+}
@@ -8,6 +8,8 @@ import (
 	"encoding/binary"
 	"io"
 	"os"
+	"runtime"
+	"sync"
 )
 
 // A FatFile is a Mach-O universal binary that contains at least one architecture.
@@ -34,6 +36,10 @@ type FatArch struct {
 	*File
 }
 
+// ErrNotFat is returned from NewFatFile or OpenFat when the file is not
+// a universal binary, but may be a thin Mach-O file; use NewFile.
+var ErrNotFat = &FormatError{0, "not a fat Mach-O file"}
+
 // NewFatFile creates a new FatFile for accessing all the Mach-O images in a
 // universal binary. The Mach-O binary is expected to start at position 0 in
 // the ReaderAt.
@@ -52,8 +58,8 @@ func NewFatFile(r io.ReaderAt) (*FatFile, error) {
 		var buf [4]byte
 		binary.BigEndian.PutUint32(buf[:], ff.Magic)
 		leMagic := binary.LittleEndian.Uint32(buf[:])
-		if leMagic == Magic32 || leMagic == Magic64 {
-			return nil, formatError(0, "not a fat Mach-O file, leMagic=0x%x", leMagic)
+		if leMagic == Magic32 || leMagic == Magic64 || ff.Magic == Magic32 || ff.Magic == Magic64 {
+			return nil, ErrNotFat
 		} else {
 			return nil, formatError(0, "invalid magic number, leMagic=0x%x", leMagic)
 		}
@@ -72,12 +78,6 @@ func NewFatFile(r io.ReaderAt) (*FatFile, error) {
 		return nil, formatError(offset, "file contains no images, narch=%d", narch)
 	}
 
-	// Combine the Cpu and SubCpu (both uint32) into a uint64 to make sure
-	// there are not duplicate architectures.
-	seenArches := make(map[uint64]bool, narch)
-	// Make sure that all images are for the same MH_ type.
-	var machoType HdrType
-
 	// Following the fat_header comes narch fat_arch structs that index
 	// Mach-O images further in the file.
 	ff.Arches = make([]FatArch, narch)
@@ -88,11 +88,33 @@ func NewFatFile(r io.ReaderAt) (*FatFile, error) {
 			return nil, formatError(offset, "invalid fat_arch header, %v", err)
 		}
 		offset += fatArchHeaderSize
+	}
 
-		fr := io.NewSectionReader(r, int64(fa.Offset), int64(fa.Size))
-		fa.File, err = NewFile(fr)
-		if err != nil {
-			return nil, err
+	// The images are independent, so parse them at the same time.
+	errs := make([]error, narch)
+	var wg sync.WaitGroup
+	for i := range ff.Arches {
+		fa := &ff.Arches[i]
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fr := io.NewSectionReader(r, int64(fa.Offset), int64(fa.Size))
+			fa.File, errs[i] = NewFile(fr)
+		}(i)
+	}
+	wg.Wait()
+
+	// Combine the Cpu and SubCpu (both uint32) into a uint64 to make sure
+	// there are not duplicate architectures.
+	seenArches := make(map[uint64]bool, narch)
+	// Make sure that all images are for the same MH_ type.
+	var machoType HdrType
+
+	for i := range ff.Arches {
+		fa := &ff.Arches[i]
+		offset = 8 + int64(i+1)*fatArchHeaderSize
+		if errs[i] != nil {
+			return nil, errs[i]
 		}
 
 		// Make sure the architecture for this image is not duplicate.
@@ -115,6 +137,91 @@ func NewFatFile(r io.ReaderAt) (*FatFile, error) {
 	return &ff, nil
 }
 
+// FatHeaderSize returns the size of the header of a universal binary
+// of narch images, which the images follow.
+func FatHeaderSize(narch int) uint32 {
+	return 8 + uint32(narch)*fatArchHeaderSize
+}
+
+// PutFatHeader writes the header of a universal binary holding images
+// described by arches into b, and returns the number of bytes written.
+func PutFatHeader(b []byte, arches []FatArchHeader) int {
+	o := binary.BigEndian
+	o.PutUint32(b[0:], MagicFat)
+	o.PutUint32(b[4:], uint32(len(arches)))
+	for i, a := range arches {
+		h := b[8+i*fatArchHeaderSize:]
+		o.PutUint32(h[0:], uint32(a.Cpu))
+		o.PutUint32(h[4:], a.SubCpu)
+		o.PutUint32(h[8:], a.Offset)
+		o.PutUint32(h[12:], a.Size)
+		o.PutUint32(h[16:], a.Align)
+	}
+	return int(FatHeaderSize(len(arches)))
+}
+
+// Arch returns the image in ff for cpu and subcpu, ignoring the
+// capability bits of the subtype, or nil if there is none.
+func (ff *FatFile) Arch(cpu Cpu, subcpu uint32) *FatArch {
+	for i := range ff.Arches {
+		a := &ff.Arches[i]
+		if a.Cpu == cpu && CpuSubtype(a.SubCpu).Base() == CpuSubtype(subcpu).Base() {
+			return a
+		}
+	}
+	return nil
+}
+
+// BestArch returns the image in ff that a machine of cpu and subcpu
+// would choose to run: that for exactly its subtype, or failing that,
+// that for every subtype of its cpu (CPU_SUBTYPE_*_ALL), or nil.
+func (ff *FatFile) BestArch(cpu Cpu, subcpu uint32) *FatArch {
+	if a := ff.Arch(cpu, subcpu); a != nil {
+		return a
+	}
+	return ff.Arch(cpu, allSubCpu(cpu))
+}
+
+// HostArch returns the image in ff that the machine running the program
+// would choose, as BestArch does, or nil if there is none.
+func (ff *FatFile) HostArch() *FatArch {
+	cpu, subcpu, ok := HostCpu()
+	if !ok {
+		return nil
+	}
+	return ff.BestArch(cpu, subcpu)
+}
+
+// allSubCpu returns the subtype that runs on every machine of cpu.
+func allSubCpu(cpu Cpu) uint32 {
+	if cpu == Cpu386 || cpu == CpuAmd64 {
+		return uint32(SubCpuX86All)
+	}
+	return uint32(SubCpuArmAll) // and arm64's, and ppc's
+}
+
+// HostCpu returns the cpu and subtype of the images that the machine
+// running the program runs natively, and whether it has one Mach-O
+// describes.  The subtype is the most general one.
+func HostCpu() (Cpu, uint32, bool) {
+	var cpu Cpu
+	switch runtime.GOARCH {
+	case "386":
+		cpu = Cpu386
+	case "amd64":
+		cpu = CpuAmd64
+	case "arm":
+		cpu = CpuArm
+	case "arm64":
+		cpu = CpuArm64
+	case "ppc64":
+		cpu = CpuPpc64
+	default:
+		return 0, 0, false
+	}
+	return cpu, allSubCpu(cpu), true
+}
+
 // OpenFat opens the named file using os.Open and prepares it for use as a Mach-O
 // universal binary.
 func OpenFat(name string) (*FatFile, error) {
@@ -9,9 +9,9 @@ package macho
 
 import (
 	"bytes"
-	"compress/zlib"
 	"debug/dwarf"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
@@ -26,7 +26,9 @@ type File struct {
 	Symtab   *Symtab
 	Dysymtab *Dysymtab
 
+	r      io.ReaderAt // the whole file
 	closer io.Closer
+	raw    []LoadBytes // each load command, as read
 }
 
 type FileTOC struct {
@@ -34,6 +36,8 @@ type FileTOC struct {
 	ByteOrder binary.ByteOrder
 	Loads     []Load
 	Sections  []*Section
+
+	payloads []*payload // for WriteTo and Bytes; see write.go
 }
 
 func (t *FileTOC) AddLoad(l Load) {
@@ -46,25 +50,124 @@ func (t *FileTOC) AddLoad(l Load) {
 // and also zeroes out the segment information with the expectation
 // that this will be added next.
 func (t *FileTOC) AddSegment(s *Segment) {
-	t.AddLoad(s)
 	s.Nsect = 0
 	s.Firstsect = 0
+	s.Len = s.LoadSize(t)
+	t.AddLoad(s)
 }
 
-// Adds section to the most recently added Segment
+// Adds section to the most recently added Segment.
+// If that segment claims sections other than the most recently
+// added ones (for example, because it was copied from another file
+// and added with AddLoad), the claim is stale and is dropped, so that
+// the segment's sections are always the contiguous run ending with s.
 func (t *FileTOC) AddSection(s *Section) {
-	g := t.Loads[len(t.Loads)-1].(*Segment)
+	g, ok := t.Loads[len(t.Loads)-1].(*Segment)
+	if !ok {
+		panic(fmt.Sprintf("AddSection %s: most recent load is %s, not a segment", s.Name, t.Loads[len(t.Loads)-1]))
+	}
+	sectionsize := uint32(unsafe.Sizeof(Section32{}))
+	if g.Command() == LcSegment64 {
+		sectionsize = uint32(unsafe.Sizeof(Section64{}))
+	}
+	if g.Nsect != 0 && uint64(g.Firstsect)+uint64(g.Nsect) != uint64(len(t.Sections)) {
+		t.Cmdsz -= g.Nsect * sectionsize
+		g.Len -= g.Nsect * sectionsize
+		g.Nsect = 0
+	}
 	if g.Nsect == 0 {
 		g.Firstsect = uint32(len(t.Sections))
 	}
 	g.Nsect++
 	t.Sections = append(t.Sections, s)
-	sectionsize := uint32(unsafe.Sizeof(Section32{}))
-	if g.Command() == LcSegment64 {
-		sectionsize  = uint32(unsafe.Sizeof(Section64{}))
+	t.Cmdsz += sectionsize
+	g.Len += sectionsize
+}
+
+// Validate checks that t is consistent enough to Put: that Ncmd and
+// Cmdsz agree with the loads, that each segment's length covers its
+// sections, that the segments' Firstsect and Nsect divide
+// t.Sections into contiguous, non-overlapping runs, with no section
+// left out, and that LC_TWOLEVEL_HINTS, if there is one, still has a
+// hint for each undefined symbol.
+func (t *FileTOC) Validate() error {
+	if t.Ncmd != uint32(len(t.Loads)) {
+		return fmt.Errorf("Ncmd is %d, but there are %d loads", t.Ncmd, len(t.Loads))
+	}
+	if err := t.validateSections(); err != nil {
+		return err
+	}
+	for i, l := range t.Loads {
+		if g, ok := l.(*Segment); ok && g.Len != g.LoadSize(t) {
+			return fmt.Errorf("load %d, segment %s: length is %d, but %d sections need %d", i, g.Name, g.Len, g.Nsect, g.LoadSize(t))
+		}
+	}
+	if t.Cmdsz != t.LoadSize() {
+		return fmt.Errorf("Cmdsz is %d, but the loads need %d", t.Cmdsz, t.LoadSize())
+	}
+	return t.validateHints()
+}
+
+// validateHints checks that each LC_TWOLEVEL_HINTS of t has as many
+// hints as it says, one for each undefined symbol of LC_DYSYMTAB, in
+// turn, and that each hint's table of contents index fits in the 24
+// bits it is written in.  A symbol table edited without its hints
+// leaves dyld looking for symbols where they are not.
+func (t *FileTOC) validateHints() error {
+	_, dt := t.symtabs()
+	for i, l := range t.Loads {
+		h, ok := l.(*TwolevelHints)
+		if !ok {
+			continue
+		}
+		if h.Nhints != uint32(len(h.Hints)) {
+			return fmt.Errorf("load %d, %v: Nhints is %d, but there are %d hints", i, h.Command(), h.Nhints, len(h.Hints))
+		}
+		if dt == nil {
+			if h.Nhints > 0 {
+				return fmt.Errorf("load %d, %v: %d hints, but there is no %v, whose undefined symbols they are for", i, h.Command(), h.Nhints, LcDysymtab)
+			}
+			continue
+		}
+		if h.Nhints != dt.Nundefsym {
+			return fmt.Errorf("load %d, %v: %d hints, but %v has %d undefined symbols", i, h.Command(), h.Nhints, LcDysymtab, dt.Nundefsym)
+		}
+		for j, x := range h.Hints {
+			if x.Toc > 0xffffff {
+				return fmt.Errorf("load %d, %v: hint %d: table of contents index %#x does not fit in 24 bits", i, h.Command(), j, x.Toc)
+			}
+		}
+	}
+	return nil
+}
+
+// validateSections checks that the segments' section ranges lie within
+// t.Sections, do not overlap, and together cover all of it.
+func (t *FileTOC) validateSections() error {
+	owner := make([]int, len(t.Sections)) // index of load+1 owning each section
+	for i, l := range t.Loads {
+		g, ok := l.(*Segment)
+		if !ok || g.Nsect == 0 {
+			continue
+		}
+		if end := uint64(g.Firstsect) + uint64(g.Nsect); end > uint64(len(t.Sections)) {
+			return fmt.Errorf("load %d, segment %s: sections %d through %d, but there are only %d sections",
+				i, g.Name, g.Firstsect, end-1, len(t.Sections))
+		}
+		for j := g.Firstsect; j < g.Firstsect+g.Nsect; j++ {
+			if o := owner[j]; o != 0 {
+				return fmt.Errorf("load %d, segment %s: section %d (%s) also belongs to load %d",
+					i, g.Name, j, t.Sections[j].Name, o-1)
+			}
+			owner[j] = i + 1
+		}
+	}
+	for j, o := range owner {
+		if o == 0 {
+			return fmt.Errorf("section %d (%s) belongs to no segment", j, t.Sections[j].Name)
+		}
 	}
-	t.Cmdsz +=sectionsize
-	g.Len +=sectionsize
+	return nil
 }
 
 // A Load represents any Mach-O load command.
@@ -231,8 +334,7 @@ func (s *Section) Put32(b []byte, o binary.ByteOrder) int {
 	o.PutUint32(b[14*4:], uint32(s.Flags))
 	o.PutUint32(b[15*4:], s.Reserved1)
 	o.PutUint32(b[16*4:], s.Reserved2)
-	a := 17 * 4
-	return a + s.PutRelocs(b[a:], o)
+	return 17 * 4
 }
 
 func (s *Section) Put64(b []byte, o binary.ByteOrder) int {
@@ -248,44 +350,97 @@ func (s *Section) Put64(b []byte, o binary.ByteOrder) int {
 	o.PutUint32(b[13*4+2*8:], s.Reserved1)
 	o.PutUint32(b[14*4+2*8:], s.Reserved2)
 	o.PutUint32(b[15*4+2*8:], s.Reserved3)
-	a := 16*4 + 2*8
-	return a + s.PutRelocs(b[a:], o)
+	return 16*4 + 2*8
 }
 
+// PutRelocs writes s's relocations to b, as they lie at s.Reloff, and
+// returns the number of bytes written.
 func (s *Section) PutRelocs(b []byte, o binary.ByteOrder) int {
-	a := 0
-	for _, r := range s.Relocs {
-		var ri relocInfo
-		typ := uint32(r.Type) & (1<<4 - 1)
-		len := uint32(r.Len) & (1<<2 - 1)
-		pcrel := uint32(0)
-		if r.Pcrel {
-			pcrel = 1
-		}
-		ext := uint32(0)
-		if r.Extern {
-			ext = 1
-		}
-		switch {
-		case r.Scattered:
-			ri.Addr = r.Addr&(1<<24-1) | typ<<24 | len<<28 | 1<<31 | pcrel<<30
-			ri.Symnum = r.Value
-		case o == binary.LittleEndian:
-			ri.Addr = r.Addr
-			ri.Symnum = r.Value&(1<<24-1) | pcrel << 24 | len<<25 | ext << 27 | typ << 28
-		case o == binary.BigEndian:
-			ri.Addr = r.Addr
-			ri.Symnum = r.Value << 8 | pcrel << 7 | len << 5 | ext << 4 | typ
+	for i, r := range s.Relocs {
+		r.Put(b[i*RelocSize:], o)
+	}
+	return len(s.Relocs) * RelocSize
+}
+
+// Put writes r to b, as a relocation_info, or if r is scattered, a
+// scattered_relocation_info, and returns the number of bytes written.
+// A scattered relocation's fields lie in the same bits of its first
+// word whatever the byte order, but those of a plain relocation's
+// second word are reversed on a big-endian machine such as PowerPC.
+// Put panics if r's address or value does not fit in its 24 bits.
+func (r Reloc) Put(b []byte, o binary.ByteOrder) int {
+	typ := uint32(r.Type) & (1<<4 - 1)
+	len := uint32(r.Len) & (1<<2 - 1)
+	pcrel := uint32(0)
+	if r.Pcrel {
+		pcrel = 1
+	}
+	ext := uint32(0)
+	if r.Extern {
+		ext = 1
+	}
+	var addr, symnum uint32
+	switch {
+	case r.Scattered:
+		if r.Addr >= 1<<24 {
+			panic(fmt.Sprintf("scattered relocation address %#x does not fit in 24 bits", r.Addr))
 		}
-		o.PutUint32(b, ri.Addr)
-		o.PutUint32(b[4:], ri.Symnum)
-		a += 8
-		b = b[8:]
+		addr = r.Addr | typ<<24 | len<<28 | pcrel<<30 | 1<<31
+		symnum = r.Value
+	case r.Value >= 1<<24:
+		panic(fmt.Sprintf("relocation symbol or section number %d does not fit in 24 bits", r.Value))
+	case o == binary.BigEndian:
+		addr = r.Addr
+		symnum = r.Value<<8 | pcrel<<7 | len<<5 | ext<<4 | typ
+	default:
+		addr = r.Addr
+		symnum = r.Value | pcrel<<24 | len<<25 | ext<<27 | typ<<28
+	}
+	o.PutUint32(b, addr)
+	o.PutUint32(b[4:], symnum)
+	return RelocSize
+}
+
+// RelocSize is the size of a relocation_info, and so of a
+// scattered_relocation_info.
+const RelocSize = 8
+
+// Get sets r to the relocation at the start of b, in byte order o, the
+// inverse of Put, and returns the number of bytes read.  With Put, it
+// lets a tool edit a section's relocations in place, without a File.
+// It panics if o is neither binary.LittleEndian nor binary.BigEndian.
+func (r *Reloc) Get(b []byte, o binary.ByteOrder) int {
+	*r = Reloc{}
+	addr, symnum := o.Uint32(b), o.Uint32(b[4:])
+	if addr&(1<<31) != 0 { // scattered
+		r.Addr = addr & (1<<24 - 1)
+		r.Type = uint8((addr >> 24) & (1<<4 - 1))
+		r.Len = uint8((addr >> 28) & (1<<2 - 1))
+		r.Pcrel = addr&(1<<30) != 0
+		r.Value = symnum
+		r.Scattered = true
+		return RelocSize
+	}
+	r.Addr = addr
+	switch o {
+	case binary.LittleEndian:
+		r.Value = symnum & (1<<24 - 1)
+		r.Pcrel = symnum&(1<<24) != 0
+		r.Len = uint8((symnum >> 25) & (1<<2 - 1))
+		r.Extern = symnum&(1<<27) != 0
+		r.Type = uint8((symnum >> 28) & (1<<4 - 1))
+	case binary.BigEndian:
+		r.Value = symnum >> 8
+		r.Pcrel = symnum&(1<<7) != 0
+		r.Len = uint8((symnum >> 5) & (1<<2 - 1))
+		r.Extern = symnum&(1<<4) != 0
+		r.Type = uint8(symnum & (1<<4 - 1))
+	default:
+		panic(fmt.Sprintf("unknown byte order %v", o))
 	}
-	return a
+	return RelocSize
 }
 
-
 func putAtMost16Bytes(b []byte, n string) {
 	for i := range n { // at most 16 bytes
 		if i == 16 {
@@ -332,6 +487,7 @@ func (e *FormatError) String() string {
 func (t *FileTOC) DerivedCopy(Type HdrType, Flags HdrFlags) *FileTOC {
 	h := t.FileHeader
 	h.Ncmd, h.Cmdsz, h.Type, h.Flags = 0, 0, Type, Flags
+	h.SubCpu = uint32(CpuSubtype(h.SubCpu).Normalize(h.Cpu))
 
 	return &FileTOC{FileHeader: h, ByteOrder: t.ByteOrder}
 }
@@ -353,9 +509,9 @@ func (t *FileTOC) LoadAlign() uint64 {
 
 func (t *FileTOC) SymbolSize() uint32 {
 	if t.Magic == Magic64 {
-		return uint32(unsafe.Sizeof(Nlist64{}))
+		return Nlist64Size
 	}
-	return uint32(unsafe.Sizeof(Nlist32{}))
+	return Nlist32Size
 }
 
 func (t *FileTOC) HdrSize() uint32 {
@@ -365,7 +521,7 @@ func (t *FileTOC) HdrSize() uint32 {
 	case Magic64:
 		return fileHeaderSize64
 	case MagicFat:
-		panic("MagicFat not handled yet")
+		panic("a universal binary has no single header; see FatFile")
 	default:
 		panic(fmt.Sprintf("Unexpected magic number 0x%x, expected Mach-O object file", t.Magic))
 	}
@@ -397,7 +553,16 @@ func (t *FileTOC) FileSize() uint64 {
 	return sz
 }
 
+// Put writes the header and load commands of t, including segments'
+// section headers, to buffer, and returns the number of bytes written,
+// which is TOCSize; the contents they describe are the caller's to
+// write, or WriteTo's.  It panics if the segments' sections are
+// inconsistent (see Validate), rather than write garbage section
+// headers.
 func (t *FileTOC) Put(buffer []byte) int {
+	if err := t.validateSections(); err != nil {
+		panic(err.Error())
+	}
 	next := t.FileHeader.Put(buffer, t.ByteOrder)
 	for _, l := range t.Loads {
 		if s, ok := l.(*Segment); ok {
@@ -419,78 +584,107 @@ func (t *FileTOC) Put(buffer []byte) int {
 			}
 
 		} else {
-			next += l.Put(buffer[next:], t.ByteOrder)
+			n := l.Put(buffer[next:], t.ByteOrder)
+			// A command that ends in a string, such as a Dylib,
+			// is padded to the alignment of t's loads, as its
+			// size, its second word, says.
+			if size := int(l.LoadSize(t)); n < size {
+				for i := next + n; i < next+size; i++ {
+					buffer[i] = 0
+				}
+				t.ByteOrder.PutUint32(buffer[next+4:], uint32(size))
+				n = size
+			}
+			next += n
 		}
 	}
 	return next
 }
 
+// PutRelocs writes the relocations of each of t's sections to buffer,
+// which holds the whole file, at the section's Reloff.  It writes
+// nothing and returns an error if a section's Nreloc is not the number
+// of its Relocs, or if they would not fit in buffer.
+func (t *FileTOC) PutRelocs(buffer []byte) error {
+	for _, s := range t.Sections {
+		if s.Nreloc != uint32(len(s.Relocs)) {
+			return fmt.Errorf("section %s,%s: Nreloc is %d, but there are %d relocations", s.Seg, s.Name, s.Nreloc, len(s.Relocs))
+		}
+		if uint64(s.Reloff)+uint64(s.Nreloc)*RelocSize > uint64(len(buffer)) {
+			return fmt.Errorf("section %s,%s: relocations at %#x extend beyond the %d-byte buffer", s.Seg, s.Name, s.Reloff, len(buffer))
+		}
+	}
+	for _, s := range t.Sections {
+		s.PutRelocs(buffer[s.Reloff:], t.ByteOrder)
+	}
+	return nil
+}
+
 // UncompressedSize returns the size of the segment with its sections uncompressed, ignoring
 // its offset within the file.  The returned size is rounded up to the power of two in align.
-func (s *Segment) UncompressedSize(t *FileTOC, align uint64) uint64 {
+// It returns an error if a section's compression cannot be read, or the size overflows.
+func (s *Segment) UncompressedSize(t *FileTOC, align uint64) (uint64, error) {
 	sz := uint64(0)
 	for j := uint32(0); j < s.Nsect; j++ {
 		c := t.Sections[j+s.Firstsect]
-		sz += c.UncompressedSize()
+		csz, err := c.UncompressedSize()
+		if err != nil {
+			return 0, err
+		}
+		var ok bool
+		if sz, ok = CheckedAdd(sz, csz); !ok {
+			return 0, fmt.Errorf("segment %s uncompressed size overflows", s.Name)
+		}
 	}
-	return (sz + align - 1) & uint64(-int64(align))
+	sz, ok := CheckedRoundUp(sz, align)
+	if !ok {
+		return 0, fmt.Errorf("segment %s uncompressed size overflows", s.Name)
+	}
+	return sz, nil
 }
 
-func (s *Section) UncompressedSize() uint64 {
-	if !strings.HasPrefix(s.Name, "__z") {
-		return s.Size
-	}
-	b := make([]byte, 12)
-	n, err := s.sr.ReadAt(b, 0)
+// UncompressedSize returns the size of s once uncompressed.  It returns
+// an error if s is compressed, but its header is short or in no known
+// format (see Compression).
+func (s *Section) UncompressedSize() (uint64, error) {
+	c, err := s.Compression()
 	if err != nil {
-		panic("Malformed object file")
-	}
-	if n != len(b) {
-		return s.Size
+		return 0, err
 	}
-	if string(b[:4]) == "ZLIB" {
-		return binary.BigEndian.Uint64(b[4:12])
+	if c == nil {
+		return s.Size, nil
 	}
-	return s.Size
+	return c.Size, nil
 }
 
-func (s *Section) PutData(b []byte) {
-	bb := b[0:s.Size]
-	n, err := s.sr.ReadAt(bb, 0)
-	if err != nil || uint64(n) != s.Size {
-		panic("Malformed object file (ReadAt error)")
+// PutData writes the contents of s, as they are in the file, to b.
+// It returns an error if they cannot all be read.
+func (s *Section) PutData(b []byte) error {
+	if _, err := s.sr.ReadAt(b[0:s.Size], 0); err != nil {
+		return fmt.Errorf("section %s: %v", s.Name, err)
 	}
+	return nil
 }
 
-func (s *Section) PutUncompressedData(b []byte) {
-	if strings.HasPrefix(s.Name, "__z") {
-		bb := make([]byte, 12)
-		n, err := s.sr.ReadAt(bb, 0)
-		if err != nil {
-			panic("Malformed object file")
-		}
-		if n == len(bb) && string(bb[:4]) == "ZLIB" {
-			size := binary.BigEndian.Uint64(bb[4:12])
-			// Decompress starting at b[12:]
-			r, err := zlib.NewReader(io.NewSectionReader(s, 12, int64(size)-12))
-			if err != nil {
-				panic("Malformed object file (zlib.NewReader error)")
-			}
-			n, err := io.ReadFull(r, b[0:size])
-			if err != nil {
-				panic("Malformed object file (ReadFull error)")
-			}
-			if uint64(n) != size {
-				panic(fmt.Sprintf("PutUncompressedData, expected to read %d bytes, instead read %d", size, n))
-			}
-			if err := r.Close(); err != nil {
-				panic("Malformed object file (Close error)")
-			}
-			return
-		}
+// PutUncompressedData writes the uncompressed contents of s to b.
+// It returns an error if s cannot be uncompressed.
+func (s *Section) PutUncompressedData(b []byte) error {
+	size, err := s.UncompressedSize()
+	if err != nil {
+		return err
+	}
+	r, err := s.UncompressedReader()
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(r, b[0:size])
+	if cerr := r.Close(); err == nil {
+		err = cerr
 	}
-	// Not compressed
-	s.PutData(b)
+	if err != nil {
+		return fmt.Errorf("section %s: %v", s.Name, err)
+	}
+	return nil
 }
 
 func (b LoadBytes) String() string {
@@ -520,19 +714,22 @@ func (lc LoadCmd) Put(b []byte, o binary.ByteOrder) int {
 func (s LoadCmdBytes) String() string {
 	return s.LoadCmd.String() + ": " + s.LoadBytes.String()
 }
+func (s LoadCmdBytes) Put(b []byte, o binary.ByteOrder) int {
+	return copy(b, s.LoadBytes)
+}
 func (s LoadCmdBytes) Copy() LoadCmdBytes {
 	return LoadCmdBytes{LoadCmd: s.LoadCmd, LoadBytes: s.LoadBytes.Copy()}
 }
 
 func (s *SegmentHeader) String() string {
 	return fmt.Sprintf(
-		"Seg %s, len=0x%x, addr=0x%x, memsz=0x%x, offset=0x%x, filesz=0x%x, maxprot=0x%x, prot=0x%x, nsect=%d, flag=0x%x, firstsect=%d",
+		"Seg %s, len=0x%x, addr=0x%x, memsz=0x%x, offset=0x%x, filesz=0x%x, maxprot=0x%x, prot=0x%x, nsect=%d, flag=%s, firstsect=%d",
 		s.Name, s.Len, s.Addr, s.Memsz, s.Offset, s.Filesz, s.Maxprot, s.Prot, s.Nsect, s.Flag, s.Firstsect)
 }
 
 func (s *Segment) String() string {
 	return fmt.Sprintf(
-		"Seg %s, len=0x%x, addr=0x%x, memsz=0x%x, offset=0x%x, filesz=0x%x, maxprot=0x%x, prot=0x%x, nsect=%d, flag=0x%x, firstsect=%d",
+		"Seg %s, len=0x%x, addr=0x%x, memsz=0x%x, offset=0x%x, filesz=0x%x, maxprot=0x%x, prot=0x%x, nsect=%d, flag=%s, firstsect=%d",
 		s.Name, s.Len, s.Addr, s.Memsz, s.Offset, s.Filesz, s.Maxprot, s.Prot, s.Nsect, s.Flag, s.Firstsect)
 }
 
@@ -598,15 +795,64 @@ type Dylib struct {
 	Time           uint32
 	CurrentVersion uint32
 	CompatVersion  uint32
+	Kind           DylibKind
+}
+
+// A DylibKind is how a Dylib is loaded, which is to say, which load
+// command it came from.
+type DylibKind uint8
+
+const (
+	DylibLoad     DylibKind = iota // LC_LOAD_DYLIB
+	DylibWeak                      // LC_LOAD_WEAK_DYLIB: it may be missing
+	DylibReexport                  // LC_REEXPORT_DYLIB: its exports are this image's too
+	DylibLazy                      // LC_LAZY_LOAD_DYLIB: loaded when first used
+	DylibUpward                    // LC_LOAD_UPWARD_DYLIB: it is also a client of this image
+	DylibID                        // LC_ID_DYLIB: not loaded; it is this image, a dylib, and Name its install name
+)
+
+var dylibKindCmds = []LoadCmd{LcDylib, LcLoadWeakDylib, LcReexportDylib, LcLazyLoadDylib, LcLoadUpwardDylib, LcIdDylib}
+var dylibKindNames = []string{"load", "weak", "reexport", "lazy", "upward", "id"}
+
+func (k DylibKind) String() string {
+	if int(k) < len(dylibKindNames) {
+		return dylibKindNames[k]
+	}
+	return fmt.Sprintf("DylibKind(%d)", k)
 }
 
-func (s *Dylib) String() string { return "Dylib " + s.Name }
+func (s *Dylib) String() string {
+	if s.Kind == DylibLoad {
+		return "Dylib " + s.Name
+	}
+	return "Dylib " + s.Kind.String() + " " + s.Name
+}
+func (s *Dylib) Command() LoadCmd {
+	if int(s.Kind) < len(dylibKindCmds) {
+		return dylibKindCmds[s.Kind]
+	}
+	return s.LoadCmd
+}
 func (s *Dylib) Copy() *Dylib {
 	r := *s
 	return &r
 }
 func (s *Dylib) LoadSize(t *FileTOC) uint32 {
-	return uint32(RoundUp(uint64(unsafe.Sizeof(DylibCmd{}))+uint64(len(s.Name)), t.LoadAlign()))
+	return uint32(RoundUp(uint64(unsafe.Sizeof(DylibCmd{}))+uint64(len(s.Name))+1, t.LoadAlign())) // +1 for the NUL
+}
+
+// Put writes s, with its name just after the fixed fields, and returns
+// the number of bytes written, up to the name's NUL; FileTOC.Put pads
+// it to LoadSize.
+func (s *Dylib) Put(b []byte, o binary.ByteOrder) int {
+	n := int(unsafe.Sizeof(DylibCmd{}))
+	o.PutUint32(b[0*4:], uint32(s.Command()))
+	o.PutUint32(b[1*4:], uint32(n+len(s.Name)+1))
+	o.PutUint32(b[2*4:], uint32(n))
+	o.PutUint32(b[3*4:], s.Time)
+	o.PutUint32(b[4*4:], s.CurrentVersion)
+	o.PutUint32(b[5*4:], s.CompatVersion)
+	return putCString(b, n, s.Name)
 }
 
 type Dylinker struct {
@@ -619,7 +865,24 @@ func (s *Dylinker) Copy() *Dylinker {
 	return &Dylinker{DylinkerCmd: s.DylinkerCmd, Name: s.Name}
 }
 func (s *Dylinker) LoadSize(t *FileTOC) uint32 {
-	return uint32(RoundUp(uint64(unsafe.Sizeof(DylinkerCmd{}))+uint64(len(s.Name)), t.LoadAlign()))
+	return uint32(RoundUp(uint64(unsafe.Sizeof(DylinkerCmd{}))+uint64(len(s.Name))+1, t.LoadAlign())) // +1 for the NUL
+}
+
+// Put writes s as Dylib.Put does.
+func (s *Dylinker) Put(b []byte, o binary.ByteOrder) int {
+	n := int(unsafe.Sizeof(DylinkerCmd{}))
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], uint32(n+len(s.Name)+1))
+	o.PutUint32(b[2*4:], uint32(n))
+	return putCString(b, n, s.Name)
+}
+
+// putCString writes str, and a NUL, to b at n, and returns where they
+// end.
+func putCString(b []byte, n int, str string) int {
+	n += copy(b[n:], str)
+	b[n] = 0
+	return n + 1
 }
 
 // A Symtab represents a Mach-O symbol table command.
@@ -657,6 +920,468 @@ func (s *LinkEditData) Copy() *LinkEditData {
 func (s *LinkEditData) LoadSize(t *FileTOC) uint32 {
 	return uint32(unsafe.Sizeof(LinkEditDataCmd{}))
 }
+func (s *LinkEditData) Put(b []byte, o binary.ByteOrder) int {
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], s.Len)
+	o.PutUint32(b[2*4:], s.DataOff)
+	o.PutUint32(b[3*4:], s.DataLen)
+	return 4 * 4
+}
+
+// An EntryPoint represents an LC_MAIN command, which gives the file
+// offset of a program's main entry point.
+type EntryPoint struct {
+	EntryPointCmd
+}
+
+func (s *EntryPoint) String() string {
+	return fmt.Sprintf("EntryPoint entryoff=0x%x, stacksize=%d", s.EntryOff, s.StackSize)
+}
+func (s *EntryPoint) Copy() *EntryPoint {
+	return &EntryPoint{EntryPointCmd: s.EntryPointCmd}
+}
+func (s *EntryPoint) LoadSize(t *FileTOC) uint32 {
+	return uint32(unsafe.Sizeof(EntryPointCmd{}))
+}
+func (s *EntryPoint) Put(b []byte, o binary.ByteOrder) int {
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], s.Len)
+	o.PutUint64(b[2*4:], s.EntryOff)
+	o.PutUint64(b[2*4+8:], s.StackSize)
+	return 2*4 + 2*8
+}
+
+// A Uuid represents an LC_UUID command, which identifies a binary and
+// the dSYM made from it.
+type Uuid struct {
+	UuidCmd
+}
+
+// String returns the UUID in the canonical upper-case 8-4-4-4-12 form.
+func (s *Uuid) String() string {
+	h := strings.ToUpper(hex.EncodeToString(s.Id[:]))
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+func (s *Uuid) Copy() *Uuid {
+	return &Uuid{UuidCmd: s.UuidCmd}
+}
+func (s *Uuid) LoadSize(t *FileTOC) uint32 {
+	return uint32(unsafe.Sizeof(UuidCmd{}))
+}
+func (s *Uuid) Put(b []byte, o binary.ByteOrder) int {
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], s.Len)
+	copy(b[2*4:], s.Id[:])
+	return 2*4 + len(s.Id)
+}
+
+// A SourceVersion represents an LC_SOURCE_VERSION command, the version
+// of the sources a binary was built from.
+type SourceVersion struct {
+	SourceVersionCmd
+}
+
+// Parts returns the version's components, A through E.
+func (s *SourceVersion) Parts() [5]uint64 {
+	v := s.Version
+	return [5]uint64{v >> 40, v >> 30 & 0x3ff, v >> 20 & 0x3ff, v >> 10 & 0x3ff, v & 0x3ff}
+}
+
+// String returns the version in the usual dotted form, A.B.C.D.E.
+func (s *SourceVersion) String() string {
+	p := s.Parts()
+	return fmt.Sprintf("%d.%d.%d.%d.%d", p[0], p[1], p[2], p[3], p[4])
+}
+func (s *SourceVersion) Copy() *SourceVersion {
+	return &SourceVersion{SourceVersionCmd: s.SourceVersionCmd}
+}
+func (s *SourceVersion) LoadSize(t *FileTOC) uint32 {
+	return uint32(unsafe.Sizeof(SourceVersionCmd{}))
+}
+func (s *SourceVersion) Put(b []byte, o binary.ByteOrder) int {
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], s.Len)
+	o.PutUint64(b[2*4:], s.Version)
+	return 2*4 + 8
+}
+
+// A Symseg represents an LC_SYMSEG command, which locates a symbol
+// segment in the format of long-gone versions of gdb.
+type Symseg struct {
+	SymsegCmd
+}
+
+func (s *Symseg) String() string { return fmt.Sprintf("Symseg offset=0x%x, size=%d", s.Offset, s.Size) }
+func (s *Symseg) Copy() *Symseg {
+	return &Symseg{SymsegCmd: s.SymsegCmd}
+}
+func (s *Symseg) LoadSize(t *FileTOC) uint32 {
+	return uint32(unsafe.Sizeof(SymsegCmd{}))
+}
+func (s *Symseg) Put(b []byte, o binary.ByteOrder) int {
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], s.Len)
+	o.PutUint32(b[2*4:], s.Offset)
+	o.PutUint32(b[3*4:], s.Size)
+	return 4 * 4
+}
+
+// An Ident represents an LC_IDENT command, in which old linkers
+// recorded identifying strings.
+type Ident struct {
+	LoadCmd
+	Len     uint32
+	Strings []string
+}
+
+func (s *Ident) String() string { return "Ident " + strings.Join(s.Strings, " ") }
+func (s *Ident) Copy() *Ident {
+	return &Ident{LoadCmd: s.LoadCmd, Len: s.Len, Strings: append([]string{}, s.Strings...)}
+}
+func (s *Ident) LoadSize(t *FileTOC) uint32 {
+	n := uint64(8)
+	for _, str := range s.Strings {
+		n += uint64(len(str)) + 1
+	}
+	return uint32(RoundUp(n, t.LoadAlign()))
+}
+func (s *Ident) Put(b []byte, o binary.ByteOrder) int {
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], s.Len)
+	n := 2 * 4
+	for _, str := range s.Strings {
+		n += copy(b[n:], str)
+		b[n] = 0
+		n++
+	}
+	for ; n < int(s.Len); n++ {
+		b[n] = 0
+	}
+	return n
+}
+
+// A Prepage represents an LC_PREPAGE command, which was only ever used
+// within the kernel and has no defined contents.
+type Prepage struct {
+	LoadCmd
+	Len  uint32
+	Data []byte
+}
+
+func (s *Prepage) String() string { return fmt.Sprintf("Prepage (%d bytes)", len(s.Data)) }
+func (s *Prepage) Copy() *Prepage {
+	return &Prepage{LoadCmd: s.LoadCmd, Len: s.Len, Data: append([]byte{}, s.Data...)}
+}
+func (s *Prepage) LoadSize(t *FileTOC) uint32 {
+	return 8 + uint32(len(s.Data))
+}
+func (s *Prepage) Put(b []byte, o binary.ByteOrder) int {
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], s.Len)
+	return 2*4 + copy(b[2*4:], s.Data)
+}
+
+func (s *Thread) String() string {
+	name := "Thread"
+	if s.LoadCmd == LcUnixthread {
+		name = "UnixThread"
+	}
+	for _, st := range s.States {
+		name += " " + threadFlavorName(s.cpu, st.Flavor)
+	}
+	if pc, ok := s.PC(); ok {
+		name += fmt.Sprintf(", pc=0x%x", pc)
+	}
+	return name
+}
+func (s *Thread) Copy() *Thread {
+	r := *s
+	r.States = nil
+	for _, st := range s.States {
+		r.States = append(r.States, ThreadState{st.Flavor, append([]uint32{}, st.Data...)})
+	}
+	if len(r.States) > 0 {
+		r.Data = r.States[0].Data
+	}
+	return &r
+}
+func (s *Thread) LoadSize(t *FileTOC) uint32 {
+	n := uint32(8)
+	for _, st := range s.States {
+		n += 8 + 4*uint32(len(st.Data))
+	}
+	return n
+}
+func (s *Thread) Put(b []byte, o binary.ByteOrder) int {
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], s.Len)
+	n := 2 * 4
+	for _, st := range s.States {
+		o.PutUint32(b[n:], st.Flavor)
+		o.PutUint32(b[n+4:], uint32(len(st.Data)))
+		n += 8
+		for _, w := range st.Data {
+			o.PutUint32(b[n:], w)
+			n += 4
+		}
+	}
+	return n
+}
+
+func threadFlavorName(cpu Cpu, flavor uint32) string {
+	switch {
+	case (cpu == Cpu386 || cpu == CpuAmd64) && flavor == ThreadStateX86_32:
+		return "x86_THREAD_STATE32"
+	case (cpu == Cpu386 || cpu == CpuAmd64) && flavor == ThreadStateX86_64:
+		return "x86_THREAD_STATE64"
+	case (cpu == Cpu386 || cpu == CpuAmd64) && flavor == ThreadStateX86:
+		return "x86_THREAD_STATE"
+	case cpu == CpuArm64 && flavor == ThreadStateARM64:
+		return "ARM_THREAD_STATE64"
+	}
+	return fmt.Sprintf("flavor%d", flavor)
+}
+
+// Regs returns the registers of the first state of s whose flavor is
+// known for s's CPU, as a *Regs386, *RegsAMD64, or *RegsARM64, or nil
+// if there is none.
+func (s *Thread) Regs() interface{} {
+	if s.bo == nil {
+		return nil
+	}
+	for _, st := range s.States {
+		flavor, data := st.Flavor, st.Data
+		if flavor == ThreadStateX86 && len(data) >= 2 {
+			flavor, data = data[0], data[2:]
+		}
+		var regs interface{}
+		switch {
+		case (s.cpu == Cpu386 || s.cpu == CpuAmd64) && flavor == ThreadStateX86_32:
+			regs = new(Regs386)
+		case (s.cpu == Cpu386 || s.cpu == CpuAmd64) && flavor == ThreadStateX86_64:
+			regs = new(RegsAMD64)
+		case s.cpu == CpuArm64 && flavor == ThreadStateARM64:
+			regs = new(RegsARM64)
+		default:
+			continue
+		}
+		b := make([]byte, 4*len(data))
+		for i, w := range data {
+			s.bo.PutUint32(b[4*i:], w)
+		}
+		if binary.Size(regs) <= len(b) && binary.Read(bytes.NewReader(b), s.bo, regs) == nil {
+			return regs
+		}
+	}
+	return nil
+}
+
+// PC returns the program counter in s's registers, and whether there
+// is one.
+func (s *Thread) PC() (uint64, bool) {
+	switch r := s.Regs().(type) {
+	case *Regs386:
+		return uint64(r.IP), true
+	case *RegsAMD64:
+		return r.IP, true
+	case *RegsARM64:
+		return r.PC, true
+	}
+	return 0, false
+}
+
+// A Routines represents an LC_ROUTINES or LC_ROUTINES_64 command,
+// which names the routine that initializes a dynamic library.
+type Routines struct {
+	LoadCmd
+	Len         uint32
+	InitAddress uint64
+	InitModule  uint64
+	Reserved    [6]uint64
+}
+
+func (s *Routines) String() string {
+	return fmt.Sprintf("Routines init=0x%x, module=%d", s.InitAddress, s.InitModule)
+}
+func (s *Routines) Copy() *Routines {
+	r := *s
+	return &r
+}
+func (s *Routines) LoadSize(t *FileTOC) uint32 {
+	if s.LoadCmd == LcRoutines64 {
+		return uint32(unsafe.Sizeof(Routines64{}))
+	}
+	return uint32(unsafe.Sizeof(Routines32{}))
+}
+func (s *Routines) Put(b []byte, o binary.ByteOrder) int {
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], s.Len)
+	if s.LoadCmd == LcRoutines64 {
+		o.PutUint64(b[2*4:], s.InitAddress)
+		o.PutUint64(b[2*4+8:], s.InitModule)
+		for i, r := range s.Reserved {
+			o.PutUint64(b[2*4+16+8*i:], r)
+		}
+		return 2*4 + 8*8
+	}
+	o.PutUint32(b[2*4:], uint32(s.InitAddress))
+	o.PutUint32(b[3*4:], uint32(s.InitModule))
+	for i, r := range s.Reserved {
+		o.PutUint32(b[4*4+4*i:], uint32(r))
+	}
+	return 10 * 4
+}
+
+// A TwolevelHints represents an LC_TWOLEVEL_HINTS command and the
+// hints it refers to, one for each undefined symbol, in the order of
+// the undefined symbols in the symbol table.
+type TwolevelHints struct {
+	TwolevelHintsCmd
+	Hints []TwolevelHint
+}
+
+// A TwolevelHint says where the dynamic linker should look first for
+// an undefined symbol: in which sub-image, and at which entry of its
+// table of contents.
+type TwolevelHint struct {
+	SubImage uint8  // index of the sub-image, in the order of the dylibs
+	Toc      uint32 // index into that image's table of contents; 24 bits
+}
+
+func (s *TwolevelHints) String() string { return fmt.Sprintf("TwolevelHints nhints=%d", len(s.Hints)) }
+func (s *TwolevelHints) Copy() *TwolevelHints {
+	return &TwolevelHints{TwolevelHintsCmd: s.TwolevelHintsCmd, Hints: append([]TwolevelHint{}, s.Hints...)}
+}
+func (s *TwolevelHints) LoadSize(t *FileTOC) uint32 {
+	return uint32(unsafe.Sizeof(TwolevelHintsCmd{}))
+}
+func (s *TwolevelHints) Put(b []byte, o binary.ByteOrder) int {
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], s.Len)
+	o.PutUint32(b[2*4:], s.Offset)
+	o.PutUint32(b[3*4:], s.Nhints)
+	return 4 * 4
+}
+
+// PutHints writes the hints themselves, as they belong at s.Offset.
+func (s *TwolevelHints) PutHints(b []byte, o binary.ByteOrder) int {
+	for i, h := range s.Hints {
+		o.PutUint32(b[4*i:], h.pack(o))
+	}
+	return 4 * len(s.Hints)
+}
+
+// The C struct is a pair of bitfields, which compilers lay out from
+// the least significant bit on little-endian targets and from the most
+// significant on big-endian ones.
+func (h TwolevelHint) pack(o binary.ByteOrder) uint32 {
+	if o == binary.BigEndian {
+		return uint32(h.SubImage)<<24 | h.Toc&0xffffff
+	}
+	return h.Toc<<8 | uint32(h.SubImage)
+}
+func unpackTwolevelHint(v uint32, o binary.ByteOrder) TwolevelHint {
+	if o == binary.BigEndian {
+		return TwolevelHint{SubImage: uint8(v >> 24), Toc: v & 0xffffff}
+	}
+	return TwolevelHint{SubImage: uint8(v), Toc: v >> 8}
+}
+
+// A PrebindCksum represents an LC_PREBIND_CKSUM command: the checksum
+// of a prebound image, or zero if it was not yet prebound.
+type PrebindCksum struct {
+	PrebindCksumCmd
+}
+
+func (s *PrebindCksum) String() string { return fmt.Sprintf("PrebindCksum 0x%x", s.Cksum) }
+func (s *PrebindCksum) Copy() *PrebindCksum {
+	return &PrebindCksum{PrebindCksumCmd: s.PrebindCksumCmd}
+}
+func (s *PrebindCksum) LoadSize(t *FileTOC) uint32 {
+	return uint32(unsafe.Sizeof(PrebindCksumCmd{}))
+}
+func (s *PrebindCksum) Put(b []byte, o binary.ByteOrder) int {
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], s.Len)
+	o.PutUint32(b[2*4:], s.Cksum)
+	return 3 * 4
+}
+
+// A VersionMin represents an LC_VERSION_MIN_* command, the predecessor
+// of LC_BUILD_VERSION: the minimum OS version and the SDK, for the
+// platform the command names.
+type VersionMin struct {
+	VersionMinCmd
+}
+
+// String gives the versions as otool does, with "n/a" for a zero SDK.
+func (s *VersionMin) String() string {
+	sdk := "n/a"
+	if s.Sdk != 0 {
+		sdk = s.Sdk.Short()
+	}
+	return fmt.Sprintf("VersionMin %s version %s sdk %s", s.Platform(), s.Version.Short(), sdk)
+}
+func (s *VersionMin) Copy() *VersionMin {
+	return &VersionMin{VersionMinCmd: s.VersionMinCmd}
+}
+func (s *VersionMin) LoadSize(t *FileTOC) uint32 {
+	return uint32(unsafe.Sizeof(VersionMinCmd{}))
+}
+func (s *VersionMin) Put(b []byte, o binary.ByteOrder) int {
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], s.Len)
+	o.PutUint32(b[2*4:], uint32(s.Version))
+	o.PutUint32(b[3*4:], uint32(s.Sdk))
+	return 4 * 4
+}
+
+// Platform returns the platform s's command is for.
+func (s *VersionMin) Platform() Platform {
+	switch s.LoadCmd {
+	case LcVersionMinMacosx:
+		return PlatformMacOS
+	case LcVersionMinIphoneos:
+		return PlatformIOS
+	case LcVersionMinTvos:
+		return PlatformTvOS
+	case LcVersionMinWatchos:
+		return PlatformWatchOS
+	}
+	return 0
+}
+
+// A BuildVersion represents an LC_BUILD_VERSION command: the platform a
+// binary targets, the OS and SDK versions, and the tools that built it.
+type BuildVersion struct {
+	BuildVersionCmd
+	Tools []BuildTool
+}
+
+func (s *BuildVersion) String() string {
+	return fmt.Sprintf("BuildVersion %s, minos=%s, sdk=%s, ntools=%d", s.Platform, s.Minos, s.Sdk, len(s.Tools))
+}
+func (s *BuildVersion) Copy() *BuildVersion {
+	return &BuildVersion{BuildVersionCmd: s.BuildVersionCmd, Tools: append([]BuildTool{}, s.Tools...)}
+}
+func (s *BuildVersion) LoadSize(t *FileTOC) uint32 {
+	return uint32(unsafe.Sizeof(BuildVersionCmd{})) + uint32(len(s.Tools))*uint32(unsafe.Sizeof(BuildTool{}))
+}
+func (s *BuildVersion) Put(b []byte, o binary.ByteOrder) int {
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], s.Len)
+	o.PutUint32(b[2*4:], uint32(s.Platform))
+	o.PutUint32(b[3*4:], uint32(s.Minos))
+	o.PutUint32(b[4*4:], uint32(s.Sdk))
+	o.PutUint32(b[5*4:], uint32(len(s.Tools)))
+	n := 6 * 4
+	for _, t := range s.Tools {
+		o.PutUint32(b[n:], uint32(t.Tool))
+		o.PutUint32(b[n+4:], uint32(t.Version))
+		n += 8
+	}
+	return n
+}
 
 type DyldInfo struct {
 	DyldInfoCmd
@@ -669,6 +1394,11 @@ func (s *DyldInfo) Copy() *DyldInfo {
 func (s *DyldInfo) LoadSize(t *FileTOC) uint32 {
 	return uint32(unsafe.Sizeof(DyldInfoCmd{}))
 }
+func (s *DyldInfo) Put(b []byte, o binary.ByteOrder) int {
+	return putUint32s(b, o, uint32(s.LoadCmd), s.Len,
+		s.RebaseOff, s.RebaseLen, s.BindOff, s.BindLen, s.WeakBindOff, s.WeakBindLen,
+		s.LazyBindOff, s.LazyBindLen, s.ExportOff, s.ExportLen)
+}
 
 type EncryptionInfo struct {
 	EncryptionInfoCmd
@@ -679,8 +1409,14 @@ func (s *EncryptionInfo) Copy() *EncryptionInfo {
 	return &EncryptionInfo{EncryptionInfoCmd: s.EncryptionInfoCmd}
 }
 func (s *EncryptionInfo) LoadSize(t *FileTOC) uint32 {
+	if s.LoadCmd == LcEncryptionInfo64 {
+		return uint32(unsafe.Sizeof(EncryptionInfoCmd{})) + 4 // and a reserved word
+	}
 	return uint32(unsafe.Sizeof(EncryptionInfoCmd{}))
 }
+func (s *EncryptionInfo) Put(b []byte, o binary.ByteOrder) int {
+	return putUint32s(b, o, uint32(s.LoadCmd), s.Len, s.CryptOff, s.CryptLen, s.CryptId)
+}
 
 // A Dysymtab represents a Mach-O dynamic symbol table command.
 type Dysymtab struct {
@@ -695,6 +1431,21 @@ func (s *Dysymtab) Copy() *Dysymtab {
 func (s *Dysymtab) LoadSize(t *FileTOC) uint32 {
 	return uint32(unsafe.Sizeof(DysymtabCmd{}))
 }
+func (s *Dysymtab) Put(b []byte, o binary.ByteOrder) int {
+	return putUint32s(b, o, uint32(s.LoadCmd), s.Len,
+		s.Ilocalsym, s.Nlocalsym, s.Iextdefsym, s.Nextdefsym, s.Iundefsym, s.Nundefsym,
+		s.Tocoffset, s.Ntoc, s.Modtaboff, s.Nmodtab, s.Extrefsymoff, s.Nextrefsyms,
+		s.Indirectsymoff, s.Nindirectsyms, s.Extreloff, s.Nextrel, s.Locreloff, s.Nlocrel)
+}
+
+// putUint32s writes words to b, one after another, and returns the
+// number of bytes written.
+func putUint32s(b []byte, o binary.ByteOrder, words ...uint32) int {
+	for i, w := range words {
+		o.PutUint32(b[i*4:], w)
+	}
+	return 4 * len(words)
+}
 
 // A Rpath represents a Mach-O rpath command.
 type Rpath struct {
@@ -708,7 +1459,16 @@ func (s *Rpath) Copy() *Rpath {
 	return &Rpath{Path: s.Path}
 }
 func (s *Rpath) LoadSize(t *FileTOC) uint32 {
-	return uint32(RoundUp(uint64(unsafe.Sizeof(RpathCmd{}))+uint64(len(s.Path)), t.LoadAlign()))
+	return uint32(RoundUp(uint64(unsafe.Sizeof(RpathCmd{}))+uint64(len(s.Path))+1, t.LoadAlign())) // +1 for the NUL
+}
+
+// Put writes s as Dylib.Put does.
+func (s *Rpath) Put(b []byte, o binary.ByteOrder) int {
+	n := int(unsafe.Sizeof(RpathCmd{}))
+	o.PutUint32(b[0*4:], uint32(LcRpath))
+	o.PutUint32(b[1*4:], uint32(n+len(s.Path)+1))
+	o.PutUint32(b[2*4:], uint32(n))
+	return putCString(b, n, s.Path)
 }
 
 // Open opens the named file using os.Open and prepares it for use as a Mach-O binary.
@@ -738,16 +1498,27 @@ func (f *File) Close() error {
 	return err
 }
 
+// ErrFat is returned from NewFile or Open when the file is a universal
+// binary, whose slices are Mach-O files; use NewFatFile.
+var ErrFat = &FormatError{0, "universal (fat) Mach-O file; use NewFatFile"}
+
 // NewFile creates a new File for accessing a Mach-O binary in an underlying reader.
 // The Mach-O binary is expected to start at position 0 in the ReaderAt.
 func NewFile(r io.ReaderAt) (*File, error) {
-	f := new(File)
-	sr := io.NewSectionReader(r, 0, 1<<63-1)
+	return newFileAt(r, 0)
+}
+
+// newFileAt is NewFile for a Mach-O binary whose header and load
+// commands start at position base in r, but whose file offsets, like
+// those of a fileset entry, are positions in r.
+func newFileAt(r io.ReaderAt, base int64) (*File, error) {
+	f := &File{r: r}
+	sr := io.NewSectionReader(r, base, 1<<63-1-base)
 
 	// Read and decode Mach magic to determine byte order, size.
 	// Magic32 and Magic64 differ only in the bottom bit.
 	var ident [4]byte
-	if _, err := r.ReadAt(ident[0:], 0); err != nil {
+	if _, err := r.ReadAt(ident[0:], base); err != nil {
 		return nil, err
 	}
 	be := binary.BigEndian.Uint32(ident[0:])
@@ -760,6 +1531,9 @@ func NewFile(r io.ReaderAt) (*File, error) {
 		f.ByteOrder = binary.LittleEndian
 		f.Magic = le
 	default:
+		if be == MagicFat {
+			return nil, ErrFat
+		}
 		return nil, formatError(0, "invalid magic number be=0x%x, le=0x%x", be, le)
 	}
 
@@ -774,7 +1548,7 @@ func NewFile(r io.ReaderAt) (*File, error) {
 		offset = fileHeaderSize64
 	}
 	dat := make([]byte, f.Cmdsz)
-	if _, err := r.ReadAt(dat, offset); err != nil {
+	if _, err := r.ReadAt(dat, base+offset); err != nil {
 		return nil, err
 	}
 	f.Loads = make([]Load, f.Ncmd)
@@ -790,6 +1564,7 @@ func NewFile(r io.ReaderAt) (*File, error) {
 		}
 		var cmddat []byte
 		cmddat, dat = dat[0:siz], dat[siz:]
+		f.raw = append(f.raw, LoadBytes(cmddat))
 		offset += int64(siz)
 		var s *Segment
 		switch cmd {
@@ -823,7 +1598,7 @@ func NewFile(r io.ReaderAt) (*File, error) {
 			l.DylinkerCmd = hdr
 			f.Loads[i] = l
 
-		case LcDylib:
+		case LcDylib, LcLoadWeakDylib, LcReexportDylib, LcLazyLoadDylib, LcLoadUpwardDylib, LcIdDylib:
 			var hdr DylibCmd
 			b := bytes.NewReader(cmddat)
 			if err := binary.Read(b, bo, &hdr); err != nil {
@@ -837,6 +1612,11 @@ func NewFile(r io.ReaderAt) (*File, error) {
 			l.Time = hdr.Time
 			l.CurrentVersion = hdr.CurrentVersion
 			l.CompatVersion = hdr.CompatVersion
+			for k, c := range dylibKindCmds {
+				if c == LoadCmd(cmd) {
+					l.Kind = DylibKind(k)
+				}
+			}
 			f.Loads[i] = l
 
 		case LcSymtab:
@@ -972,8 +1752,192 @@ func NewFile(r io.ReaderAt) (*File, error) {
 				}
 			}
 
+		case LcMain:
+			if uint64(siz) != uint64(unsafe.Sizeof(EntryPointCmd{})) {
+				f.Loads[i] = LoadCmdBytes{LoadCmd(cmd), LoadBytes(cmddat)}
+				break
+			}
+			l := new(EntryPoint)
+			if err := binary.Read(bytes.NewReader(cmddat), bo, &l.EntryPointCmd); err != nil {
+				return nil, err
+			}
+			f.Loads[i] = l
+
+		case LcSourceVersion:
+			if uint64(siz) != uint64(unsafe.Sizeof(SourceVersionCmd{})) {
+				f.Loads[i] = LoadCmdBytes{LoadCmd(cmd), LoadBytes(cmddat)}
+				break
+			}
+			l := new(SourceVersion)
+			if err := binary.Read(bytes.NewReader(cmddat), bo, &l.SourceVersionCmd); err != nil {
+				return nil, err
+			}
+			f.Loads[i] = l
+
+		case LcVersionMinMacosx, LcVersionMinIphoneos, LcVersionMinTvos, LcVersionMinWatchos:
+			if uint64(siz) != uint64(unsafe.Sizeof(VersionMinCmd{})) {
+				f.Loads[i] = LoadCmdBytes{LoadCmd(cmd), LoadBytes(cmddat)}
+				break
+			}
+			l := new(VersionMin)
+			if err := binary.Read(bytes.NewReader(cmddat), bo, &l.VersionMinCmd); err != nil {
+				return nil, err
+			}
+			f.Loads[i] = l
+
+		case LcUuid:
+			if uint64(siz) != uint64(unsafe.Sizeof(UuidCmd{})) {
+				f.Loads[i] = LoadCmdBytes{LoadCmd(cmd), LoadBytes(cmddat)}
+				break
+			}
+			l := new(Uuid)
+			if err := binary.Read(bytes.NewReader(cmddat), bo, &l.UuidCmd); err != nil {
+				return nil, err
+			}
+			f.Loads[i] = l
+
+		case LcSymseg:
+			if uint64(siz) != uint64(unsafe.Sizeof(SymsegCmd{})) {
+				f.Loads[i] = LoadCmdBytes{LoadCmd(cmd), LoadBytes(cmddat)}
+				break
+			}
+			l := new(Symseg)
+			if err := binary.Read(bytes.NewReader(cmddat), bo, &l.SymsegCmd); err != nil {
+				return nil, err
+			}
+			f.Loads[i] = l
+
+		case LcIdent:
+			l := &Ident{LoadCmd: cmd, Len: siz}
+			for b := bytes.TrimRight(cmddat[8:], "\x00"); len(b) > 0; {
+				str := cstring(b)
+				l.Strings = append(l.Strings, str)
+				b = b[min(len(str)+1, len(b)):]
+			}
+			if l.LoadSize(&f.FileTOC) != siz {
+				// Padded more than necessary; keep the bytes as they are.
+				f.Loads[i] = LoadCmdBytes{LoadCmd(cmd), LoadBytes(cmddat)}
+				break
+			}
+			f.Loads[i] = l
+
+		case LcPrepage:
+			f.Loads[i] = &Prepage{LoadCmd: cmd, Len: siz, Data: append([]byte{}, cmddat[8:]...)}
+
+		case LcThread, LcUnixthread:
+			l := &Thread{LoadCmd: cmd, Len: siz, cpu: f.Cpu, bo: bo}
+			for b := cmddat[8:]; len(b) > 0; {
+				if len(b) < 8 {
+					l = nil
+					break
+				}
+				flavor, count := bo.Uint32(b), bo.Uint32(b[4:])
+				if uint64(count)*4 > uint64(len(b)-8) {
+					l = nil
+					break
+				}
+				st := ThreadState{Flavor: flavor, Data: make([]uint32, count)}
+				for j := range st.Data {
+					st.Data[j] = bo.Uint32(b[8+4*j:])
+				}
+				l.States = append(l.States, st)
+				b = b[8+4*count:]
+			}
+			if l == nil {
+				// Not laid out as expected; keep the bytes as they are.
+				f.Loads[i] = LoadCmdBytes{LoadCmd(cmd), LoadBytes(cmddat)}
+				break
+			}
+			if len(l.States) > 0 {
+				l.Type, l.Data = l.States[0].Flavor, l.States[0].Data
+			}
+			f.Loads[i] = l
+
+		case LcRoutines:
+			var r32 Routines32
+			if uint64(siz) != uint64(unsafe.Sizeof(r32)) {
+				f.Loads[i] = LoadCmdBytes{LoadCmd(cmd), LoadBytes(cmddat)}
+				break
+			}
+			if err := binary.Read(bytes.NewReader(cmddat), bo, &r32); err != nil {
+				return nil, err
+			}
+			l := &Routines{LoadCmd: cmd, Len: siz, InitAddress: uint64(r32.InitAddress), InitModule: uint64(r32.InitModule)}
+			for j, r := range r32.Reserved {
+				l.Reserved[j] = uint64(r)
+			}
+			f.Loads[i] = l
+
+		case LcRoutines64:
+			var r64 Routines64
+			if uint64(siz) != uint64(unsafe.Sizeof(r64)) {
+				f.Loads[i] = LoadCmdBytes{LoadCmd(cmd), LoadBytes(cmddat)}
+				break
+			}
+			if err := binary.Read(bytes.NewReader(cmddat), bo, &r64); err != nil {
+				return nil, err
+			}
+			f.Loads[i] = &Routines{LoadCmd: cmd, Len: siz, InitAddress: r64.InitAddress, InitModule: r64.InitModule, Reserved: r64.Reserved}
+
+		case LcTwolevelHints:
+			if uint64(siz) != uint64(unsafe.Sizeof(TwolevelHintsCmd{})) {
+				f.Loads[i] = LoadCmdBytes{LoadCmd(cmd), LoadBytes(cmddat)}
+				break
+			}
+			l := new(TwolevelHints)
+			if err := binary.Read(bytes.NewReader(cmddat), bo, &l.TwolevelHintsCmd); err != nil {
+				return nil, err
+			}
+			dat := make([]byte, uint64(l.Nhints)*4)
+			if _, err := r.ReadAt(dat, int64(l.Offset)); err != nil {
+				return nil, err
+			}
+			l.Hints = make([]TwolevelHint, l.Nhints)
+			for j := range l.Hints {
+				l.Hints[j] = unpackTwolevelHint(bo.Uint32(dat[4*j:]), bo)
+			}
+			f.Loads[i] = l
+
+		case LcPrebindCksum:
+			if uint64(siz) != uint64(unsafe.Sizeof(PrebindCksumCmd{})) {
+				f.Loads[i] = LoadCmdBytes{LoadCmd(cmd), LoadBytes(cmddat)}
+				break
+			}
+			l := new(PrebindCksum)
+			if err := binary.Read(bytes.NewReader(cmddat), bo, &l.PrebindCksumCmd); err != nil {
+				return nil, err
+			}
+			f.Loads[i] = l
+
+		case LcFilesetEntry:
+			var hdr FilesetEntryCmd
+			if err := binary.Read(bytes.NewReader(cmddat), bo, &hdr); err != nil {
+				return nil, err
+			}
+			if hdr.EntryID < uint32(unsafe.Sizeof(hdr)) || hdr.EntryID >= uint32(len(cmddat)) {
+				return nil, formatError(offset, "invalid entry id in fileset entry command, hdr.EntryID=%d, len(cmddat)=%d", hdr.EntryID, len(cmddat))
+			}
+			f.Loads[i] = &FilesetEntry{FilesetEntryCmd: hdr, EntryID: cstring(cmddat[hdr.EntryID:])}
+
+		case LcBuildVersion:
+			var hdr BuildVersionCmd
+			b := bytes.NewReader(cmddat)
+			if err := binary.Read(b, bo, &hdr); err != nil {
+				return nil, err
+			}
+			if uint64(siz) != uint64(unsafe.Sizeof(hdr))+8*uint64(hdr.Ntools) {
+				// Not laid out as expected; keep the bytes as they are.
+				f.Loads[i] = LoadCmdBytes{LoadCmd(cmd), LoadBytes(cmddat)}
+				break
+			}
+			l := &BuildVersion{BuildVersionCmd: hdr, Tools: make([]BuildTool, hdr.Ntools)}
+			if err := binary.Read(b, bo, l.Tools); err != nil {
+				return nil, err
+			}
+			f.Loads[i] = l
+
 		case LcCodeSignature, LcSegmentSplitInfo, LcFunctionStarts,
-			LcDataInCode, LcDylibCodeSignDrs:
+			LcDataInCode, LcDylibCodeSignDrs, LcDyldExportsTrie, LcDyldChainedFixups:
 			var hdr LinkEditDataCmd
 			b := bytes.NewReader(cmddat)
 
@@ -1013,9 +1977,8 @@ func NewFile(r io.ReaderAt) (*File, error) {
 			s.sr = io.NewSectionReader(r, int64(s.Offset), int64(s.Filesz))
 			s.ReaderAt = s.sr
 		}
-		if f.Loads[i].LoadSize(&f.FileTOC) != siz {
-			fmt.Printf("Oops, actual size was %d, calculated was %d, load was %s\n", siz, f.Loads[i].LoadSize(&f.FileTOC), f.Loads[i].String())
-			panic("oops")
+		if n := f.Loads[i].LoadSize(&f.FileTOC); n != siz {
+			return nil, formatError(offset-int64(siz), "load command %v is %d bytes, but its contents take %d", cmd, siz, n)
 		}
 	}
 	return f, nil
@@ -1024,23 +1987,16 @@ func NewFile(r io.ReaderAt) (*File, error) {
 func (f *File) parseSymtab(symdat, strtab, cmddat []byte, hdr *SymtabCmd, offset int64) (*Symtab, error) {
 	bo := f.ByteOrder
 	symtab := make([]Symbol, hdr.Nsyms)
-	b := bytes.NewReader(symdat)
+	size := f.SymbolSize()
+	if uint64(hdr.Nsyms)*uint64(size) > uint64(len(symdat)) {
+		return nil, io.ErrUnexpectedEOF
+	}
 	for i := range symtab {
 		var n Nlist64
 		if f.Magic == Magic64 {
-			if err := binary.Read(b, bo, &n); err != nil {
-				return nil, err
-			}
+			n.Get64(symdat[uint32(i)*size:], bo)
 		} else {
-			var n32 Nlist32
-			if err := binary.Read(b, bo, &n32); err != nil {
-				return nil, err
-			}
-			n.Name = n32.Name
-			n.Type = n32.Type
-			n.Sect = n32.Sect
-			n.Desc = n32.Desc
-			n.Value = uint64(n32.Value)
+			n.Get32(symdat[uint32(i)*size:], bo)
 		}
 		sym := &symtab[i]
 		if n.Name >= uint32(len(strtab)) {
@@ -1057,11 +2013,6 @@ func (f *File) parseSymtab(symdat, strtab, cmddat []byte, hdr *SymtabCmd, offset
 	return st, nil
 }
 
-type relocInfo struct {
-	Addr   uint32
-	Symnum uint32
-}
-
 func (f *File) pushSection(sh *Section, r io.ReaderAt) error {
 	f.Sections = append(f.Sections, sh)
 	sh.sr = io.NewSectionReader(r, int64(sh.Offset), int64(sh.Size))
@@ -1072,46 +2023,9 @@ func (f *File) pushSection(sh *Section, r io.ReaderAt) error {
 		if _, err := r.ReadAt(reldat, int64(sh.Reloff)); err != nil {
 			return err
 		}
-		b := bytes.NewReader(reldat)
-
-		bo := f.ByteOrder
-
 		sh.Relocs = make([]Reloc, sh.Nreloc)
 		for i := range sh.Relocs {
-			rel := &sh.Relocs[i]
-
-			var ri relocInfo
-			if err := binary.Read(b, bo, &ri); err != nil {
-				return err
-			}
-
-			if ri.Addr&(1<<31) != 0 { // scattered
-				rel.Addr = ri.Addr & (1<<24 - 1)
-				rel.Type = uint8((ri.Addr >> 24) & (1<<4 - 1))
-				rel.Len = uint8((ri.Addr >> 28) & (1<<2 - 1))
-				rel.Pcrel = ri.Addr&(1<<30) != 0
-				rel.Value = ri.Symnum
-				rel.Scattered = true
-			} else {
-				switch bo {
-				case binary.LittleEndian:
-					rel.Addr = ri.Addr
-					rel.Value = ri.Symnum & (1<<24 - 1)
-					rel.Pcrel = ri.Symnum&(1<<24) != 0
-					rel.Len = uint8((ri.Symnum >> 25) & (1<<2 - 1))
-					rel.Extern = ri.Symnum&(1<<27) != 0
-					rel.Type = uint8((ri.Symnum >> 28) & (1<<4 - 1))
-				case binary.BigEndian:
-					rel.Addr = ri.Addr
-					rel.Value = ri.Symnum >> 8
-					rel.Pcrel = ri.Symnum&(1<<7) != 0
-					rel.Len = uint8((ri.Symnum >> 5) & (1<<2 - 1))
-					rel.Extern = ri.Symnum&(1<<4) != 0
-					rel.Type = uint8(ri.Symnum & (1<<4 - 1))
-				default:
-					panic("unreachable")
-				}
-			}
+			sh.Relocs[i].Get(reldat[i*RelocSize:], f.ByteOrder)
 		}
 	}
 
@@ -1136,71 +2050,99 @@ func (f *File) Segment(name string) *Segment {
 	return nil
 }
 
-// Section returns the first section with the given name, or nil if no such
-// section exists.
-func (f *File) Section(name string) *Section {
-	for _, s := range f.Sections {
-		if s.Name == name {
-			return s
+// EntryPoint returns the LC_MAIN command, or nil if there is none.
+func (f *File) EntryPoint() *EntryPoint {
+	for _, l := range f.Loads {
+		if e, ok := l.(*EntryPoint); ok {
+			return e
 		}
 	}
 	return nil
 }
 
-// DWARF returns the DWARF debug information for the Mach-O file.
-func (f *File) DWARF() (*dwarf.Data, error) {
-	dwarfSuffix := func(s *Section) string {
-		switch {
-		case strings.HasPrefix(s.Name, "__debug_"):
-			return s.Name[8:]
-		case strings.HasPrefix(s.Name, "__zdebug_"):
-			return s.Name[9:]
-		default:
-			return ""
+// InitialPC returns the program counter in f's LC_UNIXTHREAD command,
+// or else its first LC_THREAD command, as old-style executables and
+// core files record it, and whether there is one.
+func (f *File) InitialPC() (uint64, bool) {
+	var thread *Thread
+	for _, l := range f.Loads {
+		if t, ok := l.(*Thread); ok && (thread == nil || t.LoadCmd == LcUnixthread && thread.LoadCmd != LcUnixthread) {
+			thread = t
 		}
+	}
+	if thread == nil {
+		return 0, false
+	}
+	return thread.PC()
+}
 
+// UUID returns the LC_UUID command, or nil if there is none.
+func (f *File) UUID() *Uuid {
+	for _, l := range f.Loads {
+		if u, ok := l.(*Uuid); ok {
+			return u
+		}
 	}
-	sectionData := func(s *Section) ([]byte, error) {
-		b, err := s.Data()
-		if err != nil && uint64(len(b)) < s.Size {
-			return nil, err
+	return nil
+}
+
+// SourceVersion returns the LC_SOURCE_VERSION command, or nil if there
+// is none.
+func (f *File) SourceVersion() *SourceVersion {
+	for _, l := range f.Loads {
+		if v, ok := l.(*SourceVersion); ok {
+			return v
 		}
+	}
+	return nil
+}
 
-		if len(b) >= 12 && string(b[:4]) == "ZLIB" {
-			dlen := binary.BigEndian.Uint64(b[4:12])
-			dbuf := make([]byte, dlen)
-			r, err := zlib.NewReader(bytes.NewBuffer(b[12:]))
-			if err != nil {
-				return nil, err
-			}
-			if _, err := io.ReadFull(r, dbuf); err != nil {
-				return nil, err
-			}
-			if err := r.Close(); err != nil {
-				return nil, err
-			}
-			b = dbuf
+// BuildVersion returns the first LC_BUILD_VERSION command, or nil if
+// there is none.
+func (f *File) BuildVersion() *BuildVersion {
+	for _, l := range f.Loads {
+		if b, ok := l.(*BuildVersion); ok {
+			return b
+		}
+	}
+	return nil
+}
+
+// Section returns the first section with the given name, or nil if no such
+// section exists.
+func (f *File) Section(name string) *Section {
+	for _, s := range f.Sections {
+		if s.Name == name {
+			return s
 		}
-		return b, nil
 	}
+	return nil
+}
 
+// DWARF returns the DWARF debug information for the Mach-O file.
+func (f *File) DWARF() (*dwarf.Data, error) {
 	// There are many other DWARF sections, but these
 	// are the ones the debug/dwarf package uses.
-	// Don't bother loading others.
+	// Don't bother loading others; see DWARFMacros
+	// for the macro sections.
 	var dat = map[string][]byte{"abbrev": nil, "info": nil, "str": nil, "line": nil, "ranges": nil}
+	var dwarf5 = map[string][]byte{"addr": nil, "line_str": nil, "str_offsets": nil, "rnglists": nil}
 	for _, s := range f.Sections {
-		suffix := dwarfSuffix(s)
-		if suffix == "" {
+		suffix, _ := DWARFSection(s.Name)
+		_, ok := dat[suffix]
+		_, ok5 := dwarf5[suffix]
+		if !ok && !ok5 {
 			continue
 		}
-		if _, ok := dat[suffix]; !ok {
-			continue
-		}
-		b, err := sectionData(s)
+		b, err := s.UncompressedData()
 		if err != nil {
 			return nil, err
 		}
-		dat[suffix] = b
+		if ok {
+			dat[suffix] = b
+		} else {
+			dwarf5[suffix] = b
+		}
 	}
 
 	d, err := dwarf.New(dat["abbrev"], nil, nil, dat["info"], dat["line"], nil, dat["ranges"], dat["str"])
@@ -1208,14 +2150,22 @@ func (f *File) DWARF() (*dwarf.Data, error) {
 		return nil, err
 	}
 
+	// Add the DWARF5 sections whose names may have been truncated.
+	for _, suffix := range []string{"addr", "line_str", "str_offsets", "rnglists"} {
+		if b := dwarf5[suffix]; b != nil {
+			if err := d.AddSection(".debug_"+suffix, b); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	// Look for DWARF4 .debug_types sections.
 	for i, s := range f.Sections {
-		suffix := dwarfSuffix(s)
-		if suffix != "types" {
+		if suffix, _ := DWARFSection(s.Name); suffix != "types" {
 			continue
 		}
 
-		b, err := sectionData(s)
+		b, err := s.UncompressedData()
 		if err != nil {
 			return nil, err
 		}
@@ -1229,12 +2179,48 @@ func (f *File) DWARF() (*dwarf.Data, error) {
 	return d, nil
 }
 
+// IsDWARFMacroSection reports whether name is that of a section holding
+// DWARF macro information, compressed or not: __debug_macinfo (DWARF 2
+// through 4) or __debug_macro (DWARF 5, and the GNU extension to DWARF 4).
+func IsDWARFMacroSection(name string) bool {
+	section, _ := DWARFSection(name)
+	return section == "macinfo" || section == "macro"
+}
+
+// DWARFMacros returns the uncompressed contents of f's __debug_macinfo
+// and __debug_macro sections, nil for either that f lacks.  The
+// debug/dwarf package does not read macro information, so the
+// *dwarf.Data that DWARF returns cannot carry them.
+func (f *File) DWARFMacros() (macinfo, macro []byte, err error) {
+	for _, s := range f.Sections {
+		if !IsDWARFMacroSection(s.Name) {
+			continue
+		}
+		b, err := s.UncompressedData()
+		if err != nil {
+			return nil, nil, err
+		}
+		if strings.HasSuffix(s.Name, "macinfo") {
+			macinfo = b
+		} else {
+			macro = b
+		}
+	}
+	return macinfo, macro, nil
+}
+
 // ImportedSymbols returns the names of all symbols
 // referred to by the binary f that are expected to be
 // satisfied by other libraries at dynamic load time.
+// If f's symbol table has been stripped, they are the
+// symbols its binds or chained fixups refer to.
 func (f *File) ImportedSymbols() ([]string, error) {
 	if f.Dysymtab == nil || f.Symtab == nil {
-		return nil, formatError(0, "missing symbol table, f.Dsymtab=%v, f.Symtab=%v", f.Dysymtab, f.Symtab)
+		all, err := f.boundSymbols()
+		if all == nil && err == nil {
+			err = formatError(0, "missing symbol table, f.Dsymtab=%v, f.Symtab=%v", f.Dysymtab, f.Symtab)
+		}
+		return all, err
 	}
 
 	st := f.Symtab
@@ -1248,17 +2234,24 @@ func (f *File) ImportedSymbols() ([]string, error) {
 
 // ImportedLibraries returns the paths of all libraries
 // referred to by the binary f that are expected to be
-// linked with the binary at dynamic link time.
-func (f *File) ImportedLibraries() ([]string, error) {
+// linked with the binary at dynamic link time, or if
+// kinds are given, those loaded in one of those ways.
+// A dylib's own install name, its DylibID, is not one
+// of them unless asked for.
+func (f *File) ImportedLibraries(kinds ...DylibKind) ([]string, error) {
 	var all []string
 	for _, l := range f.Loads {
-		if lib, ok := l.(*Dylib); ok {
+		lib, ok := l.(*Dylib)
+		if !ok {
+			continue
+		}
+		match := len(kinds) == 0 && lib.Kind != DylibID
+		for _, k := range kinds {
+			match = match || lib.Kind == k
+		}
+		if match {
 			all = append(all, lib.Name)
 		}
 	}
 	return all, nil
 }
-
-func RoundUp(x, align uint64) uint64 {
-	return uint64((x + align - 1) & -align)
-}
@@ -5,7 +5,18 @@
 package macho
 
 import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"debug/dwarf"
+	stdmacho "debug/macho"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"reflect"
+	"regexp"
 	"testing"
 	"strings"
 )
@@ -33,8 +44,8 @@ var fileTests = []fileTest{
 			nil, // LC_LOAD_DYLINKER
 			nil, // LC_UUID
 			nil, // LC_UNIXTHREAD
-			&Dylib{DylibCmd{}, "/usr/lib/libgcc_s.1.dylib", 0x2, 0x10000, 0x10000},
-			&Dylib{DylibCmd{}, "/usr/lib/libSystem.B.dylib", 0x2, 0x6f0104, 0x10000},
+			&Dylib{DylibCmd{}, "/usr/lib/libgcc_s.1.dylib", 0x2, 0x10000, 0x10000, DylibLoad},
+			&Dylib{DylibCmd{}, "/usr/lib/libSystem.B.dylib", 0x2, 0x6f0104, 0x10000, DylibLoad},
 		},
 		[]*SectionHeader{
 			{"__text", "__TEXT", 0x1f68, 0x88, 0xf68, 0x2, 0x0, 0x0, 0x80000400, 0, 0, 0},
@@ -58,8 +69,8 @@ var fileTests = []fileTest{
 			nil, // LC_LOAD_DYLINKER
 			nil, // LC_UUID
 			nil, // LC_UNIXTHREAD
-			&Dylib{DylibCmd{}, "/usr/lib/libgcc_s.1.dylib", 0x2, 0x10000, 0x10000},
-			&Dylib{DylibCmd{}, "/usr/lib/libSystem.B.dylib", 0x2, 0x6f0104, 0x10000},
+			&Dylib{DylibCmd{}, "/usr/lib/libgcc_s.1.dylib", 0x2, 0x10000, 0x10000, DylibLoad},
+			&Dylib{DylibCmd{}, "/usr/lib/libSystem.B.dylib", 0x2, 0x6f0104, 0x10000, DylibLoad},
 		},
 		[]*SectionHeader{
 			{"__text", "__TEXT", 0x100000f14, 0x6d, 0xf14, 0x2, 0x0, 0x0, 0x80000400, 0, 0, 0},
@@ -318,6 +329,24 @@ func TestOpenFailure(t *testing.T) {
 	}
 }
 
+func TestNewFileBadLoadSize(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// __TEXT claims one section fewer than its size holds.
+	i := bytes.Index(b, []byte("__TEXT\x00"))
+	if i < 8 {
+		t.Fatal("no __TEXT segment")
+	}
+	nsect := binary.LittleEndian.Uint32(b[i+56:])
+	binary.LittleEndian.PutUint32(b[i+56:], nsect-1)
+	f, err := NewFile(bytes.NewReader(b))
+	if _, ok := err.(*FormatError); !ok || !strings.Contains(err.Error(), "its contents take") {
+		t.Errorf("NewFile with a segment shorter than its size = %v, %v; want a FormatError", f, err)
+	}
+}
+
 func TestOpenFat(t *testing.T) {
 	ff, err := OpenFat("testdata/fat-gcc-386-amd64-darwin-exec")
 	if err != nil {
@@ -387,3 +416,3348 @@ func TestTypeString(t *testing.T) {
 		t.Errorf("got %v, want %v", MhExecute.GoString(), "macho.Exec")
 	}
 }
+
+func TestValidate(t *testing.T) {
+	for _, tt := range fileTests {
+		f, err := Open(tt.file)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if err := f.FileTOC.Validate(); err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+		}
+		f.Close()
+	}
+
+	f, err := Open("testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	text := f.Segment("__TEXT")
+	data := f.Segment("__DATA")
+	for _, c := range []struct {
+		name  string
+		edit  func()
+		undo  func()
+		error string
+	}{
+		{"too many", func() { data.Nsect++ }, func() { data.Nsect-- }, "there are only"},
+		{"overlap", func() { data.Firstsect-- }, func() { data.Firstsect++ }, "also belongs"},
+		{"orphan", func() { text.Firstsect++; text.Nsect-- }, func() { text.Firstsect--; text.Nsect++ }, "belongs to no segment"},
+		{"length", func() { text.Len++ }, func() { text.Len-- }, "length is"},
+		{"ncmd", func() { f.Ncmd++ }, func() { f.Ncmd-- }, "Ncmd is"},
+	} {
+		c.edit()
+		err := f.FileTOC.Validate()
+		if err == nil || !strings.Contains(err.Error(), c.error) {
+			t.Errorf("%s: Validate() = %v, want error containing %q", c.name, err, c.error)
+		}
+		c.undo()
+	}
+	if err := f.FileTOC.Validate(); err != nil {
+		t.Errorf("after undoing edits: %v", err)
+	}
+}
+
+func TestAddSectionRepair(t *testing.T) {
+	f, err := Open("testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	toc := f.FileTOC.DerivedCopy(MhDsym, 0)
+	text := f.Segment("__TEXT")
+	data := f.Segment("__DATA")
+
+	// AddSegment discards the copied segment's sections.
+	toc.AddSegment(text.Copy())
+	toc.AddSection(f.Sections[text.Firstsect].Copy())
+	if err := toc.Validate(); err != nil {
+		t.Errorf("after AddSegment: %v", err)
+	}
+
+	// A segment added with AddLoad still claims the sections of the file
+	// it came from; AddSection drops that claim.
+	toc.AddLoad(data.Copy())
+	toc.AddSection(f.Sections[data.Firstsect].Copy())
+	toc.AddSection(f.Sections[data.Firstsect+1].Copy())
+	g := toc.Loads[len(toc.Loads)-1].(*Segment)
+	if g.Firstsect != 1 || g.Nsect != 2 {
+		t.Errorf("after AddLoad, segment has Firstsect=%d, Nsect=%d, want 1, 2", g.Firstsect, g.Nsect)
+	}
+	if err := toc.Validate(); err != nil {
+		t.Errorf("after AddLoad: %v", err)
+	}
+
+	// The result can be written and read back.
+	buf := make([]byte, toc.TOCSize())
+	toc.Put(buf)
+	back, err := NewFile(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := back.FileTOC.Validate(); err != nil {
+		t.Errorf("after round trip: %v", err)
+	}
+	if len(back.Sections) != 3 {
+		t.Errorf("after round trip, %d sections, want 3", len(back.Sections))
+	}
+}
+
+func TestRenumberSections(t *testing.T) {
+	f, err := Open("testdata/clang-amd64-darwin.obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	old := append([]*Section(nil), f.Sections...)
+	text, cstring, unwind := old[0], old[1], old[2]
+
+	// Removing a section that a symbol refers to fails, and changes nothing.
+	f.Sections = []*Section{old[1], old[2], old[3]}
+	if err := f.RenumberSections(old); err == nil || !strings.Contains(err.Error(), "_main") {
+		t.Errorf("RenumberSections after removing __text = %v, want error about _main", err)
+	}
+	if f.Symtab.Syms[0].Sect != 1 || text.Relocs[1].Value != 2 {
+		t.Errorf("failed RenumberSections changed references")
+	}
+
+	// Reversing them renumbers symbols and section-relative relocations,
+	// but not extern ones.
+	f.Sections = []*Section{old[3], old[2], old[1], old[0]}
+	if err := f.RenumberSections(old); err != nil {
+		t.Fatal(err)
+	}
+	if s := f.Symtab.Syms[0]; s.Name != "_main" || s.Sect != 4 {
+		t.Errorf("%s is in section %d, want 4", s.Name, s.Sect)
+	}
+	if s := f.Symtab.Syms[1]; s.Sect != 0 {
+		t.Errorf("undefined %s is in section %d, want 0", s.Name, s.Sect)
+	}
+	if r := text.Relocs[0]; r.Value != 1 {
+		t.Errorf("extern relocation refers to symbol %d, want 1", r.Value)
+	}
+	if r := text.Relocs[1]; f.Sections[r.Value-1] != cstring {
+		t.Errorf("__text relocation refers to section %d, want __cstring", r.Value)
+	}
+	if r := unwind.Relocs[0]; f.Sections[r.Value-1] != text {
+		t.Errorf("__compact_unwind relocation refers to section %d, want __text", r.Value)
+	}
+}
+
+func TestFunctionBoundaries(t *testing.T) {
+	tests := []struct {
+		file string
+		want []Function
+	}{
+		{"testdata/gcc-amd64-darwin-exec", []Function{
+			{"start", 0x100000f14, 0x100000f50, FromSymtab},
+			{"dyld_stub_binding_helper", 0x100000f50, 0x100000f64, FromSymtab},
+			{"__dyld_func_lookup", 0x100000f64, 0x100000f6a, FromSymtab},
+			{"_main", 0x100000f6a, 0x100000f81, FromSymtab},
+		}},
+		{"testdata/gcc-amd64-darwin-exec-debug", []Function{
+			{"main", 0x100000f6a, 0x100000f81, FromDWARF},
+		}},
+		{"testdata/clang-amd64-darwin-exec-with-rpath", []Function{
+			{"_main", 0x100000f60, 0x100000f8a, FromSymtab | FromFunctionStarts},
+		}},
+	}
+	for _, tt := range tests {
+		f, err := Open(tt.file)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		got, err := f.FunctionBoundaries()
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n\thave %v\n\twant %v", tt.file, got, tt.want)
+		}
+	}
+	if s := (FromSymtab | FromDWARF).String(); s != "symtab|dwarf" {
+		t.Errorf("FunctionSource.String() = %q", s)
+	}
+}
+
+func TestStringTable(t *testing.T) {
+	f, err := Open("testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	st, err := f.StringTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Len() != len(f.Symtab.Syms) {
+		t.Fatalf("Len() = %d, want %d", st.Len(), len(f.Symtab.Syms))
+	}
+	for i, s := range f.Symtab.Syms {
+		if n := st.Name(i); n != s.Name {
+			t.Errorf("Name(%d) = %q, want %q", i, n, s.Name)
+		}
+	}
+	for name, want := range map[string]bool{"_main": true, "main": false, "_mai": false, "_puts": true, "": false} {
+		if got := st.Contains(name); got != want {
+			t.Errorf("Contains(%q) = %v, want %v", name, got, want)
+		}
+	}
+	check := func(what string, got, want []string) {
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %q, want %q", what, got, want)
+		}
+	}
+	check("HasPrefix(_NX)", st.HasPrefix("_NX"), []string{"_NXArgc", "_NXArgv"})
+	check("HasSuffix(lookup)", st.HasSuffix("lookup"), []string{"__dyld_func_lookup"})
+	check("Match(^_[a-z]+$)", st.Match(regexp.MustCompile(`^_[a-z]+$`)), []string{"_environ", "_main", "_exit", "_puts"})
+	if s, ok := st.Lookup(st.offs[0]); !ok || s != f.Symtab.Syms[0].Name {
+		t.Errorf("Lookup(%d) = %q, %v, want %q", st.offs[0], s, ok, f.Symtab.Syms[0].Name)
+	}
+	if _, ok := st.Lookup(uint32(len(st.Bytes()))); ok {
+		t.Errorf("Lookup past end succeeded")
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	sum := func(file string) []byte {
+		f, err := Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		h := sha256.New()
+		if err := f.ContentHash(h); err != nil {
+			t.Fatal(err)
+		}
+		return h.Sum(nil)
+	}
+	a := sum("testdata/gcc-amd64-darwin-exec")
+	if !bytes.Equal(a, sum("testdata/gcc-amd64-darwin-exec")) {
+		t.Errorf("ContentHash is not repeatable")
+	}
+	if bytes.Equal(a, sum("testdata/gcc-386-darwin-exec")) {
+		t.Errorf("different files have the same ContentHash")
+	}
+
+	f, err := Open("testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := f.Section("__text")
+	data, err := s.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.New()
+	if err := s.Hash(h); err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256(data); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Errorf("Section.Hash differs from hash of Section.Data")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	want := []byte(strings.Repeat("uncompressed DWARF ", 20))
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	w.Write(want)
+	w.Close()
+
+	section := func(hdr []byte) *Section {
+		b := append(append([]byte{}, hdr...), z.Bytes()...)
+		return &Section{SectionHeader: SectionHeader{Name: "__zdebug_info", Size: uint64(len(b))},
+			sr: io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))}
+	}
+	n := len(want)
+	goHdr := append([]byte("ZLIB"), 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(goHdr[4:], uint64(n))
+	hdr32 := append([]byte("ZLIB"), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(hdr32[4:], uint32(n))
+	chdr64 := make([]byte, 24)
+	binary.LittleEndian.PutUint32(chdr64, 1)
+	binary.LittleEndian.PutUint64(chdr64[8:], uint64(n))
+	binary.LittleEndian.PutUint64(chdr64[16:], 1)
+	chdr32 := make([]byte, 12)
+	binary.BigEndian.PutUint32(chdr32, 1)
+	binary.BigEndian.PutUint32(chdr32[4:], uint32(n))
+	binary.BigEndian.PutUint32(chdr32[8:], 1)
+
+	for _, tt := range []struct {
+		format string
+		hdr    []byte
+	}{
+		{"ZLIB", goHdr},
+		{"ZLIB32", hdr32},
+		{"Elf64_Chdr", chdr64},
+		{"Elf32_Chdr", chdr32},
+	} {
+		s := section(tt.hdr)
+		c, err := s.Compression()
+		if err != nil || c == nil || c.Format != tt.format {
+			t.Errorf("%s: Compression() = %+v, %v", tt.format, c, err)
+			continue
+		}
+		if got, err := s.UncompressedSize(); err != nil || got != uint64(n) {
+			t.Errorf("%s: UncompressedSize() = %d, %v, want %d", tt.format, got, err, n)
+		}
+		got := make([]byte, n)
+		if err := s.PutUncompressedData(got); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: PutUncompressedData wrote %q, %v", tt.format, got, err)
+		}
+		if got, err := s.UncompressedData(); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: UncompressedData() = %q, %v", tt.format, got, err)
+		}
+	}
+
+	r, err := section(goHdr).UncompressedReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	for {
+		b := make([]byte, 7)
+		k, err := r.Read(b)
+		got.Write(b[:k])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("UncompressedReader: %v", err)
+		}
+	}
+	r.Close()
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("UncompressedReader read %q", got.Bytes())
+	}
+
+	long := append([]byte{}, goHdr...)
+	binary.BigEndian.PutUint64(long[4:], uint64(n+1))
+	if _, err := section(long).UncompressedData(); err == nil || !strings.Contains(err.Error(), io.ErrUnexpectedEOF.Error()) {
+		t.Errorf("stream shorter than header: UncompressedData error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	plainData, err := (&Section{SectionHeader: SectionHeader{Name: "__debug_str", Size: 5},
+		sr: io.NewSectionReader(strings.NewReader("hello"), 0, 5)}).UncompressedData()
+	if err != nil || string(plainData) != "hello" {
+		t.Errorf("uncompressed section: UncompressedData() = %q, %v", plainData, err)
+	}
+
+	unknown := section([]byte("LZMA\x00\x00\x00\x10"))
+	if c, err := unknown.Compression(); err == nil {
+		t.Errorf("unrecognized header: Compression() = %+v, want error", c)
+	}
+	if size, err := unknown.UncompressedSize(); err == nil {
+		t.Errorf("unrecognized header: UncompressedSize() = %d, want error", size)
+	}
+
+	// A truncated __zdebug_info: a header cut short, and a section
+	// claiming more bytes than the file holds.
+	short := &Section{SectionHeader: SectionHeader{Name: "__zdebug_info", Size: 6},
+		sr: io.NewSectionReader(bytes.NewReader(goHdr[:6]), 0, 6)}
+	cut := &Section{SectionHeader: SectionHeader{Name: "__zdebug_info", Size: uint64(len(goHdr)) + 100},
+		sr: io.NewSectionReader(bytes.NewReader(goHdr[:8]), 0, int64(len(goHdr))+100)}
+	for name, s := range map[string]*Section{"short header": short, "truncated file": cut} {
+		if size, err := s.UncompressedSize(); err == nil {
+			t.Errorf("%s: UncompressedSize() = %d, want error", name, size)
+		}
+		seg := &Segment{SegmentHeader: SegmentHeader{Name: "__DWARF", Nsect: 1}}
+		if size, err := seg.UncompressedSize(&FileTOC{Sections: []*Section{s}}, 4096); err == nil {
+			t.Errorf("%s: Segment.UncompressedSize() = %d, want error", name, size)
+		}
+		if err := (&FileTOC{}).AddSectionFrom(&Section{}, s, PayloadDecompress); err == nil {
+			t.Errorf("%s: AddSectionFrom succeeded", name)
+		}
+	}
+
+	RegisterCompression(func(hdr []byte) (Compression, bool) {
+		if len(hdr) < 8 || string(hdr[:4]) != "RAW!" {
+			return Compression{}, false
+		}
+		return Compression{Format: "RAW!", Offset: 8, Size: uint64(binary.BigEndian.Uint32(hdr[4:])),
+			NewReader: func(r io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(r), nil }}, true
+	})
+	raw := append([]byte("RAW!\x00\x00\x00\x05"), "hello"...)
+	s := &Section{SectionHeader: SectionHeader{Name: "__zdebug_str", Size: uint64(len(raw))},
+		sr: io.NewSectionReader(bytes.NewReader(raw), 0, int64(len(raw)))}
+	if got, err := s.UncompressedData(); err != nil || string(got) != "hello" {
+		t.Errorf("registered format: UncompressedData() = %q, %v", got, err)
+	}
+
+	plain := &Section{SectionHeader: SectionHeader{Name: "__debug_info", Size: uint64(len(goHdr))},
+		sr: io.NewSectionReader(bytes.NewReader(goHdr), 0, int64(len(goHdr)))}
+	if c, err := plain.Compression(); c != nil || err != nil {
+		t.Errorf("__debug_info: Compression() = %+v, %v, want not compressed", c, err)
+	}
+}
+
+func TestDataTo(t *testing.T) {
+	f, err := Open("testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, l := range f.Loads {
+		s, ok := l.(*Segment)
+		if !ok {
+			continue
+		}
+		want, _ := s.Data()
+		var got bytes.Buffer
+		if n, err := s.DataTo(&got); err != nil || n != int64(len(want)) || !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("segment %s: DataTo wrote %d bytes, %v; want %d bytes", s.Name, n, err, len(want))
+		}
+	}
+	for _, s := range f.Sections {
+		want, _ := s.Data()
+		var got bytes.Buffer
+		if n, err := s.DataTo(&got); err != nil || n != int64(len(want)) || !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("section %s: DataTo wrote %d bytes, %v; want %d bytes", s.Name, n, err, len(want))
+		}
+		if len(want) < 4 {
+			continue
+		}
+		got.Reset()
+		if _, err := s.DataRangeTo(&got, 1, int64(len(want)-2)); err != nil || !bytes.Equal(got.Bytes(), want[1:len(want)-1]) {
+			t.Errorf("section %s: DataRangeTo(1, %d) = %x, %v", s.Name, len(want)-2, got.Bytes(), err)
+		}
+		if _, err := s.DataRangeTo(&got, 1, int64(len(want))); err == nil {
+			t.Errorf("section %s: DataRangeTo past the end succeeded", s.Name)
+		}
+	}
+
+	short := &Section{SectionHeader: SectionHeader{Name: "__short", Size: 10},
+		sr: io.NewSectionReader(strings.NewReader("abc"), 0, 10)}
+	if n, err := short.DataTo(ioutil.Discard); n != 3 || err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated file: DataTo = %d, %v; want 3, %v", n, err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestBuildVersion(t *testing.T) {
+	want := &BuildVersion{
+		BuildVersionCmd: BuildVersionCmd{LoadCmd: LcBuildVersion, Len: 40, Platform: PlatformMacOS, Minos: 13 << 16, Sdk: 14<<16 | 2<<8},
+		Tools:           []BuildTool{{ToolClang, 15 << 16}, {ToolLd, 1015<<16 | 7<<8 | 3}},
+	}
+	want.Ntools = uint32(len(want.Tools))
+	toc := &FileTOC{FileHeader: FileHeader{Magic: Magic64, Cpu: CpuArm64, Type: MhExecute}, ByteOrder: binary.LittleEndian}
+	toc.AddLoad(want)
+	b := make([]byte, toc.TOCSize())
+	toc.Put(b)
+
+	f, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := f.BuildVersion()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("BuildVersion() = %#v, want %#v", got, want)
+	}
+	if s := got.String(); s != "BuildVersion PlatformMacOS, minos=13.0.0, sdk=14.2.0, ntools=2" {
+		t.Errorf("String() = %q", s)
+	}
+	if s := got.Tools[1].Version.String(); s != "1015.7.3" {
+		t.Errorf("ld version = %q", s)
+	}
+	b2 := make([]byte, len(b))
+	f.FileTOC.Put(b2)
+	if !bytes.Equal(b2, b) {
+		t.Errorf("round trip:\n got %x\nwant %x", b2, b)
+	}
+
+	// A command whose length disagrees with its tool count is kept as bytes.
+	binary.LittleEndian.PutUint32(b[32+20:], 3)
+	f, err = NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.BuildVersion() != nil {
+		t.Errorf("inconsistent LC_BUILD_VERSION parsed as %v", f.BuildVersion())
+	}
+	if _, ok := f.Loads[0].(LoadCmdBytes); !ok {
+		t.Errorf("inconsistent LC_BUILD_VERSION is %T, want LoadCmdBytes", f.Loads[0])
+	}
+}
+
+func TestUuid(t *testing.T) {
+	want := &Uuid{UuidCmd{LoadCmd: LcUuid, Len: 24,
+		Id: [16]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0xfe, 0xdc, 0xba, 0x98, 0x76, 0x54, 0x32, 0x10}}}
+	toc := &FileTOC{FileHeader: FileHeader{Magic: Magic64, Cpu: CpuArm64, Type: MhExecute}, ByteOrder: binary.LittleEndian}
+	toc.AddLoad(want)
+	b := make([]byte, toc.TOCSize())
+	toc.Put(b)
+
+	f, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := f.UUID()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("UUID() = %#v, want %#v", got, want)
+	}
+	if s := got.String(); s != "01234567-89AB-CDEF-FEDC-BA9876543210" {
+		t.Errorf("String() = %q", s)
+	}
+	b2 := make([]byte, len(b))
+	f.FileTOC.Put(b2)
+	if !bytes.Equal(b2, b) {
+		t.Errorf("round trip:\n got %x\nwant %x", b2, b)
+	}
+
+	f, err = Open("testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if u := f.UUID(); u == nil || u.String() != "3B24B872-0E45-76D4-28AA-EE89B0C1215D" {
+		t.Errorf("UUID() = %v", u)
+	}
+}
+
+func TestEntryPoint(t *testing.T) {
+	f, err := Open("testdata/clang-amd64-darwin-exec-with-rpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	e := f.EntryPoint()
+	if e == nil {
+		t.Fatal("no LC_MAIN")
+	}
+	if want := (EntryPointCmd{LoadCmd: LcMain, Len: 24, EntryOff: 0xf60}); e.EntryPointCmd != want {
+		t.Errorf("EntryPoint() = %#v, want %#v", e.EntryPointCmd, want)
+	}
+	if s := e.String(); s != "EntryPoint entryoff=0xf60, stacksize=0" {
+		t.Errorf("String() = %q", s)
+	}
+
+	// An adjusted copy is written back out.
+	toc := &FileTOC{FileHeader: FileHeader{Magic: Magic64, Cpu: CpuAmd64, Type: MhExecute}, ByteOrder: binary.LittleEndian}
+	c := e.Copy()
+	c.EntryOff += 0x1000
+	c.StackSize = 1 << 20
+	toc.AddLoad(c)
+	b := make([]byte, toc.TOCSize())
+	toc.Put(b)
+	g, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := g.EntryPoint(); got == nil || *got != *c {
+		t.Errorf("round trip: EntryPoint() = %v, want %v", got, c)
+	}
+	if e.EntryOff != 0xf60 {
+		t.Errorf("Copy shares the original")
+	}
+}
+
+func TestSourceVersion(t *testing.T) {
+	want := &SourceVersion{SourceVersionCmd{LoadCmd: LcSourceVersion, Len: 16, Version: 1205<<40 | 2<<30 | 3<<20 | 4<<10 | 5}}
+	toc := &FileTOC{FileHeader: FileHeader{Magic: Magic64, Cpu: CpuArm64, Type: MhExecute}, ByteOrder: binary.LittleEndian}
+	toc.AddLoad(want)
+	b := make([]byte, toc.TOCSize())
+	toc.Put(b)
+
+	f, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := f.SourceVersion()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("SourceVersion() = %#v, want %#v", got, want)
+	}
+	if p := got.Parts(); p != [5]uint64{1205, 2, 3, 4, 5} {
+		t.Errorf("Parts() = %v", p)
+	}
+	if s := got.String(); s != "1205.2.3.4.5" {
+		t.Errorf("String() = %q", s)
+	}
+
+	// A copy in a derived TOC is written out unchanged.
+	derived := &FileTOC{FileHeader: FileHeader{Magic: Magic64, Cpu: CpuArm64, Type: MhDsym}, ByteOrder: binary.LittleEndian}
+	derived.AddLoad(got.Copy())
+	b2 := make([]byte, derived.TOCSize())
+	derived.Put(b2)
+	if !bytes.Equal(b2[32:], b[32:]) {
+		t.Errorf("copied command is %x, want %x", b2[32:], b[32:])
+	}
+}
+
+func TestLineTable(t *testing.T) {
+	f, err := Open("testdata/gcc-amd64-darwin-exec-debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lt, err := f.LineTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const hello = "/home/rsc/go/src/pkg/debug/macho/testdata/hello.c"
+	if len(lt.Files) != 1 || lt.Files[0] != hello || len(lt.Rows) != 5 {
+		t.Fatalf("LineTable() = %+v", lt)
+	}
+	for _, test := range []struct {
+		pc   uint64
+		line int
+	}{
+		{0x100000f69, 0},
+		{0x100000f6a, 3},
+		{0x100000f6d, 3},
+		{0x100000f6e, 4},
+		{0x100000f7f, 6},
+		{0x100000f81, 0},
+	} {
+		file, line, ok := lt.Lookup(test.pc)
+		if ok != (test.line != 0) || line != test.line || ok && file != hello {
+			t.Errorf("Lookup(%#x) = %q, %d, %v; want line %d", test.pc, file, line, ok, test.line)
+		}
+	}
+}
+
+func TestChainedFixups(t *testing.T) {
+	toc := &FileTOC{FileHeader: FileHeader{Magic: Magic64, Cpu: CpuArm64, Type: MhExecute}, ByteOrder: binary.LittleEndian}
+	for _, s := range []SegmentHeader{
+		{LoadCmd: LcSegment64, Name: "__TEXT", Addr: 0x100000000, Memsz: 0x4000, Offset: 0, Filesz: 0x1000},
+		{LoadCmd: LcSegment64, Name: "__DATA", Addr: 0x100004000, Memsz: 0x4000, Offset: 0x1000, Filesz: 0x1000},
+		{LoadCmd: LcSegment64, Name: "__LINKEDIT", Addr: 0x100008000, Memsz: 0x4000, Offset: 0x2000, Filesz: 0x100},
+	} {
+		toc.AddSegment(&Segment{SegmentHeader: s})
+	}
+	le := func(vs ...interface{}) []byte {
+		var buf bytes.Buffer
+		for _, v := range vs {
+			binary.Write(&buf, binary.LittleEndian, v)
+		}
+		return buf.Bytes()
+	}
+	var fixups []byte
+	fixups = append(fixups, le(uint32(0), uint32(0x20), uint32(0x48), uint32(0x50), uint32(2), uint32(1), uint32(0), uint32(0))...)
+	fixups = append(fixups, le(uint32(3), uint32(0), uint32(0x10), uint32(0))...)
+	// __DATA: one page of 0x4000 bytes, in ChainedPtr64Offset, with a chain at 8.
+	fixups = append(fixups, le(uint32(24), uint16(0x4000), uint16(ChainedPtr64Offset), uint64(0x4000), uint32(0), uint16(1), uint16(8))...)
+	fixups = append(fixups, le(uint32(1), uint32(0xfe|1<<8|8<<9))...)
+	fixups = append(fixups, "_printf\x00_weakfn\x00"...)
+	toc.AddLoad(&LinkEditData{LinkEditDataCmd{LoadCmd: LcDyldChainedFixups, Len: 16, DataOff: 0x2000, DataLen: uint32(len(fixups))}})
+
+	b := make([]byte, 0x2100)
+	toc.Put(b)
+	copy(b[0x1008:], le(uint64(0x3f00|2<<51), uint64(1|5<<24|2<<51|1<<63), uint64(1<<63)))
+	copy(b[0x2000:], fixups)
+
+	f, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := f.ChainedFixups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ChainedFixups{
+		Imports: []ChainedImport{{Name: "_printf", LibOrdinal: 1}, {Name: "_weakfn", LibOrdinal: -2, Weak: true}},
+		Segments: []*ChainedStarts{nil,
+			{PageSize: 0x4000, PointerFormat: ChainedPtr64Offset, SegmentOffset: 0x4000, PageStarts: [][]uint16{{8}}}, nil},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Fatalf("ChainedFixups() = %+v, want %+v", c, want)
+	}
+	got, err := f.Fixups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFixups := []Fixup{
+		{Addr: 0x100004008, Target: 0x100003f00},
+		{Addr: 0x100004010, Import: &c.Imports[1], Addend: 5},
+		{Addr: 0x100004018, Import: &c.Imports[0]},
+	}
+	if !reflect.DeepEqual(got, wantFixups) {
+		t.Errorf("Fixups() = %+v, want %+v", got, wantFixups)
+	}
+}
+
+func TestDecodeChainedPtr(t *testing.T) {
+	const base = 0x100000000
+	for _, test := range []struct {
+		format  ChainedPtrFormat
+		v       uint64
+		fixup   Fixup
+		ordinal int
+		next    uint64
+	}{
+		{ChainedPtr64, 0x100003f00 | 0x12<<36 | 7<<51, Fixup{Target: 0x100003f00, High8: 0x12}, -1, 7},
+		{ChainedPtr32, 0x1234 | 3<<26, Fixup{Target: 0x1234}, -1, 3},
+		{ChainedPtr32, 9 | 4<<20 | 1<<31, Fixup{Addend: 4}, 9, 0},
+		{ChainedPtrArm64e, 0x100003f00 | 1<<51, Fixup{Target: 0x100003f00}, -1, 1},
+		{ChainedPtrArm64eUserland, 0x3f00 | 2<<51, Fixup{Target: 0x100003f00}, -1, 2},
+		{ChainedPtrArm64e, 0x3f00 | 0xbeef<<32 | 1<<48 | 2<<49 | 1<<63,
+			Fixup{Target: 0x100003f00, Auth: true, Diversity: 0xbeef, AddrDiv: true, Key: 2}, -1, 0},
+		{ChainedPtrArm64e, 3 | 0x7ffff<<32 | 1<<62, Fixup{Addend: -1}, 3, 0},
+		{ChainedPtrArm64eUserland24, 0x10003 | 0x1234<<32 | 1<<62 | 1<<63,
+			Fixup{Auth: true, Diversity: 0x1234}, 0x10003, 0},
+	} {
+		fx, ordinal, next := decodeChainedPtr(&ChainedStarts{PointerFormat: test.format, MaxValidPointer: 1 << 25}, test.v, base)
+		if fx != test.fixup || ordinal != test.ordinal || next != test.next {
+			t.Errorf("%v %#x: got %+v, %d, %d; want %+v, %d, %d", test.format, test.v, fx, ordinal, next, test.fixup, test.ordinal, test.next)
+		}
+	}
+}
+
+func TestUnwindTable(t *testing.T) {
+	for _, test := range []struct {
+		file string
+		want []UnwindRow
+	}{
+		// Compact unwind: main keeps a frame pointer.
+		{"clang-amd64-darwin-exec-with-rpath", []UnwindRow{
+			{PC: 0x100000f60, CFA: UnwindFP, CFAOffset: 16, RAOffset: -8, FPOffset: -16},
+			{PC: 0x100000f8b},
+		}},
+		// __eh_frame: main's prologue, push %rbp; mov %rsp,%rbp.
+		{"gcc-amd64-darwin-exec", []UnwindRow{
+			{PC: 0x100000f6a, CFA: UnwindSP, CFAOffset: 8, RAOffset: -8},
+			{PC: 0x100000f6b, CFA: UnwindSP, CFAOffset: 16, RAOffset: -8, FPOffset: -16},
+			{PC: 0x100000f6e, CFA: UnwindFP, CFAOffset: 16, RAOffset: -8, FPOffset: -16},
+			{PC: 0x100000f81},
+		}},
+	} {
+		f, err := Open("testdata/" + test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := f.UnwindTable()
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: UnwindTable() = %+v, want %+v", test.file, got, test.want)
+		}
+	}
+
+	f, err := Open("testdata/gcc-386-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.UnwindTable(); err == nil {
+		t.Errorf("UnwindTable() for 386 succeeded")
+	}
+}
+
+func TestFrameless64Regs(t *testing.T) {
+	for _, test := range []struct {
+		count, perm uint32
+		want        []uint32
+	}{
+		{1, 5, []uint32{6}},
+		{2, 0, []uint32{1, 2}},
+		{3, 2*20 + 3*4 + 3, []uint32{3, 5, 6}},
+		{6, 0, []uint32{1, 2, 3, 4, 5, 6}},
+	} {
+		if got := frameless64Regs(test.count, test.perm); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("frameless64Regs(%d, %#x) = %v, want %v", test.count, test.perm, got, test.want)
+		}
+	}
+}
+
+func TestExports(t *testing.T) {
+	f, err := Open("testdata/clang-amd64-darwin-exec-with-rpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := f.Exports() // from LC_DYLD_INFO_ONLY
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Export{{Name: "__mh_execute_header", Addr: 0x100000000}, {Name: "_main", Addr: 0x100000f60}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Exports() = %+v, want %+v", got, want)
+	}
+
+	trie := []byte{
+		0, 1, '_', 0, 5, // the root, at 0
+		0, 4, 'f', 'o', 'o', 0, 29, 'a', 'b', 's', 0, 34, 'i', 'f', 'u', 'n', 'c', 0, 38, 'b', 'a', 'r', 0, 45,
+		3, 0x04, 0x80, 0x20, 0, // _foo, weak, at 0x1000
+		2, 0x02, 0x2a, 0, // _abs, absolute, 42
+		5, 0x10, 0x80, 0x40, 0x90, 0x40, 0, // _ifunc, stub at 0x2000, resolver at 0x2010
+		7, 0x08, 0x02, '_', 'b', 'a', 'z', 0, 0, // _bar, from dylib 2 as _baz
+	}
+	toc := &FileTOC{FileHeader: FileHeader{Magic: Magic64, Cpu: CpuArm64, Type: MhDylib}, ByteOrder: binary.LittleEndian}
+	toc.AddSegment(&Segment{SegmentHeader: SegmentHeader{LoadCmd: LcSegment64, Name: "__TEXT", Addr: 0x100000000, Memsz: 0x4000, Filesz: 0x1000}})
+	toc.AddLoad(&LinkEditData{LinkEditDataCmd{LoadCmd: LcDyldExportsTrie, Len: 16, DataOff: 0x1000, DataLen: uint32(len(trie))}})
+	b := make([]byte, 0x1000+len(trie))
+	toc.Put(b)
+	copy(b[0x1000:], trie)
+	if f, err = NewFile(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = f.Exports(); err != nil {
+		t.Fatal(err)
+	}
+	want = []Export{
+		{Name: "_abs", Flags: ExportAbsolute, Addr: 42},
+		{Name: "_bar", Flags: ExportReexport, Ordinal: 2, ImportName: "_baz"},
+		{Name: "_foo", Flags: ExportWeakDefinition, Addr: 0x100001000},
+		{Name: "_ifunc", Flags: ExportStubAndResolver, Addr: 0x100002000, Resolver: 0x100002010},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Exports() = %+v, want %+v", got, want)
+	}
+
+	trie[4] = 0 // the edge from the root leads back to it
+	if _, err := ExportTrie(trie, 0); err == nil {
+		t.Errorf("ExportTrie accepted a cycle")
+	}
+}
+
+func TestAddrToOffset(t *testing.T) {
+	f, err := Open("testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	toc := &f.FileTOC
+
+	// A segment ending in zero fill, with a zero-fill section inside
+	// its file contents, as a linker may leave one.
+	data := &Segment{SegmentHeader: SegmentHeader{LoadCmd: LcSegment64, Name: "__DATA2",
+		Addr: 0x200000000, Memsz: 0x3000, Offset: 0x3000, Filesz: 0x1000}}
+	toc.AddSegment(data)
+	toc.AddSection(&Section{SectionHeader: SectionHeader{Name: "__bss", Seg: "__DATA2", Addr: 0x200000800, Size: 0x100, Flags: SZerofill}})
+	toc.AddSection(&Section{SectionHeader: SectionHeader{Name: "__thread_bss", Seg: "__DATA2", Addr: 0x200000900, Size: 0x10, Flags: SThreadLocalZerofill}})
+
+	for _, test := range []struct {
+		addr, off uint64
+		ok        bool
+	}{
+		{0, 0, false},               // __PAGEZERO
+		{0x100000000, 0, true},      // the header
+		{0x100000f14, 0xf14, true},  // __text
+		{0x100001058, 0x1058, true}, // __la_symbol_ptr
+		{0x100002100, 0x2100, true}, // __LINKEDIT
+		{0x100002fff, 0, false},     // __LINKEDIT's zero-filled tail
+		{0x100003000, 0, false},     // past every segment
+		{0x2000007ff, 0x37ff, true}, // __DATA2, before __bss
+		{0x200000800, 0, false},     // __bss
+		{0x200000908, 0, false},     // __thread_bss
+		{0x200000910, 0x3910, true}, // after __thread_bss
+		{0x200001000, 0, false},     // __DATA2's zero-filled tail
+	} {
+		off, ok := toc.AddrToOffset(test.addr)
+		if off != test.off || ok != test.ok {
+			t.Errorf("AddrToOffset(%#x) = %#x, %v; want %#x, %v", test.addr, off, ok, test.off, test.ok)
+		}
+	}
+
+	for _, test := range []struct {
+		off, addr uint64
+		ok        bool
+	}{
+		{0, 0x100000000, true},
+		{0xf14, 0x100000f14, true},
+		{0x1058, 0x100001058, true},
+		{0x213f, 0x10000213f, true}, // the end of __LINKEDIT
+		{0x2140, 0, false},          // between __LINKEDIT and __DATA2
+		{0x3800, 0x200000800, true}, // the file bytes under __bss
+		{0x4000, 0, false},          // past the end
+	} {
+		addr, ok := toc.OffsetToAddr(test.off)
+		if addr != test.addr || ok != test.ok {
+			t.Errorf("OffsetToAddr(%#x) = %#x, %v; want %#x, %v", test.off, addr, ok, test.addr, test.ok)
+		}
+	}
+}
+
+func TestDIEPaths(t *testing.T) {
+	const (
+		tagCU, tagNamespace, tagClass, tagStruct, tagSubprogram = 0x11, 0x39, 0x02, 0x13, 0x2e
+		atName, atLanguage, atLowpc, atHighpc, atDeclaration    = 0x03, 0x13, 0x11, 0x12, 0x3c
+		atSpecification                                         = 0x47
+		formAddr, formData1, formData4, formString, formRef4    = 0x01, 0x0b, 0x06, 0x08, 0x13
+		formFlagPresent                                         = 0x19
+	)
+	abbrevs := [][]byte{
+		1: {tagCU, 1, atName, formString, atLanguage, formData1},
+		2: {tagNamespace, 1, atName, formString},
+		3: {tagClass, 1, atName, formString},
+		4: {tagSubprogram, 0, atName, formString, atDeclaration, formFlagPresent},
+		5: {tagSubprogram, 1, atSpecification, formRef4, atLowpc, formAddr, atHighpc, formData4},
+		6: {tagNamespace, 1},
+		7: {tagStruct, 0, atName, formString},
+		8: {tagSubprogram, 0, atName, formString, atLowpc, formAddr, atHighpc, formData4},
+	}
+	var abbrev []byte
+	for code, a := range abbrevs {
+		if a != nil {
+			abbrev = append(append(append(abbrev, byte(code)), a...), 0, 0)
+		}
+	}
+	abbrev = append(abbrev, 0)
+
+	var info []byte
+	offs := make(map[string]dwarf.Offset)
+	die := func(label string, code byte, vals ...interface{}) {
+		if label != "" {
+			offs[label] = dwarf.Offset(len(info))
+		}
+		info = append(info, code)
+		for _, v := range vals {
+			switch v := v.(type) {
+			case string:
+				info = append(append(info, v...), 0)
+			case byte:
+				info = append(info, v)
+			case uint32:
+				info = binary.LittleEndian.AppendUint32(info, v)
+			case uint64:
+				info = binary.LittleEndian.AppendUint64(info, v)
+			}
+		}
+	}
+	unit := func(build func()) {
+		start := len(info)
+		info = append(info, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 8)
+		build()
+		binary.LittleEndian.PutUint32(info[start:], uint32(len(info)-start-4))
+	}
+	unit(func() {
+		die("", 1, "a.cc", byte(0x4)) // C++
+		die("", 2, "ns")
+		die("", 3, "C")
+		die("decl", 4, "m")
+		info = append(info, 0, 0) // end C, ns
+		die("", 6)
+		die("anon", 7, "S")
+		info = append(info, 0)
+		die("def", 5, uint32(offs["decl"]), uint64(0x1000), uint32(0x20))
+		die("local", 7, "L")
+		info = append(info, 0)
+		die("cfunc", 8, "f", uint64(0x1020), uint32(0x10))
+		info = append(info, 0)
+	})
+	unit(func() {
+		die("", 1, "main", byte(dwLangGo))
+		die("gofunc", 8, "main.(*T).M", uint64(0x2000), uint32(0x40))
+		info = append(info, 0)
+	})
+
+	d, err := dwarf.New(abbrev, nil, nil, info, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewDIEPaths(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for label, want := range map[string]string{
+		"decl":   "ns::C::m",
+		"def":    "ns::C::m",
+		"anon":   "(anonymous namespace)::S",
+		"local":  "ns::C::m::L",
+		"cfunc":  "f",
+		"gofunc": "main.(*T).M",
+	} {
+		if got, err := p.Path(offs[label]); got != want || err != nil {
+			t.Errorf("Path(%s) = %q, %v; want %q", label, got, err, want)
+		}
+	}
+	if _, err := p.Path(1); err == nil {
+		t.Errorf("Path(1) succeeded")
+	}
+	for _, test := range []struct {
+		pc   uint64
+		want string
+	}{
+		{0xfff, ""},
+		{0x1000, "ns::C::m"},
+		{0x101f, "ns::C::m"},
+		{0x1020, "f"},
+		{0x1030, ""},
+		{0x2010, "main.(*T).M"},
+	} {
+		got, ok, err := p.PCPath(test.pc)
+		if got != test.want || ok != (test.want != "") || err != nil {
+			t.Errorf("PCPath(%#x) = %q, %v, %v; want %q", test.pc, got, ok, err, test.want)
+		}
+	}
+}
+
+func TestDylibKinds(t *testing.T) {
+	dylib := func(cmd LoadCmd, name string) LoadCmdBytes {
+		b := make([]byte, 24+(len(name)+8)&^7)
+		binary.LittleEndian.PutUint32(b[0:], uint32(cmd))
+		binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+		binary.LittleEndian.PutUint32(b[8:], 24)
+		binary.LittleEndian.PutUint32(b[16:], 0x10000)
+		binary.LittleEndian.PutUint32(b[20:], 0x10000)
+		copy(b[24:], name)
+		return LoadCmdBytes{cmd, LoadBytes(b)}
+	}
+	toc := &FileTOC{FileHeader: FileHeader{Magic: Magic64, Cpu: CpuAmd64, Type: MhExecute}, ByteOrder: binary.LittleEndian}
+	toc.AddLoad(dylib(LcDylib, "/usr/lib/libSystem.B.dylib"))
+	toc.AddLoad(dylib(LcLoadWeakDylib, "/usr/lib/libweak.dylib"))
+	toc.AddLoad(dylib(LcReexportDylib, "/usr/lib/libreexport.dylib"))
+	toc.AddLoad(dylib(LcLazyLoadDylib, "/usr/lib/liblazy.dylib"))
+	toc.AddLoad(dylib(LcLoadUpwardDylib, "/usr/lib/libupward.dylib"))
+	b := make([]byte, toc.TOCSize())
+	toc.Put(b)
+
+	f, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantKinds := []DylibKind{DylibLoad, DylibWeak, DylibReexport, DylibLazy, DylibUpward}
+	for i, l := range f.Loads {
+		d, ok := l.(*Dylib)
+		if !ok {
+			t.Fatalf("load %d is %T, want *Dylib", i, l)
+		}
+		if d.Kind != wantKinds[i] || d.Command() != toc.Loads[i].Command() {
+			t.Errorf("load %d: kind %v, command %v; want %v, %v", i, d.Kind, d.Command(), wantKinds[i], toc.Loads[i].Command())
+		}
+	}
+	if s := f.Loads[1].String(); s != "Dylib weak /usr/lib/libweak.dylib" {
+		t.Errorf("String() = %q", s)
+	}
+
+	all, _ := f.ImportedLibraries()
+	if len(all) != 5 {
+		t.Errorf("ImportedLibraries() = %q, want all 5", all)
+	}
+	some, _ := f.ImportedLibraries(DylibWeak, DylibUpward)
+	if want := []string{"/usr/lib/libweak.dylib", "/usr/lib/libupward.dylib"}; !reflect.DeepEqual(some, want) {
+		t.Errorf("ImportedLibraries(DylibWeak, DylibUpward) = %q, want %q", some, want)
+	}
+}
+
+func TestTwolevelHintsAndPrebindCksum(t *testing.T) {
+	for _, o := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		hints := &TwolevelHints{TwolevelHintsCmd{LoadCmd: LcTwolevelHints, Len: 16, Nhints: 3},
+			[]TwolevelHint{{0, 5}, {1, 0x123456}, {2, 0}}}
+		cksum := &PrebindCksum{PrebindCksumCmd{LoadCmd: LcPrebindCksum, Len: 12, Cksum: 0xfeedf00d}}
+		toc := &FileTOC{FileHeader: FileHeader{Magic: Magic32, Cpu: CpuPpc, Type: MhExecute}, ByteOrder: o}
+		toc.AddLoad(hints)
+		toc.AddLoad(cksum)
+		hints.Offset = toc.TOCSize()
+		b := make([]byte, toc.TOCSize()+4*hints.Nhints)
+		toc.Put(b)
+		hints.PutHints(b[hints.Offset:], o)
+
+		f, err := NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%v: %v", o, err)
+		}
+		if got, ok := f.Loads[0].(*TwolevelHints); !ok || !reflect.DeepEqual(got, hints) {
+			t.Errorf("%v: load 0 is %#v, want %#v", o, f.Loads[0], hints)
+		}
+		if got, ok := f.Loads[1].(*PrebindCksum); !ok || *got != *cksum {
+			t.Errorf("%v: load 1 is %#v, want %#v", o, f.Loads[1], cksum)
+		}
+
+		// What was read writes out the same.
+		b2 := make([]byte, len(b))
+		f.FileTOC.Put(b2)
+		f.Loads[0].(*TwolevelHints).PutHints(b2[hints.Offset:], o)
+		if !bytes.Equal(b2, b) {
+			t.Errorf("%v: rewritten file is %x, want %x", o, b2, b)
+		}
+	}
+}
+
+func TestRoutines(t *testing.T) {
+	for _, tc := range []struct {
+		magic uint32
+		cmd   LoadCmd
+		len   uint32
+	}{
+		{Magic32, LcRoutines, 40},
+		{Magic64, LcRoutines64, 72},
+	} {
+		want := &Routines{LoadCmd: tc.cmd, Len: tc.len, InitAddress: 0x1f30, InitModule: 2}
+		toc := &FileTOC{FileHeader: FileHeader{Magic: tc.magic, Cpu: CpuAmd64, Type: MhDylib}, ByteOrder: binary.LittleEndian}
+		toc.AddLoad(want)
+		if got := toc.Cmdsz; got != tc.len {
+			t.Errorf("%v: Cmdsz = %d, want %d", tc.cmd, got, tc.len)
+		}
+		b := make([]byte, toc.TOCSize())
+		toc.Put(b)
+
+		f, err := NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%v: %v", tc.cmd, err)
+		}
+		got, ok := f.Loads[0].(*Routines)
+		if !ok || *got != *want {
+			t.Fatalf("%v: load 0 is %#v, want %#v", tc.cmd, f.Loads[0], want)
+		}
+
+		// A copy in a derived TOC is written out unchanged.
+		derived := f.FileTOC.DerivedCopy(MhDsym, 0)
+		derived.AddLoad(got.Copy())
+		b2 := make([]byte, derived.TOCSize())
+		derived.Put(b2)
+		hdr := toc.HdrSize()
+		if !bytes.Equal(b2[hdr:], b[hdr:]) {
+			t.Errorf("%v: copied command is %x, want %x", tc.cmd, b2[hdr:], b[hdr:])
+		}
+	}
+}
+
+func TestVersionMin(t *testing.T) {
+	for _, tc := range []struct {
+		file string
+		want string
+	}{
+		{"testdata/clang-amd64-darwin-exec-with-rpath", "VersionMin PlatformMacOS version 10.12 sdk 10.12"},
+		{"testdata/clang-386-darwin.obj", "VersionMin PlatformMacOS version 10.12 sdk n/a"},
+	} {
+		f, err := Open(tc.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var vm *VersionMin
+		for _, l := range f.Loads {
+			if l, ok := l.(*VersionMin); ok {
+				vm = l
+			}
+		}
+		f.Close()
+		if vm == nil {
+			t.Errorf("%s: no VersionMin", tc.file)
+			continue
+		}
+		if s := vm.String(); s != tc.want {
+			t.Errorf("%s: String() = %q, want %q", tc.file, s, tc.want)
+		}
+	}
+
+	v := Version(10<<16 | 14<<8 | 6)
+	if v.Major() != 10 || v.Minor() != 14 || v.Patch() != 6 || v.Short() != "10.14.6" {
+		t.Errorf("Version %#x is %d, %d, %d, %q", uint32(v), v.Major(), v.Minor(), v.Patch(), v.Short())
+	}
+
+	// Every variant is parsed, and writes out the same.
+	for _, cmd := range []LoadCmd{LcVersionMinMacosx, LcVersionMinIphoneos, LcVersionMinTvos, LcVersionMinWatchos} {
+		want := &VersionMin{VersionMinCmd{LoadCmd: cmd, Len: 16, Version: 0x0d0000, Sdk: 0x0e0100}}
+		toc := &FileTOC{FileHeader: FileHeader{Magic: Magic64, Cpu: CpuArm64, Type: MhExecute}, ByteOrder: binary.LittleEndian}
+		toc.AddLoad(want)
+		b := make([]byte, toc.TOCSize())
+		toc.Put(b)
+		f, err := NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := f.Loads[0].(*VersionMin)
+		if !ok || *got != *want {
+			t.Errorf("%v: load is %#v, want %#v", cmd, f.Loads[0], want)
+			continue
+		}
+		if got.Platform() == 0 {
+			t.Errorf("%v: no platform", cmd)
+		}
+		b2 := make([]byte, len(b))
+		f.FileTOC.Put(b2)
+		if !bytes.Equal(b2, b) {
+			t.Errorf("%v: rewritten as %x, want %x", cmd, b2, b)
+		}
+	}
+}
+
+func TestThread(t *testing.T) {
+	for _, tc := range []struct {
+		file string
+		pc   uint64
+	}{
+		{"testdata/gcc-386-darwin-exec", 0x1f68},
+		{"testdata/gcc-amd64-darwin-exec", 0x100000f14},
+	} {
+		f, err := Open(tc.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pc, ok := f.InitialPC(); !ok || pc != tc.pc {
+			t.Errorf("%s: InitialPC() = %#x, %v, want %#x", tc.file, pc, ok, tc.pc)
+		}
+		f.Close()
+	}
+
+	// An arm64 thread, which writes out as it was read.
+	regs := RegsARM64{SP: 0x16fdff000, PC: 0x100003f50, CPSR: 0x60000000}
+	regs.X[0] = 1
+	var state bytes.Buffer
+	binary.Write(&state, binary.LittleEndian, &regs)
+	data := make([]uint32, state.Len()/4)
+	binary.Read(&state, binary.LittleEndian, data)
+	thread := &Thread{LoadCmd: LcUnixthread, Len: 8 + 8 + 4*uint32(len(data)),
+		States: []ThreadState{{Flavor: ThreadStateARM64, Data: data}}}
+	toc := &FileTOC{FileHeader: FileHeader{Magic: Magic64, Cpu: CpuArm64, Type: MhExecute}, ByteOrder: binary.LittleEndian}
+	toc.AddLoad(thread)
+	b := make([]byte, toc.TOCSize())
+	toc.Put(b)
+	f, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := f.Loads[0].(*Thread)
+	if !ok {
+		t.Fatalf("load is %T, want *Thread", f.Loads[0])
+	}
+	if r, ok := got.Regs().(*RegsARM64); !ok || *r != regs {
+		t.Errorf("Regs() = %#v, want %#v", got.Regs(), regs)
+	}
+	if s := got.String(); s != "UnixThread ARM_THREAD_STATE64, pc=0x100003f50" {
+		t.Errorf("String() = %q", s)
+	}
+	derived := f.FileTOC.DerivedCopy(MhExecute, 0)
+	derived.AddLoad(got.Copy())
+	b2 := make([]byte, derived.TOCSize())
+	derived.Put(b2)
+	if !bytes.Equal(b2, b) {
+		t.Errorf("copied thread is %x, want %x", b2, b)
+	}
+}
+
+func TestLegacyLoads(t *testing.T) {
+	ident := make([]byte, 8+12)
+	binary.BigEndian.PutUint32(ident[0:], uint32(LcIdent))
+	binary.BigEndian.PutUint32(ident[4:], uint32(len(ident)))
+	copy(ident[8:], "ld 1.0\x00cc\x00")
+	toc := &FileTOC{FileHeader: FileHeader{Magic: Magic32, Cpu: CpuPpc, Type: MhObject}, ByteOrder: binary.BigEndian}
+	toc.AddLoad(&Symseg{SymsegCmd{LoadCmd: LcSymseg, Len: 16, Offset: 0x1000, Size: 0x40}})
+	toc.AddLoad(LoadCmdBytes{LcIdent, LoadBytes(ident)})
+	toc.AddLoad(&Prepage{LoadCmd: LcPrepage, Len: 16, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}})
+	b := make([]byte, toc.TOCSize())
+	toc.Put(b)
+
+	f, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Symseg offset=0x1000, size=64", "Ident ld 1.0 cc", "Prepage (8 bytes)"}
+	for i, l := range f.Loads {
+		if _, ok := l.(LoadCmdBytes); ok {
+			t.Errorf("load %d was kept as bytes", i)
+		} else if s := l.String(); s != want[i] {
+			t.Errorf("load %d is %q, want %q", i, s, want[i])
+		}
+	}
+
+	// They are copied as they were, but for any offsets fixed up.
+	derived := f.FileTOC.DerivedCopy(MhObject, 0)
+	symseg := f.Loads[0].(*Symseg).Copy()
+	symseg.Offset += 0x100
+	derived.AddLoad(symseg)
+	derived.AddLoad(f.Loads[1].(*Ident).Copy())
+	derived.AddLoad(f.Loads[2].(*Prepage).Copy())
+	b2 := make([]byte, derived.TOCSize())
+	derived.Put(b2)
+	binary.BigEndian.PutUint32(b[toc.HdrSize()+8:], 0x1100)
+	if !bytes.Equal(b2, b) {
+		t.Errorf("copied loads are %x, want %x", b2, b)
+	}
+}
+
+func TestOpenWrongKind(t *testing.T) {
+	if _, err := Open("testdata/fat-gcc-386-amd64-darwin-exec"); err != ErrFat {
+		t.Errorf("Open of a universal file: got %v, want ErrFat", err)
+	}
+	if _, err := OpenFat("testdata/gcc-amd64-darwin-exec"); err != ErrNotFat {
+		t.Errorf("OpenFat of a thin file: got %v, want ErrNotFat", err)
+	}
+}
+
+func TestFatArch(t *testing.T) {
+	ff, err := OpenFat("testdata/fat-gcc-386-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	for _, tt := range []struct {
+		cpu    Cpu
+		subcpu uint32
+		arch   *FatArch // for Arch
+		best   *FatArch // for BestArch
+	}{
+		{Cpu386, 3, &ff.Arches[0], &ff.Arches[0]},
+		{CpuAmd64, 3, &ff.Arches[1], &ff.Arches[1]}, // the slice's LIB64 bit is ignored
+		{CpuAmd64, 8, nil, &ff.Arches[1]},           // x86_64h runs x86_64
+		{CpuArm64, 0, nil, nil},
+	} {
+		if a := ff.Arch(tt.cpu, tt.subcpu); a != tt.arch {
+			t.Errorf("Arch(%v, %#x) = %v, want %v", tt.cpu, tt.subcpu, a, tt.arch)
+		}
+		if a := ff.BestArch(tt.cpu, tt.subcpu); a != tt.best {
+			t.Errorf("BestArch(%v, %#x) = %v, want %v", tt.cpu, tt.subcpu, a, tt.best)
+		}
+	}
+	if cpu, _, ok := HostCpu(); ok {
+		want := ff.BestArch(cpu, allSubCpu(cpu))
+		if a := ff.HostArch(); a != want {
+			t.Errorf("HostArch() = %v, want %v", a, want)
+		}
+	}
+}
+
+func TestRelocTypeStringByCpu(t *testing.T) {
+	r := Reloc{Type: 2}
+	for cpu, want := range map[Cpu]string{
+		Cpu386:   "GENERIC_RELOC_SECTDIFF",
+		CpuAmd64: "X86_64_RELOC_BRANCH",
+		CpuArm:   "ARM_RELOC_SECTDIFF",
+		CpuArm64: "ARM64_RELOC_BRANCH26",
+		CpuPpc:   "RelocType(2)",
+	} {
+		if got := r.TypeString(cpu); got != want {
+			t.Errorf("TypeString(%v) = %s, want %s", cpu, got, want)
+		}
+	}
+	if got := (Reloc{Type: 11}).TypeString(CpuArm64); got != "ARM64_RELOC_AUTHENTICATED_POINTER" {
+		t.Errorf("TypeString(CpuArm64) of type 11 = %s", got)
+	}
+}
+
+func TestPutRelocs(t *testing.T) {
+	// Every relocation of an object file, scattered or not, is written
+	// back as it was read.
+	for _, name := range []string{"testdata/clang-386-darwin.obj", "testdata/clang-amd64-darwin.obj"} {
+		want, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := NewFile(bytes.NewReader(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(want))
+		if err := f.FileTOC.PutRelocs(got); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range f.Sections {
+			lo, hi := s.Reloff, s.Reloff+s.Nreloc*RelocSize
+			if !bytes.Equal(got[lo:hi], want[lo:hi]) {
+				t.Errorf("%s: relocations of %s are\n%x\nwant\n%x", name, s.Name, got[lo:hi], want[lo:hi])
+			}
+		}
+	}
+
+	// A big-endian (PowerPC) file's plain relocations put their fields
+	// in the other end of the word; its scattered ones do not.
+	relocs := []Reloc{
+		{Addr: 0x10, Value: 3, Type: 1, Len: 2, Pcrel: true, Extern: true},
+		{Addr: 0x24, Value: 0x1234, Type: 4, Len: 2, Pcrel: false, Scattered: true},
+		{Addr: 0x28, Value: 0xfffffe, Type: 0, Len: 3},
+	}
+	for _, tt := range []struct {
+		o    binary.ByteOrder
+		want string
+	}{
+		{binary.BigEndian, "00000010000003d1" + "a400002400001234" + "00000028fffffe60"},
+		{binary.LittleEndian, "100000000300001d" + "240000a434120000" + "28000000feffff06"},
+	} {
+		s := &Section{Relocs: relocs}
+		b := make([]byte, len(relocs)*RelocSize)
+		if n := s.PutRelocs(b, tt.o); n != len(b) {
+			t.Errorf("%v: PutRelocs wrote %d bytes, want %d", tt.o, n, len(b))
+		}
+		if got := hex.EncodeToString(b); got != tt.want {
+			t.Errorf("%v: PutRelocs wrote %s, want %s", tt.o, got, tt.want)
+		}
+		for i, want := range relocs {
+			var got Reloc
+			if n := got.Get(b[i*RelocSize:], tt.o); n != RelocSize || got != want {
+				t.Errorf("%v: relocation %d reads back as %+v, want %+v", tt.o, i, got, want)
+			}
+		}
+	}
+
+	toc := &FileTOC{FileHeader: FileHeader{Magic: Magic32}, ByteOrder: binary.BigEndian}
+	toc.Sections = []*Section{{SectionHeader: SectionHeader{Name: "__text", Reloff: 8, Nreloc: 2}, Relocs: relocs}}
+	if err := toc.PutRelocs(make([]byte, 64)); err == nil {
+		t.Errorf("PutRelocs succeeded with Nreloc wrong")
+	}
+	toc.Sections[0].Nreloc = 3
+	if err := toc.PutRelocs(make([]byte, 24)); err == nil {
+		t.Errorf("PutRelocs succeeded with too small a buffer")
+	}
+}
+
+func TestCpuSubtype(t *testing.T) {
+	for _, tt := range []struct {
+		cpu       Cpu
+		s         CpuSubtype
+		str       string
+		version   uint8
+		versioned bool
+		norm      CpuSubtype
+	}{
+		{CpuAmd64, 0x80000003, "0x3 caps=0x80", 0, false, 0x80000003},
+		{CpuAmd64, 0x08, "0x8", 0, false, 0x08},
+		{CpuArm64, 0x00000000, "0x0", 0, false, 0x00000000},
+		{CpuArm64, 0x80000001, "0x1 caps=0x80", 0, false, 0x00000001},
+		{CpuArm64, 0x00000002, "0x2", 0, false, 0x00000002},
+		{CpuArm64, 0x80000002, "0x2 caps=0x80", 0, true, 0x80000002},
+		{CpuArm64, 0xc1000002, "0x2 caps=0xc1", 1, true, 0x81000002},
+		{Cpu386, 0x40000003, "0x3 caps=0x40", 0, false, 0x00000003},
+	} {
+		if got := tt.s.String(); got != tt.str {
+			t.Errorf("%v subtype %#x: String() = %q, want %q", tt.cpu, uint32(tt.s), got, tt.str)
+		}
+		if v, ok := tt.s.PtrauthVersion(tt.cpu); v != tt.version || ok != tt.versioned {
+			t.Errorf("%v subtype %#x: PtrauthVersion() = %d, %v, want %d, %v", tt.cpu, uint32(tt.s), v, ok, tt.version, tt.versioned)
+		}
+		if got := tt.s.Normalize(tt.cpu); got != tt.norm {
+			t.Errorf("%v subtype %#x: Normalize() = %#x, want %#x", tt.cpu, uint32(tt.s), uint32(got), uint32(tt.norm))
+		}
+	}
+
+	// The dSYM of an arm64e executable keeps its pointer authentication ABI.
+	toc := &FileTOC{FileHeader: FileHeader{Magic: Magic64, Cpu: CpuArm64, SubCpu: 0x81000002, Type: MhExecute}}
+	if d := toc.DerivedCopy(MhDsym, 0); d.SubCpu != 0x81000002 {
+		t.Errorf("DerivedCopy of an arm64e header has subtype %#x, want 0x81000002", d.SubCpu)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	for _, tt := range []struct {
+		file string
+		want string
+	}{
+		{"testdata/gcc-amd64-darwin-exec", "none"},
+		{"testdata/gcc-amd64-darwin-exec-debug", "DWARF"},
+		{"testdata/clang-amd64-darwin-exec-with-rpath", "dyld info"},
+	} {
+		f, err := Open(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := f.Capabilities()
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.file, err)
+		} else if c.String() != tt.want {
+			t.Errorf("%s: Capabilities() = %s, want %s", tt.file, c, tt.want)
+		}
+	}
+
+	// Split seg info is v2 if its first byte says so.
+	data := []byte{0, 0, 0, 0, dyldCacheAdjV2Format}
+	f := &File{r: bytes.NewReader(data)}
+	f.Loads = []Load{
+		&LinkEditData{LinkEditDataCmd{LoadCmd: LcDyldChainedFixups}},
+		&LinkEditData{LinkEditDataCmd{LoadCmd: LcSegmentSplitInfo, DataOff: 4, DataLen: 1}},
+		&LinkEditData{LinkEditDataCmd{LoadCmd: LcCodeSignature}},
+		&EncryptionInfo{EncryptionInfoCmd{LoadCmd: LcEncryptionInfo64, CryptId: 1}},
+	}
+	f.Sections = []*Section{{SectionHeader: SectionHeader{Name: "__zdebug_info", Seg: "__DWARF"}}}
+	c, err := f.Capabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Capabilities{ChainedFixups: true, DWARF: true, CompressedDWARF: true, SplitSeg: true, SplitSegV2: true, CodeSignature: true, Encrypted: true}
+	if c != want {
+		t.Errorf("Capabilities() = %+v, want %+v", c, want)
+	}
+	if s := c.String(); s != "chained fixups, compressed DWARF, split seg info v2, code signature, encryption" {
+		t.Errorf("String() = %s", s)
+	}
+}
+
+func TestRebases(t *testing.T) {
+	f, err := Open("testdata/clang-386-darwin-exec-with-rpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := f.Rebases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rebase{
+		{2, 8, 0x2008, RebaseTypePointer},
+		{1, 0xf90, 0x1f90, RebaseTypeTextAbsolute32},
+		{1, 0xf95, 0x1f95, RebaseTypeTextAbsolute32},
+		{1, 0xf9b, 0x1f9b, RebaseTypeTextAbsolute32},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Rebases() =\n%+v\nwant\n%+v", got, want)
+	}
+
+	// Every opcode, on an image of 64-bit pointers.
+	segs := []*Segment{
+		{SegmentHeader: SegmentHeader{Name: "__TEXT", Addr: 0x1000, Memsz: 0x1000}},
+		{SegmentHeader: SegmentHeader{Name: "__DATA", Addr: 0x2000, Memsz: 0x100}},
+	}
+	ops := []byte{
+		0x11,       // SET_TYPE_IMM pointer
+		0x21, 0x10, // SET_SEGMENT_AND_OFFSET_ULEB __DATA, 0x10
+		0x52,       // DO_REBASE_IMM_TIMES 2: 0x10, 0x18
+		0x30, 0x08, // ADD_ADDR_ULEB 8
+		0x41,       // ADD_ADDR_IMM_SCALED 1
+		0x70, 0x10, // DO_REBASE_ADD_ADDR_ULEB 0x10: 0x30
+		0x61,             // DO_REBASE_ULEB_TIMES
+		0x02,             //   2: 0x48, 0x50
+		0x80, 0x02, 0x08, // DO_REBASE_ULEB_TIMES_SKIPPING_ULEB 2, 8: 0x58, 0x68
+		0x12,             // SET_TYPE_IMM text absolute 32
+		0x20, 0x80, 0x01, // SET_SEGMENT_AND_OFFSET_ULEB __TEXT, 0x80
+		0x51, // DO_REBASE_IMM_TIMES 1: 0x80
+		0x00, // DONE
+		0x51, // ignored
+	}
+	got, err = decodeRebases(ops, 8, segs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offs []uint64
+	for _, r := range got {
+		offs = append(offs, r.SegOffset)
+		if r.Addr != segs[r.SegIndex].Addr+r.SegOffset {
+			t.Errorf("rebase %+v has the wrong address", r)
+		}
+	}
+	if want := []uint64{0x10, 0x18, 0x30, 0x48, 0x50, 0x58, 0x68, 0x80}; !reflect.DeepEqual(offs, want) {
+		t.Errorf("rebased offsets %#x, want %#x", offs, want)
+	}
+	if r := got[len(got)-1]; r.SegIndex != 0 || r.Type != RebaseTypeTextAbsolute32 {
+		t.Errorf("last rebase is %+v", r)
+	}
+
+	for _, bad := range [][]byte{
+		{0x51},                   // no segment
+		{0x22, 0x00},             // no such segment
+		{0x21, 0x80, 0x02, 0x51}, // beyond the segment
+		{0x21, 0x00, 0x60, 0x80, 0x80, 0x80, 0x80, 0x01}, // far beyond it
+		{0x21}, // truncated
+		{0x90}, // unknown
+	} {
+		if _, err := decodeRebases(bad, 8, segs); err == nil {
+			t.Errorf("decodeRebases(% x) succeeded", bad)
+		}
+	}
+}
+
+func TestBindInfo(t *testing.T) {
+	f, err := Open("testdata/clang-amd64-darwin-exec-with-rpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := f.BindInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Bind{
+		{Kind: BindRegular, SegIndex: 2, SegOffset: 0, Addr: 0x100001000, Type: RebaseTypePointer, LibOrdinal: 1, Name: "dyld_stub_binder"},
+		{Kind: BindLazy, SegIndex: 2, SegOffset: 16, Addr: 0x100001010, Type: RebaseTypePointer, LibOrdinal: 1, Name: "_printf"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BindInfo() =\n%+v\nwant\n%+v", got, want)
+	}
+	// Stripped of its symbol table, it still imports what it binds.
+	f.Symtab, f.Dysymtab = nil, nil
+	if syms, err := f.ImportedSymbols(); err != nil || !reflect.DeepEqual(syms, []string{"dyld_stub_binder", "_printf"}) {
+		t.Errorf("ImportedSymbols() of the stripped file = %q, %v", syms, err)
+	}
+
+	segs := []*Segment{
+		{SegmentHeader: SegmentHeader{Name: "__TEXT", Addr: 0x1000, Memsz: 0x1000}},
+		{SegmentHeader: SegmentHeader{Name: "__DATA", Addr: 0x2000, Memsz: 0x100}},
+	}
+	ops := []byte{
+		0x12,              // SET_DYLIB_ORDINAL_IMM 2
+		0x41, '_', 'a', 0, // SET_SYMBOL_TRAILING_FLAGS_IMM weak import, _a
+		0x71, 0x08, // SET_SEGMENT_AND_OFFSET_ULEB __DATA, 8
+		0x90,              // DO_BIND: 8
+		0x3e,              // SET_DYLIB_SPECIAL_IMM -2
+		0x40, '_', 'b', 0, // SET_SYMBOL_TRAILING_FLAGS_IMM 0, _b
+		0x60, 0x7f, // SET_ADDEND_SLEB -1
+		0xa0, 0x08, // DO_BIND_ADD_ADDR_ULEB 8: 0x10
+		0xb1,             // DO_BIND_ADD_ADDR_IMM_SCALED 1: 0x20
+		0x20, 0x81, 0x01, // SET_DYLIB_ORDINAL_ULEB 129
+		0x52,       // SET_TYPE_IMM text absolute 32
+		0x80, 0x08, // ADD_ADDR_ULEB 8
+		0xc0, 0x02, 0x04, // DO_BIND_ULEB_TIMES_SKIPPING_ULEB 2, 4: 0x38, 0x44
+		0x00, // DONE
+		0x90, // for lazy binds, another: 0x50
+	}
+	type b struct {
+		off     uint64
+		name    string
+		ordinal int
+		typ     RebaseType
+		flags   uint8
+		addend  int64
+	}
+	wantb := []b{
+		{0x08, "_a", 2, RebaseTypePointer, BindSymbolWeakImport, 0},
+		{0x10, "_b", -2, RebaseTypePointer, 0, -1},
+		{0x20, "_b", -2, RebaseTypePointer, 0, -1},
+		{0x38, "_b", 129, RebaseTypeTextAbsolute32, 0, -1},
+		{0x44, "_b", 129, RebaseTypeTextAbsolute32, 0, -1},
+	}
+	for _, kind := range []BindKind{BindRegular, BindLazy} {
+		got, _, err := decodeBinds(ops, kind, 8, segs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := wantb
+		if kind == BindLazy {
+			want = append(want, b{0x50, "_b", 129, RebaseTypeTextAbsolute32, 0, -1})
+		}
+		var have []b
+		for _, x := range got {
+			if x.Kind != kind || x.SegIndex != 1 || x.Addr != 0x2000+x.SegOffset {
+				t.Errorf("%v: bind %+v", kind, x)
+			}
+			have = append(have, b{x.SegOffset, x.Name, x.LibOrdinal, x.Type, x.Flags, x.Addend})
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("%v: binds\n%+v\nwant\n%+v", kind, have, want)
+		}
+	}
+
+	for _, bad := range [][]byte{
+		{0x40, '_', 'a', 0, 0x90}, // no segment
+		{0x71, 0x00, 0x90},        // no symbol
+		{0x72, 0x00},              // no such segment
+		{0x40, '_', 'a', 0, 0x71, 0x80, 0x02, 0x90}, // beyond the segment
+		{0x40, '_', 'a'}, // unterminated name
+		{0xd0, 0x01},     // threaded
+		{0xe0},           // unknown
+	} {
+		if _, _, err := decodeBinds(bad, BindRegular, 8, segs); err == nil {
+			t.Errorf("decodeBinds(% x) succeeded", bad)
+		}
+	}
+}
+
+func TestWeakSymbols(t *testing.T) {
+	f, err := Open("testdata/clang-amd64-darwin-exec-with-rpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if binds, strong, err := f.WeakBinds(); binds != nil || strong != nil || err != nil {
+		t.Errorf("WeakBinds() of a file without weak binds = %v, %q, %v", binds, strong, err)
+	}
+	if defs, refs := f.WeakDefinitions(), f.WeakReferences(); defs != nil || refs != nil {
+		t.Errorf("WeakDefinitions(), WeakReferences() = %v, %v", defs, refs)
+	}
+
+	f.Symtab = &Symtab{Syms: []Symbol{
+		{Name: "_strong", Type: NSect | NExt, Sect: 1, Value: 0x1000},
+		{Name: "_weak", Type: NSect | NExt, Sect: 1, Desc: NWeakDef, Value: 0x1010},
+		{Name: "_maybe", Type: NUndf | NExt, Desc: NWeakRef | 1<<8},
+		{Name: "_puts", Type: NUndf | NExt, Desc: 1 << 8},
+	}}
+	if defs := f.WeakDefinitions(); len(defs) != 1 || defs[0].Name != "_weak" {
+		t.Errorf("WeakDefinitions() = %v", defs)
+	}
+	if refs := f.WeakReferences(); len(refs) != 1 || refs[0].Name != "_maybe" {
+		t.Errorf("WeakReferences() = %v", refs)
+	}
+
+	segs := []*Segment{
+		{SegmentHeader: SegmentHeader{Name: "__TEXT", Addr: 0x1000, Memsz: 0x1000}},
+		{SegmentHeader: SegmentHeader{Name: "__DATA", Addr: 0x2000, Memsz: 0x100}},
+	}
+	ops := []byte{
+		0x40, '_', 'w', 0, // SET_SYMBOL_TRAILING_FLAGS_IMM 0, _w
+		0x51,       // SET_TYPE_IMM pointer
+		0x71, 0x10, // SET_SEGMENT_AND_OFFSET_ULEB __DATA, 0x10
+		0x90,              // DO_BIND: 0x10
+		0x48, '_', 's', 0, // SET_SYMBOL_TRAILING_FLAGS_IMM non-weak definition, _s
+		0x00, // DONE
+	}
+	binds, strong, err := decodeBinds(ops, BindWeak, 8, segs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Bind{{Kind: BindWeak, SegIndex: 1, SegOffset: 0x10, Addr: 0x2010, Type: RebaseTypePointer, Name: "_w"}}
+	if !reflect.DeepEqual(binds, want) || !reflect.DeepEqual(strong, []string{"_s"}) {
+		t.Errorf("weak binds\n%+v, strong %q\nwant\n%+v, strong [\"_s\"]", binds, strong, want)
+	}
+	// Only the weak bind stream declares strong definitions.
+	if _, strong, err := decodeBinds(ops, BindRegular, 8, segs); strong != nil || err != nil {
+		t.Errorf("regular binds: strong %q, %v", strong, err)
+	}
+}
+
+func TestDebugMachoCompat(t *testing.T) {
+	for _, name := range []string{
+		"testdata/gcc-386-darwin-exec",
+		"testdata/gcc-amd64-darwin-exec",
+		"testdata/gcc-amd64-darwin-exec-debug",
+		"testdata/clang-386-darwin-exec-with-rpath",
+		"testdata/clang-amd64-darwin.obj",
+	} {
+		std, err := stdmacho.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isObj := strings.HasSuffix(name, ".obj"); uint32(f.Type) != uint32(std.Type) || isObj != (f.Type == TypeObj) {
+			t.Errorf("%s: Type %v, debug/macho has %v", name, f.Type, std.Type)
+		}
+		if len(f.Loads) != len(std.Loads) {
+			t.Fatalf("%s: %d loads, debug/macho has %d", name, len(f.Loads), len(std.Loads))
+		}
+		for i, l := range std.Loads {
+			if !bytes.Equal(f.RawLoad(i), l.Raw()) {
+				t.Errorf("%s: RawLoad(%d) differs from debug/macho's Raw()", name, i)
+			}
+			if s, ok := l.(*stdmacho.Segment); ok {
+				if g := f.Segment(s.Name); g == nil || uint32(g.Command()) != uint32(s.Cmd) || g.Addr != s.Addr || g.Filesz != s.Filesz {
+					t.Errorf("%s: Segment(%s) = %v", name, s.Name, g)
+				}
+			}
+		}
+		for _, s := range std.Sections {
+			sec := f.Section(s.Name)
+			want, _ := s.Data()
+			if got, _ := sec.Data(); !bytes.Equal(got, want) {
+				t.Errorf("%s: Section(%s).Data() differs from debug/macho's", name, s.Name)
+			}
+		}
+		if std.Symtab != nil && !reflect.DeepEqual(f.Symtab.Syms, convertSyms(std.Symtab.Syms)) {
+			t.Errorf("%s: symbols differ from debug/macho's", name)
+		}
+		want, _ := std.ImportedLibraries()
+		if got, _ := f.ImportedLibraries(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: ImportedLibraries() = %q, debug/macho has %q", name, got, want)
+		}
+		wantSyms, _ := std.ImportedSymbols()
+		if got, _ := f.ImportedSymbols(); !reflect.DeepEqual(got, wantSyms) {
+			t.Errorf("%s: ImportedSymbols() = %q, debug/macho has %q", name, got, wantSyms)
+		}
+		std.Close()
+		f.Close()
+	}
+	if (&File{}).RawLoad(0) != nil {
+		t.Errorf("RawLoad of a File not read from a file is not nil")
+	}
+}
+
+func convertSyms(syms []stdmacho.Symbol) []Symbol {
+	var s []Symbol
+	for _, y := range syms {
+		s = append(s, Symbol(y))
+	}
+	return s
+}
+
+func TestFunctionStarts(t *testing.T) {
+	f, err := Open("testdata/clang-amd64-darwin-exec-with-rpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	starts, err := f.FunctionStarts()
+	f.Close()
+	if err != nil || !reflect.DeepEqual(starts, []uint64{0x100000f60}) {
+		t.Errorf("FunctionStarts() = %#x, %v", starts, err)
+	}
+
+	// Starts at 0x1010, 0x1030, and 0x10b0, only the first of them named.
+	data := []byte{0x10, 0x20, 0x80, 0x01, 0x00, 0x00}
+	text := &Segment{SegmentHeader: SegmentHeader{LoadCmd: LcSegment64, Name: "__TEXT", Addr: 0x1000}}
+	linkedit := &Segment{SegmentHeader: SegmentHeader{LoadCmd: LcSegment64, Name: "__LINKEDIT", Offset: 0x4000}, ReaderAt: bytes.NewReader(data)}
+	f = &File{}
+	f.Loads = []Load{text, linkedit, &LinkEditData{LinkEditDataCmd{LoadCmd: LcFunctionStarts, DataOff: 0x4000, DataLen: uint32(len(data))}}}
+	f.Sections = []*Section{{SectionHeader: SectionHeader{Name: "__text", Seg: "__TEXT", Addr: 0x1000, Size: 0x100, Flags: SAttrPureInstructions}}}
+	f.Symtab = &Symtab{Syms: []Symbol{{Name: "_f", Type: 0x0f, Sect: 1, Value: 0x1010}}}
+	fns, err := f.NamedFunctionStarts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Function{
+		{"_f", 0x1010, 0x1030, FromSymtab | FromFunctionStarts},
+		{"", 0x1030, 0x10b0, FromFunctionStarts},
+		{"", 0x10b0, 0x1100, FromFunctionStarts},
+	}
+	if !reflect.DeepEqual(fns, want) {
+		t.Errorf("NamedFunctionStarts() =\n\t%v\nwant\n\t%v", fns, want)
+	}
+
+	linkedit.ReaderAt = bytes.NewReader([]byte{0x10, 0x80})
+	f.Loads[2].(*LinkEditData).DataLen = 2
+	if _, err := f.FunctionStarts(); err == nil {
+		t.Errorf("FunctionStarts() of a truncated ULEB128 succeeded")
+	}
+}
+
+func TestDWARFSection(t *testing.T) {
+	tests := []struct {
+		name       string
+		section    string
+		compressed bool
+		plain      string // the uncompressed section's name
+	}{
+		{"__debug_info", "info", false, "__debug_info"},
+		{"__zdebug_info", "info", true, "__debug_info"},
+		{"__debug_str_offs", "str_offsets", false, "__debug_str_offs"},
+		{"__zdebug_str_off", "str_offsets", true, "__debug_str_offs"},
+		{"__debug_line_str", "line_str", false, "__debug_line_str"},
+		{"__zdebug_line_st", "line_str", true, "__debug_line_str"},
+		{"__zdebug_rnglist", "rnglists", true, "__debug_rnglists"},
+		{"__zdebug_pubname", "pubnames", true, "__debug_pubnames"},
+		{"__zdebug_aranges", "aranges", true, "__debug_aranges"},
+		{"__debug_gnu_pubn", "gnu_pubnames", false, "__debug_gnu_pubn"},
+		{"__debug_mystery", "mystery", false, "__debug_mystery"},
+		{"__text", "", false, ""},
+	}
+	for _, tt := range tests {
+		section, compressed := DWARFSection(tt.name)
+		if section != tt.section || compressed != tt.compressed {
+			t.Errorf("DWARFSection(%q) = %q, %v, want %q, %v", tt.name, section, compressed, tt.section, tt.compressed)
+			continue
+		}
+		if section == "" {
+			continue
+		}
+		if got := DWARFSectionName(section, compressed); got != tt.name {
+			t.Errorf("DWARFSectionName(%q, %v) = %q, want %q", section, compressed, got, tt.name)
+		}
+		if got := DWARFSectionName(section, false); got != tt.plain {
+			t.Errorf("DWARFSectionName(%q, false) = %q, want %q", section, got, tt.plain)
+		}
+	}
+	if !IsDWARFMacroSection("__zdebug_macinfo") || IsDWARFMacroSection("__debug_macinf") {
+		t.Errorf("IsDWARFMacroSection does not match macro sections by their full names")
+	}
+}
+
+func TestDataInCode(t *testing.T) {
+	b := []byte{
+		0x08, 0x10, 0, 0, 4, 0, 1, 0,
+		0x40, 0x10, 0, 0, 0x10, 0, 4, 0,
+	}
+	got, err := DataInCodeEntries(b, binary.LittleEndian, 0x100000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DataInCode{
+		{Offset: 0x1008, Addr: 0x100001008, Length: 4, Kind: DataInCodeData},
+		{Offset: 0x1040, Addr: 0x100001040, Length: 0x10, Kind: DataInCodeJumpTable32},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DataInCodeEntries = %+v, want %+v", got, want)
+	}
+	if s := got[1].Kind.String(); s != "DataInCodeJumpTable32" {
+		t.Errorf("Kind.String() = %q", s)
+	}
+	if _, err := DataInCodeEntries(b[:12], binary.LittleEndian, 0); err == nil {
+		t.Errorf("DataInCodeEntries of a partial entry succeeded")
+	}
+
+	f, err := Open("testdata/clang-amd64-darwin-exec-with-rpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got, err := f.DataInCode(); err != nil || len(got) != 0 {
+		t.Errorf("DataInCode() = %v, %v, want an empty table", got, err)
+	}
+}
+
+// testCodeSignature builds a SuperBlob holding a code directory for two
+// pages, a designated requirement, and entitlements, and returns it
+// with the code directory.
+func testCodeSignature() (sig, cd []byte) {
+	be := binary.BigEndian
+	blob := func(magic uint32, body []byte) []byte {
+		b := make([]byte, 8, 8+len(body))
+		be.PutUint32(b, magic)
+		be.PutUint32(b[4:], uint32(8+len(body)))
+		return append(b, body...)
+	}
+	u32 := func(b []byte, v uint32) []byte { return be.AppendUint32(b, v) }
+
+	// A version 0x20400 directory, 88 bytes of header, then the
+	// identifier and team ID, then one special and two code hashes.
+	hdr := make([]byte, 0, 80)
+	hdr = u32(hdr, 0x20400)                                // version
+	hdr = u32(hdr, 0x2)                                    // flags: adhoc
+	hdr = u32(hdr, uint32(88+len("ident\x00team\x00")+32)) // hashOffset
+	hdr = u32(hdr, 88)                                     // identOffset
+	hdr = u32(hdr, 1)                                      // nSpecialSlots
+	hdr = u32(hdr, 2)                                      // nCodeSlots
+	hdr = u32(hdr, 0x1800)                                 // codeLimit
+	hdr = append(hdr, 32, byte(CodeHashSHA256), 0, 12)
+	hdr = u32(hdr, 0)                           // spare2
+	hdr = u32(hdr, 0)                           // scatterOffset
+	hdr = u32(hdr, uint32(88+len("ident\x00"))) // teamOffset
+	hdr = u32(hdr, 0)                           // spare3
+	hdr = be.AppendUint64(hdr, 0)               // codeLimit64
+	hdr = be.AppendUint64(hdr, 0)               // execSegBase
+	hdr = be.AppendUint64(hdr, 0x1000)          // execSegLimit
+	hdr = be.AppendUint64(hdr, 1)               // execSegFlags: main binary
+	hdr = append(hdr, "ident\x00team\x00"...)
+	for i := 0; i < 3; i++ {
+		hdr = append(hdr, bytes.Repeat([]byte{byte(i + 1)}, 32)...)
+	}
+	cd = blob(CsMagicCodeDirectory, hdr)
+
+	expr := []byte{0, 0, 0, 6} // "always"
+	req := blob(CsMagicRequirement, append(u32(nil, 1), expr...))
+	reqs := blob(CsMagicRequirements, append(u32(u32(u32(nil, 1), uint32(RequirementDesignated)), 20), req...))
+	ents := blob(CsMagicEntitlements, []byte("<plist/>"))
+
+	blobs := [][]byte{cd, reqs, ents}
+	slots := []CodeSignatureSlot{CsSlotCodeDirectory, CsSlotRequirements, CsSlotEntitlements}
+	body := u32(nil, uint32(len(blobs)))
+	off := uint32(12 + 8*len(blobs))
+	for i, b := range blobs {
+		body = u32(u32(body, uint32(slots[i])), off)
+		off += uint32(len(b))
+	}
+	for _, b := range blobs {
+		body = append(body, b...)
+	}
+	sig = append(blob(CsMagicEmbeddedSignature, body), 0, 0, 0, 0) // padded, as ld pads it
+	return sig, cd
+}
+
+func TestCodeSignature(t *testing.T) {
+	sig, cdBlob := testCodeSignature()
+	cs, err := ParseCodeSignature(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs.Blobs) != 3 || cs.Blobs[0].Slot != CsSlotCodeDirectory || cs.Blobs[1].Magic != CsMagicRequirements || cs.Blobs[2].Offset != 36+uint32(len(cdBlob)+len(cs.Blobs[1].Data)) {
+		t.Errorf("blobs %+v", cs.Blobs)
+	}
+	if len(cs.CodeDirectories) != 1 {
+		t.Fatalf("%d code directories, want 1", len(cs.CodeDirectories))
+	}
+	cd := cs.CodeDirectories[0]
+	sum := sha256.Sum256(cdBlob)
+	want := &CodeDirectory{
+		Version: 0x20400, Flags: 2, HashType: CodeHashSHA256, HashSize: 32, PageSize: 4096,
+		Identifier: "ident", TeamID: "team", NSpecialSlots: 1, CodeLimit: 0x1800,
+		ExecSegLimit: 0x1000, ExecSegFlags: 1,
+		CodeHashes: [][]byte{bytes.Repeat([]byte{2}, 32), bytes.Repeat([]byte{3}, 32)},
+		CDHash:     sum[:20],
+	}
+	if !reflect.DeepEqual(cd, want) {
+		t.Errorf("code directory\n%+v, want\n%+v", cd, want)
+	}
+	if len(cs.Requirements) != 1 || cs.Requirements[0].Type != RequirementDesignated || cs.Requirements[0].Kind != 1 || !bytes.Equal(cs.Requirements[0].Expr, []byte{0, 0, 0, 6}) {
+		t.Errorf("requirements %+v", cs.Requirements)
+	}
+	if cs.Entitlements != "<plist/>" {
+		t.Errorf("entitlements %q", cs.Entitlements)
+	}
+
+	// Damage: a wrong magic, a blob outside the signature, a code
+	// directory whose hashes overrun it.
+	bad := append([]byte(nil), sig...)
+	bad[3] = 0
+	if _, err := ParseCodeSignature(bad); err == nil {
+		t.Errorf("ParseCodeSignature with a bad magic succeeded")
+	}
+	bad = append([]byte(nil), sig...)
+	binary.BigEndian.PutUint32(bad[16:], uint32(len(sig)))
+	if _, err := ParseCodeSignature(bad); err == nil || !strings.Contains(err.Error(), "outside the signature") {
+		t.Errorf("blob outside the signature: err = %v", err)
+	}
+	bad = append([]byte(nil), sig...)
+	binary.BigEndian.PutUint32(bad[36+28:], 100) // nCodeSlots
+	if _, err := ParseCodeSignature(bad); err == nil || !strings.Contains(err.Error(), "overrun") {
+		t.Errorf("too many code hashes: err = %v", err)
+	}
+
+	f, err := Open("testdata/clang-amd64-darwin-exec-with-rpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if cs, err := f.CodeSignature(); cs != nil || err != nil {
+		t.Errorf("CodeSignature() of an unsigned file = %v, %v", cs, err)
+	}
+}
+
+func TestSymbolKinds(t *testing.T) {
+	f, err := Open("testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	byName := make(map[string]Symbol)
+	for _, s := range f.Symtab.Syms {
+		byName[s.Name] = s
+	}
+	if s := byName["_main"]; !s.IsDefinedInSection() || !s.IsExternal() || s.IsPrivateExternal() || s.IsUndefined() || s.IsStab() {
+		t.Errorf("_main: %+v", s)
+	}
+	if s := byName["dyld_stub_binding_helper"]; !s.IsDefinedInSection() || !s.IsPrivateExternal() || s.IsExternal() {
+		t.Errorf("dyld_stub_binding_helper: %+v", s)
+	}
+	if s := byName["__mh_execute_header"]; s.Kind() != NAbs || s.IsDefinedInSection() || !s.IsReferencedDynamically() {
+		t.Errorf("__mh_execute_header: %+v", s)
+	}
+	if s := byName["_puts"]; !s.IsUndefined() || s.LibraryOrdinal() != 2 || s.IsWeakRef() || s.IsWeakDef() {
+		t.Errorf("_puts: %+v, library ordinal %d", s, s.LibraryOrdinal())
+	}
+
+	oso := Symbol{Name: "/tmp/x.o", Type: uint8(NOso), Sect: 0, Desc: 1, Value: 0x5f000000}
+	if !oso.IsStab() || oso.StabType() != NOso || oso.Kind() != 0 || oso.IsExternal() || oso.IsUndefined() || oso.IsDefinedInSection() {
+		t.Errorf("N_OSO stab: stab type %v, kind %#x", oso.StabType(), oso.Kind())
+	}
+	if s := oso.StabType().String(); s != "NOso" {
+		t.Errorf("StabType.String() = %q", s)
+	}
+	// N_BNSYM's type has N_SECT's bits, but it is a stab.
+	bnsym := Symbol{Type: uint8(NBnsym), Sect: 1}
+	if bnsym.IsDefinedInSection() || bnsym.StabType() != NBnsym {
+		t.Errorf("N_BNSYM stab taken for a symbol")
+	}
+	weak := Symbol{Type: NSect | NExt, Sect: 1, Desc: NWeakDef}
+	if !weak.IsWeakDef() || weak.IsWeakRef() {
+		t.Errorf("weak definition: IsWeakDef %v, IsWeakRef %v", weak.IsWeakDef(), weak.IsWeakRef())
+	}
+	weakRef := Symbol{Type: NUndf | NExt, Desc: NWeakRef | uint16(DynamicLookupOrdinal)<<8}
+	if !weakRef.IsWeakRef() || weakRef.IsWeakDef() || weakRef.LibraryOrdinal() != DynamicLookupOrdinal {
+		t.Errorf("weak reference: IsWeakRef %v, ordinal %#x", weakRef.IsWeakRef(), weakRef.LibraryOrdinal())
+	}
+}
+
+func TestFlagStrings(t *testing.T) {
+	tests := []struct {
+		f          fmt.Stringer
+		str, gostr string
+	}{
+		{FlagNoUndefs | FlagDyldLink | FlagTwoLevel, "FlagNoUndefs|FlagDyldLink|FlagTwoLevel", "macho.FlagNoUndefs|macho.FlagDyldLink|macho.FlagTwoLevel"},
+		{HdrFlags(0), "0x0", "0x0"},
+		{FlagPIE | 0x80000000, "FlagPIE|0x80000000", "macho.FlagPIE|0x80000000"},
+		{SgNoreloc | SgReadOnly, "SgNoreloc|SgReadOnly", "macho.SgNoreloc|macho.SgReadOnly"},
+		{SRegular | SAttrPureInstructions | SAttrSomeInstructions, "SRegular|SAttrPureInstructions|SAttrSomeInstructions", "macho.SRegular|macho.SAttrPureInstructions|macho.SAttrSomeInstructions"},
+		{SCoalesced | SAttrNoToc | SAttrStripStaticSyms, "SCoalesced|SAttrNoToc|SAttrStripStaticSyms", "macho.SCoalesced|macho.SAttrNoToc|macho.SAttrStripStaticSyms"},
+		{SZerofill, "SZerofill", "macho.SZerofill"},
+		{SecFlags(0x40) | SAttrDebug | 0x1000, "0x40|SAttrDebug|0x1000", "0x40|macho.SAttrDebug|0x1000"},
+	}
+	for _, tt := range tests {
+		if got := tt.f.String(); got != tt.str {
+			t.Errorf("String() = %q, want %q", got, tt.str)
+		}
+		if got := fmt.Sprintf("%#v", tt.f); got != tt.gostr {
+			t.Errorf("GoString() = %q, want %q", got, tt.gostr)
+		}
+	}
+
+	f := SLazySymbolPointers | SAttrLocReloc
+	if f.Type() != SLazySymbolPointers || f.Attributes() != SAttrLocReloc {
+		t.Errorf("%#x: Type() = %v, Attributes() = %v", uint32(f), f.Type(), f.Attributes())
+	}
+	for _, z := range []SecFlags{SZerofill, SGbZerofill, SThreadLocalZerofill | SAttrNoDeadStrip} {
+		if !z.IsZerofill() {
+			t.Errorf("%v.IsZerofill() = false", z)
+		}
+	}
+	if SThreadLocalRegular.IsZerofill() {
+		t.Errorf("SThreadLocalRegular.IsZerofill() = true")
+	}
+}
+
+func TestSectionTypes(t *testing.T) {
+	f, err := Open("testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	type kind struct {
+		typ                                     SecFlags
+		zerofill, instructions, stubs, indirect bool
+	}
+	want := map[string]kind{
+		"__text":          {SRegular, false, true, false, false},
+		"__symbol_stub1":  {SSymbolStubs, false, true, true, true},
+		"__stub_helper":   {SRegular, false, false, false, false},
+		"__cstring":       {SCstringLiterals, false, false, false, false},
+		"__eh_frame":      {SCoalesced, false, false, false, false},
+		"__la_symbol_ptr": {SLazySymbolPointers, false, false, false, true},
+	}
+	for _, s := range f.Sections {
+		w, ok := want[s.Name]
+		if !ok {
+			continue
+		}
+		got := kind{s.Flags.Type(), s.Flags.IsZerofill(), s.Flags.HasInstructions(), s.Flags.IsSymbolStubs(), s.Flags.HasIndirectSymbols()}
+		if got != w {
+			t.Errorf("%s (%v): got %+v, want %+v", s.Name, s.Flags, got, w)
+		}
+	}
+	if f := SAttrDebug | SRegular; !f.IsDebug() || f.HasInstructions() {
+		t.Errorf("%v: IsDebug() = %v, HasInstructions() = %v", f, f.IsDebug(), f.HasInstructions())
+	}
+	if f := SThreadLocalVariablePointers; !f.HasIndirectSymbols() || f.IsSymbolStubs() {
+		t.Errorf("%v: HasIndirectSymbols() = %v, IsSymbolStubs() = %v", f, f.HasIndirectSymbols(), f.IsSymbolStubs())
+	}
+}
+
+func TestIndirectSymbols(t *testing.T) {
+	f, err := Open("testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	slots, err := f.IndirectSymbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type slot struct {
+		sect, sym string
+		addr      uint64
+		index     uint32
+	}
+	var got []slot
+	for _, s := range slots {
+		if s.Symbol == nil {
+			t.Fatalf("slot %#x is bound to no symbol", s.Addr)
+		}
+		got = append(got, slot{s.Section.Name, s.Symbol.Name, s.Addr, s.Index})
+	}
+	want := []slot{
+		{"__symbol_stub1", "_exit", 0x100000f81, 0},
+		{"__symbol_stub1", "_puts", 0x100000f87, 1},
+		{"__la_symbol_ptr", "_exit", 0x100001058, 2},
+		{"__la_symbol_ptr", "_puts", 0x100001060, 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("IndirectSymbols() = %+v, want %+v", got, want)
+	}
+
+	// Marked entries are bound to no symbol; entries past the table's
+	// end are an error.
+	ptrs := f.Section("__la_symbol_ptr")
+	f.Dysymtab.IndirectSyms[3] = IndirectSymbolLocal | IndirectSymbolAbs
+	slots, err = f.SectionIndirectSymbols(ptrs)
+	if err != nil || len(slots) != 2 || slots[1].Symbol != nil || !slots[1].Local || !slots[1].Absolute {
+		t.Errorf("with a local absolute entry: got %+v, %v", slots, err)
+	}
+	f.Dysymtab.IndirectSyms = f.Dysymtab.IndirectSyms[:3]
+	if _, err := f.SectionIndirectSymbols(ptrs); err == nil {
+		t.Errorf("slots past the end of the table: no error")
+	}
+	if slots, err := f.SectionIndirectSymbols(f.Section("__text")); slots != nil || err != nil {
+		t.Errorf("__text: got %+v, %v", slots, err)
+	}
+}
+
+func TestRelocations(t *testing.T) {
+	type rel struct {
+		sect, kind string
+		at         uint64
+		size       int
+		to         string
+	}
+	for name, want := range map[string][]rel{
+		"testdata/clang-386-darwin.obj": {
+			{"__text", "GENERIC_RELOC_VANILLA", 29, 4, "_printf"},
+			{"__text", "GENERIC_RELOC_LOCAL_SECTDIFF", 14, 4, ""},
+			{"__text", "GENERIC_RELOC_PAIR", 0, 4, ""},
+		},
+		"testdata/clang-amd64-darwin.obj": {
+			{"__text", "X86_64_RELOC_BRANCH", 25, 4, "_printf"},
+			{"__text", "X86_64_RELOC_SIGNED", 11, 4, "__cstring"},
+			{"__compact_unwind", "X86_64_RELOC_UNSIGNED", 56, 8, "__text"},
+		},
+	} {
+		f, err := Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []rel
+		for _, s := range f.Sections {
+			rs, err := f.Relocations(s)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			for _, r := range rs {
+				to := ""
+				if r.Symbol != nil {
+					to = r.Symbol.Name
+				} else if r.Section != nil {
+					to = r.Section.Name
+				}
+				got = append(got, rel{s.Name, r.Kind.String(), r.At, r.Size, to})
+			}
+		}
+		f.Close()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: relocations are\n\t%+v\nwant\n\t%+v", name, got, want)
+		}
+	}
+
+	if k := (Reloc{Type: 10}).Kind(CpuArm64); k != ARM64_RELOC_ADDEND || !isPairReloc(k) {
+		t.Errorf("Kind(CpuArm64) of type 10 = %#v", k)
+	}
+	if k := (Reloc{Type: 1}).Kind(CpuPpc); k != nil {
+		t.Errorf("Kind(CpuPpc) = %#v, want nil", k)
+	}
+}
+
+func TestFileset(t *testing.T) {
+	o := binary.LittleEndian
+	hdr := FileHeader{Magic: Magic64, Cpu: CpuArm64, Type: MhFileset}
+	toc := &FileTOC{FileHeader: hdr, ByteOrder: o}
+	ids := []string{"com.apple.kernel", "com.example.driver"}
+	for i, id := range ids {
+		e := &FilesetEntry{FilesetEntryCmd: FilesetEntryCmd{LoadCmd: LcFilesetEntry, Addr: 0xfffffe0007004000 + uint64(i)<<16,
+			FileOff: 0x1000 * uint64(i+1), EntryID: 32}, EntryID: id}
+		e.Len = e.LoadSize(toc)
+		toc.AddLoad(e)
+	}
+	b := make([]byte, 0x3000)
+	toc.Put(b)
+
+	// Each entry's offsets are offsets in the whole file.
+	for i, id := range ids {
+		base := 0x1000 * (i + 1)
+		hdr.Type = MhExecute
+		if i > 0 {
+			hdr.Type = 0xb // MH_KEXT_BUNDLE
+		}
+		et := &FileTOC{FileHeader: hdr, ByteOrder: o}
+		et.AddSegment(&Segment{SegmentHeader: SegmentHeader{LoadCmd: LcSegment64, Name: "__TEXT",
+			Offset: uint64(base), Filesz: 0x1000, Memsz: 0x1000}})
+		et.AddSection(&Section{SectionHeader: SectionHeader{Name: "__text", Seg: "__TEXT", Offset: uint32(base + 0x800), Size: uint64(len(id))}})
+		et.Put(b[base:])
+		copy(b[base+0x800:], id)
+	}
+
+	f, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := f.FilesetEntries()
+	if len(entries) != len(ids) {
+		t.Fatalf("%d fileset entries, want %d", len(entries), len(ids))
+	}
+	for i, e := range entries {
+		if e.EntryID != ids[i] || e.FileOff != 0x1000*uint64(i+1) {
+			t.Errorf("entry %d is %s", i, e)
+		}
+		ef, err := f.OpenFilesetEntry(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := ef.Section("__text").Data(); err != nil || string(data) != ids[i] {
+			t.Errorf("%s: __text holds %q, %v", e.EntryID, data, err)
+		}
+	}
+	if e := f.FilesetEntry("com.example.driver"); e != entries[1] {
+		t.Errorf("FilesetEntry(com.example.driver) = %v", e)
+	}
+	if f.Type.String() != "Fileset" || entries[0].Command() != LcFilesetEntry {
+		t.Errorf("type %v, command %v", f.Type, entries[0].Command())
+	}
+
+	// The commands are written back as they were read.
+	out := make([]byte, toc.TOCSize())
+	f.FileTOC.Put(out)
+	if !bytes.Equal(out, b[:len(out)]) {
+		t.Errorf("load commands written back differ")
+	}
+}
+
+func TestFileTOCWriteTo(t *testing.T) {
+	build := func() (*FileTOC, *Section) {
+		toc := &FileTOC{FileHeader: FileHeader{Magic: Magic64, Cpu: CpuAmd64, Type: MhExecute}, ByteOrder: binary.LittleEndian}
+		toc.AddSegment(&Segment{SegmentHeader: SegmentHeader{LoadCmd: LcSegment64, Name: "__TEXT", Filesz: 0x1010, Memsz: 0x2000}})
+		text := &Section{SectionHeader: SectionHeader{Name: "__text", Seg: "__TEXT", Offset: 0x1000, Size: 4}}
+		toc.AddSection(text)
+		toc.AddSectionPayload(text, strings.NewReader("text"))
+		bss := &Section{SectionHeader: SectionHeader{Name: "__bss", Seg: "__TEXT", Size: 0x100, Flags: SZerofill}}
+		toc.AddSection(bss)
+		toc.AddSectionPayload(bss, strings.NewReader("not written"))
+		le := &Segment{SegmentHeader: SegmentHeader{LoadCmd: LcSegment64, Name: "__LINKEDIT", Offset: 0x2000, Filesz: 8}}
+		toc.AddSegment(le)
+		toc.AddSegmentPayload(le, strings.NewReader("linkedit, and more"))
+		toc.AddPayload(0x2010, strings.NewReader("tail"), 4)
+		return toc, text
+	}
+
+	toc, _ := build()
+	var buf bytes.Buffer
+	n, err := toc.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := toc.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0x2014 || !bytes.Equal(buf.Bytes(), b) {
+		t.Fatalf("WriteTo wrote %#x bytes, and Bytes returned %#x that differ", n, len(b))
+	}
+	head := make([]byte, toc.TOCSize())
+	toc.Put(head)
+	if !bytes.Equal(b[:len(head)], head) || string(b[0x2000:0x2008]) != "linkedit" || string(b[0x2010:]) != "tail" ||
+		!bytes.Equal(b[len(head):0x1000], make([]byte, 0x1000-len(head))) {
+		t.Errorf("file is not the load commands and payloads, with zeros between")
+	}
+	f, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := f.Section("__text").Data(); err != nil || string(data) != "text" {
+		t.Errorf("__text holds %q, %v", data, err)
+	}
+
+	// Payloads may not overlap, or fall short.
+	toc, text := build()
+	toc.AddPayload(0x1002, strings.NewReader("xx"), 2)
+	buf.Reset()
+	if _, err := toc.WriteTo(&buf); err == nil || !strings.Contains(err.Error(), "overlaps section __TEXT,__text") || buf.Len() != 0 {
+		t.Errorf("overlapping payloads: wrote %d bytes, %v", buf.Len(), err)
+	}
+	toc, text = build()
+	text.Size = 8
+	if _, err := toc.Bytes(); err == nil || !strings.Contains(err.Error(), "section __TEXT,__text: 4 bytes, but it should have 8") {
+		t.Errorf("short payload: %v", err)
+	}
+}
+
+func TestWriteToRelocs(t *testing.T) {
+	for _, name := range []string{"testdata/clang-amd64-darwin.obj", "testdata/clang-386-darwin.obj"} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nreloc := 0
+		for _, s := range f.Sections {
+			nreloc += len(s.Relocs)
+		}
+		if nreloc == 0 {
+			t.Fatalf("%s: no relocations", name)
+		}
+		// The file again, from its segment, symbols, and strings,
+		// and its sections' Relocs, which are written at their Reloff.
+		toc := f.FileTOC
+		r := bytes.NewReader(b)
+		for _, l := range toc.Loads {
+			if g, ok := l.(*Segment); ok {
+				toc.AddSegmentPayload(g, io.NewSectionReader(r, int64(g.Offset), int64(g.Filesz)))
+			}
+		}
+		st := f.Symtab
+		toc.AddPayload(uint64(st.Symoff), io.NewSectionReader(r, int64(st.Symoff), int64(st.Stroff+st.Strsize-st.Symoff)), uint64(st.Stroff+st.Strsize-st.Symoff))
+		var buf bytes.Buffer
+		if _, err := toc.WriteTo(&buf); err != nil {
+			t.Fatalf("%s: WriteTo: %v", name, err)
+		}
+		if !bytes.Equal(buf.Bytes(), b) {
+			t.Errorf("%s: WriteTo did not reproduce the file", name)
+		}
+		g, err := NewFile(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, s := range g.Sections {
+			if !reflect.DeepEqual(s.Relocs, f.Sections[i].Relocs) {
+				t.Errorf("%s: section %s: relocations %v, want %v", name, s.Name, s.Relocs, f.Sections[i].Relocs)
+			}
+		}
+
+		// A section whose Nreloc its Relocs do not match is not written.
+		s := toc.Sections[0]
+		for _, c := range toc.Sections {
+			if len(c.Relocs) > 0 {
+				s = c
+				break
+			}
+		}
+		relocs := s.Relocs
+		s.Relocs = nil
+		buf.Reset()
+		if _, err := toc.WriteTo(&buf); err == nil || buf.Len() != 0 {
+			t.Errorf("%s: WriteTo with Nreloc %d and no Relocs wrote %d bytes, %v", name, s.Nreloc, buf.Len(), err)
+		}
+		if _, err := toc.Bytes(); err == nil {
+			t.Errorf("%s: Bytes with Nreloc %d and no Relocs succeeded", name, s.Nreloc)
+		}
+		s.Relocs = relocs
+	}
+}
+
+func TestSectionAttachments(t *testing.T) {
+	want := []byte(strings.Repeat("uncompressed DWARF ", 20))
+	var z bytes.Buffer
+	w := zlib.NewWriter(&z)
+	w.Write(want)
+	w.Close()
+	hdr := append([]byte("ZLIB"), 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(hdr[4:], uint64(len(want)))
+	zb := append(hdr, z.Bytes()...)
+	from := &Section{SectionHeader: SectionHeader{Name: "__zdebug_info", Seg: "__DWARF", Size: uint64(len(zb))},
+		sr: io.NewSectionReader(bytes.NewReader(zb), 0, int64(len(zb)))}
+
+	build := func() (*FileTOC, *Segment) {
+		toc := &FileTOC{FileHeader: FileHeader{Magic: Magic64, Cpu: CpuAmd64, Type: MhDsym}, ByteOrder: binary.LittleEndian}
+		g := &Segment{SegmentHeader: SegmentHeader{LoadCmd: LcSegment64, Name: "__DWARF", Addr: 0x1000}}
+		toc.AddSegment(g)
+		for _, tr := range []PayloadTransform{PayloadDecompress, PayloadAsIs} {
+			s := &Section{SectionHeader: SectionHeader{Name: "__debug_info", Seg: "__DWARF"}}
+			toc.AddSection(s)
+			if err := toc.AddSectionFrom(s, from, tr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s := &Section{SectionHeader: SectionHeader{Name: "__debug_str", Seg: "__DWARF", Align: 4}}
+		toc.AddSection(s)
+		toc.AddSectionData(s, []byte("main\x00"))
+		if err := toc.LayOutSegment(g, 0x1000); err != nil {
+			t.Fatal(err)
+		}
+		return toc, g
+	}
+
+	toc, g := build()
+	var buf bytes.Buffer
+	if _, err := toc.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	toc2, _ := build()
+	b, err := toc2.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), b) {
+		t.Fatalf("WriteTo and Bytes differ")
+	}
+	secs := toc.Sections
+	off := 0x1000 + uint64(len(want)) + uint64(len(zb))
+	if secs[0].Offset != 0x1000 || secs[0].Size != uint64(len(want)) || secs[1].Size != uint64(len(zb)) ||
+		uint64(secs[2].Offset) != RoundUp(off, 16) || secs[2].Addr != uint64(secs[2].Offset) {
+		t.Errorf("laid out at %#x+%#x, %#x+%#x, %#x+%#x", secs[0].Offset, secs[0].Size, secs[1].Offset, secs[1].Size, secs[2].Offset, secs[2].Size)
+	}
+	if g.Offset != 0x1000 || g.Filesz != uint64(secs[2].Offset)+5-0x1000 || g.Memsz != g.Filesz {
+		t.Errorf("segment at %#x+%#x, memory %#x", g.Offset, g.Filesz, g.Memsz)
+	}
+	f, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range [][]byte{want, zb, []byte("main\x00")} {
+		if got, err := f.Sections[i].Data(); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("section %d holds %q, %v", i, got, err)
+		}
+	}
+
+	// A stream longer than its section is an error too.
+	toc, _ = build()
+	toc.Sections[0].Size--
+	if _, err := toc.WriteTo(ioutil.Discard); err == nil || !strings.Contains(err.Error(), "more than the") {
+		t.Errorf("long payload: %v", err)
+	}
+	if err := toc.AddSectionFrom(toc.Sections[0], &Section{}, PayloadAsIs); err == nil {
+		t.Errorf("section not read from a file: no error")
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	o := binary.LittleEndian
+	id := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	// A DWARF-only object, such as sd might put DWARF in.
+	b := NewBuilder(CpuArm64, 0, MhObject, o)
+	b.AddSection("__DWARF", "__debug_str", []byte("main\x00"), 0, SAttrDebug)
+	b.AddSection("__DWARF", "__debug_info", []byte("info"), 0, SAttrDebug)
+	text := b.AddSection("__TEXT", "__text", []byte{0xc0, 0x03, 0x5f, 0xd6}, 2, SAttrPureInstructions|SAttrSomeInstructions)
+	b.AddSymbol(Symbol{Name: "_main", Type: 0xf, Sect: text, Value: 0x10})
+	b.SetUUID(id)
+	toc, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := toc.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Validate(); err != nil {
+		t.Error(err)
+	}
+	if f.Ncmd != 3 || f.Type != MhObject || f.UUID() == nil || f.UUID().Id != id {
+		t.Errorf("header %+v, UUID %v", f.FileHeader, f.UUID())
+	}
+	if g := f.Segment(""); g == nil || g.Nsect != 3 || g.Offset != uint64(f.TOCSize()) {
+		t.Errorf("segment %+v", g)
+	}
+	for _, s := range []struct{ name, want string }{{"__debug_str", "main\x00"}, {"__debug_info", "info"}, {"__text", "\xc0\x03\x5f\xd6"}} {
+		sec := f.Section(s.name)
+		if sec == nil || sec.Offset%(1<<sec.Align) != 0 {
+			t.Errorf("section %s: %+v", s.name, sec)
+			continue
+		}
+		if got, err := sec.Data(); err != nil || string(got) != s.want {
+			t.Errorf("section %s holds %q, %v", s.name, got, err)
+		}
+	}
+	if text := f.Section("__text"); text.Addr != 12 || text.Offset != uint32(f.TOCSize())+12 {
+		t.Errorf("__text at %#x, offset %#x", text.Addr, text.Offset)
+	}
+	sf, err := stdmacho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sf.Symtab == nil || len(sf.Symtab.Syms) != 1 || sf.Symtab.Syms[0].Name != "_main" || sf.Symtab.Syms[0].Sect != 3 {
+		t.Errorf("symbols %+v", sf.Symtab)
+	}
+
+	// A file of segments, each page-aligned, with __LINKEDIT last.
+	b = NewBuilder(CpuAmd64, 3, MhDsym, o)
+	b.PageSize = 0x4000
+	b.Addr = 0x100000000
+	b.AddSegment("__TEXT", 5)
+	b.AddSection("__TEXT", "__text", make([]byte, 0x10), 4, SAttrPureInstructions)
+	b.AddSection("__DATA", "__data", []byte("data"), 3, 0)
+	b.AddSectionReader("__DATA", "__bss", nil, 0x5000, 3, SZerofill)
+	b.AddSegment("__LINKEDIT", 1)
+	b.AddSymbol(Symbol{Name: "_x", Type: 0xf, Sect: 2, Value: 0x100004000})
+	toc, err = b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := toc.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	f, err = NewFile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []struct {
+		name                        string
+		offset, filesz, addr, memsz uint64
+	}{
+		{"__TEXT", 0x4000, 0x4000, 0x100000000, 0x4000},
+		{"__DATA", 0x8000, 0x4000, 0x100004000, 0x8000},
+		{"__LINKEDIT", 0xc000, 0x18, 0x10000c000, 0x4000}, // one symbol, and " \x00_x\x00" padded to 8
+	} {
+		g := f.Segment(w.name)
+		if g == nil || g.Offset != w.offset || g.Filesz != w.filesz || g.Addr != w.addr || g.Memsz != w.memsz {
+			t.Errorf("segment %s: %+v, want offset %#x filesz %#x addr %#x memsz %#x", w.name, g, w.offset, w.filesz, w.addr, w.memsz)
+		}
+	}
+	if bss := f.Section("__bss"); bss.Addr != 0x100004008 || bss.Offset != 0 {
+		t.Errorf("__bss at %#x, offset %#x", bss.Addr, bss.Offset)
+	}
+	if f.Symtab == nil || len(f.Symtab.Syms) != 1 || f.Symtab.Syms[0].Name != "_x" || f.Symtab.Symoff != 0xc000 {
+		t.Errorf("symbols %+v", f.Symtab.Syms)
+	}
+	if int64(buf.Len()) != 0xc018 {
+		t.Errorf("file is %#x bytes", buf.Len())
+	}
+
+	b = NewBuilder(CpuAmd64, 3, MhExecute, o)
+	b.AddSectionReader("__DATA", "__bss", nil, 8, 3, SZerofill)
+	b.AddSection("__DATA", "__data", []byte("data"), 3, 0)
+	if _, err := b.Build(); err == nil || !strings.Contains(err.Error(), "follows a zero-fill section") {
+		t.Errorf("section after zero-fill: %v", err)
+	}
+}
+
+func TestInsertRemoveSection(t *testing.T) {
+	b := NewBuilder(CpuAmd64, 3, MhExecute, binary.LittleEndian)
+	b.Addr = 0x100000000
+	text := b.AddSection("__TEXT", "__text", bytes.Repeat([]byte{0x90}, 0x100), 4, SAttrPureInstructions)
+	cstr := b.AddSection("__TEXT", "__cstring", []byte("hi\x00"), 0, 0)
+	b.AddSection("__DATA", "__data", []byte{1, 2, 3, 4}, 3, 0)
+	b.AddSegment("__LINKEDIT", 1)
+	b.AddSymbol(Symbol{Name: "_main", Type: 0xf, Sect: text, Value: 0x100001000})
+	b.AddSymbol(Symbol{Name: "_hi", Type: 0xf, Sect: cstr, Value: 0x100001100})
+	toc, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segs []*Segment
+	var symtab *Symtab
+	for _, l := range toc.Loads {
+		switch l := l.(type) {
+		case *Segment:
+			segs = append(segs, l)
+		case *Symtab:
+			symtab = l
+		}
+	}
+	textSeg, data, linkedit := segs[0], segs[1], segs[2]
+
+	// __TEXT cannot grow into __DATA, which follows it in memory.
+	konst := &Section{SectionHeader: SectionHeader{Name: "__const", Seg: "__TEXT", Align: 3}}
+	toc.AddSectionData(konst, bytes.Repeat([]byte("const"), 0x300))
+	if err := toc.InsertSection(textSeg, 1, konst); err == nil || !strings.Contains(err.Error(), "segment __DATA follows it") {
+		t.Fatalf("growing into __DATA: %v", err)
+	}
+	if len(toc.Sections) != 3 || textSeg.Nsect != 2 {
+		t.Fatalf("a failed insertion changed the file: %d sections", len(toc.Sections))
+	}
+
+	// Given room, what follows moves by a whole number of the largest pages.
+	data.Addr += 0x100000
+	linkedit.Addr += 0x100000
+	before := struct {
+		cstr, data, syms, strs uint64
+	}{uint64(toc.Sections[1].Offset), data.Offset, uint64(symtab.Symoff), uint64(symtab.Stroff)}
+	if err := toc.InsertSection(textSeg, 1, konst); err != nil {
+		t.Fatal(err)
+	}
+	if err := toc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if konst.Offset != 0x1100 || konst.Addr != 0x100000100 || textSeg.Nsect != 3 || data.Firstsect != 3 {
+		t.Errorf("__const at %#x, address %#x; __TEXT has %d sections, __DATA's begin at %d", konst.Offset, konst.Addr, textSeg.Nsect, data.Firstsect)
+	}
+	cs := toc.Sections[2]
+	if uint64(cs.Offset) != before.cstr+maxPageSize || data.Offset != before.data+maxPageSize ||
+		uint64(symtab.Symoff) != before.syms+maxPageSize || uint64(symtab.Stroff) != before.strs+maxPageSize {
+		t.Errorf("__cstring at %#x, __DATA at %#x, symbols at %#x and %#x; want each %#x later than before", cs.Offset, data.Offset, symtab.Symoff, symtab.Stroff, maxPageSize)
+	}
+	if textSeg.Filesz != 0x1000+maxPageSize || cs.Addr != 0x100000100+maxPageSize {
+		t.Errorf("__TEXT is %#x bytes; __cstring is at address %#x", textSeg.Filesz, cs.Addr)
+	}
+	if symtab.Syms[1].Sect != 3 {
+		t.Errorf("_hi is in section %d, want 3", symtab.Syms[1].Sect)
+	}
+	buf, err := toc.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []struct{ name, want string }{{"__const", strings.Repeat("const", 0x300)}, {"__cstring", "hi\x00"}, {"__data", "\x01\x02\x03\x04"}} {
+		if got, err := f.Section(s.name).Data(); err != nil || string(got) != s.want {
+			t.Errorf("section %s holds %.20q, %v", s.name, got, err)
+		}
+	}
+	if f.Symtab == nil || f.Symtab.Syms[1].Name != "_hi" || f.Symtab.Syms[1].Sect != 3 {
+		t.Errorf("symbols %+v", f.Symtab.Syms)
+	}
+
+	// Removing it puts everything back; a section a symbol is in stays.
+	if err := toc.RemoveSection(cs); err == nil || !strings.Contains(err.Error(), "_hi") {
+		t.Errorf("removing __cstring: %v", err)
+	}
+	if err := toc.RemoveSection(konst); err != nil {
+		t.Fatal(err)
+	}
+	if err := toc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if uint64(cs.Offset) != before.cstr || data.Offset != before.data || uint64(symtab.Symoff) != before.syms ||
+		textSeg.Filesz != 0x1000 || data.Firstsect != 2 || symtab.Syms[1].Sect != 2 {
+		t.Errorf("after removal, __cstring at %#x, __DATA at %#x (sections from %d), symbols at %#x", cs.Offset, data.Offset, data.Firstsect, symtab.Symoff)
+	}
+	if _, err := toc.Bytes(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRemoveLoad(t *testing.T) {
+	b := NewBuilder(CpuAmd64, 3, MhExecute, binary.LittleEndian)
+	b.Addr = 0x100000000
+	text := b.AddSection("__TEXT", "__text", bytes.Repeat([]byte{0x90}, 0x100), 4, SAttrPureInstructions)
+	b.AddSection("__DATA", "__data", []byte{1, 2, 3, 4}, 3, 0)
+	b.AddSegment("__LINKEDIT", 1)
+	b.AddSymbol(Symbol{Name: "_main", Type: 0xf, Sect: text, Value: 0x100001000})
+	toc, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := func(name string) int {
+		for i, l := range toc.Loads {
+			if g, ok := l.(*Segment); ok && g.Name == name {
+				return i
+			}
+		}
+		return -1
+	}
+	linkedit := toc.Loads[index("__LINKEDIT")].(*Segment)
+	unsigned := linkedit.Filesz
+
+	// Sign it, as the linker would, at the end of __LINKEDIT.
+	off := RoundUp(linkedit.Offset+linkedit.Filesz, 16)
+	sig := &LinkEditData{LinkEditDataCmd{LoadCmd: LcCodeSignature, DataOff: uint32(off), DataLen: 0x20}}
+	sig.Len = sig.LoadSize(toc)
+	toc.AddLoad(sig)
+	toc.AddPayload(off, bytes.NewReader(bytes.Repeat([]byte{0xfa}, 0x20)), 0x20)
+	linkedit.Filesz = off + 0x20 - linkedit.Offset
+	signed, err := toc.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := toc.RemoveLoad(len(toc.Loads)); err == nil {
+		t.Errorf("removing load %d of %d succeeded", len(toc.Loads), len(toc.Loads))
+	}
+	if err := toc.RemoveLoad(index("__LINKEDIT")); err == nil || !strings.Contains(err.Error(), "locates data in it") {
+		t.Errorf("removing __LINKEDIT, which holds the symbols: %v", err)
+	}
+	if err := toc.RemoveLoad(index("__TEXT")); err == nil || !strings.Contains(err.Error(), "_main") {
+		t.Errorf("removing __TEXT, which _main is in: %v", err)
+	}
+
+	// Removing the signature shrinks the file to what it was unsigned.
+	ncmd := toc.Ncmd
+	if n, err := toc.RemoveLoadsOfType(LcCodeSignature); n != 1 || err != nil {
+		t.Fatalf("RemoveLoadsOfType(LcCodeSignature) = %d, %v", n, err)
+	}
+	if err := toc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if toc.Ncmd != ncmd-1 || linkedit.Filesz != unsigned {
+		t.Errorf("Ncmd %d, __LINKEDIT %#x bytes; want %d, %#x", toc.Ncmd, linkedit.Filesz, ncmd-1, unsigned)
+	}
+	buf, err := toc.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(buf)) != linkedit.Offset+unsigned || len(buf) >= len(signed) {
+		t.Errorf("unsigned file is %#x bytes, signed %#x; want %#x", len(buf), len(signed), linkedit.Offset+unsigned)
+	}
+
+	// Removing __DATA takes its section, and the sections after it
+	// are numbered from where its were.
+	if err := toc.RemoveLoad(index("__DATA")); err != nil {
+		t.Fatal(err)
+	}
+	if err := toc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err = toc.Bytes(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Segment("__DATA") != nil || f.Section("__data") != nil || len(f.Sections) != 1 {
+		t.Errorf("__DATA or __data remains: %d sections", len(f.Sections))
+	}
+	for _, l := range f.Loads {
+		if l.Command() == LcCodeSignature {
+			t.Errorf("LC_CODE_SIGNATURE remains")
+		}
+	}
+	if got, err := f.Section("__text").Data(); err != nil || !bytes.Equal(got, bytes.Repeat([]byte{0x90}, 0x100)) {
+		t.Errorf("__text holds %.20q, %v", got, err)
+	}
+	if f.Symtab == nil || f.Symtab.Syms[0].Name != "_main" {
+		t.Errorf("symbols %+v", f.Symtab)
+	}
+}
+
+func TestNlistGetPut(t *testing.T) {
+	for _, o := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		n := Nlist64{Name: 0x01020304, Type: 0x0f, Sect: 3, Desc: 0x0506, Value: 0x1122334455667788}
+		b := make([]byte, Nlist64Size)
+		var got Nlist64
+		if k := n.Put64(b, o); k != Nlist64Size || got.Get64(b, o) != Nlist64Size || got != n {
+			t.Errorf("%v: Nlist64 reads back as %+v, want %+v", o, got, n)
+		}
+		b = make([]byte, Nlist32Size)
+		n32 := Nlist32{Name: n.Name, Type: n.Type, Sect: n.Sect, Desc: n.Desc, Value: 0x55667788}
+		if k := n.Put32(b, o); k != Nlist32Size || got.Get32(b, o) != Nlist32Size || got.Value != 0x55667788 || got.Name != n.Name {
+			t.Errorf("%v: Nlist64 as 32 bits reads back as %+v", o, got)
+		}
+		c := make([]byte, Nlist32Size)
+		var got32 Nlist32
+		if n32.Put(c, o); !bytes.Equal(b, c) || got32.Get(c, o) != Nlist32Size || got32 != n32 {
+			t.Errorf("%v: Nlist32 reads back as %+v, want %+v", o, got32, n32)
+		}
+	}
+
+	// Edit a symbol table in place, with no File, and read it back.
+	for _, name := range []string{"testdata/gcc-386-darwin-exec", "testdata/gcc-amd64-darwin-exec"} {
+		f, err := Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		symoff, nsyms, size := f.Symtab.Symoff, f.Symtab.Nsyms, f.SymbolSize()
+		o := f.ByteOrder
+		want := append([]Symbol{}, f.Symtab.Syms...)
+		f.Close()
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := uint32(0); i < nsyms; i++ {
+			var n Nlist64
+			e := b[symoff+i*size:]
+			if size == Nlist64Size {
+				n.Get64(e, o)
+				n.Value += 0x1000
+				n.Put64(e, o)
+			} else {
+				n.Get32(e, o)
+				n.Value += 0x1000
+				n.Put32(e, o)
+			}
+			want[i].Value += 0x1000
+		}
+		g, err := NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(g.Symtab.Syms, want) {
+			t.Errorf("%s: symbols after editing are %+v, want %+v", name, g.Symtab.Syms, want)
+		}
+	}
+}
+
+func TestEditDylibPaths(t *testing.T) {
+	for _, name := range []string{"testdata/clang-386-darwin-exec-with-rpath", "testdata/clang-amd64-darwin-exec-with-rpath"} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.TOCSize() != f.HdrSize()+f.Cmdsz {
+			t.Errorf("%s: TOCSize is %#x, but the load commands end at %#x", name, f.TOCSize(), f.HdrSize()+f.Cmdsz)
+		}
+		// Written back unedited, the load commands are as they were.
+		same := append([]byte{}, b...)
+		if err := f.PutOver(same); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(same, b) {
+			t.Errorf("%s: load commands written back unedited differ", name)
+		}
+
+		if err := f.SetDylibID("/usr/lib/libexec.dylib"); err == nil {
+			t.Errorf("%s: SetDylibID of an executable succeeded", name)
+		}
+		if err := f.ChangeDylibPath("/usr/lib/libNone.dylib", "/x"); err == nil {
+			t.Errorf("%s: ChangeDylibPath of a dylib not loaded succeeded", name)
+		}
+		cmdsz := f.Cmdsz
+		if err := f.ChangeDylibPath("/usr/lib/libSystem.B.dylib", "/"+strings.Repeat("x", 1<<16)); err == nil {
+			t.Errorf("%s: ChangeDylibPath to a path too long to fit succeeded", name)
+		}
+		if libs, _ := f.ImportedLibraries(); f.Cmdsz != cmdsz || libs[0] != "/usr/lib/libSystem.B.dylib" {
+			t.Errorf("%s: a failed ChangeDylibPath changed Cmdsz to %#x, libraries to %q", name, f.Cmdsz, libs)
+		}
+
+		const system, rpath = "/opt/local/lib/system/libSystem.B.dylib", "@loader_path/../lib"
+		if err := f.ChangeDylibPath("/usr/lib/libSystem.B.dylib", system); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.ChangeRpath("/my/rpath", rpath); err != nil {
+			t.Fatal(err)
+		}
+		if f.Cmdsz == cmdsz || f.TOCSize() != f.HdrSize()+f.Cmdsz {
+			t.Errorf("%s: after editing, Cmdsz is %#x (was %#x), TOCSize %#x", name, f.Cmdsz, cmdsz, f.TOCSize())
+		}
+		edited := append([]byte{}, b...)
+		if err := f.PutOver(edited); err != nil {
+			t.Fatal(err)
+		}
+		g, err := NewFile(bytes.NewReader(edited))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if libs, _ := g.ImportedLibraries(); len(libs) != 1 || libs[0] != system {
+			t.Errorf("%s: libraries after editing are %q, want %q", name, libs, system)
+		}
+		var rpaths []string
+		for _, l := range g.Loads {
+			if r, ok := l.(*Rpath); ok {
+				rpaths = append(rpaths, r.Path)
+			}
+		}
+		if len(rpaths) != 1 || rpaths[0] != rpath {
+			t.Errorf("%s: rpaths after editing are %q, want %q", name, rpaths, rpath)
+		}
+		if g.Cmdsz != f.Cmdsz || len(g.Loads) != len(f.Loads) || !reflect.DeepEqual(g.Symtab.Syms, f.Symtab.Syms) {
+			t.Errorf("%s: edited file has Cmdsz %#x and %d loads, want %#x and %d, or its symbols differ", name, g.Cmdsz, len(g.Loads), f.Cmdsz, len(f.Loads))
+		}
+		if !bytes.Equal(edited[f.TOCSize():], b[f.TOCSize():]) {
+			t.Errorf("%s: editing changed more than the load commands", name)
+		}
+	}
+
+	// A dylib's install name.
+	bld := NewBuilder(CpuAmd64, 3, MhDylib, binary.LittleEndian)
+	bld.AddSection("__TEXT", "__text", []byte{0xc3}, 0, 0)
+	toc, err := bld.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	toc.AddLoad(&Dylib{Name: "/usr/local/lib/libfoo.1.dylib", CurrentVersion: 0x10000, CompatVersion: 0x10000, Kind: DylibID})
+	toc.AddLoad(&Dylib{Name: "/usr/lib/libSystem.B.dylib", Kind: DylibWeak})
+	b, err := toc.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := f.Loads[1].(*Dylib); !ok || d.Command() != LcIdDylib || d.String() != "Dylib id /usr/local/lib/libfoo.1.dylib" {
+		t.Fatalf("load 1 is %v, want the dylib's LC_ID_DYLIB", f.Loads[1])
+	}
+	if libs, _ := f.ImportedLibraries(); len(libs) != 1 || libs[0] != "/usr/lib/libSystem.B.dylib" {
+		t.Errorf("ImportedLibraries() = %q, want only libSystem", libs)
+	}
+	if err := f.ChangeDylibPath("/usr/local/lib/libfoo.1.dylib", "/x"); err == nil {
+		t.Errorf("ChangeDylibPath changed the install name")
+	}
+	const id = "@rpath/libfoo.1.dylib"
+	if err := f.SetDylibID(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.PutOver(b); err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := g.ImportedLibraries(DylibID); len(ids) != 1 || ids[0] != id || g.Cmdsz != f.Cmdsz {
+		t.Errorf("install name after SetDylibID is %q, Cmdsz %#x; want %q, %#x", ids, g.Cmdsz, id, f.Cmdsz)
+	}
+	if d := g.Loads[1].(*Dylib); d.CurrentVersion != 0x10000 || d.LoadSize(&g.FileTOC) != 24+24 {
+		t.Errorf("install name load is %+v, of size %d", d, d.LoadSize(&g.FileTOC))
+	}
+}
+
+func TestAddRemoveRpath(t *testing.T) {
+	rpaths := func(f *File) []string {
+		var all []string
+		for _, l := range f.Loads {
+			if r, ok := l.(*Rpath); ok {
+				all = append(all, r.Path)
+			}
+		}
+		return all
+	}
+	for _, name := range []string{"testdata/clang-386-darwin-exec-with-rpath", "testdata/clang-amd64-darwin-exec-with-rpath"} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ncmd, cmdsz := f.Ncmd, f.Cmdsz
+		if err := f.AddRpath("/my/rpath"); err == nil {
+			t.Errorf("%s: AddRpath of an rpath already there succeeded", name)
+		}
+		if err := f.AddRpath("/" + strings.Repeat("x", 1<<16)); err == nil {
+			t.Errorf("%s: AddRpath of a path too long to fit succeeded", name)
+		}
+		if err := f.RemoveRpath("/not/my/rpath"); err == nil {
+			t.Errorf("%s: RemoveRpath of an rpath not there succeeded", name)
+		}
+		if f.Ncmd != ncmd || f.Cmdsz != cmdsz {
+			t.Errorf("%s: failed edits changed Ncmd, Cmdsz to %d, %#x; want %d, %#x", name, f.Ncmd, f.Cmdsz, ncmd, cmdsz)
+		}
+
+		const added = "@executable_path/../Frameworks"
+		if err := f.AddRpath(added); err != nil {
+			t.Fatal(err)
+		}
+		if f.Ncmd != ncmd+1 || f.TOCSize() != f.HdrSize()+f.Cmdsz {
+			t.Errorf("%s: after AddRpath, Ncmd is %d, Cmdsz %#x, TOCSize %#x", name, f.Ncmd, f.Cmdsz, f.TOCSize())
+		}
+		if err := f.PutOver(b); err != nil {
+			t.Fatal(err)
+		}
+		g, err := NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := rpaths(g), []string{"/my/rpath", added}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: rpaths after AddRpath are %q, want %q", name, got, want)
+		}
+
+		if err := g.RemoveRpath("/my/rpath"); err != nil {
+			t.Fatal(err)
+		}
+		if g.Ncmd != ncmd || g.TOCSize() != g.HdrSize()+g.Cmdsz {
+			t.Errorf("%s: after RemoveRpath, Ncmd is %d, Cmdsz %#x, TOCSize %#x", name, g.Ncmd, g.Cmdsz, g.TOCSize())
+		}
+		if err := g.PutOver(b); err != nil {
+			t.Fatal(err)
+		}
+		h, err := NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := rpaths(h), []string{added}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: rpaths after RemoveRpath are %q, want %q", name, got, want)
+		}
+		if h.Ncmd != g.Ncmd || h.Cmdsz != g.Cmdsz || !reflect.DeepEqual(h.Symtab.Syms, f.Symtab.Syms) {
+			t.Errorf("%s: after RemoveRpath, the file has Ncmd %d, Cmdsz %#x; want %d, %#x, or its symbols differ", name, h.Ncmd, h.Cmdsz, g.Ncmd, g.Cmdsz)
+		}
+	}
+}
+
+func TestEditSymbols(t *testing.T) {
+	names := func(f *File) []string {
+		var all []string
+		for _, s := range f.Symtab.Syms {
+			all = append(all, s.Name)
+		}
+		return all
+	}
+	indirect := func(f *File) []string {
+		slots, err := f.IndirectSymbols()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var all []string
+		for _, s := range slots {
+			if s.Symbol != nil {
+				all = append(all, s.Symbol.Name)
+			}
+		}
+		return all
+	}
+	read := func(name string) ([]byte, *File) {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b, f
+	}
+
+	// An executable, whose indirect symbols refer to the undefined.
+	b, f := read("testdata/gcc-amd64-darwin-exec")
+	stubs := indirect(f)
+	if n, err := f.RemoveSymbols(func(s Symbol) bool { return s.Name == "_puts" }); err == nil || n != 0 {
+		t.Errorf("RemoveSymbols of _puts, which an indirect symbol refers to, = %d, %v", n, err)
+	}
+	if err := f.AddAlias("_environ", "_main"); err == nil {
+		t.Errorf("AddAlias of a symbol already defined succeeded")
+	}
+	if err := f.AddAlias("_exit2", "_exit"); err == nil {
+		t.Errorf("AddAlias of an undefined symbol succeeded")
+	}
+	if err := f.RenameSymbol("_nothing", "_something"); err == nil {
+		t.Errorf("RenameSymbol of no symbol succeeded")
+	}
+	if len(f.Symtab.Syms) != 11 || f.Dysymtab.Iundefsym != 9 {
+		t.Fatalf("failed edits left %d symbols, Iundefsym %d", len(f.Symtab.Syms), f.Dysymtab.Iundefsym)
+	}
+	if n, err := f.RemoveSymbols(func(s Symbol) bool { return strings.Contains(s.Name, "dyld") }); err != nil || n != 2 {
+		t.Fatalf("RemoveSymbols = %d, %v; want 2", n, err)
+	}
+	if err := f.AddAlias("_main_alias", "_main"); err != nil {
+		t.Fatal(err)
+	}
+	long := "_NXArgc" + strings.Repeat("_renamed", 32) // the strings no longer fit where they were
+	if err := f.RenameSymbol("_NXArgc", long); err != nil {
+		t.Fatal(err)
+	}
+	out, err := f.PutSymtab(append([]byte{}, b...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewFile(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{long, "_NXArgv", "___progname", "__mh_execute_header", "_environ", "_main", "start", "_main_alias", "_exit", "_puts"}
+	if got := names(g); !reflect.DeepEqual(got, want) {
+		t.Errorf("symbols after editing are %q, want %q", got, want)
+	}
+	if d := g.Dysymtab; d.Nlocalsym != 0 || d.Iextdefsym != 0 || d.Nextdefsym != 8 || d.Iundefsym != 8 || d.Nundefsym != 2 {
+		t.Errorf("LC_DYSYMTAB's ranges after editing are %+v", d.DysymtabCmd)
+	}
+	if got := indirect(g); !reflect.DeepEqual(got, stubs) {
+		t.Errorf("indirect symbols after editing are %q, want %q", got, stubs)
+	}
+	if a, m := g.Symtab.Syms[7], g.Symtab.Syms[5]; a.Value != m.Value || a.Sect != m.Sect || a.Type != m.Type {
+		t.Errorf("alias %+v is not defined as %+v is", a, m)
+	}
+	linkedit := g.Segment("__LINKEDIT")
+	if end := uint64(g.Symtab.Stroff + g.Symtab.Strsize); end != linkedit.Offset+linkedit.Filesz || end != uint64(len(out)) {
+		t.Errorf("the strings end at %#x, __LINKEDIT at %#x, the file at %#x", end, linkedit.Offset+linkedit.Filesz, len(out))
+	}
+	if err := g.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// An object file, whose relocations refer to symbols.
+	for _, name := range []string{"testdata/clang-386-darwin.obj", "testdata/clang-amd64-darwin.obj"} {
+		b, f := read(name)
+		if _, err := f.RemoveSymbols(func(s Symbol) bool { return s.Name == "_printf" }); err == nil {
+			t.Errorf("%s: RemoveSymbols of _printf, which a relocation refers to, succeeded", name)
+		}
+		if err := f.AddAlias("_main_alias", "_main"); err != nil {
+			t.Fatal(err)
+		}
+		out, err := f.PutSymtab(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, err := NewFile(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := names(g), []string{"_main", "_main_alias", "_printf"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: symbols after AddAlias are %q, want %q", name, got, want)
+		}
+		if r := g.Sections[0].Relocs[0]; !r.Extern || r.Value != 2 {
+			t.Errorf("%s: relocation %+v does not refer to _printf, now symbol 2", name, r)
+		}
+		if d := g.Dysymtab; d.Nextdefsym != 2 || d.Iundefsym != 2 || d.Nundefsym != 1 {
+			t.Errorf("%s: LC_DYSYMTAB's ranges after AddAlias are %+v", name, d.DysymtabCmd)
+		}
+	}
+}
+
+func TestStripSymbols(t *testing.T) {
+	names := func(f *File) []string {
+		var all []string
+		for _, s := range f.Symtab.Syms {
+			all = append(all, s.Name)
+		}
+		return all
+	}
+	strip := func(b []byte, level StripLevel) (*File, int, []byte) {
+		f, err := NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := f.StripSymbols(level)
+		if err != nil {
+			t.Fatalf("StripSymbols(%v): %v", level, err)
+		}
+		out := append([]byte{}, b...)
+		if f.Symtab != nil && level != StripTables {
+			if out, err = f.PutSymtab(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if out, err = f.PackLinkedit(out); err != nil {
+			t.Fatal(err)
+		}
+		g, err := NewFile(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Validate(); err != nil {
+			t.Errorf("stripped %v: %v", level, err)
+		}
+		linkedit := g.Segment("__LINKEDIT")
+		if end := linkedit.Offset + linkedit.Filesz; end != uint64(len(out)) || len(out) >= len(b) && n > 0 {
+			t.Errorf("stripped %v: __LINKEDIT ends at %#x, the file, once %#x, at %#x", level, end, len(b), len(out))
+		}
+		return g, n, out
+	}
+
+	// A linked executable: dyld needs the undefined symbols, which its
+	// indirect symbols refer to, and __mh_execute_header.
+	b, err := ioutil.ReadFile("testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stubs, _ := f.IndirectSymbols()
+	if _, err := f.StripSymbols(StripTables); err == nil || !strings.Contains(err.Error(), "__mh_execute_header") {
+		t.Errorf("StripSymbols(StripTables) of an executable that needs its symbols = %v", err)
+	}
+	if len(f.Symtab.Syms) != 11 {
+		t.Errorf("a failed StripSymbols left %d symbols", len(f.Symtab.Syms))
+	}
+	g, n, _ := strip(b, StripLocals)
+	if want := []string{"_NXArgc", "_NXArgv", "___progname", "__mh_execute_header", "_environ", "_main", "start", "_exit", "_puts"}; n != 2 || !reflect.DeepEqual(names(g), want) {
+		t.Errorf("StripLocals removed %d, leaving %q; want 2, leaving %q", n, names(g), want)
+	}
+	g, n, _ = strip(b, StripAll)
+	if want := []string{"__mh_execute_header", "_exit", "_puts"}; n != 8 || !reflect.DeepEqual(names(g), want) {
+		t.Errorf("StripAll removed %d, leaving %q; want 8, leaving %q", n, names(g), want)
+	}
+	after, _ := g.IndirectSymbols()
+	for i := range after {
+		if a, s := after[i].Symbol, stubs[i].Symbol; (a == nil) != (s == nil) || a != nil && a.Name != s.Name {
+			t.Errorf("after StripAll, indirect symbol %d is %v, want %v", i, a, s)
+		}
+	}
+
+	// A built one, with a debug map, a local symbol, and main, none of
+	// which dyld needs.
+	bld := NewBuilder(CpuAmd64, 3, MhExecute, binary.LittleEndian)
+	bld.Addr = 0x100000000
+	bld.AddSegment("__PAGEZERO", 0)
+	text := bld.AddSection("__TEXT", "__text", bytes.Repeat([]byte{0xc3}, 16), 4, SAttrPureInstructions)
+	bld.AddSegment("__LINKEDIT", 1)
+	for _, s := range []Symbol{
+		{Name: "/tmp/", Type: uint8(NSo)},
+		{Name: "/tmp/main.o", Type: uint8(NOso)},
+		{Name: "_helper", Type: uint8(NFun), Sect: text, Value: 0x100001000},
+		{Name: "", Type: uint8(NFun), Value: 8},
+		{Name: "", Type: uint8(NSo)},
+		{Name: "_helper", Type: NSect, Sect: text, Value: 0x100001000},
+		{Name: "_main", Type: NSect | NExt, Sect: text, Value: 0x100001008},
+	} {
+		bld.AddSymbol(s)
+	}
+	toc, err := bld.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err = toc.Bytes(); err != nil {
+		t.Fatal(err)
+	}
+	g, n, _ = strip(b, StripDebug)
+	if want := []string{"_helper", "_main"}; n != 5 || !reflect.DeepEqual(names(g), want) {
+		t.Errorf("StripDebug removed %d, leaving %q; want 5, leaving %q", n, names(g), want)
+	}
+	g, n, _ = strip(b, StripTables)
+	if n != 7 || g.Symtab != nil || len(g.Loads) != len(toc.Loads)-1 {
+		t.Errorf("StripTables removed %d symbols, leaving %v and %d loads", n, g.Symtab, len(g.Loads))
+	}
+}
+
+func TestStripDWARF(t *testing.T) {
+	bld := NewBuilder(CpuAmd64, 3, MhExecute, binary.LittleEndian)
+	bld.Addr = 0x100000000
+	bld.AddSegment("__PAGEZERO", 0)
+	text := bld.AddSection("__TEXT", "__text", bytes.Repeat([]byte{0xc3}, 16), 4, SAttrPureInstructions)
+	bld.AddSection("__TEXT", "__debug_str", []byte("main\x00"), 0, SAttrDebug)
+	data := bld.AddSection("__DATA", "__data", []byte("datadata"), 3, 0)
+	bld.AddSection("__DWARF", "__debug_info", bytes.Repeat([]byte{1}, 0x8000), 0, SAttrDebug)
+	bld.AddSection("__DWARF", "__debug_abbrev", []byte{2, 2, 2}, 0, SAttrDebug)
+	bld.AddSegment("__LINKEDIT", 1)
+	bld.AddSymbol(Symbol{Name: "_main", Type: NSect | NExt, Sect: text, Value: 0x100001000})
+	bld.AddSymbol(Symbol{Name: "_d", Type: NSect | NExt, Sect: data})
+	toc, err := bld.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := toc.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkedit := *f.Segment("__LINKEDIT")
+	out, n, err := f.StripDWARF(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewFile(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Validate(); err != nil {
+		t.Error(err)
+	}
+	if n != 3 || g.Segment("__DWARF") != nil || g.Section("__debug_str") != nil || len(g.Sections) != 2 || g.Ncmd != toc.Ncmd-1 {
+		t.Errorf("StripDWARF removed %d sections, leaving %d, in %d loads", n, len(g.Sections), g.Ncmd)
+	}
+	// __LINKEDIT moves back over __DWARF by whole 16K pages.
+	if l := g.Segment("__LINKEDIT"); l.Offset != linkedit.Offset-0x8000 || l.Addr != linkedit.Addr || uint64(len(out)) != l.Offset+l.Filesz {
+		t.Errorf("__LINKEDIT at %#x, addr %#x, in a %#x-byte file; was at %#x", l.Offset, l.Addr, len(out), linkedit.Offset)
+	}
+	if d, err := g.Section("__data").Data(); err != nil || string(d) != "datadata" {
+		t.Errorf("__data holds %q, %v", d, err)
+	}
+	want := []Symbol{
+		{Name: "_main", Type: NSect | NExt, Sect: 1, Value: 0x100001000},
+		{Name: "_d", Type: NSect | NExt, Sect: 2},
+	}
+	if !reflect.DeepEqual(g.Symtab.Syms, want) {
+		t.Errorf("symbols %+v, want %+v", g.Symtab.Syms, want)
+	}
+
+	f, err = Open("testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, _, err := f.StripDWARF(nil); err == nil {
+		t.Errorf("StripDWARF of a file without DWARF succeeded")
+	}
+}
+
+func TestTwolevelHintsValidate(t *testing.T) {
+	st := &Symtab{SymtabCmd: SymtabCmd{LoadCmd: LcSymtab, Len: 24}, Syms: []Symbol{
+		{Name: "_a", Type: NSect, Sect: 1},
+		{Name: "_b", Type: NSect | NExt, Sect: 1},
+		{Name: "_x", Type: NUndf | NExt, Desc: 1 << 8},
+		{Name: "_y", Type: NUndf | NExt, Desc: 1 << 8},
+	}}
+	dt := &Dysymtab{DysymtabCmd: DysymtabCmd{LoadCmd: LcDysymtab, Len: 80,
+		Nlocalsym: 1, Iextdefsym: 1, Nextdefsym: 1, Iundefsym: 2, Nundefsym: 2}}
+	hints := &TwolevelHints{TwolevelHintsCmd{LoadCmd: LcTwolevelHints, Len: 16, Offset: 0x1000, Nhints: 2},
+		[]TwolevelHint{{1, 5}, {2, 7}}}
+	toc := &FileTOC{FileHeader: FileHeader{Magic: Magic64, Cpu: CpuAmd64, Type: MhExecute}, ByteOrder: binary.LittleEndian}
+	for _, l := range []Load{st, dt, hints} {
+		toc.AddLoad(l)
+	}
+	if err := toc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if r := toc.loadRanges(hints); !reflect.DeepEqual(r, []fileRange{{0x1000, 8}}) {
+		t.Errorf("the hints lie at %v", r)
+	}
+
+	// Removing an undefined symbol removes its hint.
+	if n, err := toc.RemoveSymbols(func(s Symbol) bool { return s.Name == "_x" }); n != 1 || err != nil {
+		t.Fatalf("RemoveSymbols(_x) = %d, %v", n, err)
+	}
+	if want := []TwolevelHint{{2, 7}}; hints.Nhints != 1 || !reflect.DeepEqual(hints.Hints, want) {
+		t.Errorf("after removing _x, %d hints %v, want %v", hints.Nhints, hints.Hints, want)
+	}
+	if err := toc.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	for _, c := range []struct {
+		hints  []TwolevelHint
+		nhints uint32
+		error  string
+	}{
+		{[]TwolevelHint{{2, 7}, {3, 9}}, 2, "2 hints, but LoadCmdDysymtab has 1 undefined symbols"},
+		{[]TwolevelHint{{2, 7}}, 2, "Nhints is 2, but there are 1 hints"},
+		{[]TwolevelHint{{2, 1 << 24}}, 1, "does not fit in 24 bits"},
+	} {
+		hints.Hints, hints.Nhints = c.hints, c.nhints
+		if err := toc.Validate(); err == nil || !strings.Contains(err.Error(), c.error) {
+			t.Errorf("Validate() with hints %v, Nhints %d = %v, want error containing %q", c.hints, c.nhints, err, c.error)
+		}
+	}
+	// Stale hints are not edited further.
+	hints.Hints, hints.Nhints = []TwolevelHint{{2, 7}, {3, 9}}, 2
+	if _, err := toc.RemoveSymbols(func(s Symbol) bool { return s.Name == "_a" }); err == nil {
+		t.Errorf("RemoveSymbols with stale hints succeeded")
+	}
+	if len(st.Syms) != 3 {
+		t.Errorf("a failed RemoveSymbols left %d symbols", len(st.Syms))
+	}
+}
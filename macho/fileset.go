@@ -0,0 +1,88 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+)
+
+// A FilesetEntry represents an LC_FILESET_ENTRY command of an MhFileset
+// file, such as a kernel collection: one of the Mach-O files combined
+// in it, whose header is at FileOff.  The entry's own file offsets, of
+// its segments, sections, and symbols, are offsets in the whole file.
+type FilesetEntry struct {
+	FilesetEntryCmd
+	EntryID string // such as "com.apple.kernel"
+}
+
+func (s *FilesetEntry) String() string {
+	return fmt.Sprintf("FilesetEntry %s, addr=%#x, fileoff=%#x", s.EntryID, s.Addr, s.FileOff)
+}
+func (s *FilesetEntry) Copy() *FilesetEntry {
+	r := *s
+	return &r
+}
+
+// LoadSize returns the size of the command, its ID and NUL, rounded up,
+// or Len, if the command is that long, to keep the padding a file has.
+func (s *FilesetEntry) LoadSize(t *FileTOC) uint32 {
+	n := uint32(RoundUp(uint64(unsafe.Sizeof(FilesetEntryCmd{}))+uint64(len(s.EntryID))+1, t.LoadAlign()))
+	if s.Len > n {
+		return s.Len
+	}
+	return n
+}
+func (s *FilesetEntry) Put(b []byte, o binary.ByteOrder) int {
+	o.PutUint32(b[0*4:], uint32(s.LoadCmd))
+	o.PutUint32(b[1*4:], s.Len)
+	o.PutUint64(b[2*4:], s.Addr)
+	o.PutUint64(b[4*4:], s.FileOff)
+	o.PutUint32(b[6*4:], s.FilesetEntryCmd.EntryID)
+	o.PutUint32(b[7*4:], s.Reserved)
+	n := 8 * 4
+	n += copy(b[n:], s.EntryID)
+	for ; n < int(s.Len); n++ {
+		b[n] = 0
+	}
+	return n
+}
+
+// FilesetEntries returns the LC_FILESET_ENTRY commands of f, in order.
+func (f *File) FilesetEntries() []*FilesetEntry {
+	var entries []*FilesetEntry
+	for _, l := range f.Loads {
+		if e, ok := l.(*FilesetEntry); ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// FilesetEntry returns the entry of f with ID id, or nil if there is
+// none.
+func (f *File) FilesetEntry(id string) *FilesetEntry {
+	for _, e := range f.FilesetEntries() {
+		if e.EntryID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// OpenFilesetEntry returns the Mach-O file that e, an entry of f,
+// holds, read from the same reader as f.  Closing it has no effect;
+// the entry is readable as long as f is open.
+func (f *File) OpenFilesetEntry(e *FilesetEntry) (*File, error) {
+	if e.FileOff > 1<<63-1 {
+		return nil, fmt.Errorf("fileset entry %s: offset %#x is out of range", e.EntryID, e.FileOff)
+	}
+	ef, err := newFileAt(f.r, int64(e.FileOff))
+	if err != nil {
+		return nil, fmt.Errorf("fileset entry %s: %v", e.EntryID, err)
+	}
+	return ef, nil
+}
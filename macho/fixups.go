@@ -0,0 +1,363 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"fmt"
+)
+
+// A ChainedPtrFormat is the encoding of the pointers in one segment's
+// fixup chains (DYLD_CHAINED_PTR_*).
+type ChainedPtrFormat uint16
+
+const (
+	ChainedPtrArm64e           ChainedPtrFormat = 1
+	ChainedPtr64               ChainedPtrFormat = 2
+	ChainedPtr32               ChainedPtrFormat = 3
+	ChainedPtr32Cache          ChainedPtrFormat = 4
+	ChainedPtr32Firmware       ChainedPtrFormat = 5
+	ChainedPtr64Offset         ChainedPtrFormat = 6
+	ChainedPtrArm64eKernel     ChainedPtrFormat = 7
+	ChainedPtr64KernelCache    ChainedPtrFormat = 8
+	ChainedPtrArm64eUserland   ChainedPtrFormat = 9
+	ChainedPtrArm64eFirmware   ChainedPtrFormat = 10
+	ChainedPtrX8664KernelCache ChainedPtrFormat = 11
+	ChainedPtrArm64eUserland24 ChainedPtrFormat = 12
+)
+
+var chainedPtrStrings = []intName{
+	{uint32(ChainedPtrArm64e), "ChainedPtrArm64e"},
+	{uint32(ChainedPtr64), "ChainedPtr64"},
+	{uint32(ChainedPtr32), "ChainedPtr32"},
+	{uint32(ChainedPtr32Cache), "ChainedPtr32Cache"},
+	{uint32(ChainedPtr32Firmware), "ChainedPtr32Firmware"},
+	{uint32(ChainedPtr64Offset), "ChainedPtr64Offset"},
+	{uint32(ChainedPtrArm64eKernel), "ChainedPtrArm64eKernel"},
+	{uint32(ChainedPtr64KernelCache), "ChainedPtr64KernelCache"},
+	{uint32(ChainedPtrArm64eUserland), "ChainedPtrArm64eUserland"},
+	{uint32(ChainedPtrArm64eFirmware), "ChainedPtrArm64eFirmware"},
+	{uint32(ChainedPtrX8664KernelCache), "ChainedPtrX8664KernelCache"},
+	{uint32(ChainedPtrArm64eUserland24), "ChainedPtrArm64eUserland24"},
+}
+
+func (i ChainedPtrFormat) String() string   { return stringName(uint32(i), chainedPtrStrings, false) }
+func (i ChainedPtrFormat) GoString() string { return stringName(uint32(i), chainedPtrStrings, true) }
+
+// Formats of the imports table (DYLD_CHAINED_IMPORT*).
+const (
+	chainedImport         = 1
+	chainedImportAddend   = 2
+	chainedImportAddend64 = 3
+)
+
+// Special values of page starts (DYLD_CHAINED_PTR_START_*).
+const (
+	chainedStartNone  = 0xffff
+	chainedStartMulti = 0x8000 // the index of a list of starts, for 32-bit formats
+	chainedStartLast  = 0x8000 // ends such a list
+)
+
+// ChainedFixups is the decoded payload of LC_DYLD_CHAINED_FIXUPS.
+type ChainedFixups struct {
+	Version  uint32
+	Imports  []ChainedImport
+	Segments []*ChainedStarts // indexed like the segments; nil for those without fixups
+}
+
+// A ChainedImport is a symbol that binds refer to.
+type ChainedImport struct {
+	Name       string
+	LibOrdinal int // 1 and up for a dylib; 0 for this image, -1 the main executable, -2 flat lookup, -3 weak lookup
+	Weak       bool
+	Addend     int64
+}
+
+// ChainedStarts says where the fixup chains of one segment begin.
+type ChainedStarts struct {
+	PageSize        uint16
+	PointerFormat   ChainedPtrFormat
+	SegmentOffset   uint64     // from the start of the image, in memory
+	MaxValidPointer uint32     // for 32-bit formats, values above this are not pointers
+	PageStarts      [][]uint16 // for each page, the offsets of its chains; none if it has no fixups
+}
+
+// A Fixup is one pointer that dyld rebases or binds.
+type Fixup struct {
+	Addr   uint64         // where the pointer is
+	Import *ChainedImport // for a bind, what it binds to; nil for a rebase
+	Target uint64         // for a rebase, the address it points to
+	Addend int64          // for a bind, added to the import's address, as is the import's own Addend
+	High8  uint8          // for a rebase, the pointer's top byte
+
+	// For arm64e authenticated pointers, how they are signed.
+	Auth      bool
+	Key       uint8
+	Diversity uint16
+	AddrDiv   bool
+}
+
+// ChainedFixups decodes the LC_DYLD_CHAINED_FIXUPS payload of f; it
+// returns nil if f has none.
+func (f *File) ChainedFixups() (*ChainedFixups, error) {
+	var le *LinkEditData
+	for _, l := range f.Loads {
+		if l, ok := l.(*LinkEditData); ok && l.Command() == LcDyldChainedFixups {
+			le = l
+		}
+	}
+	if le == nil {
+		return nil, nil
+	}
+	b := make([]byte, le.DataLen)
+	if _, err := f.r.ReadAt(b, int64(le.DataOff)); err != nil {
+		return nil, fmt.Errorf("reading LC_DYLD_CHAINED_FIXUPS: %v", err)
+	}
+	bad := func(format string, args ...interface{}) (*ChainedFixups, error) {
+		return nil, fmt.Errorf("malformed LC_DYLD_CHAINED_FIXUPS: "+format, args...)
+	}
+	o := f.ByteOrder
+	u32 := func(off uint64) (uint32, bool) {
+		if off+4 > uint64(len(b)) {
+			return 0, false
+		}
+		return o.Uint32(b[off:]), true
+	}
+	if len(b) < 28 {
+		return bad("short header")
+	}
+	c := &ChainedFixups{Version: o.Uint32(b[0:])}
+	startsOff, importsOff, symbolsOff := uint64(o.Uint32(b[4:])), uint64(o.Uint32(b[8:])), uint64(o.Uint32(b[12:]))
+	nimports, importsFormat, symbolsFormat := o.Uint32(b[16:]), o.Uint32(b[20:]), o.Uint32(b[24:])
+	if c.Version != 0 {
+		return bad("version %d", c.Version)
+	}
+	if symbolsFormat != 0 {
+		return nil, fmt.Errorf("LC_DYLD_CHAINED_FIXUPS: unsupported (compressed) symbols format %d", symbolsFormat)
+	}
+
+	name := func(off uint64) (string, bool) {
+		off += symbolsOff
+		for i := off; i < uint64(len(b)); i++ {
+			if b[i] == 0 {
+				return string(b[off:i]), true
+			}
+		}
+		return "", false
+	}
+	size := map[uint32]uint64{chainedImport: 4, chainedImportAddend: 8, chainedImportAddend64: 16}[importsFormat]
+	if size == 0 {
+		return bad("imports format %d", importsFormat)
+	}
+	if importsOff+uint64(nimports)*size > uint64(len(b)) {
+		return bad("imports extend past the end")
+	}
+	c.Imports = make([]ChainedImport, nimports)
+	for i := range c.Imports {
+		p, imp := b[importsOff+uint64(i)*size:], &c.Imports[i]
+		var nameOff uint64
+		if importsFormat == chainedImportAddend64 {
+			v := o.Uint64(p)
+			imp.LibOrdinal = libOrdinal(v&0xffff, 16)
+			imp.Weak = v>>16&1 != 0
+			nameOff = v >> 32
+			imp.Addend = int64(o.Uint64(p[8:]))
+		} else {
+			v := o.Uint32(p)
+			imp.LibOrdinal = libOrdinal(uint64(v&0xff), 8)
+			imp.Weak = v>>8&1 != 0
+			nameOff = uint64(v >> 9)
+			if importsFormat == chainedImportAddend {
+				imp.Addend = int64(int32(o.Uint32(p[4:])))
+			}
+		}
+		var ok bool
+		if imp.Name, ok = name(nameOff); !ok {
+			return bad("import %d has no name", i)
+		}
+	}
+
+	nsegs, ok := u32(startsOff)
+	if !ok {
+		return bad("no segment starts")
+	}
+	c.Segments = make([]*ChainedStarts, nsegs)
+	for i := range c.Segments {
+		segOff, ok := u32(startsOff + 4 + 4*uint64(i))
+		if !ok {
+			return bad("short segment starts")
+		}
+		if segOff == 0 {
+			continue
+		}
+		at := startsOff + uint64(segOff)
+		if at+22 > uint64(len(b)) {
+			return bad("segment %d starts extend past the end", i)
+		}
+		s := &ChainedStarts{
+			PageSize:        o.Uint16(b[at+4:]),
+			PointerFormat:   ChainedPtrFormat(o.Uint16(b[at+6:])),
+			SegmentOffset:   o.Uint64(b[at+8:]),
+			MaxValidPointer: o.Uint32(b[at+16:]),
+		}
+		npages := uint64(o.Uint16(b[at+20:]))
+		starts := at + 22
+		if starts+2*npages > uint64(len(b)) {
+			return bad("segment %d page starts extend past the end", i)
+		}
+		start := func(j uint64) uint16 { return o.Uint16(b[starts+2*j:]) }
+		s.PageStarts = make([][]uint16, npages)
+		for j := range s.PageStarts {
+			switch p := start(uint64(j)); {
+			case p == chainedStartNone:
+			case p&chainedStartMulti != 0:
+				for k := uint64(p &^ chainedStartMulti); ; k++ {
+					if starts+2*k+2 > uint64(len(b)) {
+						return bad("segment %d page %d starts extend past the end", i, j)
+					}
+					q := start(k)
+					s.PageStarts[j] = append(s.PageStarts[j], q&^chainedStartLast)
+					if q&chainedStartLast != 0 {
+						break
+					}
+				}
+			default:
+				s.PageStarts[j] = []uint16{p}
+			}
+		}
+		c.Segments[i] = s
+	}
+	return c, nil
+}
+
+// libOrdinal sign-extends the special library ordinals, which count
+// down from the largest value of a field of the given width.
+func libOrdinal(v uint64, bits uint) int {
+	if v > 1<<bits-16 {
+		return int(v) - 1<<bits
+	}
+	return int(v)
+}
+
+// Fixups walks the chains of f's LC_DYLD_CHAINED_FIXUPS and returns
+// each rebase and bind, in order of segment, page, and chain.  Rebase
+// targets that the pointer format gives as offsets from the image are
+// returned as addresses.
+func (f *File) Fixups() ([]Fixup, error) {
+	c, err := f.ChainedFixups()
+	if c == nil || err != nil {
+		return nil, err
+	}
+	segs := f.segments()
+	base := f.imageBase()
+	if len(c.Segments) > len(segs) {
+		return nil, fmt.Errorf("LC_DYLD_CHAINED_FIXUPS: starts for %d segments, but there are %d", len(c.Segments), len(segs))
+	}
+	var fixups []Fixup
+	for i, s := range c.Segments {
+		if s == nil {
+			continue
+		}
+		seg := segs[i]
+		stride, size := uint64(4), uint64(8)
+		switch s.PointerFormat {
+		case ChainedPtrArm64e, ChainedPtrArm64eUserland, ChainedPtrArm64eUserland24:
+			stride = 8
+		case ChainedPtr64, ChainedPtr64Offset:
+		case ChainedPtr32:
+			size = 4
+		default:
+			return nil, fmt.Errorf("LC_DYLD_CHAINED_FIXUPS: unsupported pointer format %v in %s", s.PointerFormat, seg.Name)
+		}
+		b := make([]byte, size)
+		for page, starts := range s.PageStarts {
+			for _, start := range starts {
+				for off := uint64(page)*uint64(s.PageSize) + uint64(start); ; {
+					if _, err := seg.ReadAt(b, int64(off)); err != nil {
+						return nil, fmt.Errorf("LC_DYLD_CHAINED_FIXUPS: reading %s+%#x: %v", seg.Name, off, err)
+					}
+					var v uint64
+					if size == 4 {
+						v = uint64(f.ByteOrder.Uint32(b))
+					} else {
+						v = f.ByteOrder.Uint64(b)
+					}
+					fx, ordinal, next := decodeChainedPtr(s, v, base)
+					fx.Addr = seg.Addr + off
+					if ordinal >= 0 {
+						if ordinal >= len(c.Imports) {
+							return nil, fmt.Errorf("LC_DYLD_CHAINED_FIXUPS: bind at %s+%#x to import %d of %d", seg.Name, off, ordinal, len(c.Imports))
+						}
+						fx.Import = &c.Imports[ordinal]
+					}
+					fixups = append(fixups, fx)
+					if next == 0 {
+						break
+					}
+					off += next * stride
+				}
+			}
+		}
+	}
+	return fixups, nil
+}
+
+// decodeChainedPtr decodes v, a pointer in the chains of s.  For a bind
+// it returns the index of the import, or else -1; next is the distance,
+// in strides, to the next pointer in the chain, 0 at the end.
+func decodeChainedPtr(s *ChainedStarts, v, base uint64) (fx Fixup, ordinal int, next uint64) {
+	bits := func(lo, n uint) uint64 { return v >> lo & (1<<n - 1) }
+	signed := func(lo, n uint) int64 { return int64(bits(lo, n)<<(64-n)) >> (64 - n) }
+	ordinal = -1
+	switch s.PointerFormat {
+	case ChainedPtr64, ChainedPtr64Offset:
+		next = bits(51, 12)
+		if bits(63, 1) != 0 {
+			ordinal, fx.Addend = int(bits(0, 24)), int64(bits(24, 8))
+			break
+		}
+		fx.Target, fx.High8 = bits(0, 36), uint8(bits(36, 8))
+		if s.PointerFormat == ChainedPtr64Offset {
+			fx.Target += base
+		}
+
+	case ChainedPtr32:
+		next = bits(26, 5)
+		if bits(31, 1) != 0 {
+			ordinal, fx.Addend = int(bits(0, 20)), int64(bits(20, 6))
+			break
+		}
+		fx.Target = bits(0, 26)
+		if fx.Target > uint64(s.MaxValidPointer) {
+			// Not a pointer, but a small value stored with a bias.
+			fx.Target -= (uint64(s.MaxValidPointer) + 0x4000000) / 2
+		}
+
+	default: // the arm64e formats
+		next = bits(51, 11)
+		fx.Auth = bits(63, 1) != 0
+		if fx.Auth {
+			fx.Diversity, fx.AddrDiv, fx.Key = uint16(bits(32, 16)), bits(48, 1) != 0, uint8(bits(49, 2))
+		}
+		ordinalBits := uint(16)
+		if s.PointerFormat == ChainedPtrArm64eUserland24 {
+			ordinalBits = 24
+		}
+		switch {
+		case bits(62, 1) != 0:
+			ordinal = int(bits(0, ordinalBits))
+			if !fx.Auth {
+				fx.Addend = signed(32, 19)
+			}
+		case fx.Auth:
+			fx.Target = bits(0, 32) + base
+		default:
+			fx.Target, fx.High8 = bits(0, 43), uint8(bits(43, 8))
+			if s.PointerFormat != ChainedPtrArm64e {
+				fx.Target += base
+			}
+		}
+	}
+	return fx, ordinal, next
+}
@@ -0,0 +1,224 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The flags of a segment (SG_*), from <mach-o/loader.h>.
+const ( // SNAKE_CASE to CamelCase translation from C names
+	SgHighvm            SegFlags = 0x1  // the segment is at the high end of the VM space
+	SgFvmlib            SegFlags = 0x2  // the segment is a fixed VM library's
+	SgNoreloc           SegFlags = 0x4  // nothing in the segment is relocated, or refers elsewhere
+	SgProtectedVersion1 SegFlags = 0x8  // the segment is encrypted, but for its first page
+	SgReadOnly          SegFlags = 0x10 // the segment is made read-only after fixups
+)
+
+// A section's flags are its type, in the low byte, and its attributes.
+const (
+	SectionType       SecFlags = 0x000000ff
+	SectionAttributes SecFlags = 0xffffff00
+)
+
+// The section types (S_*).
+const ( // SNAKE_CASE to CamelCase translation from C names
+	SRegular                         SecFlags = 0x0
+	SZerofill                        SecFlags = 0x1 // occupies no space in the file
+	SCstringLiterals                 SecFlags = 0x2
+	S4ByteLiterals                   SecFlags = 0x3
+	S8ByteLiterals                   SecFlags = 0x4
+	SLiteralPointers                 SecFlags = 0x5
+	SNonLazySymbolPointers           SecFlags = 0x6
+	SLazySymbolPointers              SecFlags = 0x7
+	SSymbolStubs                     SecFlags = 0x8
+	SModInitFuncPointers             SecFlags = 0x9
+	SModTermFuncPointers             SecFlags = 0xa
+	SCoalesced                       SecFlags = 0xb
+	SGbZerofill                      SecFlags = 0xc // zero-filled, and may be larger than 4GB
+	SInterposing                     SecFlags = 0xd
+	S16ByteLiterals                  SecFlags = 0xe
+	SDtraceDof                       SecFlags = 0xf
+	SLazyDylibSymbolPointers         SecFlags = 0x10
+	SThreadLocalRegular              SecFlags = 0x11
+	SThreadLocalZerofill             SecFlags = 0x12
+	SThreadLocalVariables            SecFlags = 0x13
+	SThreadLocalVariablePointers     SecFlags = 0x14
+	SThreadLocalInitFunctionPointers SecFlags = 0x15
+	SInitFuncOffsets                 SecFlags = 0x16
+)
+
+// The section attributes (S_ATTR_*).
+const ( // SNAKE_CASE to CamelCase translation from C names
+	SAttrPureInstructions  SecFlags = 0x80000000 // section contains only machine instructions
+	SAttrNoToc             SecFlags = 0x40000000 // coalesced symbols not to go in a ranlib table of contents
+	SAttrStripStaticSyms   SecFlags = 0x20000000 // static symbols may be stripped with MhDyldLink
+	SAttrNoDeadStrip       SecFlags = 0x10000000 // never dead-stripped
+	SAttrLiveSupport       SecFlags = 0x08000000 // live if anything it refers to is
+	SAttrSelfModifyingCode SecFlags = 0x04000000 // stubs that dyld rewrites
+	SAttrDebug             SecFlags = 0x02000000 // a debugging section
+	SAttrSomeInstructions  SecFlags = 0x400      // section contains some machine instructions
+	SAttrExtReloc          SecFlags = 0x200      // section has external relocations
+	SAttrLocReloc          SecFlags = 0x100      // section has local relocations
+)
+
+var hdrFlagStrings = []intName{
+	{uint32(FlagNoUndefs), "FlagNoUndefs"},
+	{uint32(FlagIncrLink), "FlagIncrLink"},
+	{uint32(FlagDyldLink), "FlagDyldLink"},
+	{uint32(FlagBindAtLoad), "FlagBindAtLoad"},
+	{uint32(FlagPrebound), "FlagPrebound"},
+	{uint32(FlagSplitSegs), "FlagSplitSegs"},
+	{uint32(FlagLazyInit), "FlagLazyInit"},
+	{uint32(FlagTwoLevel), "FlagTwoLevel"},
+	{uint32(FlagForceFlat), "FlagForceFlat"},
+	{uint32(FlagNoMultiDefs), "FlagNoMultiDefs"},
+	{uint32(FlagNoFixPrebinding), "FlagNoFixPrebinding"},
+	{uint32(FlagPrebindable), "FlagPrebindable"},
+	{uint32(FlagAllModsBound), "FlagAllModsBound"},
+	{uint32(FlagSubsectionsViaSymbols), "FlagSubsectionsViaSymbols"},
+	{uint32(FlagCanonical), "FlagCanonical"},
+	{uint32(FlagWeakDefines), "FlagWeakDefines"},
+	{uint32(FlagBindsToWeak), "FlagBindsToWeak"},
+	{uint32(FlagAllowStackExecution), "FlagAllowStackExecution"},
+	{uint32(FlagRootSafe), "FlagRootSafe"},
+	{uint32(FlagSetuidSafe), "FlagSetuidSafe"},
+	{uint32(FlagNoReexportedDylibs), "FlagNoReexportedDylibs"},
+	{uint32(FlagPIE), "FlagPIE"},
+	{uint32(FlagDeadStrippableDylib), "FlagDeadStrippableDylib"},
+	{uint32(FlagHasTLVDescriptors), "FlagHasTLVDescriptors"},
+	{uint32(FlagNoHeapExecution), "FlagNoHeapExecution"},
+	{uint32(FlagAppExtensionSafe), "FlagAppExtensionSafe"},
+}
+
+var segFlagStrings = []intName{
+	{uint32(SgHighvm), "SgHighvm"},
+	{uint32(SgFvmlib), "SgFvmlib"},
+	{uint32(SgNoreloc), "SgNoreloc"},
+	{uint32(SgProtectedVersion1), "SgProtectedVersion1"},
+	{uint32(SgReadOnly), "SgReadOnly"},
+}
+
+var sectionTypeStrings = []intName{
+	{uint32(SRegular), "SRegular"},
+	{uint32(SZerofill), "SZerofill"},
+	{uint32(SCstringLiterals), "SCstringLiterals"},
+	{uint32(S4ByteLiterals), "S4ByteLiterals"},
+	{uint32(S8ByteLiterals), "S8ByteLiterals"},
+	{uint32(SLiteralPointers), "SLiteralPointers"},
+	{uint32(SNonLazySymbolPointers), "SNonLazySymbolPointers"},
+	{uint32(SLazySymbolPointers), "SLazySymbolPointers"},
+	{uint32(SSymbolStubs), "SSymbolStubs"},
+	{uint32(SModInitFuncPointers), "SModInitFuncPointers"},
+	{uint32(SModTermFuncPointers), "SModTermFuncPointers"},
+	{uint32(SCoalesced), "SCoalesced"},
+	{uint32(SGbZerofill), "SGbZerofill"},
+	{uint32(SInterposing), "SInterposing"},
+	{uint32(S16ByteLiterals), "S16ByteLiterals"},
+	{uint32(SDtraceDof), "SDtraceDof"},
+	{uint32(SLazyDylibSymbolPointers), "SLazyDylibSymbolPointers"},
+	{uint32(SThreadLocalRegular), "SThreadLocalRegular"},
+	{uint32(SThreadLocalZerofill), "SThreadLocalZerofill"},
+	{uint32(SThreadLocalVariables), "SThreadLocalVariables"},
+	{uint32(SThreadLocalVariablePointers), "SThreadLocalVariablePointers"},
+	{uint32(SThreadLocalInitFunctionPointers), "SThreadLocalInitFunctionPointers"},
+	{uint32(SInitFuncOffsets), "SInitFuncOffsets"},
+}
+
+var sectionAttrStrings = []intName{
+	{uint32(SAttrPureInstructions), "SAttrPureInstructions"},
+	{uint32(SAttrNoToc), "SAttrNoToc"},
+	{uint32(SAttrStripStaticSyms), "SAttrStripStaticSyms"},
+	{uint32(SAttrNoDeadStrip), "SAttrNoDeadStrip"},
+	{uint32(SAttrLiveSupport), "SAttrLiveSupport"},
+	{uint32(SAttrSelfModifyingCode), "SAttrSelfModifyingCode"},
+	{uint32(SAttrDebug), "SAttrDebug"},
+	{uint32(SAttrSomeInstructions), "SAttrSomeInstructions"},
+	{uint32(SAttrExtReloc), "SAttrExtReloc"},
+	{uint32(SAttrLocReloc), "SAttrLocReloc"},
+}
+
+// stringFlags returns the names of the flags set in i, joined by "|",
+// followed by any bits that names does not cover, in hex.  For no
+// flags, it returns "0x0".
+func stringFlags(i uint32, names []intName, goSyntax bool) string {
+	var s []string
+	for _, n := range names {
+		if i&n.i == n.i && n.i != 0 {
+			i &^= n.i
+			if goSyntax {
+				s = append(s, "macho."+n.s)
+			} else {
+				s = append(s, n.s)
+			}
+		}
+	}
+	if i != 0 || len(s) == 0 {
+		s = append(s, "0x"+strconv.FormatUint(uint64(i), 16))
+	}
+	return strings.Join(s, "|")
+}
+
+func (i HdrFlags) String() string   { return stringFlags(uint32(i), hdrFlagStrings, false) }
+func (i HdrFlags) GoString() string { return stringFlags(uint32(i), hdrFlagStrings, true) }
+func (i SegFlags) String() string   { return stringFlags(uint32(i), segFlagStrings, false) }
+func (i SegFlags) GoString() string { return stringFlags(uint32(i), segFlagStrings, true) }
+
+// Type returns the section type of f, one of SRegular through
+// SInitFuncOffsets.
+func (f SecFlags) Type() SecFlags { return f & SectionType }
+
+// Attributes returns the section attributes of f.
+func (f SecFlags) Attributes() SecFlags { return f & SectionAttributes }
+
+// IsZerofill reports whether a section of type f occupies no space in
+// the file.
+func (f SecFlags) IsZerofill() bool {
+	switch f.Type() {
+	case SZerofill, SGbZerofill, SThreadLocalZerofill:
+		return true
+	}
+	return false
+}
+
+// HasInstructions reports whether a section with flags f holds machine
+// instructions, whether only them or some among data.
+func (f SecFlags) HasInstructions() bool {
+	return f&(SAttrPureInstructions|SAttrSomeInstructions) != 0
+}
+
+// IsDebug reports whether a section with flags f holds debugging
+// information, which the linker does not lay out.
+func (f SecFlags) IsDebug() bool { return f&SAttrDebug != 0 }
+
+// IsSymbolStubs reports whether a section of type f holds stubs, each
+// of a section's Reserved2 bytes.
+func (f SecFlags) IsSymbolStubs() bool { return f.Type() == SSymbolStubs }
+
+// HasIndirectSymbols reports whether a section of type f holds stubs or
+// pointers that are bound to the symbols of the indirect symbol table,
+// from a section's Reserved1 on, one for each entry.
+func (f SecFlags) HasIndirectSymbols() bool {
+	switch f.Type() {
+	case SNonLazySymbolPointers, SLazySymbolPointers, SLazyDylibSymbolPointers,
+		SThreadLocalVariablePointers, SSymbolStubs:
+		return true
+	}
+	return false
+}
+
+// String returns the section type of f, then the attributes set.
+func (f SecFlags) String() string { return f.string(false) }
+
+func (f SecFlags) GoString() string { return f.string(true) }
+
+func (f SecFlags) string(goSyntax bool) string {
+	s := stringName(uint32(f.Type()), sectionTypeStrings, goSyntax)
+	if a := f.Attributes(); a != 0 {
+		s += "|" + stringFlags(uint32(a), sectionAttrStrings, goSyntax)
+	}
+	return s
+}
@@ -0,0 +1,260 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"debug/gosym"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A Function is the extent of one function, as best it can be determined.
+type Function struct {
+	Name    string // "" if no source names it
+	Start   uint64
+	End     uint64         // first address past the function
+	Sources FunctionSource // which sources reported the function
+}
+
+// A FunctionSource is a set of places a Function was found.
+type FunctionSource uint8
+
+const (
+	FromSymtab         FunctionSource = 1 << iota // defined symbol in an instruction section
+	FromFunctionStarts                            // LC_FUNCTION_STARTS
+	FromDWARF                                     // DW_TAG_subprogram
+	FromPclntab                                   // Go's __gopclntab
+)
+
+var functionSourceNames = []string{"symtab", "function-starts", "dwarf", "pclntab"}
+
+func (s FunctionSource) String() string {
+	var names []string
+	for i, n := range functionSourceNames {
+		if s&(1<<uint(i)) != 0 {
+			names = append(names, n)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// FunctionBoundaries returns the functions of f, sorted by start address,
+// merging what the symbol table, LC_FUNCTION_STARTS, DWARF subprograms,
+// and a Go pclntab each report.  Functions are identified by start
+// address.  Names are taken from DWARF, then the pclntab, then the
+// symbol table; ends from DWARF or the pclntab.  Where no source gives
+// an end, the function is taken to run to the next function or the end
+// of its section.
+//
+// Sources that f lacks are skipped.  If a source is present but cannot
+// be read, FunctionBoundaries returns what the other sources found,
+// along with the first such error.
+func (f *File) FunctionBoundaries() ([]Function, error) {
+	byStart := make(map[uint64]*Function)
+	add := func(src FunctionSource, name string, start, end uint64) {
+		fn := byStart[start]
+		if fn == nil {
+			fn = &Function{Start: start}
+			byStart[start] = fn
+		}
+		// Sources are added in order of increasing preference.
+		if name != "" {
+			fn.Name = name
+		}
+		if end > start {
+			fn.End = end
+		}
+		fn.Sources |= src
+	}
+
+	var firstErr error
+	note := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	note(f.symtabFunctions(add))
+	note(f.functionStarts(add))
+	note(f.pclntabFunctions(add))
+	note(f.dwarfFunctions(add))
+
+	fns := make([]Function, 0, len(byStart))
+	for _, fn := range byStart {
+		fns = append(fns, *fn)
+	}
+	sort.Slice(fns, func(i, j int) bool { return fns[i].Start < fns[j].Start })
+	for i := range fns {
+		fn := &fns[i]
+		if fn.End != 0 {
+			continue
+		}
+		if s := f.sectionContaining(fn.Start); s != nil {
+			fn.End = s.Addr + s.Size
+		}
+		if i+1 < len(fns) && (fn.End == 0 || fns[i+1].Start < fn.End) {
+			fn.End = fns[i+1].Start
+		}
+	}
+	return fns, firstErr
+}
+
+func (f *File) sectionContaining(addr uint64) *Section {
+	for _, s := range f.Sections {
+		if s.Addr <= addr && addr-s.Addr < s.Size {
+			return s
+		}
+	}
+	return nil
+}
+
+func (f *File) symtabFunctions(add func(FunctionSource, string, uint64, uint64)) error {
+	if f.Symtab == nil {
+		return nil
+	}
+	for _, s := range f.Symtab.Syms {
+		if !s.IsDefinedInSection() || int(s.Sect) > len(f.Sections) {
+			continue
+		}
+		sect := f.Sections[s.Sect-1]
+		if !sect.Flags.HasInstructions() {
+			continue
+		}
+		if s.Value < sect.Addr || s.Value-sect.Addr >= sect.Size {
+			continue // e.g., __mh_execute_header
+		}
+		add(FromSymtab, s.Name, s.Value, 0)
+	}
+	return nil
+}
+
+func (f *File) functionStarts(add func(FunctionSource, string, uint64, uint64)) error {
+	starts, err := f.FunctionStarts()
+	for _, addr := range starts {
+		add(FromFunctionStarts, "", addr, 0)
+	}
+	return err
+}
+
+// FunctionStarts decodes f's LC_FUNCTION_STARTS, ULEB128 deltas, the
+// first from the start of __TEXT, ending with a zero, and returns the
+// address of each function it lists, in increasing order.  It returns
+// nil if f has none.
+func (f *File) FunctionStarts() ([]uint64, error) {
+	var starts []uint64
+	text, linkedit := f.Segment("__TEXT"), f.Segment("__LINKEDIT")
+	for _, l := range f.Loads {
+		le, ok := l.(*LinkEditData)
+		if !ok || le.Command() != LcFunctionStarts {
+			continue
+		}
+		if text == nil || linkedit == nil {
+			return nil, fmt.Errorf("LC_FUNCTION_STARTS without __TEXT and __LINKEDIT")
+		}
+		b := make([]byte, le.DataLen)
+		if _, err := linkedit.ReadAt(b, int64(le.DataOff)-int64(linkedit.Offset)); err != nil {
+			return nil, fmt.Errorf("reading LC_FUNCTION_STARTS: %v", err)
+		}
+		addr := text.Addr
+		for len(b) > 0 {
+			var delta uint64
+			var shift uint
+			for {
+				if len(b) == 0 || shift >= 64 {
+					return starts, fmt.Errorf("malformed LC_FUNCTION_STARTS")
+				}
+				c := b[0]
+				b = b[1:]
+				delta |= uint64(c&0x7f) << shift
+				shift += 7
+				if c < 0x80 {
+					break
+				}
+			}
+			if delta == 0 {
+				break
+			}
+			addr += delta
+			starts = append(starts, addr)
+		}
+	}
+	return starts, nil
+}
+
+// NamedFunctionStarts returns a Function for each address that
+// FunctionStarts does, named by the symbol table if it has a function
+// there, and taken to run to the next one or the end of its section.
+// It is cheaper than FunctionBoundaries, which also consults DWARF and
+// the pclntab, and so suits stripped binaries.
+func (f *File) NamedFunctionStarts() ([]Function, error) {
+	starts, err := f.FunctionStarts()
+	if starts == nil || err != nil {
+		return nil, err
+	}
+	names := make(map[uint64]string)
+	f.symtabFunctions(func(_ FunctionSource, name string, start, _ uint64) {
+		names[start] = name
+	})
+	fns := make([]Function, len(starts))
+	for i, start := range starts {
+		fn := Function{Start: start, Sources: FromFunctionStarts}
+		if name, ok := names[start]; ok {
+			fn.Name = name
+			fn.Sources |= FromSymtab
+		}
+		if s := f.sectionContaining(start); s != nil {
+			fn.End = s.Addr + s.Size
+		}
+		if i+1 < len(starts) && (fn.End == 0 || starts[i+1] < fn.End) {
+			fn.End = starts[i+1]
+		}
+		fns[i] = fn
+	}
+	return fns, nil
+}
+
+func (f *File) pclntabFunctions(add func(FunctionSource, string, uint64, uint64)) error {
+	pcln, text := f.Section("__gopclntab"), f.Section("__text")
+	if pcln == nil || text == nil || pcln.Offset == 0 {
+		return nil // absent, or only described (as in a dSYM)
+	}
+	data, err := pcln.Data()
+	if err != nil {
+		return err
+	}
+	tab, err := gosym.NewTable(nil, gosym.NewLineTable(data, text.Addr))
+	if err != nil {
+		return fmt.Errorf("reading __gopclntab: %v", err)
+	}
+	for _, fn := range tab.Funcs {
+		add(FromPclntab, fn.Name, fn.Entry, fn.End)
+	}
+	return nil
+}
+
+func (f *File) dwarfFunctions(add func(FunctionSource, string, uint64, uint64)) error {
+	if f.Segment("__DWARF") == nil && f.Section("__debug_info") == nil && f.Section("__zdebug_info") == nil {
+		return nil
+	}
+	d, err := f.DWARF()
+	if err != nil {
+		return err
+	}
+	p, err := NewDIEPaths(d)
+	if err != nil {
+		return err
+	}
+	for _, fn := range p.funcs {
+		name, err := p.Path(fn.off)
+		if err != nil {
+			return err
+		}
+		add(FromDWARF, name, fn.low, fn.high)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"encoding/binary"
+	"hash"
+	"io"
+)
+
+// hasFileData reports whether s has contents in the file.  Zero-fill
+// sections have none, and neither do the sections of a dSYM outside
+// __DWARF, which keep their headers but are given offset 0.
+func (s *Section) hasFileData() bool {
+	return s.Flags.Type() != SZerofill && s.Offset != 0 && s.Size != 0
+}
+
+// Hash writes the contents of s, as stored in the file (so compressed,
+// if it is compressed), to h.  The contents are streamed, not read into
+// memory.  A section with no contents in the file adds nothing to h.
+func (s *Section) Hash(h hash.Hash) error {
+	if !s.hasFileData() {
+		return nil
+	}
+	_, err := s.DataRangeTo(h, 0, int64(s.Size))
+	return err
+}
+
+// ContentHash writes to h the contents of every section of f outside
+// __LINKEDIT, in file order, each preceded by its segment and section
+// names and its length.  Because symbol tables, fixups, and code
+// signatures live in __LINKEDIT, and the header and load commands are
+// not included, the result is unchanged by stripping, re-signing, or
+// changing the UUID, which makes it suitable for generating UUIDs and
+// as a cache key.
+func (f *File) ContentHash(h hash.Hash) error {
+	var n [8]byte
+	for _, s := range f.Sections {
+		if s.Seg == "__LINKEDIT" {
+			continue
+		}
+		io.WriteString(h, s.Seg)
+		h.Write([]byte{0})
+		io.WriteString(h, s.Name)
+		h.Write([]byte{0})
+		size := uint64(0)
+		if s.hasFileData() {
+			size = s.Size
+		}
+		binary.BigEndian.PutUint64(n[:], size)
+		h.Write(n[:])
+		if err := s.Hash(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
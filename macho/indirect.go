@@ -0,0 +1,89 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import "fmt"
+
+// Entries of the indirect symbol table (INDIRECT_SYMBOL_*) for slots
+// bound to no symbol: a local symbol, whose pointer the linker filled
+// in and which must be slid, or an absolute one, which must not be.
+// Both are set for a local absolute symbol.
+const (
+	IndirectSymbolLocal uint32 = 0x80000000
+	IndirectSymbolAbs   uint32 = 0x40000000
+)
+
+// An IndirectSymbol is a slot of a stub or symbol pointer section, and
+// the symbol it is bound to.
+type IndirectSymbol struct {
+	Section *Section
+	Addr    uint64 // the address of the slot
+	Index   uint32 // the slot's entry in Dysymtab.IndirectSyms
+	// The symbol, unless the entry is IndirectSymbolLocal or
+	// IndirectSymbolAbs, in which case Symbol is nil and Local or
+	// Absolute says which.
+	Symbol          *Symbol
+	Local, Absolute bool
+}
+
+// IndirectSymbols returns the slots of every section of f bound to the
+// indirect symbol table, those whose flags HasIndirectSymbols, in
+// section order.  It returns nil if f has no LC_DYSYMTAB.
+func (f *File) IndirectSymbols() ([]IndirectSymbol, error) {
+	var slots []IndirectSymbol
+	for _, s := range f.Sections {
+		ss, err := f.SectionIndirectSymbols(s)
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, ss...)
+	}
+	return slots, nil
+}
+
+// SectionIndirectSymbols returns the slots of s, a section of f, and
+// the symbols they are bound to.  A section of stubs has one slot for
+// each Reserved2 bytes; a section of pointers has one for each pointer.
+// Either's first slot is bound by entry Reserved1 of the indirect
+// symbol table, and each later slot by the next entry.  It returns nil
+// if s is not bound to the table, or f has no LC_DYSYMTAB.
+func (f *File) SectionIndirectSymbols(s *Section) ([]IndirectSymbol, error) {
+	if !s.Flags.HasIndirectSymbols() || f.Dysymtab == nil {
+		return nil, nil
+	}
+	size := uint64(4)
+	if f.Magic == Magic64 {
+		size = 8
+	}
+	if s.Flags.IsSymbolStubs() {
+		size = uint64(s.Reserved2)
+		if size == 0 {
+			return nil, fmt.Errorf("section %s,%s: stubs of 0 bytes", s.Seg, s.Name)
+		}
+	}
+	n := s.Size / size
+	table := f.Dysymtab.IndirectSyms
+	if uint64(s.Reserved1)+n > uint64(len(table)) {
+		return nil, fmt.Errorf("section %s,%s: %d slots from indirect symbol %d, but the table has %d entries",
+			s.Seg, s.Name, n, s.Reserved1, len(table))
+	}
+	slots := make([]IndirectSymbol, n)
+	for i := range slots {
+		index := s.Reserved1 + uint32(i)
+		slot := IndirectSymbol{Section: s, Addr: s.Addr + uint64(i)*size, Index: index}
+		sym := table[index]
+		slot.Local = sym&IndirectSymbolLocal != 0
+		slot.Absolute = sym&IndirectSymbolAbs != 0
+		if !slot.Local && !slot.Absolute {
+			if f.Symtab == nil || uint64(sym) >= uint64(len(f.Symtab.Syms)) {
+				return nil, fmt.Errorf("section %s,%s: slot %d: indirect symbol %d refers to symbol %d of a symbol table without it",
+					s.Seg, s.Name, i, index, sym)
+			}
+			slot.Symbol = &f.Symtab.Syms[sym]
+		}
+		slots[i] = slot
+	}
+	return slots, nil
+}
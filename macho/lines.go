@@ -0,0 +1,110 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"debug/dwarf"
+	"io"
+	"sort"
+)
+
+// A LineTable maps program counters to source lines, compactly: it is
+// what a sampling profiler needs from the DWARF line tables, and no more.
+type LineTable struct {
+	Files []string  // file names, indexed by LineRow.File
+	Rows  []LineRow // sorted by PC
+}
+
+// A LineRow says that the PCs from its own up to the next row's come
+// from one line.  A row with Line 0, as at the end of a sequence of
+// code, says that those PCs have no line.
+type LineRow struct {
+	PC   uint64
+	File uint32
+	Line uint32
+}
+
+// LineTable reads the DWARF line tables of f into a LineTable.  Rows
+// that repeat the file and line of the row before are omitted.
+func (f *File) LineTable() (*LineTable, error) {
+	d, err := f.DWARF()
+	if err != nil {
+		return nil, err
+	}
+	t := &LineTable{}
+	files := make(map[string]uint32)
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		if e.Tag != dwarf.TagCompileUnit && e.Tag != dwarf.TagPartialUnit {
+			r.SkipChildren()
+			continue
+		}
+		r.SkipChildren()
+		lr, err := d.LineReader(e)
+		if err != nil {
+			return nil, err
+		}
+		if lr == nil {
+			continue
+		}
+		var le dwarf.LineEntry
+		last := -1 // the index of the current sequence's last row
+		for {
+			if err := lr.Next(&le); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if le.EndSequence {
+				t.Rows = append(t.Rows, LineRow{PC: le.Address})
+				last = -1
+				continue
+			}
+			row := LineRow{PC: le.Address, Line: uint32(le.Line)}
+			if le.File != nil {
+				i, ok := files[le.File.Name]
+				if !ok {
+					i = uint32(len(t.Files))
+					files[le.File.Name] = i
+					t.Files = append(t.Files, le.File.Name)
+				}
+				row.File = i
+			}
+			if last >= 0 && t.Rows[last].File == row.File && t.Rows[last].Line == row.Line {
+				continue
+			}
+			last = len(t.Rows)
+			t.Rows = append(t.Rows, row)
+		}
+	}
+	// Sequences do not overlap, but one may end where the next
+	// begins, so at equal PCs the end comes first.
+	sort.SliceStable(t.Rows, func(i, j int) bool {
+		a, b := &t.Rows[i], &t.Rows[j]
+		if a.PC != b.PC {
+			return a.PC < b.PC
+		}
+		return a.Line == 0 && b.Line != 0
+	})
+	return t, nil
+}
+
+// Lookup returns the file and line of the code at pc, and whether
+// there is any.
+func (t *LineTable) Lookup(pc uint64) (file string, line int, ok bool) {
+	i := sort.Search(len(t.Rows), func(i int) bool { return t.Rows[i].PC > pc }) - 1
+	if i < 0 || t.Rows[i].Line == 0 {
+		return "", 0, false
+	}
+	r := t.Rows[i]
+	return t.Files[r.File], int(r.Line), true
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import "fmt"
+
+// Removing a load command from a FileTOC removes what it alone
+// describes.  A segment takes its sections with it, and their contents;
+// a command that locates data in the file, as LC_SYMTAB, LC_DYLD_INFO,
+// and the LinkEditData commands such as LC_CODE_SIGNATURE do in
+// __LINKEDIT, takes that data, and if it was the last of __LINKEDIT,
+// __LINKEDIT shrinks to end where what remains of it does.  Nothing
+// else moves: the load commands shrink, leaving room after them, and a
+// range freed elsewhere in the file is left as zeros.
+
+// A fileRange is a range of a file, n bytes at offset off.
+type fileRange struct {
+	off, n uint64
+}
+
+func (r fileRange) end() uint64 { return r.off + r.n }
+
+// RemoveLoad removes the i'th load command of t, and what it alone
+// describes, as above, and updates Ncmd and Cmdsz.  It returns an
+// error, and changes nothing, if i is out of range, or something that
+// remains would refer to what is removed: a symbol or relocation to a
+// section of a removed segment, another command to data in it, or
+// LC_DYSYMTAB to the symbols of a removed LC_SYMTAB.
+func (t *FileTOC) RemoveLoad(i int) error {
+	if i < 0 || i >= len(t.Loads) {
+		return fmt.Errorf("there are %d load commands; cannot remove load %d", len(t.Loads), i)
+	}
+	l := t.Loads[i]
+	others := append(append([]Load{}, t.Loads[:i]...), t.Loads[i+1:]...)
+	if _, ok := l.(*Symtab); ok {
+		for _, o := range others {
+			if _, ok := o.(*Dysymtab); ok {
+				return fmt.Errorf("load %d, %v: LC_DYSYMTAB indexes its symbols", i, l.Command())
+			}
+		}
+	}
+
+	var freed []fileRange
+	if g, ok := l.(*Segment); ok {
+		span := fileRange{g.Offset, g.Filesz}
+		for _, o := range others {
+			for _, r := range t.loadRanges(o) {
+				if r.n > 0 && r.off < span.end() && span.off < r.end() {
+					return fmt.Errorf("load %d, segment %s: %v locates data in it at %#x", i, g.Name, o.Command(), r.off)
+				}
+			}
+		}
+		first, sects, err := t.segmentSections(g)
+		if err != nil {
+			return err
+		}
+		old := t.Sections
+		t.Sections = append(append([]*Section{}, old[:first]...), old[first+len(sects):]...)
+		if err := t.RenumberSections(old); err != nil {
+			t.Sections = old
+			return err
+		}
+		t.setNsect(g, first, 0)
+		var kept []*payload
+		for _, p := range t.payloads {
+			if p.g == g || sectionIn(p.s, sects) || p.s == nil && p.g == nil && inRanges(p.off, []fileRange{span}) {
+				continue
+			}
+			kept = append(kept, p)
+		}
+		t.payloads = kept
+	} else {
+		freed = t.loadRanges(l)
+	}
+
+	t.Loads = others
+	t.Ncmd--
+	t.Cmdsz -= l.LoadSize(t)
+	if len(freed) > 0 {
+		t.free(freed)
+	}
+	return nil
+}
+
+// RemoveLoadsOfType removes, as RemoveLoad does, every load command of
+// t that is a cmd, such as LcCodeSignature, and returns how many it
+// removed.  If one cannot be removed, it returns an error, having
+// removed those before it.
+func (t *FileTOC) RemoveLoadsOfType(cmd LoadCmd) (int, error) {
+	n := 0
+	for i := 0; i < len(t.Loads); {
+		if t.Loads[i].Command() != cmd {
+			i++
+			continue
+		}
+		if err := t.RemoveLoad(i); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// free drops the payloads registered in the freed ranges, and if any
+// of them ended __LINKEDIT, shrinks it to end where the data the load
+// commands still locate in it does.
+func (t *FileTOC) free(freed []fileRange) {
+	var kept []*payload
+	for _, p := range t.payloads {
+		if p.s == nil && p.g == nil && inRanges(p.off, freed) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	t.payloads = kept
+
+	var linkedit *Segment
+	for _, l := range t.Loads {
+		if g, ok := l.(*Segment); ok && g.Name == "__LINKEDIT" {
+			linkedit = g
+		}
+	}
+	if linkedit == nil || linkedit.Filesz == 0 {
+		return
+	}
+	end := linkedit.Offset + linkedit.Filesz
+	last := false
+	for _, r := range freed {
+		if r.n > 0 && r.off >= linkedit.Offset && r.off < end && r.end() >= end {
+			last = true
+		}
+	}
+	if !last {
+		return
+	}
+	newEnd := linkedit.Offset
+	for _, l := range t.Loads {
+		for _, r := range t.loadRanges(l) {
+			if r.n > 0 && r.off >= linkedit.Offset && r.off < end && r.end() > newEnd {
+				newEnd = r.end()
+			}
+		}
+	}
+	linkedit.Filesz = newEnd - linkedit.Offset
+}
+
+// loadRanges returns the ranges of the file in which l locates data of
+// its own, such as symbols, strings, or a code signature; those it
+// locates in the contents of a segment, as LC_ENCRYPTION_INFO and
+// LC_MAIN do, are not its own.
+func (t *FileTOC) loadRanges(l Load) []fileRange {
+	r := func(off, n uint32) fileRange {
+		if off == 0 {
+			n = 0
+		}
+		return fileRange{uint64(off), uint64(n)}
+	}
+	switch l := l.(type) {
+	case *Symtab:
+		return []fileRange{r(l.Symoff, l.Nsyms*t.SymbolSize()), r(l.Stroff, l.Strsize)}
+	case *Dysymtab:
+		modtab := uint32(52) // sizeof(struct dylib_module)
+		if t.Magic == Magic64 {
+			modtab = 56
+		}
+		return []fileRange{
+			r(l.Tocoffset, l.Ntoc*8),
+			r(l.Modtaboff, l.Nmodtab*modtab),
+			r(l.Extrefsymoff, l.Nextrefsyms*4),
+			r(l.Indirectsymoff, l.Nindirectsyms*4),
+			r(l.Extreloff, l.Nextrel*8),
+			r(l.Locreloff, l.Nlocrel*8),
+		}
+	case *DyldInfo:
+		return []fileRange{
+			r(l.RebaseOff, l.RebaseLen),
+			r(l.BindOff, l.BindLen),
+			r(l.WeakBindOff, l.WeakBindLen),
+			r(l.LazyBindOff, l.LazyBindLen),
+			r(l.ExportOff, l.ExportLen),
+		}
+	case *LinkEditData:
+		return []fileRange{r(l.DataOff, l.DataLen)}
+	case *Symseg:
+		return []fileRange{r(l.Offset, l.Size)}
+	case *TwolevelHints:
+		return []fileRange{r(l.Offset, l.Nhints*4)}
+	}
+	return nil
+}
+
+// inRanges reports whether off lies in one of rs.
+func inRanges(off uint64, rs []fileRange) bool {
+	for _, r := range rs {
+		if r.n > 0 && r.off <= off && off < r.end() {
+			return true
+		}
+	}
+	return false
+}
+
+// sectionIn reports whether s, if not nil, is one of sects.
+func sectionIn(s *Section, sects []*Section) bool {
+	for _, c := range sects {
+		if c == s && s != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -63,6 +63,7 @@ const ( // SNAKE_CASE to CamelCase translation from C names
 	MhDylib   HdrType = 6
 	MhBundle  HdrType = 8
 	MhDsym    HdrType = 0xa
+	MhFileset HdrType = 0xc // Mach-O files, such as a kernel and its extensions, combined
 )
 
 var typeStrings = []intName{
@@ -71,6 +72,7 @@ var typeStrings = []intName{
 	{uint32(MhDylib), "Dylib"},
 	{uint32(MhBundle), "Bundle"},
 	{uint32(MhDsym), "Dsym"},
+	{uint32(MhFileset), "Fileset"},
 }
 
 func (t HdrType) String() string   { return stringName(uint32(t), typeStrings, false) }
@@ -102,6 +104,65 @@ var cpuStrings = []intName{
 func (i Cpu) String() string   { return stringName(uint32(i), cpuStrings, false) }
 func (i Cpu) GoString() string { return stringName(uint32(i), cpuStrings, true) }
 
+// A CpuSubtype is a Mach-O cpu subtype.  Its low 24 bits say which
+// variant of its Cpu a file is for, and its high 8 are capability bits;
+// the same value can mean different things for different Cpus.
+type CpuSubtype uint32
+
+const (
+	SubCpuMask        CpuSubtype = 0xff000000 // the capability bits
+	SubCpuLib64       CpuSubtype = 0x80000000 // a 64-bit executable
+	SubCpuPtrauthABI  CpuSubtype = 0x80000000 // on arm64e, the pointer authentication ABI is versioned
+	SubCpuPtrauthMask CpuSubtype = 0x0f000000 // on arm64e, the version of that ABI
+
+	SubCpuX86All   CpuSubtype = 3 // also x86_64
+	SubCpuX86_64H  CpuSubtype = 8 // Haswell and later
+	SubCpuArmAll   CpuSubtype = 0
+	SubCpuArmV7    CpuSubtype = 9
+	SubCpuArmV7s   CpuSubtype = 11
+	SubCpuArmV7k   CpuSubtype = 12
+	SubCpuArm64All CpuSubtype = 0
+	SubCpuArm64V8  CpuSubtype = 1
+	SubCpuArm64E   CpuSubtype = 2
+	SubCpuPpcAll   CpuSubtype = 0
+)
+
+// Base returns s without its capability bits.
+func (s CpuSubtype) Base() CpuSubtype { return s &^ SubCpuMask }
+
+// PtrauthVersion returns the version of the pointer authentication ABI
+// of an arm64e file of subtype s, and whether s says; it says nothing
+// for any other cpu, or for an arm64e file from before the ABI was
+// versioned.
+func (s CpuSubtype) PtrauthVersion(cpu Cpu) (uint8, bool) {
+	if cpu != CpuArm64 || s.Base() != SubCpuArm64E || s&SubCpuPtrauthABI == 0 {
+		return 0, false
+	}
+	return uint8((s & SubCpuPtrauthMask) >> 24), true
+}
+
+// Normalize returns s, as a file of cpu derived from one of subtype s,
+// such as its dSYM, should have it: with the capability bits that
+// cpu's loaders and debuggers look at, arm64e's pointer authentication
+// ABI and version, or elsewhere LIB64, and without any others.
+func (s CpuSubtype) Normalize(cpu Cpu) CpuSubtype {
+	if _, ok := s.PtrauthVersion(cpu); ok {
+		return s & (^SubCpuMask | SubCpuPtrauthABI | SubCpuPtrauthMask)
+	}
+	if cpu == CpuArm64 {
+		return s.Base()
+	}
+	return s & (^SubCpuMask | SubCpuLib64)
+}
+
+func (s CpuSubtype) String() string {
+	str := "0x" + strconv.FormatUint(uint64(s.Base()), 16)
+	if caps := s & SubCpuMask; caps != 0 {
+		str += " caps=0x" + strconv.FormatUint(uint64(caps>>24), 16)
+	}
+	return str
+}
+
 // A LoadCmd is a Mach-O load command.
 type LoadCmd uint32
 
@@ -111,21 +172,32 @@ const ( // SNAKE_CASE to CamelCase translation from C names
 	// Note 3 and 8 are obsolete
 	LcSegment            LoadCmd = 0x1
 	LcSymtab             LoadCmd = 0x2
+	LcSymseg             LoadCmd = 0x3 // obsolete gdb symbol table
 	LcThread             LoadCmd = 0x4
 	LcUnixthread         LoadCmd = 0x5 // thread+stack
+	LcIdent              LoadCmd = 0x8 // obsolete object identification
+	LcPrepage            LoadCmd = 0xa // obsolete, internal to the kernel
 	LcDysymtab           LoadCmd = 0xb
-	LcDylib              LoadCmd = 0xc // load dylib command
-	LcIdDylib            LoadCmd = 0xd // dynamically linked shared lib ident
-	LcLoadDylinker       LoadCmd = 0xe // load a dynamic linker
-	LcIdDylinker         LoadCmd = 0xf // id dylinker command (not load dylinker command)
+	LcDylib              LoadCmd = 0xc        // load dylib command
+	LcIdDylib            LoadCmd = 0xd        // dynamically linked shared lib ident
+	LcLoadDylinker       LoadCmd = 0xe        // load a dynamic linker
+	LcIdDylinker         LoadCmd = 0xf        // id dylinker command (not load dylinker command)
+	LcRoutines           LoadCmd = 0x11       // image initialization routine
+	LcTwolevelHints      LoadCmd = 0x16       // hints for the two-level namespace lookup
+	LcPrebindCksum       LoadCmd = 0x17       // checksum of a prebound image
+	LcLoadWeakDylib      LoadCmd = 0x80000018 // load a dylib that may be missing
 	LcSegment64          LoadCmd = 0x19
+	LcRoutines64         LoadCmd = 0x1a // 64-bit image initialization routine
 	LcUuid               LoadCmd = 0x1b
 	LcCodeSignature      LoadCmd = 0x1d
 	LcSegmentSplitInfo   LoadCmd = 0x1e
 	LcRpath              LoadCmd = 0x8000001c
+	LcReexportDylib      LoadCmd = 0x8000001f // load and re-export a dylib
+	LcLazyLoadDylib      LoadCmd = 0x20       // load a dylib when first used
 	LcEncryptionInfo     LoadCmd = 0x21
 	LcDyldInfo           LoadCmd = 0x22
 	LcDyldInfoOnly       LoadCmd = 0x80000022
+	LcLoadUpwardDylib    LoadCmd = 0x80000023 // load a dylib that is also a client of this one
 	LcVersionMinMacosx   LoadCmd = 0x24
 	LcVersionMinIphoneos LoadCmd = 0x25
 	LcFunctionStarts     LoadCmd = 0x26
@@ -137,16 +209,33 @@ const ( // SNAKE_CASE to CamelCase translation from C names
 	LcEncryptionInfo64   LoadCmd = 0x2c
 	LcVersionMinTvos     LoadCmd = 0x2f
 	LcVersionMinWatchos  LoadCmd = 0x30
+	LcBuildVersion       LoadCmd = 0x32       // Platform, minimum OS, SDK, and tools
+	LcDyldExportsTrie    LoadCmd = 0x80000033 // Exported symbols, as a trie
+	LcDyldChainedFixups  LoadCmd = 0x80000034 // Rebases and binds, as chains through the pointers
+	LcFilesetEntry       LoadCmd = 0x80000035 // A Mach-O file embedded in an MhFileset file
 )
 
 var cmdStrings = []intName{
 	{uint32(LcSegment), "LoadCmdSegment"},
 	{uint32(LcThread), "LoadCmdThread"},
 	{uint32(LcUnixthread), "LoadCmdUnixThread"},
+	{uint32(LcSymtab), "LoadCmdSymtab"},
+	{uint32(LcSymseg), "LoadCmdSymseg"},
+	{uint32(LcIdent), "LoadCmdIdent"},
+	{uint32(LcPrepage), "LoadCmdPrepage"},
+	{uint32(LcDysymtab), "LoadCmdDysymtab"},
 	{uint32(LcDylib), "LoadCmdDylib"},
 	{uint32(LcIdDylib), "LoadCmdIdDylib"},
+	{uint32(LcLoadWeakDylib), "LoadCmdLoadWeakDylib"},
+	{uint32(LcReexportDylib), "LoadCmdReexportDylib"},
+	{uint32(LcLazyLoadDylib), "LoadCmdLazyLoadDylib"},
+	{uint32(LcLoadUpwardDylib), "LoadCmdLoadUpwardDylib"},
 	{uint32(LcLoadDylinker), "LoadCmdLoadDylinker"},
 	{uint32(LcIdDylinker), "LoadCmdIdDylinker"},
+	{uint32(LcRoutines), "LoadCmdRoutines"},
+	{uint32(LcRoutines64), "LoadCmdRoutines64"},
+	{uint32(LcTwolevelHints), "LoadCmdTwolevelHints"},
+	{uint32(LcPrebindCksum), "LoadCmdPrebindCksum"},
 	{uint32(LcSegment64), "LoadCmdSegment64"},
 	{uint32(LcUuid), "LoadCmdUuid"},
 	{uint32(LcRpath), "LoadCmdRpath"},
@@ -157,7 +246,14 @@ var cmdStrings = []intName{
 	{uint32(LcDyldInfo), "LoadCmdDyldInfo"},
 	{uint32(LcDyldInfoOnly), "LoadCmdDyldInfoOnly"},
 	{uint32(LcVersionMinMacosx), "LoadCmdMinOsx"},
+	{uint32(LcVersionMinIphoneos), "LoadCmdMinIphoneos"},
+	{uint32(LcVersionMinTvos), "LoadCmdMinTvos"},
+	{uint32(LcVersionMinWatchos), "LoadCmdMinWatchos"},
+	{uint32(LcBuildVersion), "LoadCmdBuildVersion"},
 	{uint32(LcFunctionStarts), "LoadCmdFunctionStarts"},
+	{uint32(LcDyldExportsTrie), "LoadCmdDyldExportsTrie"},
+	{uint32(LcDyldChainedFixups), "LoadCmdDyldChainedFixups"},
+	{uint32(LcFilesetEntry), "LoadCmdFilesetEntry"},
 }
 
 func (i LoadCmd) String() string   { return stringName(uint32(i), cmdStrings, false) }
@@ -252,12 +348,25 @@ type (
 		Path uint32
 	}
 
-	// A Thread is a Mach-O thread state command.
+	// A Thread is a Mach-O thread state command, LC_THREAD or
+	// LC_UNIXTHREAD: the registers of a thread, as a sequence of
+	// states of various flavors.  Type and Data are the flavor and
+	// words of the first state.
 	Thread struct {
 		LoadCmd
-		Len  uint32
-		Type uint32
-		Data []uint32
+		Len    uint32
+		Type   uint32
+		Data   []uint32
+		States []ThreadState
+
+		cpu Cpu              // how to read the states
+		bo  binary.ByteOrder // and the words of uint64 registers
+	}
+
+	// A ThreadState is one flavor/count/state block of a Thread.
+	ThreadState struct {
+		Flavor uint32
+		Data   []uint32 // count words of state
 	}
 
 	// LC_DYLD_INFO, LC_DYLD_INFO_ONLY
@@ -271,7 +380,8 @@ type (
 		ExportOff, ExportLen     uint32 // file offset and length
 	}
 
-	// LC_CODE_SIGNATURE, LC_SEGMENT_SPLIT_INFO, LC_FUNCTION_STARTS, LC_DATA_IN_CODE, LC_DYLIB_CODE_SIGN_DRS
+	// LC_CODE_SIGNATURE, LC_SEGMENT_SPLIT_INFO, LC_FUNCTION_STARTS, LC_DATA_IN_CODE, LC_DYLIB_CODE_SIGN_DRS,
+	// LC_DYLD_EXPORTS_TRIE, LC_DYLD_CHAINED_FIXUPS
 	LinkEditDataCmd struct {
 		LoadCmd
 		Len              uint32
@@ -286,8 +396,33 @@ type (
 		CryptId            uint32
 	}
 
-	// TODO Commands below not fully supported yet.
+	// LC_BUILD_VERSION, followed by Ntools BuildTools.
+	BuildVersionCmd struct {
+		LoadCmd
+		Len      uint32
+		Platform Platform
+		Minos    Version
+		Sdk      Version
+		Ntools   uint32
+	}
+
+	// An LC_FILESET_ENTRY, followed by the entry's ID.
+	FilesetEntryCmd struct {
+		LoadCmd
+		Len      uint32
+		Addr     uint64 // of the entry's header, in memory
+		FileOff  uint64 // of the entry's header, in the file
+		EntryID  uint32 // offset of the ID within the command
+		Reserved uint32
+	}
+
+	// A BuildTool is one tool listed in an LC_BUILD_VERSION command.
+	BuildTool struct {
+		Tool    Tool
+		Version Version
+	}
 
+	// LC_MAIN
 	EntryPointCmd struct {
 		LoadCmd
 		Len       uint32
@@ -295,6 +430,71 @@ type (
 		StackSize uint64 // if not zero, initial stack size
 	}
 
+	// LC_VERSION_MIN_MACOSX, LC_VERSION_MIN_IPHONEOS, LC_VERSION_MIN_TVOS, LC_VERSION_MIN_WATCHOS
+	VersionMinCmd struct {
+		LoadCmd
+		Len     uint32
+		Version Version // minimum OS version
+		Sdk     Version // 0 if not known
+	}
+
+	// LC_SOURCE_VERSION
+	SourceVersionCmd struct {
+		LoadCmd
+		Len     uint32
+		Version uint64 // A.B.C.D.E packed as a24.b10.c10.d10.e10
+	}
+
+	// LC_SYMSEG
+	SymsegCmd struct {
+		LoadCmd
+		Len    uint32
+		Offset uint32 // file offset of the symbol segment
+		Size   uint32
+	}
+
+	// LC_ROUTINES
+	Routines32 struct {
+		LoadCmd
+		Len         uint32
+		InitAddress uint32 // address of the initialization routine
+		InitModule  uint32 // index of the module that holds it
+		Reserved    [6]uint32
+	}
+
+	// LC_ROUTINES_64
+	Routines64 struct {
+		LoadCmd
+		Len         uint32
+		InitAddress uint64
+		InitModule  uint64
+		Reserved    [6]uint64
+	}
+
+	// LC_TWOLEVEL_HINTS, whose Nhints hints are at file offset Offset.
+	TwolevelHintsCmd struct {
+		LoadCmd
+		Len    uint32
+		Offset uint32
+		Nhints uint32
+	}
+
+	// LC_PREBIND_CKSUM
+	PrebindCksumCmd struct {
+		LoadCmd
+		Len   uint32
+		Cksum uint32
+	}
+
+	// LC_UUID
+	UuidCmd struct {
+		LoadCmd
+		Len uint32
+		Id  [16]byte
+	}
+
+	// TODO Commands below not fully supported yet.
+
 	NoteCmd struct {
 		LoadCmd
 		Len            uint32
@@ -381,6 +581,14 @@ type Nlist64 struct {
 	Value uint64
 }
 
+// The sizes of an Nlist32 and an Nlist64 in a file.
+const (
+	Nlist32Size = 12
+	Nlist64Size = 16
+)
+
+// Put64 writes n to b as a 64-bit symbol table entry, in byte order
+// o, and returns the number of bytes written, Nlist64Size.
 func (n *Nlist64) Put64(b []byte, o binary.ByteOrder) uint32 {
 	o.PutUint32(b[0:], n.Name)
 	b[4] = byte(n.Type)
@@ -390,6 +598,9 @@ func (n *Nlist64) Put64(b []byte, o binary.ByteOrder) uint32 {
 	return 8 + 8
 }
 
+// Put32 writes n to b as a 32-bit symbol table entry, its Value cut
+// to 32 bits, in byte order o, and returns the number of bytes
+// written, Nlist32Size.
 func (n *Nlist64) Put32(b []byte, o binary.ByteOrder) uint32 {
 	o.PutUint32(b[0:], n.Name)
 	b[4] = byte(n.Type)
@@ -399,6 +610,47 @@ func (n *Nlist64) Put32(b []byte, o binary.ByteOrder) uint32 {
 	return 8 + 4
 }
 
+// Get64 sets n to the 64-bit symbol table entry at the start of b, in
+// byte order o, the inverse of Put64, and returns the number of bytes
+// read.  With Put64, it lets a tool edit a symbol table in place,
+// without a File.
+func (n *Nlist64) Get64(b []byte, o binary.ByteOrder) uint32 {
+	n.Name = o.Uint32(b[0:])
+	n.Type = b[4]
+	n.Sect = b[5]
+	n.Desc = o.Uint16(b[6:])
+	n.Value = o.Uint64(b[8:])
+	return 8 + 8
+}
+
+// Get32 sets n to the 32-bit symbol table entry at the start of b, in
+// byte order o, the inverse of Put32, and returns the number of bytes
+// read.
+func (n *Nlist64) Get32(b []byte, o binary.ByteOrder) uint32 {
+	n.Name = o.Uint32(b[0:])
+	n.Type = b[4]
+	n.Sect = b[5]
+	n.Desc = o.Uint16(b[6:])
+	n.Value = uint64(o.Uint32(b[8:]))
+	return 8 + 4
+}
+
+// Put writes n to b, in byte order o, and returns the number of bytes
+// written, Nlist32Size.
+func (n *Nlist32) Put(b []byte, o binary.ByteOrder) uint32 {
+	n64 := Nlist64{Name: n.Name, Type: n.Type, Sect: n.Sect, Desc: n.Desc, Value: uint64(n.Value)}
+	return n64.Put32(b, o)
+}
+
+// Get sets n to the entry at the start of b, in byte order o, the
+// inverse of Put, and returns the number of bytes read.
+func (n *Nlist32) Get(b []byte, o binary.ByteOrder) uint32 {
+	var n64 Nlist64
+	k := n64.Get32(b, o)
+	*n = Nlist32{Name: n64.Name, Type: n64.Type, Sect: n64.Sect, Desc: n64.Desc, Value: uint32(n64.Value)}
+	return k
+}
+
 // Regs386 is the Mach-O 386 register structure.
 type Regs386 struct {
 	AX    uint32
@@ -444,6 +696,104 @@ type RegsAMD64 struct {
 	GS    uint64
 }
 
+// RegsARM64 is the Mach-O ARM64 register structure.
+type RegsARM64 struct {
+	X     [29]uint64
+	FP    uint64
+	LR    uint64
+	SP    uint64
+	PC    uint64
+	CPSR  uint32
+	Flags uint32
+}
+
+// Thread state flavors.  The same value means different things for
+// different CPUs; x86_THREAD_STATE32 is also i386_THREAD_STATE.
+const (
+	ThreadStateX86_32 = 1 // x86_THREAD_STATE32, a Regs386
+	ThreadStateX86_64 = 4 // x86_THREAD_STATE64, a RegsAMD64
+	ThreadStateX86    = 7 // x86_THREAD_STATE, a flavor and count, then either of those
+	ThreadStateARM64  = 6 // ARM_THREAD_STATE64, a RegsARM64
+)
+
+// A Platform is a PLATFORM_* value, naming the OS a binary targets.
+type Platform uint32
+
+const (
+	PlatformMacOS             Platform = 1
+	PlatformIOS               Platform = 2
+	PlatformTvOS              Platform = 3
+	PlatformWatchOS           Platform = 4
+	PlatformBridgeOS          Platform = 5
+	PlatformMacCatalyst       Platform = 6
+	PlatformIOSSimulator      Platform = 7
+	PlatformTvOSSimulator     Platform = 8
+	PlatformWatchOSSimulator  Platform = 9
+	PlatformDriverKit         Platform = 10
+	PlatformVisionOS          Platform = 11
+	PlatformVisionOSSimulator Platform = 12
+)
+
+var platformStrings = []intName{
+	{uint32(PlatformMacOS), "PlatformMacOS"},
+	{uint32(PlatformIOS), "PlatformIOS"},
+	{uint32(PlatformTvOS), "PlatformTvOS"},
+	{uint32(PlatformWatchOS), "PlatformWatchOS"},
+	{uint32(PlatformBridgeOS), "PlatformBridgeOS"},
+	{uint32(PlatformMacCatalyst), "PlatformMacCatalyst"},
+	{uint32(PlatformIOSSimulator), "PlatformIOSSimulator"},
+	{uint32(PlatformTvOSSimulator), "PlatformTvOSSimulator"},
+	{uint32(PlatformWatchOSSimulator), "PlatformWatchOSSimulator"},
+	{uint32(PlatformDriverKit), "PlatformDriverKit"},
+	{uint32(PlatformVisionOS), "PlatformVisionOS"},
+	{uint32(PlatformVisionOSSimulator), "PlatformVisionOSSimulator"},
+}
+
+func (i Platform) String() string   { return stringName(uint32(i), platformStrings, false) }
+func (i Platform) GoString() string { return stringName(uint32(i), platformStrings, true) }
+
+// A Tool is a TOOL_* value, naming a tool in LC_BUILD_VERSION.
+type Tool uint32
+
+const (
+	ToolClang Tool = 1
+	ToolSwift Tool = 2
+	ToolLd    Tool = 3
+	ToolLld   Tool = 4
+)
+
+var toolStrings = []intName{
+	{uint32(ToolClang), "ToolClang"},
+	{uint32(ToolSwift), "ToolSwift"},
+	{uint32(ToolLd), "ToolLd"},
+	{uint32(ToolLld), "ToolLld"},
+}
+
+func (i Tool) String() string   { return stringName(uint32(i), toolStrings, false) }
+func (i Tool) GoString() string { return stringName(uint32(i), toolStrings, true) }
+
+// A Version is a version number X.Y.Z packed into 16, 8, and 8 bits,
+// as in LC_BUILD_VERSION and the dylib and version-min commands.
+type Version uint32
+
+func (v Version) String() string {
+	return strconv.Itoa(int(v>>16)) + "." + strconv.Itoa(int(v>>8&0xff)) + "." + strconv.Itoa(int(v&0xff))
+}
+
+func (v Version) Major() int { return int(v >> 16) }
+func (v Version) Minor() int { return int(v >> 8 & 0xff) }
+func (v Version) Patch() int { return int(v & 0xff) }
+
+// Short formats v as otool does, leaving off a zero patch: 10.14 or
+// 10.14.1.
+func (v Version) Short() string {
+	s := strconv.Itoa(v.Major()) + "." + strconv.Itoa(v.Minor())
+	if v.Patch() != 0 {
+		s += "." + strconv.Itoa(v.Patch())
+	}
+	return s
+}
+
 type intName struct {
 	i uint32
 	s string
@@ -0,0 +1,55 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import "fmt"
+
+// A Relocation is a relocation of a section, decoded: what it relocates
+// and what to.
+type Relocation struct {
+	Reloc
+	Kind    RelocType // nil if the file's architecture is not known
+	At      uint64    // the address of the bytes relocated
+	Size    int       // how many bytes are relocated
+	Symbol  *Symbol   // for an external relocation, the symbol it refers to
+	Section *Section  // for a local one, the section it refers to, or nil for an absolute one
+}
+
+// Relocations returns the relocations of s, a section of f, decoded.
+// A scattered relocation refers to an address, its Value, and so has
+// neither Symbol nor Section; nor does a relocation that completes the
+// one before it (GENERIC_RELOC_PAIR, ARM_RELOC_PAIR, or
+// ARM64_RELOC_ADDEND), whose fields mean what that one's type says.
+func (f *File) Relocations(s *Section) ([]Relocation, error) {
+	rs := make([]Relocation, len(s.Relocs))
+	for i, r := range s.Relocs {
+		rel := Relocation{Reloc: r, Kind: r.Kind(f.Cpu), At: s.Addr + uint64(r.Addr), Size: 1 << r.Len}
+		switch {
+		case r.Scattered, isPairReloc(rel.Kind):
+		case r.Extern:
+			if f.Symtab == nil || uint64(r.Value) >= uint64(len(f.Symtab.Syms)) {
+				return nil, fmt.Errorf("section %s,%s: relocation %d refers to symbol %d of a symbol table without it", s.Seg, s.Name, i, r.Value)
+			}
+			rel.Symbol = &f.Symtab.Syms[r.Value]
+		case r.Value != 0: // 0 is R_ABS
+			if uint64(r.Value) > uint64(len(f.Sections)) {
+				return nil, fmt.Errorf("section %s,%s: relocation %d refers to section %d of %d", s.Seg, s.Name, i, r.Value, len(f.Sections))
+			}
+			rel.Section = f.Sections[r.Value-1]
+		}
+		rs[i] = rel
+	}
+	return rs, nil
+}
+
+// isPairReloc reports whether k is the type of a relocation that only
+// completes the one before it.
+func isPairReloc(k RelocType) bool {
+	switch k {
+	case GENERIC_RELOC_PAIR, ARM_RELOC_PAIR, ARM64_RELOC_ADDEND:
+		return true
+	}
+	return false
+}
@@ -4,6 +4,8 @@
 
 package macho
 
+import "strconv"
+
 //go:generate stringer -type=RelocTypeGeneric,RelocTypeX86_64,RelocTypeARM,RelocTypeARM64 -output reloctype_string.go
 
 type RelocTypeGeneric int
@@ -56,17 +58,52 @@ func (r RelocTypeARM) GoString() string { return "macho." + r.String() }
 type RelocTypeARM64 int
 
 const (
-	ARM64_RELOC_UNSIGNED            RelocTypeARM64 = 0
-	ARM64_RELOC_SUBTRACTOR          RelocTypeARM64 = 1
-	ARM64_RELOC_BRANCH26            RelocTypeARM64 = 2
-	ARM64_RELOC_PAGE21              RelocTypeARM64 = 3
-	ARM64_RELOC_PAGEOFF12           RelocTypeARM64 = 4
-	ARM64_RELOC_GOT_LOAD_PAGE21     RelocTypeARM64 = 5
-	ARM64_RELOC_GOT_LOAD_PAGEOFF12  RelocTypeARM64 = 6
-	ARM64_RELOC_POINTER_TO_GOT      RelocTypeARM64 = 7
-	ARM64_RELOC_TLVP_LOAD_PAGE21    RelocTypeARM64 = 8
-	ARM64_RELOC_TLVP_LOAD_PAGEOFF12 RelocTypeARM64 = 9
-	ARM64_RELOC_ADDEND              RelocTypeARM64 = 10
+	ARM64_RELOC_UNSIGNED              RelocTypeARM64 = 0
+	ARM64_RELOC_SUBTRACTOR            RelocTypeARM64 = 1
+	ARM64_RELOC_BRANCH26              RelocTypeARM64 = 2
+	ARM64_RELOC_PAGE21                RelocTypeARM64 = 3
+	ARM64_RELOC_PAGEOFF12             RelocTypeARM64 = 4
+	ARM64_RELOC_GOT_LOAD_PAGE21       RelocTypeARM64 = 5
+	ARM64_RELOC_GOT_LOAD_PAGEOFF12    RelocTypeARM64 = 6
+	ARM64_RELOC_POINTER_TO_GOT        RelocTypeARM64 = 7
+	ARM64_RELOC_TLVP_LOAD_PAGE21      RelocTypeARM64 = 8
+	ARM64_RELOC_TLVP_LOAD_PAGEOFF12   RelocTypeARM64 = 9
+	ARM64_RELOC_ADDEND                RelocTypeARM64 = 10
+	ARM64_RELOC_AUTHENTICATED_POINTER RelocTypeARM64 = 11 // arm64e
 )
 
 func (r RelocTypeARM64) GoString() string { return "macho." + r.String() }
+
+// TypeString returns the name of r's Type, whose meaning depends on
+// cpu, the architecture of the file r is from.
+func (r Reloc) TypeString(cpu Cpu) string {
+	if k := r.Kind(cpu); k != nil {
+		return k.String()
+	}
+	return "RelocType(" + strconv.Itoa(int(r.Type)) + ")"
+}
+
+// A RelocType is the type of a relocation as its architecture defines
+// it: a RelocTypeGeneric, RelocTypeX86_64, RelocTypeARM, or
+// RelocTypeARM64.
+type RelocType interface {
+	String() string
+	GoString() string
+}
+
+// Kind returns r's Type as cpu, the architecture of the file r is
+// from, defines it, or nil if this package does not know cpu's
+// relocations.
+func (r Reloc) Kind(cpu Cpu) RelocType {
+	switch cpu {
+	case Cpu386:
+		return RelocTypeGeneric(r.Type)
+	case CpuAmd64:
+		return RelocTypeX86_64(r.Type)
+	case CpuArm:
+		return RelocTypeARM(r.Type)
+	case CpuArm64:
+		return RelocTypeARM64(r.Type)
+	}
+	return nil
+}
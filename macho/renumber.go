@@ -0,0 +1,88 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import "fmt"
+
+// RenumberSections updates the section references held by t's symbols
+// and relocations after t.Sections has been edited.
+//
+// Symbols (Symbol.Sect, when not zero) and relocations that are neither
+// extern nor scattered (Reloc.Value) refer to sections by 1-based
+// position in Sections.  old is the Sections slice those references were
+// made against; a section keeps its identity across the edit if the same
+// *Section appears in both old and t.Sections.  All relocations of the
+// sections now in t are taken to use the old numbering.
+//
+// If any reference is to a section that has been removed, or cannot be
+// expressed in the new numbering, RenumberSections returns an error and
+// changes nothing.
+func (t *FileTOC) RenumberSections(old []*Section) error {
+	where := make(map[*Section]uint32, len(t.Sections))
+	for i, s := range t.Sections {
+		where[s] = uint32(i + 1)
+	}
+	renum := make([]uint32, len(old)+1) // old number -> new number, 0 if removed
+	for i, s := range old {
+		renum[i+1] = where[s]
+	}
+	lookup := func(n uint32) (uint32, error) {
+		if n >= uint32(len(renum)) {
+			return 0, fmt.Errorf("section %d, but there were only %d sections", n, len(old))
+		}
+		if renum[n] == 0 {
+			return 0, fmt.Errorf("section %d (%s), which has been removed", n, old[n-1].Name)
+		}
+		return renum[n], nil
+	}
+
+	// Check everything before changing anything.
+	for _, l := range t.Loads {
+		st, ok := l.(*Symtab)
+		if !ok {
+			continue
+		}
+		for i, s := range st.Syms {
+			if s.Sect == 0 {
+				continue
+			}
+			n, err := lookup(uint32(s.Sect))
+			if err != nil {
+				return fmt.Errorf("symbol %d (%s) refers to %v", i, s.Name, err)
+			}
+			if n > 255 {
+				return fmt.Errorf("symbol %d (%s) refers to section %d, beyond the 255 a symbol can name", i, s.Name, n)
+			}
+		}
+	}
+	for _, c := range t.Sections {
+		for i, r := range c.Relocs {
+			if r.Scattered || r.Extern {
+				continue
+			}
+			if _, err := lookup(r.Value); err != nil {
+				return fmt.Errorf("relocation %d in section %s refers to %v", i, c.Name, err)
+			}
+		}
+	}
+
+	for _, l := range t.Loads {
+		if st, ok := l.(*Symtab); ok {
+			for i := range st.Syms {
+				if s := &st.Syms[i]; s.Sect != 0 {
+					s.Sect = uint8(renum[s.Sect])
+				}
+			}
+		}
+	}
+	for _, c := range t.Sections {
+		for i := range c.Relocs {
+			if r := &c.Relocs[i]; !r.Scattered && !r.Extern {
+				r.Value = renum[r.Value]
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import "fmt"
+
+// Inserting a section into a laid-out FileTOC, or removing one, moves
+// what follows it in the file: the sections after it in its segment,
+// the segments after that, and everything the load commands locate by
+// file offset, such as the symbol table and LINKEDIT data.  Whatever
+// moves keeps its alignment, so the distance is rounded up (or down,
+// for a removal) to the largest alignment of the sections that move,
+// and if segments after the section's move too, to maxPageSize, so
+// that each keeps its file offset congruent to its address.  In memory,
+// only the sections after it in its segment move, and the segment
+// grows or shrinks; no other segment moves, as addresses are held in
+// code and data that no load command describes.
+
+// maxPageSize is the largest page size of any Mach-O target, a multiple
+// of all the others.
+const maxPageSize = 1 << 14
+
+// InsertSection inserts s into segment g of t, as its i'th section,
+// and lays it out after the section before it, or at the start of g,
+// at its alignment, setting its Offset and Addr; a zero-fill section
+// takes no room in the file, and may be followed only by others.  What
+// follows s moves as described above, g's Filesz and Memsz grow, and
+// the section numbers symbols and relocations hold are renumbered.
+// It returns an error, and changes nothing, if s cannot go there, or g
+// would grow in memory into another segment.
+func (t *FileTOC) InsertSection(g *Segment, i int, s *Section) error {
+	first, sects, err := t.segmentSections(g)
+	if err != nil {
+		return err
+	}
+	if i < 0 || i > len(sects) {
+		return fmt.Errorf("segment %s has %d sections; cannot insert %s as section %d", g.Name, len(sects), s.Name, i)
+	}
+	zerofill := s.Flags.IsZerofill()
+	if zerofill && i < len(sects) && !sects[i].Flags.IsZerofill() {
+		return fmt.Errorf("zero-fill section %s cannot precede section %s,%s", s.Name, sects[i].Seg, sects[i].Name)
+	}
+	if !zerofill && i > 0 && sects[i-1].Flags.IsZerofill() {
+		return fmt.Errorf("section %s cannot follow zero-fill section %s,%s", s.Name, sects[i-1].Seg, sects[i-1].Name)
+	}
+
+	// Where s goes, and how far what follows must move to make room.
+	a := uint64(1) << s.Align
+	var fileShift, memShift, moveFrom uint64
+	if zerofill {
+		vm := g.Addr + g.Filesz
+		if i > 0 {
+			vm = sects[i-1].Addr + sects[i-1].Size
+		}
+		s.Addr = RoundUp(vm, a)
+		next := g.Addr + g.Memsz
+		if i < len(sects) {
+			next = sects[i].Addr
+		}
+		if end := s.Addr + s.Size; end > next {
+			memShift = RoundUp(end-next, t.moveAlign(sects[i:], false))
+		}
+		s.Offset = 0
+	} else {
+		off := g.Offset
+		if i > 0 {
+			off = uint64(sects[i-1].Offset) + sects[i-1].Size
+		}
+		off = RoundUp(off, a)
+		next := g.Offset + g.Filesz
+		if i < len(sects) && !sects[i].Flags.IsZerofill() {
+			next = uint64(sects[i].Offset)
+		}
+		if end := off + s.Size; end > next {
+			fileShift = RoundUp(end-next, t.moveAlign(sects[i:], t.movesBeyond(g, next)))
+			moveFrom = next
+		}
+		if off+s.Size+fileShift > 1<<32-1 {
+			return fmt.Errorf("section %s would end beyond 4GB, which its offset cannot reach", s.Name)
+		}
+		memShift = fileShift
+		s.Offset = uint32(off)
+		s.Addr = g.Addr + (off - g.Offset)
+	}
+	if memShift > 0 {
+		if other := t.segmentIn(g, g.Addr+g.Memsz, g.Addr+g.Memsz+memShift); other != nil {
+			return fmt.Errorf("segment %s cannot grow by %#x bytes in memory for section %s: segment %s follows it", g.Name, memShift, s.Name, other.Name)
+		}
+	}
+	old := t.Sections
+	t.Sections = append(append(append([]*Section{}, old[:first+i]...), s), old[first+i:]...)
+	if err := t.RenumberSections(old); err != nil {
+		t.Sections = old
+		return err
+	}
+
+	if fileShift > 0 {
+		t.shiftFile(g, s, moveFrom, int64(fileShift))
+		g.Filesz += fileShift
+	}
+	for _, c := range sects[i:] {
+		c.Addr += memShift
+	}
+	g.Memsz += memShift
+	t.setNsect(g, first, uint32(len(sects)+1))
+	return nil
+}
+
+// RemoveSection removes s from t, and from the segment that holds it.
+// What followed s moves back as described above, the segment's Filesz
+// and Memsz shrink, and the section numbers symbols and relocations
+// hold are renumbered.  It returns an error, and changes nothing, if s
+// is not in t, or a symbol or relocation refers to it.
+func (t *FileTOC) RemoveSection(s *Section) error {
+	var g *Segment
+	var first int
+	var sects []*Section
+	i := -1
+	for _, l := range t.Loads {
+		seg, ok := l.(*Segment)
+		if !ok {
+			continue
+		}
+		f, ss, err := t.segmentSections(seg)
+		if err != nil {
+			return err
+		}
+		for j, c := range ss {
+			if c == s {
+				g, first, sects, i = seg, f, ss, j
+			}
+		}
+	}
+	if g == nil {
+		return fmt.Errorf("section %s,%s is not in the file", s.Seg, s.Name)
+	}
+	old := t.Sections
+	t.Sections = append(append([]*Section{}, old[:first+i]...), old[first+i+1:]...)
+	if err := t.RenumberSections(old); err != nil {
+		t.Sections = old
+		return err
+	}
+	var kept []*payload
+	for _, p := range t.payloads {
+		if p.s != s {
+			kept = append(kept, p)
+		}
+	}
+	t.payloads = kept
+
+	// How far what followed s can move back.
+	rest := sects[i+1:]
+	var fileShift, memShift uint64
+	if !s.Flags.IsZerofill() && s.Offset != 0 {
+		start := g.Offset
+		if i > 0 {
+			start = uint64(sects[i-1].Offset) + sects[i-1].Size
+		}
+		next := g.Offset + g.Filesz
+		if len(rest) > 0 && !rest[0].Flags.IsZerofill() {
+			next = uint64(rest[0].Offset)
+		}
+		if next > start {
+			fileShift = RoundDown(next-start, t.moveAlign(rest, t.movesBeyond(g, next)))
+		}
+		if fileShift > 0 {
+			t.shiftFile(g, nil, next, -int64(fileShift))
+			g.Filesz -= fileShift
+		}
+		memShift = fileShift
+	} else if s.Flags.IsZerofill() {
+		start := g.Addr + g.Filesz
+		if i > 0 {
+			start = sects[i-1].Addr + sects[i-1].Size
+		}
+		next := g.Addr + g.Memsz
+		if len(rest) > 0 {
+			next = rest[0].Addr
+		}
+		if next > start {
+			memShift = RoundDown(next-start, t.moveAlign(rest, false))
+		}
+	}
+	for _, c := range rest {
+		c.Addr -= memShift
+	}
+	if g.Memsz -= memShift; g.Memsz < g.Filesz {
+		g.Memsz = g.Filesz
+	}
+	t.setNsect(g, first, uint32(len(sects)-1))
+	return nil
+}
+
+// segmentSections returns the sections of g, and the index in
+// t.Sections of the first of them, or where its first would go.
+func (t *FileTOC) segmentSections(g *Segment) (int, []*Section, error) {
+	first := 0
+	for _, l := range t.Loads {
+		seg, ok := l.(*Segment)
+		if !ok {
+			continue
+		}
+		if seg == g {
+			if g.Nsect > 0 && int(g.Firstsect) != first {
+				return 0, nil, fmt.Errorf("segment %s: sections begin at %d, not %d, after those of the segments before it", g.Name, g.Firstsect, first)
+			}
+			if first+int(g.Nsect) > len(t.Sections) {
+				return 0, nil, fmt.Errorf("segment %s: sections %d through %d, but there are only %d sections", g.Name, first, first+int(g.Nsect)-1, len(t.Sections))
+			}
+			return first, t.Sections[first : first+int(g.Nsect)], nil
+		}
+		first += int(seg.Nsect)
+	}
+	return 0, nil, fmt.Errorf("segment %s is not in the file", g.Name)
+}
+
+// setNsect gives g, whose sections begin at first, n sections, and
+// renumbers the first sections of the segments after it.
+func (t *FileTOC) setNsect(g *Segment, first int, n uint32) {
+	d := int64(n) - int64(g.Nsect)
+	g.Nsect = n
+	g.Firstsect = uint32(first)
+	if n == 0 {
+		g.Firstsect = 0
+	}
+	size := g.LoadSize(t)
+	t.Cmdsz = t.Cmdsz - g.Len + size
+	g.Len = size
+	after := false
+	for _, l := range t.Loads {
+		seg, ok := l.(*Segment)
+		if !ok {
+			continue
+		}
+		if after && seg.Nsect > 0 {
+			seg.Firstsect = uint32(int64(seg.Firstsect) + d)
+		}
+		after = after || seg == g
+	}
+}
+
+// movesBeyond reports whether anything outside segment g lies in the
+// file at or after off, and so would move with what follows it.
+func (t *FileTOC) movesBeyond(g *Segment, off uint64) bool {
+	for _, l := range t.Loads {
+		if seg, ok := l.(*Segment); ok && seg != g && seg.Filesz > 0 && seg.Offset >= off {
+			return true
+		}
+	}
+	return false
+}
+
+// moveAlign returns the alignment to which a distance that moves sects,
+// and if segments is set, whole segments, must be rounded.
+func (t *FileTOC) moveAlign(sects []*Section, segments bool) uint64 {
+	a := uint64(1)
+	for _, c := range sects {
+		if b := uint64(1) << c.Align; b > a {
+			a = b
+		}
+	}
+	if segments && t.Type != MhObject && a < maxPageSize {
+		a = maxPageSize
+	}
+	return a
+}
+
+// segmentIn returns a segment other than g that overlaps the addresses
+// [lo, hi), or nil if none does.
+func (t *FileTOC) segmentIn(g *Segment, lo, hi uint64) *Segment {
+	for _, l := range t.Loads {
+		if seg, ok := l.(*Segment); ok && seg != g && seg.Memsz > 0 && seg.Addr < hi && lo < seg.Addr+seg.Memsz {
+			return seg
+		}
+	}
+	return nil
+}
+
+// shiftFile moves by d everything in the file at or after off, but for
+// segment g itself, whose size its caller sets, and section except.
+func (t *FileTOC) shiftFile(g *Segment, except *Section, off uint64, d int64) {
+	move32 := func(x *uint32) {
+		if *x != 0 && uint64(*x) >= off {
+			*x = uint32(int64(*x) + d)
+		}
+	}
+	move64 := func(x *uint64) {
+		if *x != 0 && *x >= off {
+			*x = uint64(int64(*x) + d)
+		}
+	}
+	for _, c := range t.Sections {
+		if c != except && !c.Flags.IsZerofill() {
+			move32(&c.Offset)
+		}
+		move32(&c.Reloff)
+	}
+	for _, l := range t.Loads {
+		switch l := l.(type) {
+		case *Segment:
+			if l != g && l.Filesz > 0 {
+				move64(&l.Offset)
+			}
+		case *Symtab:
+			move32(&l.Symoff)
+			move32(&l.Stroff)
+		case *Dysymtab:
+			for _, x := range []*uint32{&l.Tocoffset, &l.Modtaboff, &l.Extrefsymoff, &l.Indirectsymoff, &l.Extreloff, &l.Locreloff} {
+				move32(x)
+			}
+		case *DyldInfo:
+			for _, x := range []*uint32{&l.RebaseOff, &l.BindOff, &l.WeakBindOff, &l.LazyBindOff, &l.ExportOff} {
+				move32(x)
+			}
+		case *LinkEditData:
+			move32(&l.DataOff)
+		case *EncryptionInfo:
+			move32(&l.CryptOff)
+		case *EntryPoint:
+			move64(&l.EntryOff)
+		case *Symseg:
+			move32(&l.Offset)
+		case *TwolevelHints:
+			move32(&l.Offset)
+		}
+	}
+	for _, p := range t.payloads {
+		if p.s == nil && p.g == nil {
+			move64(&p.off)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Stripping a file removes from its symbol table what only a debugger
+// or a person reading it needs, once its DWARF is split out, as strip
+// does: the stabs of its debug map, and its local symbols, or all but
+// what dyld and the linker need to load it or link with it.  What
+// remains is written back with PutSymtab, and PackLinkedit closes up
+// the gaps that leaves in __LINKEDIT.
+
+// A StripLevel says what StripSymbols removes.
+type StripLevel int
+
+const (
+	StripDebug  StripLevel = iota // the stabs, as strip -S does
+	StripLocals                   // and the local symbols, as strip -x does
+	StripAll                      // all but the symbols dyld and the linker need, as strip does
+	StripTables                   // LC_SYMTAB and LC_DYSYMTAB themselves, if dyld needs no symbol
+)
+
+var stripLevelNames = []string{"debug", "locals", "all", "tables"}
+
+func (l StripLevel) String() string {
+	if int(l) < len(stripLevelNames) {
+		return stripLevelNames[l]
+	}
+	return fmt.Sprintf("StripLevel(%d)", l)
+}
+
+// StripSymbols removes the symbols of t that level says to, and
+// returns how many it removed.  The symbols dyld and the linker need,
+// which StripAll keeps, are the undefined, those an indirect symbol or
+// relocation refers to, those marked ReferencedDynamically, such as
+// __mh_execute_header, and the external definitions of a dylib, bundle,
+// or object file, which others link against.  It returns an error, and
+// changes nothing, if t has no symbol table, or for StripTables, if it
+// has one of those symbols, or the symbols cannot be renumbered (see
+// RemoveSymbols).
+func (t *FileTOC) StripSymbols(level StripLevel) (int, error) {
+	st, dt := t.symtabs()
+	if st == nil {
+		return 0, fmt.Errorf("there is no %v", LcSymtab)
+	}
+	groups, err := symbolGroups(st, dt)
+	if err != nil {
+		return 0, err
+	}
+	needed := t.neededSymbols(st, dt)
+	var syms []Symbol
+	var from, group []int
+	for i, s := range st.Syms {
+		var keep bool
+		switch level {
+		case StripDebug:
+			keep = !s.IsStab()
+		case StripLocals:
+			keep = !s.IsStab() && (s.IsExternal() || needed[i])
+		case StripAll, StripTables:
+			keep = needed[i]
+		default:
+			return 0, fmt.Errorf("unknown strip level %v", level)
+		}
+		if keep {
+			syms = append(syms, s)
+			from = append(from, i)
+			group = append(group, groups[i])
+		}
+	}
+	n := len(st.Syms) - len(syms)
+	if level == StripTables {
+		if len(syms) > 0 {
+			return 0, fmt.Errorf("the symbol table cannot be removed: %d symbols, such as %s, are needed", len(syms), syms[0].Name)
+		}
+		if dt != nil && dt.Nindirectsyms > 0 {
+			return 0, fmt.Errorf("the symbol table cannot be removed: %v has indirect symbols", LcDysymtab)
+		}
+		if dt != nil {
+			// The hints, one for each undefined symbol, are none.
+			if _, err := t.RemoveLoadsOfType(LcTwolevelHints); err != nil {
+				return 0, err
+			}
+			if _, err := t.RemoveLoadsOfType(LcDysymtab); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := t.RemoveLoadsOfType(LcSymtab); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+	if err := t.replaceSymbols(st, dt, syms, from, group); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// neededSymbols returns, by number, which symbols of st StripAll keeps.
+func (t *FileTOC) neededSymbols(st *Symtab, dt *Dysymtab) []bool {
+	needed := make([]bool, len(st.Syms))
+	exports := t.Type == MhDylib || t.Type == MhBundle || t.Type == MhObject
+	for i, s := range st.Syms {
+		needed[i] = !s.IsStab() && (s.IsUndefined() || s.IsReferencedDynamically() ||
+			exports && s.IsExternal() && !s.IsPrivateExternal())
+	}
+	refer := func(i uint32) {
+		if int(i) < len(needed) {
+			needed[i] = true
+		}
+	}
+	if dt != nil {
+		for _, x := range dt.IndirectSyms {
+			if x&(IndirectSymbolLocal|IndirectSymbolAbs) == 0 {
+				refer(x)
+			}
+		}
+	}
+	for _, s := range t.Sections {
+		for _, r := range s.Relocs {
+			if !r.Scattered && r.Extern {
+				refer(r.Value)
+			}
+		}
+	}
+	return needed
+}
+
+// PackLinkedit moves the data the load commands of t locate in
+// __LINKEDIT, in b, the file t was read from, to close the gaps between
+// them, keeping their order, and each at the alignment of t's loads, or
+// a code signature at 16 bytes; __LINKEDIT, and the file, then end
+// where the last of them does, unless another segment follows it.
+// It writes the header and load commands, with the data's new offsets,
+// and returns the file.  It returns an error, and changes nothing, if
+// t has no __LINKEDIT, or two of the data overlap, or are not in b.
+func (t *FileTOC) PackLinkedit(b []byte) ([]byte, error) {
+	var linkedit *Segment
+	for _, l := range t.Loads {
+		if g, ok := l.(*Segment); ok && g.Name == "__LINKEDIT" {
+			linkedit = g
+		}
+	}
+	if linkedit == nil {
+		return nil, fmt.Errorf("there is no segment __LINKEDIT")
+	}
+	type datum struct {
+		r     fileRange
+		off   *uint32
+		align uint64
+	}
+	var data []datum
+	end := linkedit.Offset + linkedit.Filesz
+	for _, l := range t.Loads {
+		align := t.LoadAlign()
+		if l.Command() == LcCodeSignature {
+			align = 16
+		}
+		offs := linkeditOffsets(l)
+		for i, r := range t.loadRanges(l) {
+			if r.n > 0 && r.off >= linkedit.Offset && r.off < end {
+				data = append(data, datum{r, offs[i], align})
+			}
+		}
+	}
+	sort.SliceStable(data, func(i, j int) bool { return data[i].r.off < data[j].r.off })
+	for i, d := range data {
+		if i > 0 && d.r.off < data[i-1].r.end() {
+			return nil, fmt.Errorf("data at %#x in __LINKEDIT overlaps that at %#x", d.r.off, data[i-1].r.off)
+		}
+		if d.r.end() > uint64(len(b)) {
+			return nil, fmt.Errorf("data at %#x in __LINKEDIT extends beyond the %d-byte file", d.r.off, len(b))
+		}
+	}
+
+	next := linkedit.Offset
+	for _, d := range data {
+		to := RoundUp(next, d.align)
+		if to > d.r.off {
+			to = d.r.off // already as packed as its alignment allows
+		}
+		copy(b[to:to+d.r.n], b[d.r.off:d.r.end()])
+		*d.off = uint32(to)
+		next = to + d.r.n
+	}
+	last := true // in the file
+	for _, l := range t.Loads {
+		if g, ok := l.(*Segment); ok && g != linkedit && g.Offset+g.Filesz > linkedit.Offset {
+			last = false
+		}
+	}
+	if last && next < uint64(len(b)) {
+		b = b[:next]
+	}
+	for i := next; i < end && i < uint64(len(b)); i++ {
+		b[i] = 0
+	}
+	linkedit.Filesz = next - linkedit.Offset
+	t.Put(b)
+	return b, nil
+}
+
+// linkeditOffsets returns the offset fields of l, one for each range
+// loadRanges returns, in the same order.
+func linkeditOffsets(l Load) []*uint32 {
+	switch l := l.(type) {
+	case *Symtab:
+		return []*uint32{&l.Symoff, &l.Stroff}
+	case *Dysymtab:
+		return []*uint32{&l.Tocoffset, &l.Modtaboff, &l.Extrefsymoff, &l.Indirectsymoff, &l.Extreloff, &l.Locreloff}
+	case *DyldInfo:
+		return []*uint32{&l.RebaseOff, &l.BindOff, &l.WeakBindOff, &l.LazyBindOff, &l.ExportOff}
+	case *LinkEditData:
+		return []*uint32{&l.DataOff}
+	case *Symseg:
+		return []*uint32{&l.Offset}
+	case *TwolevelHints:
+		return []*uint32{&l.Offset}
+	}
+	return nil
+}
+
+// StripDWARF removes from t, and from b, the file t was read from, the
+// DWARF that a split has copied into a dSYM: the __DWARF segment, with
+// its sections, and any __debug_ or __zdebug_ section of another
+// segment, as RemoveLoad and RemoveSection remove them.  What followed
+// them in the file moves back, as RemoveSection says, and what followed
+// __DWARF, by as much of the room it took as keeps each segment's
+// offset congruent to its address; nothing moves in memory.  It writes
+// the header and load commands, with the new offsets and section
+// numbers, and returns the file, and how many sections it removed.  It
+// returns an error if t has no DWARF, or something that remains refers
+// to it, or the contents are not in b; t may then be partly changed.
+func (t *FileTOC) StripDWARF(b []byte) ([]byte, int, error) {
+	var dwarf *Segment
+	dwarfAt := -1
+	for i, l := range t.Loads {
+		if g, ok := l.(*Segment); ok && g.Name == "__DWARF" {
+			dwarf, dwarfAt = g, i
+		}
+	}
+	var inDwarf []*Section
+	if dwarf != nil {
+		_, sects, err := t.segmentSections(dwarf)
+		if err != nil {
+			return nil, 0, err
+		}
+		inDwarf = sects
+	}
+	var debug []*Section
+	for _, s := range t.Sections {
+		if name, _ := DWARFSection(s.Name); name != "" && !sectionIn(s, inDwarf) {
+			debug = append(debug, s)
+		}
+	}
+	if dwarf == nil && len(debug) == 0 {
+		return nil, 0, fmt.Errorf("there is no segment __DWARF, nor DWARF section")
+	}
+
+	// What remains, and where it is now; it is copied from there to
+	// wherever the removals leave it.
+	type piece struct {
+		from uint64
+		to   func() (uint64, uint64) // offset and size
+	}
+	var pieces []piece
+	add := func(from, n uint64, to func() (uint64, uint64)) error {
+		if n > 0 && from+n > uint64(len(b)) {
+			return fmt.Errorf("contents at %#x extend beyond the %d-byte file", from, len(b))
+		}
+		pieces = append(pieces, piece{from, to})
+		return nil
+	}
+	var err error
+	for _, l := range t.Loads {
+		if g, ok := l.(*Segment); ok && g != dwarf && g.Filesz > 0 {
+			err = add(g.Offset, g.Filesz, func() (uint64, uint64) { return g.Offset, g.Filesz })
+		}
+		offs := linkeditOffsets(l)
+		for i, r := range t.loadRanges(l) {
+			if p := offs[i]; err == nil && r.n > 0 {
+				n := r.n
+				err = add(r.off, n, func() (uint64, uint64) { return uint64(*p), n })
+			}
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	for _, s := range t.Sections {
+		if sectionIn(s, inDwarf) || sectionIn(s, debug) {
+			continue
+		}
+		s := s
+		if !s.Flags.IsZerofill() && s.Offset != 0 {
+			err = add(uint64(s.Offset), s.Size, func() (uint64, uint64) { return uint64(s.Offset), s.Size })
+		}
+		if err == nil && s.Nreloc > 0 {
+			err = add(uint64(s.Reloff), uint64(s.Nreloc)*RelocSize, func() (uint64, uint64) {
+				return uint64(s.Reloff), uint64(s.Nreloc) * RelocSize
+			})
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	n := len(inDwarf) + len(debug)
+	for _, s := range debug {
+		if err := t.RemoveSection(s); err != nil {
+			return nil, 0, err
+		}
+	}
+	if dwarf != nil {
+		if err := t.RemoveLoad(dwarfAt); err != nil {
+			return nil, 0, err
+		}
+		end := dwarf.Offset + dwarf.Filesz
+		if next := t.contentFrom(end); next != ^uint64(0) && dwarf.Filesz > 0 {
+			var after []*Section
+			for _, s := range t.Sections {
+				if !s.Flags.IsZerofill() && uint64(s.Offset) >= end {
+					after = append(after, s)
+				}
+			}
+			if d := RoundDown(next-dwarf.Offset, t.moveAlign(after, true)); d > 0 {
+				t.shiftFile(dwarf, nil, end, -int64(d))
+			}
+		}
+	}
+
+	size := t.FileSize()
+	if toc := uint64(t.TOCSize()); toc > size {
+		size = toc
+	}
+	for _, p := range pieces {
+		if off, n := p.to(); off+n > size {
+			size = off + n
+		}
+	}
+	out := make([]byte, size)
+	for _, p := range pieces {
+		off, n := p.to()
+		copy(out[off:off+n], b[p.from:p.from+n])
+	}
+	// The symbols' section numbers, which the removals renumbered.
+	if st, _ := t.symtabs(); st != nil {
+		for i, s := range st.Syms {
+			if at := uint64(st.Symoff) + uint64(i)*uint64(t.SymbolSize()) + 5; at < size {
+				out[at] = s.Sect
+			}
+		}
+	}
+	if err := t.PutRelocs(out); err != nil {
+		return nil, 0, err
+	}
+	if err := t.PutOver(out); err != nil {
+		return nil, 0, err
+	}
+	return out, n, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// A StringTable is the raw string table of a symbol table, together with
+// the offset of each symbol's name within it.  It answers questions about
+// symbol names without building a Symbol for every entry, which is much
+// cheaper when asking the same question of many files.
+//
+// The linker may share storage between a name and the tail of a longer
+// one, so names are found through the symbols' offsets, not by splitting
+// the table at NUL bytes.
+type StringTable struct {
+	data []byte
+	offs []uint32 // name offset of each symbol, in symbol table order
+}
+
+// StringTable reads f's symbol string table and the name offsets of its
+// symbols.  It returns nil and no error if f has no symbol table.
+func (f *File) StringTable() (*StringTable, error) {
+	if f.Symtab == nil {
+		return nil, nil
+	}
+	st := f.Symtab
+	data := make([]byte, st.Strsize)
+	if _, err := f.r.ReadAt(data, int64(st.Stroff)); err != nil {
+		return nil, err
+	}
+	size := int64(f.SymbolSize())
+	syms := make([]byte, int64(st.Nsyms)*size)
+	if _, err := f.r.ReadAt(syms, int64(st.Symoff)); err != nil {
+		return nil, err
+	}
+	t := &StringTable{data: data, offs: make([]uint32, st.Nsyms)}
+	for i := range t.offs {
+		off := f.ByteOrder.Uint32(syms[int64(i)*size:]) // n_strx comes first
+		if off >= uint32(len(data)) {
+			return nil, formatError(int64(st.Symoff)+int64(i)*size, "invalid name in symbol table, n.Name=%d, len(strtab)=%d", off, len(data))
+		}
+		t.offs[i] = off
+	}
+	return t, nil
+}
+
+// Bytes returns the raw string table.
+func (t *StringTable) Bytes() []byte { return t.data }
+
+// Len returns the number of symbols whose names the table holds.
+func (t *StringTable) Len() int { return len(t.offs) }
+
+// Name returns the name of the i'th symbol.
+func (t *StringTable) Name(i int) string { return string(t.name(i)) }
+
+// Lookup returns the NUL-terminated string at byte offset off,
+// or ok=false if off is outside the table.
+func (t *StringTable) Lookup(off uint32) (s string, ok bool) {
+	if off >= uint32(len(t.data)) {
+		return "", false
+	}
+	return cstring(t.data[off:]), true
+}
+
+func (t *StringTable) name(i int) []byte {
+	b := t.data[t.offs[i]:]
+	if j := bytes.IndexByte(b, 0); j >= 0 {
+		b = b[:j]
+	}
+	return b
+}
+
+// Contains reports whether some symbol is named name.
+func (t *StringTable) Contains(name string) bool {
+	// Most names are absent, and a quick search for the bytes
+	// rules them out without looking at any symbols.
+	if !bytes.Contains(t.data, []byte(name)) {
+		return false
+	}
+	for i := range t.offs {
+		if string(t.name(i)) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Search returns the names, in symbol table order, of the symbols for
+// which match returns true.  The slice passed to match must not be retained.
+// A name appears once for each symbol that has it.
+func (t *StringTable) Search(match func(name []byte) bool) []string {
+	var names []string
+	for i := range t.offs {
+		if n := t.name(i); match(n) {
+			names = append(names, string(n))
+		}
+	}
+	return names
+}
+
+// HasPrefix returns the names of the symbols that begin with prefix.
+func (t *StringTable) HasPrefix(prefix string) []string {
+	p := []byte(prefix)
+	return t.Search(func(n []byte) bool { return bytes.HasPrefix(n, p) })
+}
+
+// HasSuffix returns the names of the symbols that end with suffix.
+func (t *StringTable) HasSuffix(suffix string) []string {
+	s := []byte(suffix)
+	return t.Search(func(n []byte) bool { return bytes.HasSuffix(n, s) })
+}
+
+// Match returns the names of the symbols that re matches.
+func (t *StringTable) Match(re *regexp.Regexp) []string {
+	return t.Search(re.Match)
+}
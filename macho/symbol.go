@@ -0,0 +1,210 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+// The fields of a symbol's Type (n_type), from <mach-o/nlist.h>.  If
+// any NStab bit is set, the symbol is a debugging (stab) entry, and
+// the whole of Type is its StabType.
+const (
+	NStab uint8 = 0xe0
+	NPext uint8 = 0x10 // private external
+	NType uint8 = 0x0e
+	NExt  uint8 = 0x01 // external
+)
+
+// The values of the NType bits of a symbol's Type.
+const (
+	NUndf uint8 = 0x0 // undefined
+	NAbs  uint8 = 0x2 // absolute, defined in no section
+	NIndr uint8 = 0xa // indirect, an alias of the symbol Value names
+	NPbud uint8 = 0xc // prebound undefined
+	NSect uint8 = 0xe // defined in section Sect
+)
+
+// The flags of a symbol's Desc (n_desc).  Some bits mean one thing
+// for defined symbols and another for undefined ones.
+const (
+	ReferenceTypeMask     uint16 = 0x0007 // for undefined symbols in objects, how they are referred to
+	ReferencedDynamically uint16 = 0x0010 // never strip
+	NNoDeadStrip          uint16 = 0x0020 // in objects, defined: keep even if unreferenced
+	NDescDiscarded        uint16 = 0x0020 // in images, defined: discarded by the linker
+	NWeakRef              uint16 = 0x0040 // undefined: may be missing at run time
+	NWeakDef              uint16 = 0x0080 // defined: may be coalesced with another definition
+	NRefToWeak            uint16 = 0x0080 // undefined: refers to a weak definition
+	NArmThumbDef          uint16 = 0x0008 // defined: a Thumb function
+	NSymbolResolver       uint16 = 0x0100 // defined: a resolver function
+	NAltEntry             uint16 = 0x0200 // defined: an entry point into the middle of a function
+	NColdFunc             uint16 = 0x0400 // defined: rarely used
+)
+
+// Library ordinals with special meanings, as LibraryOrdinal returns them.
+const (
+	SelfLibraryOrdinal   uint8 = 0x00 // this image
+	DynamicLookupOrdinal uint8 = 0xfe // looked up by name in every image
+	ExecutableOrdinal    uint8 = 0xff // the main executable
+)
+
+// A StabType is the Type of a debugging (stab) symbol, from
+// <mach-o/stab.h>.
+type StabType uint8
+
+const (
+	NGsym    StabType = 0x20 // global symbol
+	NFname   StabType = 0x22 // procedure name (f77 kludge)
+	NFun     StabType = 0x24 // procedure; Value is its address, then its size
+	NStsym   StabType = 0x26 // static symbol
+	NLcsym   StabType = 0x28 // .lcomm symbol
+	NBnsym   StabType = 0x2e // begin nsect symbol
+	NAst     StabType = 0x32 // AST file path
+	NOpt     StabType = 0x3c // emitted with gcc2_compiled and in gcc source
+	NRsym    StabType = 0x40 // register symbol
+	NSline   StabType = 0x44 // source line
+	NEnsym   StabType = 0x4e // end nsect symbol
+	NSsym    StabType = 0x60 // structure element
+	NSo      StabType = 0x64 // source file name
+	NOso     StabType = 0x66 // object file name; Value is its modification time
+	NLsym    StabType = 0x80 // local symbol
+	NBincl   StabType = 0x82 // include file beginning
+	NSol     StabType = 0x84 // #included file name
+	NParams  StabType = 0x86 // compiler parameters
+	NVersion StabType = 0x88 // compiler version
+	NOlevel  StabType = 0x8a // compiler optimization level
+	NPsym    StabType = 0xa0 // parameter
+	NEincl   StabType = 0xa2 // include file end
+	NEntry   StabType = 0xa4 // alternate entry point
+	NLbrac   StabType = 0xc0 // left bracket
+	NExcl    StabType = 0xc2 // deleted include file
+	NRbrac   StabType = 0xe0 // right bracket
+	NBcomm   StabType = 0xe2 // begin common
+	NEcomm   StabType = 0xe4 // end common
+	NEcoml   StabType = 0xe8 // end common (local name)
+	NLeng    StabType = 0xfe // second stab entry with length information
+)
+
+var stabTypeStrings = []intName{
+	{uint32(NGsym), "NGsym"},
+	{uint32(NFname), "NFname"},
+	{uint32(NFun), "NFun"},
+	{uint32(NStsym), "NStsym"},
+	{uint32(NLcsym), "NLcsym"},
+	{uint32(NBnsym), "NBnsym"},
+	{uint32(NAst), "NAst"},
+	{uint32(NOpt), "NOpt"},
+	{uint32(NRsym), "NRsym"},
+	{uint32(NSline), "NSline"},
+	{uint32(NEnsym), "NEnsym"},
+	{uint32(NSsym), "NSsym"},
+	{uint32(NSo), "NSo"},
+	{uint32(NOso), "NOso"},
+	{uint32(NLsym), "NLsym"},
+	{uint32(NBincl), "NBincl"},
+	{uint32(NSol), "NSol"},
+	{uint32(NParams), "NParams"},
+	{uint32(NVersion), "NVersion"},
+	{uint32(NOlevel), "NOlevel"},
+	{uint32(NPsym), "NPsym"},
+	{uint32(NEincl), "NEincl"},
+	{uint32(NEntry), "NEntry"},
+	{uint32(NLbrac), "NLbrac"},
+	{uint32(NExcl), "NExcl"},
+	{uint32(NRbrac), "NRbrac"},
+	{uint32(NBcomm), "NBcomm"},
+	{uint32(NEcomm), "NEcomm"},
+	{uint32(NEcoml), "NEcoml"},
+	{uint32(NLeng), "NLeng"},
+}
+
+func (i StabType) String() string   { return stringName(uint32(i), stabTypeStrings, false) }
+func (i StabType) GoString() string { return stringName(uint32(i), stabTypeStrings, true) }
+
+// IsStab reports whether s is a debugging (stab) entry rather than a
+// symbol.
+func (s Symbol) IsStab() bool { return s.Type&NStab != 0 }
+
+// StabType returns the kind of debugging entry s is, or 0 if s is not one.
+func (s Symbol) StabType() StabType {
+	if !s.IsStab() {
+		return 0
+	}
+	return StabType(s.Type)
+}
+
+// Kind returns the NType bits of a symbol's Type: NUndf, NAbs, NSect,
+// NPbud, or NIndr.  It returns 0 for a stab.
+func (s Symbol) Kind() uint8 {
+	if s.IsStab() {
+		return 0
+	}
+	return s.Type & NType
+}
+
+// IsExternal reports whether s is visible outside its image, or for a
+// private external, outside its object file.
+func (s Symbol) IsExternal() bool { return !s.IsStab() && s.Type&NExt != 0 }
+
+// IsPrivateExternal reports whether s was external in its object file
+// but was made local to the image when it was linked.
+func (s Symbol) IsPrivateExternal() bool { return !s.IsStab() && s.Type&NPext != 0 }
+
+// IsUndefined reports whether s is a symbol that another image, or
+// another object file, defines.
+func (s Symbol) IsUndefined() bool {
+	k := s.Kind()
+	return !s.IsStab() && (k == NUndf || k == NPbud)
+}
+
+// IsDefinedInSection reports whether s is defined in a section, which
+// is f.Sections[s.Sect-1].
+func (s Symbol) IsDefinedInSection() bool { return s.Kind() == NSect && s.Sect != 0 }
+
+// IsWeakDef reports whether s is a weak definition, which may be
+// coalesced with another.
+func (s Symbol) IsWeakDef() bool { return !s.IsStab() && !s.IsUndefined() && s.Desc&NWeakDef != 0 }
+
+// IsWeakRef reports whether s is a weak reference, which may be missing
+// at run time.
+func (s Symbol) IsWeakRef() bool { return s.IsUndefined() && s.Desc&NWeakRef != 0 }
+
+// IsReferencedDynamically reports whether s is marked never to be
+// stripped, because it is looked up at run time.
+func (s Symbol) IsReferencedDynamically() bool {
+	return !s.IsStab() && s.Desc&ReferencedDynamically != 0
+}
+
+// LibraryOrdinal returns, for an undefined symbol of an image linked
+// with two-level namespaces, the library that defines it: the 1-based
+// index of its LC_LOAD_DYLIB among the dylib commands, or one of
+// SelfLibraryOrdinal, DynamicLookupOrdinal, and ExecutableOrdinal.
+func (s Symbol) LibraryOrdinal() uint8 { return uint8(s.Desc >> 8) }
+
+// WeakDefinitions returns the symbols of f that are weak definitions,
+// in symbol table order.  dyld coalesces such a definition with those
+// of other images, by f's weak binds (see WeakBinds), or the linker with
+// those of other object files; the image whose definition is used can
+// interpose on the others.  It returns nil if f has no symbol table.
+func (f *File) WeakDefinitions() []Symbol {
+	return f.symbolsWhere(Symbol.IsWeakDef)
+}
+
+// WeakReferences returns the undefined symbols of f that are weak
+// references, in symbol table order, which dyld binds to 0 if no image
+// defines them.  It returns nil if f has no symbol table.
+func (f *File) WeakReferences() []Symbol {
+	return f.symbolsWhere(Symbol.IsWeakRef)
+}
+
+// symbolsWhere returns the symbols of f for which keep is true.
+func (f *File) symbolsWhere(keep func(Symbol) bool) []Symbol {
+	if f.Symtab == nil {
+		return nil
+	}
+	var syms []Symbol
+	for _, s := range f.Symtab.Syms {
+		if keep(s) {
+			syms = append(syms, s)
+		}
+	}
+	return syms
+}
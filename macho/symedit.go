@@ -0,0 +1,436 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The symbols of a FileTOC read from a file can be renamed, removed,
+// and given aliases, and then written back, with PutSymtab, into the
+// file's own bytes.  Symbols are numbered by their place in the symbol
+// table, and LC_DYSYMTAB's ranges of them, its indirect symbol table,
+// and sections' relocations refer to them by number, so removing or
+// adding a symbol renumbers those that follow it, and what refers to
+// them.  Nothing else is changed: a renamed export keeps its old name
+// in the export trie of LC_DYLD_INFO or LC_DYLD_EXPORTS_TRIE, and a
+// code signature no longer matches the file.
+
+// RenameSymbol renames each symbol of t named from, stabs aside, to
+// to.  It returns an error, and changes nothing, if there is none.
+func (t *FileTOC) RenameSymbol(from, to string) error {
+	st, _ := t.symtabs()
+	if st == nil {
+		return fmt.Errorf("there is no %v", LcSymtab)
+	}
+	if err := checkSymbolName(to); err != nil {
+		return err
+	}
+	n := 0
+	for i := range st.Syms {
+		if s := &st.Syms[i]; !s.IsStab() && s.Name == from {
+			s.Name = to
+			n++
+		}
+	}
+	if n == 0 {
+		return fmt.Errorf("there is no symbol %s", from)
+	}
+	return nil
+}
+
+// RemoveSymbols removes each symbol of t for which remove returns true,
+// and returns how many it removed.  It returns an error, and changes
+// nothing, if something still refers to one of them, or the symbols
+// would be renumbered but LC_DYSYMTAB refers to them in a way this
+// does not renumber: by external relocations, references, a table of
+// contents, or a module table, as only files from old linkers do.
+func (t *FileTOC) RemoveSymbols(remove func(Symbol) bool) (int, error) {
+	st, dt := t.symtabs()
+	if st == nil {
+		return 0, fmt.Errorf("there is no %v", LcSymtab)
+	}
+	groups, err := symbolGroups(st, dt)
+	if err != nil {
+		return 0, err
+	}
+	var syms []Symbol
+	var from, group []int
+	for i, s := range st.Syms {
+		if !remove(s) {
+			syms = append(syms, s)
+			from = append(from, i)
+			group = append(group, groups[i])
+		}
+	}
+	n := len(st.Syms) - len(syms)
+	if err := t.replaceSymbols(st, dt, syms, from, group); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// AddAlias adds a symbol alias, defined as the symbol target is, at the
+// same address, after the other symbols of its kind, local or external.
+// It returns an error, and changes nothing, if there is not exactly one
+// symbol target that is defined, or a symbol alias is already defined,
+// or the symbols cannot be renumbered, as for RemoveSymbols.
+func (t *FileTOC) AddAlias(alias, target string) error {
+	st, dt := t.symtabs()
+	if st == nil {
+		return fmt.Errorf("there is no %v", LcSymtab)
+	}
+	if err := checkSymbolName(alias); err != nil {
+		return err
+	}
+	groups, err := symbolGroups(st, dt)
+	if err != nil {
+		return err
+	}
+	defined := func(s Symbol) bool { return !s.IsStab() && !s.IsUndefined() && s.Kind() != NIndr }
+	at := -1
+	for i, s := range st.Syms {
+		switch {
+		case !defined(s):
+		case s.Name == alias:
+			return fmt.Errorf("symbol %s is already defined", alias)
+		case s.Name == target && at >= 0:
+			return fmt.Errorf("symbol %s is defined more than once", target)
+		case s.Name == target:
+			at = i
+		}
+	}
+	if at < 0 {
+		return fmt.Errorf("there is no defined symbol %s", target)
+	}
+	// The alias goes after the last symbol of the target's group.
+	last := at
+	for last+1 < len(st.Syms) && groups[last+1] == groups[at] {
+		last++
+	}
+	a := st.Syms[at]
+	a.Name = alias
+	var syms []Symbol
+	var from, group []int
+	for i, s := range st.Syms {
+		syms = append(syms, s)
+		from = append(from, i)
+		group = append(group, groups[i])
+		if i == last {
+			syms = append(syms, a)
+			from = append(from, -1)
+			group = append(group, groups[at])
+		}
+	}
+	return t.replaceSymbols(st, dt, syms, from, group)
+}
+
+// symtabs returns t's LC_SYMTAB and LC_DYSYMTAB, or nil for either it
+// does not have.
+func (t *FileTOC) symtabs() (st *Symtab, dt *Dysymtab) {
+	for _, l := range t.Loads {
+		switch l := l.(type) {
+		case *Symtab:
+			st = l
+		case *Dysymtab:
+			dt = l
+		}
+	}
+	return st, dt
+}
+
+// Symbols are, in order, in one of these groups of LC_DYSYMTAB.
+const (
+	localSymbols = iota
+	extdefSymbols
+	undefSymbols
+)
+
+// symbolGroups returns the group of each symbol of st, which are all
+// local if there is no dt.  It returns an error if dt's ranges are not
+// the local, externally defined, and undefined symbols in turn, as the
+// linker writes them.
+func symbolGroups(st *Symtab, dt *Dysymtab) ([]int, error) {
+	groups := make([]int, len(st.Syms))
+	if dt == nil {
+		return groups, nil
+	}
+	if dt.Ilocalsym != 0 || dt.Iextdefsym != dt.Nlocalsym || dt.Iundefsym != dt.Iextdefsym+dt.Nextdefsym ||
+		int(dt.Iundefsym+dt.Nundefsym) != len(st.Syms) {
+		return nil, fmt.Errorf("%v's ranges are not the local, externally defined, and undefined symbols of the %d in turn", LcDysymtab, len(st.Syms))
+	}
+	for i := range groups {
+		switch {
+		case uint32(i) >= dt.Iundefsym:
+			groups[i] = undefSymbols
+		case uint32(i) >= dt.Iextdefsym:
+			groups[i] = extdefSymbols
+		}
+	}
+	return groups, nil
+}
+
+// replaceSymbols replaces the symbols of st with syms, where from[i] is
+// the number of syms[i] among those of st, or -1 if it is new, and
+// group[i] its group, which never decreases.  It renumbers what refers
+// to a symbol by number, sets dt's ranges, and keeps the two-level
+// hints of the undefined symbols that remain, or returns an error, and
+// changes nothing, if something refers to a symbol that is gone, or
+// cannot be renumbered, or the hints are not those of st's undefined
+// symbols, or a new undefined symbol would have none.
+func (t *FileTOC) replaceSymbols(st *Symtab, dt *Dysymtab, syms []Symbol, from, group []int) error {
+	renum := make([]int, len(st.Syms))
+	for i := range renum {
+		renum[i] = -1
+	}
+	for i, o := range from {
+		if o >= 0 {
+			renum[o] = i
+		}
+	}
+	moved := len(syms) != len(st.Syms)
+	for o, n := range renum {
+		moved = moved || n != o
+	}
+	if !moved {
+		return nil
+	}
+	name := func(i uint32) string {
+		if int(i) < len(st.Syms) {
+			return st.Syms[i].Name
+		}
+		return fmt.Sprintf("%d", i)
+	}
+	gone := func(i uint32) bool { return int(i) >= len(renum) || renum[i] < 0 }
+	if dt != nil {
+		if dt.Nextrel > 0 || dt.Nextrefsyms > 0 || dt.Ntoc > 0 || dt.Nmodtab > 0 {
+			return fmt.Errorf("%v refers to symbols by number in external relocations, references, a table of contents, or a module table", LcDysymtab)
+		}
+		for i, x := range dt.IndirectSyms {
+			if x&(IndirectSymbolLocal|IndirectSymbolAbs) == 0 && gone(x) {
+				return fmt.Errorf("indirect symbol %d refers to symbol %s", i, name(x))
+			}
+		}
+	}
+	for _, s := range t.Sections {
+		for _, r := range s.Relocs {
+			if !r.Scattered && r.Extern && gone(r.Value) {
+				return fmt.Errorf("section %s,%s: the relocation at %#x refers to symbol %s", s.Seg, s.Name, r.Addr, name(r.Value))
+			}
+		}
+	}
+	hints := make(map[*TwolevelHints][]TwolevelHint)
+	for _, l := range t.Loads {
+		h, ok := l.(*TwolevelHints)
+		if !ok {
+			continue
+		}
+		if dt == nil || len(h.Hints) != int(dt.Nundefsym) {
+			return fmt.Errorf("%v has %d hints, not one for each undefined symbol", h.Command(), len(h.Hints))
+		}
+		kept := []TwolevelHint{}
+		for i, o := range from {
+			if group[i] != undefSymbols {
+				continue
+			}
+			if o < 0 {
+				return fmt.Errorf("%v has no hint for the new undefined symbol %s", h.Command(), syms[i].Name)
+			}
+			kept = append(kept, h.Hints[o-int(dt.Iundefsym)])
+		}
+		hints[h] = kept
+	}
+
+	if dt != nil {
+		for i, x := range dt.IndirectSyms {
+			if x&(IndirectSymbolLocal|IndirectSymbolAbs) == 0 {
+				dt.IndirectSyms[i] = uint32(renum[x])
+			}
+		}
+		var n [3]uint32
+		for _, g := range group {
+			n[g]++
+		}
+		dt.Ilocalsym, dt.Nlocalsym = 0, n[localSymbols]
+		dt.Iextdefsym, dt.Nextdefsym = n[localSymbols], n[extdefSymbols]
+		dt.Iundefsym, dt.Nundefsym = n[localSymbols]+n[extdefSymbols], n[undefSymbols]
+	}
+	for _, s := range t.Sections {
+		for i := range s.Relocs {
+			if r := &s.Relocs[i]; !r.Scattered && r.Extern {
+				r.Value = uint32(renum[r.Value])
+			}
+		}
+	}
+	for h, kept := range hints {
+		h.Hints, h.Nhints = kept, uint32(len(kept))
+	}
+	st.Syms = syms
+	return nil
+}
+
+// checkSymbolName returns an error if name cannot be a symbol's name,
+// being empty, or holding a NUL.
+func checkSymbolName(name string) error {
+	if name == "" || strings.IndexByte(name, 0) >= 0 {
+		return fmt.Errorf("invalid symbol name %q", name)
+	}
+	return nil
+}
+
+// PutSymtab writes the symbols of t, as edited, into b, the file t was
+// read from, and returns the file, which may have grown or shrunk.  The
+// symbols, and the string table of their names, each go where they
+// were, if they still fit there, or if not, after the rest of the
+// file's contents, in __LINKEDIT, if there is one, which grows to hold
+// them.  __LINKEDIT then ends where its last data does, and the file
+// with it, unless something follows it.  The indirect symbol table,
+// the two-level hints, which only shrink, the sections' relocations,
+// and the header and load commands, with
+// LC_SYMTAB's offsets and sizes, are written where they were, and what
+// the old tables held, and the new do not, is zeroed.  It returns an
+// error, and changes nothing, if __LINKEDIT would grow in memory into
+// another segment, or LC_DYSYMTAB has a module table, which refers to
+// the string table.
+func (t *FileTOC) PutSymtab(b []byte) ([]byte, error) {
+	st, dt := t.symtabs()
+	if st == nil {
+		return nil, fmt.Errorf("there is no %v", LcSymtab)
+	}
+	if dt != nil && dt.Nmodtab > 0 {
+		return nil, fmt.Errorf("%v has a module table, which refers to the string table", LcDysymtab)
+	}
+	align := t.LoadAlign()
+
+	// The new tables.
+	size := uint64(t.SymbolSize())
+	syms := make([]byte, uint64(len(st.Syms))*size)
+	strs := []byte{' ', 0}
+	names := make(map[string]uint32)
+	for i, s := range st.Syms {
+		n := Nlist64{Name: 1, Type: s.Type, Sect: s.Sect, Desc: s.Desc, Value: s.Value} // 1 is the NUL of " "
+		if s.Name != "" {
+			off, ok := names[s.Name]
+			if !ok {
+				off = uint32(len(strs))
+				names[s.Name] = off
+				strs = append(append(strs, s.Name...), 0)
+			}
+			n.Name = off
+		}
+		if t.Magic == Magic64 {
+			n.Put64(syms[uint64(i)*size:], t.ByteOrder)
+		} else {
+			n.Put32(syms[uint64(i)*size:], t.ByteOrder)
+		}
+	}
+	for uint64(len(strs))%align != 0 {
+		strs = append(strs, 0)
+	}
+
+	// Where they go: where the old were, or after everything else.
+	var linkedit *Segment
+	end := uint64(0)
+	grow := func(e uint64) {
+		if e > end {
+			end = e
+		}
+	}
+	for _, l := range t.Loads {
+		if g, ok := l.(*Segment); ok {
+			if g.Name == "__LINKEDIT" {
+				linkedit = g
+				grow(g.Offset)
+			} else {
+				grow(g.Offset + g.Filesz)
+			}
+			continue
+		}
+		if l != st {
+			for _, r := range t.loadRanges(l) {
+				grow(r.end())
+			}
+		}
+	}
+	for _, s := range t.Sections {
+		grow(uint64(s.Reloff) + uint64(s.Nreloc)*RelocSize)
+	}
+	old := []fileRange{{uint64(st.Symoff), uint64(st.Nsyms) * size}, {uint64(st.Stroff), uint64(st.Strsize)}}
+	contents := end
+	for _, r := range old {
+		if r.end() > contents {
+			contents = r.end()
+		}
+	}
+	if linkedit != nil && linkedit.Offset+linkedit.Filesz > contents {
+		contents = linkedit.Offset + linkedit.Filesz
+	}
+	if uint64(len(b)) > contents {
+		grow(uint64(len(b))) // what follows is not the tables' to reuse
+	}
+	tables := [][]byte{syms, strs}
+	var offs [2]uint64
+	for i, r := range old {
+		if r.off != 0 && uint64(len(tables[i])) <= r.n {
+			offs[i] = r.off
+			grow(r.off + uint64(len(tables[i])))
+		}
+	}
+	for i := range offs {
+		if offs[i] == 0 && len(tables[i]) > 0 {
+			offs[i] = RoundUp(end, align)
+			end = offs[i] + uint64(len(tables[i]))
+		}
+	}
+	if offs[1]+uint64(len(strs)) > 1<<32-1 {
+		return nil, fmt.Errorf("the string table would end beyond 4GB, which its offset cannot reach")
+	}
+	newLen := end
+	if linkedit != nil {
+		filesz := end - linkedit.Offset
+		memsz := linkedit.Memsz
+		if filesz > memsz {
+			memsz = RoundUp(filesz, maxPageSize)
+			for _, l := range t.Loads {
+				if g, ok := l.(*Segment); ok && g != linkedit && g.Memsz > 0 &&
+					g.Addr < linkedit.Addr+memsz && linkedit.Addr < g.Addr+g.Memsz {
+					return nil, fmt.Errorf("segment __LINKEDIT would grow in memory into segment %s", g.Name)
+				}
+			}
+		}
+		linkedit.Filesz, linkedit.Memsz = filesz, memsz
+	}
+
+	// Write them.
+	for _, r := range old {
+		for i := r.off; i < r.end() && i < uint64(len(b)); i++ {
+			b[i] = 0
+		}
+	}
+	if newLen > uint64(len(b)) {
+		b = append(b, make([]byte, newLen-uint64(len(b)))...)
+	}
+	b = b[:newLen]
+	st.Symoff, st.Nsyms = uint32(offs[0]), uint32(len(st.Syms))
+	st.Stroff, st.Strsize = uint32(offs[1]), uint32(len(strs))
+	copy(b[offs[0]:], syms)
+	copy(b[offs[1]:], strs)
+	if dt != nil {
+		for i, x := range dt.IndirectSyms {
+			t.ByteOrder.PutUint32(b[uint64(dt.Indirectsymoff)+4*uint64(i):], x)
+		}
+	}
+	for _, l := range t.Loads {
+		if h, ok := l.(*TwolevelHints); ok && h.Nhints > 0 {
+			h.PutHints(b[h.Offset:], t.ByteOrder)
+		}
+	}
+	if err := t.PutRelocs(b); err != nil {
+		return nil, err
+	}
+	t.Put(b)
+	return b, nil
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import "fmt"
+
+// A SectionTransform rewrites the contents of a section as a tool such
+// as sd copies it: mapping paths, redacting, or recompressing.  It is
+// given the section, as it is in the input, and its contents,
+// uncompressed and with any other edits already made, and returns the
+// contents to write in their place.  It may return data unchanged.
+type SectionTransform func(s *Section, data []byte) ([]byte, error)
+
+var sectionTransforms []SectionTransform
+
+// RegisterSectionTransform adds t to the transforms that
+// SectionTransforms returns, after those registered before it.  It is
+// meant to be called from init functions, so that a program built with
+// an extra file registering a transform applies it without changes to
+// the code that copies sections.
+func RegisterSectionTransform(t SectionTransform) {
+	compressionMu.Lock()
+	sectionTransforms = append(sectionTransforms, t)
+	compressionMu.Unlock()
+}
+
+// SectionTransforms returns the registered transforms, in order.
+func SectionTransforms() []SectionTransform {
+	compressionMu.Lock()
+	defer compressionMu.Unlock()
+	return append([]SectionTransform(nil), sectionTransforms...)
+}
+
+// ApplyTransforms passes data, the contents of s, through each of
+// transforms in turn, and returns the result.
+func ApplyTransforms(transforms []SectionTransform, s *Section, data []byte) ([]byte, error) {
+	for i, t := range transforms {
+		var err error
+		if data, err = t(s, data); err != nil {
+			return nil, fmt.Errorf("section %s: transform %d: %v", s.Name, i, err)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,694 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// An UnwindRule says how to find the canonical frame address (CFA),
+// the value of the stack pointer just before the call.
+type UnwindRule uint8
+
+const (
+	UnwindUnknown UnwindRule = iota // not expressible in this table; fall back to frame pointers, or stop
+	UnwindSP                        // CFA = SP + CFAOffset
+	UnwindFP                        // CFA = FP + CFAOffset
+)
+
+var unwindRuleStrings = []intName{
+	{uint32(UnwindUnknown), "UnwindUnknown"},
+	{uint32(UnwindSP), "UnwindSP"},
+	{uint32(UnwindFP), "UnwindFP"},
+}
+
+func (i UnwindRule) String() string   { return stringName(uint32(i), unwindRuleStrings, false) }
+func (i UnwindRule) GoString() string { return stringName(uint32(i), unwindRuleStrings, true) }
+
+// An UnwindRow says how to unwind one frame from the code at PC up to
+// the next row's PC.
+type UnwindRow struct {
+	PC        uint64
+	CFA       UnwindRule
+	CFAOffset int64
+	RAOffset  int64 // where the return address is saved, from the CFA; 0 if it is still in the link register
+	FPOffset  int64 // where the caller's frame pointer is saved, from the CFA; 0 if the frame pointer is unchanged
+}
+
+// UnwindTable returns, sorted by PC, the rows needed to unwind f's code
+// from any PC, for profilers that walk the stacks of stripped binaries.
+// It reads compact unwind (__unwind_info), and __eh_frame for the
+// functions compact unwind defers to it, or if there is no compact
+// unwind.  Compact unwind describes the body of a function, not its
+// prologue and epilogue; __eh_frame is exact.  Adjacent rows with the
+// same rule are merged, and the last row, at the end of the code, is
+// UnwindUnknown.  Only amd64 and arm64 are supported.
+func (f *File) UnwindTable() ([]UnwindRow, error) {
+	var arch unwindArch
+	switch f.Cpu {
+	case CpuAmd64:
+		arch = unwindArch{sp: 7, fp: 6, ra: 16, ptrSize: 8}
+	case CpuArm64:
+		arch = unwindArch{sp: 31, fp: 29, ra: 30, ptrSize: 8, lr: true}
+	default:
+		return nil, fmt.Errorf("unwind tables for %v are not supported", f.Cpu)
+	}
+	var eh []UnwindRow
+	if s := f.Section("__eh_frame"); s != nil && s.Offset != 0 {
+		b, err := s.Data()
+		if err != nil {
+			return nil, err
+		}
+		if eh, err = ehFrameRows(b, s.Addr, f.ByteOrder, &arch); err != nil {
+			return nil, fmt.Errorf("__eh_frame: %v", err)
+		}
+	}
+	s := f.Section("__unwind_info")
+	if s == nil || s.Offset == 0 {
+		return eh, nil
+	}
+	b, err := s.Data()
+	if err != nil {
+		return nil, err
+	}
+	funcs, err := compactUnwind(b, f.ByteOrder)
+	if err != nil {
+		return nil, fmt.Errorf("__unwind_info: %v", err)
+	}
+	base := f.imageBase()
+	var t unwindTable
+	for i, fn := range funcs {
+		start := base + uint64(fn.offset)
+		if i == len(funcs)-1 {
+			t.add(UnwindRow{PC: start}) // the sentinel, at the end of the code
+			break
+		}
+		end := base + uint64(funcs[i+1].offset)
+		row, dwarf, err := f.compactRow(fn.encoding, start, &arch)
+		if err != nil {
+			return nil, err
+		}
+		if !dwarf {
+			t.add(row)
+			continue
+		}
+		j := sort.Search(len(eh), func(j int) bool { return eh[j].PC > start }) - 1
+		if j < 0 {
+			j = 0
+		}
+		t.add(UnwindRow{PC: start})
+		for ; j < len(eh) && eh[j].PC < end; j++ {
+			r := eh[j]
+			if r.PC < start {
+				r.PC = start
+			}
+			t.add(r)
+		}
+	}
+	return t.rows, nil
+}
+
+// imageBase returns the address of the segment holding the Mach-O
+// header, from which compact unwind and some fixups count.
+func (f *File) imageBase() uint64 {
+	for _, l := range f.Loads {
+		if s, ok := l.(*Segment); ok && s.Offset == 0 && s.Filesz != 0 {
+			return s.Addr
+		}
+	}
+	return 0
+}
+
+// An unwindArch is what unwinding needs to know of an architecture:
+// the DWARF numbers of its stack pointer, frame pointer, and return
+// address column, and whether calls leave the return address in a
+// link register rather than on the stack.
+type unwindArch struct {
+	sp, fp, ra uint64
+	ptrSize    int64
+	lr         bool
+}
+
+// An unwindTable accumulates rows in PC order, merging rows that change
+// nothing and letting a later row at the same PC replace an earlier one.
+type unwindTable struct {
+	rows []UnwindRow
+}
+
+func (t *unwindTable) add(r UnwindRow) {
+	if n := len(t.rows); n > 0 {
+		if last := &t.rows[n-1]; last.PC == r.PC {
+			t.rows = t.rows[:n-1]
+		}
+	}
+	if n := len(t.rows); n > 0 {
+		last := t.rows[n-1]
+		if last.CFA == r.CFA && last.CFAOffset == r.CFAOffset && last.RAOffset == r.RAOffset && last.FPOffset == r.FPOffset {
+			return
+		}
+	}
+	t.rows = append(t.rows, r)
+}
+
+// A compactFunc is an entry of the compact unwind table.
+type compactFunc struct {
+	offset   uint32 // from the image base
+	encoding uint32
+}
+
+// compactUnwind reads the functions of an __unwind_info section,
+// ending with the sentinel entry that marks the end of the code.
+func compactUnwind(b []byte, o binary.ByteOrder) ([]compactFunc, error) {
+	u32 := func(off uint64) uint32 {
+		if off+4 > uint64(len(b)) {
+			return 0
+		}
+		return o.Uint32(b[off:])
+	}
+	u16 := func(off uint64) uint16 {
+		if off+2 > uint64(len(b)) {
+			return 0
+		}
+		return o.Uint16(b[off:])
+	}
+	if len(b) < 28 || u32(0) != 1 {
+		return nil, fmt.Errorf("unsupported version %d", u32(0))
+	}
+	commonOff, ncommon := uint64(u32(4)), uint64(u32(8))
+	indexOff, nindex := uint64(u32(20)), uint64(u32(24))
+	if commonOff+4*ncommon > uint64(len(b)) || indexOff+12*nindex > uint64(len(b)) || nindex == 0 {
+		return nil, fmt.Errorf("tables extend past the end")
+	}
+	var funcs []compactFunc
+	for i := uint64(0); i < nindex; i++ {
+		e := indexOff + 12*i
+		funcOff, page := u32(e), uint64(u32(e+4))
+		if page == 0 {
+			// The last entry has no page; it marks the end of the code.
+			funcs = append(funcs, compactFunc{offset: funcOff})
+			continue
+		}
+		switch kind := u32(page); kind {
+		case 2: // regular
+			entries, n := page+uint64(u16(page+4)), uint64(u16(page+6))
+			if entries+8*n > uint64(len(b)) {
+				return nil, fmt.Errorf("page %d extends past the end", i)
+			}
+			for j := uint64(0); j < n; j++ {
+				funcs = append(funcs, compactFunc{u32(entries + 8*j), u32(entries + 8*j + 4)})
+			}
+		case 3: // compressed
+			entries, n := page+uint64(u16(page+4)), uint64(u16(page+6))
+			encodings, nenc := page+uint64(u16(page+8)), uint64(u16(page+10))
+			if entries+4*n > uint64(len(b)) || encodings+4*nenc > uint64(len(b)) {
+				return nil, fmt.Errorf("page %d extends past the end", i)
+			}
+			for j := uint64(0); j < n; j++ {
+				e := u32(entries + 4*j)
+				fn := compactFunc{offset: funcOff + e&0xffffff}
+				switch k := uint64(e >> 24); {
+				case k < ncommon:
+					fn.encoding = u32(commonOff + 4*k)
+				case k-ncommon < nenc:
+					fn.encoding = u32(encodings + 4*(k-ncommon))
+				default:
+					return nil, fmt.Errorf("page %d entry %d has encoding %d of %d", i, j, k, ncommon+nenc)
+				}
+				funcs = append(funcs, fn)
+			}
+		default:
+			return nil, fmt.Errorf("page %d has unknown kind %d", i, kind)
+		}
+	}
+	sort.SliceStable(funcs, func(i, j int) bool { return funcs[i].offset < funcs[j].offset })
+	return funcs, nil
+}
+
+// compactRow turns a compact unwind encoding for the function at start
+// into a row, or reports that the encoding defers to __eh_frame.
+func (f *File) compactRow(enc uint32, start uint64, arch *unwindArch) (row UnwindRow, dwarf bool, err error) {
+	row.PC = start
+	mode := enc >> 24 & 0xf
+	if f.Cpu == CpuArm64 {
+		switch mode {
+		case 2: // frameless: the return address is still in LR
+			row.CFA, row.CFAOffset = UnwindSP, int64(enc>>12&0xfff)*16
+		case 3:
+			return row, true, nil
+		case 4: // frame
+			row.CFA, row.CFAOffset, row.RAOffset, row.FPOffset = UnwindFP, 16, -8, -16
+		}
+		return row, false, nil
+	}
+	switch mode {
+	case 1: // RBP frame
+		row.CFA, row.CFAOffset, row.RAOffset, row.FPOffset = UnwindFP, 16, -8, -16
+	case 2, 3: // frameless, with the stack size here or in the function's SUB instruction
+		size := int64(enc >> 16 & 0xff)
+		if mode == 2 {
+			size *= 8
+		} else {
+			var b [4]byte
+			if err := f.readText(b[:], start+uint64(size)); err != nil {
+				return row, false, fmt.Errorf("__unwind_info: stack size of function at %#x: %v", start, err)
+			}
+			size = int64(f.ByteOrder.Uint32(b[:])) + int64(enc>>13&7)*8
+		}
+		row.CFA, row.CFAOffset, row.RAOffset = UnwindSP, size, -8
+		regs := frameless64Regs(enc>>10&7, enc&0x3ff)
+		for i, r := range regs {
+			if r == 6 { // RBP
+				row.FPOffset = -8 - 8*int64(len(regs)) + 8*int64(i)
+			}
+		}
+	case 4:
+		return row, true, nil
+	}
+	return row, false, nil
+}
+
+// frameless64Regs decodes the permutation of the registers an amd64
+// frameless function saves, in the order it pushed them, as numbered by
+// compact unwind (1 RBX, 2 R12, 3 R13, 4 R14, 5 R15, 6 RBP).
+func frameless64Regs(count, perm uint32) []uint32 {
+	if count > 6 {
+		return nil
+	}
+	// Each register is an index among those not yet chosen,
+	// packed in a mixed radix that shrinks as registers are chosen.
+	radix := map[uint32][]uint32{
+		6: {120, 24, 6, 2, 1, 1},
+		5: {120, 24, 6, 2, 1},
+		4: {60, 12, 3, 1},
+		3: {20, 4, 1},
+		2: {5, 1},
+		1: {1},
+	}[count]
+	var regs []uint32
+	var used [7]bool
+	for _, r := range radix {
+		n := perm / r
+		perm -= n * r
+		for reg := uint32(1); reg <= 6; reg++ {
+			if used[reg] {
+				continue
+			}
+			if n == 0 {
+				used[reg] = true
+				regs = append(regs, reg)
+				break
+			}
+			n--
+		}
+	}
+	return regs
+}
+
+// readText reads the code at addr into b.
+func (f *File) readText(b []byte, addr uint64) error {
+	for _, s := range f.Sections {
+		if s.Addr <= addr && addr+uint64(len(b)) <= s.Addr+s.Size && s.Offset != 0 {
+			_, err := s.ReadAt(b, int64(addr-s.Addr))
+			return err
+		}
+	}
+	return fmt.Errorf("no section holds %#x", addr)
+}
+
+// ehFrameRows interprets the call frame information in an __eh_frame
+// section at addr.
+func ehFrameRows(b []byte, addr uint64, o binary.ByteOrder, arch *unwindArch) ([]UnwindRow, error) {
+	type cie struct {
+		codeAlign  uint64
+		dataAlign  int64
+		ra         uint64
+		ptrEnc     byte
+		hasAugData bool
+		initial    readBuf // the initial instructions
+	}
+	cies := make(map[uint64]*cie)
+	type fde struct {
+		start, end uint64
+		cie        *cie
+		insns      readBuf
+	}
+	var fdes []fde
+	for off := uint64(0); off+4 <= uint64(len(b)); {
+		d := &readBuf{b: b, off: off, o: o}
+		length := uint64(d.u32())
+		if length == 0 {
+			break // a terminator
+		}
+		if length == 0xffffffff {
+			return nil, fmt.Errorf("64-bit entry at %#x is not supported", off)
+		}
+		end := d.off + length
+		if end > uint64(len(b)) {
+			return nil, fmt.Errorf("entry at %#x extends past the end", off)
+		}
+		d.b = b[:end]
+		idAt := d.off
+		id := uint64(d.u32())
+		if id == 0 {
+			c := &cie{ptrEnc: 0}
+			if v := d.u8(); v != 1 && v != 3 {
+				return nil, fmt.Errorf("CIE at %#x has unsupported version %d", off, v)
+			}
+			aug := d.cstring()
+			c.codeAlign, c.dataAlign = d.uleb(), d.sleb()
+			c.ra = d.uleb()
+			if len(aug) > 0 && aug[0] == 'z' {
+				c.hasAugData = true
+				n := d.uleb()
+				augEnd := d.off + n
+				for _, a := range aug[1:] {
+					switch a {
+					case 'R':
+						c.ptrEnc = d.u8()
+					case 'P':
+						d.ptr(d.u8(), addr, arch.ptrSize)
+					case 'L':
+						d.u8()
+					}
+				}
+				d.off = augEnd
+			} else if aug != "" {
+				return nil, fmt.Errorf("CIE at %#x has unsupported augmentation %q", off, aug)
+			}
+			c.initial = readBuf{b: b[:end], off: d.off, o: o}
+			cies[off] = c
+		} else {
+			c := cies[idAt-id]
+			if c == nil {
+				return nil, fmt.Errorf("FDE at %#x refers to no CIE", off)
+			}
+			start := d.ptr(c.ptrEnc, addr, arch.ptrSize)
+			n := d.ptr(c.ptrEnc&0xf, addr, arch.ptrSize)
+			if c.hasAugData {
+				d.off += d.uleb()
+			}
+			fdes = append(fdes, fde{start, start + n, c, readBuf{b: b[:end], off: d.off, o: o}})
+		}
+		if d.err != nil {
+			return nil, fmt.Errorf("entry at %#x: %v", off, d.err)
+		}
+		off = end
+	}
+
+	sort.SliceStable(fdes, func(i, j int) bool { return fdes[i].start < fdes[j].start })
+	var t unwindTable
+	for _, fd := range fdes {
+		c := fd.cie
+		m := &cfaMachine{arch: arch, raColumn: c.ra, codeAlign: c.codeAlign, dataAlign: c.dataAlign, ptrEnc: c.ptrEnc, addr: addr}
+		initial := c.initial
+		if err := m.run(&initial, 0, nil); err != nil {
+			return nil, fmt.Errorf("CIE for %#x: %v", fd.start, err)
+		}
+		m.initial = m.state.copy()
+		if err := m.run(&fd.insns, fd.start, &t); err != nil {
+			return nil, fmt.Errorf("FDE for %#x: %v", fd.start, err)
+		}
+		t.add(m.row(fd.start + m.loc))
+		t.add(UnwindRow{PC: fd.end})
+	}
+	return t.rows, nil
+}
+
+// A cfaState is a row of the DWARF call frame table, as far as this
+// package keeps it.
+type cfaState struct {
+	reg   uint64
+	off   int64
+	expr  bool             // the CFA is an expression
+	saved map[uint64]int64 // register offsets from the CFA
+}
+
+func (s cfaState) copy() cfaState {
+	n := s
+	n.saved = make(map[uint64]int64, len(s.saved))
+	for r, o := range s.saved {
+		n.saved[r] = o
+	}
+	return n
+}
+
+// A cfaMachine runs call frame instructions.
+type cfaMachine struct {
+	arch      *unwindArch
+	raColumn  uint64
+	codeAlign uint64
+	dataAlign int64
+	ptrEnc    byte
+	addr      uint64 // of __eh_frame
+	loc       uint64 // from the start of the function
+	state     cfaState
+	initial   cfaState
+	stack     []cfaState
+}
+
+// row returns the state as a row at pc.
+func (m *cfaMachine) row(pc uint64) UnwindRow {
+	r := UnwindRow{PC: pc, CFAOffset: m.state.off}
+	switch {
+	case m.state.expr:
+		return UnwindRow{PC: pc}
+	case m.state.reg == m.arch.sp:
+		r.CFA = UnwindSP
+	case m.state.reg == m.arch.fp:
+		r.CFA = UnwindFP
+	default:
+		return UnwindRow{PC: pc}
+	}
+	r.RAOffset = m.state.saved[m.raColumn]
+	r.FPOffset = m.state.saved[m.arch.fp]
+	if r.RAOffset == 0 && !m.arch.lr {
+		return UnwindRow{PC: pc} // the return address is nowhere this table can say
+	}
+	return r
+}
+
+// run runs the instructions in d, for the function at start, adding
+// to t a row for each change of location if t is not nil.
+func (m *cfaMachine) run(d *readBuf, start uint64, t *unwindTable) error {
+	if m.state.saved == nil {
+		m.state.saved = make(map[uint64]int64)
+	}
+	advance := func(delta uint64) {
+		if t != nil {
+			t.add(m.row(start + m.loc))
+		}
+		m.loc += delta * m.codeAlign
+	}
+	restore := func(reg uint64) {
+		if o, ok := m.initial.saved[reg]; ok {
+			m.state.saved[reg] = o
+		} else {
+			delete(m.state.saved, reg)
+		}
+	}
+	for d.off < uint64(len(d.b)) && d.err == nil {
+		op := d.u8()
+		switch op >> 6 {
+		case 1: // DW_CFA_advance_loc
+			advance(uint64(op & 0x3f))
+			continue
+		case 2: // DW_CFA_offset
+			m.state.saved[uint64(op&0x3f)] = int64(d.uleb()) * m.dataAlign
+			continue
+		case 3: // DW_CFA_restore
+			restore(uint64(op & 0x3f))
+			continue
+		}
+		switch op {
+		case 0x00: // DW_CFA_nop
+		case 0x01: // DW_CFA_set_loc
+			loc := d.ptr(m.ptrEnc, m.addr, m.arch.ptrSize)
+			if t != nil {
+				t.add(m.row(start + m.loc))
+			}
+			m.loc = loc - start
+		case 0x02: // DW_CFA_advance_loc1
+			advance(uint64(d.u8()))
+		case 0x03: // DW_CFA_advance_loc2
+			advance(uint64(d.u16()))
+		case 0x04: // DW_CFA_advance_loc4
+			advance(uint64(d.u32()))
+		case 0x05: // DW_CFA_offset_extended
+			reg := d.uleb()
+			m.state.saved[reg] = int64(d.uleb()) * m.dataAlign
+		case 0x06: // DW_CFA_restore_extended
+			restore(d.uleb())
+		case 0x07, 0x08: // DW_CFA_undefined, DW_CFA_same_value
+			delete(m.state.saved, d.uleb())
+		case 0x09: // DW_CFA_register
+			reg := d.uleb()
+			d.uleb()
+			delete(m.state.saved, reg)
+		case 0x0a: // DW_CFA_remember_state
+			m.stack = append(m.stack, m.state.copy())
+		case 0x0b: // DW_CFA_restore_state
+			if len(m.stack) == 0 {
+				return fmt.Errorf("DW_CFA_restore_state with no state remembered")
+			}
+			m.state = m.stack[len(m.stack)-1]
+			m.stack = m.stack[:len(m.stack)-1]
+		case 0x0c: // DW_CFA_def_cfa
+			m.state.reg, m.state.off, m.state.expr = d.uleb(), int64(d.uleb()), false
+		case 0x0d: // DW_CFA_def_cfa_register
+			m.state.reg, m.state.expr = d.uleb(), false
+		case 0x0e: // DW_CFA_def_cfa_offset
+			m.state.off = int64(d.uleb())
+		case 0x0f: // DW_CFA_def_cfa_expression
+			d.off += d.uleb()
+			m.state.expr = true
+		case 0x10, 0x16: // DW_CFA_expression, DW_CFA_val_expression
+			reg := d.uleb()
+			d.off += d.uleb()
+			delete(m.state.saved, reg)
+		case 0x11: // DW_CFA_offset_extended_sf
+			reg := d.uleb()
+			m.state.saved[reg] = d.sleb() * m.dataAlign
+		case 0x12: // DW_CFA_def_cfa_sf
+			m.state.reg, m.state.off, m.state.expr = d.uleb(), d.sleb()*m.dataAlign, false
+		case 0x13: // DW_CFA_def_cfa_offset_sf
+			m.state.off = d.sleb() * m.dataAlign
+		case 0x14, 0x15: // DW_CFA_val_offset, DW_CFA_val_offset_sf
+			reg := d.uleb()
+			d.uleb()
+			delete(m.state.saved, reg)
+		case 0x2e: // DW_CFA_GNU_args_size
+			d.uleb()
+		case 0x2f: // DW_CFA_GNU_negative_offset_extended
+			reg := d.uleb()
+			m.state.saved[reg] = -int64(d.uleb()) * m.dataAlign
+		default:
+			return fmt.Errorf("unknown call frame instruction %#x", op)
+		}
+	}
+	return d.err
+}
+
+// A readBuf reads the LEB128 and other encodings of __eh_frame and
+// dyld's tables.
+type readBuf struct {
+	b   []byte
+	off uint64
+	o   binary.ByteOrder
+	err error
+}
+
+func (d *readBuf) bytes(n uint64) []byte {
+	if d.err != nil || d.off+n > uint64(len(d.b)) || d.off+n < d.off {
+		if d.err == nil {
+			d.err = fmt.Errorf("truncated at %#x", d.off)
+		}
+		return make([]byte, n&0xff)
+	}
+	b := d.b[d.off : d.off+n]
+	d.off += n
+	return b
+}
+
+func (d *readBuf) u8() byte    { return d.bytes(1)[0] }
+func (d *readBuf) u16() uint16 { return d.order().Uint16(d.bytes(2)) }
+func (d *readBuf) u32() uint32 { return d.order().Uint32(d.bytes(4)) }
+func (d *readBuf) u64() uint64 { return d.order().Uint64(d.bytes(8)) }
+
+func (d *readBuf) order() binary.ByteOrder {
+	if d.o == nil {
+		return binary.LittleEndian
+	}
+	return d.o
+}
+
+func (d *readBuf) uleb() uint64 {
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		c := d.u8()
+		if shift < 64 {
+			v |= uint64(c&0x7f) << shift
+		}
+		if c < 0x80 || d.err != nil {
+			return v
+		}
+	}
+}
+
+func (d *readBuf) sleb() int64 {
+	var v int64
+	shift := uint(0)
+	for {
+		c := d.u8()
+		if shift < 64 {
+			v |= int64(c&0x7f) << shift
+		}
+		shift += 7
+		if c < 0x80 || d.err != nil {
+			if shift < 64 && c&0x40 != 0 {
+				v |= -1 << shift
+			}
+			return v
+		}
+	}
+}
+
+func (d *readBuf) cstring() string {
+	for i := d.off; i < uint64(len(d.b)); i++ {
+		if d.b[i] == 0 {
+			s := string(d.b[d.off:i])
+			d.off = i + 1
+			return s
+		}
+	}
+	d.err = fmt.Errorf("unterminated string at %#x", d.off)
+	return ""
+}
+
+// ptr reads a pointer in DW_EH_PE encoding enc, in a section at addr.
+func (d *readBuf) ptr(enc byte, addr uint64, ptrSize int64) uint64 {
+	if enc == 0xff { // DW_EH_PE_omit
+		return 0
+	}
+	pc := addr + d.off
+	var v uint64
+	switch enc & 0xf {
+	case 0x0: // absptr
+		if ptrSize == 8 {
+			v = d.u64()
+		} else {
+			v = uint64(d.u32())
+		}
+	case 0x1:
+		v = d.uleb()
+	case 0x2:
+		v = uint64(d.u16())
+	case 0x3:
+		v = uint64(d.u32())
+	case 0x4, 0xc:
+		v = d.u64()
+	case 0x9:
+		v = uint64(d.sleb())
+	case 0xa:
+		v = uint64(int16(d.u16()))
+	case 0xb:
+		v = uint64(int32(d.u32()))
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("unsupported pointer encoding %#x", enc)
+		}
+	}
+	switch enc & 0x70 {
+	case 0x00:
+	case 0x10: // pcrel
+		v += pc
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("unsupported pointer encoding %#x", enc)
+		}
+	}
+	return v
+}
@@ -0,0 +1,363 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package macho
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A FileTOC can be written out whole, as a Mach-O file: the header and
+// load commands that Put writes, and after them the payloads registered
+// with AddPayload, AddSegmentPayload, AddSectionPayload, and the like,
+// and each section's Relocs, at its Reloff, each at its offset, with
+// zeros in between.  The file is FileSize
+// bytes long, or longer if a payload ends beyond that.
+//
+// The offsets in the load commands say where the payloads go; those of
+// a segment or section are read from it when the file is written, not
+// when it is registered, so a payload may be registered first and
+// placed after, by hand or with LayOutSegment.
+
+// A payload is contents of the file, at an offset, and of a size, that
+// are its section's or segment's if it has one.  They are read from r,
+// or if it is nil, from what open returns, which must be exactly the
+// payload's size.
+type payload struct {
+	s      *Section
+	g      *Segment
+	relocs *Section // whose relocations these are, at off
+	off, n uint64
+	r      io.ReaderAt
+	open   func() (io.ReadCloser, error)
+}
+
+// A PayloadTransform says how the contents of a section of another file
+// are changed as AddSectionFrom writes them.
+type PayloadTransform int
+
+const (
+	PayloadAsIs       PayloadTransform = iota // as they are, compressed or not
+	PayloadDecompress                         // uncompressed, as UncompressedReader reads them
+)
+
+func (p *payload) extent() (off, n uint64) {
+	switch {
+	case p.s != nil:
+		return uint64(p.s.Offset), p.s.Size
+	case p.g != nil:
+		return p.g.Offset, p.g.Filesz
+	}
+	return p.off, p.n
+}
+
+func (p *payload) String() string {
+	switch {
+	case p.s != nil:
+		return fmt.Sprintf("section %s,%s", p.s.Seg, p.s.Name)
+	case p.g != nil:
+		return fmt.Sprintf("segment %s", p.g.Name)
+	case p.relocs != nil:
+		return fmt.Sprintf("relocations of section %s,%s", p.relocs.Seg, p.relocs.Name)
+	}
+	return fmt.Sprintf("payload at %#x", p.off)
+}
+
+// AddPayload registers the first size bytes of r as contents of the
+// file at offset off, such as a symbol table, or the data of a
+// LinkEditData command.
+func (t *FileTOC) AddPayload(off uint64, r io.ReaderAt, size uint64) {
+	t.payloads = append(t.payloads, &payload{off: off, n: size, r: r})
+}
+
+// AddSegmentPayload registers r as the contents of segment g, its
+// Filesz bytes at its Offset; for a segment whose sections are
+// registered one by one, use AddSectionPayload instead.
+func (t *FileTOC) AddSegmentPayload(g *Segment, r io.ReaderAt) {
+	t.payloads = append(t.payloads, &payload{g: g, r: r})
+}
+
+// AddSegmentData registers b as the contents of segment g, and sets
+// its Filesz to the length of b.
+func (t *FileTOC) AddSegmentData(g *Segment, b []byte) {
+	g.Filesz = uint64(len(b))
+	t.AddSegmentPayload(g, bytes.NewReader(b))
+}
+
+// AddSectionPayload registers r as the contents of section s, its Size
+// bytes at its Offset.  A zero-fill section has no contents.
+func (t *FileTOC) AddSectionPayload(s *Section, r io.ReaderAt) {
+	t.payloads = append(t.payloads, &payload{s: s, r: r})
+}
+
+// AddSectionData registers b as the contents of section s, and sets its
+// Size to the length of b.
+func (t *FileTOC) AddSectionData(s *Section, b []byte) {
+	s.Size = uint64(len(b))
+	t.AddSectionPayload(s, bytes.NewReader(b))
+}
+
+// AddSectionFrom registers the contents of from, a section of another
+// file, changed as tr says, as the contents of section s, and sets its
+// Size to theirs.  They are read from from's file as s is written, so
+// that file must stay open until then.
+func (t *FileTOC) AddSectionFrom(s *Section, from *Section, tr PayloadTransform) error {
+	p := &payload{s: s}
+	if from.sr == nil {
+		return fmt.Errorf("section %s,%s is not read from a file", from.Seg, from.Name)
+	}
+	switch tr {
+	case PayloadAsIs:
+		s.Size = from.Size
+		p.r = from.sr
+	case PayloadDecompress:
+		size, err := from.UncompressedSize()
+		if err != nil {
+			return err
+		}
+		s.Size = size
+		p.open = from.UncompressedReader
+	default:
+		return fmt.Errorf("section %s,%s: unknown payload transform %d", from.Seg, from.Name, tr)
+	}
+	t.payloads = append(t.payloads, p)
+	return nil
+}
+
+// LayOutSegment places the sections of segment g end to end, each at
+// its alignment, from file offset off, and at the same distance from
+// g's Addr in memory; zero-fill sections, which must come last, take
+// no room in the file.  It sets g's Offset to off, and its Filesz and
+// Memsz to what the sections take, unrounded.  It returns an error if
+// a section would end beyond 4GB, which its offset cannot reach, or a
+// section follows a zero-fill one.
+func (t *FileTOC) LayOutSegment(g *Segment, off uint64) error {
+	g.Offset = off
+	vm := g.Addr
+	zerofill := false
+	for _, s := range t.Sections[g.Firstsect : g.Firstsect+g.Nsect] {
+		a := uint64(1) << s.Align
+		if s.Flags.IsZerofill() {
+			zerofill = true
+			vm = RoundUp(vm, a)
+			s.Addr = vm
+			vm += s.Size
+			continue
+		}
+		if zerofill {
+			return fmt.Errorf("section %s,%s follows a zero-fill section", s.Seg, s.Name)
+		}
+		off = RoundUp(off, a)
+		vm = g.Addr + (off - g.Offset)
+		if off+s.Size > 1<<32-1 {
+			return fmt.Errorf("section %s,%s ends beyond 4GB, which its offset cannot reach", s.Seg, s.Name)
+		}
+		s.Offset, s.Addr = uint32(off), vm
+		off += s.Size
+		vm += s.Size
+	}
+	g.Filesz, g.Memsz = off-g.Offset, vm-g.Addr
+	return nil
+}
+
+// copy writes the contents of p, n bytes, to w, and returns the number
+// of bytes written.
+func (p *payload) copy(w io.Writer, n uint64) (int64, error) {
+	if p.r != nil {
+		m, err := io.Copy(w, io.NewSectionReader(p.r, 0, int64(n)))
+		if err == nil && uint64(m) != n {
+			err = fmt.Errorf("%s: %d bytes, but it should have %d", p, m, n)
+		}
+		return m, err
+	}
+	rc, err := p.open()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", p, err)
+	}
+	defer rc.Close()
+	m, err := io.Copy(w, io.LimitReader(rc, int64(n)))
+	if err != nil {
+		return m, fmt.Errorf("%s: %v", p, err)
+	}
+	if uint64(m) != n {
+		return m, fmt.Errorf("%s: %d bytes, but it should have %d", p, m, n)
+	}
+	return m, p.atEnd(rc, n)
+}
+
+// fill reads the contents of p, which has no r, into b, its size.
+func (p *payload) fill(b []byte) error {
+	rc, err := p.open()
+	if err != nil {
+		return fmt.Errorf("%s: %v", p, err)
+	}
+	defer rc.Close()
+	m, err := io.ReadFull(rc, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%s: %d bytes, but it should have %d", p, m, len(b))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", p, err)
+	}
+	return p.atEnd(rc, uint64(len(b)))
+}
+
+// atEnd returns an error if r, having given the n bytes of p, has more.
+func (p *payload) atEnd(r io.Reader, n uint64) error {
+	if k, _ := r.Read(make([]byte, 1)); k > 0 {
+		return fmt.Errorf("%s: more than the %d bytes it should have", p, n)
+	}
+	return nil
+}
+
+// layout returns the size of the file t writes, and its payloads, in
+// file order, or an error if t is not consistent (see Validate), or
+// the payloads overlap one another or the load commands.
+func (t *FileTOC) layout() (uint64, []*payload, error) {
+	if err := t.Validate(); err != nil {
+		return 0, nil, err
+	}
+	var ps []*payload
+	for _, p := range t.payloads {
+		if p.s != nil && p.s.Flags.IsZerofill() {
+			continue
+		}
+		if _, n := p.extent(); n > 0 {
+			ps = append(ps, p)
+		}
+	}
+	rs, err := t.relocPayloads()
+	if err != nil {
+		return 0, nil, err
+	}
+	ps = append(ps, rs...)
+	sort.SliceStable(ps, func(i, j int) bool {
+		a, _ := ps[i].extent()
+		b, _ := ps[j].extent()
+		return a < b
+	})
+	size := t.FileSize()
+	end := uint64(t.TOCSize())
+	var last *payload
+	for _, p := range ps {
+		off, n := p.extent()
+		if off < end {
+			if last == nil {
+				return 0, nil, fmt.Errorf("%s at %#x overlaps the load commands, which end at %#x", p, off, end)
+			}
+			return 0, nil, fmt.Errorf("%s at %#x overlaps %s, which ends at %#x", p, off, last, end)
+		}
+		var ok bool
+		if end, ok = CheckedAdd(off, n); !ok {
+			return 0, nil, fmt.Errorf("%s at %#x: size %#x overflows", p, off, n)
+		}
+		if end > size {
+			size = end
+		}
+		last = p
+	}
+	return size, ps, nil
+}
+
+// relocPayloads returns the relocations of t's sections, encoded, as
+// payloads at their sections' Reloff, or an error if a section's Nreloc
+// is not the number of its Relocs, or a relocation cannot be encoded.
+func (t *FileTOC) relocPayloads() ([]*payload, error) {
+	var ps []*payload
+	for _, s := range t.Sections {
+		if s.Nreloc != uint32(len(s.Relocs)) {
+			return nil, fmt.Errorf("section %s,%s: Nreloc is %d, but there are %d relocations", s.Seg, s.Name, s.Nreloc, len(s.Relocs))
+		}
+		if s.Nreloc == 0 {
+			continue
+		}
+		for _, r := range s.Relocs {
+			if r.Scattered && r.Addr >= 1<<24 || !r.Scattered && r.Value >= 1<<24 {
+				return nil, fmt.Errorf("section %s,%s: relocation at %#x does not fit its 24 bits", s.Seg, s.Name, r.Addr)
+			}
+		}
+		b := make([]byte, len(s.Relocs)*RelocSize)
+		s.PutRelocs(b, t.ByteOrder)
+		ps = append(ps, &payload{relocs: s, off: uint64(s.Reloff), n: uint64(len(b)), r: bytes.NewReader(b)})
+	}
+	return ps, nil
+}
+
+// WriteTo writes the file t describes to w, as described above, and
+// returns the number of bytes written.  The payloads are read as they
+// are written, so that a large file need never be in memory at once.
+// It writes nothing and returns an error if t is not consistent (see
+// Validate), or its payloads overlap one another or the load commands;
+// it stops with an error if a payload is shorter than it should be.
+func (t *FileTOC) WriteTo(w io.Writer) (int64, error) {
+	size, ps, err := t.layout()
+	if err != nil {
+		return 0, err
+	}
+	head := make([]byte, t.TOCSize())
+	t.Put(head)
+	n, err := w.Write(head)
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	zeros := func(to uint64) error {
+		var z [4096]byte
+		for uint64(written) < to {
+			k := to - uint64(written)
+			if k > uint64(len(z)) {
+				k = uint64(len(z))
+			}
+			n, err := w.Write(z[:k])
+			written += int64(n)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, p := range ps {
+		off, n := p.extent()
+		if err := zeros(off); err != nil {
+			return written, err
+		}
+		m, err := p.copy(w, n)
+		written += m
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, zeros(size)
+}
+
+// Bytes returns the file t describes, as WriteTo would write it.
+func (t *FileTOC) Bytes() ([]byte, error) {
+	size, ps, err := t.layout()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	t.Put(b)
+	for _, p := range ps {
+		off, n := p.extent()
+		if p.r == nil {
+			if err := p.fill(b[off : off+n]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		m, err := p.r.ReadAt(b[off:off+n], 0)
+		if uint64(m) == n {
+			continue
+		}
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("%s: %d bytes, but it should have %d", p, m, n)
+		}
+		return nil, err
+	}
+	return b, nil
+}
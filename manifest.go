@@ -0,0 +1,276 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A Manifest records what went into and came out of one run of sd,
+// so that a symbol archive can later be checked for silent corruption.
+//
+// Toolchain is what sd took the input to have been built with, since
+// that decides how its debug information is laid out.  Supplementary
+// is the supplementary DWARF file the input refers into, if any; unless
+// it was inlined, the artifacts are not complete without it.  Options
+// are the flags the split was run with, so that "sd reproduce" can run
+// it again.  Hash is the algorithm of its checksums; see hash.go.
+type Manifest struct {
+	Tool          string         `json:"tool"`
+	Hash          hashAlgorithm  `json:"hash,omitempty"`
+	Input         FileDigest     `json:"input"`
+	Options       []string       `json:"options,omitempty"`
+	Toolchain     *Toolchain     `json:"toolchain,omitempty"`
+	Supplementary *Supplementary `json:"supplementary,omitempty"`
+	Artifacts     []FileDigest   `json:"artifacts"`
+}
+
+// A FileDigest is the size and checksum of one file, SHA-256 or
+// BLAKE3, whichever field is set.  Path is relative to the directory
+// containing the manifest whenever that is possible, so a store can be
+// moved as a whole.
+//
+// For a Mach-O input, ContentSHA256 (or ContentBLAKE3) is the checksum
+// of its section contents outside __LINKEDIT (see
+// macho.File.ContentHash), which, unlike SHA256, survives stripping and
+// re-signing.
+type FileDigest struct {
+	Path          string `json:"path"`
+	Size          int64  `json:"size"`
+	SHA256        string `json:"sha256,omitempty"`
+	BLAKE3        string `json:"blake3,omitempty"`
+	ContentSHA256 string `json:"content_sha256,omitempty"`
+	ContentBLAKE3 string `json:"content_blake3,omitempty"`
+}
+
+// hash returns the algorithm of d's checksums.
+func (d FileDigest) hash() hashAlgorithm {
+	if d.BLAKE3 != "" {
+		return hashBLAKE3
+	}
+	return hashSHA256
+}
+
+// checksum returns d's checksum of the whole file.
+func (d FileDigest) checksum() string {
+	if d.hash() == hashBLAKE3 {
+		return d.BLAKE3
+	}
+	return d.SHA256
+}
+
+// contentChecksum returns d's checksum of the file's contents, or "".
+func (d FileDigest) contentChecksum() string {
+	if d.hash() == hashBLAKE3 {
+		return d.ContentBLAKE3
+	}
+	return d.ContentSHA256
+}
+
+// setContentChecksum records sum as d's checksum of the file's
+// contents, by a.
+func (d *FileDigest) setContentChecksum(a hashAlgorithm, sum string) {
+	if a == hashBLAKE3 {
+		d.ContentBLAKE3 = sum
+	} else {
+		d.ContentSHA256 = sum
+	}
+}
+
+// matches reports whether d and e, digests by the same hash, are of
+// the same size and checksum.
+func (d FileDigest) matches(e FileDigest) bool {
+	return d.Size == e.Size && d.hash() == e.hash() && d.checksum() == e.checksum()
+}
+
+func (d FileDigest) String() string {
+	return fmt.Sprintf("size=%d %s=%s", d.Size, d.hash(), d.checksum())
+}
+
+// contentDigest returns the hex checksum by a of f's ContentHash, or ""
+// if it cannot be computed.
+func contentDigest(f *macho.File, a hashAlgorithm) string {
+	h := a.new()
+	if err := f.ContentHash(h); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func digestBytes(path string, b []byte, a hashAlgorithm) FileDigest {
+	return newFileDigest(path, int64(len(b)), a, a.sum(b))
+}
+
+func digestFile(path string, a hashAlgorithm) (FileDigest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileDigest{}, err
+	}
+	defer f.Close()
+	h := a.new()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return FileDigest{}, err
+	}
+	return newFileDigest(path, n, a, h.Sum(nil)), nil
+}
+
+func newFileDigest(path string, size int64, a hashAlgorithm, sum []byte) FileDigest {
+	d := FileDigest{Path: path, Size: size}
+	if a == hashBLAKE3 {
+		d.BLAKE3 = hex.EncodeToString(sum)
+	} else {
+		d.SHA256 = hex.EncodeToString(sum)
+	}
+	return d
+}
+
+// relativeTo returns path relative to dir if that can be done without
+// climbing out of dir, otherwise path made absolute.
+func relativeTo(dir, path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if rel, err := filepath.Rel(dir, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return rel
+	}
+	return abs
+}
+
+// writeManifest digests input and outputs and writes the result as JSON
+// to file, with sup, the supplementary file the input refers into, and
+// the options of the split.
+func writeManifest(file, input string, outputs []string, sup *Supplementary, opts *splitOptions) error {
+	in, err := digestFile(input, opts.hash)
+	if err != nil {
+		return err
+	}
+	var tc *Toolchain
+	if osf, err := os.Open(input); err == nil {
+		if f, err := macho.NewFile(osf); err == nil {
+			in.setContentChecksum(opts.hash, contentDigest(f, opts.hash))
+			tc = detectToolchain(f, osf)
+		}
+		osf.Close()
+	}
+	dir := filepath.Dir(file)
+	if abs, err := filepath.Abs(dir); err == nil {
+		in.Path = relativeTo(abs, input)
+	}
+	m, err := newManifest(dir, in, outputs, opts.hash)
+	if err != nil {
+		return err
+	}
+	m.Toolchain = tc
+	m.Supplementary = sup
+	m.Options = opts.flags()
+	return m.write(file)
+}
+
+// newManifest returns a manifest for input, digested by a, and outputs,
+// to be stored in dir.  Output paths are made relative to dir; the
+// input is recorded as given.
+func newManifest(dir string, input FileDigest, outputs []string, a hashAlgorithm) (*Manifest, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if a == "" {
+		a = hashSHA256
+	}
+	m := &Manifest{Tool: "split-dwarf", Hash: a, Input: input}
+	for _, o := range outputs {
+		d, err := digestFile(o, a)
+		if err != nil {
+			return nil, err
+		}
+		d.Path = relativeTo(dir, o)
+		m.Artifacts = append(m.Artifacts, d)
+	}
+	return m, nil
+}
+
+func (m *Manifest) write(file string) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(b, '\n'), 0644)
+}
+
+func readManifest(file string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Manifest)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if m.Hash, err = parseHash(string(m.Hash)); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return m, nil
+}
+
+// verifyIntegrity implements "sd verify-integrity manifest.json ...".
+// Every artifact listed in each manifest is re-read and its size and
+// checksum compared against the recorded values.  The input is not
+// checked, since it usually does not live alongside the symbols.
+func verifyIntegrity(args []string) {
+	if len(args) == 0 {
+		fail("Usage: %s verify-integrity manifest.json ...", os.Args[0])
+	}
+	bad := 0
+	for _, file := range args {
+		problems, err := checkArtifacts(file)
+		if err != nil {
+			fail("Could not read manifest %s, error=%v", file, err)
+		}
+		for _, p := range problems {
+			note("%s", p)
+		}
+		bad += len(problems)
+	}
+	if bad > 0 {
+		fail("%d artifact(s) failed verification", bad)
+	}
+}
+
+// checkArtifacts re-reads each artifact the manifest file lists, and
+// returns a line for each that is missing, unreadable, or no longer
+// has its recorded size and checksum.  Relative paths are relative to
+// the manifest's directory.
+func checkArtifacts(file string) ([]string, error) {
+	m, err := readManifest(file)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	dir := filepath.Dir(file)
+	for _, want := range m.Artifacts {
+		path := want.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		have, err := digestFile(path, m.Hash)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %v", path, err))
+		case !have.matches(want):
+			problems = append(problems, fmt.Sprintf("%s: checksum mismatch, recorded %v, found %v", path, want, have))
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metrics counts what a server does, for export in the Prometheus
+// text exposition format at /metrics.
+type metrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]int64
+	lookups  map[lookupKey]int64
+
+	// Histogram of split durations in seconds.
+	splitBuckets []float64 // upper bounds
+	splitCounts  []int64   // one per bucket, plus +Inf
+	splitSum     float64
+}
+
+type requestKey struct {
+	handler string
+	code    int
+}
+
+// A lookupKey counts debuginfo fetches, chunk index fetches, and
+// splits that could (hit) or could not (miss) be answered from the store.
+type lookupKey struct {
+	kind string // "debuginfo", "chunks", or "split"
+	hit  bool
+}
+
+func newMetrics() *metrics {
+	b := []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	return &metrics{
+		requests:     make(map[requestKey]int64),
+		lookups:      make(map[lookupKey]int64),
+		splitBuckets: b,
+		splitCounts:  make([]int64, len(b)+1),
+	}
+}
+
+func (m *metrics) request(handler string, code int) {
+	m.mu.Lock()
+	m.requests[requestKey{handler, code}]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) lookup(kind string, hit bool) {
+	m.mu.Lock()
+	m.lookups[lookupKey{kind, hit}]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) split(d time.Duration) {
+	sec := d.Seconds()
+	m.mu.Lock()
+	i := sort.SearchFloat64s(m.splitBuckets, sec)
+	m.splitCounts[i]++
+	m.splitSum += sec
+	m.mu.Unlock()
+}
+
+// write writes all the metrics to w, in a stable order.
+// Store size is passed in because it belongs to the server.
+func (m *metrics) write(w io.Writer, storeEntries int, storeBytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP sd_requests_total HTTP requests by handler and status code.\n")
+	fmt.Fprintf(w, "# TYPE sd_requests_total counter\n")
+	var rk []requestKey
+	for k := range m.requests {
+		rk = append(rk, k)
+	}
+	sort.Slice(rk, func(i, j int) bool {
+		if rk[i].handler != rk[j].handler {
+			return rk[i].handler < rk[j].handler
+		}
+		return rk[i].code < rk[j].code
+	})
+	for _, k := range rk {
+		fmt.Fprintf(w, "sd_requests_total{handler=%q,code=\"%d\"} %d\n", k.handler, k.code, m.requests[k])
+	}
+
+	fmt.Fprintf(w, "# HELP sd_store_lookups_total Debuginfo fetches, chunk index fetches, and splits, by whether the store already had the symbols.\n")
+	fmt.Fprintf(w, "# TYPE sd_store_lookups_total counter\n")
+	for _, kind := range []string{"debuginfo", "chunks", "split"} {
+		for _, hit := range []bool{true, false} {
+			fmt.Fprintf(w, "sd_store_lookups_total{kind=%q,result=%q} %d\n", kind, hitString(hit), m.lookups[lookupKey{kind, hit}])
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP sd_split_duration_seconds Time taken to split an executable.\n")
+	fmt.Fprintf(w, "# TYPE sd_split_duration_seconds histogram\n")
+	var cum int64
+	for i, b := range m.splitBuckets {
+		cum += m.splitCounts[i]
+		fmt.Fprintf(w, "sd_split_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(b, 'g', -1, 64), cum)
+	}
+	cum += m.splitCounts[len(m.splitBuckets)]
+	fmt.Fprintf(w, "sd_split_duration_seconds_bucket{le=\"+Inf\"} %d\n", cum)
+	fmt.Fprintf(w, "sd_split_duration_seconds_sum %g\n", m.splitSum)
+	fmt.Fprintf(w, "sd_split_duration_seconds_count %d\n", cum)
+
+	fmt.Fprintf(w, "# HELP sd_store_entries Number of UUIDs held in the store.\n")
+	fmt.Fprintf(w, "# TYPE sd_store_entries gauge\n")
+	fmt.Fprintf(w, "sd_store_entries %d\n", storeEntries)
+	fmt.Fprintf(w, "# HELP sd_store_bytes Total size of the DWARF files held in the store.\n")
+	fmt.Fprintf(w, "# TYPE sd_store_bytes gauge\n")
+	fmt.Fprintf(w, "sd_store_bytes %d\n", storeBytes)
+}
+
+func hitString(hit bool) string {
+	if hit {
+		return "hit"
+	}
+	return "miss"
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
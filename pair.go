@@ -0,0 +1,156 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sd verify-pair [ -arch arch ] executable dsym
+func verifyPair(args []string) {
+	fs := flag.NewFlagSet("verify-pair", flag.ExitOnError)
+	arch := fs.String("arch", "", "check only the slice for `arch`, the one being symbolicated (default every slice the two share)")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fail("Usage: %s verify-pair [ -arch arch ] executable dsym", os.Args[0])
+	}
+	exef, exe, _, err := openLipo(fs.Arg(0))
+	if err != nil {
+		fail("%v", err)
+	}
+	defer exef.Close()
+	files, err := bundleFiles(fs.Arg(1))
+	if err != nil {
+		fail("%v", err)
+	}
+	ok, problems, err := checkPairFiles(exe, files, *arch)
+	if err != nil {
+		fail("%v", err)
+	}
+	for _, s := range ok {
+		fmt.Println(s)
+	}
+	if len(problems) > 0 {
+		for _, s := range problems[1:] {
+			note("%s", s)
+		}
+		fail("%s", problems[0])
+	}
+}
+
+// checkPairFiles checks the executable whose slices are exe against
+// each of files, the DWARF files of a dSYM bundle, as checkPair does.
+// A bundle may hold the DWARF of several images, so the pair is good if
+// any file matches; the lines of those that do name them.  If none
+// does, the problems of each are returned, naming it, after one that
+// says so.
+func checkPairFiles(exe []lipoSlice, files []string, arch string) (ok, problems []string, err error) {
+	if len(files) == 1 {
+		f, dsym, _, err := openLipo(files[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		ok, problems := checkPair(exe, dsym, arch)
+		return ok, problems, nil
+	}
+	var all []string
+	for _, file := range files {
+		f, dsym, _, err := openLipo(file)
+		if err != nil {
+			all = append(all, fmt.Sprintf("%s: %v", file, err))
+			continue
+		}
+		fok, fproblems := checkPair(exe, dsym, arch)
+		f.Close()
+		if len(fproblems) == 0 {
+			for _, line := range fok {
+				ok = append(ok, fmt.Sprintf("%s (in %s)", line, file))
+			}
+			continue
+		}
+		for _, p := range fproblems {
+			all = append(all, fmt.Sprintf("%s: %s", file, p))
+		}
+	}
+	if len(ok) > 0 {
+		return ok, nil, nil
+	}
+	problems = append([]string{fmt.Sprintf("none of the %d DWARF files of the dSYM matches", len(files))}, all...)
+	return nil, problems, nil
+}
+
+// checkPair checks that the debugging symbols in the slices of dsym
+// are those of the executable whose slices are exe, for the one
+// architecture arch, or if that is "", for every architecture the two
+// have in common.  It returns a line for each slice that matches,
+// saying how sd produced the dSYM if it did, and,
+// if the pair is bad, why; when the cause is that the architectures
+// differ, it says so, rather than leaving it to look like a UUID
+// mismatch, and it names any slice of a universal file that would do.
+func checkPair(exe, dsym []lipoSlice, arch string) (ok, problems []string) {
+	find := func(slices []lipoSlice, name string) *lipoSlice {
+		for i, s := range slices {
+			if archName(s.Cpu, s.SubCpu) == name {
+				return &slices[i]
+			}
+		}
+		return nil
+	}
+	names := func(slices []lipoSlice) string {
+		var n []string
+		for _, s := range slices {
+			n = append(n, archName(s.Cpu, s.SubCpu))
+		}
+		return strings.Join(n, ", ")
+	}
+
+	var archs []string
+	if arch != "" {
+		archs = []string{arch}
+	} else {
+		for _, s := range exe {
+			if name := archName(s.Cpu, s.SubCpu); find(dsym, name) != nil {
+				archs = append(archs, name)
+			}
+		}
+		if len(archs) == 0 {
+			return nil, []string{fmt.Sprintf("architecture mismatch: the executable is %s, but the dSYM is %s", names(exe), names(dsym))}
+		}
+	}
+
+	for _, name := range archs {
+		e, d := find(exe, name), find(dsym, name)
+		switch {
+		case e == nil:
+			problems = append(problems, fmt.Sprintf("architecture mismatch: the executable has no %s slice, only %s", name, names(exe)))
+			continue
+		case d == nil:
+			problems = append(problems, fmt.Sprintf("architecture mismatch: the dSYM has no %s slice, only %s", name, names(dsym)))
+			continue
+		case e.uuid == "" || d.uuid == "":
+			problems = append(problems, fmt.Sprintf("%s: cannot match without UUIDs: executable %q, dSYM %q", name, e.uuid, d.uuid))
+			continue
+		case e.uuid != d.uuid:
+			problems = append(problems, fmt.Sprintf("UUID mismatch for %s: executable %s, dSYM %s", name, e.uuid, d.uuid))
+			continue
+		}
+		line := fmt.Sprintf("%s: %s", name, e.uuid)
+		if len(dsym) > 1 {
+			line += fmt.Sprintf("; the dSYM is universal, and its %s slice matches (sd lipo -thin %s %s extracts it)", name, name, d.from)
+		}
+		if len(exe) > 1 {
+			line += fmt.Sprintf("; the executable is universal, and its %s slice matches", name)
+		}
+		if d.stamp != nil {
+			line += fmt.Sprintf("; the dSYM was produced by %s", d.stamp)
+		}
+		ok = append(ok, line)
+	}
+	return ok, problems
+}
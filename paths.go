@@ -0,0 +1,216 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// dsymPath returns the bundle directory and DWARF file that dsymutil
+// would use for the debugging symbols of exe, i.e. exe.dSYM and
+// exe.dSYM/Contents/Resources/DWARF/base(exe).
+func dsymPath(exe string) (bundle, file string) {
+	base := safeFileName(filepath.Base(exe), runtime.GOOS == "windows")
+	bundle = filepath.Join(filepath.Dir(exe), shortName(base, ".dSYM"))
+	return bundle, filepath.Join(bundle, "Contents", "Resources", "DWARF", shortName(base, ""))
+}
+
+// bundleFiles returns the DWARF files of path: if path is a dSYM
+// bundle, every file in its Contents/Resources/DWARF, in name order,
+// since the bundle of a framework, or one merged by hand, can hold
+// several that are not named for the executable; and otherwise just
+// path itself.
+func bundleFiles(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil || !fi.IsDir() {
+		return []string{path}, nil
+	}
+	dir := filepath.Join(path, "Contents", "Resources", "DWARF")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s is a directory, but not a dSYM bundle: %v", path, err)
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Mode().IsRegular() || e.Mode()&os.ModeSymlink != 0 {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("dSYM bundle %s holds no DWARF files", path)
+	}
+	return files, nil
+}
+
+// expandBundles returns names with each dSYM bundle among them replaced
+// by its DWARF files.
+func expandBundles(names []string) ([]string, error) {
+	var files []string
+	for _, name := range names {
+		f, err := bundleFiles(name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f...)
+	}
+	return files, nil
+}
+
+// maxNameBytes is the longest file name component most file systems allow.
+const maxNameBytes = 255
+
+// shortName returns base+suffix, unless that is too long to be a file name,
+// in which case base is shortened (at a character boundary) and a hash of
+// the full name is added so that different long names stay distinct.
+func shortName(base, suffix string) string {
+	name := base + suffix
+	if len(name) <= maxNameBytes {
+		return name
+	}
+	sum := sha256.Sum256([]byte(base))
+	suffix = "-" + hex.EncodeToString(sum[:4]) + suffix
+	n := maxNameBytes - len(suffix)
+	for n > 0 && !utf8.RuneStart(base[n]) {
+		n--
+	}
+	return base[:n] + suffix
+}
+
+// hasDsymSuffix reports whether name ends in .dSYM, ignoring case,
+// since bundles are often found on case-insensitive volumes.
+func hasDsymSuffix(name string) bool {
+	return len(name) >= 5 && strings.EqualFold(name[len(name)-5:], ".dSYM")
+}
+
+// windowsReserved are file names that Windows refuses, with or without an extension.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// safeFileName returns name with any characters that cannot appear in
+// a file name replaced by '_'.  If portable is set, Windows' rules are
+// applied (no <>:"|?*\, control characters, trailing dots or spaces,
+// or reserved device names) so the name works on any host.
+func safeFileName(name string, portable bool) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c == '/' || c == 0:
+			b[i] = '_'
+		case portable && (c < ' ' || strings.IndexByte(`<>:"|?*\`, c) >= 0):
+			b[i] = '_'
+		}
+	}
+	if portable {
+		for i := len(b) - 1; i >= 0 && (b[i] == '.' || b[i] == ' '); i-- {
+			b[i] = '_'
+		}
+		stem := string(b)
+		if i := strings.IndexByte(stem, '.'); i >= 0 {
+			stem = stem[:i]
+		}
+		if windowsReserved[strings.ToUpper(stem)] {
+			b = append([]byte{'_'}, b...)
+		}
+	}
+	if len(b) == 0 || string(b) == "." || string(b) == ".." {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// checkDistinct returns an error if out already exists and is the same
+// file as in, as happens when the names differ only in case on a
+// case-insensitive volume, or are hard links to one another.
+func checkDistinct(in, out string) error {
+	fi, err := os.Stat(in)
+	if err != nil {
+		return nil
+	}
+	fo, err := os.Stat(out)
+	if err != nil {
+		return nil
+	}
+	if os.SameFile(fi, fo) {
+		return fmt.Errorf("output %s is the same file as input %s", out, in)
+	}
+	return nil
+}
+
+// sameAsSeen returns the name in seen of the file that name, with its
+// symbolic links followed, is, or "" if it is none of them, in which
+// case it is added to seen.  A name that cannot be found is left to
+// fail where it is opened.
+func sameAsSeen(seen map[string]os.FileInfo, name string) string {
+	real, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return ""
+	}
+	fi, err := os.Stat(real)
+	if err != nil {
+		return ""
+	}
+	for earlier, fe := range seen {
+		if os.SameFile(fi, fe) {
+			return earlier
+		}
+	}
+	seen[name] = fi
+	return ""
+}
+
+// resolveInput returns inexe with its symbolic links followed, if they
+// can be, and the name its dSYM is named for: the same, or with
+// keepName, inexe as given.
+func resolveInput(inexe string, keepName bool) (resolved, bundle string) {
+	resolved, bundle = inexe, inexe
+	if r, err := filepath.EvalSymlinks(inexe); err == nil {
+		resolved = r
+		if !keepName {
+			bundle = r
+		}
+	}
+	return resolved, bundle
+}
+
+// foldCollision returns an error if out differs only in case from an
+// output in seen, keyed by foldCase, which it would overwrite on a
+// case-insensitive volume, the default on macOS; and otherwise adds it.
+func foldCollision(seen map[string]string, out string) error {
+	k := foldCase(out)
+	if earlier, ok := seen[k]; ok {
+		return fmt.Errorf("output %s would be the same file as %s on a case-insensitive volume", out, earlier)
+	}
+	seen[k] = out
+	return nil
+}
+
+// foldCase returns s with each letter replaced by the least rune it
+// folds to, so that strings.EqualFold(a, b) exactly when
+// foldCase(a) == foldCase(b).
+func foldCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		least := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < least {
+				least = f
+			}
+		}
+		return least
+	}, s)
+}
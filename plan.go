@@ -0,0 +1,218 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"os"
+	"path/filepath"
+)
+
+// A dsymPlan is a dSYM file as planDsym decides it: where everything
+// goes, and what goes there, before any of it is written.
+type dsymPlan struct {
+	toc *macho.FileTOC
+
+	// The abbreviated symbol table, and the payloads of the
+	// LINKEDIT data commands, which follow its strings.
+	symtab       *macho.Symtab
+	syms         []macho.Nlist64
+	strings      []string
+	linkeditdata []*macho.LinkEditData
+	payloads     [][]byte
+
+	// __DWARF and its sections, if the dSYM has DWARF.
+	dwarf         *macho.Segment
+	dwarfSections []dsymSection
+
+	supplementary *Supplementary
+	warnings      []string
+}
+
+// assemble returns the dSYM p plans, its contents registered with its
+// table of contents to be written.
+func (p *dsymPlan) assemble() (*dsym, error) {
+	t := p.toc
+
+	// (1) Linkedit segment: the symbols, their strings, and the
+	// payloads of the LINKEDIT data commands.
+	size := int(t.SymbolSize())
+	syms := make([]byte, len(p.syms)*size)
+	for i := range p.syms {
+		if t.Magic == macho.Magic64 {
+			p.syms[i].Put64(syms[i*size:], t.ByteOrder)
+		} else {
+			p.syms[i].Put32(syms[i*size:], t.ByteOrder)
+		}
+	}
+	strs := []byte{' ', 0}
+	for _, str := range p.strings {
+		strs = append(append(strs, str...), 0)
+	}
+	t.AddPayload(uint64(p.symtab.Symoff), bytes.NewReader(syms), uint64(len(syms)))
+	t.AddPayload(uint64(p.symtab.Stroff), bytes.NewReader(strs), uint64(len(strs)))
+	for i, l := range p.linkeditdata {
+		t.AddPayload(uint64(l.DataOff), bytes.NewReader(p.payloads[i]), uint64(len(p.payloads[i])))
+	}
+
+	// (2) DWARF segment, copied from the input as the file is written.
+	if p.dwarf != nil {
+		for i, ds := range p.dwarfSections {
+			if err := ds.attach(t, t.Sections[p.dwarf.Firstsect+uint32(i)]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &dsym{toc: t, size: int64(t.FileSize()),
+		supplementary: p.supplementary, warnings: p.warnings}, nil
+}
+
+// A Layout describes where a split puts everything in the dSYM it
+// writes: what "sd layout" prints, for tests and tools to check
+// without reading the dSYM back.
+type Layout struct {
+	Arch     string          `json:"arch"`
+	Size     uint64          `json:"size"`
+	Loads    []string        `json:"loads"` // the load commands, in order
+	Symtab   LayoutSymtab    `json:"symtab"`
+	Segments []LayoutSegment `json:"segments"`
+}
+
+// A LayoutSymtab is where the symbols and their strings go.
+type LayoutSymtab struct {
+	Symoff  uint32 `json:"symoff"`
+	Nsyms   uint32 `json:"nsyms"`
+	Stroff  uint32 `json:"stroff"`
+	Strsize uint32 `json:"strsize"`
+}
+
+// A LayoutSegment is a segment of the dSYM, and its sections.
+type LayoutSegment struct {
+	Name     string          `json:"name"`
+	Offset   uint64          `json:"offset"`
+	Filesz   uint64          `json:"filesz"`
+	Addr     uint64          `json:"addr"`
+	Memsz    uint64          `json:"memsz"`
+	Sections []LayoutSection `json:"sections,omitempty"`
+}
+
+// A LayoutSection is a section of the dSYM.  Only those of __DWARF
+// have contents; the input section each is copied from is From, and
+// if the split rewrote it, or made it, Edited is set.
+type LayoutSection struct {
+	Name   string `json:"name"`
+	Offset uint32 `json:"offset"`
+	Size   uint64 `json:"size"`
+	Addr   uint64 `json:"addr"`
+	From   string `json:"from,omitempty"`
+	Edited bool   `json:"edited,omitempty"`
+}
+
+// layout returns the Layout of the dSYM p plans.
+func (p *dsymPlan) layout() *Layout {
+	t := p.toc
+	l := &Layout{
+		Arch: archName(t.Cpu, t.SubCpu),
+		Size: t.FileSize(),
+		Symtab: LayoutSymtab{
+			Symoff:  p.symtab.Symoff,
+			Nsyms:   p.symtab.Nsyms,
+			Stroff:  p.symtab.Stroff,
+			Strsize: p.symtab.Strsize,
+		},
+	}
+	for _, load := range t.Loads {
+		l.Loads = append(l.Loads, load.Command().String())
+		g, ok := load.(*macho.Segment)
+		if !ok {
+			continue
+		}
+		seg := LayoutSegment{Name: g.Name, Offset: g.Offset, Filesz: g.Filesz, Addr: g.Addr, Memsz: g.Memsz}
+		for i := g.Firstsect; i < g.Firstsect+g.Nsect; i++ {
+			s := t.Sections[i]
+			ls := LayoutSection{Name: s.Name, Offset: s.Offset, Size: s.Size, Addr: s.Addr}
+			if g == p.dwarf {
+				ds := p.dwarfSections[i-g.Firstsect]
+				if ds.in.Name != stampSection {
+					ls.From = ds.in.Name
+				}
+				ls.Edited = ds.edited
+			}
+			seg.Sections = append(seg.Sections, ls)
+		}
+		l.Segments = append(l.Segments, seg)
+	}
+	return l
+}
+
+// sd layout [ flags ] inputexe
+func layoutCmd(args []string) {
+	var opts splitOptions
+	fs := flag.NewFlagSet("layout", flag.ExitOnError)
+	splitFlags(fs, &opts)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s layout [ flags ] inputexe\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts.transforms = macho.SectionTransforms()
+	layouts, err := layoutFile(fs.Arg(0), &opts)
+	if err != nil {
+		fail("%v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(layouts); err != nil {
+		fail("%v", err)
+	}
+}
+
+// layoutFile returns the Layout of the dSYM that splitting inexe with
+// opts would write: one, or for a universal binary split whole, one
+// for each slice.  It writes nothing.
+func layoutFile(inexe string, opts *splitOptions) ([]*Layout, error) {
+	f, err := os.Open(inexe)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	opts.supDir = filepath.Dir(inexe)
+	var files []*macho.File
+	if isFat(f) && opts.arch == "" {
+		ff, err := macho.NewFatFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("input file %s: %v", inexe, err)
+		}
+		for _, a := range ff.Arches {
+			files = append(files, a.File)
+		}
+	} else {
+		exem, err := thinSlice(f, opts.arch)
+		if err != nil {
+			return nil, fmt.Errorf("input file %s: %v", inexe, err)
+		}
+		files = append(files, exem)
+	}
+	var layouts []*Layout
+	for _, exem := range files {
+		p, err := planDsym(exem, opts)
+		if err != nil && len(files) > 1 {
+			return nil, fmt.Errorf("input file %s: %v slice: %v", inexe, exem.Cpu, err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("input file %s: %v", inexe, err)
+		}
+		layouts = append(layouts, p.layout())
+	}
+	return layouts, nil
+}
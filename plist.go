@@ -0,0 +1,61 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// infoPlist returns the Contents/Info.plist of a dSYM bundle for
+// an executable named name, in the form dsymutil writes it.
+func infoPlist(name string) []byte {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+	<dict>
+`)
+	entry := func(key, value string) {
+		b.WriteString("\t\t<key>")
+		xml.EscapeText(&b, []byte(key))
+		b.WriteString("</key>\n\t\t<string>")
+		xml.EscapeText(&b, []byte(value))
+		b.WriteString("</string>\n")
+	}
+	entry("CFBundleDevelopmentRegion", "English")
+	entry("CFBundleIdentifier", "com.apple.xcode.dsym."+bundleIdentifier(name))
+	entry("CFBundleInfoDictionaryVersion", "6.0")
+	entry("CFBundlePackageType", "dSYM")
+	entry("CFBundleSignature", "????")
+	entry("CFBundleShortVersionString", "1.0")
+	entry("CFBundleVersion", "1")
+	b.WriteString("\t</dict>\n</plist>\n")
+	return b.Bytes()
+}
+
+// bundleIdentifier returns name with every character that may not appear
+// in a CFBundleIdentifier (anything but ASCII letters, digits, '-' and '.')
+// replaced by '-'.  The executable name itself is recorded elsewhere;
+// the identifier only needs to be valid and recognizable.
+func bundleIdentifier(name string) string {
+	var b []byte
+	for _, r := range name {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '.':
+			b = append(b, byte(r))
+		default:
+			b = append(b, '-')
+		}
+	}
+	return string(b)
+}
+
+// writeInfoPlist writes the Info.plist for the executable name into bundle.
+func writeInfoPlist(bundle, name string) error {
+	return ioutil.WriteFile(filepath.Join(bundle, "Contents", "Info.plist"), infoPlist(name), 0644)
+}
@@ -0,0 +1,317 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"debug/buildinfo"
+	"debug/dwarf"
+	"encoding/json"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// A Provenance is what a binary records about how it was built,
+// for supply-chain inventories.  Parts that are present but cannot be
+// read are listed in Problems rather than failing the whole report.
+type Provenance struct {
+	File          FileDigest     `json:"file"`
+	UUID          string         `json:"uuid,omitempty"`
+	Cpu           string         `json:"cpu"`
+	Type          string         `json:"type"`
+	Builds        []BuildVersion `json:"builds,omitempty"`
+	SourceVersion string         `json:"source_version,omitempty"`
+	Dylibs        []DylibDep     `json:"dylibs,omitempty"`
+	Go            *GoBuild       `json:"go,omitempty"`
+	Producers     []Producer     `json:"producers,omitempty"`
+	Problems      []string       `json:"problems,omitempty"`
+}
+
+// A BuildVersion is the platform and versions from an LC_BUILD_VERSION
+// or LC_VERSION_MIN_* command.
+type BuildVersion struct {
+	Platform string      `json:"platform"`
+	MinOS    string      `json:"min_os"`
+	SDK      string      `json:"sdk"`
+	Tools    []BuildTool `json:"tools,omitempty"`
+}
+
+// A BuildTool is a tool listed in LC_BUILD_VERSION.
+type BuildTool struct {
+	Tool    string `json:"tool"`
+	Version string `json:"version"`
+}
+
+// A DylibDep is a dynamic library the binary loads.
+type DylibDep struct {
+	Name           string `json:"name"`
+	CurrentVersion string `json:"current_version"`
+	CompatVersion  string `json:"compat_version"`
+	Kind           string `json:"kind,omitempty"` // "weak", "reexport", "lazy", or "upward"; empty for a plain load
+}
+
+// A GoBuild is the build information the Go toolchain embeds.
+type GoBuild struct {
+	GoVersion string            `json:"go_version"`
+	Path      string            `json:"path,omitempty"`
+	Main      GoModule          `json:"main"`
+	Deps      []GoModule        `json:"deps,omitempty"`
+	Settings  map[string]string `json:"settings,omitempty"`
+}
+
+// A GoModule is a module that went into a Go binary.
+type GoModule struct {
+	Path    string `json:"path"`
+	Version string `json:"version,omitempty"`
+	Sum     string `json:"sum,omitempty"`
+	Replace string `json:"replace,omitempty"`
+}
+
+// A Producer is a DW_AT_producer string and how many compile units carry it.
+type Producer struct {
+	Producer string `json:"producer"`
+	Language string `json:"language,omitempty"`
+	Units    int    `json:"units"`
+}
+
+// provenanceCmd implements "sd provenance".
+func provenanceCmd(args []string) {
+	if len(args) == 0 {
+		fail("Usage: %s provenance file ...", os.Args[0])
+	}
+	args, err := expandBundles(args)
+	if err != nil {
+		fail("%v", err)
+	}
+	var ps []*Provenance
+	for _, name := range args {
+		p, err := provenances(name)
+		if err != nil {
+			fail("%s: %v", name, err)
+		}
+		ps = append(ps, p...)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(ps); err != nil {
+		fail("%v", err)
+	}
+}
+
+// provenances assembles the provenance reports for the Mach-O file
+// name: one, or for a universal binary, one for each slice.
+func provenances(name string) ([]*Provenance, error) {
+	osf, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer osf.Close()
+	if !isFat(osf) {
+		p, err := provenance(name)
+		if err != nil {
+			return nil, err
+		}
+		return []*Provenance{p}, nil
+	}
+	d, err := digestFile(name, hashSHA256)
+	if err != nil {
+		return nil, err
+	}
+	ff, err := macho.NewFatFile(osf)
+	if err != nil {
+		return nil, err
+	}
+	var ps []*Provenance
+	for _, a := range ff.Arches {
+		ps = append(ps, provenanceOf(d, a.File, io.NewSectionReader(osf, int64(a.Offset), int64(a.Size))))
+	}
+	return ps, nil
+}
+
+// provenance assembles the provenance report for the Mach-O file name.
+func provenance(name string) (*Provenance, error) {
+	d, err := digestFile(name, hashSHA256)
+	if err != nil {
+		return nil, err
+	}
+	osf, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer osf.Close()
+	f, err := macho.NewFile(osf)
+	if err != nil {
+		return nil, err
+	}
+	return provenanceOf(d, f, osf), nil
+}
+
+// provenanceOf assembles the provenance report for f, read from r, a
+// file with digest d or a slice of it.
+func provenanceOf(d FileDigest, f *macho.File, r io.ReaderAt) *Provenance {
+	d.ContentSHA256 = contentDigest(f, hashSHA256)
+	p := &Provenance{File: d, UUID: uuidOf(f), Cpu: f.Cpu.String(), Type: f.Type.String()}
+	problem := func(format string, args ...interface{}) {
+		p.Problems = append(p.Problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, l := range f.Loads {
+		switch l := l.(type) {
+		case macho.LoadCmdBytes:
+			switch l.Command() {
+			case macho.LcBuildVersion:
+				problem("malformed LC_BUILD_VERSION")
+			case macho.LcVersionMinMacosx, macho.LcVersionMinIphoneos, macho.LcVersionMinTvos, macho.LcVersionMinWatchos:
+				problem("malformed %v", l.Command())
+			case macho.LcSourceVersion:
+				problem("malformed LC_SOURCE_VERSION")
+			}
+		case *macho.VersionMin:
+			p.Builds = append(p.Builds, BuildVersion{Platform: platformName(l.Platform()), MinOS: l.Version.String(), SDK: l.Sdk.String()})
+		case *macho.SourceVersion:
+			p.SourceVersion = l.String()
+		case *macho.BuildVersion:
+			bv := BuildVersion{Platform: platformName(l.Platform), MinOS: l.Minos.String(), SDK: l.Sdk.String()}
+			for _, t := range l.Tools {
+				bv.Tools = append(bv.Tools, BuildTool{Tool: toolName(t.Tool), Version: t.Version.String()})
+			}
+			p.Builds = append(p.Builds, bv)
+		case *macho.Dylib:
+			if l.Kind == macho.DylibID {
+				break // the image itself, not a dependency
+			}
+			d := DylibDep{Name: l.Name, CurrentVersion: macho.Version(l.CurrentVersion).String(), CompatVersion: macho.Version(l.CompatVersion).String()}
+			if l.Kind != macho.DylibLoad {
+				d.Kind = l.Kind.String()
+			}
+			p.Dylibs = append(p.Dylibs, d)
+		}
+	}
+
+	if bi, err := buildinfo.Read(r); err == nil {
+		g := &GoBuild{GoVersion: bi.GoVersion, Path: bi.Path, Main: goModule(&bi.Main)}
+		for _, m := range bi.Deps {
+			g.Deps = append(g.Deps, goModule(m))
+		}
+		for _, s := range bi.Settings {
+			if g.Settings == nil {
+				g.Settings = make(map[string]string)
+			}
+			g.Settings[s.Key] = s.Value
+		}
+		p.Go = g
+	}
+
+	if f.Section("__debug_info") != nil || f.Section("__zdebug_info") != nil {
+		producers, err := dwarfProducers(f)
+		if err != nil {
+			problem("reading DWARF: %v", err)
+		}
+		p.Producers = producers
+	}
+	return p
+}
+
+func goModule(m *debug.Module) GoModule {
+	g := GoModule{Path: m.Path, Version: m.Version, Sum: m.Sum}
+	if m.Replace != nil {
+		g.Replace = m.Replace.Path
+		if m.Replace.Version != "" {
+			g.Replace += "@" + m.Replace.Version
+		}
+	}
+	return g
+}
+
+// dwarfProducers returns the distinct producers of f's compile units,
+// sorted by producer and language.
+func dwarfProducers(f *macho.File) ([]Producer, error) {
+	d, err := f.DWARF()
+	if err != nil {
+		return nil, err
+	}
+	type key struct{ producer, language string }
+	counts := make(map[key]int)
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		if e.Tag == dwarf.TagCompileUnit {
+			producer, _ := e.Val(dwarf.AttrProducer).(string)
+			lang, _ := e.Val(dwarf.AttrLanguage).(int64)
+			counts[key{producer, languageName(lang)}]++
+		}
+		r.SkipChildren()
+	}
+	var ps []Producer
+	for k, n := range counts {
+		ps = append(ps, Producer{Producer: k.producer, Language: k.language, Units: n})
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].Producer != ps[j].Producer {
+			return ps[i].Producer < ps[j].Producer
+		}
+		return ps[i].Language < ps[j].Language
+	})
+	return ps, nil
+}
+
+// platformName names p as in <mach-o/loader.h>, without the PLATFORM_ prefix.
+func platformName(p macho.Platform) string {
+	if s := p.String(); strings.HasPrefix(s, "Platform") {
+		return strings.ToLower(s[len("Platform"):])
+	}
+	return fmt.Sprintf("platform%d", p)
+}
+
+// toolName names t as in <mach-o/loader.h>, without the TOOL_ prefix.
+func toolName(t macho.Tool) string {
+	if s := t.String(); strings.HasPrefix(s, "Tool") {
+		return strings.ToLower(s[len("Tool"):])
+	}
+	return fmt.Sprintf("tool%d", t)
+}
+
+// languageName names a DW_LANG_* value.
+func languageName(l int64) string {
+	switch l {
+	case 0:
+		return ""
+	case 0x1:
+		return "C89"
+	case 0x2:
+		return "C"
+	case 0x4:
+		return "C++"
+	case 0xc:
+		return "C99"
+	case 0x10:
+		return "ObjC"
+	case 0x11:
+		return "ObjC++"
+	case 0x16:
+		return "Go"
+	case 0x1a:
+		return "C++11"
+	case 0x1c:
+		return "Rust"
+	case 0x1d:
+		return "C11"
+	case 0x1e:
+		return "Swift"
+	case 0x21:
+		return "C++14"
+	}
+	return fmt.Sprintf("%#x", l)
+}
@@ -0,0 +1,709 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"sort"
+)
+
+// A redaction names functions and variables to remove from the DWARF,
+// by DW_AT_name or linkage name, with patterns as for cuFilter.
+type redaction struct {
+	patterns []string
+}
+
+func (r *redaction) add(p string) error {
+	if err := checkPattern(p); err != nil {
+		return fmt.Errorf("bad redaction pattern %q: %v", p, err)
+	}
+	r.patterns = append(r.patterns, p)
+	return nil
+}
+
+// DWARF constants used in redaction.
+const (
+	dwTagInlinedSubroutine = 0x1d
+	dwTagSubprogram        = 0x2e
+	dwTagVariable          = 0x34
+
+	dwAtSibling         = 0x01
+	dwAtLowpc           = 0x11
+	dwAtHighpc          = 0x12
+	dwAtRanges          = 0x55
+	dwAtLinkageName     = 0x6e
+	dwAtMIPSLinkageName = 0x2007
+
+	dwRleEndOfList   = 0x00
+	dwRleOffsetPair  = 0x04
+	dwRleBaseAddress = 0x05
+	dwRleStartEnd    = 0x06
+	dwRleStartLength = 0x07
+)
+
+// A span is a half-open range [start, end) of offsets or addresses.
+type span struct {
+	start, end uint64
+}
+
+// A redactedDIE is what redactDwarf needs to know of a DIE.
+type redactedDIE struct {
+	off, end  uint64 // extent, including any children
+	depth     int
+	tag       uint64
+	unit      int
+	refs      []attrValue // references to other DIEs
+	low, high uint64      // PC range, if high > low
+	ranges    uint64      // DW_AT_ranges, if hasRanges
+	hasRanges bool
+	removed   bool
+}
+
+// redactDwarf adds to edits the changes to the DWARF sections of exem
+// needed to remove the functions and variables r names, and every DIE
+// that refers to one of them (inlined copies, out-of-line instances,
+// and call sites).  The line table rows for the code of removed
+// functions are removed too, by ending the line sequence where that
+// code begins.  If nothing matches, edits is left alone.
+func redactDwarf(exem *macho.File, r *redaction, edits map[*macho.Section]sectionEdit) error {
+	sections := dwarfSectionsByName(exem)
+	data := func(name string) ([]byte, error) {
+		return editedData(edits, sections[name])
+	}
+	info, err := data("debug_info")
+	if err != nil || info == nil {
+		return err
+	}
+	abbrevs, err := data("debug_abbrev")
+	if err != nil {
+		return err
+	}
+	str, err := data("debug_str")
+	if err != nil {
+		return err
+	}
+	o := exem.ByteOrder
+
+	units, err := unitHeaders(info, abbrevs, o)
+	if err != nil {
+		return err
+	}
+	var dies []redactedDIE
+	stmtList := make([]*attrValue, len(units)) // of each unit's DIE
+	base := make([]uint64, len(units))         // of each unit, for range lists
+	for ui := range units {
+		u := &units[ui]
+		var open []int
+		err := walkDIEs(info, u, o, func(off, next uint64, depth int, a *abbrev, attrs []attrValue) {
+			if a == nil {
+				if n := len(open); n > 0 {
+					dies[open[n-1]].end = next
+					open = open[:n-1]
+				}
+				return
+			}
+			e := redactedDIE{off: off, end: next, depth: depth, tag: a.tag, unit: ui}
+			var high uint64
+			highIsAddr := false
+			for i := range attrs {
+				v := &attrs[i]
+				switch v.attr {
+				case dwAtName, dwAtLinkageName, dwAtMIPSLinkageName:
+					if s, ok := v.string(str); ok && (a.tag == dwTagSubprogram || a.tag == dwTagVariable) && depth > 0 && matchPatterns(r.patterns, s) {
+						e.removed = true
+					}
+				case dwAtLowpc:
+					if v.form == dwFormAddr {
+						e.low = v.val
+					}
+				case dwAtHighpc:
+					high, highIsAddr = v.val, v.form == dwFormAddr
+				case dwAtRanges:
+					if v.form == dwFormSecOffset || v.form == dwFormData4 || v.form == dwFormData8 {
+						e.ranges, e.hasRanges = v.val, true
+					}
+				case dwAtStmtList:
+					if depth == 0 && (v.size == 4 || v.size == 8) {
+						sl := *v
+						stmtList[ui] = &sl
+					}
+				}
+				switch v.form {
+				case dwFormRef1, dwFormRef2, dwFormRef4, dwFormRef8, dwFormRefUdata, dwFormRefAddr:
+					if v.size > 0 {
+						e.refs = append(e.refs, *v)
+					}
+				}
+			}
+			if highIsAddr {
+				e.high = high
+			} else {
+				e.high = e.low + high
+			}
+			if depth == 0 {
+				base[ui] = e.low
+			}
+			dies = append(dies, e)
+			if a.children {
+				open = append(open, len(dies)-1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	target := func(e *redactedDIE, v *attrValue) uint64 {
+		if v.form == dwFormRefAddr {
+			return v.val
+		}
+		return units[e.unit].start + v.val
+	}
+
+	// Remove what refers to what is removed, until nothing changes.
+	var spans []span
+	for {
+		spans = spans[:0]
+		for i := range dies {
+			if e := &dies[i]; e.removed && (len(spans) == 0 || e.off >= spans[len(spans)-1].end) {
+				spans = append(spans, span{e.off, e.end})
+			}
+		}
+		changed := false
+		for i := range dies {
+			e := &dies[i]
+			if e.removed || e.depth == 0 || spanAt(spans, e.off) >= 0 {
+				continue
+			}
+			for j := range e.refs {
+				if v := &e.refs[j]; v.attr != dwAtSibling && spanAt(spans, target(e, v)) >= 0 {
+					e.removed, changed = true, true
+					break
+				}
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+
+	// removedBefore[i] is the number of bytes in spans[:i].
+	removedBefore := make([]uint64, len(spans)+1)
+	for i, s := range spans {
+		removedBefore[i+1] = removedBefore[i] + s.end - s.start
+	}
+	newOff := func(off uint64) uint64 {
+		i := sort.Search(len(spans), func(i int) bool { return spans[i].end > off })
+		if i < len(spans) && off > spans[i].start {
+			off = spans[i].start
+		}
+		return off - removedBefore[i]
+	}
+
+	newInfo := make([]byte, 0, uint64(len(info))-removedBefore[len(spans)])
+	prev := uint64(0)
+	for _, s := range spans {
+		newInfo = append(newInfo, info[prev:s.start]...)
+		prev = s.end
+	}
+	newInfo = append(newInfo, info[prev:]...)
+	for _, u := range units {
+		start, hdr := newOff(u.start), uint64(4)
+		if u.offSize == 8 {
+			hdr = 12
+		}
+		putOffset(newInfo[start+hdr-u.offSize:], u.offSize, newOff(u.end)-start-hdr, o)
+	}
+	for i := range dies {
+		e := &dies[i]
+		if spanAt(spans, e.off) >= 0 {
+			continue
+		}
+		for j := range e.refs {
+			v := &e.refs[j]
+			t := newOff(target(e, v))
+			if v.form != dwFormRefAddr {
+				t -= newOff(units[e.unit].start)
+			}
+			if v.leb {
+				putULEB(newInfo[newOff(v.pos):newOff(v.pos)+v.size], t)
+			} else {
+				putOffset(newInfo[newOff(v.pos):], v.size, t, o)
+			}
+		}
+	}
+
+	// The code of removed functions, by line program.
+	drop := make(map[uint64][]span)
+	rnglists, err := data("debug_rnglists")
+	if err != nil {
+		return err
+	}
+	rangesSect, err := data("debug_ranges")
+	if err != nil {
+		return err
+	}
+	for i := range dies {
+		e := &dies[i]
+		sl := stmtList[e.unit]
+		if sl == nil || e.tag != dwTagSubprogram && e.tag != dwTagInlinedSubroutine || spanAt(spans, e.off) < 0 {
+			continue
+		}
+		if e.high > e.low {
+			drop[sl.val] = append(drop[sl.val], span{e.low, e.high})
+		}
+		if e.hasRanges {
+			u := &units[e.unit]
+			var rs []span
+			if u.version >= 5 {
+				rs, err = rangeList(rnglists, e.ranges, base[e.unit], u.addrSize, o)
+			} else {
+				rs, err = oldRangeList(rangesSect, e.ranges, base[e.unit], u.addrSize, o)
+			}
+			if err != nil {
+				return fmt.Errorf("DIE at %#x: %v", e.off, err)
+			}
+			drop[sl.val] = append(drop[sl.val], rs...)
+		}
+	}
+	if line, err := data("debug_line"); err != nil {
+		return err
+	} else if line != nil && len(drop) > 0 {
+		var newLine []byte
+		moved := make(map[uint64]uint64)
+		for off := uint64(0); off < uint64(len(line)); {
+			_, end, err := unitExtent(line, off, o)
+			if err != nil {
+				return fmt.Errorf("__debug_line: %v", err)
+			}
+			moved[off] = uint64(len(newLine))
+			if d, ok := drop[off]; ok {
+				p, err := redactLineProgram(line[off:end], d, o)
+				if err != nil {
+					return fmt.Errorf("__debug_line: program at %#x: %v", off, err)
+				}
+				newLine = append(newLine, p...)
+			} else {
+				newLine = append(newLine, line[off:end]...)
+			}
+			off = end
+		}
+		for _, sl := range stmtList {
+			if sl != nil {
+				if n, ok := moved[sl.val]; ok {
+					putOffset(newInfo[newOff(sl.pos):], sl.size, n, o)
+				}
+			}
+		}
+		edits[sections["debug_line"]] = sectionEdit{data: newLine}
+	}
+	edits[sections["debug_info"]] = sectionEdit{data: newInfo}
+	dropAccelerators(sections, edits)
+
+	if b, err := data("debug_aranges"); err != nil {
+		return err
+	} else if b != nil {
+		nb, err := filterInfoIndexed(b, func(old uint64) (uint64, bool) { return newOff(old), true }, o)
+		if err != nil {
+			return fmt.Errorf("__debug_aranges: %v", err)
+		}
+		edits[sections["debug_aranges"]] = sectionEdit{data: nb}
+	}
+	for _, name := range []string{"debug_pubnames", "debug_pubtypes"} {
+		b, err := data(name)
+		if err != nil {
+			return err
+		}
+		if b == nil {
+			continue
+		}
+		nb, err := redactPubNames(b, spans, newOff, o)
+		if err != nil {
+			return fmt.Errorf("__%s: %v", name, err)
+		}
+		edits[sections[name]] = sectionEdit{data: nb}
+	}
+	return nil
+}
+
+// spanAt returns the index of the span in spans, which are sorted and
+// disjoint, that contains off, or -1.
+func spanAt(spans []span, off uint64) int {
+	i := sort.Search(len(spans), func(i int) bool { return spans[i].end > off })
+	if i < len(spans) && spans[i].start <= off {
+		return i
+	}
+	return -1
+}
+
+// putULEB writes v into b as a ULEB128 padded to fill b.
+func putULEB(b []byte, v uint64) {
+	for i := range b {
+		b[i] = byte(v&0x7f) | 0x80
+		v >>= 7
+	}
+	b[len(b)-1] &^= 0x80
+}
+
+func appendULEB(b []byte, v uint64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func appendSLEB(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 && c&0x40 == 0 || v == -1 && c&0x40 != 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// oldRangeList reads the DWARF 4 range list at off in __debug_ranges.
+func oldRangeList(b []byte, off, base, addrSize uint64, o binary.ByteOrder) ([]span, error) {
+	if off > uint64(len(b)) {
+		return nil, fmt.Errorf("range list offset %#x is past the end of __debug_ranges", off)
+	}
+	d := &dwarfBuf{b: b, off: off, o: o}
+	var rs []span
+	for d.err == nil {
+		start, end := d.uint(addrSize), d.uint(addrSize)
+		switch {
+		case start == 0 && end == 0:
+			return rs, d.err
+		case start == ^uint64(0)>>(64-8*addrSize):
+			base = end
+		default:
+			rs = append(rs, span{base + start, base + end})
+		}
+	}
+	return nil, d.err
+}
+
+// rangeList reads the DWARF 5 range list at off in __debug_rnglists.
+// Entries that index __debug_addr are not supported.
+func rangeList(b []byte, off, base, addrSize uint64, o binary.ByteOrder) ([]span, error) {
+	if off > uint64(len(b)) {
+		return nil, fmt.Errorf("range list offset %#x is past the end of __debug_rnglists", off)
+	}
+	d := &dwarfBuf{b: b, off: off, o: o}
+	var rs []span
+	for d.err == nil {
+		switch kind := d.uint(1); kind {
+		case dwRleEndOfList:
+			return rs, d.err
+		case dwRleOffsetPair:
+			start, end := d.uleb(), d.uleb()
+			rs = append(rs, span{base + start, base + end})
+		case dwRleBaseAddress:
+			base = d.uint(addrSize)
+		case dwRleStartEnd:
+			start, end := d.uint(addrSize), d.uint(addrSize)
+			rs = append(rs, span{start, end})
+		case dwRleStartLength:
+			start := d.uint(addrSize)
+			rs = append(rs, span{start, start + d.uleb()})
+		default:
+			d.fail("unsupported range list entry kind %#x", kind)
+		}
+	}
+	return nil, d.err
+}
+
+// redactPubNames rewrites a __debug_pubnames or __debug_pubtypes
+// section for the __debug_info that has spans removed, dropping the
+// entries for removed DIEs.
+func redactPubNames(b []byte, spans []span, newOff func(uint64) uint64, o binary.ByteOrder) ([]byte, error) {
+	var out []byte
+	for off := uint64(0); off < uint64(len(b)); {
+		hdr, end, err := unitExtent(b, off, o)
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(4)
+		if hdr-off == 12 {
+			size = 8
+		}
+		d := &dwarfBuf{b: b[:end], off: hdr, o: o}
+		d.uint(2) // version
+		unit, unitLen := d.uint(size), d.uint(size)
+		if d.err != nil {
+			return nil, fmt.Errorf("set at %#x: %v", off, d.err)
+		}
+		start := uint64(len(out))
+		out = append(out, b[off:d.off]...)
+		putOffset(out[start+d.off-off-2*size:], size, newOff(unit), o)
+		putOffset(out[start+d.off-off-size:], size, newOff(unit+unitLen)-newOff(unit), o)
+		for d.err == nil {
+			die := d.uint(size)
+			if die == 0 {
+				break
+			}
+			name := d.cstring()
+			if spanAt(spans, unit+die) >= 0 {
+				continue
+			}
+			out = append(out, make([]byte, size)...)
+			putOffset(out[uint64(len(out))-size:], size, newOff(unit+die)-newOff(unit), o)
+			out = append(append(out, name...), 0)
+		}
+		if d.err != nil {
+			return nil, fmt.Errorf("set at %#x: %v", off, d.err)
+		}
+		out = append(out, make([]byte, size)...)
+		putOffset(out[start+hdr-off-size:], size, uint64(len(out))-start-(hdr-off), o)
+		off = end
+	}
+	return out, nil
+}
+
+// Line number program opcodes.
+const (
+	dwLnsCopy             = 0x01
+	dwLnsAdvancePc        = 0x02
+	dwLnsAdvanceLine      = 0x03
+	dwLnsSetFile          = 0x04
+	dwLnsSetColumn        = 0x05
+	dwLnsNegateStmt       = 0x06
+	dwLnsSetBasicBlock    = 0x07
+	dwLnsConstAddPc       = 0x08
+	dwLnsFixedAdvancePc   = 0x09
+	dwLnsSetPrologueEnd   = 0x0a
+	dwLnsSetEpilogueBegin = 0x0b
+	dwLnsSetIsa           = 0x0c
+
+	dwLneEndSequence      = 0x01
+	dwLneSetAddress       = 0x02
+	dwLneSetDiscriminator = 0x04
+)
+
+// A lineRow is a row of the line table.
+type lineRow struct {
+	addr                  uint64
+	file, column, isa     uint64
+	discriminator         uint64
+	line                  int64
+	isStmt, basicBlock    bool
+	prologueEnd, epilogue bool
+	endSequence           bool
+}
+
+// redactLineProgram rewrites the line program prog without the rows
+// for addresses in drop.  A sequence is ended where dropped rows begin,
+// and a new one started where kept rows resume, so that no kept row
+// comes to cover dropped code.  The header, and so the file table, is
+// unchanged.
+func redactLineProgram(prog []byte, drop []span, o binary.ByteOrder) ([]byte, error) {
+	hdr, end, err := unitExtent(prog, 0, o)
+	if err != nil {
+		return nil, err
+	}
+	offSize := uint64(4)
+	if hdr == 12 {
+		offSize = 8
+	}
+	d := &dwarfBuf{b: prog[:end], off: hdr, o: o}
+	version := d.uint(2)
+	if version < 2 || version > 5 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	addrSize := uint64(8)
+	if version >= 5 {
+		addrSize = d.uint(1)
+		d.uint(1) // segment selector size
+	}
+	headerLength := d.uint(offSize)
+	body := d.off + headerLength
+	minInst := d.uint(1)
+	if version >= 4 {
+		d.uint(1) // maximum operations per instruction
+	}
+	defaultIsStmt := d.uint(1) != 0
+	lineBase := int64(int8(d.uint(1)))
+	lineRange := d.uint(1)
+	opcodeBase := d.uint(1)
+	if d.err != nil {
+		return nil, d.err
+	}
+	if minInst == 0 || lineRange == 0 || opcodeBase == 0 {
+		return nil, fmt.Errorf("bad header")
+	}
+	opLengths := d.bytes(opcodeBase - 1)
+	if d.err != nil || body > end {
+		return nil, fmt.Errorf("bad header")
+	}
+	sort.Slice(drop, func(i, j int) bool { return drop[i].start < drop[j].start })
+	dropped := func(addr uint64) bool {
+		i := sort.Search(len(drop), func(i int) bool { return drop[i].start > addr })
+		for ; i > 0; i-- {
+			if addr < drop[i-1].end {
+				return true
+			}
+		}
+		return false
+	}
+
+	initial := lineRow{file: 1, line: 1, isStmt: defaultIsStmt}
+	out := append([]byte(nil), prog[:body]...)
+	st := initial // the state of the rewritten program
+	open := false
+	advance := func(addr uint64) {
+		if addr >= st.addr && (addr-st.addr)%minInst == 0 {
+			if n := (addr - st.addr) / minInst; n > 0 {
+				out = appendULEB(append(out, dwLnsAdvancePc), n)
+			}
+		} else {
+			out = appendULEB(append(out, 0), 1+addrSize)
+			out = append(out, dwLneSetAddress)
+			out = append(out, make([]byte, addrSize)...)
+			putOffset(out[uint64(len(out))-addrSize:], addrSize, addr, o)
+		}
+		st.addr = addr
+	}
+	emit := func(r *lineRow) {
+		if r.endSequence {
+			if open {
+				advance(r.addr)
+				out = append(out, 0, 1, dwLneEndSequence)
+			}
+			st, open = initial, false
+			return
+		}
+		if dropped(r.addr) {
+			if open {
+				advance(r.addr)
+				out = append(out, 0, 1, dwLneEndSequence)
+			}
+			st, open = initial, false
+			return
+		}
+		if !open {
+			st.addr = ^uint64(0) // force DW_LNE_set_address
+			open = true
+		}
+		if r.file != st.file {
+			out = appendULEB(append(out, dwLnsSetFile), r.file)
+		}
+		if r.column != st.column {
+			out = appendULEB(append(out, dwLnsSetColumn), r.column)
+		}
+		if r.isStmt != st.isStmt {
+			out = append(out, dwLnsNegateStmt)
+		}
+		if r.isa != st.isa {
+			out = appendULEB(append(out, dwLnsSetIsa), r.isa)
+		}
+		if r.basicBlock {
+			out = append(out, dwLnsSetBasicBlock)
+		}
+		if r.prologueEnd {
+			out = append(out, dwLnsSetPrologueEnd)
+		}
+		if r.epilogue {
+			out = append(out, dwLnsSetEpilogueBegin)
+		}
+		if r.discriminator != 0 {
+			v := appendULEB(nil, r.discriminator)
+			out = appendULEB(append(out, 0), uint64(1+len(v)))
+			out = append(append(out, dwLneSetDiscriminator), v...)
+		}
+		delta := r.line - st.line
+		special := uint64(0)
+		if r.addr >= st.addr && (r.addr-st.addr)%minInst == 0 && delta >= lineBase && delta < lineBase+int64(lineRange) {
+			special = uint64(delta-lineBase) + lineRange*((r.addr-st.addr)/minInst) + opcodeBase
+		}
+		if special > 0 && special <= 255 {
+			out = append(out, byte(special))
+			st.addr = r.addr
+		} else {
+			advance(r.addr)
+			if delta != 0 {
+				out = appendSLEB(append(out, dwLnsAdvanceLine), delta)
+			}
+			out = append(out, dwLnsCopy)
+		}
+		st.file, st.column, st.isStmt, st.isa, st.line = r.file, r.column, r.isStmt, r.isa, r.line
+	}
+
+	d.off = body
+	r := initial
+	for d.err == nil && d.off < end {
+		switch op := d.uint(1); {
+		case op >= opcodeBase:
+			adj := op - opcodeBase
+			r.addr += adj / lineRange * minInst
+			r.line += lineBase + int64(adj%lineRange)
+			emit(&r)
+			r.basicBlock, r.prologueEnd, r.epilogue, r.discriminator = false, false, false, 0
+		case op == 0:
+			n := d.uleb()
+			next := d.off + n
+			if n == 0 {
+				d.fail("empty extended opcode")
+				break
+			}
+			switch sub := d.uint(1); sub {
+			case dwLneEndSequence:
+				r.endSequence = true
+				emit(&r)
+				r = initial
+			case dwLneSetAddress:
+				addrSize = n - 1
+				r.addr = d.uint(addrSize)
+			case dwLneSetDiscriminator:
+				r.discriminator = d.uleb()
+			default:
+				d.fail("unsupported extended opcode %#x", sub)
+			}
+			d.off = next
+		case op == dwLnsCopy:
+			emit(&r)
+			r.basicBlock, r.prologueEnd, r.epilogue, r.discriminator = false, false, false, 0
+		case op == dwLnsAdvancePc:
+			r.addr += d.uleb() * minInst
+		case op == dwLnsAdvanceLine:
+			r.line += d.sleb()
+		case op == dwLnsSetFile:
+			r.file = d.uleb()
+		case op == dwLnsSetColumn:
+			r.column = d.uleb()
+		case op == dwLnsNegateStmt:
+			r.isStmt = !r.isStmt
+		case op == dwLnsSetBasicBlock:
+			r.basicBlock = true
+		case op == dwLnsConstAddPc:
+			r.addr += (255 - opcodeBase) / lineRange * minInst
+		case op == dwLnsFixedAdvancePc:
+			r.addr += d.uint(2)
+		case op == dwLnsSetPrologueEnd:
+			r.prologueEnd = true
+		case op == dwLnsSetEpilogueBegin:
+			r.epilogue = true
+		case op == dwLnsSetIsa:
+			r.isa = d.uleb()
+		default:
+			for i := byte(0); i < opLengths[op-1]; i++ {
+				d.uleb()
+			}
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	putOffset(out[hdr-offSize:], offSize, uint64(len(out))-hdr, o)
+	return out, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// sd reproduce [ -input file ] [ -supplementary-file file ] [ -o file ] manifest.json
+func reproduce(args []string) {
+	fs := flag.NewFlagSet("reproduce", flag.ExitOnError)
+	input := fs.String("input", "", "split `file`, which must be the input the manifest records, rather than the file at its recorded path")
+	supFile := fs.String("supplementary-file", "", "for -supplementary=inline, read the supplementary file from `file`")
+	out := fs.String("o", "", "keep the reproduced dSYM in `file`, to compare it with the recorded one")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail("Usage: %s reproduce [ -input file ] [ -supplementary-file file ] [ -o file ] manifest.json", os.Args[0])
+	}
+	line, err := reproduceManifest(fs.Arg(0), *input, *supFile, *out)
+	if err != nil {
+		fail("%v", err)
+	}
+	fmt.Println(line)
+}
+
+// reproduceManifest splits again the input the manifest in file
+// records, with the options it records, and checks that the result is
+// the artifact it records, byte for byte.  The input is found at input,
+// or if that is "", at its recorded path, and is identified by its
+// checksum.  The result is written to out, or if that is "", to a
+// temporary file that is removed.  It returns a line saying what was
+// reproduced.
+func reproduceManifest(file, input, supFile, out string) (string, error) {
+	m, err := readManifest(file)
+	if err != nil {
+		return "", err
+	}
+	if len(m.Artifacts) != 1 {
+		return "", fmt.Errorf("%s: records %d artifacts; a split makes one", file, len(m.Artifacts))
+	}
+	dir := filepath.Dir(file)
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	if input == "" {
+		input = resolve(m.Input.Path)
+	}
+	want := m.Artifacts[0]
+	artifact := resolve(want.Path)
+
+	have, err := digestFile(input, m.Hash)
+	if err != nil {
+		return "", fmt.Errorf("recorded input: %v", err)
+	}
+	if !have.matches(m.Input) {
+		why := ""
+		if f, err := macho.Open(input); err == nil {
+			if c := m.Input.contentChecksum(); c != "" && contentDigest(f, m.Hash) == c {
+				why = "; its code is the same, so it was probably re-signed or stripped"
+			}
+			f.Close()
+		}
+		return "", fmt.Errorf("%s is not the recorded input: %v, want %v%s", input, have, m.Input, why)
+	}
+
+	// The options are those the manifest records, or for a manifest
+	// that predates them, those the artifact's stamp records.
+	options := m.Options
+	if options == nil {
+		if f, err := macho.Open(artifact); err == nil {
+			if s := stampOf(f); s != nil {
+				options = s.Options
+			}
+			f.Close()
+		}
+	}
+	var opts splitOptions
+	ofs := flag.NewFlagSet("options", flag.ContinueOnError)
+	ofs.SetOutput(ioutil.Discard)
+	splitFlags(ofs, &opts)
+	if err := ofs.Parse(options); err != nil || ofs.NArg() > 0 {
+		return "", fmt.Errorf("%s: cannot use recorded options %q: %v", file, options, err)
+	}
+	opts.supFile = supFile
+	opts.transforms = macho.SectionTransforms()
+
+	if out == "" {
+		tmp, err := ioutil.TempFile("", "sd-reproduce")
+		if err != nil {
+			return "", err
+		}
+		tmp.Close()
+		out = tmp.Name()
+		defer os.Remove(out)
+	}
+	if err := splitFile(input, out, false, &opts, "", ""); err != nil {
+		return "", err
+	}
+	got, err := digestFile(out, m.Hash)
+	if err != nil {
+		return "", err
+	}
+	if !got.matches(want) {
+		why := ""
+		if f, err := macho.Open(artifact); err == nil {
+			if s := stampOf(f); s != nil {
+				version, goVersion := toolVersion()
+				if s.Version != version || s.GoVersion != goVersion {
+					why = fmt.Sprintf("; the recorded dSYM was produced by %s, and this is %s (%s)", s, version, goVersion)
+				}
+			}
+			f.Close()
+		}
+		return "", fmt.Errorf("%s was not reproduced: %v, want %v%s", want.Path, got, want, why)
+	}
+	return fmt.Sprintf("reproduced %s: %v", want.Path, got), nil
+}
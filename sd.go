@@ -5,11 +5,14 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"github.com/dr2chase/split-dwarf/macho"
-	"io/ioutil"
+	"io"
+	"math"
 	"os"
-	"strings"
+	"path/filepath"
 	"unsafe"
 )
 
@@ -26,31 +29,581 @@ func fail(format string, why ...interface{}) {
 	os.Exit(1)
 }
 
-// sd inputexe [ outputdwarf ]
+// sd [ -dedup dir ] [ -manifest file ] [ -strip [ -strip-backup=false ] [ -strip-signed ] ] inputexe [ outputdwarf ]
+// sd -batch [ -fail-fast ] inputexe ...
+// sd -chunks dir [ -chunk-content-only ] inputexe [ outputdwarf ]
+// sd verify-integrity manifest.json
+// sd reproduce [ -input file ] [ -supplementary-file file ] [ -o file ] manifest.json
+// sd verify-pair [ -arch arch ] executable dsym
+// sd store gc [ flags ] storedir
+// sd store find [ flags ] uuid|binary
+// sd store serve [ flags ] storedir
+// sd store share-strings [ flags ] storedir
+// sd store unshare [ -backup=false ] [ -lock-wait duration ] file ...
+// sd layout [ flags ] inputexe
+// sd describe file ...
+// sd provenance file ...
+// sd unwind-table [ flags ] file
+// sd lipo -thin arch input output
+// sd lipo -create input ... -o output
+// sd delta [ flags ] -base dsym inputexe delta
+// sd apply-delta base delta output
+// sd corpus-check [ -split ] [ -v ] [ flags ] dir ...
+// sd edit-symbols [ -rename old=new ] [ -remove name ] [ -alias alias=target ] input output
+// sd strip [ -S | -x | -tables ] input output
 func main() {
-	if len(os.Args) < 2 || len(os.Args) > 3 {
-		fmt.Printf(`
-Usage: %s inputexe [ outputdwarf ]
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify-integrity":
+			verifyIntegrity(os.Args[2:])
+			return
+		case "verify-pair":
+			verifyPair(os.Args[2:])
+			return
+		case "reproduce":
+			reproduce(os.Args[2:])
+			return
+		case "store":
+			store(os.Args[2:])
+			return
+		case "layout":
+			layoutCmd(os.Args[2:])
+			return
+		case "describe":
+			describeFiles(os.Args[2:])
+			return
+		case "provenance":
+			provenanceCmd(os.Args[2:])
+			return
+		case "unwind-table":
+			unwindTableCmd(os.Args[2:])
+			return
+		case "lipo":
+			lipoCmd(os.Args[2:])
+			return
+		case "delta":
+			deltaCmd(os.Args[2:])
+			return
+		case "apply-delta":
+			applyDeltaCmd(os.Args[2:])
+			return
+		case "corpus-check":
+			corpusCheck(os.Args[2:])
+			return
+		case "edit-symbols":
+			editSymbolsCmd(os.Args[2:])
+			return
+		case "strip":
+			stripCmd(os.Args[2:])
+			return
+		}
+	}
+
+	flag.StringVar(&dedupDir, "dedup", "", "share the dSYM, by a hard link, with any identical one written with the same `dir`, a pool of\n"+
+		"files named for their SHA-256 on the same file system; with none, nothing is shared.  Only whole\n"+
+		"files are shared; -chunks shares identical sections instead")
+	manifest := flag.String("manifest", "", "write a JSON manifest with SHA-256 checksums of the input and output to `file`")
+	batch := flag.Bool("batch", false, "treat every argument as an inputexe, writing each one's dSYM beside it; a failure is reported,\n"+
+		"the rest are still split, and sd exits nonzero at the end")
+	failFast := flag.Bool("fail-fast", false, "with -batch, stop at the first input that cannot be split")
+	chunks := flag.String("chunks", "", "write the dSYM as content-addressed chunks into `dir`, shared with other dSYMs written there,\n"+
+		"and in its place, an index of them; \"sd store find\" reassembles it")
+	keepName := flag.Bool("keep-name", false, "if inputexe is a symbolic link, name the dSYM after the link rather than its target")
+	var opts splitOptions
+	flag.BoolVar(&opts.chunkContentOnly, "chunk-content-only", false, "with -chunks, cut only where the contents say, not also at each DWARF section's bounds,\n"+
+		"so that sections identical across slices and builds are no longer stored once")
+	hashFlag(flag.CommandLine, &opts.hash, "inputexe and the dSYM, in the -manifest,")
+	flag.DurationVar(&opts.lockWait, "lock-wait", 0, "if another sd is writing the same dSYM, or with -chunks the same dir, wait up to `duration`\n"+
+		"for it to finish rather than failing at once as busy")
+	flag.BoolVar(&opts.strip, "strip", false, "once the dSYM is written, rewrite inputexe without its __DWARF segment and DWARF sections,\n"+
+		"which the dSYM now holds")
+	stripBackup := flag.Bool("strip-backup", true, "with -strip, keep inputexe as it was, in inputexe.bak")
+	flag.BoolVar(&opts.stripSigned, "strip-signed", false, "with -strip, strip an inputexe with a code signature, which it then no longer matches, rather than\n"+
+		"refusing; it must be signed again")
+	splitFlags(flag.CommandLine, &opts)
+	opts.transforms = macho.SectionTransforms()
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `
+Usage: %s [ flags ] inputexe [ outputdwarf ]
 Reads the executable inputexe, extracts debugging into outputdwarf.
+If inputexe is a universal binary, its slices are split concurrently
+into a universal outputdwarf, or with -arch, just the one slice.
 If outputdwarf is not specified, the path 
       inputexe.dSYM/Contents/Resources/DWARF/inputexe
-is used instead.
-`, os.Args[0])
+is used instead.  Symbolic links are followed, so by default
+the dSYM lands beside, and is named for, the real executable.
+The dSYM records, in its __DWARF,__splitdwarf section, the version
+of sd and the flags that produced it.
+While sd writes a dSYM, it holds a lock on it, inputexe.dSYM.lock
+beside the bundle, so that concurrent runs writing the same dSYM
+do not interleave; one finding it locked fails as busy, or with
+-lock-wait, waits for it.
+With -chunks, the dSYM is cut where its contents say into chunks
+named for their SHA-256, kept in dir, and outputdwarf is an index
+of them; the dSYMs of successive releases share most chunks, so a
+client fetching from "sd store serve" downloads only what changed.
+Chunks are also cut at the bounds of each DWARF section, so that a
+section identical in two slices of a universal dSYM, or in two
+builds, is one set of chunks, stored and fetched once.
+With -dedup, a dSYM identical to one written before with the same
+dir becomes a hard link to it, so however many names it is split
+to, one copy is kept.  Only whole files are shared; to share the
+sections that dSYMs differing elsewhere have in common, use -chunks,
+which -dedup cannot be combined with.
+
+With -strip, inputexe is then rewritten without its DWARF, shrunk
+to what it needs to run; its dSYM holds the rest.  The original is
+kept as inputexe.bak, unless -strip-backup=false.  A signed inputexe
+is refused, as stripping invalidates its signature, unless
+-strip-signed is given.
+
+Usage: %s -batch [ -fail-fast ] [ flags ] inputexe ...
+Splits each inputexe into the dSYM beside it.  An input that cannot
+be split is reported and the rest are still split, unless -fail-fast
+is given; a summary follows, and sd exits nonzero if any failed.
+
+Usage: %s verify-integrity manifest.json
+Rechecks the checksums recorded in a manifest written by -manifest,
+by the hash, SHA-256 or BLAKE3 (see -hash), that it records.
+
+Usage: %s reproduce [ -input file ] [ -supplementary-file file ] [ -o file ] manifest.json
+Splits the input a manifest records again, with the flags it records,
+and checks that the result is, byte for byte, the dSYM it records.
+
+Usage: %s verify-pair [ -arch arch ] executable dsym
+Checks that dsym holds the debugging symbols of executable, slice by
+slice if either is universal, telling an architecture mismatch apart
+from a UUID mismatch, and says how sd produced dsym if it did.
+If dsym is a bundle, each of its DWARF files is tried.
+
+Usage: %s store gc [ flags ] storedir
+Prunes old dSYMs from a directory of debugging symbols.  It, and
+share-strings, lock the store, in storedir/.sd.lock, while they
+change it; -lock-wait waits for another holder rather than failing.
+
+Usage: %s store find [ flags ] uuid|binary
+Locates the debugging symbols for a UUID or binary in a directory
+or debuginfod server.  A chunked dSYM is reassembled; with -chunk-cache,
+only the chunks not fetched before are downloaded from sd servers.
+
+Usage: %s store serve [ flags ] storedir
+Serves a directory of debugging symbols over HTTP, debuginfod style,
+and accepts executables POSTed to /split to be split into it.  With
+-fetch-from, /split?url= fetches the executable from under those URLs.
+
+Usage: %s store share-strings [ -min-files n ] [ -n ] [ -backup ] [ -hash algorithm ] [ -lock-wait duration ] storedir
+Experimental: moves the DWARF strings that at least n dSYMs of the
+store share into one supplementary file there, which they then refer
+into; such dSYMs are served, or unshared, self-contained.
+
+Usage: %s store unshare [ -backup=false ] [ -lock-wait duration ] file ...
+Copies back into each dSYM the strings it refers to in a shared file.
+Each is edited in place, and kept as it was in FILE.bak; an edit whose
+result is not a dSYM of the same UUIDs is not made, or is rolled back.
+
+Usage: %s layout [ flags ] inputexe
+Prints, as JSON, where splitting inputexe with flags would put each
+segment and section of the dSYM, and the symbol table, writing nothing.
+
+Usage: %s describe file ...
+Prints the header, load commands, and sections of each Mach-O file,
+in file order, in a form stable enough to diff or keep as a golden file,
+followed by a guess at the linker and Go version that produced it and why,
+and the format features, such as chained fixups or compressed DWARF,
+that it uses, and for a dSYM that sd produced, how.
+A dSYM bundle stands for each of its DWARF files, here and for
+provenance.
+
+Usage: %s provenance file ...
+Prints, as a JSON array, what each Mach-O file records about how it
+was built: UUID, platform and SDK versions, source version, dylibs,
+Go build information, and DWARF producers.
+
+Usage: %s unwind-table [ -binary ] [ -o file ] file
+Writes, as JSON or a compact binary table, how to unwind the stack
+from each PC of a Mach-O file, from its compact unwind and __eh_frame,
+for profilers that must unwind stripped binaries.
+
+Usage: %s lipo -thin arch input output
+       %s lipo -create input ... -o output
+Extracts the slice for arch (arm64, arm64e, x86_64, i386, ...) from a
+universal binary or dSYM, or combines thin and universal files into one.
+
+Usage: %s delta [ flags ] -base dsym inputexe delta
+Splits inputexe, with flags, and writes only how its dSYM differs from
+dsym, an earlier one, such as the last build's: the unchanged runs of
+bytes it copies from dsym, and the rest.
+
+Usage: %s apply-delta base delta output
+Writes into output the dSYM that delta makes from base, checking that
+base is the dSYM it was made from, and output the one it makes.
+
+Usage: %s corpus-check [ -split ] [ -v ] [ flags ] dir ...
+Reads every Mach-O file under each dir, checks that its load commands
+are consistent, and with -split, splits each slice that has DWARF, as
+flags say, discarding the dSYM; then reports what it found, by type and
+architecture, and every file that failed, exiting nonzero if any did.
+
+Usage: %s edit-symbols [ -rename old=new ] [ -remove name ] [ -alias alias=target ] input output
+Writes to output the thin Mach-O file input with its symbols renamed,
+removed, or given aliases, as the flags say, in order, the symbol and
+indirect symbol tables and relocations renumbered to match, and
+__LINKEDIT resized; a removed symbol must not still be referred to.
+
+Usage: %s strip [ -S | -x | -tables ] input output
+Writes to output the thin Mach-O file input with only the symbols dyld
+and the linker need, or with -S all but the stabs, or with -x all but
+the stabs and local symbols, or with -tables no symbol tables at all,
+and __LINKEDIT packed to match: after a split, the dSYM keeps the rest.
+
+Flags:
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	opts.stripNoBackup = !*stripBackup
+	if *manifest != "" && opts.strip {
+		fail("-manifest records inputexe as it was split; it cannot be combined with -strip")
+	}
+	if dedupDir != "" && *chunks != "" {
+		fail("-chunks already shares what dSYMs have in common; it cannot be combined with -dedup")
+	}
+	if *batch {
+		if flag.NArg() < 1 {
+			flag.Usage()
+			return
+		}
+		if *manifest != "" {
+			fail("-manifest records a single input; it cannot be combined with -batch")
+		}
+		if !splitBatch(flag.Args(), *keepName, &opts, *failFast, *chunks) {
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
 		return
 	}
+	outdwarf := ""
+	if flag.NArg() > 1 {
+		outdwarf = flag.Arg(1)
+	}
+	if err := splitFile(flag.Arg(0), outdwarf, *keepName, &opts, *manifest, *chunks); err != nil {
+		fail("%v", err)
+	}
+}
 
+// splitFlags defines in fs the flags that set opts, which say how to
+// split; "sd reproduce" parses a manifest's record of them with it.
+func splitFlags(fs *flag.FlagSet, opts *splitOptions) {
+	fs.StringVar(&opts.arch, "arch", "", "if inputexe is a universal binary, split only its slice for `arch` (arm64, x86_64, ...,\n"+
+		"or host, for the slice this machine would run) into a thin dSYM")
+	fs.BoolVar(&opts.dsymutil, "dsymutil", false, "order load commands and segments as dsymutil does: UUID, versions, symtab, then every segment\n"+
+		"of inputexe in its original order, with __DWARF last")
+	fs.BoolVar(&opts.linkEditData, "linkedit-data", false, "also copy LC_FUNCTION_STARTS and LC_DATA_IN_CODE, so that consumers of the symbol table\n"+
+		"can enumerate functions without reading DWARF")
+	fs.BoolVar(&opts.onlyDwarf, "only-dwarf", false, "write only the UUID, versions, an abbreviated symbol table, and __DWARF, omitting the\n"+
+		"empty __PAGEZERO, __TEXT, __DATA, and __LINKEDIT segments; smaller, but not a dSYM every tool accepts")
+	fs.BoolVar(&opts.symbolsOnly, "symbols-only", false, "write the symbol table and LC_FUNCTION_STARTS but no __DWARF, for those who\n"+
+		"need symbolicated backtraces but must not receive the debugging information")
+	fs.Func("vmaddr", "assign segment addresses by `policy`: chain (the default; __LINKEDIT and __DWARF follow __DATA),\n"+
+		"preserve (as in inputexe, but for a __LINKEDIT that would overlap __DWARF, which then follows it), pack (each\n"+
+		"segment follows the one before), or base=ADDR (chain, slid to put __TEXT at ADDR)",
+		func(s string) error { return parseVmaddr(s, opts) })
+	cus := func() *cuFilter {
+		if opts.cus == nil {
+			opts.cus = new(cuFilter)
+		}
+		return opts.cus
+	}
+	fs.Func("include-cu", "keep only the DWARF of compile units whose names match `pattern` (repeatable; a pattern\n"+
+		"ending in /... matches a path and everything below it); units they refer to are kept as well",
+		func(s string) error { return cus().addInclude(s) })
+	fs.Func("exclude-cu", "drop the DWARF of compile units whose names match `pattern` (repeatable)",
+		func(s string) error { return cus().addExclude(s) })
+	fs.Func("redact", "remove from the DWARF the functions and variables whose names match `pattern` (repeatable),\n"+
+		"with their inlined copies and line table rows; the symbol table still names them",
+		func(s string) error {
+			if opts.redact == nil {
+				opts.redact = new(redaction)
+			}
+			return opts.redact.add(s)
+		})
+	fs.Func("supplementary", "if the DWARF refers into a supplementary (dwz alt) file, `policy` says what to do: fail (the default),\n"+
+		"inline (copy what it refers to into the dSYM), or record (write an incomplete dSYM, noting the file in any manifest)",
+		func(s string) error { return parseSupPolicy(s, opts) })
+	fs.Func("rename", "name the uncompressed DWARF sections by `policy`: canonical (the default; __zdebug_x becomes __debug_x,\n"+
+		"its full name cut to 16 bytes), keep (as in inputexe), or map=FROM:TO,... (the named sections as given, the rest canonical)",
+		func(s string) error { return parseRename(s, opts) })
+	fs.StringVar(&opts.supFile, "supplementary-file", "", "for -supplementary=inline, read the supplementary file from `file`\n"+
+		"rather than where the input names it")
+	fs.BoolVar(&opts.stripMacros, "strip-macros", false, "omit the DWARF macro sections, __debug_macinfo and __debug_macro, which can be large\n"+
+		"and record build-time definitions; DW_AT_macro_info and DW_AT_macros are left, dangling")
+	fs.BoolVar(&opts.lineTables, "line-tables-only", false, "keep only the DWARF line tables, and each compile unit's own DIE reduced to its name,\n"+
+		"directory, and address ranges; enough for profilers that need only file:line, in a fraction of the space")
+	fs.Func("filter", "pass each DWARF section through `command` (repeatable, in order), which reads a line naming the section,\n"+
+		"then its contents, and writes the contents to keep; for policies that sd cannot apply itself",
+		func(s string) error { return parseFilter(s, opts) })
+}
+
+// splitBatch splits each of inputs into the dSYM beside it, reporting
+// but otherwise getting past any that fail, unless failFast is set, in
+// which case it stops at the first.  It ends with a summary, and
+// returns whether every input was split.  With a chunkDir, each dSYM is
+// written as chunks there, as splitFile does.  An input that is the
+// same file as an earlier one, by a hard link, a symbolic link, or a
+// name differing only in case, is reported and skipped, not split twice;
+// one whose dSYM differs from an earlier one's only in case, and so
+// would overwrite it on a case-insensitive volume, fails.
+func splitBatch(inputs []string, keepName bool, opts *splitOptions, failFast bool, chunkDir string) bool {
+	var failed []string
+	done := 0
+	seen := map[string]os.FileInfo{}
+	outputs := map[string]string{}
+	for _, inexe := range inputs {
+		if earlier := sameAsSeen(seen, inexe); earlier != "" {
+			note("%s: the same file as %s, skipped", inexe, earlier)
+			continue
+		}
+		_, bundle := resolveInput(inexe, keepName)
+		_, out := dsymPath(bundle)
+		if err := foldCollision(outputs, out); err != nil {
+			note("%s: %v", inexe, err)
+			failed = append(failed, inexe)
+			if failFast {
+				break
+			}
+			continue
+		}
+		if err := splitFile(inexe, "", keepName, opts, "", chunkDir); err != nil {
+			note("%s: %v", inexe, err)
+			failed = append(failed, inexe)
+			if failFast {
+				break
+			}
+			continue
+		}
+		done++
+	}
+	skipped := len(inputs) - done - len(failed)
+	note("%d of %d inputs split, %d failed, %d skipped", done, len(inputs), len(failed), skipped)
+	for _, inexe := range failed {
+		note("failed: %s", inexe)
+	}
+	return len(failed) == 0
+}
+
+// splitFile writes the debugging information of inexe into outdwarf,
+// or if that is "", into the dSYM bundle beside inexe, and if manifest
+// is not "", a manifest of the two.  If chunkDir is not "", the dSYM
+// is written as chunks there, and outdwarf holds the index of them;
+// see chunk.go.  Malformed input is reported as an
+// error, never a panic, so one bad file cannot end a batch.
+func splitFile(inexe, outdwarf string, keepName bool, opts *splitOptions, manifest, chunkDir string) (err error) {
 	// Read input, find DWARF, be sure it looks right
-	inexe := os.Args[1]
+	inexe, bundle := resolveInput(inexe, keepName)
 	exef, err := os.Open(inexe)
 	if err != nil {
-		fail("Could not open %s, error=%v", inexe, err)
+		return fmt.Errorf("Could not open %s, error=%v", inexe, err)
 	}
-	exem, err := macho.NewFile(exef)
-	if err != nil {
-		fail("(internal) Couldn't create macho, err=%v", err)
+	defer exef.Close()
+	if opts.strip && isFat(exef) {
+		return fmt.Errorf("input file %s is universal; -strip rewrites only a thin inputexe", inexe)
 	}
+	opts.supDir = filepath.Dir(inexe)
 	// Postpone dealing with output till input is known-good
 
+	var dsym interface {
+		writeFile(name string, perm os.FileMode) error
+	}
+	var sup *Supplementary
+	var warnings []string
+	if isFat(exef) && opts.arch == "" {
+		fd, err := splitFat(exef, opts)
+		if err != nil {
+			return fmt.Errorf("input file %s: %v", inexe, err)
+		}
+		dsym, sup = fd, fd.supplementary
+		warnings = fd.warnings
+	} else {
+		exem, err := thinSlice(exef, opts.arch)
+		if err != nil && opts.arch != "" {
+			return fmt.Errorf("input file %s: %v", inexe, err)
+		}
+		if err != nil {
+			return fmt.Errorf("(internal) Couldn't create macho, err=%v", err)
+		}
+		d, err := splitDwarf(exem, opts)
+		if err != nil {
+			return fmt.Errorf("input file %s: %v", inexe, err)
+		}
+		dsym, sup = d, d.supplementary
+		warnings = d.warnings
+	}
+	for _, w := range warnings {
+		note("input file %s: %s", inexe, w)
+	}
+
+	var outbundle string
+	if outdwarf == "" {
+		outbundle, outdwarf = dsymPath(bundle)
+	}
+	if err := checkDistinct(inexe, outdwarf); err != nil {
+		return err
+	}
+	// Another sd may be writing the same dSYM; see lock.go.
+	l, err := lockDsym(outdwarf, opts.lockWait)
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+	if outbundle != "" {
+		outdir := filepath.Dir(outdwarf)
+		err := os.MkdirAll(outdir, 0755)
+		if err != nil {
+			return fmt.Errorf("Could not create directory for debugging symbols %s, error=%v", outdir, err)
+		}
+		err = writeInfoPlist(outbundle, filepath.Base(outdwarf))
+		if err != nil {
+			return fmt.Errorf("Could not write Info.plist in %s, error=%v", outbundle, err)
+		}
+	}
+	if chunkDir != "" {
+		// Nor may "sd store gc" prune chunks the index will list.
+		if err := os.MkdirAll(chunkDir, 0755); err != nil {
+			return err
+		}
+		l, err := lockStore(chunkDir, opts.lockWait)
+		if err != nil {
+			return err
+		}
+		defer l.unlock()
+	}
+	if err := removeOutput(outdwarf); err != nil {
+		return fmt.Errorf("Could not replace %s, error=%v", outdwarf, err)
+	}
+	if chunkDir != "" {
+		err = writeChunked(dsym, outdwarf, chunkDir, opts.chunkContentOnly)
+	} else {
+		err = dsym.writeFile(outdwarf, 0755)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not create output dwarf/dsym file %s, error=%v", outdwarf, err)
+	}
+	if chunkDir == "" && dedupDir != "" {
+		if err := dedupFile(dedupDir, outdwarf); err != nil {
+			return fmt.Errorf("Could not share %s through %s, error=%v", outdwarf, dedupDir, err)
+		}
+	}
+	if opts.strip {
+		if err := stripInput(inexe, !opts.stripNoBackup, opts.stripSigned); err != nil {
+			return fmt.Errorf("Could not strip input file %s, error=%v", inexe, err)
+		}
+	}
+
+	if manifest != "" {
+		err = writeManifest(manifest, inexe, []string{outdwarf}, sup, opts)
+		if err != nil {
+			return fmt.Errorf("Could not write manifest %s, error=%v", manifest, err)
+		}
+	}
+	return nil
+}
+
+// A dsym is a laid-out dSYM file: its table of contents, with the
+// contents of the file registered to be written.  The DWARF sections,
+// which come last, are copied from the input as the file is written,
+// so they are never all in memory at once.
+type dsym struct {
+	toc  *macho.FileTOC
+	size int64
+
+	// If the input's DWARF refers into a supplementary file, that file.
+	supplementary *Supplementary
+
+	// What the split put right in the input, for the user to know.
+	warnings []string
+}
+
+// A dsymSection is a DWARF section of the dSYM: an input section, to be
+// copied, or if edited, replacement contents for it.
+type dsymSection struct {
+	in     *macho.Section
+	data   []byte
+	edited bool
+}
+
+// attach registers the contents of ds as those of s, its section in t.
+// Sections compressed in the input are inflated as they are copied.
+func (ds dsymSection) attach(t *macho.FileTOC, s *macho.Section) error {
+	if ds.edited {
+		t.AddSectionData(s, ds.data)
+		return nil
+	}
+	return t.AddSectionFrom(s, ds.in, macho.PayloadDecompress)
+}
+
+// size returns the size of s in the dSYM, or an error if s is an input
+// section whose compression cannot be read.
+func (s dsymSection) size() (uint64, error) {
+	if s.edited {
+		return uint64(len(s.data)), nil
+	}
+	return s.in.UncompressedSize()
+}
+
+// WriteTo writes the dSYM file to w.
+func (d *dsym) WriteTo(w io.Writer) (int64, error) {
+	written, err := d.toc.WriteTo(w)
+	if err == nil && written != d.size {
+		err = fmt.Errorf("(internal) wrote %d bytes of a %d-byte dSYM", written, d.size)
+	}
+	return written, err
+}
+
+// Bytes returns the whole dSYM file.
+func (d *dsym) Bytes() ([]byte, error) {
+	var b bytes.Buffer
+	b.Grow(int(d.size))
+	_, err := d.WriteTo(&b)
+	return b.Bytes(), err
+}
+
+// writeFile writes the dSYM file to name, with permissions perm.
+func (d *dsym) writeFile(name string, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = d.WriteTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// splitDwarf lays out a dSYM file holding the debugging information of
+// exem, as directed by opts.
+func splitDwarf(exem *macho.File, opts *splitOptions) (*dsym, error) {
+	p, err := planDsym(exem, opts)
+	if err != nil {
+		return nil, err
+	}
+	return p.assemble()
+}
+
+// planDsym decides the layout of a dSYM file holding the debugging
+// information of exem, as directed by opts, and what to write there,
+// but writes none of it.
+func planDsym(exem *macho.File, opts *splitOptions) (p *dsymPlan, err error) {
+	if opts.onlyDwarf && (opts.dsymutil || opts.linkEditData || opts.symbolsOnly || opts.vmaddr != vmaddrChain) {
+		return nil, fmt.Errorf("-only-dwarf cannot be combined with -dsymutil, -linkedit-data, -symbols-only, or -vmaddr")
+	}
+	if opts.symbolsOnly && (opts.cus != nil || opts.redact != nil || opts.lineTables) {
+		return nil, fmt.Errorf("-symbols-only writes no DWARF to select compile units from, redact, or reduce to line tables")
+	}
+
 	cmdOffset := unsafe.Sizeof(exem.FileHeader)
 	is64bit := exem.Magic == macho.Magic64
 	if is64bit {
@@ -58,7 +611,7 @@ is used instead.
 		cmdOffset += unsafe.Sizeof(exem.Magic)
 	}
 
-	// describe(&exem.FileTOC)
+	// describe(os.Stderr, &exem.FileTOC)
 
 	// Offsets into __LINKEDIT:
 	//
@@ -76,18 +629,9 @@ is used instead.
 	// Command LC_DYSYMTAB = indices within symtab (above), except for IndSym
 	//   IndSym Offset = file offset (within link edit section) of 4-byte indices within symtab.
 	//
-	// Section __TEXT.__symbol_stub1.
-	//   Offset and size (Reserved2) locate and describe a table for thios section.
-	//   Symbols beginning at IndirectSymIndex (Reserved1) (see LC_DYSYMTAB.IndSymOffset) refer to this table.
-	//   (These table entries are PLTs, I think)
-	//
-	// Section __DATA.__nl_symbol_ptr.
-	//   Reserved1 seems to be an index within the Indirect symbols (see LC_DYSYMTAB.IndSymOffset)
-	//   Some of these symbols appear to be duplicates of other indirect symbols appearing early
-	//
-	// Section __DATA.__la_symbol_ptr.
-	//   Reserved1 seems to be an index within the Indirect symbols (see LC_DYSYMTAB.IndSymOffset)
-	//   Some of these symbols appear to be duplicates of other indirect symbols appearing early
+	// Stub and symbol pointer sections (__TEXT.__symbol_stub1, __DATA.__la_symbol_ptr, ...)
+	// are bound to symbols by the IndSym table, from their Reserved1 on; see
+	// macho.File.IndirectSymbols.
 	//
 
 	// Create a File for the output dwarf.
@@ -103,10 +647,14 @@ is used instead.
 	// Segment __DWARF (uncompressed)
 
 	var uuid macho.Load
+	var versions []macho.Load // copied after the UUID, as dsymutil does
 	for _, l := range exem.Loads {
 		switch l.Command() {
 		case macho.LcUuid:
 			uuid = l
+		case macho.LcVersionMinMacosx, macho.LcVersionMinIphoneos, macho.LcVersionMinTvos,
+			macho.LcVersionMinWatchos, macho.LcBuildVersion, macho.LcSourceVersion:
+			versions = append(versions, l)
 		}
 	}
 
@@ -114,32 +662,53 @@ is used instead.
 	//	note("%s has no uuid", inexe)
 	//}
 
-	// Ensure a given load is not nil
-	nonnilC := func(l macho.Load, s string) {
-		if l == nil {
-			fail("input file %s lacks load command %s", inexe, s)
-		}
-	}
-
-	// Find a segment by name and ensure it is not nil
+	// Find a segment by name, noting if it is missing
 	nonnilS := func(s string) *macho.Segment {
 		l := exem.Segment(s)
-		if l == nil {
-			fail("input file %s lacks segment %s", inexe, s)
+		if l == nil && err == nil {
+			err = fmt.Errorf("lacks segment %s", s)
 		}
 		return l
 	}
 
+	// Add addresses or offsets, noting if the sum overflows.
+	add := func(x, y uint64) uint64 {
+		sum, ok := macho.CheckedAdd(x, y)
+		if !ok && err == nil {
+			err = fmt.Errorf("address or offset overflows (0x%x + 0x%x)", x, y)
+		}
+		return sum
+	}
+	// Likewise round them up.
+	roundUp := func(x, align uint64) uint64 {
+		r, ok := macho.CheckedRoundUp(x, align)
+		if !ok && err == nil {
+			err = fmt.Errorf("address or offset overflows (0x%x rounded up to a multiple of 0x%x)", x, align)
+		}
+		return r
+	}
+
 	newtoc := exem.FileTOC.DerivedCopy(macho.MhDsym, 0)
 
 	symtab := exem.Symtab
 	dysymtab := exem.Dysymtab // Not appearing in output, but necessary to construct output
-	nonnilC(symtab, "symtab")
-	nonnilC(dysymtab, "dysymtab")
+	if symtab == nil {
+		return nil, fmt.Errorf("lacks load command symtab")
+	}
+	if dysymtab == nil {
+		return nil, fmt.Errorf("lacks load command dysymtab")
+	}
 	text := nonnilS("__TEXT")
 	data := nonnilS("__DATA")
 	linkedit := nonnilS("__LINKEDIT")
 	pagezero := nonnilS("__PAGEZERO")
+	dwarf := exem.Segment("__DWARF")
+	if !opts.symbolsOnly {
+		dwarf = nonnilS("__DWARF")
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	newtext := text.CopyZeroed()
 	newdata := data.CopyZeroed()
@@ -155,9 +724,23 @@ is used instead.
 	// Symbols come first
 	linkeditsymbase := uint32(1) << pageAlign
 
+	// Only those symbols from dysymtab.defsym are written into the debugging information,
+	// except that -symbols-only output, which has no DWARF to name functions in a
+	// backtrace, also gets the local symbols (but not the stabs among them).
+	var symbols []uint32
+	if opts.symbolsOnly {
+		for i := dysymtab.Ilocalsym; i < dysymtab.Ilocalsym+dysymtab.Nlocalsym; i++ {
+			if !symtab.Syms[i].IsStab() {
+				symbols = append(symbols, i)
+			}
+		}
+	}
+	for i := uint32(0); i < dysymtab.Nextdefsym; i++ {
+		symbols = append(symbols, i+dysymtab.Iextdefsym)
+	}
+
 	// Strings come second, offset by the number of symbols times their size.
-	// Only those symbols from dysymtab.defsym are written into the debugging information.
-	linkeditstringbase := linkeditsymbase + exem.FileTOC.SymbolSize()*dysymtab.Nextdefsym
+	linkeditstringbase := linkeditsymbase + exem.FileTOC.SymbolSize()*uint32(len(symbols))
 
 	// The first two bytes of the strings are reserved for space, null (' ', \000)
 	linkeditstringcur := uint32(2)
@@ -165,11 +748,16 @@ is used instead.
 	newsymtab.Syms = newsymtab.Syms[:0]
 	newsymtab.Symoff = linkeditsymbase
 	newsymtab.Stroff = linkeditstringbase
-	newsymtab.Nsyms = dysymtab.Nextdefsym
-	for i := uint32(0); i < dysymtab.Nextdefsym; i++ {
-		ii := i + dysymtab.Iextdefsym
+	newsymtab.Nsyms = uint32(len(symbols))
+	for _, ii := range symbols {
 		oldsym := symtab.Syms[ii]
 		// fmt.Printf("Extdef %d = %#v\n", i, oldsym)
+		if opts.onlyDwarf && oldsym.Kind() == macho.NSect {
+			// The sections it was defined in are not written,
+			// so leave it as just an address.
+			oldsym.Type = oldsym.Type&^macho.NType | macho.NAbs
+			oldsym.Sect = 0
+		}
 		newsymtab.Syms = append(newsymtab.Syms, oldsym)
 
 		linkeditsyms = append(linkeditsyms, macho.Nlist64{Name: uint32(linkeditstringcur),
@@ -178,10 +766,37 @@ is used instead.
 		linkeditstrings = append(linkeditstrings, oldsym.Name)
 	}
 	newsymtab.Strsize = linkeditstringcur
+	linkeditend := uint64(linkeditstringbase) + uint64(linkeditstringcur)
+
+	// Optionally, LINKEDIT payloads that let symbol-table-only consumers
+	// find functions; these follow the strings.
+	var linkeditdata []*macho.LinkEditData
+	var linkeditpayloads [][]byte
+	if opts.linkEditData || opts.symbolsOnly {
+		for _, l := range exem.Loads {
+			le, ok := l.(*macho.LinkEditData)
+			if !ok || le.Command() != macho.LcFunctionStarts && (le.Command() != macho.LcDataInCode || !opts.linkEditData) {
+				continue
+			}
+			payload := make([]byte, le.DataLen)
+			if _, err := linkedit.ReadAt(payload, int64(le.DataOff)-int64(linkedit.Offset)); err != nil {
+				return nil, fmt.Errorf("reading %v payload: %v", le.Command(), err)
+			}
+			nle := le.Copy()
+			linkeditend = roundUp(linkeditend, 8)
+			nle.DataOff = uint32(linkeditend)
+			linkeditend = add(linkeditend, uint64(nle.DataLen))
+			linkeditdata = append(linkeditdata, nle)
+			linkeditpayloads = append(linkeditpayloads, payload)
+		}
+	}
 
 	if uuid != nil {
 		newtoc.AddLoad(uuid)
 	}
+	for _, l := range versions {
+		newtoc.AddLoad(l)
+	}
 
 	// For the specified segment (assumed to be in exem) make a copy of its
 	// sections with appropriate fields zeroed out, and append them to the
@@ -196,125 +811,236 @@ is used instead.
 		}
 	}
 
-	newtoc.AddLoad(newsymtab)
-	newtoc.AddSegment(pagezero)
-	newtoc.AddSegment(newtext)
-	copyZOdSections(text)
-	newtoc.AddSegment(newdata)
-	copyZOdSections(data)
-
 	newlinkedit := linkedit.Copy()
 	newlinkedit.Offset = uint64(linkeditsymbase)
-	newlinkedit.Filesz = uint64(linkeditstringcur)
-	newlinkedit.Addr = macho.RoundUp(newdata.Addr+newdata.Memsz, 1<<pageAlign)
-	newlinkedit.Memsz = macho.RoundUp(newlinkedit.Filesz, 1<<pageAlign)
+	newlinkedit.Filesz = linkeditend - newlinkedit.Offset
+	newlinkedit.Addr = roundUp(add(newdata.Addr, newdata.Memsz), 1<<pageAlign)
+	newlinkedit.Memsz = roundUp(newlinkedit.Filesz, 1<<pageAlign)
+	if err != nil {
+		return nil, err
+	}
 	// The rest should copy over fine.
-	newtoc.AddSegment(newlinkedit)
 
-	dwarf := nonnilS("__DWARF")
-	newdwarf := dwarf.CopyZeroed()
-	newdwarf.Offset = macho.RoundUp(newlinkedit.Offset+newlinkedit.Filesz, 1<<pageAlign)
-	newdwarf.Filesz = dwarf.UncompressedSize(&exem.FileTOC, 1)
-	newdwarf.Addr = newlinkedit.Addr + newlinkedit.Memsz
-	newdwarf.Memsz = macho.RoundUp(newdwarf.Filesz, 1<<pageAlign)
-
-	newtoc.AddSegment(newdwarf)
+	newtoc.AddLoad(newsymtab)
+	for _, l := range linkeditdata {
+		newtoc.AddLoad(l)
+	}
+	switch {
+	case opts.onlyDwarf:
+		// Symbols and strings lie outside any segment, between the
+		// load commands and __DWARF; see below.
+	case opts.dsymutil:
+		// Every segment but __DWARF, in the executable's order;
+		// __DWARF is added last, below.
+		for _, l := range exem.Loads {
+			g, ok := l.(*macho.Segment)
+			switch {
+			case !ok || g == dwarf:
+			case g == linkedit:
+				newtoc.AddSegment(newlinkedit)
+			default:
+				newtoc.AddSegment(g.CopyZeroed())
+				copyZOdSections(g)
+			}
+		}
+	default:
+		newtoc.AddSegment(pagezero)
+		newtoc.AddSegment(newtext)
+		copyZOdSections(text)
+		newtoc.AddSegment(newdata)
+		copyZOdSections(data)
+		newtoc.AddSegment(newlinkedit)
+	}
 
-	offset := uint32(newdwarf.Offset)
+	// Without __DWARF, the file ends with __LINKEDIT.
+	var newdwarf *macho.Segment
+	var dwarfSections []dsymSection
+	var sup *Supplementary
+	var warnings []string
+	if !opts.symbolsOnly {
+		edits := make(map[*macho.Section]sectionEdit)
+		_, dups := dedupDWARFSections(exem)
+		for _, d := range dups {
+			edits[d.drop] = sectionEdit{drop: true}
+			warnings = append(warnings, d.String())
+		}
+		// DWARF that cannot be read is copied as it is, as it always
+		// has been, unless it is to be combined with another file's.
+		if sup, err = findSupplementary(exem, edits); err != nil {
+			if opts.supplementary == supInline {
+				return nil, err
+			}
+			sup, err = nil, nil
+		}
+		if sup != nil {
+			switch opts.supplementary {
+			case supFail:
+				return nil, fmt.Errorf("DWARF refers into supplementary file %q (%d DIE and %d string references); "+
+					"use -supplementary=inline to copy them in, or -supplementary=record to write an incomplete dSYM", sup.Name, sup.DIERefs, sup.StrRefs)
+			case supInline:
+				name, err := supplementaryPath(sup, opts.supFile, opts.supDir)
+				if err != nil {
+					return nil, err
+				}
+				alt, err := macho.Open(name)
+				if err != nil {
+					return nil, fmt.Errorf("supplementary file: %v", err)
+				}
+				err = inlineSupplementary(exem, alt, edits)
+				alt.Close()
+				if err != nil {
+					return nil, err
+				}
+				sup.Inlined = true
+			}
+		}
+		if opts.stripMacros {
+			for _, s := range exem.Sections[dwarf.Firstsect : dwarf.Firstsect+dwarf.Nsect] {
+				if macho.IsDWARFMacroSection(s.Name) {
+					edits[s] = sectionEdit{drop: true}
+				}
+			}
+		}
+		if opts.redact != nil {
+			if err := redactDwarf(exem, opts.redact, edits); err != nil {
+				return nil, err
+			}
+		}
+		if opts.cus != nil {
+			if err := filterCompileUnits(exem, opts.cus, edits); err != nil {
+				return nil, err
+			}
+		}
+		if opts.lineTables {
+			if err := lineTablesOnly(exem, edits); err != nil {
+				return nil, err
+			}
+		}
+		transforms := opts.sectionTransforms()
+		dwarfsize := uint64(0)
+		var dwarfSizes []uint64 // of each of dwarfSections
+		for _, s := range exem.Sections[dwarf.Firstsect : dwarf.Firstsect+dwarf.Nsect] {
+			e, edited := edits[s]
+			if e.drop || s.Name == stampSection {
+				continue
+			}
+			ds := dsymSection{in: s, data: e.data, edited: edited}
+			if len(transforms) > 0 {
+				// A transform needs the whole section, so the
+				// section is no longer streamed from the input.
+				if !ds.edited {
+					if ds.data, err = s.UncompressedData(); err != nil {
+						return nil, fmt.Errorf("reading %s: %v", s.Name, err)
+					}
+				}
+				if ds.data, err = macho.ApplyTransforms(transforms, s, ds.data); err != nil {
+					return nil, err
+				}
+				ds.edited = true
+			}
+			size, err := ds.size()
+			if err != nil {
+				return nil, err
+			}
+			dwarfSections = append(dwarfSections, ds)
+			dwarfSizes = append(dwarfSizes, size)
+			dwarfsize = add(dwarfsize, size)
+		}
+		// Last, the record of how the dSYM was made, which follows the
+		// other sections in memory as well.
+		stamp := &macho.Section{SectionHeader: macho.SectionHeader{Name: stampSection, Seg: "__DWARF", Addr: dwarf.Addr}}
+		if n := len(dwarfSections); n > 0 {
+			stamp.Addr = add(dwarfSections[n-1].in.Addr, dwarfSizes[n-1])
+		}
+		ds := dsymSection{in: stamp, data: makeStamp(opts), edited: true}
+		dwarfSections = append(dwarfSections, ds)
+		dwarfSizes = append(dwarfSizes, uint64(len(ds.data)))
+		dwarfsize = add(dwarfsize, uint64(len(ds.data)))
 
-	for i := dwarf.Firstsect; i < dwarf.Firstsect+dwarf.Nsect; i++ {
-		o := exem.Sections[i]
-		s := o.Copy()
-		s.Offset = offset
-		us := o.UncompressedSize()
-		if s.Size < us {
-			s.Size = uint64(us)
-			s.Align = 0 // This is apparently true for debugging sections; not sure if it generalizes.
+		newdwarf = dwarf.CopyZeroed()
+		newdwarf.Offset = roundUp(add(newlinkedit.Offset, newlinkedit.Filesz), 1<<pageAlign)
+		newdwarf.Filesz = dwarfsize
+		newdwarf.Addr = add(newlinkedit.Addr, newlinkedit.Memsz)
+		if opts.onlyDwarf {
+			newdwarf.Addr = dwarf.Addr
 		}
-		offset += uint32(us)
-		if strings.HasPrefix(s.Name, "__z") {
-			s.Name = s.Name[0:2] + s.Name[3:]
+		newdwarf.Memsz = roundUp(newdwarf.Filesz, 1<<pageAlign)
+		if err != nil {
+			return nil, err
+		}
+		// Section offsets are only 32 bits.
+		if add(newdwarf.Offset, newdwarf.Filesz) > math.MaxUint32 {
+			return nil, fmt.Errorf("uncompressed DWARF (%d bytes) is too large for a Mach-O file", newdwarf.Filesz)
 		}
-		s.Reloff = 0
-		s.Nreloc = 0
-		newtoc.AddSection(s)
-	}
 
-	//note("New table of contents:")
-	//describe(newtoc)
+		newtoc.AddSegment(newdwarf)
 
-	buffer := make([]byte, newtoc.FileSize())
+		offset := uint32(newdwarf.Offset)
 
-	// Write segments/sections.
-	// Only dwarf and linkedit contain anything interesting.
-	// (1) Linkedit segment
-	offset = uint32(newlinkedit.Offset)
-	for i := range linkeditsyms {
-		if is64bit {
-			offset += linkeditsyms[i].Put64(buffer[offset:], newtoc.ByteOrder)
-		} else {
-			offset += linkeditsyms[i].Put32(buffer[offset:], newtoc.ByteOrder)
+		named := make(map[string]bool)
+		for i, ds := range dwarfSections {
+			s := ds.in.Copy()
+			s.Offset = offset
+			us := dwarfSizes[i]
+			if s.Size != us {
+				s.Size = uint64(us)
+				s.Align = 0 // This is apparently true for debugging sections; not sure if it generalizes.
+			}
+			offset += uint32(us)
+			s.Name = opts.sectionName(s.Name)
+			if named[s.Name] {
+				return nil, fmt.Errorf("two DWARF sections would be named %s", s.Name)
+			}
+			named[s.Name] = true
+			s.Reloff = 0
+			s.Nreloc = 0
+			newtoc.AddSection(s)
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
 
-	buffer[linkeditstringbase] = ' '
-	buffer[linkeditstringbase+1] = 0
-	offset = linkeditstringbase + 2
-	for _, str := range linkeditstrings {
-		for i := 0; i < len(str); i++ {
-			buffer[offset] = str[i]
-			offset++
+	// Checked before the shift below, which would underflow.
+	if newtoc.TOCSize() > linkeditsymbase {
+		return nil, fmt.Errorf("load commands (%d bytes) do not fit before __LINKEDIT", newtoc.TOCSize())
+	}
+	if opts.onlyDwarf {
+		// With no __LINKEDIT to hold them, symbols and strings follow
+		// the load commands directly, and __DWARF follows them.  As
+		// linkeditsymbase is a multiple of 8, shift cannot underflow.
+		shift := linkeditsymbase - uint32(macho.RoundUp(uint64(newtoc.TOCSize()), 8))
+		newsymtab.Symoff -= shift
+		newsymtab.Stroff -= shift
+		dwarfOffset := macho.RoundUp(linkeditend-uint64(shift), 16)
+		for i := newdwarf.Firstsect; i < newdwarf.Firstsect+newdwarf.Nsect; i++ {
+			newtoc.Sections[i].Offset -= uint32(newdwarf.Offset - dwarfOffset)
 		}
-		buffer[offset] = 0
-		offset++
+		newdwarf.Offset = dwarfOffset
 	}
 
-	// (2) DWARF segment
-	ioff := newdwarf.Firstsect - dwarf.Firstsect
-	for i := dwarf.Firstsect; i < dwarf.Firstsect+dwarf.Nsect; i++ {
-		s := exem.Sections[i]
-		j := i + ioff
-		s.PutUncompressedData(buffer[newtoc.Sections[j].Offset:])
+	if err := assignAddrs(newtoc, exem, linkeditsyms, opts); err != nil {
+		return nil, err
 	}
 
-	// Because "text" overlaps the header and the loads, write them afterwards, just in case.
-	// Write header.
-	newtoc.Put(buffer)
-
-	outdwarf := inexe + ".dSYM/Contents/Resources/DWARF"
-	if len(os.Args) > 2 {
-		outdwarf = os.Args[2]
-	} else {
-		err := os.MkdirAll(outdwarf, 0755)
-		if err != nil {
-			fail("Could not create directory for debugging symbols %s, error=%v", outdwarf, err)
-		}
-		outdwarf += "/" + inexe
-	}
-	err = ioutil.WriteFile(outdwarf, buffer, 0755)
-	if err != nil {
-		fail("Could not create output dwarf/dsym file %s, error=%v\n", outdwarf, err)
+	//note("New table of contents:")
+	//describe(os.Stderr, newtoc)
+	if err := newtoc.Validate(); err != nil {
+		return nil, fmt.Errorf("(internal) inconsistent output: %v", err)
 	}
-}
 
-func describe(exem *macho.FileTOC) {
-	note("Type = %s, Flags=0x%x", exem.Type, uint32(exem.Flags))
-	for i, l := range exem.Loads {
-		if s, ok := l.(*macho.Segment); ok {
-			fmt.Printf("Load %d is Segment %s, offset=0x%x, filesz=%d, addr=0x%x, memsz=%d, nsect=%d\n", i, s.Name,
-				s.Offset, s.Filesz, s.Addr, s.Memsz, s.Nsect)
-			for j := uint32(0); j < s.Nsect; j++ {
-				c := exem.Sections[j+s.Firstsect]
-				fmt.Printf("   Section %s, offset=0x%x, size=%d, addr=0x%x, flags=0x%x, nreloc=%d, res1=%d, res2=%d, res3=%d\n", c.Name, c.Offset, c.Size, c.Addr, c.Flags, c.Nreloc, c.Reserved1, c.Reserved2, c.Reserved3)
-			}
-		} else {
-			fmt.Printf("Load %d is %v\n", i, l)
-		}
+	p = &dsymPlan{
+		toc:           newtoc,
+		symtab:        newsymtab,
+		syms:          linkeditsyms,
+		strings:       linkeditstrings,
+		linkeditdata:  linkeditdata,
+		payloads:      linkeditpayloads,
+		supplementary: sup,
+		warnings:      warnings,
 	}
-	if exem.Cmdsz != exem.LoadSize() {
-		fail("recorded command size %d does not equal computed command size %d", exem.Cmdsz, exem.LoadSize())
-	} else {
-		note("recorded command size %d, computed command size %d", exem.Cmdsz, exem.LoadSize())
+	if newdwarf != nil {
+		p.dwarf, p.dwarfSections = newdwarf, dwarfSections
 	}
-	note("File size is %d", exem.FileSize())
+	return p, nil
 }
@@ -0,0 +1,3375 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"debug/dwarf"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+var awkwardNames = []string{
+	"hello",
+	"My Product",
+	"Ünïcödé 日本語 app",
+	"a&b <c> \"d\" 'e'",
+	"emoji 🚀",
+	strings.Repeat("x", 255),
+	strings.Repeat("é", 127),
+	strings.Repeat("日", 85),
+	strings.Repeat("日", 100), // too long for a file, but possible in a server request
+}
+
+func TestDsymPath(t *testing.T) {
+	dir := filepath.Join("some dir", "ünïcode")
+	for _, name := range awkwardNames {
+		bundle, file := dsymPath(filepath.Join(dir, name))
+		if filepath.Dir(bundle) != dir {
+			t.Errorf("%q: bundle %q not in %q", name, bundle, dir)
+		}
+		b := filepath.Base(bundle)
+		if len(b) > maxNameBytes || !utf8.ValidString(b) || !hasDsymSuffix(b) {
+			t.Errorf("%q: bad bundle name %q (%d bytes)", name, b, len(b))
+		}
+		if filepath.Dir(file) != filepath.Join(bundle, "Contents", "Resources", "DWARF") {
+			t.Errorf("%q: file %q not in bundle %q", name, file, bundle)
+		}
+		f := filepath.Base(file)
+		if len(name) <= maxNameBytes && f != name {
+			t.Errorf("%q: DWARF file named %q", name, f)
+		}
+		if len(f) > maxNameBytes || !utf8.ValidString(f) {
+			t.Errorf("%q: bad DWARF file name %q (%d bytes)", name, f, len(f))
+		}
+	}
+
+	// Distinct long names must not share a bundle.
+	long := strings.Repeat("y", 300)
+	b1, _ := dsymPath(long + "1")
+	b2, _ := dsymPath(long + "2")
+	if b1 == b2 {
+		t.Errorf("long names share bundle %q", b1)
+	}
+}
+
+func TestSafeFileName(t *testing.T) {
+	tests := []struct {
+		in       string
+		portable bool
+		want     string
+	}{
+		{"hello", true, "hello"},
+		{"My Product", true, "My Product"},
+		{"日本語", true, "日本語"},
+		{"a/b", false, "a_b"},
+		{"a:b?", false, "a:b?"},
+		{"a:b?", true, "a_b_"},
+		{"trailing. ", true, "trailing__"},
+		{"con.txt", true, "_con.txt"},
+		{"", false, "_"},
+		{"..", false, "_.."},
+	}
+	for _, tt := range tests {
+		if got := safeFileName(tt.in, tt.portable); got != tt.want {
+			t.Errorf("safeFileName(%q, %v) = %q, want %q", tt.in, tt.portable, got, tt.want)
+		}
+	}
+}
+
+func TestFoldCollision(t *testing.T) {
+	tests := []struct {
+		outputs []string
+		collide bool // whether the last collides with one before it
+	}{
+		{[]string{"bin/Foo.dSYM", "bin/foo.dSYM"}, true},
+		{[]string{"bin/foo.dSYM", "BIN/FOO.DSYM"}, true},
+		{[]string{"bin/foo.dSYM", "bin/bar.dSYM", "bin/FOO.dSYM"}, true},
+		{[]string{"bin/foo.dSYM", "bin/foo.dSYM"}, true},
+		{[]string{"bin/foo.dSYM", "lib/foo.dSYM"}, false},
+		{[]string{"bin/foo.dSYM", "bin/foo2.dSYM"}, false},
+		{[]string{"Ωmega.dSYM", "ωMEGA.dSYM"}, true},
+		{[]string{"K.dSYM", "\u212a.dSYM"}, true}, // the Kelvin sign folds to k
+		{[]string{"Straße.dSYM", "STRASSE.dSYM"}, false},
+	}
+	for _, tt := range tests {
+		seen := map[string]string{}
+		var err error
+		for i, out := range tt.outputs {
+			if err = foldCollision(seen, out); err != nil && i < len(tt.outputs)-1 {
+				t.Errorf("%q: %s collides: %v", tt.outputs, out, err)
+			}
+		}
+		if (err != nil) != tt.collide {
+			t.Errorf("%q: the last collides: %v, want %v", tt.outputs, err, tt.collide)
+		}
+		if len(tt.outputs) == 2 && strings.EqualFold(tt.outputs[0], tt.outputs[1]) != tt.collide {
+			t.Errorf("%q: strings.EqualFold disagrees with foldCollision", tt.outputs)
+		}
+	}
+}
+
+func TestInfoPlist(t *testing.T) {
+	for _, name := range awkwardNames {
+		var plist struct {
+			Dict struct {
+				Keys    []string `xml:"key"`
+				Strings []string `xml:"string"`
+			} `xml:"dict"`
+		}
+		if err := xml.Unmarshal(infoPlist(name), &plist); err != nil {
+			t.Errorf("%q: %v", name, err)
+			continue
+		}
+		d := plist.Dict
+		if len(d.Keys) != len(d.Strings) {
+			t.Fatalf("%q: %d keys, %d values", name, len(d.Keys), len(d.Strings))
+		}
+		for i, k := range d.Keys {
+			if k != "CFBundleIdentifier" {
+				continue
+			}
+			id := d.Strings[i]
+			if !strings.HasPrefix(id, "com.apple.xcode.dsym.") {
+				t.Errorf("%q: identifier %q", name, id)
+			}
+			for _, r := range id {
+				if !(r == '.' || r == '-' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+					t.Errorf("%q: identifier %q contains %q", name, id, r)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestWriteInfoPlist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range awkwardNames {
+		bundle, file := dsymPath(filepath.Join(dir, name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeInfoPlist(bundle, name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+		if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	f, err := macho.Open("macho/testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want, err := ioutil.ReadFile("testdata/gcc-amd64-darwin-exec.describe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		var b bytes.Buffer
+		if err := describe(&b, &f.FileTOC); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), want) {
+			t.Fatalf("describe output differs from golden file:\n%s", b.Bytes())
+		}
+	}
+}
+
+func TestDescribeFat(t *testing.T) {
+	f, err := os.Open("macho/testdata/fat-gcc-386-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var b bytes.Buffer
+	if err := describeFat(&b, f); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"Universal, narch=2\n",
+		"\nArch 0 is i386, subcpu=0x3, offset=0x1000, ",
+		"\nArch 1 is x86_64, subcpu=0x80000003, offset=0x5000, ",
+		"Load 8 is UnixThread x86_THREAD_STATE64, pc=0x100000f14\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("describeFat output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestDescribeWeak(t *testing.T) {
+	f, err := macho.Open("macho/testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var b bytes.Buffer
+	if err := describeWeak(&b, f); err != nil || b.Len() != 0 {
+		t.Errorf("describeWeak of a file without weak symbols = %q, %v", b.String(), err)
+	}
+	f.Symtab.Syms = append(f.Symtab.Syms,
+		macho.Symbol{Name: "_weak", Type: macho.NSect | macho.NExt, Sect: 1, Desc: macho.NWeakDef, Value: 0x100000f00},
+		macho.Symbol{Name: "_maybe", Type: macho.NUndf | macho.NExt, Desc: macho.NWeakRef | 2<<8})
+	if err := describeWeak(&b, f); err != nil {
+		t.Fatal(err)
+	}
+	want := "Weak definition _weak, addr=0x100000f00\nWeak reference _maybe, library=2\n"
+	if b.String() != want {
+		t.Errorf("describeWeak output\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+// testExecutable returns a small synthetic 64-bit executable with the
+// segments splitDwarf needs, and __DATA_CONST, which it need not copy.
+// __DATA is not adjacent to __TEXT, and __DWARF lies between __DATA
+// and __LINKEDIT, as the Go linker puts it.
+func testExecutable(t *testing.T) *macho.File {
+	t.Helper()
+	f, err := macho.NewFile(bytes.NewReader(testExecutableBytes(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// testExecutableBytes returns the image that testExecutable parses.
+func testExecutableBytes(t *testing.T) []byte {
+	t.Helper()
+	o := binary.LittleEndian
+	toc := &macho.FileTOC{
+		FileHeader: macho.FileHeader{Magic: macho.Magic64, Cpu: macho.CpuAmd64, SubCpu: 3, Type: macho.MhExecute},
+		ByteOrder:  o,
+	}
+	seg := func(name string, addr, memsz, off, filesz uint64) {
+		toc.AddSegment(&macho.Segment{SegmentHeader: macho.SegmentHeader{LoadCmd: macho.LcSegment64,
+			Name: name, Addr: addr, Memsz: memsz, Offset: off, Filesz: filesz, Maxprot: 7, Prot: 5}})
+	}
+	sect := func(name, seg string, addr, size uint64, off uint32) {
+		toc.AddSection(&macho.Section{SectionHeader: macho.SectionHeader{Name: name, Seg: seg, Addr: addr, Size: size, Offset: off}})
+	}
+	toc.AddLoad(macho.LoadCmdBytes{LoadCmd: macho.LcUuid, LoadBytes: []byte{
+		0x1b, 0, 0, 0, 24, 0, 0, 0,
+		0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0xfe, 0xdc, 0xba, 0x98, 0x76, 0x54, 0x32, 0x10}})
+	toc.AddLoad(macho.LoadCmdBytes{LoadCmd: macho.LcBuildVersion, LoadBytes: []byte{
+		0x32, 0, 0, 0, 24, 0, 0, 0,
+		1, 0, 0, 0, 0, 0, 13, 0, 0, 0, 14, 0, 0, 0, 0, 0}}) // macOS 13.0, SDK 14.0, no tools
+	toc.AddLoad(macho.LoadCmdBytes{LoadCmd: macho.LcSourceVersion, LoadBytes: []byte{
+		0x2a, 0, 0, 0, 16, 0, 0, 0,
+		1, 2, 3, 4, 0, 0, 0, 0}})
+	seg("__PAGEZERO", 0, 0x100000000, 0, 0)
+	seg("__TEXT", 0x100000000, 0x2000, 0, 0x2000)
+	sect("__text", "__TEXT", 0x100001000, 0x10, 0x1000)
+	seg("__DATA_CONST", 0x100002000, 0x1000, 0x2000, 0)
+	sect("__got", "__DATA_CONST", 0x100002000, 8, 0)
+	seg("__DATA", 0x100004000, 0x1000, 0x2000, 0x1000)
+	sect("__data", "__DATA", 0x100004000, 8, 0x2000)
+	seg("__DWARF", 0x100005000, 0, 0x3000, 0x28)
+	sect("__debug_abbrev", "__DWARF", 0x100005000, 0x10, 0x3000)
+	sect("__debug_info", "__DWARF", 0x100005010, 0x10, 0x3010)
+	sect("__debug_macinfo", "__DWARF", 0x100005020, 0x8, 0x3020)
+	seg("__LINKEDIT", 0x100005000, 0x1000, 0x4000, 0x100)
+
+	strs := "\x00_main\x00_counter\x00"
+	syms := []macho.Nlist64{
+		{Name: 1, Type: 0x0f, Sect: 1, Value: 0x100001000},
+		{Name: 7, Type: 0x0f, Sect: 3, Value: 0x100004000},
+	}
+	toc.AddLoad(&macho.Symtab{SymtabCmd: macho.SymtabCmd{LoadCmd: macho.LcSymtab, Len: 24,
+		Symoff: 0x4000, Nsyms: uint32(len(syms)), Stroff: 0x4040, Strsize: uint32(len(strs))}})
+	var dy bytes.Buffer
+	binary.Write(&dy, o, macho.DysymtabCmd{LoadCmd: macho.LcDysymtab, Len: 80, Nextdefsym: uint32(len(syms))})
+	toc.AddLoad(macho.LoadCmdBytes{LoadCmd: macho.LcDysymtab, LoadBytes: dy.Bytes()})
+	functionStarts := []byte{0x80, 0x20, 0, 0} // __text, as ULEB128 deltas
+	dataInCode := []byte{0x08, 0x10, 0, 0, 4, 0, 1, 0}
+	for _, le := range []macho.LinkEditDataCmd{
+		{LoadCmd: macho.LcFunctionStarts, Len: 16, DataOff: 0x4060, DataLen: uint32(len(functionStarts))},
+		{LoadCmd: macho.LcDataInCode, Len: 16, DataOff: 0x4068, DataLen: uint32(len(dataInCode))},
+	} {
+		var b bytes.Buffer
+		binary.Write(&b, o, le)
+		toc.AddLoad(macho.LoadCmdBytes{LoadCmd: le.LoadCmd, LoadBytes: b.Bytes()})
+	}
+
+	b := make([]byte, 0x4100)
+	toc.Put(b)
+	copy(b[0x3000:], "abbrev..........info............macinfo.")
+	for i := range syms {
+		syms[i].Put64(b[0x4000+16*i:], o)
+	}
+	copy(b[0x4040:], strs)
+	copy(b[0x4060:], functionStarts)
+	copy(b[0x4068:], dataInCode)
+	return b
+}
+
+func TestVmaddrPolicies(t *testing.T) {
+	type want struct {
+		seg  string
+		addr uint64
+	}
+	tests := []struct {
+		policy string
+		segs   []want
+		main   uint64
+		count  uint64
+	}{
+		{"chain", []want{{"__TEXT", 0x100000000}, {"__DATA", 0x100004000}, {"__LINKEDIT", 0x100005000}, {"__DWARF", 0x100006000}},
+			0x100001000, 0x100004000},
+		// testExecutable is laid out as Go links executables, with
+		// __LINKEDIT and an empty __DWARF both at 0x100005000, so that
+		// __LINKEDIT must move past the dSYM's __DWARF.
+		{"preserve", []want{{"__TEXT", 0x100000000}, {"__DATA", 0x100004000}, {"__LINKEDIT", 0x100006000}, {"__DWARF", 0x100005000}},
+			0x100001000, 0x100004000},
+		{"pack", []want{{"__TEXT", 0x100000000}, {"__DATA", 0x100002000}, {"__LINKEDIT", 0x100003000}, {"__DWARF", 0x100004000}},
+			0x100001000, 0x100002000},
+		{"base=0x200000000", []want{{"__TEXT", 0x200000000}, {"__DATA", 0x200004000}, {"__LINKEDIT", 0x200005000}, {"__DWARF", 0x200006000}},
+			0x200001000, 0x200004000},
+	}
+	for _, tt := range tests {
+		var opts splitOptions
+		if err := parseVmaddr(tt.policy, &opts); err != nil {
+			t.Fatal(err)
+		}
+		in := testExecutable(t)
+		buf, err := splitToBytes(in, &opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.policy, err)
+			continue
+		}
+		out, err := macho.NewFile(bytes.NewReader(buf))
+		if err != nil {
+			t.Errorf("%s: %v", tt.policy, err)
+			continue
+		}
+		for _, w := range tt.segs {
+			g := out.Segment(w.seg)
+			if g == nil || g.Addr != w.addr {
+				t.Errorf("%s: %s = %v, want addr %#x", tt.policy, w.seg, g, w.addr)
+				continue
+			}
+			// Sections move with their segments.
+			if ig := in.Segment(w.seg); g.Nsect > 0 && tt.policy != "chain" {
+				got := out.Sections[g.Firstsect].Addr - g.Addr
+				want := in.Sections[ig.Firstsect].Addr - ig.Addr
+				if got != want {
+					t.Errorf("%s: first section of %s at offset %#x, want %#x", tt.policy, w.seg, got, want)
+				}
+			}
+		}
+		if s := out.Symtab.Syms; len(s) != 2 || s[0].Value != tt.main || s[1].Value != tt.count {
+			t.Errorf("%s: symbols %+v, want _main at %#x, _counter at %#x", tt.policy, s, tt.main, tt.count)
+		}
+		if err := checkOverlap(&out.FileTOC, false); err != nil {
+			t.Errorf("%s: %v", tt.policy, err)
+		}
+	}
+
+	// Segments that overlap other than as Go lays them out are an error.
+	toc := &macho.FileTOC{FileHeader: macho.FileHeader{Magic: macho.Magic64}}
+	for _, g := range []struct {
+		name        string
+		addr, memsz uint64
+	}{{"__TEXT", 0x1000, 0x2000}, {"__DATA", 0x2000, 0x1000}} {
+		toc.AddSegment(&macho.Segment{SegmentHeader: macho.SegmentHeader{LoadCmd: macho.LcSegment64, Name: g.name, Addr: g.addr, Memsz: g.memsz}})
+	}
+	if err := checkOverlap(toc, true); err == nil || !strings.Contains(err.Error(), "__TEXT at 0x1000 and __DATA at 0x2000 would overlap") {
+		t.Errorf("overlapping __TEXT and __DATA: %v", err)
+	}
+
+	var opts splitOptions
+	for _, bad := range []string{"", "chained", "base=", "base=0x1234", "base=zzz"} {
+		if err := parseVmaddr(bad, &opts); err == nil {
+			t.Errorf("parseVmaddr(%q) succeeded", bad)
+		}
+	}
+	if err := parseVmaddr("base=0x1000", &opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := splitDwarf(testExecutable(t), &opts); err == nil || !strings.Contains(err.Error(), "__PAGEZERO") {
+		t.Errorf("base below __PAGEZERO: err = %v", err)
+	}
+}
+
+func TestRenamePolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		in     []string
+		want   []string
+	}{
+		{"canonical",
+			[]string{"__zdebug_info", "__zdebug_str_off", "__zdebug_line_st", "__debug_line", "__zdebug_mystery"},
+			[]string{"__debug_info", "__debug_str_offs", "__debug_line_str", "__debug_line", "__debug_mystery"}},
+		{"keep",
+			[]string{"__zdebug_info", "__zdebug_str_off", "__debug_line"},
+			[]string{"__zdebug_info", "__zdebug_str_off", "__debug_line"}},
+		{"map=__zdebug_info:__info,__debug_line:__zdebug_line",
+			[]string{"__zdebug_info", "__zdebug_str_off", "__debug_line"},
+			[]string{"__info", "__debug_str_offs", "__zdebug_line"}},
+	}
+	for _, tt := range tests {
+		var opts splitOptions
+		if err := parseRename(tt.policy, &opts); err != nil {
+			t.Fatal(err)
+		}
+		for i, name := range tt.in {
+			if got := opts.sectionName(name); got != tt.want[i] {
+				t.Errorf("%s: sectionName(%q) = %q, want %q", tt.policy, name, got, tt.want[i])
+			}
+		}
+	}
+
+	var opts splitOptions
+	for _, bad := range []string{"", "canon", "map=", "map=__debug_info", "map=__debug_info:", "map=a:b,a:c",
+		"map=__debug_info:__debug_info_renamed"} {
+		if err := parseRename(bad, &opts); err == nil {
+			t.Errorf("parseRename(%q) succeeded", bad)
+		}
+	}
+
+	// The dSYM's sections take the mapped names, but two may not
+	// share one.
+	if err := parseRename("map=__debug_info:__dbg_info", &opts); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := splitToBytes(testExecutable(t), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := macho.NewFile(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Section("__dbg_info") == nil || out.Section("__debug_info") != nil || out.Section("__debug_abbrev") == nil {
+		t.Errorf("-rename=map=__debug_info:__dbg_info did not rename just __debug_info")
+	}
+	if err := parseRename("map=__debug_info:__debug_abbrev", &opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := splitDwarf(testExecutable(t), &opts); err == nil || !strings.Contains(err.Error(), "two DWARF sections") {
+		t.Errorf("renaming onto another section: err = %v", err)
+	}
+}
+
+func TestDsymutilOrder(t *testing.T) {
+	buf, err := splitToBytes(testExecutable(t), &splitOptions{dsymutil: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := macho.NewFile(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, l := range out.Loads {
+		if g, ok := l.(*macho.Segment); ok {
+			got = append(got, g.Name)
+		} else {
+			got = append(got, fmt.Sprintf("%#x", uint32(l.Command())))
+		}
+	}
+	want := []string{"0x1b", "0x32", "0x2a", "0x2", "__PAGEZERO", "__TEXT", "__DATA_CONST", "__DATA", "__LINKEDIT", "__DWARF"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("loads are\n\t%v\nwant\n\t%v", got, want)
+	}
+	// With every section copied in order, symbols' section numbers still hold.
+	for _, s := range out.Symtab.Syms {
+		if want := map[string]string{"_main": "__text", "_counter": "__data"}[s.Name]; out.Sections[s.Sect-1].Name != want {
+			t.Errorf("%s is in section %s, want %s", s.Name, out.Sections[s.Sect-1].Name, want)
+		}
+	}
+}
+
+// loadBytes returns l as it is written in a file laid out by t.
+func loadBytes(t *macho.FileTOC, l macho.Load) []byte {
+	b := make([]byte, l.LoadSize(t))
+	return b[:l.Put(b, t.ByteOrder)]
+}
+
+func TestCopyVersions(t *testing.T) {
+	in := testExecutable(t)
+	buf, err := splitToBytes(in, &splitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := macho.NewFile(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []macho.LoadCmd{macho.LcUuid, macho.LcBuildVersion, macho.LcSourceVersion} {
+		var want, got []byte
+		for _, l := range in.Loads {
+			if l.Command() == cmd {
+				want = loadBytes(&in.FileTOC, l)
+			}
+		}
+		for _, l := range out.Loads {
+			if l.Command() == cmd {
+				got = loadBytes(&out.FileTOC, l)
+			}
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v: got %x, want %x", cmd, got, want)
+		}
+	}
+}
+
+func TestLinkEditData(t *testing.T) {
+	in := testExecutable(t)
+	payloads := func(f *macho.File) map[macho.LoadCmd][]byte {
+		m := make(map[macho.LoadCmd][]byte)
+		le := f.Segment("__LINKEDIT")
+		for _, l := range f.Loads {
+			if d, ok := l.(*macho.LinkEditData); ok {
+				b := make([]byte, d.DataLen)
+				if _, err := le.ReadAt(b, int64(d.DataOff)-int64(le.Offset)); err != nil {
+					t.Errorf("%v: %v", d.Command(), err)
+				}
+				m[d.Command()] = b
+			}
+		}
+		return m
+	}
+	want := payloads(in)
+
+	for _, copyData := range []bool{false, true} {
+		buf, err := splitToBytes(in, &splitOptions{linkEditData: copyData})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := macho.NewFile(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := payloads(out)
+		if !copyData {
+			if len(got) != 0 {
+				t.Errorf("without -linkedit-data, copied %v", got)
+			}
+			continue
+		}
+		for _, cmd := range []macho.LoadCmd{macho.LcFunctionStarts, macho.LcDataInCode} {
+			if !bytes.Equal(got[cmd], want[cmd]) {
+				t.Errorf("%v: got %x, want %x", cmd, got[cmd], want[cmd])
+			}
+		}
+		st, le := out.Symtab, out.Segment("__LINKEDIT")
+		for _, l := range out.Loads {
+			if d, ok := l.(*macho.LinkEditData); ok {
+				if d.DataOff < st.Stroff+st.Strsize || uint64(d.DataOff+d.DataLen) > le.Offset+le.Filesz {
+					t.Errorf("%v payload at [%#x, %#x) overlaps strings or leaves __LINKEDIT", d.Command(), d.DataOff, d.DataOff+d.DataLen)
+				}
+			}
+		}
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "exe")
+	if err := ioutil.WriteFile(name, testExecutableBytes(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := provenance(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.UUID != "01234567-89AB-CDEF-FEDC-BA9876543210" {
+		t.Errorf("UUID = %s", p.UUID)
+	}
+	if want := []BuildVersion{{Platform: "macos", MinOS: "13.0.0", SDK: "14.0.0"}}; fmt.Sprint(p.Builds) != fmt.Sprint(want) {
+		t.Errorf("Builds = %v, want %v", p.Builds, want)
+	}
+	if p.SourceVersion != "0.0.64.192.513" {
+		t.Errorf("SourceVersion = %s", p.SourceVersion)
+	}
+	if p.Go != nil {
+		t.Errorf("Go = %+v, want none", p.Go)
+	}
+	if len(p.Problems) != 1 || !strings.Contains(p.Problems[0], "DWARF") {
+		t.Errorf("Problems = %q, want one about the unreadable DWARF", p.Problems)
+	}
+
+	p, err = provenance("macho/testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (DylibDep{Name: "/usr/lib/libSystem.B.dylib", CurrentVersion: "111.1.4", CompatVersion: "1.0.0"}); len(p.Dylibs) != 2 || p.Dylibs[1] != want {
+		t.Errorf("Dylibs = %v, want libgcc_s and %v", p.Dylibs, want)
+	}
+
+	p, err = provenance("macho/testdata/gcc-amd64-darwin-exec-debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Producer{Producer: "GNU C 4.0.1 (Apple Inc. build 5484)", Language: "C89", Units: 1}); len(p.Producers) != 1 || p.Producers[0] != want {
+		t.Errorf("Producers = %v, want %v", p.Producers, want)
+	}
+}
+
+func TestDetectToolchain(t *testing.T) {
+	f := testExecutable(t)
+	r := bytes.NewReader(testExecutableBytes(t))
+	if tc := detectToolchain(f, r); tc.Linker != "unknown" || tc.GoVersion != "" {
+		t.Errorf("plain executable: got %v, want unknown", tc)
+	}
+
+	f.Sections = append(f.Sections, &macho.Section{SectionHeader: macho.SectionHeader{Name: "__gopclntab", Seg: "__TEXT"}})
+	if tc := detectToolchain(f, r); tc.Linker != "go" {
+		t.Errorf("with __gopclntab: got %v, want go", tc)
+	}
+
+	bv := f.BuildVersion()
+	bv.Tools = append(bv.Tools, macho.BuildTool{Tool: macho.ToolLd, Version: 811 << 16})
+	tc := detectToolchain(f, r)
+	if tc.Linker != "ld64" || tc.LinkerVersion != "811.0.0" {
+		t.Errorf("with LC_BUILD_VERSION tools: got %v, want ld64 811.0.0", tc)
+	}
+	var b bytes.Buffer
+	if err := describeToolchain(&b, tc); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Toolchain is ld64 811.0.0\n   because LC_BUILD_VERSION lists ld 811.0.0\n"; !strings.HasPrefix(b.String(), want) {
+		t.Errorf("describeToolchain wrote\n%s\nwant prefix\n%s", b.String(), want)
+	}
+}
+
+// splitToBytes returns the dSYM file splitDwarf lays out for exem.
+func splitToBytes(exem *macho.File, opts *splitOptions) ([]byte, error) {
+	d, err := splitDwarf(exem, opts)
+	if err != nil {
+		return nil, err
+	}
+	return d.Bytes()
+}
+
+// A countingReaderAt counts the bytes read from r at offsets in
+// [from, to).
+type countingReaderAt struct {
+	r        io.ReaderAt
+	from, to int64
+	n        int64
+}
+
+func (c *countingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(b, off)
+	if off >= c.from && off < c.to {
+		c.n += int64(n)
+	}
+	return n, err
+}
+
+func TestDsymStreamsDwarf(t *testing.T) {
+	exe := testExecutableBytes(t)
+	dw := testExecutable(t).Segment("__DWARF")
+	cr := &countingReaderAt{r: bytes.NewReader(exe), from: int64(dw.Offset), to: int64(dw.Offset + dw.Filesz)}
+	in, err := macho.NewFile(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := splitDwarf(in, &splitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The DWARF is read from the input as the dSYM is written.
+	cr.n = 0
+	buf, err := d.Bytes()
+	if cr.n < int64(dw.Filesz) {
+		t.Errorf("read %d bytes of DWARF from the input while writing, want all %d", cr.n, dw.Filesz)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := macho.NewFile(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"__debug_abbrev", "__debug_info"} {
+		want, _ := in.Section(name).Data()
+		got, _ := out.Section(name).Data()
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if _, err := d.WriteTo(ioutil.Discard); err != nil {
+		t.Errorf("second WriteTo: %v", err)
+	}
+}
+
+func TestOnlyDwarf(t *testing.T) {
+	in := testExecutable(t)
+	full, err := splitToBytes(in, &splitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := splitToBytes(in, &splitOptions{onlyDwarf: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) >= len(full) {
+		t.Errorf("-only-dwarf output is %d bytes, default is %d", len(buf), len(full))
+	}
+	out, err := macho.NewFile(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range out.Loads {
+		if s, ok := l.(*macho.Segment); ok && s.Name != "__DWARF" {
+			t.Errorf("unexpected segment %s", s.Name)
+		}
+	}
+	if uuidOf(out) != uuidOf(in) {
+		t.Errorf("UUID = %s, want %s", uuidOf(out), uuidOf(in))
+	}
+	for _, name := range []string{"__debug_abbrev", "__debug_info"} {
+		want, _ := in.Section(name).Data()
+		got, _ := out.Section(name).Data()
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	var got []string
+	for _, s := range out.Symtab.Syms {
+		got = append(got, fmt.Sprintf("%s type=%#x sect=%d value=%#x", s.Name, s.Type, s.Sect, s.Value))
+	}
+	want := []string{
+		"_main type=0x3 sect=0 value=0x100001000",
+		"_counter type=0x3 sect=0 value=0x100004000",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("symbols:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if _, err := splitDwarf(in, &splitOptions{onlyDwarf: true, dsymutil: true}); err == nil {
+		t.Errorf("-only-dwarf with -dsymutil succeeded")
+	}
+}
+
+func TestOnlyDwarfTooManyLoads(t *testing.T) {
+	in := testExecutable(t)
+	dwarf := in.Segment("__DWARF")
+	if dwarf.Firstsect+dwarf.Nsect != uint32(len(in.Sections)) {
+		t.Fatal("__DWARF's sections are not the last")
+	}
+	// Enough sections that their headers do not fit in the page
+	// before the symbols.
+	abbrev := in.Section("__debug_abbrev")
+	for i := 0; i < 60; i++ {
+		s := *abbrev
+		s.Name = fmt.Sprintf("__debug_x%02d", i)
+		in.Sections = append(in.Sections, &s)
+		dwarf.Nsect++
+	}
+	for _, opts := range []*splitOptions{{}, {onlyDwarf: true}} {
+		if _, err := splitDwarf(in, opts); err == nil || !strings.Contains(err.Error(), "do not fit before __LINKEDIT") {
+			t.Errorf("-only-dwarf=%v: err = %v, want load commands that do not fit", opts.onlyDwarf, err)
+		}
+	}
+}
+
+func TestSymbolsOnly(t *testing.T) {
+	in := testExecutable(t)
+	buf, err := splitToBytes(in, &splitOptions{symbolsOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := macho.NewFile(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Segment("__DWARF") != nil || out.Section("__debug_info") != nil {
+		t.Errorf("-symbols-only output has DWARF")
+	}
+	if le := out.Segment("__LINKEDIT"); le == nil || le.Offset+le.Filesz != uint64(len(buf)) {
+		t.Errorf("-symbols-only output does not end with __LINKEDIT")
+	}
+	var names []string
+	for _, s := range out.Symtab.Syms {
+		names = append(names, s.Name)
+	}
+	if got := strings.Join(names, " "); got != "_main _counter" {
+		t.Errorf("symbols = %s, want _main _counter", got)
+	}
+	var cmds []macho.LoadCmd
+	for _, l := range out.Loads {
+		if d, ok := l.(*macho.LinkEditData); ok {
+			cmds = append(cmds, d.Command())
+		}
+	}
+	if len(cmds) != 1 || cmds[0] != macho.LcFunctionStarts {
+		t.Errorf("LINKEDIT data commands = %v, want only LC_FUNCTION_STARTS", cmds)
+	}
+}
+
+func TestCUFilter(t *testing.T) {
+	var f cuFilter
+	f.addInclude("main")
+	f.addInclude("example.com/app/...")
+	f.addExclude("example.com/app/internal/gen")
+	for name, want := range map[string]bool{
+		"main":                           true,
+		"runtime":                        false,
+		"example.com/app":                true,
+		"example.com/app/server":         true,
+		"example.com/application":        false,
+		"example.com/app/internal/gen":   false,
+		"example.com/app/internal/other": true,
+	} {
+		if got := f.keep(name); got != want {
+			t.Errorf("keep(%q) = %v, want %v", name, got, want)
+		}
+	}
+	if err := f.addExclude("[x"); err == nil {
+		t.Errorf("bad pattern accepted")
+	}
+
+	exem, err := macho.Open("macho/testdata/gcc-amd64-darwin-exec-debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exem.Close()
+	info := exem.Section("__debug_info")
+	edits := make(map[*macho.Section]sectionEdit)
+	if err := filterCompileUnits(exem, &cuFilter{include: []string{"hello.c"}}, edits); err != nil {
+		t.Fatal(err)
+	}
+	e, ok := edits[info]
+	if !ok {
+		t.Fatalf("-include-cu hello.c: __debug_info not rewritten")
+	}
+	if want, _ := info.Data(); len(e.data) != len(want) {
+		t.Errorf("-include-cu hello.c: __debug_info is %d bytes, want %d", len(e.data), len(want))
+	}
+
+	// Patterns that keep nothing are an error naming them, not an empty dSYM.
+	for _, f := range []*cuFilter{
+		{include: []string{"*.h"}},
+		{exclude: []string{"hello.c"}},
+		{include: []string{"hello.c"}, exclude: []string{"*.c"}},
+	} {
+		edits := make(map[*macho.Section]sectionEdit)
+		err := filterCompileUnits(exem, f, edits)
+		if err == nil || !strings.Contains(err.Error(), f.String()) {
+			t.Errorf("%v: err = %v, want one naming the patterns", f, err)
+		}
+		if _, ok := edits[info]; ok {
+			t.Errorf("%v: __debug_info rewritten despite the error", f)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	exem, err := macho.Open("macho/testdata/gcc-amd64-darwin-exec-debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exem.Close()
+	edits := make(map[*macho.Section]sectionEdit)
+	if err := redactDwarf(exem, &redaction{patterns: []string{"printf"}}, edits); err != nil {
+		t.Fatal(err)
+	}
+	if len(edits) != 0 {
+		t.Errorf("redacting nothing edited %d sections", len(edits))
+	}
+
+	if err := redactDwarf(exem, &redaction{patterns: []string{"ma*"}}, edits); err != nil {
+		t.Fatal(err)
+	}
+	section := func(name string) []byte {
+		b, err := editedData(edits, exem.Section(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	d, err := dwarf.New(section("__debug_abbrev"), section("__debug_aranges"), section("__debug_frame"),
+		section("__debug_info"), section("__debug_line"), section("__debug_pubnames"), nil, section("__debug_str"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := d.Reader()
+	var tags []string
+	for {
+		e, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil {
+			break
+		}
+		if e.Tag == 0 {
+			continue
+		}
+		tags = append(tags, e.Tag.String())
+		if e.Tag != dwarf.TagCompileUnit {
+			continue
+		}
+		lr, err := d.LineReader(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var le dwarf.LineEntry
+		for lr.Next(&le) == nil {
+			t.Errorf("line table has a row for %#x", le.Address)
+		}
+	}
+	if got, want := strings.Join(tags, " "), "CompileUnit BaseType"; got != want {
+		t.Errorf("DIEs are %s, want %s", got, want)
+	}
+	if p := section("__debug_pubnames"); len(p) != 4+2+4+4+4 {
+		t.Errorf("__debug_pubnames is % x, want a set with no names", p)
+	}
+}
+
+func TestStripMacros(t *testing.T) {
+	in := testExecutable(t)
+	if macinfo, macro, err := in.DWARFMacros(); err != nil || string(macinfo) != "macinfo." || macro != nil {
+		t.Errorf("DWARFMacros() = %q, %q, %v", macinfo, macro, err)
+	}
+	for _, strip := range []bool{false, true} {
+		buf, err := splitToBytes(in, &splitOptions{stripMacros: strip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := macho.NewFile(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		macinfo, _, err := out.DWARFMacros()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := macinfo != nil; got == strip {
+			t.Errorf("-strip-macros=%v: __debug_macinfo present is %v", strip, got)
+		}
+		if got, _ := out.Section("__debug_info").Data(); string(got) != "info............" {
+			t.Errorf("-strip-macros=%v: __debug_info is %q", strip, got)
+		}
+		want := uint64(0x28)
+		if strip {
+			want = 0x20
+		}
+		if got := out.Segment("__DWARF").Filesz - out.Section(stampSection).Size; got != want {
+			t.Errorf("-strip-macros=%v: __DWARF has %#x bytes, want %#x", strip, got, want)
+		}
+	}
+}
+
+func TestLineTablesOnly(t *testing.T) {
+	exem, err := macho.Open("macho/testdata/gcc-amd64-darwin-exec-debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exem.Close()
+	edits := make(map[*macho.Section]sectionEdit)
+	if err := lineTablesOnly(exem, edits); err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for name, s := range dwarfSectionsByName(exem) {
+		if !edits[s].drop {
+			kept = append(kept, name)
+		}
+	}
+	sort.Strings(kept)
+	if got, want := strings.Join(kept, " "), "debug_abbrev debug_aranges debug_info debug_line debug_str"; got != want {
+		t.Errorf("kept %s, want %s", got, want)
+	}
+	section := func(name string) []byte {
+		b, err := editedData(edits, exem.Section(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	d, err := dwarf.New(section("__debug_abbrev"), section("__debug_aranges"), nil,
+		section("__debug_info"), section("__debug_line"), nil, nil, section("__debug_str"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := d.Reader()
+	var tags []string
+	rows := 0
+	for {
+		e, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil {
+			break
+		}
+		tags = append(tags, e.Tag.String())
+		if name, _ := e.Val(dwarf.AttrName).(string); name != "hello.c" {
+			t.Errorf("unit is named %q", name)
+		}
+		if e.Val(dwarf.AttrProducer) == nil || e.Val(dwarf.AttrLowpc) == nil {
+			t.Errorf("unit lost its producer or addresses: %v", e.Field)
+		}
+		lr, err := d.LineReader(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var le dwarf.LineEntry
+		for lr.Next(&le) == nil {
+			rows++
+		}
+	}
+	if got := strings.Join(tags, " "); got != "CompileUnit" {
+		t.Errorf("DIEs are %s, want CompileUnit", got)
+	}
+	if rows != 5 {
+		t.Errorf("line table has %d rows, want 5", rows)
+	}
+}
+
+// testDwarfFile returns a Mach-O file holding only a __DWARF segment
+// with the given sections, as name, contents pairs.
+func testDwarfFile(t *testing.T, sections ...string) *macho.File {
+	t.Helper()
+	f, err := macho.NewFile(bytes.NewReader(testDwarfBytes(nil, sections...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// testDwarfBytes returns the image of a file like testDwarfFile's, with
+// an LC_UUID if uuid is not nil.
+func testDwarfBytes(uuid []byte, sections ...string) []byte {
+	toc := &macho.FileTOC{
+		FileHeader: macho.FileHeader{Magic: macho.Magic64, Cpu: macho.CpuAmd64, SubCpu: 3, Type: macho.MhDsym},
+		ByteOrder:  binary.LittleEndian,
+	}
+	if uuid != nil {
+		toc.AddLoad(macho.LoadCmdBytes{LoadCmd: macho.LcUuid, LoadBytes: append([]byte{0x1b, 0, 0, 0, 24, 0, 0, 0}, uuid...)})
+	}
+	g := &macho.Segment{SegmentHeader: macho.SegmentHeader{LoadCmd: macho.LcSegment64, Name: "__DWARF", Offset: 0x1000}}
+	toc.AddSegment(g)
+	off := uint32(g.Offset)
+	for i := 0; i < len(sections); i += 2 {
+		s := &macho.Section{SectionHeader: macho.SectionHeader{Name: sections[i], Seg: "__DWARF",
+			Size: uint64(len(sections[i+1])), Offset: off}}
+		toc.AddSection(s)
+		toc.AddSectionPayload(s, strings.NewReader(sections[i+1]))
+		off += uint32(len(sections[i+1]))
+	}
+	g.Filesz = uint64(off) - g.Offset
+	b, err := toc.Bytes()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestInlineSupplementary(t *testing.T) {
+	exem := testDwarfFile(t,
+		"__debug_abbrev", "\x01\x11\x01\x03\x0e\x00\x00"+ // compile_unit: name strp
+			"\x02\x34\x00\x03\xa1\x3e\x49\xa0\x3e\x00\x00"+ // variable: name GNU_strp_alt, type GNU_ref_alt
+			"\x00",
+		"__debug_info", "\x16\x00\x00\x00\x04\x00\x00\x00\x00\x00\x08"+
+			"\x01\x00\x00\x00\x00"+
+			"\x02\x04\x00\x00\x00\x0c\x00\x00\x00"+
+			"\x00",
+		"__debug_str", "main.c\x00",
+		"__gnu_debugaltli", "alt.dwarf\x00\xca\xfe")
+	alt := testDwarfFile(t,
+		"__debug_abbrev", "\x01\x3c\x01\x00\x00"+ // partial_unit
+			"\x02\x24\x00\x03\x0e\x0b\x0b\x3e\x0b\x00\x00"+ // base_type: name strp, byte_size, encoding
+			"\x00",
+		"__debug_info", "\x10\x00\x00\x00\x04\x00\x00\x00\x00\x00\x08"+
+			"\x01"+
+			"\x02\x00\x00\x00\x00\x04\x05"+
+			"\x00",
+		"__debug_str", "int\x00secret\x00")
+
+	edits := make(map[*macho.Section]sectionEdit)
+	sup, err := findSupplementary(exem, edits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Supplementary{Name: "alt.dwarf", ID: "cafe", DIERefs: 1, StrRefs: 1}); sup == nil || *sup != want {
+		t.Fatalf("findSupplementary = %+v, want %+v", sup, want)
+	}
+	if sup, err := findSupplementary(alt, edits); sup != nil || err != nil {
+		t.Errorf("findSupplementary(alt) = %+v, %v", sup, err)
+	}
+
+	if err := inlineSupplementary(exem, alt, edits); err != nil {
+		t.Fatal(err)
+	}
+	if e := edits[exem.Section("__gnu_debugaltli")]; !e.drop {
+		t.Errorf("__gnu_debugaltli is kept")
+	}
+	section := func(name string) []byte {
+		b, err := editedData(edits, exem.Section(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	d, err := dwarf.New(section("__debug_abbrev"), nil, nil, section("__debug_info"), nil, nil, nil, section("__debug_str"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := d.Reader()
+	var got []string
+	for {
+		e, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil {
+			break
+		}
+		if e.Tag != dwarf.TagVariable {
+			continue
+		}
+		typ, err := d.Type(e.Val(dwarf.AttrType).(dwarf.Offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s %s", e.Val(dwarf.AttrName), typ))
+	}
+	if s := strings.Join(got, "; "); s != "secret int" {
+		t.Errorf("variables are %q, want %q", s, "secret int")
+	}
+	if sup, err := findSupplementary(exem, edits); sup != nil || err != nil {
+		t.Errorf("after inlining, findSupplementary = %+v, %v", sup, err)
+	}
+}
+
+func TestWriteUnwindTable(t *testing.T) {
+	f, err := macho.Open("macho/testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	if err := writeUnwindTable(&buf, f, false); err != nil {
+		t.Fatal(err)
+	}
+	var tab UnwindTable
+	if err := json.Unmarshal(buf.Bytes(), &tab); err != nil {
+		t.Fatal(err)
+	}
+	if tab.UUID != "3B24B872-0E45-76D4-28AA-EE89B0C1215D" || tab.Cpu != "CpuAmd64" || len(tab.Rows) != 4 {
+		t.Fatalf("JSON table is %+v", tab)
+	}
+	if got, want := tab.Rows[2], (UnwindRow{PC: 0x100000f6e, CFA: "fp", CFAOffset: 16, RAOffset: -8, FPOffset: -16}); got != want {
+		t.Errorf("row 2 is %+v, want %+v", got, want)
+	}
+	if got := tab.Rows[3]; got.CFA != "unknown" {
+		t.Errorf("last row is %+v, want unknown", got)
+	}
+
+	buf.Reset()
+	if err := writeUnwindTable(&buf, f, true); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if len(b) != 40+4*24 || string(b[:8]) != unwindMagic {
+		t.Fatalf("binary table is % x", b)
+	}
+	le := binary.LittleEndian
+	if v, cpu, n := le.Uint32(b[8:]), macho.Cpu(le.Uint32(b[12:])), le.Uint32(b[32:]); v != unwindVersion || cpu != macho.CpuAmd64 || n != 4 {
+		t.Errorf("binary header has version %d, cpu %v, %d rows", v, cpu, n)
+	}
+	if u := f.UUID(); !bytes.Equal(b[16:32], u.Id[:]) {
+		t.Errorf("binary header has UUID % x", b[16:32])
+	}
+	row := b[40+2*24:]
+	if pc, cfa, off, ra, fp := le.Uint64(row), row[8], int32(le.Uint32(row[12:])), int32(le.Uint32(row[16:])), int32(le.Uint32(row[20:])); pc != 0x100000f6e || cfa != 2 || off != 16 || ra != -8 || fp != -16 {
+		t.Errorf("binary row 2 is % x", row[:24])
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	good1, bad, good2 := filepath.Join(dir, "good1"), filepath.Join(dir, "bad"), filepath.Join(dir, "good2")
+	if err := ioutil.WriteFile(good1, testExecutableBytes(t), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(good2, testExecutableBytes(t), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bad, []byte("not a Mach-O file"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	exists := func(exe string) bool {
+		_, file := dsymPath(exe)
+		_, err := os.Stat(file)
+		return err == nil
+	}
+
+	// With -fail-fast, nothing after the bad input is split.
+	if splitBatch([]string{good1, bad, good2}, false, &splitOptions{}, true, "") {
+		t.Errorf("fail-fast batch with a bad input succeeded")
+	}
+	if !exists(good1) || exists(good2) {
+		t.Errorf("fail-fast batch: good1 split %v, good2 split %v; want true, false", exists(good1), exists(good2))
+	}
+
+	// Otherwise the bad input is reported and the rest are split.
+	if splitBatch([]string{bad, good2}, false, &splitOptions{}, false, "") {
+		t.Errorf("batch with a bad input succeeded")
+	}
+	if !exists(good2) {
+		t.Errorf("batch did not split the input after the bad one")
+	}
+	if !splitBatch([]string{good1, good2}, false, &splitOptions{}, false, "") {
+		t.Errorf("batch of good inputs failed")
+	}
+
+	// A hard link to an input already given is skipped, not split again.
+	link := filepath.Join(dir, "link")
+	if err := os.Link(good1, link); err != nil {
+		t.Fatal(err)
+	}
+	if !splitBatch([]string{good1, link}, false, &splitOptions{}, false, "") {
+		t.Errorf("batch of an input and a hard link to it failed")
+	}
+	if exists(link) {
+		t.Errorf("batch split the hard link to good1 again")
+	}
+	if seen := map[string]os.FileInfo{}; sameAsSeen(seen, good1) != "" || sameAsSeen(seen, link) != good1 || sameAsSeen(seen, good2) != "" {
+		t.Errorf("sameAsSeen did not match only the hard link to good1")
+	}
+
+	// Inputs whose dSYMs differ only in case would write one dSYM on a
+	// case-insensitive volume; the second fails, not overwriting the first.
+	upper := filepath.Join(dir, "Good1")
+	if err := ioutil.WriteFile(upper, testExecutableBytes(t), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(good1); err == nil {
+		if fu, err := os.Stat(upper); err == nil && os.SameFile(fi, fu) {
+			t.Skip("the temporary directory is on a case-insensitive volume")
+		}
+	}
+	if splitBatch([]string{good1, upper}, false, &splitOptions{}, false, "") {
+		t.Errorf("batch of inputs whose dSYMs differ only in case succeeded")
+	}
+	if exists(upper) {
+		t.Errorf("batch split Good1 after good1")
+	}
+}
+
+func TestSplitSymlink(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "real", "hello")
+	if err := os.MkdirAll(filepath.Dir(exe), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(exe, testExecutableBytes(t), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// bin/hi is a relative link to a link to the executable.
+	link, link2 := filepath.Join(dir, "bin", "hi"), filepath.Join(dir, "real", "current")
+	if err := os.Symlink("hello", link2); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..", "real", "current"), link); err != nil {
+		t.Fatal(err)
+	}
+	want, err := splitToBytes(testExecutable(t), &splitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	split := func(keepName bool, want string) {
+		t.Helper()
+		if err := splitFile(link, "", keepName, &splitOptions{}, "", ""); err != nil {
+			t.Fatal(err)
+		}
+		rel, _ := filepath.Rel(dir, want)
+		if fi, err := os.Lstat(want); err != nil || !fi.Mode().IsRegular() {
+			t.Errorf("-keep-name=%v: no dSYM at %s: %v", keepName, rel, err)
+		}
+	}
+
+	// Without -keep-name, the dSYM goes beside, and is named for, the
+	// file the links lead to.
+	atTarget := filepath.Join(dir, "real", "hello.dSYM", "Contents", "Resources", "DWARF", "hello")
+	split(false, atTarget)
+	if got := readFile(t, atTarget); !bytes.Equal(got, want) {
+		t.Errorf("the dSYM split through links differs from splitting the executable")
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, "bin", "*.dSYM")); len(m) != 0 {
+		t.Errorf("without -keep-name, split into the link's directory: %v", m)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "real", "current.dSYM")); err == nil {
+		t.Errorf("without -keep-name, named the dSYM for an intermediate link")
+	}
+
+	// With it, beside and named for the link given.
+	atLink := filepath.Join(dir, "bin", "hi.dSYM", "Contents", "Resources", "DWARF", "hi")
+	split(true, atLink)
+	if got := readFile(t, atLink); !bytes.Equal(got, want) {
+		t.Errorf("the dSYM split with -keep-name differs")
+	}
+}
+
+func TestSameFile(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "exe")
+	b := testExecutableBytes(t)
+	if err := ioutil.WriteFile(exe, b, 0755); err != nil {
+		t.Fatal(err)
+	}
+	hard, soft, other := filepath.Join(dir, "hard"), filepath.Join(dir, "soft"), filepath.Join(dir, "other")
+	if err := os.Link(exe, hard); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("exe", soft); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(other, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		out  string
+		same bool
+	}{
+		{exe, true},
+		{hard, true},
+		{soft, true},
+		{other, false},                         // the same bytes, but another file
+		{filepath.Join(dir, "missing"), false}, // not yet written
+	} {
+		if err := checkDistinct(exe, tc.out); (err != nil) != tc.same || tc.same && !strings.Contains(err.Error(), "is the same file as input") {
+			t.Errorf("checkDistinct(exe, %s) = %v", filepath.Base(tc.out), err)
+		}
+		// Splitting onto the input is refused before the input is harmed.
+		if tc.same {
+			if err := splitFile(exe, tc.out, false, &splitOptions{}, "", ""); err == nil {
+				t.Errorf("splitting exe onto %s succeeded", filepath.Base(tc.out))
+			}
+			if got := readFile(t, exe); !bytes.Equal(got, b) {
+				t.Fatalf("splitting exe onto %s changed it", filepath.Base(tc.out))
+			}
+		}
+	}
+
+	// A store holding a file twice, by a hard link, holds one entry.
+	store := filepath.Join(dir, "store")
+	if err := os.Mkdir(store, 0755); err != nil {
+		t.Fatal(err)
+	}
+	d := filepath.Join(store, "a.dwarf")
+	if err := splitFile(exe, d, false, &splitOptions{}, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(d, filepath.Join(store, "b.dwarf")); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := scanStore(store); err != nil || len(entries) != 1 || entries[0].path != d {
+		t.Errorf("scanStore of a hard-linked file: %d entries, %v", len(entries), err)
+	}
+}
+
+func TestSplitFat(t *testing.T) {
+	// A universal binary of the test executable for amd64 and, with its
+	// header changed, for arm64.
+	amd64 := testExecutableBytes(t)
+	arm64 := append([]byte{}, amd64...)
+	binary.LittleEndian.PutUint32(arm64[4:], uint32(macho.CpuArm64))
+	binary.LittleEndian.PutUint32(arm64[8:], 0)
+	arches := []macho.FatArchHeader{
+		{Cpu: macho.CpuAmd64, SubCpu: 3, Offset: 0x1000, Size: uint32(len(amd64)), Align: 12},
+		{Cpu: macho.CpuArm64, SubCpu: 0, Offset: 0x8000, Size: uint32(len(arm64)), Align: 14},
+	}
+	in := make([]byte, 0x8000+len(arm64))
+	macho.PutFatHeader(in, arches)
+	copy(in[0x1000:], amd64)
+	copy(in[0x8000:], arm64)
+	if !isFat(bytes.NewReader(in)) || isFat(bytes.NewReader(amd64)) {
+		t.Fatalf("isFat is wrong")
+	}
+
+	fd, err := splitFat(bytes.NewReader(in), &splitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	if err := fd.writeFile(out, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ff, err := macho.OpenFat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ff.Close()
+	if len(ff.Arches) != 2 {
+		t.Fatalf("%d slices, want 2", len(ff.Arches))
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, slice := range [][]byte{amd64, arm64} {
+		a := ff.Arches[i]
+		if a.Cpu != arches[i].Cpu || a.Type != macho.MhDsym || a.Offset%(1<<a.Align) != 0 {
+			t.Errorf("slice %d: cpu %v, type %v, offset %#x, align %d", i, a.Cpu, a.Type, a.Offset, a.Align)
+		}
+		exem, err := macho.NewFile(bytes.NewReader(slice))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := splitToBytes(exem, &splitOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := b[a.Offset : a.Offset+a.Size]; !bytes.Equal(got, want) {
+			t.Errorf("slice %d differs from splitting it alone", i)
+		}
+	}
+
+	// A slice that cannot be split is named in the error.
+	if _, err := splitFat(bytes.NewReader(in), &splitOptions{onlyDwarf: true, dsymutil: true}); err == nil || !strings.HasPrefix(err.Error(), macho.CpuAmd64.String()+" slice") {
+		t.Errorf("splitFat with bad options: error %v", err)
+	}
+}
+
+func TestLipo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const (
+		fat   = "macho/testdata/fat-gcc-386-amd64-darwin-exec"
+		i386  = "macho/testdata/gcc-386-darwin-exec"
+		amd64 = "macho/testdata/gcc-amd64-darwin-exec"
+	)
+	same := func(a, b string) bool {
+		x, err := ioutil.ReadFile(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		y, err := ioutil.ReadFile(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Equal(x, y)
+	}
+
+	// Thinning and creating undo each other.
+	thin := filepath.Join(dir, "thin")
+	if err := lipoThin(fat, "x86_64", thin); err != nil {
+		t.Fatal(err)
+	}
+	if !same(thin, amd64) {
+		t.Errorf("x86_64 slice of %s differs from %s", fat, amd64)
+	}
+	created := filepath.Join(dir, "fat")
+	if err := lipoCreate([]string{i386, amd64}, created); err != nil {
+		t.Fatal(err)
+	}
+	if !same(created, fat) {
+		t.Errorf("universal file of %s and %s differs from %s", i386, amd64, fat)
+	}
+
+	if err := lipoThin(fat, "arm64", thin); err == nil || !strings.Contains(err.Error(), "only i386, x86_64") {
+		t.Errorf("thinning to a missing arch: error %v", err)
+	}
+	if err := lipoThin(amd64, "x86_64", thin); err == nil {
+		t.Errorf("thinning a thin file succeeded")
+	}
+	if err := lipoCreate([]string{fat, i386}, created); err == nil || !strings.Contains(err.Error(), "both contain i386") {
+		t.Errorf("creating with a duplicate arch: error %v", err)
+	}
+}
+
+func TestCheckPair(t *testing.T) {
+	slice := func(cpu macho.Cpu, uuid string) lipoSlice {
+		return lipoSlice{FatArchHeader: macho.FatArchHeader{Cpu: cpu}, from: "f", uuid: uuid}
+	}
+	arm64, x86 := slice(macho.CpuArm64, "A"), slice(macho.CpuAmd64, "X")
+	for _, tc := range []struct {
+		exe, dsym []lipoSlice
+		arch      string
+		ok        int
+		problem   string
+	}{
+		{exe: []lipoSlice{arm64}, dsym: []lipoSlice{arm64}, ok: 1},
+		{exe: []lipoSlice{arm64}, dsym: []lipoSlice{x86}, problem: "architecture mismatch: the executable is arm64, but the dSYM is x86_64"},
+		{exe: []lipoSlice{arm64}, dsym: []lipoSlice{slice(macho.CpuArm64, "B")}, problem: "UUID mismatch for arm64"},
+		{exe: []lipoSlice{arm64}, dsym: []lipoSlice{x86, arm64}, ok: 1},
+		{exe: []lipoSlice{x86, arm64}, dsym: []lipoSlice{arm64}, ok: 1},
+		{exe: []lipoSlice{x86, arm64}, dsym: []lipoSlice{arm64}, arch: "x86_64", problem: "the dSYM has no x86_64 slice, only arm64"},
+		{exe: []lipoSlice{x86}, dsym: []lipoSlice{x86, arm64}, arch: "arm64", problem: "the executable has no arm64 slice, only x86_64"},
+	} {
+		ok, problems := checkPair(tc.exe, tc.dsym, tc.arch)
+		if len(ok) != tc.ok || (tc.problem == "") != (len(problems) == 0) ||
+			tc.problem != "" && !strings.Contains(problems[0], tc.problem) {
+			t.Errorf("checkPair(%v, %v, %q) = %q, %q; want %d matches and %q", tc.exe, tc.dsym, tc.arch, ok, problems, tc.ok, tc.problem)
+		}
+	}
+
+	// The x86_64 slice of the universal test file is the thin one.
+	exef, exe, _, err := openLipo("macho/testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exef.Close()
+	fatf, fat, _, err := openLipo("macho/testdata/fat-gcc-386-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fatf.Close()
+	ok, problems := checkPair(exe, fat, "")
+	if len(problems) != 0 || len(ok) != 1 || !strings.Contains(ok[0], "sd lipo -thin x86_64") {
+		t.Errorf("checkPair of the x86_64 slice = %q, %q", ok, problems)
+	}
+}
+
+func TestThinSlice(t *testing.T) {
+	for _, tt := range []struct {
+		in, arch string
+		cpu      macho.Cpu // 0 for an error
+	}{
+		{"macho/testdata/fat-gcc-386-amd64-darwin-exec", "i386", macho.Cpu386},
+		{"macho/testdata/fat-gcc-386-amd64-darwin-exec", "x86_64", macho.CpuAmd64},
+		{"macho/testdata/fat-gcc-386-amd64-darwin-exec", "arm64", 0},
+		{"macho/testdata/gcc-amd64-darwin-exec", "x86_64", macho.CpuAmd64},
+		{"macho/testdata/gcc-amd64-darwin-exec", "host", macho.CpuAmd64},
+		{"macho/testdata/gcc-amd64-darwin-exec", "i386", 0},
+	} {
+		r, err := os.Open(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := thinSlice(r, tt.arch)
+		r.Close()
+		switch {
+		case tt.cpu == 0 && err == nil:
+			t.Errorf("thinSlice(%s, %s) succeeded, want an error", tt.in, tt.arch)
+		case tt.cpu != 0 && err != nil:
+			t.Errorf("thinSlice(%s, %s): %v", tt.in, tt.arch, err)
+		case tt.cpu != 0 && f.Cpu != tt.cpu:
+			t.Errorf("thinSlice(%s, %s) is %v, want %v", tt.in, tt.arch, f.Cpu, tt.cpu)
+		}
+	}
+}
+
+// zdebug returns s compressed as a __zdebug_ section holds it.
+func zdebug(s string) string {
+	var b bytes.Buffer
+	b.WriteString("ZLIB")
+	binary.Write(&b, binary.BigEndian, uint64(len(s)))
+	w := zlib.NewWriter(&b)
+	w.Write([]byte(s))
+	w.Close()
+	return b.String()
+}
+
+func TestDuplicateSections(t *testing.T) {
+	tests := []struct {
+		sections   []string
+		keep, drop string
+		why        string
+	}{
+		{[]string{"__zdebug_info", zdebug("info"), "__debug_info", "info"}, "__debug_info", "__zdebug_info", "the same"},
+		{[]string{"__debug_info", "info", "__zdebug_info", zdebug("info, and more")}, "__zdebug_info", "__debug_info", "larger"},
+		{[]string{"__debug_info", "info", "__zdebug_info", zdebug("ofni")}, "__debug_info", "__zdebug_info", "not compressed"},
+		{[]string{"__debug_info", "info", "__zdebug_info", "ZLIB\x00\x00\x00\x00\x00\x00\x00\x10garbage"}, "__debug_info", "__zdebug_info", "cannot be read"},
+		{[]string{"__debug_str_offs", "offs", "__zdebug_str_off", zdebug("offs")}, "__debug_str_offs", "__zdebug_str_off", "the same"},
+	}
+	for _, tt := range tests {
+		sections, dups := dedupDWARFSections(testDwarfFile(t, tt.sections...))
+		if len(dups) != 1 {
+			t.Errorf("%q: %d duplicates, want 1", tt.sections[0], len(dups))
+			continue
+		}
+		d := dups[0]
+		if d.keep.Name != tt.keep || d.drop.Name != tt.drop || !strings.Contains(d.String(), tt.why) {
+			t.Errorf("%s, %s: kept %s, dropped %s (%s), want %s kept because %s", tt.sections[0], tt.sections[2], d.keep.Name, d.drop.Name, d, tt.keep, tt.why)
+		}
+		if key := dwarfSectionKey(tt.keep); sections[key] != d.keep {
+			t.Errorf("sections[%q] = %v, want %s", key, sections[key], tt.keep)
+		}
+	}
+
+	// The dSYM has one copy, and the split says why.  Here the second
+	// copy is the test executable's __debug_macinfo, renamed.
+	b := testExecutableBytes(t)
+	i := bytes.Index(b, []byte("__debug_macinfo\x00"))
+	copy(b[i:], "__zdebug_info\x00\x00\x00")
+	in, err := macho.NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := splitDwarf(in, &splitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.warnings) != 1 || !strings.Contains(d.warnings[0], "__zdebug_info is dropped") {
+		t.Errorf("warnings %q", d.warnings)
+	}
+	buf, err := d.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := macho.NewFile(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range out.Sections {
+		if s.Seg == "__DWARF" && s.Name != stampSection {
+			names = append(names, s.Name)
+		}
+	}
+	if got := strings.Join(names, " "); got != "__debug_abbrev __debug_info" {
+		t.Errorf("dSYM DWARF sections %s, want __debug_abbrev __debug_info", got)
+	}
+}
+
+func TestStamp(t *testing.T) {
+	opts := &splitOptions{dsymutil: true, vmaddr: vmaddrBase, base: 0x200000000, redact: &redaction{patterns: []string{"secret*"}}}
+	if err := parseRename("map=__debug_line:__line,__debug_info:__info", opts); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-dsymutil", "-vmaddr=base=0x200000000", "-redact=secret*", "-rename=map=__debug_info:__info,__debug_line:__line"}
+	if got := opts.flags(); !reflect.DeepEqual(got, want) {
+		t.Errorf("flags() = %q, want %q", got, want)
+	}
+
+	opts = &splitOptions{linkEditData: true, stripMacros: true}
+	buf, err := splitToBytes(testExecutable(t), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := macho.NewFile(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := readStamp(out)
+	if err != nil || s == nil {
+		t.Fatalf("readStamp = %v, %v", s, err)
+	}
+	if s.Tool != "split-dwarf" || s.Version == "" || !reflect.DeepEqual(s.Options, []string{"-linkedit-data", "-strip-macros"}) {
+		t.Errorf("stamp %+v", s)
+	}
+	if dw := out.Segment("__DWARF"); out.Sections[dw.Firstsect+dw.Nsect-1].Name != stampSection {
+		t.Errorf("the stamp is not the last section of __DWARF")
+	}
+
+	var b bytes.Buffer
+	if err := describeStamp(&b, out); err != nil || !strings.HasPrefix(b.String(), "Produced by split-dwarf ") || !strings.HasSuffix(b.String(), " with -linkedit-data -strip-macros\n") {
+		t.Errorf("describeStamp wrote %q, %v", b.String(), err)
+	}
+	b.Reset()
+	if err := describeStamp(&b, testExecutable(t)); err != nil || b.Len() != 0 {
+		t.Errorf("describeStamp of an executable wrote %q, %v", b.String(), err)
+	}
+}
+
+func TestReproduce(t *testing.T) {
+	dir := t.TempDir()
+	exe, dwarf, manifest := filepath.Join(dir, "exe"), filepath.Join(dir, "exe.dwarf"), filepath.Join(dir, "manifest.json")
+	if err := ioutil.WriteFile(exe, testExecutableBytes(t), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := splitFile(exe, dwarf, false, &splitOptions{linkEditData: true, stripMacros: true}, manifest, ""); err != nil {
+		t.Fatal(err)
+	}
+	m, err := readManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Options, []string{"-linkedit-data", "-strip-macros"}) {
+		t.Errorf("manifest options %q", m.Options)
+	}
+
+	out := filepath.Join(dir, "again.dwarf")
+	line, err := reproduceManifest(manifest, "", "", out)
+	if err != nil || !strings.HasPrefix(line, "reproduced exe.dwarf: ") {
+		t.Fatalf("reproduceManifest = %q, %v", line, err)
+	}
+	if a, b := readFile(t, dwarf), readFile(t, out); !bytes.Equal(a, b) {
+		t.Errorf("the reproduced dSYM differs")
+	}
+
+	// A manifest written before options were recorded relies on the
+	// dSYM's stamp.
+	m.Options = nil
+	if err := m.write(manifest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reproduceManifest(manifest, "", "", ""); err != nil {
+		t.Errorf("without recorded options: %v", err)
+	}
+
+	// Other options give another dSYM.
+	m.Options = []string{"-linkedit-data"}
+	m.write(manifest)
+	if _, err := reproduceManifest(manifest, "", "", ""); err == nil || !strings.Contains(err.Error(), "was not reproduced") {
+		t.Errorf("with other options: err = %v", err)
+	}
+	m.Options = []string{"-no-such-flag"}
+	m.write(manifest)
+	if _, err := reproduceManifest(manifest, "", "", ""); err == nil || !strings.Contains(err.Error(), "cannot use recorded options") {
+		t.Errorf("with a bad option: err = %v", err)
+	}
+
+	// Another input is refused.
+	m.Options = nil
+	m.write(manifest)
+	other := filepath.Join(dir, "other")
+	b := testExecutableBytes(t)
+	b[len(b)-1] ^= 1
+	ioutil.WriteFile(other, b, 0755)
+	if _, err := reproduceManifest(manifest, other, "", ""); err == nil || !strings.Contains(err.Error(), "is not the recorded input") {
+		t.Errorf("with another input: err = %v", err)
+	}
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	for _, hash := range []hashAlgorithm{hashSHA256, hashBLAKE3} {
+		dir := t.TempDir()
+		exe, dwarf, manifest := filepath.Join(dir, "exe"), filepath.Join(dir, "exe.dwarf"), filepath.Join(dir, "manifest.json")
+		if err := ioutil.WriteFile(exe, testExecutableBytes(t), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := splitFile(exe, dwarf, false, &splitOptions{hash: hash}, manifest, ""); err != nil {
+			t.Fatal(err)
+		}
+		check := func(what, want string) {
+			t.Helper()
+			problems, err := checkArtifacts(manifest)
+			if err != nil {
+				t.Fatalf("%s %s: %v", hash, what, err)
+			}
+			if got := strings.Join(problems, "\n"); want == "" && got != "" || !strings.Contains(got, want) || want != "" && len(problems) != 1 {
+				t.Errorf("%s %s: problems %q, want one containing %q", hash, what, problems, want)
+			}
+		}
+		check("as written", "")
+
+		// The artifacts are found relative to the manifest, wherever
+		// the two are moved together.
+		moved := dir + ".moved"
+		if err := os.Rename(dir, moved); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(moved)
+		dwarf, manifest = filepath.Join(moved, "exe.dwarf"), filepath.Join(moved, "manifest.json")
+		check("moved", "")
+
+		good := readFile(t, dwarf)
+		tampered := append([]byte{}, good...)
+		tampered[len(tampered)/2] ^= 1
+		ioutil.WriteFile(dwarf, tampered, 0644)
+		check("tampered", "exe.dwarf: checksum mismatch")
+		ioutil.WriteFile(dwarf, append(good, 0), 0644)
+		check("extended", "exe.dwarf: checksum mismatch, recorded size="+strconv.Itoa(len(good)))
+		ioutil.WriteFile(dwarf, good, 0644)
+		check("restored", "")
+		os.Remove(dwarf)
+		check("missing", "exe.dwarf: open")
+	}
+
+	if _, err := checkArtifacts(filepath.Join(t.TempDir(), "none.json")); err == nil {
+		t.Errorf("checking a missing manifest succeeded")
+	}
+}
+
+func readFile(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSectionTransforms(t *testing.T) {
+	in := testExecutable(t)
+	var seen []string
+	opts := &splitOptions{transforms: []macho.SectionTransform{
+		func(s *macho.Section, data []byte) ([]byte, error) {
+			seen = append(seen, s.Name)
+			if s.Name != "__debug_info" {
+				return data, nil
+			}
+			return bytes.ToUpper(data), nil
+		},
+		func(s *macho.Section, data []byte) ([]byte, error) {
+			if s.Name != "__debug_info" {
+				return data, nil
+			}
+			return append(data, "+more"...), nil
+		},
+	}}
+	buf, err := splitToBytes(in, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"__debug_abbrev", "__debug_info", "__debug_macinfo"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("transformed %q, want %q", seen, want)
+	}
+	out, err := macho.NewFile(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := out.Section("__debug_info").Data(); string(got) != "INFO............+more" {
+		t.Errorf("__debug_info is %q", got)
+	}
+	want, _ := in.Section("__debug_abbrev").Data()
+	if got, _ := out.Section("__debug_abbrev").Data(); !bytes.Equal(got, want) {
+		t.Errorf("__debug_abbrev is %q, want %q", got, want)
+	}
+	if s, err := readStamp(out); err != nil || s == nil {
+		t.Errorf("readStamp = %v, %v; want the stamp, untransformed", s, err)
+	}
+
+	opts.transforms = append(opts.transforms, func(s *macho.Section, data []byte) ([]byte, error) {
+		return nil, errors.New("no")
+	})
+	if _, err := splitDwarf(in, opts); err == nil || !strings.Contains(err.Error(), "transform 2: no") {
+		t.Errorf("failing transform: got %v", err)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run filters with")
+	}
+	in := testExecutable(t)
+	script := filepath.Join(t.TempDir(), "upper")
+	err := ioutil.WriteFile(script, []byte(`#!/bin/sh
+read name
+if [ "$name" != "$SD_SECTION" ]; then echo "$name is not $SD_SECTION" >&2; exit 1; fi
+if [ "$name" = __debug_info ]; then tr a-z A-Z; else cat; fi
+`), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var opts splitOptions
+	fs := flag.NewFlagSet("filters", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	splitFlags(fs, &opts)
+	if err := fs.Parse([]string{"-filter", script, "-filter", "sed 1d"}); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := splitToBytes(in, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := macho.NewFile(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second filter is given what the first wrote, with a line
+	// naming the section before it, and drops that line.
+	if got, _ := out.Section("__debug_info").Data(); string(got) != "INFO............" {
+		t.Errorf("__debug_info is %q", got)
+	}
+	want, _ := in.Section("__debug_abbrev").Data()
+	if got, _ := out.Section("__debug_abbrev").Data(); !bytes.Equal(got, want) {
+		t.Errorf("__debug_abbrev is %q, want %q", got, want)
+	}
+	if s := stampOf(out); s == nil || !reflect.DeepEqual(s.Options, []string{"-filter=" + script, "-filter=sed 1d"}) {
+		t.Errorf("stamp is %v", s)
+	}
+
+	opts.filters = []string{"sh -c exit"}
+	if _, err := splitDwarf(in, &opts); err != nil {
+		t.Errorf("filter writing nothing: %v", err)
+	}
+	opts.filters = []string{"false"}
+	if _, err := splitDwarf(in, &opts); err == nil || !strings.Contains(err.Error(), `filter "false"`) {
+		t.Errorf("failing filter: got %v", err)
+	}
+	if err := fs.Parse([]string{"-filter", " "}); err == nil {
+		t.Errorf("empty -filter accepted")
+	}
+}
+
+func TestLayout(t *testing.T) {
+	in := testExecutable(t)
+	opts := &splitOptions{stripMacros: true}
+	p, err := planDsym(in, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := p.layout()
+	buf, err := splitToBytes(in, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := macho.NewFile(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The layout is that of the dSYM written.
+	if l.Size != uint64(len(buf)) {
+		t.Errorf("layout size is %d, but the dSYM has %d bytes", l.Size, len(buf))
+	}
+	if len(l.Loads) != len(out.Loads) {
+		t.Fatalf("layout has %d loads, the dSYM %d", len(l.Loads), len(out.Loads))
+	}
+	var segs []string
+	for i, g := range l.Segments {
+		segs = append(segs, g.Name)
+		og := out.Segment(g.Name)
+		if og == nil || og.Offset != g.Offset || og.Filesz != g.Filesz || og.Addr != g.Addr || og.Memsz != g.Memsz {
+			t.Errorf("segment %d is %+v, but in the dSYM %v", i, g, og)
+			continue
+		}
+		for j, s := range g.Sections {
+			have := out.Sections[og.Firstsect+uint32(j)]
+			if have.Name != s.Name || have.Offset != s.Offset || have.Size != s.Size || have.Addr != s.Addr {
+				t.Errorf("section %s is %+v, but in the dSYM %+v", s.Name, s, have.SectionHeader)
+			}
+		}
+	}
+	if want := "__PAGEZERO __TEXT __DATA __LINKEDIT __DWARF"; strings.Join(segs, " ") != want {
+		t.Errorf("segments are %v, want %s", segs, want)
+	}
+	if st := out.Symtab; st.Symoff != l.Symtab.Symoff || st.Nsyms != l.Symtab.Nsyms || st.Stroff != l.Symtab.Stroff || st.Strsize != l.Symtab.Strsize {
+		t.Errorf("symtab is %+v, but in the dSYM %+v", l.Symtab, st.SymtabCmd)
+	}
+
+	// The DWARF sections say where they come from; the macro section
+	// is stripped, and the stamp is made.
+	var dwarf []LayoutSection
+	for _, g := range l.Segments {
+		if g.Name == "__DWARF" {
+			dwarf = g.Sections
+		}
+	}
+	want := []LayoutSection{
+		{Name: "__debug_abbrev", From: "__debug_abbrev"},
+		{Name: "__debug_info", From: "__debug_info"},
+		{Name: stampSection, Edited: true},
+	}
+	if len(dwarf) != len(want) {
+		t.Fatalf("__DWARF sections are %+v", dwarf)
+	}
+	for i, s := range dwarf {
+		if s.Name != want[i].Name || s.From != want[i].From || s.Edited != want[i].Edited {
+			t.Errorf("__DWARF section %d is %+v, want %+v", i, s, want[i])
+		}
+	}
+}
+
+func TestBundleFiles(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), "Frameworks.dSYM")
+	dwarf := filepath.Join(bundle, "Contents", "Resources", "DWARF")
+	if err := os.MkdirAll(dwarf, 0755); err != nil {
+		t.Fatal(err)
+	}
+	copyTo := func(from, name string) {
+		b, err := ioutil.ReadFile(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dwarf, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copyTo("macho/testdata/gcc-386-darwin-exec", "Helper")
+	copyTo("macho/testdata/clang-amd64-darwin-exec-with-rpath", "Other")
+
+	exef, exe, _, err := openLipo("macho/testdata/gcc-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exef.Close()
+
+	// No file of the bundle matches, and each says why.
+	files, err := bundleFiles(bundle)
+	if err != nil || len(files) != 2 || filepath.Base(files[0]) != "Helper" || filepath.Base(files[1]) != "Other" {
+		t.Fatalf("bundleFiles = %q, %v", files, err)
+	}
+	ok, problems, err := checkPairFiles(exe, files, "")
+	if err != nil || len(ok) != 0 || len(problems) != 3 || !strings.Contains(problems[0], "none of the 2 DWARF files") ||
+		!strings.Contains(problems[1], "Helper: architecture mismatch") || !strings.Contains(problems[2], "Other: UUID mismatch") {
+		t.Errorf("checkPairFiles without a match = %q, %q, %v", ok, problems, err)
+	}
+
+	// The one that matches is named, whatever the others are.
+	copyTo("macho/testdata/gcc-amd64-darwin-exec", "App")
+	files, err = bundleFiles(bundle)
+	if err != nil || len(files) != 3 {
+		t.Fatalf("bundleFiles = %q, %v", files, err)
+	}
+	ok, problems, err = checkPairFiles(exe, files, "")
+	if err != nil || len(problems) != 0 || len(ok) != 1 || !strings.HasSuffix(ok[0], "(in "+filepath.Join(dwarf, "App")+")") {
+		t.Errorf("checkPairFiles with a match = %q, %q, %v", ok, problems, err)
+	}
+
+	if files, err := bundleFiles("macho/testdata/gcc-amd64-darwin-exec"); err != nil || len(files) != 1 {
+		t.Errorf("bundleFiles of a file = %q, %v", files, err)
+	}
+	if _, err := bundleFiles("macho/testdata"); err == nil {
+		t.Errorf("bundleFiles of a directory that is not a bundle succeeded")
+	}
+}
+
+func TestShareStrings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd-share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	abbrevs := "\x01\x11\x01\x03\x0e\x1b\x0e\x00\x00" + // compile_unit: name, comp_dir strp
+		"\x02\x34\x00\x03\x0e\x00\x00" + // variable: name strp
+		"\x00"
+	header := "\x1b\x00\x00\x00\x04\x00\x00\x00\x00\x00\x08"
+	files := map[string]string{}
+	for _, d := range []struct {
+		name, info, str string
+	}{
+		{"a", "\x01\x00\x00\x00\x00\x07\x00\x00\x00\x02\x0c\x00\x00\x00\x02\x13\x00\x00\x00\x00", "main.c\x00/src\x00shared\x00onlyA\x00"},
+		{"b", "\x01\x05\x00\x00\x00\x00\x00\x00\x00\x02\x12\x00\x00\x00\x02\x0c\x00\x00\x00\x00", "/src\x00main.c\x00onlyB\x00shared\x00"},
+	} {
+		_, out := dsymPath(filepath.Join(dir, d.name))
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			t.Fatal(err)
+		}
+		uuid := bytes.Repeat([]byte(d.name), 16)
+		b := testDwarfBytes(uuid, "__debug_abbrev", abbrevs, "__debug_info", header+d.info, "__debug_str", d.str)
+		if err := ioutil.WriteFile(out, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files[d.name] = out
+	}
+
+	names := func(b []byte) string {
+		t.Helper()
+		f, err := macho.NewFile(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		section := func(name string) []byte {
+			b, err := f.Section(name).Data()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}
+		d, err := dwarf.New(section("__debug_abbrev"), nil, nil, section("__debug_info"), nil, nil, nil, section("__debug_str"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for r := d.Reader(); ; {
+			e, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e == nil {
+				break
+			}
+			for _, f := range e.Field {
+				got = append(got, fmt.Sprint(f.Val))
+			}
+		}
+		return strings.Join(got, " ")
+	}
+
+	for run := 1; run <= 2; run++ {
+		st, err := shareStrings(dir, 2, false, false, hashSHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.files != 2 || st.strings != 3 || st.refs != 8 || st.shared != 4 || st.removed != 0 || len(st.skipped) != 0 {
+			t.Errorf("run %d: %+v", run, st)
+		}
+		shared, err := macho.Open(st.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := shared.Section("__debug_str").Data(); string(b) != "/src\x00main.c\x00shared\x00" {
+			t.Errorf("run %d: shared __debug_str is %q", run, b)
+		}
+		shared.Close()
+
+		a, err := macho.Open(files["a"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := a.Section("__debug_str").Data(); string(b) != "shared\x00onlyA\x00" {
+			t.Errorf("run %d: a's __debug_str is %q", run, b)
+		}
+		sup, err := findSupplementary(a, nil)
+		a.Close()
+		if want := filepath.Base(st.file); err != nil || sup == nil || sup.StrRefs != 2 || filepath.Base(sup.Name) != want {
+			t.Errorf("run %d: findSupplementary = %+v, %v; want 2 string references into %s", run, sup, err, want)
+		}
+
+		for name, want := range map[string]string{
+			"a": "main.c /src shared onlyA",
+			"b": "main.c /src shared onlyB",
+		} {
+			b, err := unsharedBytes(files[name])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(b); got != want {
+				t.Errorf("run %d: %s unshared names %q, want %q", run, name, got, want)
+			}
+		}
+	}
+}
+
+// A testImage is a dSYM already written, for writeChunked.
+type testImage []byte
+
+func (b testImage) writeFile(name string, perm os.FileMode) error {
+	return ioutil.WriteFile(name, b, perm)
+}
+
+func TestChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd-chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := filepath.Join(dir, "store")
+	chunks := filepath.Join(store, "chunks")
+
+	// Two releases, whose DWARF differs in a few bytes in the middle.
+	info := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(info)
+	v1 := testDwarfBytes(bytes.Repeat([]byte{1}, 16), "__debug_info", string(info))
+	copy(info[len(info)/2:], "release 2")
+	v2 := testDwarfBytes(bytes.Repeat([]byte{2}, 16), "__debug_info", string(info))
+
+	var indexes [2]*ChunkIndex
+	for i, b := range []testImage{v1, v2} {
+		_, out := dsymPath(filepath.Join(store, fmt.Sprintf("v%d", i+1)))
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeChunked(b, out, chunks, false); err != nil {
+			t.Fatal(err)
+		}
+		ix, err := readChunkIndex(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ix.Size != int64(len(b)) || len(ix.UUIDs) != 1 || len(ix.Chunks) < 4 {
+			t.Errorf("v%d: index of %d bytes, UUIDs %v, %d chunks", i+1, ix.Size, ix.UUIDs, len(ix.Chunks))
+		}
+		// Only a chunk that ends where a section does may be short.
+		cut := make(map[int64]bool)
+		for _, off := range sectionCuts(bytes.NewReader(b)) {
+			cut[off] = true
+		}
+		var end int64
+		for j, c := range ix.Chunks {
+			end += c.Size
+			if c.Size > maxChunk || c.Size < minChunk && !cut[end] && j < len(ix.Chunks)-1 {
+				t.Errorf("v%d: chunk %d is %d bytes", i+1, j, c.Size)
+			}
+		}
+		indexes[i] = ix
+	}
+	shared := 0
+	for _, c := range indexes[1].Chunks {
+		for _, d := range indexes[0].Chunks {
+			if c == d {
+				shared++
+				break
+			}
+		}
+	}
+	if n := len(indexes[1].Chunks); shared < n-2 {
+		t.Errorf("v2 shares %d of its %d chunks with v1, want all but one or two", shared, n)
+	}
+
+	entries, err := scanStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || !entries[0].chunked || entries[0].uuids[0] != indexes[0].UUIDs[0] {
+		t.Fatalf("scanStore found %d entries, first %+v", len(entries), entries[0])
+	}
+
+	s, err := newServer(store, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	cache := filepath.Join(dir, "cache")
+	for i, want := range [][]byte{v1, v2} {
+		out := filepath.Join(dir, fmt.Sprintf("v%d.dwarf", i+1))
+		found, err := fetchChunked(ts.URL, indexes[i].UUIDs[0], out, cache)
+		if err != nil || !found {
+			t.Fatalf("v%d: fetchChunked = %v, %v", i+1, found, err)
+		}
+		if got, _ := ioutil.ReadFile(out); !bytes.Equal(got, want) {
+			t.Errorf("v%d: reassembled %d bytes differ from the %d written", i+1, len(got), len(want))
+		}
+		found, err = fetchDebuginfod(ts.URL, indexes[i].UUIDs[0], out)
+		if got, _ := ioutil.ReadFile(out); err != nil || !found || !bytes.Equal(got, want) {
+			t.Errorf("v%d: debuginfo = %v, %v, and %d bytes that do not match", i+1, found, err, len(got))
+		}
+	}
+	cached, _ := filepath.Glob(filepath.Join(cache, "*", "*.chunk"))
+	if want := len(indexes[0].Chunks) + len(indexes[1].Chunks) - shared; len(cached) != want {
+		t.Errorf("fetched %d chunks, want %d", len(cached), want)
+	}
+
+	// With v1 gone, only the chunks v2 does not list go with it.
+	if err := os.RemoveAll(entries[0].path); err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := pruneChunks(store, entries[1:], false)
+	if want := len(indexes[0].Chunks) - shared; err != nil || pruned != want {
+		t.Errorf("pruneChunks = %d, %v; want %d", pruned, err, want)
+	}
+}
+
+func TestStoreFind(t *testing.T) {
+	dir := t.TempDir()
+	store1, store2 := filepath.Join(dir, "store1"), filepath.Join(dir, "store2")
+	write := func(name string, b []byte) string {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	dwarf := func(n byte) []byte { return testDwarfBytes(bytes.Repeat([]byte{n}, 16), "__debug_info", "x") }
+	_, x := dsymPath(filepath.Join(store1, "x"))
+	write(x, dwarf(0x11))
+	y := write(filepath.Join(store1, "lib", "y.dwarf"), dwarf(0x22))
+	again := write(filepath.Join(store2, "again.dwarf"), dwarf(0x22))
+
+	// A universal dSYM is found by the UUID of either slice.
+	arm64 := dwarf(0x44)
+	binary.LittleEndian.PutUint32(arm64[4:], uint32(macho.CpuArm64))
+	arches := []macho.FatArchHeader{
+		{Cpu: macho.CpuAmd64, SubCpu: 3, Offset: 0x1000, Size: uint32(len(dwarf(0x33))), Align: 12},
+		{Cpu: macho.CpuArm64, SubCpu: 3, Offset: 0x10000, Size: uint32(len(arm64)), Align: 14},
+	}
+	b := make([]byte, 0x10000+len(arm64))
+	macho.PutFatHeader(b, arches)
+	copy(b[0x1000:], dwarf(0x33))
+	copy(b[0x10000:], arm64)
+	fat := write(filepath.Join(store2, "fat.dwarf"), b)
+
+	// An executable, kept outside the stores, is looked up by its UUID.
+	exe := write(filepath.Join(dir, "exe"), testExecutableBytes(t))
+	_, exeDwarf := dsymPath(filepath.Join(store2, "exe"))
+	if err := os.MkdirAll(filepath.Dir(exeDwarf), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := splitFile(exe, exeDwarf, false, &splitOptions{}, "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	stores := []string{store1, filepath.Join(dir, "none"), store2}
+	for _, tc := range []struct {
+		arg, want string
+	}{
+		{"11111111-1111-1111-1111-111111111111", x},
+		{"11111111111111111111111111111111", x},
+		{"22222222-2222-2222-2222-222222222222", y}, // the first store's
+		{"44444444-4444-4444-4444-444444444444", fat},
+		{exe, exeDwarf},
+		{"55555555-5555-5555-5555-555555555555", ""},
+	} {
+		u, err := uuidArg(tc.arg)
+		if err != nil {
+			t.Errorf("uuidArg(%s): %v", tc.arg, err)
+			continue
+		}
+		if got, err := findSymbols(stores, u, filepath.Join(dir, "out.dwarf"), ""); err != nil || got != tc.want {
+			t.Errorf("find %s: %q, %v; want %q", tc.arg, got, err, tc.want)
+		}
+	}
+	if got, _ := findSymbols([]string{store2, store1}, formatUUID(bytes.Repeat([]byte{0x22}, 16)), "", ""); got != again {
+		t.Errorf("with the stores the other way round, found %q, want %q", got, again)
+	}
+	if _, err := uuidArg(filepath.Join(dir, "none")); err == nil || !strings.Contains(err.Error(), "neither a UUID nor") {
+		t.Errorf("uuidArg of a missing file: %v", err)
+	}
+	if _, err := uuidArg(write(filepath.Join(dir, "nouuid"), testDwarfBytes(nil, "__debug_info", "x"))); err == nil || !strings.Contains(err.Error(), "has no UUID") {
+		t.Errorf("uuidArg of a file without a UUID: %v", err)
+	}
+}
+
+func TestChunkSections(t *testing.T) {
+	dir := t.TempDir()
+	// The chunks of ix that lie within [from, to) of its file, which
+	// must be cut at both ends.
+	within := func(ix *ChunkIndex, from, to int64) []Chunk {
+		t.Helper()
+		var in []Chunk
+		var off, size int64
+		for _, c := range ix.Chunks {
+			if off >= from && off+c.Size <= to {
+				in = append(in, c)
+				size += c.Size
+			}
+			off += c.Size
+		}
+		if size != to-from {
+			t.Fatalf("chunks cover %d bytes of the %d at %#x", size, to-from, from)
+		}
+		return in
+	}
+	stored := func(dir string) map[string]bool {
+		t.Helper()
+		m := make(map[string]bool)
+		names, _ := filepath.Glob(filepath.Join(dir, "*", "*.chunk"))
+		for _, name := range names {
+			m[strings.TrimSuffix(filepath.Base(name), ".chunk")] = true
+		}
+		return m
+	}
+	write := func(d testImage, name, chunks string, contentOnly bool) *ChunkIndex {
+		t.Helper()
+		out := filepath.Join(dir, name)
+		if err := writeChunked(d, out, chunks, contentOnly); err != nil {
+			t.Fatal(err)
+		}
+		ix, err := readChunkIndex(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := ix.writeTo(&b, func(c Chunk) ([]byte, error) { return readChunk(chunks, c) }); err != nil || !bytes.Equal(b.Bytes(), d) {
+			t.Fatalf("%s does not reassemble: %v", name, err)
+		}
+		return ix
+	}
+
+	// The slices of a universal dSYM share their DWARF, but at other
+	// offsets; each section of one is the chunks of the other's.
+	amd64 := testExecutableBytes(t)
+	arm64 := append([]byte{}, amd64...)
+	binary.LittleEndian.PutUint32(arm64[4:], uint32(macho.CpuArm64))
+	binary.LittleEndian.PutUint32(arm64[8:], 0)
+	in := make([]byte, 0x8000+len(arm64))
+	macho.PutFatHeader(in, []macho.FatArchHeader{
+		{Cpu: macho.CpuAmd64, SubCpu: 3, Offset: 0x1000, Size: uint32(len(amd64)), Align: 12},
+		{Cpu: macho.CpuArm64, SubCpu: 0, Offset: 0x8000, Size: uint32(len(arm64)), Align: 14},
+	})
+	copy(in[0x1000:], amd64)
+	copy(in[0x8000:], arm64)
+	fd, err := splitFat(bytes.NewReader(in), &splitOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fat := filepath.Join(dir, "fat")
+	if err := fd.writeFile(fat, 0644); err != nil {
+		t.Fatal(err)
+	}
+	image := testImage(readFile(t, fat))
+	ff, err := macho.NewFatFile(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix := write(image, "fat.chunks", filepath.Join(dir, "c1"), false)
+	sections := 0
+	a0, a1 := ff.Arches[0], ff.Arches[1]
+	for _, s0 := range a0.Sections {
+		s1 := a1.Section(s0.Name)
+		if s0.Seg != "__DWARF" || s0.Size == 0 || s1 == nil {
+			continue
+		}
+		from0, from1 := int64(a0.Offset)+int64(s0.Offset), int64(a1.Offset)+int64(s1.Offset)
+		if c0, c1 := within(ix, from0, from0+int64(s0.Size)), within(ix, from1, from1+int64(s1.Size)); !reflect.DeepEqual(c0, c1) {
+			t.Errorf("%s is chunked as %v in one slice, %v in the other", s0.Name, c0, c1)
+		}
+		sections++
+	}
+	if sections == 0 {
+		t.Fatalf("no DWARF sections in %d slices", len(ff.Arches))
+	}
+	if n, all := len(stored(filepath.Join(dir, "c1"))), len(ix.Chunks); n >= all {
+		t.Errorf("%d chunks stored for %d listed", n, all)
+	}
+	// Cut only by content, the small sections are not cut apart.
+	if ix := write(image, "fat.content", filepath.Join(dir, "c2"), true); len(ix.Chunks) >= sections {
+		t.Errorf("by content alone, %d chunks for %d sections", len(ix.Chunks), sections)
+	}
+
+	// In a later build, a section that has not changed, though it has
+	// moved, is already stored.
+	random := func(seed int64, n int) string {
+		b := make([]byte, n)
+		rand.New(rand.NewSource(seed)).Read(b)
+		return string(b)
+	}
+	chunks := filepath.Join(dir, "c3")
+	abbrev := random(1, 100<<10)
+	b1 := testDwarfBytes(bytes.Repeat([]byte{1}, 16), "__debug_abbrev", abbrev, "__debug_info", random(2, 300<<10))
+	b2 := testDwarfBytes(bytes.Repeat([]byte{2}, 16), "__debug_line", random(3, 50<<10+17), "__debug_abbrev", abbrev, "__debug_info", random(4, 300<<10))
+	ix1 := write(b1, "b1", chunks, false)
+	before := stored(chunks)
+	ix2 := write(b2, "b2", chunks, false)
+	f1, _ := macho.NewFile(bytes.NewReader(b1))
+	f2, _ := macho.NewFile(bytes.NewReader(b2))
+	s1, s2 := f1.Section("__debug_abbrev"), f2.Section("__debug_abbrev")
+	c1 := within(ix1, int64(s1.Offset), int64(s1.Offset)+int64(s1.Size))
+	c2 := within(ix2, int64(s2.Offset), int64(s2.Offset)+int64(s2.Size))
+	if !reflect.DeepEqual(c1, c2) {
+		t.Errorf("the moved __debug_abbrev is chunked anew")
+	}
+	for _, c := range c2 {
+		if !before[c.SHA256] {
+			t.Errorf("chunk %s of the moved __debug_abbrev was stored again", c.SHA256)
+		}
+	}
+}
+
+func TestDelta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd-delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(info)
+	v1 := testDwarfBytes(bytes.Repeat([]byte{1}, 16), "__debug_info", string(info))
+	// Today's build: a change in the middle, and DWARF added at the end.
+	copy(info[len(info)/3:], "release 2")
+	v2 := testDwarfBytes(bytes.Repeat([]byte{2}, 16), "__debug_info", string(info)+"more DWARF")
+	files := map[string][]byte{"v1": v1, "v2": v2, "other": v2[:len(v1)]}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in := func(name string) string { return filepath.Join(dir, name) }
+
+	st, err := writeDeltaFile(in("delta"), in("v1"), in("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(in("delta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.size != int64(len(v2)) || st.copied < st.size*3/4 || fi.Size() > st.size/4 {
+		t.Errorf("delta of %d bytes copies %d of %d", fi.Size(), st.copied, st.size)
+	}
+
+	h, err := applyDeltaFile(in("v1"), in("delta"), in("out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(in("out")); !bytes.Equal(got, v2) || h.Result.Path != "v2" || len(h.UUIDs) != 1 {
+		t.Errorf("applied delta made %d bytes, header %+v; want v2's %d", len(got), h, len(v2))
+	}
+	if _, err := applyDeltaFile(in("other"), in("delta"), in("out2")); err == nil || !strings.Contains(err.Error(), "not the dSYM the delta is from") {
+		t.Errorf("applying to the wrong base: %v", err)
+	}
+	if _, err := os.Stat(in("out2")); err == nil {
+		t.Errorf("applying to the wrong base left output")
+	}
+}
+
+func TestEditInPlace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd-inplace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	orig := testDwarfBytes(bytes.Repeat([]byte{1}, 16), "__debug_str", "old\x00")
+	edited := testDwarfBytes(bytes.Repeat([]byte{1}, 16), "__debug_str", "new\x00")
+	other := testDwarfBytes(bytes.Repeat([]byte{2}, 16), "__debug_str", "new\x00")
+	name := filepath.Join(dir, "a.dwarf")
+	bak := name + backupSuffix
+	reset := func() {
+		t.Helper()
+		os.Remove(bak)
+		if err := ioutil.WriteFile(name, orig, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writing := func(b []byte) func(io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := w.Write(b)
+			return err
+		}
+	}
+	check := func(want []byte, wantBak bool) {
+		t.Helper()
+		if got, _ := ioutil.ReadFile(name); !bytes.Equal(got, want) {
+			t.Errorf("file holds %q", got)
+		}
+		if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("file mode %v, %v", fi.Mode(), err)
+		}
+		got, err := ioutil.ReadFile(bak)
+		if wantBak && !bytes.Equal(got, orig) || !wantBak && err == nil {
+			t.Errorf("backup holds %q, %v; want it kept: %v", got, err, wantBak)
+		}
+	}
+
+	reset()
+	if err := editInPlace(name, writing(edited), checkDsymEdit, true); err != nil {
+		t.Fatal(err)
+	}
+	check(edited, true)
+	reset()
+	if err := editInPlace(name, writing(edited), checkDsymEdit, false); err != nil {
+		t.Fatal(err)
+	}
+	check(edited, false)
+
+	// An edit that fails the check is not made.
+	reset()
+	err = editInPlace(name, writing(other), checkDsymEdit, true)
+	if err == nil || !strings.Contains(err.Error(), "it was left as it was") {
+		t.Errorf("edit changing the UUID: %v", err)
+	}
+	check(orig, false)
+
+	// One that fails it once in place is rolled back.
+	reset()
+	checks := 0
+	err = editInPlace(name, writing(edited), func(orig, edited string) error {
+		if checks++; checks > 1 {
+			return errors.New("is unreadable")
+		}
+		return nil
+	}, true)
+	if err == nil || !strings.Contains(err.Error(), "it was rolled back") {
+		t.Errorf("edit failing in place: %v", err)
+	}
+	check(orig, false)
+	if names, _ := filepath.Glob(filepath.Join(dir, ".sd*")); len(names) != 0 {
+		t.Errorf("temporary files left: %v", names)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dwarf := filepath.Join(dir, "a.dSYM", "Contents", "Resources", "DWARF", "a")
+	if got, want := lockTarget(dwarf), filepath.Join(dir, "a.dSYM"); got != want {
+		t.Errorf("lockTarget(%s) = %s, want %s", dwarf, got, want)
+	}
+	if got := lockTarget(filepath.Join(dir, "a.dwarf")); got != filepath.Join(dir, "a.dwarf") {
+		t.Errorf("lockTarget of a bare file = %s", got)
+	}
+
+	l, err := lockDsym(dwarf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "a.dSYM"+lockSuffix)
+	if h := readLockHolder(file); h == nil || h.PID != os.Getpid() {
+		t.Errorf("lock file records %+v", h)
+	}
+	// Held, even by this process, it is busy.
+	_, err = lockDsym(dwarf, 0)
+	if be, ok := err.(*busyError); !ok || be.holder == nil || !strings.Contains(err.Error(), "is busy") || !strings.Contains(err.Error(), file) {
+		t.Errorf("second lock: %v", err)
+	}
+	// With -lock-wait, it is had once let go of.
+	time.AfterFunc(100*time.Millisecond, l.unlock)
+	l2, err := lockDsym(dwarf, 10*time.Second)
+	if err != nil {
+		t.Fatalf("waiting lock: %v", err)
+	}
+	l2.unlock()
+	l2.unlock()
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("lock file left after unlock: %v", err)
+	}
+
+	// A lock left by a process of this host that is gone is broken;
+	// one of another host's is not.
+	host, _ := os.Hostname()
+	for _, h := range []struct {
+		host  string
+		taken bool
+	}{
+		{host, true},
+		{"elsewhere.example", false},
+	} {
+		b, _ := json.Marshal(&lockHolder{PID: 1<<31 - 1, Host: h.host, Since: time.Now()})
+		if err := ioutil.WriteFile(filepath.Join(dir, storeLockName), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		l, err := lockStore(dir, 0)
+		if (err == nil) != h.taken {
+			t.Errorf("lock left on %s: %v", h.host, err)
+		}
+		l.unlock()
+	}
+}
+
+func TestCorpusCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exe := testExecutableBytes(t)
+	fat, err := ioutil.ReadFile("macho/testdata/fat-gcc-386-amd64-darwin-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"bin/good":       exe,
+		"bin/fat":        fat,
+		"bin/truncated":  exe[:64],
+		"lib/README":     []byte("not a Mach-O file"),
+		"lib/Main.class": {0xca, 0xfe, 0xba, 0xbe, 0, 0, 0, 52},
+	}
+	for name, b := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, b, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A hard link is checked once.
+	if err := os.Link(filepath.Join(dir, "bin/good"), filepath.Join(dir, "lib/good")); err != nil {
+		t.Fatal(err)
+	}
+
+	st := &corpusStats{types: make(map[string]int), arches: make(map[string]int)}
+	if err := st.walk(dir, true, &splitOptions{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if st.files != 5 || st.machos != 3 || st.universal != 1 || st.slices != 3 {
+		t.Errorf("files %d, Mach-O %d, universal %d, slices %d; want 5, 3, 1, 3", st.files, st.machos, st.universal, st.slices)
+	}
+	if st.split != 1 || st.noDwarf != 2 || st.dsymBytes == 0 {
+		t.Errorf("split %d into %d bytes, %d without DWARF; want 1, some, 2", st.split, st.dsymBytes, st.noDwarf)
+	}
+	if len(st.failures) != 1 || st.failures[0].stage != "parse" || !strings.HasSuffix(st.failures[0].path, "truncated") {
+		t.Errorf("failures %v; want bin/truncated failing to parse", st.failures)
+	}
+	var b bytes.Buffer
+	st.report(&b, time.Second)
+	for _, want := range []string{"types: Exec 3\n", "architectures: x86_64 2, i386 1\n", "1 failed (parse 1)\n", "failed: " + filepath.Join(dir, "bin/truncated") + ": parse: "} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, b.String())
+		}
+	}
+
+	// An unsplittable slice fails the split, not the walk.
+	st = &corpusStats{types: make(map[string]int), arches: make(map[string]int)}
+	if err := st.walk(filepath.Join(dir, "bin"), true, &splitOptions{onlyDwarf: true, dsymutil: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.failures) != 2 || st.failures[0].stage != "split" || !strings.HasSuffix(st.failures[0].path, "good") {
+		t.Errorf("failures %v; want bin/good failing to split, and bin/truncated to parse", st.failures)
+	}
+}
+
+func TestHash(t *testing.T) {
+	// From the BLAKE3 test vectors: input i%251 for each byte i.
+	input := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(i % 251)
+		}
+		return b
+	}
+	for _, v := range []struct {
+		n    int
+		want string
+	}{
+		{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+	} {
+		if got := fmt.Sprintf("%x", hashBLAKE3.sum(input(v.n))); got != v.want {
+			t.Errorf("BLAKE3 of %d bytes = %s, want %s", v.n, got, v.want)
+		}
+	}
+	// Written in pieces, across chunks, it is the same, and Sum
+	// does not change what has been written.
+	b := input(5000)
+	h := newBlake3()
+	for p := b; len(p) > 0; {
+		n := 700
+		if n > len(p) {
+			n = len(p)
+		}
+		h.Write(p[:n])
+		p = p[n:]
+	}
+	if got, want := h.Sum(nil), hashBLAKE3.sum(b); !bytes.Equal(got, want) || !bytes.Equal(h.Sum(nil), want) {
+		t.Errorf("BLAKE3 of 5000 bytes in pieces = %x, want %x", got, want)
+	}
+
+	// A manifest made with -hash=blake3 says so, and is checked by it.
+	dir := t.TempDir()
+	exe, dwarf, manifest := filepath.Join(dir, "exe"), filepath.Join(dir, "exe.dwarf"), filepath.Join(dir, "manifest.json")
+	if err := ioutil.WriteFile(exe, testExecutableBytes(t), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := splitFile(exe, dwarf, false, &splitOptions{hash: hashBLAKE3}, manifest, ""); err != nil {
+		t.Fatal(err)
+	}
+	m, err := readManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := m.Artifacts[0]
+	if m.Hash != hashBLAKE3 || a.SHA256 != "" || len(a.BLAKE3) != 64 || m.Input.ContentBLAKE3 == "" {
+		t.Errorf("manifest hash %q, artifact %+v, input %+v", m.Hash, a, m.Input)
+	}
+	if d, err := digestFile(dwarf, hashBLAKE3); err != nil || !d.matches(a) {
+		t.Errorf("dSYM digests as %v, %v; manifest has %v", d, err, a)
+	}
+	if d, _ := digestFile(dwarf, hashSHA256); d.matches(a) {
+		t.Errorf("a SHA-256 digest matches a BLAKE3 one")
+	}
+	line, err := reproduceManifest(manifest, "", "", "")
+	if err != nil || !strings.Contains(line, "blake3="+a.BLAKE3) {
+		t.Errorf("reproduce: %q, %v", line, err)
+	}
+	m.Hash = "md5"
+	m.write(manifest)
+	if _, err := readManifest(manifest); err == nil || !strings.Contains(err.Error(), `unknown hash "md5"`) {
+		t.Errorf("manifest with an unknown hash: %v", err)
+	}
+}
+
+func TestEditSymbolsCmd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	rename := func(from, to string) symbolEdit {
+		return func(t *macho.FileTOC) error { return t.RenameSymbol(from, to) }
+	}
+	alias := func(alias, target string) symbolEdit {
+		return func(t *macho.FileTOC) error { return t.AddAlias(alias, target) }
+	}
+	edits := []symbolEdit{rename("_main", "_main2"), alias("_main", "_main2")}
+	if err := editSymbols("macho/testdata/gcc-amd64-darwin-exec", out, edits); err != nil {
+		t.Fatal(err)
+	}
+	f, err := macho.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var main, main2 *macho.Symbol
+	for i, s := range f.Symtab.Syms {
+		switch s.Name {
+		case "_main":
+			main = &f.Symtab.Syms[i]
+		case "_main2":
+			main2 = &f.Symtab.Syms[i]
+		}
+	}
+	if main == nil || main2 == nil || main.Value != main2.Value {
+		t.Errorf("after renaming _main to _main2 and aliasing _main to it, _main is %+v, _main2 %+v", main, main2)
+	}
+
+	// The edits are made in order, and the first that fails fails all.
+	edits = []symbolEdit{alias("_start", "_main2"), rename("_main", "_main2")}
+	if err := editSymbols("macho/testdata/gcc-amd64-darwin-exec", out, edits); err == nil || !strings.Contains(err.Error(), "no defined symbol _main2") {
+		t.Errorf("aliasing a symbol before it is named succeeded, or failed with %v", err)
+	}
+	if err := editSymbols("macho/testdata/fat-gcc-386-amd64-darwin-exec", out, edits); err == nil || !strings.Contains(err.Error(), "universal") {
+		t.Errorf("editing a universal file succeeded, or failed with %v", err)
+	}
+}
+
+func TestStripCmd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in, out := "macho/testdata/gcc-amd64-darwin-exec", filepath.Join(dir, "stripped")
+	n, err := stripFile(in, out, macho.StripAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := macho.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n != 8 || len(f.Symtab.Syms) != 3 {
+		t.Errorf("stripping removed %d symbols, leaving %d; want 8, leaving 3", n, len(f.Symtab.Syms))
+	}
+	fi, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, _ := os.Stat(in)
+	if fi.Size() >= orig.Size() {
+		t.Errorf("stripped file is %d bytes; the input %d", fi.Size(), orig.Size())
+	}
+	if _, err := stripFile(in, out, macho.StripTables); err == nil {
+		t.Errorf("removing the symbol tables dyld needs succeeded")
+	}
+
+	// Stripped in place, as "sd strip exe exe", the input is read whole
+	// before it is replaced, and keeps its mode.
+	same := filepath.Join(dir, "same")
+	if err := ioutil.WriteFile(same, readFile(t, in), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := stripFile(same, same, macho.StripAll); err != nil || n != 8 {
+		t.Fatalf("stripping a file onto itself removed %d symbols, error %v; want 8", n, err)
+	}
+	if !bytes.Equal(readFile(t, same), readFile(t, out)) {
+		t.Errorf("a file stripped onto itself differs from one stripped to a new file")
+	}
+	if fi, err := os.Stat(same); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0755 {
+		t.Errorf("a file stripped onto itself has mode %v; want 0755", fi.Mode().Perm())
+	}
+	if leftover, _ := filepath.Glob(filepath.Join(dir, ".sd*")); len(leftover) != 0 {
+		t.Errorf("stripping left %v behind", leftover)
+	}
+}
+
+func TestSplitStripInput(t *testing.T) {
+	dir := t.TempDir()
+	exe, dwarf := filepath.Join(dir, "exe"), filepath.Join(dir, "exe.dwarf")
+	orig := testExecutableBytes(t)
+	if err := ioutil.WriteFile(exe, orig, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := splitFile(exe, dwarf, false, &splitOptions{strip: true}, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	d, err := macho.Open(dwarf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if d.Section("__debug_info") == nil {
+		t.Errorf("the dSYM lacks __debug_info")
+	}
+	f, err := macho.Open(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Segment("__DWARF") != nil || f.Section("__debug_info") != nil || f.Ncmd != testExecutable(t).Ncmd-1 {
+		t.Errorf("the stripped input still has its DWARF, or has %d loads", f.Ncmd)
+	}
+	if uuidOf(f) != uuidOf(d) {
+		t.Errorf("the stripped input's UUID is %s, the dSYM's %s", uuidOf(f), uuidOf(d))
+	}
+	if got := readFile(t, exe+backupSuffix); !bytes.Equal(got, orig) {
+		t.Errorf("stripping did not keep the input as it was in %s", exe+backupSuffix)
+	}
+	// The stripped input has no DWARF to split out, so is left as it is.
+	stripped := readFile(t, exe)
+	if err := splitFile(exe, dwarf, false, &splitOptions{strip: true}, "", ""); err == nil {
+		t.Errorf("splitting and stripping the stripped input succeeded")
+	}
+	if !bytes.Equal(readFile(t, exe), stripped) {
+		t.Errorf("a failed split changed the input")
+	}
+
+	// -strip-backup=false keeps none.
+	os.Remove(exe + backupSuffix)
+	if err := ioutil.WriteFile(exe, orig, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := splitFile(exe, dwarf, false, &splitOptions{strip: true, stripNoBackup: true}, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(exe + backupSuffix); err == nil {
+		t.Errorf("stripping with no backup kept one, %s", fi.Name())
+	}
+
+	// A signed input is refused, and left alone, without -strip-signed.
+	// The LC_SOURCE_VERSION becomes an (empty) LC_CODE_SIGNATURE.
+	signed := append([]byte(nil), orig...)
+	i := bytes.Index(signed, []byte{0x2a, 0, 0, 0, 16, 0, 0, 0, 1, 2, 3, 4, 0, 0, 0, 0})
+	if i < 0 {
+		t.Fatal("no LC_SOURCE_VERSION in the test executable")
+	}
+	copy(signed[i:], []byte{byte(macho.LcCodeSignature), 0, 0, 0, 16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	if err := ioutil.WriteFile(exe, signed, 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = splitFile(exe, dwarf, false, &splitOptions{strip: true}, "", "")
+	if err == nil || !strings.Contains(err.Error(), "-strip-signed") {
+		t.Errorf("stripping a signed input: err = %v, want a refusal naming -strip-signed", err)
+	}
+	if !bytes.Equal(readFile(t, exe), signed) {
+		t.Errorf("a refused strip changed the input")
+	}
+	if err := stripInput(exe, false, true); err != nil {
+		t.Errorf("stripping a signed input with -strip-signed: %v", err)
+	}
+}
+
+func TestCheckStripEdit(t *testing.T) {
+	dir := t.TempDir()
+	exe, stripped, other := filepath.Join(dir, "exe"), filepath.Join(dir, "stripped"), filepath.Join(dir, "other")
+	orig := testExecutableBytes(t)
+	f := testExecutable(t)
+	b, _, err := f.StripDWARF(append([]byte(nil), orig...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same, but with __DATA moved.
+	moved := append([]byte(nil), b...)
+	i := bytes.Index(moved, []byte("__DATA\x00"))
+	binary.LittleEndian.PutUint64(moved[i+16:], 0x100008000)
+	for name, b := range map[string][]byte{exe: orig, stripped: b, other: moved} {
+		if err := ioutil.WriteFile(name, b, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		orig, edited string
+		ok           bool
+	}{
+		{exe, stripped, true},
+		{"", stripped, true},
+		{exe, exe, false},   // the DWARF is still there
+		{exe, other, false}, // __DATA moved
+		{stripped, filepath.Join(dir, "missing"), false},
+	} {
+		if err := checkStripEdit(tt.orig, tt.edited); (err == nil) != tt.ok {
+			t.Errorf("checkStripEdit(%s, %s) = %v, want ok %v", filepath.Base(tt.orig), filepath.Base(tt.edited), err, tt.ok)
+		}
+	}
+}
+
+func TestMetricsGolden(t *testing.T) {
+	want, err := ioutil.ReadFile("testdata/metrics.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMetrics()
+	// Recorded out of order, they are written sorted.
+	for _, r := range []struct {
+		handler string
+		code    int
+	}{{"split", 413}, {"buildid", 404}, {"split", 200}, {"buildid", 200}, {"metrics", 200}, {"buildid", 200}} {
+		m.request(r.handler, r.code)
+	}
+	m.lookup("debuginfo", true)
+	m.lookup("debuginfo", false)
+	m.lookup("debuginfo", true)
+	m.lookup("chunks", true)
+	m.lookup("split", false)
+	// Two at a bucket's bound, which is inclusive, one between, and one past them all.
+	for _, d := range []time.Duration{250 * time.Millisecond, 500 * time.Millisecond, 2 * time.Second, 100 * time.Second} {
+		m.split(d)
+	}
+	var b bytes.Buffer
+	m.write(&b, 3, 12345)
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("metrics differ from golden file:\n%s", b.Bytes())
+	}
+}
+
+func TestGuard(t *testing.T) {
+	request := func(token string) *http.Request {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return r
+	}
+	tokens := map[string]string{"secret": "ci"}
+	for _, c := range []struct {
+		name, token string
+		ok          bool
+		code        int
+	}{
+		{"missing", "", false, http.StatusUnauthorized},
+		{"wrong", "guess", false, http.StatusUnauthorized},
+		{"correct", "secret", true, http.StatusOK},
+	} {
+		s := &server{tokens: tokens, limiter: newRateLimiter(1, 10)}
+		w := httptest.NewRecorder()
+		if ok := s.guard(w, request(c.token)); ok != c.ok || w.Code != c.code {
+			t.Errorf("%s token: guard = %v, status %d; want %v, %d", c.name, ok, w.Code, c.ok, c.code)
+		}
+		if !c.ok && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s token: no WWW-Authenticate header", c.name)
+		}
+	}
+
+	// A burst is limited, and so are guesses at the token, which are
+	// charged to the remote host.
+	for _, c := range []struct {
+		name, token string
+		code        int
+	}{
+		{"correct", "secret", http.StatusOK},
+		{"wrong", "guess", http.StatusUnauthorized},
+	} {
+		s := &server{tokens: tokens, limiter: newRateLimiter(0.001, 3)}
+		for i := 0; i < 5; i++ {
+			w := httptest.NewRecorder()
+			s.guard(w, request(c.token))
+			want := c.code
+			if i >= 3 {
+				want = http.StatusTooManyRequests
+			}
+			if w.Code != want {
+				t.Errorf("%s token, request %d: status %d, want %d", c.name, i, w.Code, want)
+			}
+			if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Errorf("%s token, request %d: no Retry-After header", c.name, i)
+			}
+		}
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := newRateLimiter(1.0/60, 2) // a request a minute
+	now := time.Unix(1e9, 0)
+	for _, client := range []string{"a", "b", "c"} {
+		l.allow(client, now)
+	}
+	l.allow("a", now.Add(30*time.Second))
+	l.allow("b", now.Add(pruneInterval+time.Second))
+	// Then c, idle since, has refilled and is dropped; a was charged
+	// too lately to have refilled, and b is charged just now.
+	if len(l.buckets) != 2 || l.buckets["c"] != nil {
+		t.Errorf("after pruning, %d buckets remain: %v", len(l.buckets), l.buckets)
+	}
+	if ok, _ := l.allow("c", now.Add(pruneInterval+time.Second)); !ok {
+		t.Errorf("a pruned client is refused")
+	}
+}
+
+func TestServeSplitFetch(t *testing.T) {
+	exe := testExecutableBytes(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/builds/hello":
+			w.Write(exe)
+		case "/builds/short":
+			// Promise more than is sent, so the read fails part way.
+			w.Header().Set("Content-Length", strconv.Itoa(len(exe)))
+			w.Write(exe[:len(exe)/2])
+		case "/builds/away":
+			http.Redirect(w, r, "/secret/hello", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+
+	store, err := ioutil.TempDir("", "sd-serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(store)
+	s, err := newServer(store, int64(len(exe)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(query string) (int, string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/split?"+query, nil))
+		return w.Code, w.Body.String()
+	}
+	fetch := func(p string) string { return "url=" + url.QueryEscape(origin.URL+p) }
+
+	if code, body := post(fetch("/builds/hello")); code != http.StatusForbidden {
+		t.Errorf("url= with no -fetch-from: %d %s", code, body)
+	}
+
+	from, err := parseFetchFrom(origin.URL + "/builds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.fetchFrom = []*url.URL{from}
+	s.fetch.Timeout = 10 * time.Second
+	for _, tc := range []struct {
+		query string
+		code  int
+	}{
+		{fetch("/builds/hello"), http.StatusOK},
+		{fetch("/buildsmore/hello"), http.StatusForbidden},
+		{fetch("/builds/../secret/hello"), http.StatusForbidden},
+		{fetch("/builds/%2e%2e/secret/hello"), http.StatusForbidden},
+		{"url=" + url.QueryEscape("file:///etc/passwd"), http.StatusForbidden},
+		{"url=" + url.QueryEscape(strings.Replace(origin.URL, "127.0.0.1", "localhost", 1)+"/builds/hello"), http.StatusForbidden},
+		{fetch("/builds/away"), http.StatusBadGateway},
+		{fetch("/builds/missing"), http.StatusBadGateway},
+		{fetch("/builds/short"), http.StatusBadGateway},
+	} {
+		if code, body := post(tc.query); code != tc.code {
+			t.Errorf("%s: %d %s, want %d", tc.query, code, body, tc.code)
+		}
+	}
+
+	// Only a body past the limit is too large.
+	s.maxUpload = int64(len(exe)) - 1
+	if code, body := post(fetch("/builds/hello")); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversize fetch: %d %s", code, body)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/split?name=hello", bytes.NewReader(exe)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversize upload: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want time.Duration // -1 for an error
+	}{
+		{"90d", 90 * 24 * time.Hour},
+		{"0d", 0},
+		{"36h", 36 * time.Hour},
+		{"1h30m", 90 * time.Minute},
+		{"", -1},
+		{"d", -1},
+		{"1.5d", -1},
+		{"ninety", -1},
+		{"-1d", -1},
+		{"-2h", -1},
+		{"999999999999d", -1},
+	} {
+		got, err := parseAge(tc.s)
+		if tc.want < 0 && err == nil || tc.want >= 0 && (err != nil || got != tc.want) {
+			t.Errorf("parseAge(%q) = %v, %v; want %v", tc.s, got, err, tc.want)
+		}
+	}
+}
+
+func TestStoreGC(t *testing.T) {
+	root, err := ioutil.TempDir("", "sd-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	store, outside := filepath.Join(root, "store"), filepath.Join(root, "outside")
+	uuid := func(n byte) []byte { return bytes.Repeat([]byte{n}, 16) }
+	universal := func(a, b []byte) []byte {
+		b = append([]byte{}, b...)
+		binary.LittleEndian.PutUint32(b[4:], uint32(macho.CpuArm64))
+		binary.LittleEndian.PutUint32(b[8:], 0)
+		arches := []macho.FatArchHeader{
+			{Cpu: macho.CpuAmd64, SubCpu: 3, Offset: 0x1000, Size: uint32(len(a)), Align: 12},
+			{Cpu: macho.CpuArm64, SubCpu: 0, Offset: 0x10000, Size: uint32(len(b)), Align: 14},
+		}
+		fat := make([]byte, 0x10000+len(b))
+		macho.PutFatHeader(fat, arches)
+		copy(fat[0x1000:], a)
+		copy(fat[0x10000:], b)
+		return fat
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	write := func(name string, b []byte, modTime time.Time) string {
+		t.Helper()
+		name = filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	dwarf := func(n byte) []byte { return testDwarfBytes(uuid(n), "__debug_info", "x") }
+	write("store/old.dSYM/Contents/Resources/DWARF/old", dwarf(1), old)
+	write("store/new.dwarf", dwarf(2), time.Now())
+	write("store/pinned.dwarf", dwarf(3), old)
+	write("store/fat.dSYM/Contents/Resources/DWARF/fat", universal(dwarf(4), dwarf(5)), old)
+	write("store/fatold.dwarf", universal(dwarf(6), dwarf(7)), old)
+	write("store/README", []byte("not Mach-O"), old)
+	victim := write("outside/victim.dwarf", dwarf(8), old)
+	if err := os.Symlink(victim, filepath.Join(store, "link.dwarf")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(store, "linkdir")); err != nil {
+		t.Fatal(err)
+	}
+	exists := func() []string {
+		t.Helper()
+		var names []string
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				rel, _ := filepath.Rel(root, path)
+				names = append(names, rel)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return names
+	}
+	gc := func(cutoff time.Time, kept map[string]bool, dryRun bool) (*gcStats, []string) {
+		t.Helper()
+		var printed []string
+		st, err := gcStore(store, cutoff, kept, dryRun, func(path string) { printed = append(printed, path) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st, printed
+	}
+	rel := func(paths []string) string {
+		for i, p := range paths {
+			paths[i], _ = filepath.Rel(store, p)
+		}
+		return strings.Join(paths, " ")
+	}
+
+	// Each slice of a universal dSYM counts, so fat.dSYM is kept for
+	// its second UUID; links and what is not Mach-O are not entries.
+	cutoff := time.Now().Add(-time.Hour)
+	kept := map[string]bool{formatUUID(uuid(3)): true, formatUUID(uuid(5)): true}
+	const want = "fatold.dwarf old.dSYM"
+	before := exists()
+	st, printed := gc(cutoff, kept, true)
+	if st.entries != 5 || rel(st.removed) != want || rel(printed) != want {
+		t.Errorf("dry run: %d entries, removing %v, printed %v; want 5 entries, removing %s", st.entries, st.removed, printed, want)
+	}
+	if after := exists(); !reflect.DeepEqual(after, before) {
+		t.Errorf("dry run changed the store from %v to %v", before, after)
+	}
+
+	st, _ = gc(cutoff, kept, false)
+	if rel(st.removed) != want {
+		t.Errorf("removed %v, want %s", st.removed, want)
+	}
+	for _, name := range []string{"old.dSYM", "fatold.dwarf"} {
+		if _, err := os.Lstat(filepath.Join(store, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", name, err)
+		}
+	}
+
+	// With no age kept, all but the listed UUIDs go, but never what
+	// the store only links to.
+	st, _ = gc(time.Time{}, map[string]bool{formatUUID(uuid(3)): true}, false)
+	if want := "fat.dSYM new.dwarf"; rel(st.removed) != want {
+		t.Errorf("removed %v, want %s", st.removed, want)
+	}
+	if want := []string{"outside/victim.dwarf", "store/README", "store/link.dwarf", "store/linkdir", "store/pinned.dwarf"}; !reflect.DeepEqual(exists(), want) {
+		t.Errorf("left %v, want %v", exists(), want)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "exe")
+	if err := ioutil.WriteFile(exe, testExecutableBytes(t), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(d string) { dedupDir = d }(dedupDir)
+	dedupDir = filepath.Join(dir, "pool")
+	one, two := filepath.Join(dir, "one.dwarf"), filepath.Join(dir, "two.dwarf")
+	if err := splitFile(exe, one, false, &splitOptions{}, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(one, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := splitFile(exe, two, false, &splitOptions{}, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	fi1, err := os.Stat(one)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi2, err := os.Stat(two)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Fatalf("identical dSYMs %s and %s are not shared", one, two)
+	}
+	// Both were just written, as far as a store gc can tell.
+	if !fi1.ModTime().After(old) {
+		t.Errorf("shared dSYM kept modification time %v", fi1.ModTime())
+	}
+	want := readFile(t, two)
+
+	// Writing one anew leaves two, and the pool, as they were.
+	if err := removeOutput(one); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(one, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := dedupFile(dedupDir, one); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, two); !bytes.Equal(got, want) {
+		t.Errorf("rewriting %s changed %s", one, two)
+	}
+	if got := readFile(t, one); string(got) != "other" {
+		t.Errorf("%s holds %q after dedup, want \"other\"", one, got)
+	}
+	pooled, _ := filepath.Glob(filepath.Join(dedupDir, "*", "*.dwarf"))
+	if len(pooled) != 2 {
+		t.Errorf("pool holds %v, want 2 files", pooled)
+	}
+}
@@ -0,0 +1,426 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A server answers debuginfod-style lookups from a symbol store and
+// splits uploaded executables into it.
+//
+//	GET  /buildid/UUID/debuginfo      the DWARF file for UUID, self-contained
+//	GET  /buildid/UUID/chunks         the chunk index for UUID, if it is chunked
+//	GET  /chunks/SHA256               a chunk any index lists
+//	POST /split?name=NAME             body is a Mach-O executable
+//	POST /split?url=URL[&name=NAME]   the server fetches the executable, if -fetch-from allows
+//	GET  /metrics                     counters in Prometheus format
+//
+// A split stores NAME.dSYM under a directory named for the UUID and
+// replies with the manifest describing it.
+//
+// If the server has tokens, every request must carry one as a bearer
+// token; if it has a limiter, each client (token, or else remote host)
+// is held to its rate.  It fetches an executable by URL only from under
+// one of fetchFrom, lest a client use it to reach what the server can
+// and the client should not.
+type server struct {
+	dir       string
+	maxUpload int64
+	fetchFrom []*url.URL        // the URLs under which url= may fetch
+	fetch     *http.Client      // for url=, with a timeout
+	tokens    map[string]string // bearer token -> client name
+	limiter   *rateLimiter
+	hash      hashAlgorithm // of the manifests of splits
+
+	metrics *metrics
+
+	mu        sync.Mutex
+	index     map[string]string // canonical UUID -> DWARF file, or chunk index
+	chunkDirs []string          // where the chunks of the indexes are
+}
+
+// storeServe implements "sd store serve".
+func storeServe(args []string) {
+	fs := flag.NewFlagSet("store serve", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "listen on `address`")
+	maxUpload := fs.Int64("max-upload", 1<<30, "largest executable accepted for splitting, in `bytes`")
+	tokens := fs.String("tokens", "", "require a bearer token listed, one per line with an optional client name, in `file`")
+	rate := fs.Float64("rate", 0, "limit each client to `n` requests per second (0 means no limit)")
+	burst := fs.Int("burst", 10, "allow bursts of up to `n` requests above -rate")
+	var fetchFrom []*url.URL
+	fs.Func("fetch-from", "let /split?url= fetch executables from under `URL` (repeatable), such as https://ci.example.com/artifacts/;\n"+
+		"without it, the server fetches nothing", func(s string) error {
+		u, err := parseFetchFrom(s)
+		fetchFrom = append(fetchFrom, u)
+		return err
+	})
+	fetchTimeout := fs.Duration("fetch-timeout", 2*time.Minute, "give up fetching an executable for /split?url= after `duration`")
+	var hash hashAlgorithm
+	hashFlag(fs, &hash, "the input and dSYM of each split, in its manifest,")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail("Usage: %s store serve [ flags ] storedir", os.Args[0])
+	}
+	s, err := newServer(fs.Arg(0), *maxUpload)
+	if err != nil {
+		fail("Could not scan store %s, error=%v", fs.Arg(0), err)
+	}
+	s.hash = hash
+	s.fetchFrom = fetchFrom
+	s.fetch.Timeout = *fetchTimeout
+	if *tokens != "" {
+		s.tokens, err = readTokens(*tokens)
+		if err != nil {
+			fail("Could not read tokens, error=%v", err)
+		}
+	}
+	if *rate > 0 {
+		s.limiter = newRateLimiter(*rate, *burst)
+	}
+	note("serving %d entries from %s on %s", len(s.index), s.dir, *addr)
+	fail("%v", http.ListenAndServe(*addr, s))
+}
+
+func newServer(dir string, maxUpload int64) (*server, error) {
+	entries, err := scanStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &server{dir: dir, maxUpload: maxUpload, metrics: newMetrics(), index: make(map[string]string)}
+	s.fetch = &http.Client{Timeout: 2 * time.Minute, CheckRedirect: func(r *http.Request, via []*http.Request) error {
+		if !s.mayFetch(r.URL) {
+			return fmt.Errorf("redirected to %s, which -fetch-from does not allow", r.URL)
+		}
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		return nil
+	}}
+	dirs := make(map[string]bool)
+	for _, e := range entries {
+		for i, u := range e.uuids {
+			if u != "" {
+				s.index[u] = e.files[i]
+			}
+			if !e.chunked {
+				continue
+			}
+			if ix, err := readChunkIndex(e.files[i]); err == nil {
+				if d := ix.chunkDir(e.files[i]); !dirs[d] {
+					dirs[d] = true
+					s.chunkDirs = append(s.chunkDirs, d)
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+	var handler string
+	switch {
+	case !s.guard(rec, r):
+		handler = "denied"
+	case strings.HasPrefix(r.URL.Path, "/buildid/"):
+		handler = "debuginfo"
+		s.serveDebuginfo(rec, r)
+	case strings.HasPrefix(r.URL.Path, "/chunks/"):
+		handler = "chunk"
+		s.serveChunk(rec, r)
+	case r.URL.Path == "/split":
+		handler = "split"
+		s.serveSplit(rec, r)
+	case r.URL.Path == "/metrics":
+		handler = "metrics"
+		s.serveMetrics(rec, r)
+	default:
+		handler = "other"
+		http.NotFound(rec, r)
+	}
+	s.metrics.request(handler, rec.code)
+}
+
+func (s *server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	files := make([]string, 0, len(s.index))
+	for _, f := range s.index {
+		files = append(files, f)
+	}
+	s.mu.Unlock()
+	var size int64
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			size += fi.Size()
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.write(w, len(files), size)
+}
+
+func (s *server) lookup(uuid string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index[uuid]
+}
+
+func (s *server) serveDebuginfo(w http.ResponseWriter, r *http.Request) {
+	elems := strings.Split(strings.TrimPrefix(r.URL.Path, "/buildid/"), "/")
+	if len(elems) != 2 || elems[1] != "debuginfo" && elems[1] != "chunks" {
+		http.NotFound(w, r)
+		return
+	}
+	u, ok := canonicalUUID(elems[0])
+	if !ok {
+		http.Error(w, "malformed build id", http.StatusBadRequest)
+		return
+	}
+	file := s.lookup(u)
+	ix, err := readChunkIndex(file)
+	if elems[1] == "chunks" {
+		// Only a chunked dSYM has an index; a client asking for
+		// one falls back to debuginfo.
+		s.metrics.lookup("chunks", err == nil)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		ix.ChunkDir = ""
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		enc.Encode(ix)
+		return
+	}
+	s.metrics.lookup("debuginfo", file != "")
+	if file == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if ix != nil {
+		dir := ix.chunkDir(file)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(ix.Size, 10))
+		if r.Method == http.MethodHead {
+			return
+		}
+		// Once the first chunk is sent, there is no reporting an
+		// error but by cutting the reply short.
+		ix.writeTo(w, func(c Chunk) ([]byte, error) { return readChunk(dir, c) })
+		return
+	}
+	// A dSYM whose strings are in part in a shared-strings file is
+	// served self-contained, as no client could follow it there.
+	b, err := unsharedBytes(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if b != nil {
+		var modTime time.Time
+		if fi, err := os.Stat(file); err == nil {
+			modTime = fi.ModTime()
+		}
+		http.ServeContent(w, r, filepath.Base(file), modTime, bytes.NewReader(b))
+		return
+	}
+	http.ServeFile(w, r, file)
+}
+
+func (s *server) serveChunk(w http.ResponseWriter, r *http.Request) {
+	sum := strings.TrimPrefix(r.URL.Path, "/chunks/")
+	if !isChunkSum(sum) {
+		http.Error(w, "malformed chunk", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	dirs := s.chunkDirs
+	s.mu.Unlock()
+	for _, d := range dirs {
+		file := chunkPath(d, sum)
+		if _, err := os.Stat(file); err == nil {
+			// A chunk never changes; it may be cached for good.
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			http.ServeFile(w, r, file)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (s *server) serveSplit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	body, readFailed := r.Body, http.StatusBadRequest
+	if from := r.URL.Query().Get("url"); from != "" {
+		u, err := url.Parse(from)
+		if err != nil || !s.mayFetch(u) {
+			http.Error(w, from+": the server does not fetch from there; see -fetch-from", http.StatusForbidden)
+			return
+		}
+		resp, err := s.fetch.Get(u.String())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			http.Error(w, from+": "+resp.Status, http.StatusBadGateway)
+			return
+		}
+		body, readFailed = resp.Body, http.StatusBadGateway
+		if name == "" {
+			name = path.Base(resp.Request.URL.Path)
+		}
+	}
+	if name == "" {
+		name = "a.out"
+	}
+	// Stores are often copied between hosts, so use names any host can hold.
+	name = safeFileName(name, true)
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, s.maxUpload+1))
+	if err != nil {
+		http.Error(w, err.Error(), readFailed)
+		return
+	}
+	if int64(len(data)) > s.maxUpload {
+		http.Error(w, fmt.Sprintf("executable larger than %d bytes", s.maxUpload), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	m, err := s.split(name, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(m)
+}
+
+// parseFetchFrom parses the -fetch-from URL s, which must be absolute,
+// http or https, and have no query or fragment.
+func parseFetchFrom(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("%s is not an http or https URL with a host and no query", s)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u, nil
+}
+
+// mayFetch reports whether u lies under one of s.fetchFrom: the same
+// scheme and host, and a path beneath its path.  A path that could
+// climb out of it, by a dot segment, does not.
+func (s *server) mayFetch(u *url.URL) bool {
+	clean := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") && clean != "/" {
+		clean += "/"
+	}
+	if u.User != nil || clean != u.Path {
+		return false
+	}
+	for _, f := range s.fetchFrom {
+		if u.Scheme == f.Scheme && strings.EqualFold(u.Host, f.Host) && strings.HasPrefix(u.Path, f.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// split splits the executable data, named name, into the store,
+// and returns the manifest for the result.  If the store already
+// holds symbols for the executable's UUID, those are reused.
+func (s *server) split(name string, data []byte) (*Manifest, error) {
+	exem, err := macho.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	u := uuidOf(exem)
+	if u == "" {
+		return nil, fmt.Errorf("%s has no UUID", name)
+	}
+	dir := filepath.Join(s.dir, u)
+	if s.lookup(u) != "" {
+		if m, err := readManifest(filepath.Join(dir, "manifest.json")); err == nil {
+			s.metrics.lookup("split", true)
+			return m, nil
+		}
+	}
+	s.metrics.lookup("split", false)
+
+	start := time.Now()
+	dsym, err := splitDwarf(exem, &splitOptions{})
+	if err != nil {
+		return nil, err
+	}
+	s.metrics.split(time.Since(start))
+	bundle, out := dsymPath(filepath.Join(dir, name))
+	dwarfDir := filepath.Dir(out)
+	if err := os.MkdirAll(dwarfDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := writeInfoPlist(bundle, name); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(dwarfDir, ".split")
+	if err != nil {
+		return nil, err
+	}
+	_, err = dsym.WriteTo(tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), out)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	in := digestBytes(name, data, s.hash)
+	in.setContentChecksum(s.hash, contentDigest(exem, s.hash))
+	m, err := newManifest(dir, in, []string{out}, s.hash)
+	if err != nil {
+		return nil, err
+	}
+	m.Toolchain = detectToolchain(exem, bytes.NewReader(data))
+	if err := m.write(filepath.Join(dir, "manifest.json")); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.index[u] = out
+	s.mu.Unlock()
+	return m, nil
+}
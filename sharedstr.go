@@ -0,0 +1,779 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A store of nightly builds holds many dSYMs whose __debug_str are
+// nearly the same.  "sd store share-strings" moves the strings that
+// several of them use into one supplementary file in the store, as dwz
+// does with its alt files, and makes each dSYM refer to those strings
+// there with DW_FORM_strp_sup, naming the file in a __debug_sup
+// section.  This is an experiment: a dSYM so changed is no longer
+// self-contained, and no debugger reads it as it is.  "sd store
+// unshare" copies the strings back in, and "sd store serve" does so
+// for each such dSYM it serves.
+
+// sharedStringsPrefix begins the name of a store's shared-strings file,
+// which goes on with the start of its checksum, so that a new one never
+// replaces an old one that dSYMs still refer to.
+const sharedStringsPrefix = "shared-strings-"
+
+// shareStats is what sharing a store's strings did.
+type shareStats struct {
+	file          string // the shared-strings file
+	strings       int    // in it
+	files         int    // dSYMs that now refer into it
+	refs, shared  int    // DW_FORM_strp references, and those now into file
+	before, after uint64 // the dSYMs' __debug_str, in bytes
+	accelerators  int    // dSYMs whose accelerator tables were dropped
+	removed       int    // old shared-strings files no longer needed
+	skipped       []string
+}
+
+// storeShareStrings implements "sd store share-strings".
+func storeShareStrings(args []string) {
+	fs := flag.NewFlagSet("store share-strings", flag.ExitOnError)
+	minFiles := fs.Int("min-files", 2, "share the strings used by at least `n` dSYMs")
+	dryRun := fs.Bool("n", false, "report what would be shared without changing the store")
+	keepBackup := fs.Bool("backup", false, "keep each dSYM changed as it was, in FILE.bak")
+	lockWait := fs.Duration("lock-wait", 0, "if another sd is changing the store, wait up to `duration` for it rather than failing as busy")
+	var hash hashAlgorithm
+	hashFlag(fs, &hash, "the shared strings, for the checksum that names their file and that the dSYMs record,")
+	fs.Parse(args)
+	if fs.NArg() != 1 || *minFiles < 1 {
+		fail("Usage: %s store share-strings [ -min-files n ] [ -n ] [ -backup ] [ -hash algorithm ] [ -lock-wait duration ] storedir", os.Args[0])
+	}
+	var l *fileLock
+	if !*dryRun {
+		var err error
+		if l, err = lockStore(fs.Arg(0), *lockWait); err != nil {
+			fail("%v", err)
+		}
+	}
+	st, err := shareStrings(fs.Arg(0), *minFiles, *dryRun, *keepBackup, hash)
+	l.unlock()
+	if err != nil {
+		fail("Could not share strings in store %s, error=%v", fs.Arg(0), err)
+	}
+	for _, s := range st.skipped {
+		note("skipped %s", s)
+	}
+	if st.file == "" {
+		note("no string is used by %d dSYMs; nothing shared", *minFiles)
+		return
+	}
+	note("%s: %d strings; %d of %d string references in %d dSYMs now refer to it", st.file, st.strings, st.shared, st.refs, st.files)
+	note("__debug_str of those dSYMs went from %d to %d bytes", st.before, st.after)
+	if st.accelerators > 0 {
+		note("accelerator tables, which index __debug_str, were dropped from %d dSYMs", st.accelerators)
+	}
+	if st.removed > 0 {
+		note("removed %d shared-strings files no longer needed", st.removed)
+	}
+}
+
+// storeUnshare implements "sd store unshare".
+func storeUnshare(args []string) {
+	fs := flag.NewFlagSet("store unshare", flag.ExitOnError)
+	keepBackup := fs.Bool("backup", true, "keep each file as it was, in FILE.bak")
+	lockWait := fs.Duration("lock-wait", 0, "if another sd is writing a file, wait up to `duration` for it rather than failing as busy")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fail("Usage: %s store unshare [ -backup=false ] [ -lock-wait duration ] file ...", os.Args[0])
+	}
+	files, err := expandBundles(fs.Args())
+	if err != nil {
+		fail("%v", err)
+	}
+	bad := false
+	for _, path := range files {
+		l, err := lockDsym(path, *lockWait)
+		if err != nil {
+			note("%v", err)
+			bad = true
+			continue
+		}
+		sf, err := openSharing(path)
+		if err == nil && sf.sup == nil {
+			note("%s does not share strings", path)
+			sf.close()
+			l.unlock()
+			continue
+		}
+		if err == nil {
+			var d *dsym
+			if d, err = sf.share(nil, "", nil, &shareStats{}); err == nil {
+				err = replaceFile(path, d, *keepBackup)
+			}
+			sf.close()
+		}
+		l.unlock()
+		if err != nil {
+			note("%s: %v", path, err)
+			bad = true
+		}
+	}
+	if bad {
+		os.Exit(1)
+	}
+}
+
+// shareStrings moves the strings that at least minFiles of the dSYMs in
+// the store dir refer to into a new shared-strings file there, and
+// makes those dSYMs refer to them there.  dSYMs that already do are
+// first made self-contained, so that each run shares the store as it
+// now is; shared-strings files that no dSYM then refers to are removed.
+// If dryRun is set, nothing is written or removed; if keepBackup is
+// set, each dSYM changed is kept as it was, in FILE.bak.  The checksum
+// of the shared strings is by hash.
+func shareStrings(dir string, minFiles int, dryRun, keepBackup bool, hash hashAlgorithm) (*shareStats, error) {
+	entries, err := scanStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	st := &shareStats{}
+	var hdr *macho.FileHeader
+	var order binary.ByteOrder
+	var paths []string
+	uses := make(map[string]int)
+	for _, e := range entries {
+		for i, path := range e.files {
+			if e.uuids[i] == "" {
+				continue
+			}
+			sf, err := openSharing(path)
+			if err == nil && order != nil && sf.f.ByteOrder != order {
+				err = fmt.Errorf("byte order differs from the other dSYMs'")
+			}
+			if err == nil {
+				var strs map[string]bool
+				if strs, err = sf.strings(); err == nil {
+					for s := range strs {
+						uses[s]++
+					}
+				}
+			}
+			if err != nil {
+				st.skipped = append(st.skipped, fmt.Sprintf("%s: %v", path, err))
+			} else {
+				paths = append(paths, path)
+				if hdr == nil {
+					h := sf.f.FileHeader
+					hdr, order = &h, sf.f.ByteOrder
+				}
+			}
+			if sf != nil {
+				sf.close()
+			}
+		}
+	}
+
+	var strs []string
+	for s, n := range uses {
+		if n >= minFiles {
+			strs = append(strs, s)
+		}
+	}
+	if len(strs) == 0 {
+		return st, nil
+	}
+	sort.Strings(strs)
+	offsets := make(map[string]uint64)
+	var str []byte
+	for _, s := range strs {
+		offsets[s] = uint64(len(str))
+		str = append(append(str, s...), 0)
+	}
+	id := hash.sum(str)
+	st.file = filepath.Join(dir, sharedStringsPrefix+hex.EncodeToString(id[:8])+".dwarf")
+	st.strings = len(strs)
+	if !dryRun {
+		d, err := sharedStringsDsym(*hdr, order, str, id)
+		if err == nil {
+			err = replaceFile(st.file, d, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range paths {
+		sf, err := openSharing(path)
+		if err == nil {
+			var name string
+			var d *dsym
+			if name, err = filepath.Rel(filepath.Dir(path), st.file); err == nil {
+				d, err = sf.share(offsets, name, id, st)
+			}
+			if err == nil && !dryRun {
+				err = replaceFile(path, d, keepBackup)
+			}
+			sf.close()
+		}
+		if err != nil {
+			st.skipped = append(st.skipped, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		st.files++
+	}
+	if dryRun {
+		return st, nil
+	}
+
+	// Shared-strings files that no dSYM refers to any longer go.
+	used := make(map[string]bool)
+	for _, e := range entries {
+		for _, path := range e.files {
+			if name := supplementaryName(path); name != "" {
+				used[name] = true
+			}
+		}
+	}
+	old, err := filepath.Glob(filepath.Join(dir, sharedStringsPrefix+"*.dwarf"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range old {
+		if path = filepath.Clean(path); path == filepath.Clean(st.file) || used[path] {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		st.removed++
+	}
+	return st, nil
+}
+
+// supplementaryName returns the clean path of the file named by the
+// __debug_sup section of the dSYM path, or "" if it names none.
+func supplementaryName(path string) string {
+	f, err := macho.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	s := f.Section(supSection)
+	if s == nil {
+		return ""
+	}
+	b, err := s.UncompressedData()
+	if err != nil {
+		return ""
+	}
+	isSup, name, _, err := parseSupSection(b, f.ByteOrder)
+	if err != nil || isSup || name == "" {
+		return ""
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(filepath.Dir(path), name)
+	}
+	return filepath.Clean(name)
+}
+
+// isSupplementaryFile reports whether f is a supplementary file, into
+// which other files' DWARF refers.
+func isSupplementaryFile(f *macho.File) bool {
+	s := f.Section(supSection)
+	if s == nil {
+		return false
+	}
+	b, err := s.UncompressedData()
+	if err != nil {
+		return false
+	}
+	isSup, _, _, err := parseSupSection(b, f.ByteOrder)
+	return err == nil && isSup
+}
+
+// A sharingFile is a dSYM of a store, read to share its strings.  If
+// it already refers into a supplementary file, that file is inlined in
+// edits, and sup describes it.
+type sharingFile struct {
+	file     *os.File
+	f        *macho.File
+	sections map[string]*macho.Section
+	edits    map[*macho.Section]sectionEdit
+	sup      *Supplementary
+
+	info, abbrevs, str []byte // as edited
+	units              []unitHeader
+	strSize            uint64 // of __debug_str as the dSYM holds it
+}
+
+// openSharing opens the dSYM path to share its strings.  It fails for
+// a dSYM whose __debug_str is referred to other than from __debug_info
+// and the accelerator tables, since only those references are moved.
+func openSharing(path string) (sf *sharingFile, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sf = &sharingFile{file: file, edits: make(map[*macho.Section]sectionEdit)}
+	defer func() {
+		if err != nil {
+			sf.close()
+			sf = nil
+		}
+	}()
+	if sf.f, err = macho.NewFile(file); err != nil {
+		return sf, err
+	}
+	f := sf.f
+	if f.Type != macho.MhDsym {
+		return sf, fmt.Errorf("not a dSYM")
+	}
+	if isSupplementaryFile(f) {
+		return sf, fmt.Errorf("is a supplementary file")
+	}
+	var dups []duplicateSection
+	if sf.sections, dups = dedupDWARFSections(f); len(dups) > 0 {
+		return sf, fmt.Errorf("has duplicate DWARF sections")
+	}
+	if sf.sections["debug_info"] == nil || sf.sections["debug_str"] == nil {
+		return sf, fmt.Errorf("has no __debug_info and __debug_str")
+	}
+	for _, name := range []string{"debug_str_offsets", "debug_macro", "debug_types"} {
+		if sf.sections[name] != nil {
+			return sf, fmt.Errorf("has %s, which refers into __debug_str", macho.DWARFSectionName(name[len("debug_"):], false))
+		}
+	}
+	sf.strSize = sf.sections["debug_str"].Size
+
+	if sf.sup, err = findSupplementary(f, sf.edits); err != nil {
+		return sf, err
+	}
+	if sf.sup != nil {
+		if err = inlineShared(f, path, sf.sup, sf.edits); err != nil {
+			return sf, err
+		}
+	}
+	if sf.info, err = editedData(sf.edits, sf.sections["debug_info"]); err != nil {
+		return sf, err
+	}
+	if sf.abbrevs, err = editedData(sf.edits, sf.sections["debug_abbrev"]); err != nil {
+		return sf, err
+	}
+	if sf.str, err = editedData(sf.edits, sf.sections["debug_str"]); err != nil {
+		return sf, err
+	}
+	if sf.units, err = unitHeaders(sf.info, sf.abbrevs, f.ByteOrder); err != nil {
+		return sf, err
+	}
+	line, err := editedData(sf.edits, sf.sections["debug_line"])
+	if err != nil {
+		return sf, err
+	}
+	for off := uint64(0); off < uint64(len(line)); {
+		hdr, end, err := unitExtent(line, off, f.ByteOrder)
+		if err != nil {
+			return sf, fmt.Errorf("__debug_line: %v", err)
+		}
+		if v := (&dwarfBuf{b: line, off: hdr, o: f.ByteOrder}).uint(2); v >= 5 {
+			return sf, fmt.Errorf("__debug_line: version %d line programs may refer into __debug_str", v)
+		}
+		off = end
+	}
+	return sf, nil
+}
+
+func (sf *sharingFile) close() {
+	if sf.f != nil {
+		sf.f.Close()
+	}
+	sf.file.Close()
+}
+
+// inlineShared adds to edits the changes that copy into f, the dSYM
+// path, the supplementary file sup that it refers into, after checking
+// that the file is the one f names.
+func inlineShared(f *macho.File, path string, sup *Supplementary, edits map[*macho.Section]sectionEdit) error {
+	name, err := supplementaryPath(sup, "", filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	alt, err := macho.Open(name)
+	if err != nil {
+		return fmt.Errorf("supplementary file: %v", err)
+	}
+	defer alt.Close()
+	if s := alt.Section(supSection); s != nil && sup.ID != "" {
+		b, err := s.UncompressedData()
+		if err != nil {
+			return fmt.Errorf("supplementary file: %v", err)
+		}
+		_, _, id, err := parseSupSection(b, alt.ByteOrder)
+		if err != nil {
+			return fmt.Errorf("supplementary file: %v", err)
+		}
+		if hex.EncodeToString(id) != sup.ID {
+			return fmt.Errorf("supplementary file %s has checksum %x, not %s", name, id, sup.ID)
+		}
+	}
+	return inlineSupplementary(f, alt, edits)
+}
+
+// walkStrp calls fn for each DW_FORM_strp attribute of the DIEs of sf:
+// the abbreviation and index of the attribute, its value, and the
+// string it refers to.
+func (sf *sharingFile) walkStrp(fn func(a *abbrev, i int, v attrValue, s string)) error {
+	var bad error
+	for i := range sf.units {
+		err := walkDIEs(sf.info, &sf.units[i], sf.f.ByteOrder, func(off, next uint64, depth int, a *abbrev, attrs []attrValue) {
+			for j, v := range attrs {
+				if v.form != dwFormStrp {
+					continue
+				}
+				s, ok := v.string(sf.str)
+				if !ok {
+					bad = fmt.Errorf("DIE at %#x refers to string %#x, past the end of __debug_str", off, v.val)
+					continue
+				}
+				fn(a, j, v, s)
+			}
+		})
+		if err == nil {
+			err = bad
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// strings returns the strings that sf's DIEs refer to in a way that
+// could refer into a shared-strings file instead.
+func (sf *sharingFile) strings() (map[string]bool, error) {
+	strs := make(map[string]bool)
+	err := sf.walkStrp(func(a *abbrev, i int, v attrValue, s string) {
+		if a.attrs[i].form == dwFormStrp {
+			strs[s] = true
+		}
+	})
+	return strs, err
+}
+
+// An abbrevSlot is an attribute of an abbreviation.
+type abbrevSlot struct {
+	a *abbrev
+	i int
+}
+
+// share returns sf with the strings in shared, which gives their
+// offsets in the shared-strings file name, with checksum id, referred
+// to there, and the others kept in a __debug_str holding only them.
+// With shared nil, every string is kept; for a dSYM that referred into
+// a shared-strings file, that makes it self-contained again.  The
+// accelerator tables, which index __debug_str, are dropped; lldb
+// indexes the DWARF itself without them.  What it does is added to st.
+func (sf *sharingFile) share(shared map[string]uint64, name string, id []byte, st *shareStats) (*dsym, error) {
+	o := sf.f.ByteOrder
+	// A form is changed in an abbreviation, for every DIE that uses
+	// it; so an attribute refers into the shared-strings file only if
+	// the strings of all those DIEs are there.
+	local := make(map[abbrevSlot]bool)
+	err := sf.walkStrp(func(a *abbrev, i int, v attrValue, s string) {
+		if _, ok := shared[s]; !ok || a.attrs[i].form != dwFormStrp {
+			local[abbrevSlot{a, i}] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := append([]byte(nil), sf.info...)
+	abbrevs := append([]byte(nil), sf.abbrevs...)
+	var str []byte
+	kept := make(map[string]uint64)
+	retyped := make(map[abbrevSlot]bool)
+	refs, moved := 0, 0
+	err = sf.walkStrp(func(a *abbrev, i int, v attrValue, s string) {
+		refs++
+		if slot := (abbrevSlot{a, i}); !local[slot] {
+			putOffset(info[v.pos:], v.size, shared[s], o)
+			retyped[slot] = true
+			moved++
+			return
+		}
+		off, ok := kept[s]
+		if !ok {
+			off = uint64(len(str))
+			kept[s] = off
+			str = append(append(str, s...), 0)
+		}
+		putOffset(info[v.pos:], v.size, off, o)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = abbrevForms(abbrevs, sf.units, o, func(a *abbrev, i int, form []byte) {
+		if retyped[abbrevSlot{a, i}] {
+			putULEB(form, dwFormStrpSup)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sf.edits[sf.sections["debug_info"]] = sectionEdit{data: info}
+	sf.edits[sf.sections["debug_abbrev"]] = sectionEdit{data: abbrevs}
+	sf.edits[sf.sections["debug_str"]] = sectionEdit{data: str}
+	for key, s := range sf.sections {
+		if _, ok := sf.edits[s]; !ok && (key == "debug_names" || strings.HasPrefix(key, "apple_")) {
+			st.accelerators++
+			break
+		}
+	}
+	dropAccelerators(sf.sections, sf.edits)
+	var extra []dsymSection
+	if moved > 0 {
+		sup := &macho.Section{SectionHeader: macho.SectionHeader{Name: supSection, Seg: "__DWARF", Flags: macho.SAttrDebug}}
+		extra = append(extra, dsymSection{in: sup, data: appendSupSection(nil, false, name, id, o), edited: true})
+	}
+	d, err := rewriteDwarf(sf.file, sf.f, sf.edits, extra)
+	if err != nil {
+		return nil, err
+	}
+	st.refs += refs
+	st.shared += moved
+	st.before += sf.strSize
+	st.after += uint64(len(str))
+	return d, nil
+}
+
+// abbrevForms calls fn for each attribute of each abbreviation of the
+// tables of units in b, with the abbreviation, the index of the
+// attribute, and the bytes of its form's ULEB128, for fn to change.
+func abbrevForms(b []byte, units []unitHeader, o binary.ByteOrder, fn func(a *abbrev, i int, form []byte)) error {
+	done := make(map[uint64]bool)
+	for _, u := range units {
+		if done[u.abbrevOff] {
+			continue
+		}
+		done[u.abbrevOff] = true
+		d := &dwarfBuf{b: b, off: u.abbrevOff, o: o}
+		for d.err == nil {
+			code := d.uleb()
+			if code == 0 {
+				break
+			}
+			d.uleb()  // tag
+			d.uint(1) // children
+			for i := 0; d.err == nil; i++ {
+				attr, pos := d.uleb(), d.off
+				form := d.uleb()
+				if attr == 0 && form == 0 {
+					break
+				}
+				end := d.off
+				if form == dwFormImplicitConst {
+					d.sleb()
+				}
+				if a := u.abbrevs[code]; a != nil && d.err == nil {
+					fn(a, i, b[pos:end])
+				}
+			}
+		}
+		if d.err != nil {
+			return fmt.Errorf("__debug_abbrev: %v", d.err)
+		}
+	}
+	return nil
+}
+
+// rewriteDwarf returns f, read from r, with its DWARF sections edited as
+// edits says, and the sections extra added after them.  The sections of
+// __DWARF are laid out end to end, uncompressed and named canonically,
+// from where the segment begins; nothing may follow it in the file.
+func rewriteDwarf(r io.ReaderAt, f *macho.File, edits map[*macho.Section]sectionEdit, extra []dsymSection) (*dsym, error) {
+	g := f.Segment("__DWARF")
+	if g == nil {
+		return nil, fmt.Errorf("lacks segment __DWARF")
+	}
+	// The load commands may grow up to the file's first contents.
+	start := g.Offset
+	for _, l := range f.Loads {
+		s, ok := l.(*macho.Segment)
+		if !ok || s == g || s.Filesz == 0 {
+			continue
+		}
+		if s.Offset+s.Filesz > g.Offset {
+			return nil, fmt.Errorf("segment %s follows __DWARF", s.Name)
+		}
+		if s.Offset > 0 && s.Offset < start {
+			start = s.Offset
+		}
+	}
+	if st := f.Symtab; st != nil {
+		for _, x := range [][2]uint64{
+			{uint64(st.Symoff), uint64(st.Nsyms) * uint64(f.SymbolSize())},
+			{uint64(st.Stroff), uint64(st.Strsize)},
+		} {
+			if x[1] == 0 {
+				continue
+			}
+			if x[0]+x[1] > g.Offset {
+				return nil, fmt.Errorf("the symbol table follows __DWARF")
+			}
+			if x[0] < start {
+				start = x[0]
+			}
+		}
+	}
+
+	var canonical splitOptions
+	t := &macho.FileTOC{FileHeader: f.FileHeader, ByteOrder: f.ByteOrder}
+	t.Ncmd, t.Cmdsz = 0, 0
+	var newdwarf *macho.Segment
+	var sections []dsymSection
+	for _, l := range f.Loads {
+		s, ok := l.(*macho.Segment)
+		if !ok {
+			t.AddLoad(l)
+			continue
+		}
+		if s != g {
+			t.AddSegment(s.Copy())
+			for _, sect := range f.Sections[s.Firstsect : s.Firstsect+s.Nsect] {
+				t.AddSection(sect.Copy())
+			}
+			continue
+		}
+		newdwarf = s.Copy()
+		t.AddSegment(newdwarf)
+		for _, in := range f.Sections[s.Firstsect : s.Firstsect+s.Nsect] {
+			e, edited := edits[in]
+			if !e.drop {
+				sections = append(sections, dsymSection{in: in, data: e.data, edited: edited})
+			}
+		}
+		sections = append(sections, extra...)
+		offset, addr := g.Offset, g.Addr
+		for _, ds := range sections {
+			ns := ds.in.Copy()
+			ns.Name = canonical.sectionName(ns.Name)
+			ns.Offset, ns.Addr = uint32(offset), addr
+			size, err := ds.size()
+			if err != nil {
+				return nil, err
+			}
+			if size != ns.Size {
+				ns.Size, ns.Align = size, 0
+			}
+			ns.Reloff, ns.Nreloc = 0, 0
+			t.AddSection(ns)
+			if err := ds.attach(t, ns); err != nil {
+				return nil, err
+			}
+			offset += ns.Size
+			addr += ns.Size
+		}
+		// Section offsets are only 32 bits.
+		if offset > math.MaxUint32 {
+			return nil, fmt.Errorf("uncompressed DWARF (%d bytes) is too large for a Mach-O file", offset-g.Offset)
+		}
+		newdwarf.Filesz = offset - g.Offset
+		newdwarf.Memsz = macho.RoundUp(newdwarf.Filesz, 1<<pageAlign)
+	}
+	if err := t.Validate(); err != nil {
+		return nil, fmt.Errorf("(internal) inconsistent output: %v", err)
+	}
+	if uint64(t.TOCSize()) > start {
+		return nil, fmt.Errorf("load commands (%d bytes) do not fit before the file's contents at %#x", t.TOCSize(), start)
+	}
+
+	// What lies between the old load commands and __DWARF is kept.
+	clear := uint64(f.HdrSize()) + uint64(f.Cmdsz)
+	if n := uint64(t.TOCSize()); n > clear {
+		clear = n
+	}
+	if clear < g.Offset {
+		kept := make([]byte, g.Offset-clear)
+		if _, err := r.ReadAt(kept, int64(clear)); err != nil {
+			return nil, err
+		}
+		t.AddPayload(clear, bytes.NewReader(kept), uint64(len(kept)))
+	}
+	return &dsym{toc: t, size: int64(newdwarf.Offset + newdwarf.Filesz)}, nil
+}
+
+// sharedStringsDsym returns a shared-strings file holding str, with
+// checksum id, for dSYMs with header hdr and byte order o: __debug_str,
+// and a __debug_sup that marks it supplementary.
+func sharedStringsDsym(hdr macho.FileHeader, o binary.ByteOrder, str, id []byte) (*dsym, error) {
+	t := &macho.FileTOC{
+		FileHeader: macho.FileHeader{Magic: hdr.Magic, Cpu: hdr.Cpu, SubCpu: hdr.SubCpu, Type: macho.MhDsym},
+		ByteOrder:  o,
+	}
+	cmd := macho.LcSegment
+	if t.Magic == macho.Magic64 {
+		cmd = macho.LcSegment64
+	}
+	g := &macho.Segment{SegmentHeader: macho.SegmentHeader{LoadCmd: cmd, Name: "__DWARF"}}
+	t.AddSegment(g)
+	for _, s := range []struct {
+		name string
+		data []byte
+	}{
+		{"__debug_str", str},
+		{supSection, appendSupSection(nil, true, "", id, o)},
+	} {
+		in := &macho.Section{SectionHeader: macho.SectionHeader{Name: s.name, Seg: "__DWARF", Flags: macho.SAttrDebug}}
+		t.AddSection(in)
+		t.AddSectionData(in, s.data)
+	}
+	if err := t.LayOutSegment(g, macho.RoundUp(uint64(t.TOCSize()), 1<<pageAlign)); err != nil {
+		return nil, err
+	}
+	g.Memsz = macho.RoundUp(g.Filesz, 1<<pageAlign)
+	return &dsym{toc: t, size: int64(g.Offset + g.Filesz)}, nil
+}
+
+// unsharedBytes returns the dSYM path made self-contained, if it refers
+// into a shared-strings file, or nil if it does not.
+func unsharedBytes(path string) ([]byte, error) {
+	if supplementaryName(path) == "" {
+		return nil, nil
+	}
+	sf, err := openSharing(path)
+	if err != nil {
+		return nil, err
+	}
+	defer sf.close()
+	if sf.sup == nil {
+		return nil, nil
+	}
+	d, err := sf.share(nil, "", nil, &shareStats{})
+	if err != nil {
+		return nil, err
+	}
+	return d.Bytes()
+}
+
+// replaceFile edits name in place to be d, as editInPlace does, so that
+// a reader of name finds the old file or the new one, never part of
+// either, and the new one is a dSYM of the same UUIDs.  If keepBackup
+// is set, the old one is kept as name.bak.
+func replaceFile(name string, d *dsym, keepBackup bool) error {
+	write := func(w io.Writer) error {
+		_, err := d.WriteTo(w)
+		return err
+	}
+	return editInPlace(name, write, checkDsymEdit, keepBackup)
+}
@@ -0,0 +1,182 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// stampSection is the section of __DWARF in which sd records how it
+// produced a dSYM.  Tools that read DWARF ignore sections they do not
+// know.
+const stampSection = "__splitdwarf"
+
+// A Stamp records how a dSYM was produced: by which build of sd, and
+// with which options, so that one that misbehaves years later can be
+// explained.  It is held as JSON in the dSYM's __DWARF,__splitdwarf
+// section.  It holds nothing that differs between runs, so splitting
+// is still reproducible.
+type Stamp struct {
+	Tool      string   `json:"tool"`
+	Version   string   `json:"version"`
+	GoVersion string   `json:"go,omitempty"`
+	Options   []string `json:"options,omitempty"` // as flags, in a fixed order
+}
+
+func (s *Stamp) String() string {
+	str := s.Tool + " " + s.Version
+	if s.GoVersion != "" {
+		str += " (" + s.GoVersion + ")"
+	}
+	if len(s.Options) > 0 {
+		str += " with " + strings.Join(s.Options, " ")
+	}
+	return str
+}
+
+// toolVersion returns the version of this build of sd: its module
+// version, or "(devel)", and the revision it was built from, if known.
+func toolVersion() (version, goVersion string) {
+	version = "(devel)"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return version, ""
+	}
+	if info.Main.Version != "" {
+		version = info.Main.Version
+	}
+	var rev, modified string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		}
+	}
+	if rev != "" {
+		if len(rev) > 12 {
+			rev = rev[:12]
+		}
+		version += " " + rev
+		if modified == "true" {
+			version += "-dirty"
+		}
+	}
+	return version, info.GoVersion
+}
+
+// flags returns the options o, as the flags that would set them, in
+// the order sd's usage lists them.  Options at their defaults, and
+// those that only say where to find files, are omitted.
+func (o *splitOptions) flags() []string {
+	var flags []string
+	if o.arch != "" {
+		flags = append(flags, "-arch="+o.arch)
+	}
+	bools := []struct {
+		set  bool
+		flag string
+	}{
+		{o.dsymutil, "-dsymutil"},
+		{o.linkEditData, "-linkedit-data"},
+		{o.onlyDwarf, "-only-dwarf"},
+		{o.symbolsOnly, "-symbols-only"},
+	}
+	for _, b := range bools {
+		if b.set {
+			flags = append(flags, b.flag)
+		}
+	}
+	switch o.vmaddr {
+	case vmaddrPreserve:
+		flags = append(flags, "-vmaddr=preserve")
+	case vmaddrPack:
+		flags = append(flags, "-vmaddr=pack")
+	case vmaddrBase:
+		flags = append(flags, fmt.Sprintf("-vmaddr=base=%#x", o.base))
+	}
+	if o.cus != nil {
+		for _, p := range o.cus.include {
+			flags = append(flags, "-include-cu="+p)
+		}
+		for _, p := range o.cus.exclude {
+			flags = append(flags, "-exclude-cu="+p)
+		}
+	}
+	if o.redact != nil {
+		for _, p := range o.redact.patterns {
+			flags = append(flags, "-redact="+p)
+		}
+	}
+	switch o.supplementary {
+	case supRecord:
+		flags = append(flags, "-supplementary=record")
+	case supInline:
+		flags = append(flags, "-supplementary=inline")
+	}
+	if o.stripMacros {
+		flags = append(flags, "-strip-macros")
+	}
+	if o.lineTables {
+		flags = append(flags, "-line-tables-only")
+	}
+	switch o.rename {
+	case renameKeep:
+		flags = append(flags, "-rename=keep")
+	case renameMap:
+		var pairs []string
+		for from, to := range o.renames {
+			pairs = append(pairs, from+":"+to)
+		}
+		sort.Strings(pairs)
+		flags = append(flags, "-rename=map="+strings.Join(pairs, ","))
+	}
+	for _, f := range o.filters {
+		flags = append(flags, "-filter="+f)
+	}
+	return flags
+}
+
+// makeStamp returns the contents of the __splitdwarf section of a dSYM
+// split with options o.
+func makeStamp(o *splitOptions) []byte {
+	s := &Stamp{Tool: "split-dwarf", Options: o.flags()}
+	s.Version, s.GoVersion = toolVersion()
+	b, err := json.Marshal(s)
+	if err != nil {
+		panic(err) // a Stamp always marshals
+	}
+	return append(b, '\n')
+}
+
+// readStamp returns the Stamp of the dSYM f, or nil if it has none.
+func readStamp(f *macho.File) (*Stamp, error) {
+	sect := f.Section(stampSection)
+	if sect == nil || sect.Seg != "__DWARF" {
+		return nil, nil
+	}
+	b, err := sect.Data()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", stampSection, err)
+	}
+	s := new(Stamp)
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("%s: %v", stampSection, err)
+	}
+	return s, nil
+}
+
+// stampOf returns the Stamp of f, or nil if it has none or it cannot
+// be read.
+func stampOf(f *macho.File) *Stamp {
+	s, _ := readStamp(f)
+	return s
+}
@@ -0,0 +1,480 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A symbol store is simply a directory tree containing dSYM bundles
+// (or bare DWARF files), identified by the UUIDs recorded in them.
+// No particular layout is required; the store commands walk the tree.
+
+// A storeEntry is one removable unit of a store: either a whole
+// .dSYM bundle or a single file outside of any bundle.
+type storeEntry struct {
+	path    string    // bundle directory or file
+	files   []string  // Mach-O files within path
+	uuids   []string  // their UUIDs, canonical form, "" if none
+	modTime time.Time // newest modification time of any file
+
+	// Whether path is a supplementary file, such as the one
+	// "sd store share-strings" writes, which other entries refer into.
+	supplementary bool
+	// Whether path holds chunk indexes, whose files stand for the
+	// dSYMs they list.
+	chunked bool
+}
+
+// store implements "sd store ...".
+func store(args []string) {
+	if len(args) < 1 {
+		fail("Usage: %s store gc|find|serve|share-strings|unshare ...", os.Args[0])
+	}
+	switch args[0] {
+	case "gc":
+		storeGC(args[1:])
+	case "find":
+		storeFind(args[1:])
+	case "serve":
+		storeServe(args[1:])
+	case "share-strings":
+		storeShareStrings(args[1:])
+	case "unshare":
+		storeUnshare(args[1:])
+	default:
+		fail("Unknown store command %s", args[0])
+	}
+}
+
+// storeGC implements "sd store gc".
+func storeGC(args []string) {
+	fs := flag.NewFlagSet("store gc", flag.ExitOnError)
+	keep := fs.String("keep", "", "keep symbols modified within `age` (e.g. 90d or 36h)")
+	keepUUIDs := fs.String("keep-uuids", "", "never remove symbols whose UUID is listed, one per line, in `file`")
+	dryRun := fs.Bool("n", false, "print what would be removed without removing it")
+	lockWait := fs.Duration("lock-wait", 0, "if another sd is changing the store, wait up to `duration` for it rather than failing as busy")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail("Usage: %s store gc [ -keep age ] [ -keep-uuids file ] [ -n ] [ -lock-wait duration ] storedir", os.Args[0])
+	}
+	if *keep == "" && *keepUUIDs == "" {
+		fail("store gc needs -keep or -keep-uuids; refusing to remove everything")
+	}
+
+	var cutoff time.Time
+	if *keep != "" {
+		age, err := parseAge(*keep)
+		if err != nil {
+			fail("Bad -keep age %s, error=%v", *keep, err)
+		}
+		cutoff = time.Now().Add(-age)
+	}
+	keptUUIDs := make(map[string]bool)
+	if *keepUUIDs != "" {
+		var err error
+		keptUUIDs, err = readUUIDList(*keepUUIDs)
+		if err != nil {
+			fail("Could not read %s, error=%v", *keepUUIDs, err)
+		}
+	}
+
+	// The lock must be let go of before any fail, which exits.
+	var l *fileLock
+	if !*dryRun {
+		var err error
+		if l, err = lockStore(fs.Arg(0), *lockWait); err != nil {
+			fail("%v", err)
+		}
+		defer l.unlock()
+	}
+	st, err := gcStore(fs.Arg(0), cutoff, keptUUIDs, *dryRun, func(path string) { fmt.Println(path) })
+	if err != nil {
+		l.unlock()
+		fail("%v", err)
+	}
+	if *dryRun {
+		note("%d of %d entries would be removed", len(st.removed), st.entries)
+	} else {
+		note("removed %d of %d entries", len(st.removed), st.entries)
+	}
+	if st.chunks > 0 {
+		note("and %d chunks no index lists", st.chunks)
+	}
+}
+
+// gcStats reports what gcStore removed, or would have.
+type gcStats struct {
+	entries int      // in the store
+	removed []string // their paths
+	chunks  int      // no longer listed by any index
+}
+
+// gcStore removes from the store dir each entry neither modified after
+// cutoff (if it is not zero) nor holding a UUID in keptUUIDs, calling
+// removing with its path first, and then the chunks no index left
+// lists.  Supplementary files are kept, as entries refer into them.
+// If dryRun is set, nothing is removed.  Only what scanStore finds is
+// removed, and it finds only what lies within dir: a symbolic link is
+// neither followed nor, being no Mach-O file, removed.
+func gcStore(dir string, cutoff time.Time, keptUUIDs map[string]bool, dryRun bool, removing func(path string)) (*gcStats, error) {
+	entries, err := scanStore(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Could not scan store %s, error=%v", dir, err)
+	}
+	st := &gcStats{entries: len(entries)}
+	var kept []*storeEntry
+entries:
+	for _, e := range entries {
+		// Removing a supplementary file would break every entry that
+		// refers into it; share-strings removes those it replaces.
+		if e.supplementary {
+			kept = append(kept, e)
+			continue
+		}
+		if !cutoff.IsZero() && e.modTime.After(cutoff) {
+			kept = append(kept, e)
+			continue
+		}
+		for _, u := range e.uuids {
+			if keptUUIDs[u] {
+				kept = append(kept, e)
+				continue entries
+			}
+		}
+		if rel, err := filepath.Rel(dir, e.path); err != nil || rel == "." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return st, fmt.Errorf("Refusing to remove %s, which is not within store %s", e.path, dir)
+		}
+		removing(e.path)
+		st.removed = append(st.removed, e.path)
+		if dryRun {
+			continue
+		}
+		if err := os.RemoveAll(e.path); err != nil {
+			return st, fmt.Errorf("Could not remove %s, error=%v", e.path, err)
+		}
+	}
+	// Chunks that no index left in the store lists go too.
+	st.chunks, err = pruneChunks(dir, kept, dryRun)
+	if err != nil {
+		return st, fmt.Errorf("Could not prune chunks in %s, error=%v", dir, err)
+	}
+	return st, nil
+}
+
+// storeFind implements "sd store find".  The stores searched come from
+// -store or else $SD_STORE; either is a space-separated list of local
+// directories and debuginfod server URLs, tried in order.
+func storeFind(args []string) {
+	fs := flag.NewFlagSet("store find", flag.ExitOnError)
+	stores := fs.String("store", os.Getenv("SD_STORE"), "space-separated `list` of store directories and debuginfod URLs (default $SD_STORE)")
+	out := fs.String("o", "", "where to save symbols downloaded from a debuginfod server, or reassembled from chunks (default UUID.dwarf)")
+	cache := fs.String("chunk-cache", "", "ask sd servers for chunked symbols, fetching only the chunks not already kept in `dir`,\n"+
+		"and keeping there those fetched")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail("Usage: %s store find [ -store list ] [ -o file ] [ -chunk-cache dir ] uuid|binary", os.Args[0])
+	}
+	if strings.TrimSpace(*stores) == "" {
+		fail("No store configured; use -store or set SD_STORE")
+	}
+
+	u, err := uuidArg(fs.Arg(0))
+	if err != nil {
+		fail("%v", err)
+	}
+	file := *out
+	if file == "" {
+		file = u + ".dwarf"
+	}
+	found, err := findSymbols(strings.Fields(*stores), u, file, *cache)
+	if err != nil {
+		fail("%v", err)
+	}
+	if found == "" {
+		fail("No symbols found for UUID %s", u)
+	}
+	fmt.Println(found)
+}
+
+// uuidArg returns the UUID arg is, or else that of the Mach-O file it names.
+func uuidArg(arg string) (string, error) {
+	if u, ok := canonicalUUID(arg); ok {
+		return u, nil
+	}
+	f, err := macho.Open(arg)
+	if err != nil {
+		return "", fmt.Errorf("%s is neither a UUID nor a readable Mach-O file, error=%v", arg, err)
+	}
+	u := uuidOf(f)
+	f.Close()
+	if u == "" {
+		return "", fmt.Errorf("%s has no UUID", arg)
+	}
+	return u, nil
+}
+
+// findSymbols looks in each of stores, in turn, for the symbols for
+// uuid, and returns where they are: in a store directory, or in file,
+// if they were downloaded or reassembled from chunks.  It returns ""
+// if none of the stores has them; a server that fails is noted and
+// passed over.
+func findSymbols(stores []string, uuid, file, cache string) (string, error) {
+	for _, s := range stores {
+		if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+			if cache != "" {
+				found, err := fetchChunked(s, uuid, file, cache)
+				if err != nil {
+					note("%s: %v", s, err)
+					continue
+				}
+				if found {
+					return file, nil
+				}
+			}
+			found, err := fetchDebuginfod(s, uuid, file)
+			if err != nil {
+				note("%s: %v", s, err)
+				continue
+			}
+			if found {
+				return file, nil
+			}
+			continue
+		}
+		entries, err := scanStore(s)
+		if err != nil {
+			note("%s: %v", s, err)
+			continue
+		}
+		for _, e := range entries {
+			for i, v := range e.uuids {
+				if v != uuid {
+					continue
+				}
+				// A chunk index is no use to a debugger; hand over
+				// the dSYM it lists.
+				if e.chunked {
+					if ix, err := readChunkIndex(e.files[i]); err == nil {
+						dir := ix.chunkDir(e.files[i])
+						err := ix.reassemble(file, func(c Chunk) ([]byte, error) { return readChunk(dir, c) })
+						if err != nil {
+							return "", fmt.Errorf("%s: %v", e.files[i], err)
+						}
+						return file, nil
+					}
+				}
+				return e.files[i], nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// fetchDebuginfod asks the debuginfod server at url for the debugging
+// information for uuid and, if it has any, saves it to file.
+// Debuginfod keys on build IDs; for Mach-O the UUID plays that role.
+func fetchDebuginfod(url, uuid, file string) (bool, error) {
+	id := strings.ToLower(strings.Replace(uuid, "-", "", -1))
+	resp, err := http.Get(strings.TrimSuffix(url, "/") + "/buildid/" + id + "/debuginfo")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(file)
+		return false, err
+	}
+	return true, f.Close()
+}
+
+// scanStore walks dir and returns the Mach-O debugging artifacts found there,
+// thin or universal, and the chunk indexes, grouped into removable units
+// and sorted by path.  Hard links to a file already seen are skipped, as
+// are symbolic links, which are not followed.
+func scanStore(dir string) ([]*storeEntry, error) {
+	units := make(map[string]*storeEntry)
+	seen := make(map[int64][]os.FileInfo) // by size, to find hard links
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		for _, fi := range seen[info.Size()] {
+			if os.SameFile(fi, info) {
+				return nil
+			}
+		}
+		seen[info.Size()] = append(seen[info.Size()], info)
+		if strings.HasSuffix(path, ".chunk") {
+			return nil // see chunk.go
+		}
+		if strings.HasSuffix(path, backupSuffix) {
+			return nil // an edit in place's backup; see inplace.go
+		}
+		var uuids []string
+		var sup, chunked bool
+		if f, err := macho.Open(path); err == nil {
+			uuids = []string{uuidOf(f)}
+			sup = isSupplementaryFile(f)
+			f.Close()
+		} else if ff, err := macho.OpenFat(path); err == nil {
+			// A universal dSYM stands for each of its slices.
+			for _, a := range ff.Arches {
+				uuids = append(uuids, uuidOf(a.File))
+				sup = sup || isSupplementaryFile(a.File)
+			}
+			ff.Close()
+		} else if ix, err := readChunkIndex(path); err == nil {
+			uuids, chunked = ix.UUIDs, true
+			if len(uuids) == 0 {
+				uuids = []string{""}
+			}
+		} else {
+			return nil // not Mach-O, not our business
+		}
+
+		unit := bundleOf(dir, path)
+		e := units[unit]
+		if e == nil {
+			e = &storeEntry{path: unit}
+			units[unit] = e
+		}
+		for _, u := range uuids {
+			e.files = append(e.files, path)
+			e.uuids = append(e.uuids, u)
+		}
+		e.supplementary = e.supplementary || sup
+		e.chunked = e.chunked || chunked
+		if info.ModTime().After(e.modTime) {
+			e.modTime = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var entries []*storeEntry
+	for _, e := range units {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+	return entries, nil
+}
+
+// bundleOf returns the outermost .dSYM directory below root that contains path,
+// or path itself if it is not within a bundle.
+func bundleOf(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return path
+	}
+	elems := strings.Split(rel, string(filepath.Separator))
+	for i, e := range elems[:len(elems)-1] {
+		if hasDsymSuffix(e) {
+			return filepath.Join(root, filepath.Join(elems[:i+1]...))
+		}
+	}
+	return path
+}
+
+// parseAge parses a duration, additionally accepting a whole number of days ("90d").
+// An age may not be negative.
+func parseAge(s string) (time.Duration, error) {
+	var d time.Duration
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil {
+			return 0, err
+		}
+		if n > int(math.MaxInt64/(24*time.Hour)) {
+			return 0, fmt.Errorf("%s is too long", s)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, err
+		}
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s is negative", s)
+	}
+	return d, nil
+}
+
+// readUUIDList reads a file of UUIDs, one per line; blank lines and
+// lines beginning with # are ignored.
+func readUUIDList(file string) (map[string]bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		t := strings.TrimSpace(s.Text())
+		if t == "" || t[0] == '#' {
+			continue
+		}
+		u, ok := canonicalUUID(t)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: malformed UUID %q", file, line, t)
+		}
+		m[u] = true
+	}
+	return m, s.Err()
+}
+
+// uuidOf returns the canonical form of f's LC_UUID, or "" if it has none.
+func uuidOf(f *macho.File) string {
+	if u := f.UUID(); u != nil {
+		return u.String()
+	}
+	return ""
+}
+
+// formatUUID formats 16 bytes in the usual 8-4-4-4-12 upper-case form.
+func formatUUID(b []byte) string {
+	h := strings.ToUpper(hex.EncodeToString(b))
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// canonicalUUID accepts a UUID with or without dashes, in either case,
+// and returns it in the form produced by formatUUID.
+func canonicalUUID(s string) (string, bool) {
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != 16 {
+		return "", false
+	}
+	return formatUUID(b), true
+}
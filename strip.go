@@ -0,0 +1,189 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// "sd strip" writes a copy of a thin Mach-O file with the symbols
+// that only a debugger needs, which a split has copied into the dSYM,
+// removed from its symbol table, and __LINKEDIT packed to match, so
+// that "sd exe" then "sd strip exe exe.stripped" ships the stripped
+// executable and keeps its dSYM, with no strip or dsymutil at hand.
+
+// sd strip [ -S | -x | -tables ] input output
+func stripCmd(args []string) {
+	fs := flag.NewFlagSet("strip", flag.ExitOnError)
+	debug := fs.Bool("S", false, "remove only the debugging symbols (stabs), as strip -S does")
+	locals := fs.Bool("x", false, "remove the debugging and local symbols, as strip -x does")
+	tables := fs.Bool("tables", false, "remove the symbol tables themselves, which dyld must not need")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s strip [ -S | -x | -tables ] input output\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	level, n := macho.StripAll, 0
+	for _, f := range []struct {
+		set   bool
+		level macho.StripLevel
+	}{{*debug, macho.StripDebug}, {*locals, macho.StripLocals}, {*tables, macho.StripTables}} {
+		if f.set {
+			level = f.level
+			n++
+		}
+	}
+	if n > 1 {
+		fail("-S, -x, and -tables are different levels of stripping; give one")
+	}
+	removed, err := stripFile(fs.Arg(0), fs.Arg(1), level)
+	if err != nil {
+		fail("%v", err)
+	}
+	fmt.Printf("%s: removed %d symbols\n", fs.Arg(1), removed)
+}
+
+// stripFile writes to out, which may be in, the thin Mach-O file in
+// stripped as level says, and returns how many symbols it removed.
+func stripFile(in, out string, level macho.StripLevel) (int, error) {
+	b, err := ioutil.ReadFile(in)
+	if err != nil {
+		return 0, err
+	}
+	if isFat(bytes.NewReader(b)) {
+		return 0, fmt.Errorf("%s is universal; strip its slices, which \"sd lipo -thin\" extracts, one at a time", in)
+	}
+	f, err := macho.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", in, err)
+	}
+	n, err := f.StripSymbols(level)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", in, err)
+	}
+	if level != macho.StripTables {
+		if b, err = f.PutSymtab(b); err != nil {
+			return 0, fmt.Errorf("%s: %v", in, err)
+		}
+	}
+	if f.Segment("__LINKEDIT") != nil {
+		if b, err = f.PackLinkedit(b); err != nil {
+			return 0, fmt.Errorf("%s: %v", in, err)
+		}
+	}
+	for _, l := range f.Loads {
+		if l.Command() == macho.LcCodeSignature {
+			note("%s: the code signature no longer matches; sign %s again", in, out)
+		}
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(in); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	// out may be in, which is not truncated unless the copy is written.
+	tmp, err := ioutil.TempFile(filepath.Dir(out), ".sd")
+	if err != nil {
+		return 0, err
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), out)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+// stripInput rewrites inexe, a thin Mach-O file whose DWARF a split
+// has copied into its dSYM, without that DWARF, as StripDWARF does,
+// in place (see editInPlace), keeping a backup if keepBackup is set.
+// An inexe with a code signature, which stripping invalidates, is
+// refused unless signed is set.
+func stripInput(inexe string, keepBackup, signed bool) error {
+	b, err := ioutil.ReadFile(inexe)
+	if err != nil {
+		return err
+	}
+	f, err := macho.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for _, l := range f.Loads {
+		if l.Command() == macho.LcCodeSignature && !signed {
+			return fmt.Errorf("%s has a code signature, which stripping would invalidate; with -strip-signed, it is stripped anyway, to be signed again", inexe)
+		}
+	}
+	if b, _, err = f.StripDWARF(b); err != nil {
+		return err
+	}
+	if signed {
+		note("%s: the code signature no longer matches; sign it again", inexe)
+	}
+	write := func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	}
+	return editInPlace(inexe, write, checkStripEdit, keepBackup)
+}
+
+// checkStripEdit checks that edited, an executable rewritten from orig
+// without its DWARF, is still the same executable: that it can be
+// read, has orig's architecture, UUID, and file type, no DWARF, and
+// orig's other segments, in order, at the same addresses.
+func checkStripEdit(orig, edited string) error {
+	g, err := macho.Open(edited)
+	if err != nil {
+		return fmt.Errorf("is not a readable Mach-O file: %v", err)
+	}
+	defer g.Close()
+	if g.Segment("__DWARF") != nil || g.Section("__debug_info") != nil || g.Section("__zdebug_info") != nil {
+		return fmt.Errorf("still has DWARF")
+	}
+	if orig == "" {
+		return nil
+	}
+	f, err := macho.Open(orig)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	if f.Cpu != g.Cpu || f.Type != g.Type || uuidOf(f) != uuidOf(g) {
+		return fmt.Errorf("is %s %v with UUID %s, not %s %v with UUID %s",
+			archName(g.Cpu, g.SubCpu), g.Type, uuidOf(g), archName(f.Cpu, f.SubCpu), f.Type, uuidOf(f))
+	}
+	segments := func(f *macho.File) []string {
+		var segs []string
+		for _, l := range f.Loads {
+			if s, ok := l.(*macho.Segment); ok && s.Name != "__DWARF" && s.Name != "__LINKEDIT" {
+				segs = append(segs, fmt.Sprintf("%s@%#x", s.Name, s.Addr))
+			}
+		}
+		return segs
+	}
+	if got, want := segments(g), segments(f); !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("has segments %v, not %v", got, want)
+	}
+	return nil
+}
@@ -0,0 +1,404 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"path/filepath"
+)
+
+// A Supplementary describes the supplementary file (a dwz "alt" file,
+// or a DWARF 5 supplementary object file) into which an input's debug
+// information refers.  Without that file's contents, a dSYM made from
+// the input is incomplete.
+type Supplementary struct {
+	Name    string `json:"name,omitempty"` // as recorded in the input
+	ID      string `json:"id,omitempty"`   // its build ID or checksum, in hex
+	DIERefs int    `json:"die_refs"`
+	StrRefs int    `json:"str_refs"`
+	Inlined bool   `json:"inlined"` // copied into the dSYM
+}
+
+// A supPolicy says what splitDwarf does with an input whose DWARF
+// refers into a supplementary file.
+type supPolicy int
+
+const (
+	supFail   supPolicy = iota // report an error
+	supRecord                  // write the incomplete dSYM, noting the dependency
+	supInline                  // copy what is referred to into the dSYM
+)
+
+// parseSupPolicy parses the argument of -supplementary.
+func parseSupPolicy(s string, o *splitOptions) error {
+	switch s {
+	case "fail":
+		o.supplementary = supFail
+	case "record":
+		o.supplementary = supRecord
+	case "inline":
+		o.supplementary = supInline
+	default:
+		return fmt.Errorf("unknown supplementary policy %q (want fail, record, or inline)", s)
+	}
+	return nil
+}
+
+// Sections naming the supplementary file: DWARF 5's, and the GNU one
+// (.gnu_debugaltlink, cut to fit a Mach-O section name).
+const (
+	supSection     = "__debug_sup"
+	altLinkSection = "__gnu_debugaltli"
+)
+
+// isSupForm reports whether form refers into a supplementary file, and
+// if so, the form that does the same within the file itself.
+func isSupForm(form uint64) (local uint64, ok bool) {
+	switch form {
+	case dwFormGNURefAlt, dwFormRefSup4, dwFormRefSup8:
+		return dwFormRefAddr, true
+	case dwFormGNUStrpAlt, dwFormStrpSup:
+		return dwFormStrp, true
+	}
+	return 0, false
+}
+
+// findSupplementary reports whether exem's DWARF, as edited, refers
+// into a supplementary file, and if so, describes it.
+func findSupplementary(exem *macho.File, edits map[*macho.Section]sectionEdit) (*Supplementary, error) {
+	sections := dwarfSectionsByName(exem)
+	info, err := editedData(edits, sections["debug_info"])
+	if err != nil || info == nil {
+		return nil, err
+	}
+	abbrevs, err := editedData(edits, sections["debug_abbrev"])
+	if err != nil {
+		return nil, err
+	}
+	o := exem.ByteOrder
+	units, err := unitHeaders(info, abbrevs, o)
+	if err != nil {
+		return nil, err
+	}
+	// Walking every DIE is slow; most inputs can be cleared by their
+	// abbreviations alone.
+	possible := false
+	for _, u := range units {
+		for _, a := range u.abbrevs {
+			for _, at := range a.attrs {
+				if _, ok := isSupForm(at.form); ok || at.form == dwFormIndirect {
+					possible = true
+				}
+			}
+		}
+	}
+	if !possible {
+		return nil, nil
+	}
+	sup := &Supplementary{}
+	for i := range units {
+		err := walkDIEs(info, &units[i], o, func(off, next uint64, depth int, a *abbrev, attrs []attrValue) {
+			for _, v := range attrs {
+				if local, ok := isSupForm(v.form); ok && local == dwFormRefAddr {
+					sup.DIERefs++
+				} else if ok {
+					sup.StrRefs++
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sup.DIERefs == 0 && sup.StrRefs == 0 {
+		return nil, nil
+	}
+
+	if s := exem.Section(supSection); s != nil {
+		b, err := s.UncompressedData()
+		if err != nil {
+			return nil, err
+		}
+		_, name, id, err := parseSupSection(b, o)
+		if err != nil {
+			return nil, err
+		}
+		sup.Name, sup.ID = name, hex.EncodeToString(id)
+	} else if s := exem.Section(altLinkSection); s != nil {
+		b, err := s.UncompressedData()
+		if err != nil {
+			return nil, err
+		}
+		i := bytes.IndexByte(b, 0)
+		if i < 0 {
+			return nil, fmt.Errorf("%s: unterminated file name", altLinkSection)
+		}
+		sup.Name, sup.ID = string(b[:i]), hex.EncodeToString(b[i+1:])
+	}
+	return sup, nil
+}
+
+// parseSupSection parses b, the contents of a __debug_sup section:
+// whether the file holding it is itself a supplementary file, and the
+// name and checksum of the file it names.
+func parseSupSection(b []byte, o binary.ByteOrder) (isSup bool, name string, id []byte, err error) {
+	d := &dwarfBuf{b: b, o: o}
+	d.uint(2) // version
+	isSup = d.uint(1) != 0
+	name = d.cstring()
+	id = d.bytes(d.uleb())
+	if d.err != nil {
+		return false, "", nil, fmt.Errorf("%s: %v", supSection, d.err)
+	}
+	return isSup, name, id, nil
+}
+
+// appendSupSection appends to b the contents of a __debug_sup section
+// naming the file name, with checksum id.
+func appendSupSection(b []byte, isSup bool, name string, id []byte, o binary.ByteOrder) []byte {
+	var v [2]byte
+	o.PutUint16(v[:], 5)
+	b = append(b, v[:]...)
+	if isSup {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = append(append(b, name...), 0)
+	return append(appendULEB(b, uint64(len(id))), id...)
+}
+
+// supplementaryPath returns where to find the supplementary file sup:
+// file if that is given, otherwise the name recorded in the input,
+// relative to dir, the input's directory.
+func supplementaryPath(sup *Supplementary, file, dir string) (string, error) {
+	if file != "" {
+		return file, nil
+	}
+	if sup.Name == "" {
+		return "", fmt.Errorf("the input does not name its supplementary file; use -supplementary-file")
+	}
+	if filepath.IsAbs(sup.Name) {
+		return sup.Name, nil
+	}
+	return filepath.Join(dir, sup.Name), nil
+}
+
+// inlineSupplementary adds to edits the changes to exem's DWARF that
+// make it self-contained: alt's __debug_info, __debug_abbrev,
+// __debug_str, and __debug_line are appended to exem's, the units
+// from alt are adjusted to their new offsets, and each reference into
+// alt is changed to the corresponding reference within exem, by
+// changing its form in the abbreviations.  The sections naming alt are
+// dropped.
+func inlineSupplementary(exem, alt *macho.File, edits map[*macho.Section]sectionEdit) error {
+	o := exem.ByteOrder
+	if alt.ByteOrder != o {
+		return fmt.Errorf("supplementary file has a different byte order")
+	}
+	sections, altSections := dwarfSectionsByName(exem), dwarfSectionsByName(alt)
+	get := func(name string) (main, sup []byte, err error) {
+		if main, err = editedData(edits, sections[name]); err != nil {
+			return nil, nil, err
+		}
+		if s := altSections[name]; s != nil {
+			if sup, err = s.UncompressedData(); err != nil {
+				return nil, nil, err
+			}
+		}
+		if sup != nil && sections[name] == nil {
+			return nil, nil, fmt.Errorf("input has no __%s to receive the supplementary file's", name)
+		}
+		return main, sup, nil
+	}
+	info, altInfo, err := get("debug_info")
+	if err != nil {
+		return err
+	}
+	abbrevs, altAbbrevs, err := get("debug_abbrev")
+	if err != nil {
+		return err
+	}
+	str, altStr, err := get("debug_str")
+	if err != nil {
+		return err
+	}
+	line, altLine, err := get("debug_line")
+	if err != nil {
+		return err
+	}
+	infoBase, abbrevBase := uint64(len(info)), uint64(len(abbrevs))
+	strBase, lineBase := uint64(len(str)), uint64(len(line))
+
+	units, err := unitHeaders(info, abbrevs, o)
+	if err != nil {
+		return err
+	}
+	altUnits, err := unitHeaders(altInfo, altAbbrevs, o)
+	if err != nil {
+		return fmt.Errorf("supplementary file: %v", err)
+	}
+
+	// References into alt are rebased, and their forms changed.
+	newInfo := append(append([]byte(nil), info...), altInfo...)
+	newAbbrevs := append(append([]byte(nil), abbrevs...), altAbbrevs...)
+	var bad error
+	for i := range units {
+		u := &units[i]
+		err := walkDIEs(info, u, o, func(off, next uint64, depth int, a *abbrev, attrs []attrValue) {
+			for j, v := range attrs {
+				local, ok := isSupForm(v.form)
+				if !ok {
+					continue
+				}
+				if a.attrs[j].form != v.form {
+					bad = fmt.Errorf("DIE at %#x has a supplementary reference of indirect form", off)
+					continue
+				}
+				if v.size != u.offSize {
+					bad = fmt.Errorf("DIE at %#x has a %d-byte supplementary reference in a unit with %d-byte offsets", off, v.size, u.offSize)
+					continue
+				}
+				base := infoBase
+				if local == dwFormStrp {
+					base = strBase
+				}
+				putOffset(newInfo[v.pos:], v.size, v.val+base, o)
+			}
+		})
+		if err == nil {
+			err = bad
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := retypeAbbrevs(newAbbrevs[:abbrevBase], units, o); err != nil {
+		return err
+	}
+
+	// alt's own units move, with everything they refer to.
+	for i := range altUnits {
+		u := &altUnits[i]
+		hdr := u.start + 4
+		if u.offSize == 8 {
+			hdr += 8
+		}
+		at := hdr + 2 // past the version
+		if u.version >= 5 {
+			at += 2 // and the unit type and address size
+		}
+		putOffset(newInfo[infoBase+at:], u.offSize, getOffset(altInfo[at:], u.offSize, o)+abbrevBase, o)
+		err := walkDIEs(altInfo, u, o, func(off, next uint64, depth int, a *abbrev, attrs []attrValue) {
+			for _, v := range attrs {
+				var base uint64
+				switch {
+				case v.form == dwFormRefAddr:
+					base = infoBase
+				case v.form == dwFormStrp:
+					base = strBase
+				case v.attr == dwAtStmtList && (v.form == dwFormSecOffset || v.form == dwFormData4 || v.form == dwFormData8):
+					base = lineBase
+				case refersElsewhere(v.form):
+					bad = fmt.Errorf("DIE at %#x has attribute %#x of form %#x, which refers to a section that is not copied", off, v.attr, v.form)
+					continue
+				default:
+					if _, ok := isSupForm(v.form); ok {
+						bad = fmt.Errorf("DIE at %#x refers to a further supplementary file", off)
+					}
+					continue
+				}
+				putOffset(newInfo[infoBase+v.pos:], v.size, v.val+base, o)
+			}
+		})
+		if err == nil {
+			err = bad
+		}
+		if err != nil {
+			return fmt.Errorf("supplementary file: %v", err)
+		}
+	}
+	for off := uint64(0); off < uint64(len(altLine)); {
+		hdr, end, err := unitExtent(altLine, off, o)
+		if err != nil {
+			return fmt.Errorf("supplementary file: __debug_line: %v", err)
+		}
+		if v := (&dwarfBuf{b: altLine, off: hdr, o: o}).uint(2); v >= 5 {
+			return fmt.Errorf("supplementary file: __debug_line: version %d line programs are not supported", v)
+		}
+		off = end
+	}
+
+	edits[sections["debug_info"]] = sectionEdit{data: newInfo}
+	edits[sections["debug_abbrev"]] = sectionEdit{data: newAbbrevs}
+	if altStr != nil {
+		edits[sections["debug_str"]] = sectionEdit{data: append(append([]byte(nil), str...), altStr...)}
+	}
+	if altLine != nil {
+		edits[sections["debug_line"]] = sectionEdit{data: append(append([]byte(nil), line...), altLine...)}
+	}
+	for _, name := range []string{supSection, altLinkSection} {
+		if s := exem.Section(name); s != nil {
+			edits[s] = sectionEdit{drop: true}
+		}
+	}
+	return nil
+}
+
+// refersElsewhere reports whether form is that of an offset or index
+// into a section that inlineSupplementary does not copy.
+func refersElsewhere(form uint64) bool {
+	switch form {
+	case dwFormSecOffset, dwFormLineStrp, dwFormStrx, dwFormAddrx, dwFormLoclistx, dwFormRnglistx,
+		dwFormStrx1, dwFormStrx1 + 1, dwFormStrx1 + 2, dwFormStrx4,
+		dwFormAddrx1, dwFormAddrx1 + 1, dwFormAddrx1 + 2, dwFormAddrx4,
+		dwFormGNUAddrIndex, dwFormGNUStrIndex:
+		return true
+	}
+	return false
+}
+
+// retypeAbbrevs changes, in the abbreviation tables of units in b, the
+// forms that refer into a supplementary file to the forms that refer
+// within the file itself.  The new form's ULEB128 is padded to the
+// length of the old.
+func retypeAbbrevs(b []byte, units []unitHeader, o binary.ByteOrder) error {
+	done := make(map[uint64]bool)
+	for _, u := range units {
+		if done[u.abbrevOff] {
+			continue
+		}
+		done[u.abbrevOff] = true
+		d := &dwarfBuf{b: b, off: u.abbrevOff, o: o}
+		for d.err == nil {
+			if code := d.uleb(); code == 0 {
+				break
+			}
+			d.uleb()  // tag
+			d.uint(1) // children
+			for d.err == nil {
+				attr, pos := d.uleb(), d.off
+				form := d.uleb()
+				if attr == 0 && form == 0 {
+					break
+				}
+				if form == dwFormImplicitConst {
+					d.uleb()
+				}
+				if local, ok := isSupForm(form); ok {
+					putULEB(b[pos:d.off], local)
+				}
+			}
+		}
+		if d.err != nil {
+			return fmt.Errorf("__debug_abbrev: %v", d.err)
+		}
+	}
+	return nil
+}
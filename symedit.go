@@ -0,0 +1,104 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// "sd edit-symbols" renames, removes, and adds aliases of the symbols
+// of a thin Mach-O file, in the order its flags are given, and writes
+// the result; see FileTOC.RenameSymbol, RemoveSymbols, AddAlias, and
+// PutSymtab for what that changes, and what it does not.
+
+// A symbolEdit is one flag of edit-symbols, applied to t.
+type symbolEdit func(t *macho.FileTOC) error
+
+// sd edit-symbols [ -rename old=new ] [ -remove name ] [ -alias alias=target ] input output
+func editSymbolsCmd(args []string) {
+	var edits []symbolEdit
+	fs := flag.NewFlagSet("edit-symbols", flag.ExitOnError)
+	pair := func(s, what string) (string, string, error) {
+		i := strings.Index(s, "=")
+		if i <= 0 || i == len(s)-1 {
+			return "", "", fmt.Errorf("%q is not %s", s, what)
+		}
+		return s[:i], s[i+1:], nil
+	}
+	fs.Func("rename", "rename the symbols named old to new, given as `old=new`", func(s string) error {
+		from, to, err := pair(s, "old=new")
+		edits = append(edits, func(t *macho.FileTOC) error { return t.RenameSymbol(from, to) })
+		return err
+	})
+	fs.Func("remove", "remove the symbols named `name`", func(name string) error {
+		edits = append(edits, func(t *macho.FileTOC) error {
+			n, err := t.RemoveSymbols(func(s macho.Symbol) bool { return !s.IsStab() && s.Name == name })
+			if err == nil && n == 0 {
+				err = fmt.Errorf("there is no symbol %s", name)
+			}
+			return err
+		})
+		return nil
+	})
+	fs.Func("alias", "add a symbol `alias=target`, defined as target is", func(s string) error {
+		alias, target, err := pair(s, "alias=target")
+		edits = append(edits, func(t *macho.FileTOC) error { return t.AddAlias(alias, target) })
+		return err
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s edit-symbols [ -rename old=new ] [ -remove name ] [ -alias alias=target ] input output\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 || len(edits) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	in, out := fs.Arg(0), fs.Arg(1)
+	if err := editSymbols(in, out, edits); err != nil {
+		fail("%v", err)
+	}
+}
+
+// editSymbols writes to out the thin Mach-O file in with edits made to
+// its symbols, noting if it has a code signature, which the edits
+// break.
+func editSymbols(in, out string, edits []symbolEdit) error {
+	b, err := ioutil.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	if isFat(bytes.NewReader(b)) {
+		return fmt.Errorf("%s is universal; edit its slices, which \"sd lipo -thin\" extracts, one at a time", in)
+	}
+	f, err := macho.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("%s: %v", in, err)
+	}
+	for _, e := range edits {
+		if err := e(&f.FileTOC); err != nil {
+			return fmt.Errorf("%s: %v", in, err)
+		}
+	}
+	if b, err = f.PutSymtab(b); err != nil {
+		return fmt.Errorf("%s: %v", in, err)
+	}
+	for _, l := range f.Loads {
+		if l.Command() == macho.LcCodeSignature {
+			note("%s: the code signature no longer matches; sign %s again", in, out)
+		}
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(in); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	return ioutil.WriteFile(out, b, mode)
+}
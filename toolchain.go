@@ -0,0 +1,115 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"debug/buildinfo"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"strings"
+)
+
+// A Toolchain is a guess at what produced a binary, with the evidence
+// for the guess.  Linker is "go" for the Go internal linker, "ld64"
+// or "lld" for the system linkers, or "unknown".
+type Toolchain struct {
+	Linker        string   `json:"linker"`
+	LinkerVersion string   `json:"linker_version,omitempty"`
+	GoVersion     string   `json:"go_version,omitempty"`
+	Evidence      []string `json:"evidence,omitempty"`
+}
+
+func (t *Toolchain) String() string {
+	s := t.Linker
+	if t.LinkerVersion != "" {
+		s += " " + t.LinkerVersion
+	}
+	if t.GoVersion != "" {
+		s += ", " + t.GoVersion
+	}
+	return s
+}
+
+// detectToolchain classifies the toolchain that produced f, whose
+// bytes r holds.  The classification is heuristic; Evidence lists
+// what it was based on, in the order it was considered.
+func detectToolchain(f *macho.File, r io.ReaderAt) *Toolchain {
+	t := &Toolchain{Linker: "unknown"}
+	evidence := func(format string, args ...interface{}) {
+		t.Evidence = append(t.Evidence, fmt.Sprintf(format, args...))
+	}
+
+	if bv := f.BuildVersion(); bv != nil {
+		for _, tool := range bv.Tools {
+			switch tool.Tool {
+			case macho.ToolLd:
+				t.Linker, t.LinkerVersion = "ld64", tool.Version.String()
+			case macho.ToolLld:
+				t.Linker, t.LinkerVersion = "lld", tool.Version.String()
+			default:
+				continue
+			}
+			evidence("LC_BUILD_VERSION lists %s %s", toolName(tool.Tool), tool.Version)
+		}
+	}
+
+	external := false
+	if bi, err := buildinfo.Read(r); err == nil {
+		t.GoVersion = bi.GoVersion
+		evidence("Go build information says %s", bi.GoVersion)
+		for _, s := range bi.Settings {
+			if s.Key == "-ldflags" && (strings.Contains(s.Value, "-linkmode=external") || strings.Contains(s.Value, "-linkmode external")) {
+				external = true
+				evidence("linked with -ldflags=%s", s.Value)
+			}
+		}
+	}
+	if t.GoVersion == "" && (f.Section("__debug_info") != nil || f.Section("__zdebug_info") != nil) {
+		ps, _ := dwarfProducers(f)
+		for _, p := range ps {
+			v := strings.Fields(strings.TrimPrefix(p.Producer, "Go cmd/compile "))
+			if strings.HasPrefix(p.Producer, "Go cmd/compile ") && len(v) > 0 {
+				t.GoVersion = strings.TrimSuffix(v[0], ";")
+				evidence("DWARF producer is %q", p.Producer)
+				break
+			}
+		}
+	}
+
+	isGo := t.GoVersion != "" || f.Section("__gopclntab") != nil
+	if t.GoVersion == "" && isGo {
+		evidence("has a __gopclntab section")
+	}
+	if f.Segment("__DWARF") != nil && f.Type == macho.MhExecute {
+		evidence("executable carries a __DWARF segment")
+	}
+	for _, s := range f.Sections {
+		if strings.HasPrefix(s.Name, "__zdebug_") {
+			evidence("DWARF is compressed (%s)", s.Name)
+			break
+		}
+	}
+	debugMap := false
+	if f.Symtab != nil {
+		for _, s := range f.Symtab.Syms {
+			if s.StabType() == macho.NOso {
+				debugMap = true
+				evidence("symbol table has a debug map (N_OSO %s)", s.Name)
+				break
+			}
+		}
+	}
+
+	if t.Linker == "unknown" {
+		switch {
+		case isGo && !external && !debugMap:
+			t.Linker = "go"
+		case debugMap:
+			t.Linker = "ld64"
+		}
+	}
+	return t
+}
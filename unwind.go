@@ -0,0 +1,137 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/dr2chase/split-dwarf/macho"
+	"io"
+	"os"
+)
+
+// An UnwindTable is what unwind-table writes, for profilers that must
+// unwind the stacks of stripped binaries: for each range of PCs, how to
+// find the canonical frame address (CFA, the stack pointer before the
+// call) and where the return address and caller's frame pointer are.
+// A row applies from its PC to the next row's; the last row ends the
+// code.  Offsets are from the CFA, and 0 means "not saved": the return
+// address is in the link register, or the frame pointer is unchanged.
+//
+// The JSON form is this struct.  The binary form is little-endian:
+//
+//	magic    [8]byte  "SDUNWIND"
+//	version  uint32   1
+//	cpu      uint32   the Mach-O CPU type
+//	uuid     [16]byte zero if the file has none
+//	count    uint32   the number of rows
+//	reserved uint32
+//	rows     [count]struct {
+//		pc        uint64
+//		cfa       uint8   0 unknown, 1 CFA = SP + cfaOffset, 2 CFA = FP + cfaOffset
+//		reserved  [3]byte
+//		cfaOffset int32
+//		raOffset  int32
+//		fpOffset  int32
+//	}
+type UnwindTable struct {
+	UUID string      `json:"uuid,omitempty"`
+	Cpu  string      `json:"cpu"`
+	Rows []UnwindRow `json:"rows"`
+}
+
+// An UnwindRow is a row of an UnwindTable.
+type UnwindRow struct {
+	PC        uint64 `json:"pc"`
+	CFA       string `json:"cfa"` // "sp", "fp", or "unknown"
+	CFAOffset int64  `json:"cfa_offset,omitempty"`
+	RAOffset  int64  `json:"ra_offset,omitempty"`
+	FPOffset  int64  `json:"fp_offset,omitempty"`
+}
+
+const (
+	unwindMagic   = "SDUNWIND"
+	unwindVersion = 1
+)
+
+var unwindRuleNames = map[macho.UnwindRule]string{
+	macho.UnwindUnknown: "unknown",
+	macho.UnwindSP:      "sp",
+	macho.UnwindFP:      "fp",
+}
+
+// sd unwind-table [ -binary ] [ -o file ] file
+func unwindTableCmd(args []string) {
+	fs := flag.NewFlagSet("unwind-table", flag.ExitOnError)
+	bin := fs.Bool("binary", false, "write the compact binary form rather than JSON")
+	out := fs.String("o", "", "write the table to `file` rather than standard output")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fail("Usage: %s unwind-table [ -binary ] [ -o file ] file", os.Args[0])
+	}
+	f, err := macho.Open(fs.Arg(0))
+	if err != nil {
+		fail("Could not open %s, error=%v", fs.Arg(0), err)
+	}
+	defer f.Close()
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			fail("%v", err)
+		}
+	}
+	if err := writeUnwindTable(w, f, *bin); err != nil {
+		fail("%s: %v", fs.Arg(0), err)
+	}
+	if err := w.Close(); err != nil {
+		fail("%v", err)
+	}
+}
+
+// writeUnwindTable writes f's unwind table to w, as JSON or in the
+// binary form.
+func writeUnwindTable(w io.Writer, f *macho.File, bin bool) error {
+	rows, err := f.UnwindTable()
+	if err != nil {
+		return err
+	}
+	if !bin {
+		t := &UnwindTable{UUID: uuidOf(f), Cpu: f.Cpu.String(), Rows: []UnwindRow{}}
+		for _, r := range rows {
+			t.Rows = append(t.Rows, UnwindRow{PC: r.PC, CFA: unwindRuleNames[r.CFA], CFAOffset: r.CFAOffset, RAOffset: r.RAOffset, FPOffset: r.FPOffset})
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return enc.Encode(t)
+	}
+
+	bw := bufio.NewWriter(w)
+	var hdr [40]byte
+	copy(hdr[:], unwindMagic)
+	le := binary.LittleEndian
+	le.PutUint32(hdr[8:], unwindVersion)
+	le.PutUint32(hdr[12:], uint32(f.Cpu))
+	if u := f.UUID(); u != nil {
+		copy(hdr[16:32], u.Id[:])
+	}
+	le.PutUint32(hdr[32:], uint32(len(rows)))
+	bw.Write(hdr[:])
+	for _, r := range rows {
+		var b [24]byte
+		le.PutUint64(b[0:], r.PC)
+		b[8] = byte(r.CFA)
+		for i, v := range []int64{r.CFAOffset, r.RAOffset, r.FPOffset} {
+			if int64(int32(v)) != v {
+				return fmt.Errorf("unwind offset %d at %#x does not fit the binary form", v, r.PC)
+			}
+			le.PutUint32(b[12+4*i:], uint32(int32(v)))
+		}
+		bw.Write(b[:])
+	}
+	return bw.Flush()
+}